@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/tracefile"
+	"github.com/spf13/cobra"
+)
+
+var analyzeCmd = &cobra.Command{
+	Use:   "analyze [flags] trace.jsonl",
+	Short: "Print the call tree recorded in a trace file",
+	Long: `Analyze a FlowTrace JSONL trace and print its call tree.
+
+ENTER, EXIT and EXCEPTION events are matched per goroutine and printed as an
+indented tree with the duration of every call. Calls whose ENTER or EXIT is
+missing (for example after a crash) are flagged as unbalanced.
+
+Examples:
+  # Print the full call tree
+  flowctl analyze flowtrace.jsonl
+
+  # Only show goroutine 7
+  flowctl analyze --goroutine 7 flowtrace.jsonl
+
+  # Hide calls faster than 5ms
+  flowctl analyze --min-duration 5ms flowtrace.jsonl`,
+	Args: cobra.ExactArgs(1),
+	RunE: runAnalyze,
+}
+
+var (
+	analyzeGoroutine   string
+	analyzeMinDuration time.Duration
+)
+
+func init() {
+	analyzeCmd.Flags().StringVarP(&analyzeGoroutine, "goroutine", "g", "", "only show calls of this goroutine (e.g. 7 or goroutine-7)")
+	analyzeCmd.Flags().DurationVar(&analyzeMinDuration, "min-duration", 0, "hide calls faster than this duration")
+}
+
+func runAnalyze(cmd *cobra.Command, args []string) error {
+	events, err := tracefile.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to read trace: %w", err)
+	}
+
+	tree := tracefile.BuildTree(events)
+	return printCallTree(os.Stdout, tree, analyzeGoroutine, analyzeMinDuration)
+}
+
+// printCallTree writes the call tree of each goroutine, optionally limited to
+// a single goroutine and pruned of calls faster than minDuration
+func printCallTree(w io.Writer, tree *tracefile.Tree, goroutine string, minDuration time.Duration) error {
+	if goroutine != "" && !strings.HasPrefix(goroutine, "goroutine-") {
+		goroutine = "goroutine-" + goroutine
+	}
+
+	calls, unbalanced, printed := 0, 0, 0
+	for _, thread := range tree.Threads {
+		if goroutine != "" && thread != goroutine {
+			continue
+		}
+
+		var lines []string
+		for _, root := range tree.Roots[thread] {
+			root.Walk(func(call *tracefile.Call, depth int) {
+				calls++
+				if call.Unbalanced() {
+					unbalanced++
+				}
+			})
+			lines = append(lines, renderCall(root, 1, minDuration)...)
+		}
+
+		if len(lines) == 0 {
+			continue
+		}
+		if printed > 0 {
+			fmt.Fprintln(w)
+		}
+		printed++
+		fmt.Fprintln(w, thread)
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	}
+
+	if goroutine != "" && calls == 0 {
+		return fmt.Errorf("no calls found for %s", goroutine)
+	}
+
+	fmt.Fprintf(w, "\n%d calls, %d unbalanced\n", calls, unbalanced)
+	return nil
+}
+
+// renderCall returns the indented lines for call and its children. A call
+// faster than minDuration is hidden unless it is unbalanced or has a child
+// that is shown.
+func renderCall(call *tracefile.Call, depth int, minDuration time.Duration) []string {
+	var children []string
+	for _, child := range call.Children {
+		children = append(children, renderCall(child, depth+1, minDuration)...)
+	}
+
+	if len(children) == 0 && !call.Unbalanced() && call.Duration < minDuration {
+		return nil
+	}
+
+	line := strings.Repeat("  ", depth) + describeCall(call)
+	return append([]string{line}, children...)
+}
+
+// describeCall renders one tree line, e.g. "main.LoadUser (52ms)"
+func describeCall(call *tracefile.Call) string {
+	var b strings.Builder
+	b.WriteString(call.Name())
+
+	if call.MissingExit {
+		b.WriteString(" (?)")
+	} else {
+		fmt.Fprintf(&b, " (%s)", formatDuration(call.Duration))
+	}
+
+	if call.Exception != "" {
+		fmt.Fprintf(&b, " [exception: %s]", call.Exception)
+	}
+	if call.Error != "" {
+		fmt.Fprintf(&b, " [error: %s]", call.Error)
+	}
+	switch {
+	case call.MissingExit:
+		b.WriteString(" [unbalanced: missing EXIT]")
+	case call.MissingEnter:
+		b.WriteString(" [unbalanced: missing ENTER]")
+	}
+	return b.String()
+}
+
+// formatDuration rounds d to a readable precision: whole milliseconds from
+// 1ms up and microseconds below that
+func formatDuration(d time.Duration) string {
+	if d >= time.Millisecond {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Microsecond).String()
+}
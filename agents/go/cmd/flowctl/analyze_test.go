@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rixmerz/flowtrace-agent-go/flowtrace"
+	"github.com/rixmerz/flowtrace-agent-go/internal/tracefile"
+)
+
+func loadFixtureTree(t *testing.T) *tracefile.Tree {
+	t.Helper()
+
+	events, err := tracefile.ReadFile("testdata/trace.jsonl")
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+	return tracefile.BuildTree(events)
+}
+
+func TestPrintCallTree(t *testing.T) {
+	var out bytes.Buffer
+	if err := printCallTree(&out, loadFixtureTree(t), "", 0); err != nil {
+		t.Fatalf("printCallTree failed: %v", err)
+	}
+
+	expected := `goroutine-1
+  main.main (?) [unbalanced: missing EXIT]
+    main.LoadUser (52ms)
+      cache.Get (200µs)
+      db.Query (40ms)
+
+goroutine-7
+  worker.Process (3ms) [exception: panic: nil map]
+
+goroutine-8
+  worker.Flush (1ms)
+    io.Write (?) [unbalanced: missing EXIT]
+  net.Dial (500µs) [unbalanced: missing ENTER]
+
+8 calls, 3 unbalanced
+`
+	if out.String() != expected {
+		t.Errorf("Expected output:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestPrintCallTreeFilters(t *testing.T) {
+	tests := []struct {
+		name        string
+		goroutine   string
+		minDuration time.Duration
+		contains    []string
+		excludes    []string
+	}{
+		{
+			name:      "goroutine number",
+			goroutine: "7",
+			contains:  []string{"goroutine-7", "worker.Process (3ms)", "1 calls, 0 unbalanced"},
+			excludes:  []string{"goroutine-1", "goroutine-8"},
+		},
+		{
+			name:      "goroutine name",
+			goroutine: "goroutine-8",
+			contains:  []string{"worker.Flush", "net.Dial"},
+			excludes:  []string{"main.LoadUser"},
+		},
+		{
+			name:        "min duration prunes fast calls",
+			minDuration: 10 * time.Millisecond,
+			contains:    []string{"main.LoadUser (52ms)", "db.Query (40ms)"},
+			excludes:    []string{"cache.Get", "worker.Process", "goroutine-7"},
+		},
+		{
+			name:        "min duration keeps unbalanced calls",
+			minDuration: 10 * time.Millisecond,
+			contains:    []string{"worker.Flush (1ms)", "io.Write (?)", "net.Dial (500µs)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := printCallTree(&out, loadFixtureTree(t), tt.goroutine, tt.minDuration); err != nil {
+				t.Fatalf("printCallTree failed: %v", err)
+			}
+			for _, want := range tt.contains {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("Expected output to contain %q\n%s", want, out.String())
+				}
+			}
+			for _, unwanted := range tt.excludes {
+				if strings.Contains(out.String(), unwanted) {
+					t.Errorf("Expected output not to contain %q\n%s", unwanted, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestPrintCallTreeUnknownGoroutine(t *testing.T) {
+	var out bytes.Buffer
+	if err := printCallTree(&out, loadFixtureTree(t), "99", 0); err == nil {
+		t.Error("Expected error for unknown goroutine")
+	}
+}
+
+func TestAnalyzeRejectsNewerSchemaVersion(t *testing.T) {
+	if tracefile.SchemaVersion != flowtrace.SchemaVersion {
+		t.Fatalf("tracefile reads schema version %d, the agent writes %d", tracefile.SchemaVersion, flowtrace.SchemaVersion)
+	}
+
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	trace := `{"event":"ENTER","timestamp":100,"class":"main","method":"Run","thread":"goroutine-1","schemaVersion":99}` + "\n"
+	if err := os.WriteFile(path, []byte(trace), 0644); err != nil {
+		t.Fatalf("Failed to write trace: %v", err)
+	}
+
+	err := runAnalyze(analyzeCmd, []string{path})
+	if err == nil || !strings.Contains(err.Error(), "line 1: unsupported schema version 99") {
+		t.Errorf("Expected the newer schema version to be rejected, got %v", err)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -16,8 +15,9 @@ var buildCmd = &cobra.Command{
 	Short: "Build Go packages with automatic instrumentation",
 	Long: `Build Go packages with automatic FlowTrace instrumentation.
 
-This command instruments the code, then runs 'go build' on the instrumented version.
-The original source code is not modified.
+This command instruments a copy of the module, including its go.mod and
+go.sum, then runs 'go build' on the copy. Binaries are written to the current
+directory unless -o is given. The original source code is not modified.
 
 Examples:
   # Build current package
@@ -57,7 +57,7 @@ func runBuild(cmd *cobra.Command, args []string) error {
 	}
 
 	// Create temporary directory for instrumented code
-	tempDir, err := ioutil.TempDir("", "flowtrace-build-*")
+	tempDir, err := os.MkdirTemp("", "flowtrace-build-*")
 	if err != nil {
 		return fmt.Errorf("failed to create temp directory: %w", err)
 	}
@@ -67,32 +67,14 @@ func runBuild(cmd *cobra.Command, args []string) error {
 		fmt.Printf("📁 Temp directory: %s\n", tempDir)
 	}
 
-	// Instrument code to temp directory
+	// Instrument a copy of the module
 	if verbose {
 		fmt.Println("⚙️  Instrumenting code...")
 	}
 
-	instrumentArgs := []string{
-		"instrument",
-		"--output", tempDir,
-	}
-
-	// Add exclude patterns
-	instrumentArgs = append(instrumentArgs,
-		"--exclude", "**/*_test.go",
-		"--exclude", "**/vendor/**",
-	)
-
-	// Add packages
-	instrumentArgs = append(instrumentArgs, args...)
-
-	// Run instrument command
-	instrumentCmd := exec.Command("flowctl", instrumentArgs...)
-	instrumentCmd.Stdout = os.Stdout
-	instrumentCmd.Stderr = os.Stderr
-
-	if err := instrumentCmd.Run(); err != nil {
-		return fmt.Errorf("instrumentation failed: %w", err)
+	module, err := instrumentModule(".", tempDir, false, os.Stdout)
+	if err != nil {
+		return err
 	}
 
 	// Build instrumented code
@@ -100,34 +82,40 @@ func runBuild(cmd *cobra.Command, args []string) error {
 		fmt.Println("🔨 Building instrumented code...")
 	}
 
-	buildArgs := []string{"build"}
-
-	// Add output flag
-	if buildOutput != "" {
-		buildArgs = append(buildArgs, "-o", buildOutput)
+	// go build runs in the copy, so the output is made absolute; binaries go
+	// to the current directory by default
+	output := buildOutput
+	if output == "" {
+		output = "."
+	}
+	output, err = filepath.Abs(output)
+	if err != nil {
+		return err
+	}
+	if buildOutput == "" {
+		output += string(filepath.Separator)
 	}
+	buildArgs := []string{"build", "-o", output}
 
 	// Add tags
 	if len(buildTags) > 0 {
 		buildArgs = append(buildArgs, "-tags", strings.Join(buildTags, ","))
 	}
 
-	// Calculate package paths in temp directory
+	// Calculate package paths in the copy
 	for _, arg := range args {
-		if arg == "." {
-			buildArgs = append(buildArgs, tempDir)
-		} else {
-			// Convert relative path to temp directory path
-			relPath := strings.TrimPrefix(arg, "./")
-			buildArgs = append(buildArgs, filepath.Join(tempDir, relPath))
+		pkgArg, err := module.packageArg(arg)
+		if err != nil {
+			return err
 		}
+		buildArgs = append(buildArgs, pkgArg)
 	}
 
 	// Run go build
 	goBuild := exec.Command("go", buildArgs...)
 	goBuild.Stdout = os.Stdout
 	goBuild.Stderr = os.Stderr
-	goBuild.Dir = tempDir
+	goBuild.Dir = module.dir
 
 	if err := goBuild.Run(); err != nil {
 		return fmt.Errorf("build failed: %w", err)
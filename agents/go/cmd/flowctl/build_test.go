@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
+)
+
+func TestBuildModule(t *testing.T) {
+	writeHelloModule(t)
+
+	if err := runBuild(buildCmd, []string{"./cmd/hello"}); err != nil {
+		t.Fatalf("runBuild failed: %v", err)
+	}
+
+	// The binary is written to the current directory and instrumented
+	if err := exec.Command("./hello", "you").Run(); err != nil {
+		t.Fatalf("Failed to run the built binary: %v", err)
+	}
+	out, err := os.ReadFile("out.txt")
+	if err != nil || string(out) != "hello you\n" {
+		t.Errorf("Expected the binary to write a greeting, got %q (%v)", out, err)
+	}
+
+	data, err := os.ReadFile("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "flowtrace-agent-go/flowtrace") {
+		t.Error("Expected the binary to contain the flowtrace runtime")
+	}
+	if source, _ := os.ReadFile(filepath.Join("greet", "greet.go")); strings.Contains(string(source), "flowtrace") {
+		t.Error("Expected the source to be left alone")
+	}
+}
+
+func TestBuildRequiresFlowtrace(t *testing.T) {
+	module := t.TempDir()
+	files := map[string]string{
+		"go.mod":  "module example.com/plain\n\ngo 1.24\n",
+		"main.go": "package main\n\nfunc main() {}\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(module, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(module)
+
+	err := runBuild(buildCmd, nil)
+	if err == nil || !strings.Contains(err.Error(), "go get "+flowtraceModulePath) {
+		t.Errorf("Expected an error asking to require the flowtrace module, got %v", err)
+	}
+}
+
+func TestRequireFlowtraceAddsChecksums(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go get")
+	}
+
+	// A module proxy serving a release of the flowtrace module
+	const version = "v1.2.3"
+	proxy := t.TempDir()
+	versions := filepath.Join(proxy, flowtraceModulePath, "@v")
+	if err := os.MkdirAll(versions, 0755); err != nil {
+		t.Fatal(err)
+	}
+	goMod := "module " + flowtraceModulePath + "\n\ngo 1.21\n"
+	files := map[string]string{
+		"list":            version + "\n",
+		version + ".info": `{"Version":"` + version + `"}`,
+		version + ".mod":  goMod,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(versions, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	release := t.TempDir()
+	releaseFiles := map[string]string{
+		"go.mod":                 goMod,
+		"flowtrace/flowtrace.go": "package flowtrace\n\nfunc Start() {}\n",
+	}
+	for name, content := range releaseFiles {
+		path := filepath.Join(release, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var zipped bytes.Buffer
+	if err := modzip.CreateFromDir(&zipped, module.Version{Path: flowtraceModulePath, Version: version}, release); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(versions, version+".zip"), zipped.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := t.TempDir()
+	t.Setenv("GOPROXY", "file://"+filepath.ToSlash(proxy))
+	t.Setenv("GOSUMDB", "off")
+	t.Setenv("GOFLAGS", "-modcacherw")
+	t.Setenv("GOMODCACHE", cache)
+
+	dir := t.TempDir()
+	sources := map[string]string{
+		"go.mod":  "module example.com/plain\n\ngo 1.24\n",
+		"main.go": "package main\n\nimport \"" + flowtraceModulePath + "/flowtrace\"\n\nfunc main() { flowtrace.Start() }\n",
+	}
+	for name, content := range sources {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := requireFlowtrace(dir, version); err != nil {
+		t.Fatalf("requireFlowtrace failed: %v", err)
+	}
+	sum, err := os.ReadFile(filepath.Join(dir, "go.sum"))
+	if err != nil {
+		t.Fatalf("Expected a go.sum to be written: %v", err)
+	}
+	for _, want := range []string{flowtraceModulePath + " " + version + " h1:", flowtraceModulePath + " " + version + "/go.mod h1:"} {
+		if !strings.Contains(string(sum), want) {
+			t.Errorf("Expected go.sum to contain %q, got:\n%s", want, sum)
+		}
+	}
+
+	// The build needs nothing more than what was recorded
+	goBuild := exec.Command("go", "build", "-mod=readonly", "-o", os.DevNull, ".")
+	goBuild.Dir = dir
+	if out, err := goBuild.CombinedOutput(); err != nil {
+		t.Errorf("Expected the module to build: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/tracefile"
+	"github.com/spf13/cobra"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff [flags] before.jsonl after.jsonl",
+	Short: "Compare per-function call counts and latencies of two trace files",
+	Long: `Compare two FlowTrace JSONL traces, e.g. recorded before and after a deploy.
+
+For every function the call counts and the p50/p95 latencies of both runs are
+printed with their change, sorted by the largest latency regression first.
+Functions whose p50 or p95 grew by more than --threshold percent are flagged
+as regressions. Functions recorded in only one of the runs are listed last
+as new or removed.
+
+Examples:
+  # Compare two runs
+  flowctl diff before.jsonl after.jsonl
+
+  # Only flag latencies that more than doubled
+  flowctl diff --threshold 100 before.jsonl after.jsonl`,
+	Args: cobra.ExactArgs(2),
+	RunE: runDiff,
+}
+
+var diffThreshold float64
+
+func init() {
+	diffCmd.Flags().Float64Var(&diffThreshold, "threshold", 10, "flag p50/p95 increases above this percentage as regressions")
+}
+
+// functionDiff pairs the statistics of one function in both runs; Before
+// or After is nil when the function only ran in the other
+type functionDiff struct {
+	Name   string
+	Before *functionStats
+	After  *functionStats
+}
+
+func runDiff(cmd *cobra.Command, args []string) error {
+	before, err := tracefile.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", args[0], err)
+	}
+	after, err := tracefile.ReadFile(args[1])
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", args[1], err)
+	}
+
+	return writeDiffTable(os.Stdout, computeDiff(computeStats(before), computeStats(after)), diffThreshold)
+}
+
+// computeDiff pairs the functions of two runs. Functions found in both are
+// sorted by latency regression, largest first; new and then removed
+// functions follow, each by name.
+func computeDiff(before, after []functionStats) []functionDiff {
+	byName := make(map[string]*functionDiff)
+	var diffs []*functionDiff
+	get := func(name string) *functionDiff {
+		d, ok := byName[name]
+		if !ok {
+			d = &functionDiff{Name: name}
+			byName[name] = d
+			diffs = append(diffs, d)
+		}
+		return d
+	}
+	for i := range before {
+		get(before[i].Name).Before = &before[i]
+	}
+	for i := range after {
+		get(after[i].Name).After = &after[i]
+	}
+
+	// Rank: 0 for functions in both runs, 1 for new and 2 for removed ones
+	rank := func(d *functionDiff) int {
+		switch {
+		case d.Before == nil:
+			return 1
+		case d.After == nil:
+			return 2
+		}
+		return 0
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		ri, rj := rank(diffs[i]), rank(diffs[j])
+		if ri != rj {
+			return ri < rj
+		}
+		if ri == 0 {
+			if gi, gj := diffs[i].regression(), diffs[j].regression(); gi != gj {
+				return gi > gj
+			}
+		}
+		return diffs[i].Name < diffs[j].Name
+	})
+
+	result := make([]functionDiff, len(diffs))
+	for i, d := range diffs {
+		result[i] = *d
+	}
+	return result
+}
+
+// regression returns the larger of the p50 and p95 changes in percent
+func (d *functionDiff) regression() float64 {
+	return math.Max(percentChange(d.Before.P50, d.After.P50), percentChange(d.Before.P95, d.After.P95))
+}
+
+// percentChange returns the change from before to after in percent
+func percentChange(before, after int64) float64 {
+	if before == 0 {
+		if after == 0 {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	return float64(after-before) / float64(before) * 100
+}
+
+// writeDiffTable prints the diffs as an aligned table, flagging latency
+// increases above threshold percent
+func writeDiffTable(w io.Writer, diffs []functionDiff, threshold float64) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FUNCTION\tCALLS\tP50\tΔP50\tP95\tΔP95\t")
+	for _, d := range diffs {
+		switch {
+		case d.Before == nil:
+			fmt.Fprintf(tw, "%s\t- -> %d\t- -> %s\t\t- -> %s\t\tnew\n",
+				d.Name, d.After.Calls, formatMicros(float64(d.After.P50)), formatMicros(float64(d.After.P95)))
+		case d.After == nil:
+			fmt.Fprintf(tw, "%s\t%d -> -\t%s -> -\t\t%s -> -\t\tremoved\n",
+				d.Name, d.Before.Calls, formatMicros(float64(d.Before.P50)), formatMicros(float64(d.Before.P95)))
+		default:
+			flag := ""
+			if d.regression() > threshold {
+				flag = "REGRESSION"
+			}
+			fmt.Fprintf(tw, "%s\t%d -> %d\t%s -> %s\t%s\t%s -> %s\t%s\t%s\n",
+				d.Name, d.Before.Calls, d.After.Calls,
+				formatMicros(float64(d.Before.P50)), formatMicros(float64(d.After.P50)), formatPercent(percentChange(d.Before.P50, d.After.P50)),
+				formatMicros(float64(d.Before.P95)), formatMicros(float64(d.After.P95)), formatPercent(percentChange(d.Before.P95, d.After.P95)),
+				flag)
+		}
+	}
+	return tw.Flush()
+}
+
+// formatPercent renders a signed percentage, e.g. "+12.5%"
+func formatPercent(p float64) string {
+	if math.IsInf(p, 1) {
+		return "+inf"
+	}
+	return fmt.Sprintf("%+.1f%%", p)
+}
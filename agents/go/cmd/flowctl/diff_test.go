@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/tracefile"
+)
+
+// loadDiffFixtures diffs the two fixture runs: db.Query regressed from
+// 10ms..19ms to 30ms..39ms, cache.Get slowed down by 5%, legacy.Old was
+// removed and api.New added
+func loadDiffFixtures(t *testing.T) []functionDiff {
+	t.Helper()
+
+	var stats [2][]functionStats
+	for i, path := range []string{"testdata/diff_before.jsonl", "testdata/diff_after.jsonl"} {
+		events, err := tracefile.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read fixture: %v", err)
+		}
+		stats[i] = computeStats(events)
+	}
+	return computeDiff(stats[0], stats[1])
+}
+
+func TestComputeDiff(t *testing.T) {
+	diffs := loadDiffFixtures(t)
+
+	var names []string
+	for _, d := range diffs {
+		names = append(names, d.Name)
+	}
+	if got := strings.Join(names, " "); got != "db.Query cache.Get api.New legacy.Old" {
+		t.Fatalf("Expected regressions first and new/removed functions last, got %s", got)
+	}
+
+	query := diffs[0]
+	if query.Before.P50 != 14000 || query.After.P50 != 34000 || query.Before.P95 != 19000 || query.After.P95 != 39000 {
+		t.Errorf("Unexpected db.Query percentiles: before %+v, after %+v", *query.Before, *query.After)
+	}
+	if got := query.regression(); got < 142.8 || got > 142.9 {
+		t.Errorf("Expected db.Query to regress by 142.9%%, got %.2f", got)
+	}
+	if diffs[2].Before != nil || diffs[3].After != nil {
+		t.Errorf("Expected api.New only after and legacy.Old only before, got %+v and %+v", diffs[2], diffs[3])
+	}
+}
+
+func TestWriteDiffTable(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeDiffTable(&out, loadDiffFixtures(t), 10); err != nil {
+		t.Fatalf("writeDiffTable failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("Expected a header and 4 rows, got:\n%s", out.String())
+	}
+
+	expected := []string{
+		"db.Query 10 -> 10 14ms -> 34ms +142.9% 19ms -> 39ms +105.3% REGRESSION",
+		"cache.Get 10 -> 12 100µs -> 105µs +5.0% 100µs -> 105µs +5.0%",
+		"api.New - -> 1 - -> 2ms - -> 2ms new",
+		"legacy.Old 2 -> - 500µs -> - 500µs -> - removed",
+	}
+	for i, want := range expected {
+		if got := strings.Join(strings.Fields(lines[i+1]), " "); got != want {
+			t.Errorf("Row %d:\nexpected %q\ngot      %q", i, want, got)
+		}
+	}
+}
+
+func TestWriteDiffTableThreshold(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeDiffTable(&out, loadDiffFixtures(t), 200); err != nil {
+		t.Fatalf("writeDiffTable failed: %v", err)
+	}
+	if strings.Contains(out.String(), "REGRESSION") {
+		t.Errorf("Expected no regression above 200%%, got:\n%s", out.String())
+	}
+}
+
+func TestPercentChange(t *testing.T) {
+	tests := []struct {
+		before, after int64
+		expected      string
+	}{
+		{100, 150, "+50.0%"},
+		{200, 100, "-50.0%"},
+		{0, 0, "+0.0%"},
+		{0, 10, "+inf"},
+	}
+	for _, tt := range tests {
+		if got := formatPercent(percentChange(tt.before, tt.after)); got != tt.expected {
+			t.Errorf("percentChange(%d, %d) = %s, expected %s", tt.before, tt.after, got, tt.expected)
+		}
+	}
+}
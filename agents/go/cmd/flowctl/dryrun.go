@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/rixmerz/flowtrace-agent-go/internal/ast"
+	"github.com/rixmerz/flowtrace-agent-go/internal/loader"
+)
+
+// dryRunSummary counts what `flowctl instrument --dry-run` found
+type dryRunSummary struct {
+	Files            int // files that would be changed
+	Functions        int // functions that would be instrumented
+	Unchanged        int // files with no function to instrument
+	Failed           int // files that failed to transform
+	Filtered         int // files skipped by --include/--exclude or --tests
+	Generated        int // generated files skipped
+	ExcludedPackages int // packages skipped by --include/--exclude
+}
+
+// dryRunFiles transforms files like instrumentFiles, but writes nothing:
+// the files and functions that would be instrumented are listed on out,
+// followed by a unified diff of every changed file when diff is set. The
+// skip counts already in summary are reported along with those found here.
+// With a report, the transformation of every file is added to it.
+func dryRunFiles(files []string, fileDirs map[string]string, config *ast.Config, summary *dryRunSummary, report *instrumentationReport, diff bool, out io.Writer) error {
+	sorted := append([]string(nil), files...)
+	sort.Strings(sorted)
+
+	bt := ast.NewBatchTransformer(config)
+	bt.SetPackagePaths(fileDirs)
+	progress, results, errs := bt.TransformBatch(sorted)
+	for range progress {
+		// Only the results are reported
+	}
+
+	byFile := make(map[string]*ast.TransformResult, len(sorted))
+	for result := range results {
+		byFile[result.Filename] = result
+	}
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "🔍 Dry run: no files are written")
+	var diffs []string
+	for _, file := range sorted {
+		result := byFile[file]
+		if report != nil {
+			addToReport(report, fileDirs, result)
+		}
+		if result.Error != nil {
+			fmt.Fprintf(os.Stderr, "   ⚠️  Failed to transform %s: %v\n", file, result.Error)
+			summary.Failed++
+			continue
+		}
+		if len(result.Instrumented) == 0 {
+			summary.Unchanged++
+			continue
+		}
+
+		summary.Files++
+		summary.Functions += len(result.Instrumented)
+		name := displayPath(file)
+		fmt.Fprintf(out, "   📝 %s (%d): %s\n", name, len(result.Instrumented), strings.Join(result.Instrumented, ", "))
+
+		if diff {
+			text, err := unifiedDiff(file, name, result)
+			if err != nil {
+				return fmt.Errorf("failed to diff %s: %w", file, err)
+			}
+			diffs = append(diffs, text)
+		}
+	}
+
+	fmt.Fprintf(out, "\n📊 %d function(s) in %d file(s) would be instrumented\n", summary.Functions, summary.Files)
+	fmt.Fprintf(out, "   %d file(s) without functions to instrument\n", summary.Unchanged)
+	fmt.Fprintf(out, "   %d file(s) skipped by filters\n", summary.Filtered)
+	fmt.Fprintf(out, "   %d generated file(s) skipped\n", summary.Generated)
+	fmt.Fprintf(out, "   %d package(s) excluded\n", summary.ExcludedPackages)
+	if summary.Failed > 0 {
+		fmt.Fprintf(out, "   %d file(s) failed to transform\n", summary.Failed)
+	}
+
+	for _, text := range diffs {
+		fmt.Fprint(out, "\n"+text)
+	}
+	return nil
+}
+
+// unifiedDiff returns the changes instrumenting a file would make to it,
+// as a unified diff between its source and the transformed result, with the
+// file labeled name
+func unifiedDiff(file, name string, result *ast.TransformResult) (string, error) {
+	before, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	after, err := loader.FormatFile(result.FileSet, result.File)
+	if err != nil {
+		return "", err
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(before)),
+		B:        difflib.SplitLines(string(after)),
+		FromFile: "a/" + name,
+		ToFile:   "b/" + name,
+		Context:  3,
+	})
+}
+
+// displayPath returns path relative to the current directory when it is
+// inside it, for shorter listings and diffs that apply with patch -p1
+func displayPath(path string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/tracefile"
+	"github.com/spf13/cobra"
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export [flags] trace.jsonl",
+	Short: "Convert a trace file for use in other tools",
+	Long: `Export a FlowTrace JSONL trace to a format understood by other tools.
+
+Formats:
+  chrome-trace  Chrome Trace Event JSON for chrome://tracing and Perfetto
+  folded        Folded stacks for flamegraph.pl and speedscope
+  mermaid       Mermaid call graph for Markdown documents
+  dot           Graphviz DOT call graph
+
+Examples:
+  # Open the result in chrome://tracing or https://ui.perfetto.dev
+  flowctl export --format chrome-trace -o trace.json flowtrace.jsonl
+
+  # Render a flame graph of self time
+  flowctl export --format folded --self flowtrace.jsonl | flamegraph.pl > flame.svg
+
+  # Render the package-level call graph as a PNG
+  flowctl export --format dot --group-by-package flowtrace.jsonl | dot -Tpng > calls.png`,
+	Args: cobra.ExactArgs(1),
+	RunE: runExport,
+}
+
+var (
+	exportFormat string
+	exportOutput string
+	exportSelf   bool
+	exportGroup  bool
+)
+
+func init() {
+	exportCmd.Flags().StringVarP(&exportFormat, "format", "f", "chrome-trace", "output format (chrome-trace, folded, mermaid, dot)")
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "output file (default: stdout)")
+	exportCmd.Flags().BoolVar(&exportSelf, "self", false, "use self time instead of total time (folded)")
+	exportCmd.Flags().BoolVar(&exportGroup, "group-by-package", false, "collapse functions into their packages (mermaid, dot)")
+}
+
+func runExport(cmd *cobra.Command, args []string) error {
+	write, ok := exportFormats()[exportFormat]
+	if !ok {
+		return fmt.Errorf("unknown export format: %s", exportFormat)
+	}
+
+	events, err := tracefile.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to read trace: %w", err)
+	}
+	tree := tracefile.BuildTree(events)
+
+	var w io.Writer = os.Stdout
+	if exportOutput != "" {
+		f, err := os.Create(exportOutput)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := write(w, tree); err != nil {
+		return fmt.Errorf("failed to export trace: %w", err)
+	}
+	return nil
+}
+
+// exportFormats maps format names to their writers
+func exportFormats() map[string]func(io.Writer, *tracefile.Tree) error {
+	return map[string]func(io.Writer, *tracefile.Tree) error{
+		"chrome-trace": writeChromeTrace,
+		"folded": func(w io.Writer, tree *tracefile.Tree) error {
+			return writeFolded(w, tree, exportSelf)
+		},
+		"mermaid": func(w io.Writer, tree *tracefile.Tree) error {
+			return writeMermaid(w, tree, exportGroup)
+		},
+		"dot": func(w io.Writer, tree *tracefile.Tree) error {
+			return writeDot(w, tree, exportGroup)
+		},
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/tracefile"
+)
+
+// chromeEvent is a single entry of the Chrome Trace Event format
+type chromeEvent struct {
+	Name string                 `json:"name"`
+	Cat  string                 `json:"cat,omitempty"`
+	Ph   string                 `json:"ph"`
+	Ts   int64                  `json:"ts"`
+	Dur  *int64                 `json:"dur,omitempty"`
+	Pid  int                    `json:"pid"`
+	Tid  int64                  `json:"tid"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+// writeChromeTrace writes the tree as a Chrome Trace Event JSON array. Each
+// completed call becomes an "X" event and calls that never exited become an
+// unterminated "B" event; nesting follows from the timestamps.
+func writeChromeTrace(w io.Writer, tree *tracefile.Tree) error {
+	events := []chromeEvent{}
+
+	for i, thread := range tree.Threads {
+		tid := goroutineNumber(thread, i)
+		events = append(events, chromeEvent{
+			Name: "thread_name",
+			Ph:   "M",
+			Pid:  1,
+			Tid:  tid,
+			Args: map[string]interface{}{"name": thread},
+		})
+
+		for _, root := range tree.Roots[thread] {
+			root.Walk(func(call *tracefile.Call, depth int) {
+				event := chromeEvent{
+					Name: call.Name(),
+					Cat:  call.Class,
+					Ph:   "X",
+					Ts:   call.Start,
+					Pid:  1,
+					Tid:  tid,
+					Args: chromeArgs(call),
+				}
+				if call.MissingExit {
+					event.Ph = "B"
+				} else {
+					dur := call.Duration.Microseconds()
+					event.Dur = &dur
+				}
+				events = append(events, event)
+			})
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(events)
+}
+
+// chromeArgs builds the args object shown for a call. Structured arguments
+// are embedded as is, string forms are kept under "args".
+func chromeArgs(call *tracefile.Call) map[string]interface{} {
+	args := make(map[string]interface{})
+	if call.Args != "" {
+		var structured map[string]interface{}
+		if err := json.Unmarshal([]byte(call.Args), &structured); err == nil {
+			for k, v := range structured {
+				args[k] = v
+			}
+		} else {
+			args["args"] = call.Args
+		}
+	}
+	if call.Result != "" {
+		var structured interface{}
+		if err := json.Unmarshal([]byte(call.Result), &structured); err == nil {
+			args["result"] = structured
+		} else {
+			args["result"] = call.Result
+		}
+	}
+	if call.Exception != "" {
+		args["exception"] = call.Exception
+	}
+	if call.Error != "" {
+		args["error"] = call.Error
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// goroutineNumber extracts 7 from "goroutine-7", falling back to fallback
+// for thread names without a number
+func goroutineNumber(thread string, fallback int) int64 {
+	if n, err := strconv.ParseInt(strings.TrimPrefix(thread, "goroutine-"), 10, 64); err == nil {
+		return n
+	}
+	return int64(fallback)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/tracefile"
+)
+
+// writeFolded writes the tree as Brendan Gregg folded stacks, one line per
+// distinct call stack with its total (or, with self, exclusive) time in
+// microseconds. Identical stacks are summed and zero-valued stacks dropped.
+func writeFolded(w io.Writer, tree *tracefile.Tree, self bool) error {
+	totals := make(map[string]int64)
+
+	var visit func(call *tracefile.Call, stack []string)
+	visit = func(call *tracefile.Call, stack []string) {
+		stack = append(stack, call.Name())
+
+		value := call.Duration
+		if self {
+			value = selfTime(call)
+		}
+		if micros := value.Microseconds(); micros > 0 {
+			totals[strings.Join(stack, ";")] += micros
+		}
+
+		for _, child := range call.Children {
+			visit(child, stack)
+		}
+	}
+
+	for _, thread := range tree.Threads {
+		for _, root := range tree.Roots[thread] {
+			visit(root, nil)
+		}
+	}
+
+	stacks := make([]string, 0, len(totals))
+	for stack := range totals {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+
+	for _, stack := range stacks {
+		if _, err := fmt.Fprintf(w, "%s %d\n", stack, totals[stack]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selfTime returns the time spent in call itself, excluding its children
+func selfTime(call *tracefile.Call) time.Duration {
+	self := call.Duration
+	for _, child := range call.Children {
+		self -= child.Duration
+	}
+	if self < 0 {
+		return 0
+	}
+	return self
+}
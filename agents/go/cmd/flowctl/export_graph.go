@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/tracefile"
+)
+
+// callGraph is a trace aggregated into caller -> callee edges. Nodes and
+// edges are kept in order of first appearance so output is stable.
+type callGraph struct {
+	nodes []string
+	edges []*graphEdge
+}
+
+// graphEdge aggregates every call from one node to another
+type graphEdge struct {
+	from, to string
+	calls    int
+	total    time.Duration
+}
+
+// buildCallGraph aggregates the calls of tree into a call graph. A call's
+// caller is the call owning its parent span, which may run on another
+// goroutine; calls recorded without span IDs fall back to their parent in
+// the tree. With byPackage, nodes are packages and calls within a package
+// are dropped.
+func buildCallGraph(tree *tracefile.Tree, byPackage bool) *callGraph {
+	name := func(call *tracefile.Call) string {
+		if byPackage && call.Class != "" {
+			return call.Class
+		}
+		return call.Name()
+	}
+
+	spans := make(map[string]*tracefile.Call)
+	tree.Walk(func(call *tracefile.Call, depth int) {
+		if call.SpanID != "" {
+			spans[call.SpanID] = call
+		}
+	})
+
+	graph := &callGraph{}
+	seenNodes := make(map[string]bool)
+	edges := make(map[[2]string]*graphEdge)
+
+	addNode := func(node string) {
+		if !seenNodes[node] {
+			seenNodes[node] = true
+			graph.nodes = append(graph.nodes, node)
+		}
+	}
+
+	var visit func(call, treeParent *tracefile.Call)
+	visit = func(call, treeParent *tracefile.Call) {
+		addNode(name(call))
+
+		caller := treeParent
+		if call.ParentSpanID != "" {
+			caller = spans[call.ParentSpanID]
+		} else if call.SpanID != "" {
+			// A root span has no caller even if the tree nests it
+			caller = nil
+		}
+
+		if caller != nil && (!byPackage || name(caller) != name(call)) {
+			key := [2]string{name(caller), name(call)}
+			edge, ok := edges[key]
+			if !ok {
+				edge = &graphEdge{from: key[0], to: key[1]}
+				edges[key] = edge
+				graph.edges = append(graph.edges, edge)
+			}
+			edge.calls++
+			edge.total += call.Duration
+		}
+
+		for _, child := range call.Children {
+			visit(child, call)
+		}
+	}
+
+	for _, thread := range tree.Threads {
+		for _, root := range tree.Roots[thread] {
+			visit(root, nil)
+		}
+	}
+	return graph
+}
+
+// label describes an edge, e.g. "3 calls, 52ms"
+func (e *graphEdge) label() string {
+	calls := "calls"
+	if e.calls == 1 {
+		calls = "call"
+	}
+	return fmt.Sprintf("%d %s, %s", e.calls, calls, formatDuration(e.total))
+}
+
+// writeMermaid writes the call graph as a Mermaid flowchart that can be
+// embedded in Markdown
+func writeMermaid(w io.Writer, tree *tracefile.Tree, byPackage bool) error {
+	graph := buildCallGraph(tree, byPackage)
+
+	// Mermaid IDs are restricted, so nodes get generated IDs and a label
+	ids := make(map[string]string)
+	var b strings.Builder
+	b.WriteString("graph LR\n")
+	for i, node := range graph.nodes {
+		ids[node] = "n" + strconv.Itoa(i)
+		fmt.Fprintf(&b, "    %s[\"%s\"]\n", ids[node], mermaidEscape(node))
+	}
+	for _, edge := range graph.edges {
+		fmt.Fprintf(&b, "    %s -->|\"%s\"| %s\n", ids[edge.from], edge.label(), ids[edge.to])
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeDot writes the call graph in Graphviz DOT format
+func writeDot(w io.Writer, tree *tracefile.Tree, byPackage bool) error {
+	graph := buildCallGraph(tree, byPackage)
+
+	var b strings.Builder
+	b.WriteString("digraph calls {\n")
+	b.WriteString("    rankdir=LR;\n")
+	b.WriteString("    node [shape=box];\n")
+	for _, node := range graph.nodes {
+		fmt.Fprintf(&b, "    %s;\n", strconv.Quote(node))
+	}
+	for _, edge := range graph.edges {
+		fmt.Fprintf(&b, "    %s -> %s [label=%s];\n", strconv.Quote(edge.from), strconv.Quote(edge.to), strconv.Quote(edge.label()))
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// mermaidEscape replaces the double quotes Mermaid labels cannot contain
+func mermaidEscape(s string) string {
+	return strings.ReplaceAll(s, `"`, "#quot;")
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/tracefile"
+)
+
+func TestWriteChromeTrace(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeChromeTrace(&out, loadFixtureTree(t)); err != nil {
+		t.Fatalf("writeChromeTrace failed: %v", err)
+	}
+
+	var events []struct {
+		Name string                 `json:"name"`
+		Ph   string                 `json:"ph"`
+		Ts   int64                  `json:"ts"`
+		Dur  *int64                 `json:"dur"`
+		Pid  int                    `json:"pid"`
+		Tid  int64                  `json:"tid"`
+		Args map[string]interface{} `json:"args"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &events); err != nil {
+		t.Fatalf("Output is not a JSON event array: %v\n%s", err, out.String())
+	}
+
+	byName := make(map[string]int)
+	threads := make(map[int64]string)
+	for i, event := range events {
+		switch event.Ph {
+		case "M":
+			threads[event.Tid], _ = event.Args["name"].(string)
+		case "X":
+			if event.Dur == nil {
+				t.Errorf("Expected dur on complete event %s", event.Name)
+			}
+		case "B":
+			if event.Dur != nil {
+				t.Errorf("Expected no dur on begin event %s", event.Name)
+			}
+		default:
+			t.Errorf("Unexpected phase %q on %s", event.Ph, event.Name)
+		}
+		if event.Pid != 1 {
+			t.Errorf("Expected pid 1 on %s, got %d", event.Name, event.Pid)
+		}
+		byName[event.Name] = i
+	}
+
+	if threads[1] != "goroutine-1" || threads[7] != "goroutine-7" || threads[8] != "goroutine-8" {
+		t.Errorf("Expected goroutine IDs as tids, got %v", threads)
+	}
+
+	// Children must lie within their parent's interval to render as a stack
+	parent := events[byName["main.LoadUser"]]
+	for _, name := range []string{"cache.Get", "db.Query"} {
+		child := events[byName[name]]
+		if child.Tid != parent.Tid {
+			t.Errorf("Expected %s on tid %d, got %d", name, parent.Tid, child.Tid)
+		}
+		if child.Ts < parent.Ts || child.Ts+*child.Dur > parent.Ts+*parent.Dur {
+			t.Errorf("Expected %s [%d+%d] inside main.LoadUser [%d+%d]", name, child.Ts, *child.Dur, parent.Ts, *parent.Dur)
+		}
+	}
+
+	if parent.Ts != 1700000000000100 || *parent.Dur != 52000 {
+		t.Errorf("Expected microsecond ts and dur, got ts=%d dur=%d", parent.Ts, *parent.Dur)
+	}
+	if events[byName["main.main"]].Ph != "B" {
+		t.Errorf("Expected unfinished main.main as a begin event")
+	}
+	if exc := events[byName["worker.Process"]].Args["exception"]; exc != "panic: nil map" {
+		t.Errorf("Expected exception in args, got %v", exc)
+	}
+	if args := events[byName["db.Query"]].Args["args"]; args != "map[sql:SELECT * FROM users]" {
+		t.Errorf("Expected args in args object, got %v", args)
+	}
+}
+
+func TestWriteFolded(t *testing.T) {
+	// main.main -> main.LoadUser -> main.internalLoad, with a second
+	// internalLoad call to check that identical stacks are summed
+	tree := tracefile.BuildTree([]tracefile.Event{
+		{Event: "ENTER", Class: "main", Method: "main", Thread: "goroutine-1", Timestamp: 0},
+		{Event: "ENTER", Class: "main", Method: "LoadUser", Thread: "goroutine-1", Timestamp: 100},
+		{Event: "ENTER", Class: "main", Method: "internalLoad", Thread: "goroutine-1", Timestamp: 200},
+		{Event: "EXIT", Class: "main", Method: "internalLoad", Thread: "goroutine-1", Timestamp: 30200, DurationMicros: 30000},
+		{Event: "ENTER", Class: "main", Method: "internalLoad", Thread: "goroutine-1", Timestamp: 30300},
+		{Event: "EXIT", Class: "main", Method: "internalLoad", Thread: "goroutine-1", Timestamp: 40300, DurationMicros: 10000},
+		{Event: "EXIT", Class: "main", Method: "LoadUser", Thread: "goroutine-1", Timestamp: 52100, DurationMicros: 52000},
+		{Event: "EXIT", Class: "main", Method: "main", Thread: "goroutine-1", Timestamp: 60000, DurationMicros: 60000},
+	})
+
+	tests := []struct {
+		name     string
+		self     bool
+		expected string
+	}{
+		{
+			name: "total time",
+			expected: "main.main 60000\n" +
+				"main.main;main.LoadUser 52000\n" +
+				"main.main;main.LoadUser;main.internalLoad 40000\n",
+		},
+		{
+			name: "self time",
+			self: true,
+			expected: "main.main 8000\n" +
+				"main.main;main.LoadUser 12000\n" +
+				"main.main;main.LoadUser;main.internalLoad 40000\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := writeFolded(&out, tree, tt.self); err != nil {
+				t.Fatalf("writeFolded failed: %v", err)
+			}
+			if out.String() != tt.expected {
+				t.Errorf("Expected:\n%s\ngot:\n%s", tt.expected, out.String())
+			}
+		})
+	}
+}
+
+func TestWriteFoldedSkipsUnfinishedCalls(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeFolded(&out, loadFixtureTree(t), false); err != nil {
+		t.Fatalf("writeFolded failed: %v", err)
+	}
+	if strings.Contains(out.String(), "io.Write") {
+		t.Errorf("Expected calls without a duration to be dropped\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "main.main;main.LoadUser;db.Query 40000\n") {
+		t.Errorf("Expected nested stack line\n%s", out.String())
+	}
+}
+
+func loadGraphFixture(t *testing.T) *tracefile.Tree {
+	t.Helper()
+
+	// main.main calls db.Query twice and main.helper on goroutine-1, and
+	// worker.Run on goroutine-2, which calls db.Query once more
+	events, err := tracefile.ReadFile("testdata/graph.jsonl")
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+	return tracefile.BuildTree(events)
+}
+
+func TestBuildCallGraph(t *testing.T) {
+	tests := []struct {
+		name      string
+		byPackage bool
+		expected  map[string]string
+	}{
+		{
+			name: "functions",
+			expected: map[string]string{
+				"main.main -> db.Query":    "2 calls, 15ms",
+				"main.main -> main.helper": "1 call, 500µs",
+				"main.main -> worker.Run":  "1 call, 31ms",
+				"worker.Run -> db.Query":   "1 call, 30ms",
+			},
+		},
+		{
+			name:      "packages",
+			byPackage: true,
+			expected: map[string]string{
+				"main -> db":     "2 calls, 15ms",
+				"main -> worker": "1 call, 31ms",
+				"worker -> db":   "1 call, 30ms",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			graph := buildCallGraph(loadGraphFixture(t), tt.byPackage)
+
+			edges := make(map[string]string)
+			for _, edge := range graph.edges {
+				edges[edge.from+" -> "+edge.to] = edge.label()
+			}
+			if len(edges) != len(graph.edges) {
+				t.Errorf("Expected deduplicated edges, got %d for %d pairs", len(graph.edges), len(edges))
+			}
+			if len(edges) != len(tt.expected) {
+				t.Errorf("Expected %d edges, got %v", len(tt.expected), edges)
+			}
+			for key, label := range tt.expected {
+				if edges[key] != label {
+					t.Errorf("Expected edge %s labelled %q, got %q", key, label, edges[key])
+				}
+			}
+		})
+	}
+}
+
+func TestWriteMermaid(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeMermaid(&out, loadGraphFixture(t), false); err != nil {
+		t.Fatalf("writeMermaid failed: %v", err)
+	}
+
+	expected := `graph LR
+    n0["main.main"]
+    n1["db.Query"]
+    n2["main.helper"]
+    n3["worker.Run"]
+    n0 -->|"2 calls, 15ms"| n1
+    n0 -->|"1 call, 500µs"| n2
+    n0 -->|"1 call, 31ms"| n3
+    n3 -->|"1 call, 30ms"| n1
+`
+	if out.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func TestWriteDot(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeDot(&out, loadGraphFixture(t), true); err != nil {
+		t.Fatalf("writeDot failed: %v", err)
+	}
+
+	if !strings.HasPrefix(out.String(), "digraph calls {\n") || !strings.HasSuffix(out.String(), "}\n") {
+		t.Errorf("Expected a digraph, got:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), `"main" -> "db" [label="2 calls, 15ms"];`) {
+		t.Errorf("Expected package edge with label, got:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), `"main" -> "main"`) {
+		t.Errorf("Expected calls within a package to be dropped, got:\n%s", out.String())
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/tracefile"
+)
+
+// histogramWidth is the length of the bar of the fullest bucket
+const histogramWidth = 40
+
+// histogramBucket counts the calls lasting from Low up to, but excluding,
+// High microseconds. Buckets double in width: [0,1), [1,2), [2,4), [4,8)...
+type histogramBucket struct {
+	Low   int64 `json:"lowMicros"`
+	High  int64 `json:"highMicros"`
+	Count int   `json:"count"`
+}
+
+// functionHistogram is the JSON output of stats --hist for one function
+type functionHistogram struct {
+	functionStats
+	Histogram []histogramBucket `json:"histogram"`
+}
+
+// bucketIndex returns the index of the bucket of a duration in microseconds
+func bucketIndex(micros int64) int {
+	if micros <= 0 {
+		return 0
+	}
+	return bits.Len64(uint64(micros))
+}
+
+// bucketBounds returns the bounds of the bucket at index i
+func bucketBounds(i int) (low, high int64) {
+	if i == 0 {
+		return 0, 1
+	}
+	return 1 << (i - 1), 1 << i
+}
+
+// durationHistogram buckets durations in microseconds, from the bucket of
+// the shortest to that of the longest, empty ones in between included
+func durationHistogram(durations []int64) []histogramBucket {
+	if len(durations) == 0 {
+		return nil
+	}
+	first, last := bucketIndex(durations[0]), bucketIndex(durations[0])
+	for _, d := range durations {
+		first = min(first, bucketIndex(d))
+		last = max(last, bucketIndex(d))
+	}
+
+	buckets := make([]histogramBucket, last-first+1)
+	for i := range buckets {
+		buckets[i].Low, buckets[i].High = bucketBounds(first + i)
+	}
+	for _, d := range durations {
+		buckets[bucketIndex(d)-first].Count++
+	}
+	return buckets
+}
+
+// computeHistograms buckets the durations of EXIT events per function
+func computeHistograms(events []tracefile.Event) map[string][]histogramBucket {
+	histograms := make(map[string][]histogramBucket)
+	for name, durations := range exitDurations(events) {
+		histograms[name] = durationHistogram(durations)
+	}
+	return histograms
+}
+
+// writeHistograms prints the histogram of each function of stats, in order
+func writeHistograms(w io.Writer, stats []functionStats, histograms map[string][]histogramBucket) error {
+	for _, s := range stats {
+		buckets := histograms[s.Name]
+		fmt.Fprintf(w, "\n%s (%d calls)\n", s.Name, s.Calls)
+
+		fullest := 0
+		for _, b := range buckets {
+			fullest = max(fullest, b.Count)
+		}
+		for _, b := range buckets {
+			bar := b.Count * histogramWidth / fullest
+			if bar == 0 && b.Count > 0 {
+				// A single call still shows
+				bar = 1
+			}
+			label := fmt.Sprintf("%s - %s", formatMicros(float64(b.Low)), formatMicros(float64(b.High)))
+			if _, err := fmt.Fprintf(w, "  %19s │%-*s %d\n", label, histogramWidth, strings.Repeat("█", bar), b.Count); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeHistogramsJSON prints the statistics of each function of stats with
+// its histogram as an indented JSON array
+func writeHistogramsJSON(w io.Writer, stats []functionStats, histograms map[string][]histogramBucket) error {
+	output := make([]functionHistogram, len(stats))
+	for i, s := range stats {
+		output[i] = functionHistogram{functionStats: s, Histogram: histograms[s.Name]}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(output)
+}
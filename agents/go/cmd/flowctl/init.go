@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 
 	"github.com/spf13/cobra"
+	"golang.org/x/mod/modfile"
 	"gopkg.in/yaml.v3"
 )
 
@@ -43,9 +44,15 @@ func runInit(cmd *cobra.Command, args []string) error {
 		fmt.Println("📝 Creating FlowTrace configuration...")
 	}
 
-	// Get current directory name for package prefix suggestion
+	// Suggest the module's packages as the include pattern; the tracer
+	// also applies it at runtime
 	cwd, _ := os.Getwd()
-	dirName := filepath.Base(cwd)
+	include := fmt.Sprintf("github.com/yourorg/%s/**", filepath.Base(cwd))
+	if data, err := os.ReadFile("go.mod"); err == nil {
+		if modulePath := modfile.ModulePath(data); modulePath != "" {
+			include = modulePath + "/**"
+		}
+	}
 
 	// Create default config
 	config := DefaultConfig{
@@ -56,7 +63,7 @@ func runInit(cmd *cobra.Command, args []string) error {
 			Format: "jsonl",
 		},
 		Include: []string{
-			fmt.Sprintf("github.com/yourorg/%s/**", dirName),
+			include,
 		},
 		Exclude: []string{
 			"**/vendor/**",
@@ -65,12 +72,17 @@ func runInit(cmd *cobra.Command, args []string) error {
 			"runtime/**",
 			"reflect/**",
 		},
+		Redact: []string{
+			"password",
+			"*secret*",
+			"*token*",
+		},
 		Sampling: SamplingConfig{
 			Enabled: false,
 			Rate:    0.1,
 		},
 		MaxArgLength: 1000,
-		MaxDepth:     100,
+		MaxDepth:     0, // unlimited
 		Frameworks: FrameworksConfig{
 			AutoDetect: true,
 			Gin:        true,
@@ -108,6 +120,7 @@ type DefaultConfig struct {
 	Output       OutputConfig      `yaml:"output"`
 	Include      []string          `yaml:"include"`
 	Exclude      []string          `yaml:"exclude"`
+	Redact       []string          `yaml:"redact,omitempty"`
 	Sampling     SamplingConfig    `yaml:"sampling"`
 	MaxArgLength int               `yaml:"max_arg_length"`
 	MaxDepth     int               `yaml:"max_depth"`
@@ -116,14 +129,22 @@ type DefaultConfig struct {
 
 // OutputConfig represents output configuration
 type OutputConfig struct {
-	File   string `yaml:"file"`
-	Stdout bool   `yaml:"stdout"`
-	Format string `yaml:"format"`
+	File     string `yaml:"file"`
+	Stdout   bool   `yaml:"stdout"`
+	Format   string `yaml:"format"`
+	Compress bool   `yaml:"compress"`
 }
 
 // SamplingConfig represents sampling configuration
 type SamplingConfig struct {
-	Enabled bool    `yaml:"enabled"`
+	Enabled bool                 `yaml:"enabled"`
+	Rate    float64              `yaml:"rate"`
+	Rules   []SamplingRuleConfig `yaml:"rules,omitempty"`
+}
+
+// SamplingRuleConfig represents a per-function sampling rate
+type SamplingRuleConfig struct {
+	Pattern string  `yaml:"pattern"`
 	Rate    float64 `yaml:"rate"`
 }
 
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/rixmerz/flowtrace-agent-go/internal/ast"
 	"github.com/rixmerz/flowtrace-agent-go/internal/filter"
@@ -32,6 +37,24 @@ Examples:
   # Instrument with custom output directory
   flowctl instrument --output ./instrumented ./...
 
+  # Instrument everything again, ignoring files unchanged since the last run
+  flowctl instrument --output ./instrumented --no-cache ./...
+
+  # Re-instrument changed files as you edit
+  flowctl instrument --output ./instrumented --watch ./...
+
+  # List the files and functions that would be instrumented, with a diff
+  flowctl instrument --dry-run --diff ./...
+
+  # Write a JSON report of the functions instrumented and skipped, and why
+  flowctl instrument --output ./instrumented --report report.json ./...
+
+  # Debug a single method, leaving the rest of the package untouched
+  flowctl instrument --output ./instrumented --only 'UserService.LoadUser' ./...
+
+  # Capture no contexts, database handles or request bodies as arguments
+  flowctl instrument --output ./instrumented --exclude-arg-types context.Context,*sql.DB,io.Reader ./...
+
   # Instrument with exclusion patterns
   flowctl instrument --exclude "**/*_test.go" --exclude "**/vendor/**" ./...`,
 	Args: cobra.MinimumNArgs(1),
@@ -39,11 +62,24 @@ Examples:
 }
 
 var (
-	instrumentOutput  string
-	instrumentInPlace bool
-	instrumentExclude []string
-	instrumentInclude []string
-	instrumentTests   bool
+	instrumentOutput        string
+	instrumentInPlace       bool
+	instrumentExclude       []string
+	instrumentInclude       []string
+	instrumentTests         bool
+	instrumentClosures      bool
+	instrumentDefers        bool
+	instrumentWatch         bool
+	instrumentPkgPath       string
+	instrumentMinComplexity int
+	instrumentOnlyExported  bool
+	instrumentOnly          []string
+	instrumentExcludeArgs   []string
+	instrumentExcludeTypes  []string
+	instrumentNoCache       bool
+	instrumentDryRun        bool
+	instrumentDiff          bool
+	instrumentReportPath    string
 )
 
 func init() {
@@ -52,6 +88,19 @@ func init() {
 	instrumentCmd.Flags().StringSliceVarP(&instrumentExclude, "exclude", "e", nil, "exclude patterns (glob)")
 	instrumentCmd.Flags().StringSliceVar(&instrumentInclude, "include", nil, "include patterns (glob)")
 	instrumentCmd.Flags().BoolVarP(&instrumentTests, "tests", "t", false, "instrument test files")
+	instrumentCmd.Flags().BoolVar(&instrumentClosures, "closures", false, "also instrument anonymous functions and closures")
+	instrumentCmd.Flags().BoolVar(&instrumentDefers, "defers", false, "also trace deferred calls, each as a span of its own")
+	instrumentCmd.Flags().BoolVarP(&instrumentWatch, "watch", "w", false, "keep running and re-instrument files as they change (requires --output)")
+	instrumentCmd.Flags().StringVar(&instrumentPkgPath, "flowtrace-pkg", "", "import path of the flowtrace runtime added to instrumented files")
+	instrumentCmd.Flags().IntVar(&instrumentMinComplexity, "min-complexity", 0, "skip functions whose cyclomatic complexity is below this (0 instruments all)")
+	instrumentCmd.Flags().BoolVar(&instrumentOnlyExported, "only-exported", false, "only instrument exported functions and methods")
+	instrumentCmd.Flags().StringSliceVar(&instrumentOnly, "only", nil, "only instrument the functions matching this glob, e.g. UserService.LoadUser or shop.*; repeatable")
+	instrumentCmd.Flags().StringSliceVar(&instrumentExcludeArgs, "exclude-args", nil, "names of parameters not to capture (\"receiver\" for method receivers)")
+	instrumentCmd.Flags().StringSliceVar(&instrumentExcludeTypes, "exclude-arg-types", nil, "types of parameters not to capture, as written in the source (e.g. context.Context,*sql.DB); replaces the defaults: "+strings.Join(ast.DefaultExcludeArgTypes(), ",")+", and \"\" captures all")
+	instrumentCmd.Flags().BoolVar(&instrumentNoCache, "no-cache", false, "instrument all files, not only those changed since the last run (cached in "+ast.DiskCacheDir+")")
+	instrumentCmd.Flags().BoolVar(&instrumentDryRun, "dry-run", false, "report the files and functions that would be instrumented without writing any files")
+	instrumentCmd.Flags().BoolVar(&instrumentDiff, "diff", false, "with --dry-run, also print a unified diff of the changes")
+	instrumentCmd.Flags().StringVar(&instrumentReportPath, "report", "", "write a JSON report of the functions instrumented and skipped to this file (implies --no-cache)")
 }
 
 func runInstrument(cmd *cobra.Command, args []string) error {
@@ -68,15 +117,29 @@ func runInstrument(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("cannot use --in-place and --output together")
 	}
 
-	if !instrumentInPlace && instrumentOutput == "" {
+	if !instrumentInPlace && instrumentOutput == "" && !instrumentDryRun {
 		return fmt.Errorf("must specify either --in-place or --output")
 	}
 
+	if instrumentWatch && (instrumentInPlace || instrumentDryRun) {
+		return fmt.Errorf("--watch requires --output")
+	}
+
+	if instrumentDiff && !instrumentDryRun {
+		return fmt.Errorf("--diff requires --dry-run")
+	}
+
+	for _, pattern := range instrumentOnly {
+		if err := filter.ValidatePattern(pattern); err != nil {
+			return fmt.Errorf("invalid --only pattern: %w", err)
+		}
+	}
+
 	// Setup filter
 	excludePatterns := instrumentExclude
 	if len(excludePatterns) == 0 {
-		// Use default exclude patterns
-		excludePatterns = filter.DefaultExcludePatterns()
+		// Use default exclude patterns, which skip test files unless --tests
+		excludePatterns = defaultExcludePatterns(instrumentTests)
 	}
 
 	pkgFilter := filter.NewFilter(instrumentInclude, excludePatterns)
@@ -88,6 +151,37 @@ func runInstrument(cmd *cobra.Command, args []string) error {
 	}
 	pkgLoader := loader.NewLoader(loaderConfig)
 
+	transformerConfig := &ast.Config{
+		Include:            instrumentInclude,
+		Exclude:            excludePatterns,
+		InstrumentTests:    instrumentTests,
+		InstrumentClosures: instrumentClosures,
+		InstrumentDefers:   instrumentDefers,
+		FlowtracePkgPath:   instrumentPkgPath,
+		MinComplexity:      instrumentMinComplexity,
+		OnlyExported:       instrumentOnlyExported,
+		Only:               instrumentOnly,
+		ExcludeArgs:        instrumentExcludeArgs,
+		ExcludeArgTypes:    instrumentExcludeTypes,
+	}
+
+	// Files to instrument, and the import paths of their directories
+	var files []string
+	fileDirs := make(map[string]string)
+	seen := make(map[string]bool)
+
+	// Packages seen and their import paths, for --watch
+	var watchDirs []string
+	pkgPaths := make(map[string]string)
+
+	// What was skipped, for --dry-run
+	var summary dryRunSummary
+
+	var report *instrumentationReport
+	if instrumentReportPath != "" {
+		report = newInstrumentationReport()
+	}
+
 	// Process each package pattern
 	for _, pattern := range args {
 		if verbose {
@@ -102,10 +196,11 @@ func runInstrument(cmd *cobra.Command, args []string) error {
 
 		for _, pkg := range pkgs {
 			// Check filter
-			if !pkgFilter.ShouldInstrumentPackage(pkg) {
+			if !includesPackage(pkgFilter, pkg) {
 				if debug {
 					fmt.Printf("   ⏭️  Skipping excluded package: %s\n", pkg)
 				}
+				summary.ExcludedPackages++
 				continue
 			}
 
@@ -119,14 +214,29 @@ func runInstrument(cmd *cobra.Command, args []string) error {
 				fmt.Fprintf(os.Stderr, "   ⚠️  Warning: failed to load %s: %v\n", pkg, err)
 				continue
 			}
+			watchDirs = append(watchDirs, filepath.Clean(pkg))
+			pkgPaths[filepath.Clean(pkg)] = pkgInfo.Package.PkgPath
+
+			// Files that don't type-check or use cgo; the rest of the
+			// package is still instrumented
+			for _, skipped := range pkgInfo.Skipped {
+				fmt.Fprintf(os.Stderr, "   ⚠️  Warning: skipping %s: %s\n", skipped.Path, skipped.Reason)
+			}
 
-			// Instrument files
+			// Collect files
 			for _, fileInfo := range pkgInfo.Files {
+				// Overlapping patterns load a package more than once
+				if seen[fileInfo.Path] {
+					continue
+				}
+				seen[fileInfo.Path] = true
+
 				// Skip if filtered
-				if !pkgFilter.ShouldInstrumentFile(fileInfo.Path) {
+				if !pkgFilter.ShouldInstrumentFile(fileInfo.Path) || !transformerConfig.IncludesFile(fileInfo.Path) {
 					if debug {
 						fmt.Printf("      ⏭️  Skipping: %s\n", fileInfo.Path)
 					}
+					summary.Filtered++
 					continue
 				}
 
@@ -135,56 +245,285 @@ func runInstrument(cmd *cobra.Command, args []string) error {
 					if debug {
 						fmt.Printf("      ⏭️  Skipping generated: %s\n", fileInfo.Path)
 					}
+					summary.Generated++
+					if report != nil {
+						if err := report.addGenerated(pkgInfo.Package.PkgPath, fileInfo.Path); err != nil {
+							fmt.Fprintf(os.Stderr, "   ⚠️  Warning: failed to read %s: %v\n", fileInfo.Path, err)
+						}
+					}
 					continue
 				}
 
-				if verbose {
-					fmt.Printf("      ⚙️  Instrumenting: %s\n", fileInfo.Path)
-				}
-
-				// Create transformer
-				transformerConfig := &ast.Config{
-					Include:         instrumentInclude,
-					Exclude:         excludePatterns,
-					InstrumentTests: instrumentTests,
-				}
-				transformer := ast.NewTransformer(pkgLoader.FileSet(), transformerConfig)
-
-				// Transform file
-				if err := transformer.TransformFile(fileInfo.AST); err != nil {
-					return fmt.Errorf("failed to transform %s: %w", fileInfo.Path, err)
-				}
+				files = append(files, fileInfo.Path)
+				fileDirs[filepath.Dir(fileInfo.Path)] = pkgInfo.Package.PkgPath
+			}
+		}
+	}
 
-				// Determine output path
-				outputPath := fileInfo.Path
-				if instrumentOutput != "" {
-					// Calculate relative path
-					relPath, err := filepath.Rel(".", fileInfo.Path)
-					if err != nil {
-						relPath = fileInfo.Path
-					}
-					outputPath = filepath.Join(instrumentOutput, relPath)
-				}
+	if instrumentDryRun {
+		if err := dryRunFiles(files, fileDirs, transformerConfig, &summary, report, instrumentDiff, cmd.OutOrStdout()); err != nil {
+			return err
+		}
+		if report != nil {
+			if err := report.write(instrumentReportPath); err != nil {
+				return err
+			}
+		}
+		if summary.Failed > 0 {
+			return fmt.Errorf("failed to transform %d of %d files", summary.Failed, len(files))
+		}
+		return nil
+	}
 
-				// Write instrumented file
-				if err := pkgLoader.WriteFile(fileInfo.AST, outputPath); err != nil {
-					return fmt.Errorf("failed to write %s: %w", outputPath, err)
-				}
+	// Files unchanged since the last run are skipped unless --no-cache; a
+	// report covers all files, so it needs them all transformed
+	var cache *ast.DiskCache
+	if !instrumentNoCache && report == nil {
+		var err error
+		cache, err = ast.OpenDiskCache(ast.DiskCacheDir, transformerConfig)
+		if err != nil {
+			return fmt.Errorf("failed to open cache: %w", err)
+		}
+	}
 
-				if verbose {
-					fmt.Printf("      ✅ Written: %s\n", outputPath)
-				}
-			}
+	// Instrument files
+	progress, err := instrumentFiles(files, fileDirs, transformerConfig, cache, report, os.Stdout, verbose)
+	if err != nil {
+		return err
+	}
+	if report != nil {
+		if err := report.write(instrumentReportPath); err != nil {
+			return err
+		}
+		if verbose {
+			fmt.Printf("📋 Report written to %s\n", instrumentReportPath)
+		}
+	}
+	if cache != nil {
+		if err := cache.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "   ⚠️  Warning: failed to save cache: %v\n", err)
 		}
 	}
+	if progress.Errors > 0 {
+		return fmt.Errorf("failed to instrument %d of %d files", progress.Errors, progress.Total)
+	}
 
 	if verbose {
 		fmt.Println("\n✨ Instrumentation complete!")
 	}
 
+	if instrumentWatch {
+		w := newWatcher(outputRoot("."), instrumentOutput, watchDirs, pkgPaths, pkgFilter, transformerConfig, os.Stdout)
+
+		// Stop watching on Ctrl+C
+		done := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			close(done)
+		}()
+
+		return w.run(done)
+	}
+
 	return nil
 }
 
+// instrumentFiles instruments files in parallel and writes them out, while
+// drawing a progress bar on out. fileDirs maps the directories of files to
+// their package import paths. Files that fail to transform are reported
+// and counted in the returned progress. With a cache, files whose source
+// and output are unchanged since they were recorded are left alone, and
+// the files written are recorded. With a report, the transformation of
+// every file is added to it.
+func instrumentFiles(files []string, fileDirs map[string]string, config *ast.Config, cache *ast.DiskCache, report *instrumentationReport, out io.Writer, verbose bool) (*ast.Progress, error) {
+	// Place every file before writing any
+	outputPaths := make(map[string]string, len(files))
+	for _, file := range files {
+		outputPath, err := instrumentOutputPath(file)
+		if err != nil {
+			return &ast.Progress{Total: len(files)}, err
+		}
+		outputPaths[file] = outputPath
+	}
+
+	if cache != nil {
+		var changed []string
+		for _, file := range files {
+			if !cache.Unchanged(file, outputPaths[file], fileDirs[filepath.Dir(file)]) {
+				changed = append(changed, file)
+			}
+		}
+		if skipped := len(files) - len(changed); skipped > 0 {
+			fmt.Fprintf(out, "   ⏭️  %d unchanged file(s) skipped\n", skipped)
+		}
+		files = changed
+	}
+
+	final := &ast.Progress{Total: len(files)}
+	if len(files) == 0 {
+		return final, nil
+	}
+
+	bt := ast.NewBatchTransformer(config)
+	bt.SetPackagePaths(fileDirs)
+	progress, results, errs := bt.TransformBatch(files)
+
+	// Results are buffered for every file, so only progress must be drained
+	// while the batch runs
+	for p := range progress {
+		final = p
+		renderProgress(out, p)
+	}
+	fmt.Fprintln(out)
+
+	for result := range results {
+		if report != nil {
+			addToReport(report, fileDirs, result)
+		}
+		if result.Error != nil {
+			fmt.Fprintf(os.Stderr, "   ⚠️  Failed to transform %s: %v\n", result.Filename, result.Error)
+			continue
+		}
+
+		outputPath := outputPaths[result.Filename]
+		if err := loader.WriteAST(result.FileSet, result.File, outputPath); err != nil {
+			return final, fmt.Errorf("failed to write %s: %w", outputPath, err)
+		}
+		if verbose {
+			fmt.Fprintf(out, "      ✅ Written: %s\n", outputPath)
+		}
+		if cache != nil {
+			if err := cache.Record(result.Filename, outputPath, fileDirs[filepath.Dir(result.Filename)]); err != nil {
+				fmt.Fprintf(os.Stderr, "   ⚠️  Warning: failed to cache %s: %v\n", result.Filename, err)
+			}
+		}
+	}
+
+	if err := <-errs; err != nil {
+		return final, err
+	}
+	return final, nil
+}
+
+// addToReport adds a transformed file to report, before it is written:
+// instrumenting in place replaces the source its changes are counted from
+func addToReport(report *instrumentationReport, fileDirs map[string]string, result *ast.TransformResult) {
+	lines := 0
+	if result.Error == nil {
+		var err error
+		if lines, err = changedLines(result.Filename, result); err != nil {
+			fmt.Fprintf(os.Stderr, "   ⚠️  Warning: failed to count the changes to %s: %v\n", result.Filename, err)
+		}
+	}
+	report.addResult(fileDirs[filepath.Dir(result.Filename)], result, lines)
+}
+
+// instrumentOutputPath returns where the instrumented form of a file goes:
+// the file itself in place, or else its path relative to the root of its
+// module inside the output directory
+func instrumentOutputPath(path string) (string, error) {
+	if instrumentOutput == "" {
+		return path, nil
+	}
+	return outputPath(outputRoot(filepath.Dir(path)), instrumentOutput, path)
+}
+
+// outputRoot returns the directory output paths of files in dir are
+// relative to: the root of the module holding dir, or the current
+// directory outside a module
+func outputRoot(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		if root, err := findModuleRoot(abs); err == nil {
+			return root
+		}
+	}
+	return "."
+}
+
+// outputPath maps the file at path to its place in the output directory,
+// at its path relative to root. A file outside root would land outside the
+// output directory, and is rejected.
+func outputPath(root, output, path string) (string, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absRoot, absPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside %s, so it has no place in %s", path, root, output)
+	}
+	return filepath.Join(output, rel), nil
+}
+
+// progressBarWidth is the number of cells in the instrument progress bar
+const progressBarWidth = 30
+
+// renderProgress redraws the progress bar line, e.g.
+// "[=========>                    ] 12/40 files"
+func renderProgress(out io.Writer, p *ast.Progress) {
+	filled := 0
+	if p.Total > 0 {
+		filled = p.Completed * progressBarWidth / p.Total
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+	line := fmt.Sprintf("\r[%s] %d/%d files", bar, p.Completed, p.Total)
+	if p.Errors > 0 {
+		line += fmt.Sprintf(" (%d failed)", p.Errors)
+	}
+	fmt.Fprint(out, line)
+}
+
+// includesPackage reports whether the package in dir is instrumented under
+// pkgFilter. Excluded packages still are when they contain functions
+// marked with //flowtrace:trace.
+func includesPackage(pkgFilter *filter.Filter, dir string) bool {
+	return pkgFilter.ShouldInstrumentPackage(dir) || hasTraceDirective(dir)
+}
+
+// hasTraceDirective reports whether any Go file in dir contains a
+// //flowtrace:trace directive
+func hasTraceDirective(dir string) bool {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return false
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		if bytes.Contains(data, []byte("//flowtrace:trace")) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultExcludePatterns returns filter.DefaultExcludePatterns, without
+// the test file pattern when test files are instrumented
+func defaultExcludePatterns(tests bool) []string {
+	patterns := filter.DefaultExcludePatterns()
+	if !tests {
+		return patterns
+	}
+	kept := patterns[:0]
+	for _, pattern := range patterns {
+		if pattern != "**/*_test.go" {
+			kept = append(kept, pattern)
+		}
+	}
+	return kept
+}
+
 // expandPattern expands a package pattern to a list of packages
 func expandPattern(pattern string) ([]string, error) {
 	// Handle special patterns
@@ -207,6 +546,15 @@ func expandPattern(pattern string) ([]string, error) {
 	return []string{pattern}, nil
 }
 
+// localPackage turns a relative directory such as "cart", which the go
+// tool would take for a standard library package, into "./cart"
+func localPackage(dir string) string {
+	if filepath.IsAbs(dir) || dir == "." || strings.HasPrefix(dir, "./") || strings.HasPrefix(dir, "../") {
+		return dir
+	}
+	return "./" + dir
+}
+
 // getRecursivePackages gets all packages recursively from a directory
 func getRecursivePackages(root string) ([]string, error) {
 	var packages []string
@@ -221,7 +569,7 @@ func getRecursivePackages(root string) ([]string, error) {
 		}
 
 		// Skip vendor and hidden directories
-		if info.Name() == "vendor" || info.Name() == ".git" || (len(info.Name()) > 0 && info.Name()[0] == '.') {
+		if path != root && (info.Name() == "vendor" || info.Name() == ".git" || (len(info.Name()) > 0 && info.Name()[0] == '.')) {
 			return filepath.SkipDir
 		}
 
@@ -232,7 +580,7 @@ func getRecursivePackages(root string) ([]string, error) {
 		}
 
 		if hasGoFiles {
-			packages = append(packages, path)
+			packages = append(packages, localPackage(path))
 		}
 
 		return nil
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/ast"
+)
+
+// runInstrumentCommand instruments a temp module holding a source and a
+// test file through runInstrument, and returns the instrumented output
+// files by base name
+func runInstrumentCommand(t *testing.T, tests bool) map[string]string {
+	t.Helper()
+
+	module := t.TempDir()
+	files := map[string]string{
+		"go.mod":        "module example.com/store\n\ngo 1.21\n",
+		"store.go":      "package store\n\nfunc Get() int {\n\treturn 1\n}\n",
+		"store_test.go": "package store\n\nimport \"testing\"\n\nfunc TestGet(t *testing.T) {\n\tif Get() != 1 {\n\t\tt.Fail()\n\t}\n}\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(module, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	t.Chdir(module)
+
+	out := filepath.Join(t.TempDir(), "out")
+	instrumentOutput, instrumentTests = out, tests
+	t.Cleanup(func() { instrumentOutput, instrumentTests = "", false })
+
+	if err := runInstrument(instrumentCmd, []string{"."}); err != nil {
+		t.Fatalf("runInstrument failed: %v", err)
+	}
+
+	written := make(map[string]string)
+	filepath.Walk(out, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			content, _ := os.ReadFile(path)
+			written[filepath.Base(path)] = string(content)
+		}
+		return nil
+	})
+	return written
+}
+
+func TestInstrumentSkipsTestFilesByDefault(t *testing.T) {
+	written := runInstrumentCommand(t, false)
+
+	if !strings.Contains(written["store.go"], `flowtrace.EnterAt("example.com/store", "Get", `) {
+		t.Errorf("Expected store.go to be instrumented, got:\n%s", written["store.go"])
+	}
+	if _, ok := written["store_test.go"]; ok {
+		t.Error("Expected store_test.go not to be instrumented without --tests")
+	}
+}
+
+func TestInstrumentTestsFlag(t *testing.T) {
+	written := runInstrumentCommand(t, true)
+
+	if !strings.Contains(written["store.go"], `flowtrace.EnterAt("example.com/store", "Get", `) {
+		t.Errorf("Expected store.go to be instrumented, got:\n%s", written["store.go"])
+	}
+	if !strings.Contains(written["store_test.go"], `flowtrace.EnterAt("example.com/store", "TestGet", `) {
+		t.Errorf("Expected store_test.go to be instrumented with --tests, got:\n%s", written["store_test.go"])
+	}
+}
+
+func TestInstrumentFilesInParallel(t *testing.T) {
+	module := t.TempDir()
+	files := map[string]string{
+		"go.mod":         "module example.com/shop\n\ngo 1.21\n",
+		"main.go":        "package main\n\nfunc main() {\n\tprintln(\"shop\")\n}\n",
+		"cart/cart.go":   "package cart\n\nfunc Add(n int) int {\n\treturn n + 1\n}\n",
+		"cart/total.go":  "package cart\n\nfunc Total(ns []int) int {\n\tsum := 0\n\tfor _, n := range ns {\n\t\tsum += n\n\t}\n\treturn sum\n}\n",
+		"users/users.go": "package users\n\nfunc Find(id int) string {\n\treturn \"user\"\n}\n",
+	}
+	var paths []string
+	fileDirs := make(map[string]string)
+	for name, content := range files {
+		path := filepath.Join(module, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create %s: %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		if name != "go.mod" {
+			paths = append(paths, path)
+			fileDirs[filepath.Dir(path)] = filepath.ToSlash(filepath.Join("example.com/shop", filepath.Dir(name)))
+		}
+	}
+	fileDirs[module] = "main"
+
+	out := filepath.Join(t.TempDir(), "out")
+	instrumentOutput = out
+	t.Cleanup(func() { instrumentOutput = "" })
+
+	var bar strings.Builder
+	progress, err := instrumentFiles(paths, fileDirs, &ast.Config{}, nil, nil, &bar, false)
+	if err != nil {
+		t.Fatalf("instrumentFiles failed: %v", err)
+	}
+
+	if progress.Total != 4 || progress.Completed != 4 || progress.Errors != 0 {
+		t.Errorf("Expected 4 of 4 files completed without errors, got %+v", progress)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(bar.String()), "] 4/4 files") {
+		t.Errorf("Expected the progress bar to end at 4/4 files, got %q", bar.String())
+	}
+
+	want := map[string]string{
+		"main.go":  `flowtrace.EnterAt("main", "main", `,
+		"cart.go":  `flowtrace.EnterAt("example.com/shop/cart", "Add", `,
+		"total.go": `flowtrace.EnterAt("example.com/shop/cart", "Total", `,
+		"users.go": `flowtrace.EnterAt("example.com/shop/users", "Find", `,
+	}
+	for _, path := range paths {
+		outputPath, err := instrumentOutputPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := os.ReadFile(outputPath)
+		if err != nil {
+			t.Errorf("Expected %s to be written: %v", path, err)
+			continue
+		}
+		if enter := want[filepath.Base(path)]; !strings.Contains(string(content), enter) {
+			t.Errorf("Expected %s to contain %s, got:\n%s", filepath.Base(path), enter, content)
+		}
+	}
+}
+
+func TestInstrumentRecursive(t *testing.T) {
+	module := t.TempDir()
+	files := map[string]string{
+		"go.mod":       "module example.com/shop\n\ngo 1.21\n",
+		"main.go":      "package main\n\nfunc main() {}\n",
+		"cart/cart.go": "package cart\n\nfunc Add(n int) int {\n\treturn n + 1\n}\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(module, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	t.Chdir(module)
+
+	out := filepath.Join(t.TempDir(), "out")
+	instrumentOutput = out
+	t.Cleanup(func() { instrumentOutput = "" })
+
+	if err := runInstrument(instrumentCmd, []string{"./..."}); err != nil {
+		t.Fatalf("runInstrument failed: %v", err)
+	}
+
+	var written []string
+	filepath.Walk(out, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			written = append(written, filepath.Base(path))
+		}
+		return nil
+	})
+	sort.Strings(written)
+	if strings.Join(written, ",") != "cart.go,main.go" {
+		t.Errorf("Expected cart.go and main.go to be written, got %v", written)
+	}
+}
+
+func TestInstrumentSkipsCgoAndBrokenFiles(t *testing.T) {
+	module := t.TempDir()
+	files := map[string]string{
+		"go.mod":    "module example.com/native\n\ngo 1.21\n",
+		"plain.go":  "package native\n\nfunc Double(n int) int {\n\treturn n * 2\n}\n",
+		"native.go": "package native\n\n// int add(int a, int b) { return a + b; }\nimport \"C\"\n\nfunc Add(a, b int) int {\n\treturn int(C.add(C.int(a), C.int(b)))\n}\n",
+		"broken.go": "package native\n\nfunc Broken() int {\n\treturn undefined\n}\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(module, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	t.Chdir(module)
+
+	out := filepath.Join(t.TempDir(), "out")
+	instrumentOutput = out
+	t.Cleanup(func() { instrumentOutput = "" })
+
+	if err := runInstrument(instrumentCmd, []string{"."}); err != nil {
+		t.Fatalf("Expected the package to be instrumented despite its cgo and broken files, got %v", err)
+	}
+
+	var written []string
+	filepath.Walk(out, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			written = append(written, filepath.Base(path))
+		}
+		return nil
+	})
+	if strings.Join(written, ",") != "plain.go" {
+		t.Fatalf("Expected only plain.go to be written, got %v", written)
+	}
+	content, _ := os.ReadFile(filepath.Join(out, "plain.go"))
+	if !strings.Contains(string(content), `flowtrace.EnterAt("example.com/native", "Double", `) {
+		t.Errorf("Expected plain.go to be instrumented, got:\n%s", content)
+	}
+}
+
+// instrumentTwice instruments a temp module holding a.go and b.go, changes
+// b.go and instruments it again. It returns the instrumented a.go and b.go,
+// and whether the second run wrote a.go.
+func instrumentTwice(t *testing.T, noCache bool) (a, b string, rewroteA bool) {
+	t.Helper()
+
+	module := t.TempDir()
+	files := map[string]string{
+		"go.mod": "module example.com/app\n\ngo 1.21\n",
+		"a.go":   "package app\n\nfunc A() int {\n\treturn 1\n}\n",
+		"b.go":   "package app\n\nfunc B() int {\n\treturn 2\n}\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(module, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	t.Chdir(module)
+
+	out := filepath.Join(t.TempDir(), "out")
+	instrumentOutput, instrumentNoCache = out, noCache
+	t.Cleanup(func() { instrumentOutput, instrumentNoCache = "", false })
+
+	if err := runInstrument(instrumentCmd, []string{"."}); err != nil {
+		t.Fatalf("first runInstrument failed: %v", err)
+	}
+
+	// Date the output back, so a rewrite shows in its mod time
+	outA := filepath.Join(out, "a.go")
+	outB := filepath.Join(out, "b.go")
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(outA, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := "package app\n\nfunc B2() int {\n\treturn 3\n}\n"
+	if err := os.WriteFile(filepath.Join(module, "b.go"), []byte(changed), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runInstrument(instrumentCmd, []string{"."}); err != nil {
+		t.Fatalf("second runInstrument failed: %v", err)
+	}
+
+	info, err := os.Stat(outA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contentA, _ := os.ReadFile(outA)
+	contentB, _ := os.ReadFile(outB)
+	return string(contentA), string(contentB), !info.ModTime().Equal(old)
+}
+
+func TestInstrumentCacheSkipsUnchangedFiles(t *testing.T) {
+	a, b, rewroteA := instrumentTwice(t, false)
+
+	if rewroteA {
+		t.Error("Expected unchanged a.go not to be written again")
+	}
+	if !strings.Contains(a, `flowtrace.EnterAt("example.com/app", "A", `) {
+		t.Errorf("Expected the output of a.go to be kept, got:\n%s", a)
+	}
+	if !strings.Contains(b, `flowtrace.EnterAt("example.com/app", "B2", `) {
+		t.Errorf("Expected modified b.go to be instrumented again, got:\n%s", b)
+	}
+	if _, err := os.Stat(filepath.Join(ast.DiskCacheDir, "manifest.json")); err != nil {
+		t.Errorf("Expected the cache to be saved: %v", err)
+	}
+}
+
+func TestInstrumentNoCache(t *testing.T) {
+	_, b, rewroteA := instrumentTwice(t, true)
+
+	if !rewroteA {
+		t.Error("Expected a.go to be written again with --no-cache")
+	}
+	if !strings.Contains(b, `flowtrace.EnterAt("example.com/app", "B2", `) {
+		t.Errorf("Expected modified b.go to be instrumented again, got:\n%s", b)
+	}
+}
+
+func TestInstrumentOutputPaths(t *testing.T) {
+	tests := []struct {
+		name string
+		dir  string // directory of the module to run in
+		pkg  func(module string) string
+		want string // output path relative to the output directory
+	}{
+		{
+			name: "package in a subdirectory",
+			dir:  ".",
+			pkg:  func(string) string { return "./cart" },
+			want: "cart/cart.go",
+		},
+		{
+			name: "run from a subdirectory",
+			dir:  "cart",
+			pkg:  func(string) string { return "." },
+			want: "cart/cart.go",
+		},
+		{
+			name: "package given by absolute path",
+			dir:  "users",
+			pkg:  func(module string) string { return filepath.Join(module, "cart") },
+			want: "cart/cart.go",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			module := t.TempDir()
+			files := map[string]string{
+				"go.mod":         "module example.com/shop\n\ngo 1.21\n",
+				"cart/cart.go":   "package cart\n\nfunc Add(n int) int {\n\treturn n + 1\n}\n",
+				"users/users.go": "package users\n\nfunc Find(id int) string {\n\treturn \"user\"\n}\n",
+			}
+			for name, content := range files {
+				path := filepath.Join(module, name)
+				os.MkdirAll(filepath.Dir(path), 0755)
+				if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatalf("Failed to write %s: %v", name, err)
+				}
+			}
+			t.Chdir(filepath.Join(module, tt.dir))
+
+			out := filepath.Join(t.TempDir(), "out")
+			instrumentOutput = out
+			t.Cleanup(func() { instrumentOutput = "" })
+
+			if err := runInstrument(instrumentCmd, []string{tt.pkg(module)}); err != nil {
+				t.Fatalf("runInstrument failed: %v", err)
+			}
+
+			var written []string
+			filepath.Walk(out, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					rel, _ := filepath.Rel(out, path)
+					written = append(written, filepath.ToSlash(rel))
+				}
+				return nil
+			})
+			if len(written) != 1 || written[0] != tt.want {
+				t.Errorf("Expected only %s to be written, got %v", tt.want, written)
+			}
+		})
+	}
+}
+
+func TestOutputPathRejectsEscapes(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "module")
+	out := filepath.Join(t.TempDir(), "out")
+
+	got, err := outputPath(root, out, filepath.Join(root, "cart", "cart.go"))
+	if err != nil || got != filepath.Join(out, "cart", "cart.go") {
+		t.Errorf("Expected %s, got %q (%v)", filepath.Join(out, "cart", "cart.go"), got, err)
+	}
+
+	if got, err := outputPath(root, out, filepath.Join(root, "..", "other", "main.go")); err == nil {
+		t.Errorf("Expected a file outside the root to be rejected, got %s", got)
+	}
+}
+
+// snapshotDir returns the contents of every file under dir by path
+func snapshotDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	files := make(map[string]string)
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			content, _ := os.ReadFile(path)
+			files[path] = string(content)
+		}
+		return nil
+	})
+	return files
+}
+
+func TestInstrumentDryRun(t *testing.T) {
+	module := t.TempDir()
+	files := map[string]string{
+		"go.mod":           "module example.com/shop\n\ngo 1.21\n",
+		"main.go":          "package main\n\nfunc main() {\n\tgreet()\n}\n\nfunc greet() {\n\tprintln(\"shop\")\n}\n",
+		"cart/cart.go":     "package cart\n\ntype Cart struct {\n\titems []int\n}\n\nfunc (c *Cart) Add(n int) {\n\tc.items = append(c.items, n)\n}\n\nfunc (c *Cart) Len() int {\n\treturn len(c.items)\n}\n",
+		"cart/doc.go":      "// Package cart holds shopping carts\npackage cart\n",
+		"cart/cart.pb.go":  "package cart\n\nfunc Marshal() {}\n",
+		"cart/zz_mock.go":  "// Code generated by mockgen. DO NOT EDIT.\n\npackage cart\n\nfunc Mock() {}\n",
+		"legacy/legacy.go": "package legacy\n\nfunc Old() {}\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(module, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	t.Chdir(module)
+	before := snapshotDir(t, module)
+
+	var out strings.Builder
+	instrumentCmd.SetOut(&out)
+	instrumentDryRun, instrumentDiff = true, true
+	instrumentExclude = []string{"**/*_test.go", "legacy"}
+	t.Cleanup(func() {
+		instrumentCmd.SetOut(nil)
+		instrumentDryRun, instrumentDiff = false, false
+		instrumentExclude = nil
+	})
+
+	if err := runInstrument(instrumentCmd, []string{"./..."}); err != nil {
+		t.Fatalf("runInstrument failed: %v", err)
+	}
+
+	after := snapshotDir(t, module)
+	if len(after) != len(before) {
+		t.Errorf("Expected no files to be written, got %d files instead of %d", len(after), len(before))
+	}
+	for path, content := range before {
+		if after[path] != content {
+			t.Errorf("Expected %s to be left unchanged", path)
+		}
+	}
+
+	output := out.String()
+	for _, want := range []string{
+		"📝 cart/cart.go (2): Cart.Add, Cart.Len\n",
+		"📝 main.go (2): main, greet\n",
+		"📊 4 function(s) in 2 file(s) would be instrumented\n",
+		"   1 file(s) without functions to instrument\n",
+		"   1 file(s) skipped by filters\n",
+		"   1 generated file(s) skipped\n",
+		"   1 package(s) excluded\n",
+		"--- a/main.go\n+++ b/main.go\n",
+		"+\t\t__ft_ctx = flowtrace.EnterAt(\"example.com/shop\", \"greet\", ",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected %q in the dry run output, got:\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, "Marshal") || strings.Contains(output, "Mock") || strings.Contains(output, "Old") {
+		t.Errorf("Expected skipped files not to be listed, got:\n%s", output)
+	}
+}
+
+func TestInstrumentDiffRequiresDryRun(t *testing.T) {
+	instrumentOutput, instrumentDiff = t.TempDir(), true
+	t.Cleanup(func() { instrumentOutput, instrumentDiff = "", false })
+
+	if err := runInstrument(instrumentCmd, []string{"."}); err == nil || !strings.Contains(err.Error(), "--diff requires --dry-run") {
+		t.Errorf("Expected --diff without --dry-run to be rejected, got %v", err)
+	}
+}
+
+func TestInstrumentReport(t *testing.T) {
+	module := t.TempDir()
+	files := map[string]string{
+		"go.mod":              "module example.com/shop\n\ngo 1.21\n",
+		"main.go":             "package main\n\nfunc main() {\n\tif len(\"shop\") > 0 {\n\t\tprintln(\"shop\")\n\t}\n}\n",
+		"store/store.go":      "package store\n\nfunc init() {}\n\nfunc Get(id int) int {\n\tif id < 0 {\n\t\treturn 0\n\t}\n\treturn id\n}\n\nfunc name() string { return \"store\" }\n\n//flowtrace:skip\nfunc Debug() {}\n",
+		"store/zz_mock.go":    "// Code generated by mockgen. DO NOT EDIT.\n\npackage store\n\nfunc Mock() {}\n",
+		"store/store_test.go": "package store\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(module, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	t.Chdir(module)
+
+	reportPath := filepath.Join(t.TempDir(), "report.json")
+	instrumentOutput, instrumentReportPath, instrumentMinComplexity = filepath.Join(t.TempDir(), "out"), reportPath, 2
+	t.Cleanup(func() { instrumentOutput, instrumentReportPath, instrumentMinComplexity = "", "", 0 })
+
+	if err := runInstrument(instrumentCmd, []string{"./..."}); err != nil {
+		t.Fatalf("runInstrument failed: %v", err)
+	}
+
+	data, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("Expected the report to be written: %v", err)
+	}
+	var report instrumentationReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("Invalid report: %v\n%s", err, data)
+	}
+
+	if report.Files != 2 || report.Failed != 0 || report.Instrumented != 2 || report.Skipped != 4 || report.InstrumentedPercent != 100.0/3 {
+		t.Errorf("Expected 2 files, 2 of 6 functions instrumented, got:\n%s", data)
+	}
+	if len(report.Packages) != 2 || report.Packages[0].Path != "example.com/shop" || report.Packages[1].Path != "example.com/shop/store" {
+		t.Fatalf("Expected a report per package, got:\n%s", data)
+	}
+
+	store := report.Packages[1]
+	if store.Files != 1 || strings.Join(store.Instrumented, ",") != "Get" {
+		t.Errorf("Expected Get of store.go to be instrumented, got %+v", store)
+	}
+	skipped := make(map[string]string)
+	for _, s := range store.Skipped {
+		skipped[s.Name] = s.Reason
+	}
+	expected := map[string]string{
+		"init":  ast.SkipInit,
+		"name":  ast.SkipBelowComplexity,
+		"Debug": ast.SkipFiltered,
+		"Mock":  skipGenerated,
+	}
+	for name, reason := range expected {
+		if skipped[name] != reason {
+			t.Errorf("Expected %s to be skipped as %s, got %q", name, reason, skipped[name])
+		}
+	}
+	if store.LinesChanged == 0 || report.LinesChanged <= store.LinesChanged {
+		t.Errorf("Expected the changed lines of both files to be counted, got %d in store of %d", store.LinesChanged, report.LinesChanged)
+	}
+}
@@ -38,7 +38,28 @@ Examples:
   flowctl run main.go
 
   # Test with instrumentation
-  flowctl test ./...`,
+  flowctl test ./...
+
+  # Check .flowtrace.yaml for mistakes
+  flowctl validate
+
+  # Remove instrumentation added in place
+  flowctl uninstrument --in-place ./...
+
+  # Print the call tree of a trace
+  flowctl analyze flowtrace.jsonl
+
+  # Browse the call tree of a trace
+  flowctl tui flowtrace.jsonl
+
+  # Watch a trace as it is written in the browser
+  flowctl serve --file flowtrace.jsonl
+
+  # Show where time is spent
+  flowctl stats --top 10 flowtrace.jsonl
+
+  # Export a trace for chrome://tracing or Perfetto
+  flowctl export --format chrome-trace -o trace.json flowtrace.jsonl`,
 	Version: version,
 }
 
@@ -50,11 +71,19 @@ func init() {
 
 	// Add subcommands
 	rootCmd.AddCommand(instrumentCmd)
+	rootCmd.AddCommand(uninstrumentCmd)
 	rootCmd.AddCommand(buildCmd)
 	rootCmd.AddCommand(runCmd)
 	rootCmd.AddCommand(testCmd)
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(initCmd)
+	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(analyzeCmd)
+	rootCmd.AddCommand(tuiCmd)
+	rootCmd.AddCommand(serveCmd)
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(statsCmd)
+	rootCmd.AddCommand(diffCmd)
 }
 
 var versionCmd = &cobra.Command{
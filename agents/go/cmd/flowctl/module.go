@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/ast"
+	"github.com/rixmerz/flowtrace-agent-go/internal/filter"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/semver"
+)
+
+// flowtraceModulePath is the module providing the flowtrace runtime that
+// instrumented code imports
+const flowtraceModulePath = "github.com/rixmerz/flowtrace-agent-go"
+
+// instrumentedModule is an instrumented copy of a module, which go build,
+// go test and go run are pointed at instead of the module itself. Being
+// a full copy including go.mod and go.sum, it resolves its own packages and
+// dependencies as the module does.
+type instrumentedModule struct {
+	root string // directory of the original module
+	dir  string // directory of the copy
+	path string // module path
+}
+
+// instrumentModule copies the module holding dir into tempDir and
+// instruments the packages of the copy in place; test files only with
+// tests. Progress is drawn on out.
+func instrumentModule(dir, tempDir string, tests bool, out io.Writer) (*instrumentedModule, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	root, err := findModuleRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &instrumentedModule{root: root, dir: filepath.Join(tempDir, "src")}
+	m.path, err = copyModule(root, m.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy module: %w", err)
+	}
+
+	files, fileDirs, err := moduleFiles(m.dir, m.path, tests)
+	if err != nil {
+		return nil, err
+	}
+
+	// instrumentOutput is unset, so instrumentFiles writes the copy in place.
+	// Events locate functions in the module rather than in the copy.
+	config := &ast.Config{InstrumentTests: tests, CopyDir: m.dir, SourceDir: root}
+	progress, err := instrumentFiles(files, fileDirs, config, nil, nil, out, false)
+	if err != nil {
+		return nil, fmt.Errorf("instrumentation failed: %w", err)
+	}
+	if progress.Errors > 0 {
+		return nil, fmt.Errorf("instrumentation failed for %d of %d files", progress.Errors, progress.Total)
+	}
+	return m, nil
+}
+
+// packageArg translates a package pattern given relative to the current
+// directory, such as "." or "./cmd/...", into one relative to the copy.
+// Import paths are left as they are.
+func (m *instrumentedModule) packageArg(arg string) (string, error) {
+	if !strings.HasPrefix(arg, ".") && !filepath.IsAbs(arg) {
+		return arg, nil
+	}
+
+	dir, suffix := arg, ""
+	if strings.HasSuffix(arg, "/...") {
+		dir, suffix = strings.TrimSuffix(arg, "/..."), "/..."
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(m.root, abs)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("package %s is outside module %s", arg, m.path)
+	}
+	if rel == "." {
+		return "." + suffix, nil
+	}
+	return "./" + filepath.ToSlash(rel) + suffix, nil
+}
+
+// findModuleRoot returns the nearest directory at or above dir that holds
+// a go.mod
+func findModuleRoot(dir string) (string, error) {
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, "go.mod")); err == nil {
+			return d, nil
+		}
+		if filepath.Dir(d) == d {
+			return "", fmt.Errorf("no go.mod found in %s or any parent directory", dir)
+		}
+	}
+}
+
+// copyModule copies the module at root to dst, leaving out hidden
+// directories and nested modules, and returns its module path. go.mod is
+// rewritten by rewriteGoMod.
+func copyModule(root, dst string) (string, error) {
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if p != root {
+				if strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				if _, err := os.Stat(filepath.Join(p, "go.mod")); err == nil {
+					return filepath.SkipDir
+				}
+			}
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dst, rel), data, 0644)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return rewriteGoMod(filepath.Join(dst, "go.mod"), root)
+}
+
+// rewriteGoMod adapts the go.mod at path, copied from the module at root,
+// to its new place, and returns the module path. Relative replace
+// directives are made absolute so they still resolve, and the flowtrace
+// module is required with requireFlowtrace if it is not already.
+func rewriteGoMod(path, root string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	f, err := modfile.Parse(path, data, nil)
+	if err != nil {
+		return "", err
+	}
+	if f.Module == nil {
+		return "", fmt.Errorf("%s has no module directive", path)
+	}
+
+	changed := false
+	for _, replace := range f.Replace {
+		if replace.New.Version != "" || filepath.IsAbs(replace.New.Path) {
+			continue
+		}
+		dir := filepath.Join(root, filepath.FromSlash(replace.New.Path))
+		if err := f.AddReplace(replace.Old.Path, replace.Old.Version, dir, ""); err != nil {
+			return "", err
+		}
+		changed = true
+	}
+
+	version := ""
+	if !requiresFlowtrace(f) {
+		version = flowctlVersion()
+		if version == "" {
+			return "", fmt.Errorf("module %s does not require %s; add it with go get %s", f.Module.Mod.Path, flowtraceModulePath, flowtraceModulePath)
+		}
+	}
+
+	if changed {
+		formatted, err := f.Format()
+		if err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(path, formatted, 0644); err != nil {
+			return "", err
+		}
+	}
+	if version != "" {
+		if err := requireFlowtrace(filepath.Dir(path), version); err != nil {
+			return "", err
+		}
+	}
+	return f.Module.Mod.Path, nil
+}
+
+// requireFlowtrace requires version of the flowtrace module in the module
+// in dir with go get, which also adds the checksums of the module and its
+// dependencies to go.sum, as builds need them
+func requireFlowtrace(dir, version string) error {
+	goGet := exec.Command("go", "get", flowtraceModulePath+"@"+version)
+	goGet.Dir = dir
+	if out, err := goGet.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to require %s@%s: %w\n%s", flowtraceModulePath, version, err, out)
+	}
+	return nil
+}
+
+// requiresFlowtrace reports whether the module of f is, requires or
+// replaces the flowtrace module
+func requiresFlowtrace(f *modfile.File) bool {
+	if f.Module.Mod.Path == flowtraceModulePath {
+		return true
+	}
+	for _, require := range f.Require {
+		if require.Mod.Path == flowtraceModulePath {
+			return true
+		}
+	}
+	for _, replace := range f.Replace {
+		if replace.Old.Path == flowtraceModulePath {
+			return true
+		}
+	}
+	return false
+}
+
+// flowctlVersion returns the released version of the flowtrace module
+// flowctl was installed from, or "" for a development build
+func flowctlVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Path != flowtraceModulePath {
+		return ""
+	}
+	version := info.Main.Version
+	if !semver.IsValid(version) || semver.Build(version) != "" {
+		return ""
+	}
+	return version
+}
+
+// moduleFiles lists the Go files to instrument in the module copied to
+// root, and maps their directories to import paths below modulePath. Test
+// files unless tests, generated files, vendor and testdata are left out.
+func moduleFiles(root, modulePath string, tests bool) ([]string, map[string]string, error) {
+	var files []string
+	fileDirs := make(map[string]string)
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != root && (d.Name() == "vendor" || d.Name() == "testdata") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(p) != ".go" || (!tests && ast.IsTestFile(p)) || filter.IsGeneratedFile(p) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		files = append(files, p)
+		fileDirs[filepath.Dir(p)] = path.Join(modulePath, filepath.ToSlash(rel))
+		return nil
+	})
+	return files, fileDirs, err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	goast "go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"sort"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/rixmerz/flowtrace-agent-go/internal/ast"
+	"github.com/rixmerz/flowtrace-agent-go/internal/loader"
+)
+
+// skipGenerated is the reason reported for the functions of generated
+// files, which are never transformed
+const skipGenerated = "generated"
+
+// instrumentationReport is the report written by `flowctl instrument
+// --report`, for CI to check how much of the code is traced
+type instrumentationReport struct {
+	Files               int              `json:"files"`
+	Failed              int              `json:"failed"`
+	Instrumented        int              `json:"instrumented"`
+	Skipped             int              `json:"skipped"`
+	InstrumentedPercent float64          `json:"instrumentedPercent"`
+	LinesChanged        int              `json:"linesChanged"`
+	Packages            []*packageReport `json:"packages"`
+
+	byPath map[string]*packageReport
+}
+
+// packageReport is the part of an instrumentationReport about one package
+type packageReport struct {
+	Path         string            `json:"path"`
+	Files        int               `json:"files"`
+	Instrumented []string          `json:"instrumented"`
+	Skipped      []skippedFunction `json:"skipped"`
+	LinesChanged int               `json:"linesChanged"`
+}
+
+// skippedFunction is a function left uninstrumented, with one of the
+// ast.Skip reasons or skipGenerated
+type skippedFunction struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+func newInstrumentationReport() *instrumentationReport {
+	return &instrumentationReport{byPath: make(map[string]*packageReport)}
+}
+
+// pkg returns the report of the package pkgPath, adding it if missing
+func (r *instrumentationReport) pkg(pkgPath string) *packageReport {
+	p, ok := r.byPath[pkgPath]
+	if !ok {
+		p = &packageReport{Path: pkgPath, Instrumented: []string{}, Skipped: []skippedFunction{}}
+		r.byPath[pkgPath] = p
+		r.Packages = append(r.Packages, p)
+	}
+	return p
+}
+
+// addResult records the transformation of a file of package pkgPath, which
+// changed linesChanged lines of it
+func (r *instrumentationReport) addResult(pkgPath string, result *ast.TransformResult, linesChanged int) {
+	if result.Error != nil {
+		r.Failed++
+		return
+	}
+	p := r.pkg(pkgPath)
+	p.Files++
+	p.Instrumented = append(p.Instrumented, result.Instrumented...)
+	for _, skipped := range result.Skipped {
+		p.Skipped = append(p.Skipped, skippedFunction{Name: skipped.Name, Reason: skipped.Reason})
+	}
+	p.LinesChanged += linesChanged
+}
+
+// addGenerated records the functions of a generated file of package
+// pkgPath as skipped
+func (r *instrumentationReport) addGenerated(pkgPath, path string) error {
+	file, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.SkipObjectResolution)
+	if err != nil {
+		return err
+	}
+	p := r.pkg(pkgPath)
+	for _, decl := range file.Decls {
+		if fn, ok := decl.(*goast.FuncDecl); ok {
+			p.Skipped = append(p.Skipped, skippedFunction{Name: ast.FuncDeclName(fn), Reason: skipGenerated})
+		}
+	}
+	return nil
+}
+
+// write totals the report and writes it to path as indented JSON
+func (r *instrumentationReport) write(path string) error {
+	sort.Slice(r.Packages, func(i, j int) bool { return r.Packages[i].Path < r.Packages[j].Path })
+	r.Files, r.Instrumented, r.Skipped, r.LinesChanged = 0, 0, 0, 0
+	for _, p := range r.Packages {
+		r.Files += p.Files
+		r.Instrumented += len(p.Instrumented)
+		r.Skipped += len(p.Skipped)
+		r.LinesChanged += p.LinesChanged
+	}
+	r.InstrumentedPercent = 0
+	if total := r.Instrumented + r.Skipped; total > 0 {
+		r.InstrumentedPercent = 100 * float64(r.Instrumented) / float64(total)
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
+
+// changedLines returns the number of lines instrumenting file adds and
+// removes, as counted by a diff of its source with the transformed result
+func changedLines(file string, result *ast.TransformResult) (int, error) {
+	before, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	after, err := loader.FormatFile(result.FileSet, result.File)
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	matcher := difflib.NewMatcher(difflib.SplitLines(string(before)), difflib.SplitLines(string(after)))
+	for _, op := range matcher.GetOpCodes() {
+		if op.Tag != 'e' {
+			changed += (op.I2 - op.I1) + (op.J2 - op.J1)
+		}
+	}
+	return changed, nil
+}
@@ -1,36 +1,61 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
-	"io/ioutil"
+	goast "go/ast"
+	"go/parser"
+	"go/token"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
 
+	"github.com/rixmerz/flowtrace-agent-go/internal/ast"
 	"github.com/spf13/cobra"
 )
 
 var runCmd = &cobra.Command{
-	Use:   "run [flags] [file.go]",
+	Use:   "run [flags] <package | file.go> [program args...]",
 	Short: "Run Go program with automatic instrumentation",
 	Long: `Run a Go program with automatic FlowTrace instrumentation.
 
-This command instruments the code, then runs it with 'go run'.
-The original source code is not modified.
+This command copies the module of the program to a temporary directory,
+instruments every package of the copy and runs the program built from it,
+with tracing started from FLOWTRACE_* environment variables. The original
+source code is not modified.
+
+The program runs in the current directory and gets the arguments after the
+package or file, and the standard input of flowctl.
 
 Examples:
+  # Run the package in the current directory
+  flowctl run .
+
+  # Run a command of the module, with arguments
+  flowctl run ./cmd/app --port 8080
+
   # Run main.go
   flowctl run main.go
 
-  # Run with arguments
-  flowctl run main.go --arg1 value1
-
   # Run with environment variables
-  FLOWTRACE_LOGFILE=trace.jsonl flowctl run main.go`,
+  FLOWTRACE_LOGFILE=trace.jsonl flowctl run ./cmd/app`,
 	Args: cobra.MinimumNArgs(1),
 	RunE: runRun,
 }
 
+func init() {
+	// Flags after the package belong to the program
+	runCmd.Flags().SetInterspersed(false)
+}
+
+// runStarterFile is the file added to the main package of the program to
+// start tracing
+const runStarterFile = "flowtrace_run.go"
+
 func runRun(cmd *cobra.Command, args []string) error {
 	verbose, _ := cmd.Flags().GetBool("verbose")
 
@@ -38,11 +63,20 @@ func runRun(cmd *cobra.Command, args []string) error {
 		fmt.Println("🏃 FlowTrace Run")
 	}
 
-	mainFile := args[0]
+	target := args[0]
 	programArgs := args[1:]
 
+	// A .go file names its package, and is then built on its own as by
+	// go run file.go
+	pkgDir := target
+	var mainFiles []string
+	if strings.HasSuffix(target, ".go") {
+		pkgDir = filepath.Dir(target)
+		mainFiles = []string{filepath.Base(target)}
+	}
+
 	// Create temporary directory for instrumented code
-	tempDir, err := ioutil.TempDir("", "flowtrace-run-*")
+	tempDir, err := os.MkdirTemp("", "flowtrace-run-*")
 	if err != nil {
 		return fmt.Errorf("failed to create temp directory: %w", err)
 	}
@@ -52,33 +86,57 @@ func runRun(cmd *cobra.Command, args []string) error {
 		fmt.Printf("📁 Temp directory: %s\n", tempDir)
 	}
 
-	// Get directory containing main file
-	mainDir := filepath.Dir(mainFile)
-	if mainDir == "." {
-		mainDir, _ = os.Getwd()
-	} else {
-		mainDir, _ = filepath.Abs(mainDir)
+	// Copy the module and instrument every package of the copy
+	if verbose {
+		fmt.Println("⚙️  Instrumenting code...")
 	}
 
-	// Instrument the package
+	var progressOut io.Writer = io.Discard
 	if verbose {
-		fmt.Println("⚙️  Instrumenting code...")
+		progressOut = os.Stderr
+	}
+	module, err := instrumentModule(pkgDir, tempDir, false, progressOut)
+	if err != nil {
+		return err
 	}
 
-	instrumentArgs := []string{
-		"instrument",
-		"--output", tempDir,
-		"--exclude", "**/*_test.go",
-		"--exclude", "**/vendor/**",
-		mainDir,
+	pkgArg, err := module.packageArg(localPackage(pkgDir))
+	if err != nil {
+		return err
+	}
+	started, err := addRunStarter(filepath.Join(module.dir, filepath.FromSlash(pkgArg)), mainFiles)
+	if err != nil {
+		return err
+	}
+	if started {
+		mainFiles = append(mainFiles, runStarterFile)
 	}
 
-	instrumentCmd := exec.Command("flowctl", instrumentArgs...)
-	instrumentCmd.Stdout = os.Stdout
-	instrumentCmd.Stderr = os.Stderr
+	// Build the program, so that it runs in the current directory rather
+	// than in the copy
+	if verbose {
+		fmt.Println("🔨 Building instrumented code...")
+	}
 
-	if err := instrumentCmd.Run(); err != nil {
-		return fmt.Errorf("instrumentation failed: %w", err)
+	binary := filepath.Join(tempDir, "program")
+	if runtime.GOOS == "windows" {
+		binary += ".exe"
+	}
+	buildArgs := []string{"build", "-o", binary}
+	if strings.HasSuffix(target, ".go") {
+		for _, file := range mainFiles {
+			buildArgs = append(buildArgs, pkgArg+"/"+file)
+		}
+	} else {
+		buildArgs = append(buildArgs, pkgArg)
+	}
+
+	goBuild := exec.Command("go", buildArgs...)
+	goBuild.Dir = module.dir
+	goBuild.Stdout = os.Stderr
+	goBuild.Stderr = os.Stderr
+	if err := goBuild.Run(); err != nil {
+		return fmt.Errorf("build failed: %w", err)
 	}
 
 	// Run instrumented code
@@ -86,24 +144,95 @@ func runRun(cmd *cobra.Command, args []string) error {
 		fmt.Println("🏃 Running instrumented code...")
 	}
 
-	// Calculate instrumented file path
-	relPath, _ := filepath.Rel(mainDir, mainFile)
-	instrumentedFile := filepath.Join(tempDir, filepath.Base(mainDir), relPath)
-
-	// Prepare go run command
-	runArgs := []string{"run", instrumentedFile}
-	runArgs = append(runArgs, programArgs...)
+	program := exec.Command(binary, programArgs...)
+	program.Stdout = os.Stdout
+	program.Stderr = os.Stderr
+	program.Stdin = os.Stdin
+	program.Env = os.Environ()
 
-	// Run go run
-	goRun := exec.Command("go", runArgs...)
-	goRun.Stdout = os.Stdout
-	goRun.Stderr = os.Stderr
-	goRun.Stdin = os.Stdin
-	goRun.Env = os.Environ()
-
-	if err := goRun.Run(); err != nil {
+	if err := program.Run(); err != nil {
 		return fmt.Errorf("run failed: %w", err)
 	}
 
 	return nil
 }
+
+// addRunStarter adds a file starting tracing to the package in dir, unless
+// the package starts it itself. With mainFiles, only those files of the
+// package are checked. The main function is made to stop tracing when it
+// returns, so that the trace is flushed and closed. It reports whether the
+// file was added.
+func addRunStarter(dir string, mainFiles []string) (bool, error) {
+	if len(mainFiles) == 0 {
+		matches, err := filepath.Glob(filepath.Join(dir, "*.go"))
+		if err != nil {
+			return false, err
+		}
+		for _, match := range matches {
+			if !ast.IsTestFile(match) {
+				mainFiles = append(mainFiles, filepath.Base(match))
+			}
+		}
+	}
+	if len(mainFiles) == 0 {
+		return false, fmt.Errorf("no Go files in %s", dir)
+	}
+
+	pkgName := ""
+	mainFile, mainData, mainBody := "", []byte(nil), -1
+	for _, name := range mainFiles {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return false, err
+		}
+		if bytes.Contains(data, []byte("flowtrace.Start(")) {
+			return false, nil
+		}
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, name, data, parser.SkipObjectResolution)
+		if err != nil {
+			return false, err
+		}
+		if pkgName == "" {
+			pkgName = file.Name.Name
+		}
+		for _, decl := range file.Decls {
+			if fn, ok := decl.(*goast.FuncDecl); ok && fn.Recv == nil && fn.Name.Name == "main" && fn.Body != nil {
+				mainFile, mainData, mainBody = name, data, fset.Position(fn.Body.Lbrace).Offset+1
+			}
+		}
+	}
+
+	// The deferred stop is the first statement of main, so it runs after
+	// the deferred exit of main itself. It is kept on the line of the brace
+	// so the lines of the file are unchanged.
+	if mainBody >= 0 {
+		stopped := slices.Concat(mainData[:mainBody], []byte(" defer __ft_stop();"), mainData[mainBody:])
+		if err := os.WriteFile(filepath.Join(dir, mainFile), stopped, 0644); err != nil {
+			return false, err
+		}
+	}
+
+	starter := fmt.Sprintf(`// Code generated by flowctl run. DO NOT EDIT.
+
+package %s
+
+import "%s"
+
+func init() {
+	if err := flowtrace.Start(*flowtrace.LoadConfigFromEnv()); err != nil {
+		println("flowtrace:", err.Error())
+	}
+}
+
+// __ft_stop is deferred by main to flush and close the trace when it
+// returns; os.Exit skips it
+func __ft_stop() {
+	if err := flowtrace.Stop(); err != nil {
+		println("flowtrace:", err.Error())
+	}
+}
+`, pkgName, ast.DefaultFlowtracePkgPath)
+
+	return true, os.WriteFile(filepath.Join(dir, runStarterFile), []byte(starter), 0644)
+}
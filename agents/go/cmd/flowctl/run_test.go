@@ -0,0 +1,149 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeHelloModule writes a module using the flowtrace agent of this
+// repository, with a command ./cmd/hello of two files using a package
+// ./greet, and changes to it. The command writes a greeting of its args and
+// its stdin to out.txt.
+func writeHelloModule(t *testing.T) {
+	t.Helper()
+
+	if testing.Short() {
+		t.Skip("builds a program")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+
+	agent, err := filepath.Abs("../..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	goSum, err := os.ReadFile(filepath.Join(agent, "go.sum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	module := t.TempDir()
+	// A relative replace, which only resolves once made absolute in the copy
+	replace, err := filepath.Rel(module, agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"go.mod": "module example.com/hello\n\ngo 1.24\n\n" +
+			"require github.com/rixmerz/flowtrace-agent-go v0.0.0\n\n" +
+			"replace github.com/rixmerz/flowtrace-agent-go => " + filepath.ToSlash(replace) + "\n",
+		"go.sum": string(goSum),
+		"cmd/hello/main.go": `package main
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"example.com/hello/greet"
+)
+
+func main() {
+	input, _ := io.ReadAll(os.Stdin)
+	os.WriteFile("out.txt", []byte(greet.Hello(strings.Join(os.Args[1:], " "))+shout(string(input))), 0644)
+}
+`,
+		"cmd/hello/shout.go": "package main\n\nimport \"strings\"\n\nfunc shout(s string) string {\n\treturn strings.ToUpper(s)\n}\n",
+		"greet/greet.go":     "package greet\n\nfunc Hello(name string) string {\n\treturn \"hello \" + name + \"\\n\"\n}\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(module, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	t.Chdir(module)
+	t.Setenv("GOFLAGS", "-mod=mod")
+}
+
+func TestRunPackage(t *testing.T) {
+	writeHelloModule(t)
+
+	logFile := filepath.Join(t.TempDir(), "trace.jsonl")
+	t.Setenv("FLOWTRACE_LOGFILE", logFile)
+
+	stdin, err := os.CreateTemp(t.TempDir(), "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin.WriteString("bye")
+	stdin.Seek(0, 0)
+	defer stdin.Close()
+	oldStdin := os.Stdin
+	os.Stdin = stdin
+	t.Cleanup(func() { os.Stdin = oldStdin })
+
+	if err := runRun(runCmd, []string{"./cmd/hello", "big", "world"}); err != nil {
+		t.Fatalf("runRun failed: %v", err)
+	}
+
+	out, err := os.ReadFile("out.txt")
+	if err != nil {
+		t.Fatalf("Expected the program to run in the current directory: %v", err)
+	}
+	if string(out) != "hello big world\nBYE" {
+		t.Errorf("Expected the program to get its args and stdin, got %q", out)
+	}
+
+	trace, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("Expected a trace to be written: %v", err)
+	}
+	for _, want := range []string{`"method":"main"`, `"method":"shout"`, `"method":"Hello"`} {
+		if !strings.Contains(string(trace), want) {
+			t.Errorf("Expected the trace to contain %s, got:\n%s", want, trace)
+		}
+	}
+	if _, err := os.Stat(filepath.Join("cmd", "hello", runStarterFile)); !os.IsNotExist(err) {
+		t.Error("Expected the source to be left alone")
+	}
+}
+
+func TestRunStopsTracing(t *testing.T) {
+	writeHelloModule(t)
+
+	// A gzip stream is only complete once the tracer is stopped
+	logFile := filepath.Join(t.TempDir(), "trace.jsonl.gz")
+	t.Setenv("FLOWTRACE_LOGFILE", logFile)
+	t.Setenv("FLOWTRACE_COMPRESS", "true")
+
+	if err := runRun(runCmd, []string{"./cmd/hello", "you"}); err != nil {
+		t.Fatalf("runRun failed: %v", err)
+	}
+
+	f, err := os.Open(logFile)
+	if err != nil {
+		t.Fatalf("Expected a trace to be written: %v", err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Invalid gzip trace: %v", err)
+	}
+	trace, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("Expected a complete gzip trace: %v", err)
+	}
+	if strings.Count(string(trace), `"method":"main"`) != 2 {
+		t.Errorf("Expected the trace to hold the enter and exit of main, got:\n%s", trace)
+	}
+}
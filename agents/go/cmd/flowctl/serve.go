@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/tracefile"
+	"github.com/spf13/cobra"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve [flags]",
+	Short: "Serve a live dashboard of a trace file",
+	Long: `Follow a FlowTrace JSONL trace as it is written and serve a dashboard of it.
+
+The page shows the call count and latency percentiles of every function, as
+stats prints them, the most recent calls slower than --slow, and the call
+tree of the latest requests, refreshed as events are appended. The file may
+not exist yet; it is picked up once the traced program starts writing it,
+and read again from the start when it is truncated.
+
+The data behind the page is served as JSON, for scripts:
+  /api/stats     per-function statistics, sorted by total time
+  /api/slow      recent slow calls, newest first
+  /api/tree      call trees of the latest top level calls
+  /events        server-sent "update" events as the trace grows
+
+Examples:
+  # Watch the trace of a running program at http://localhost:7070
+  flowctl serve --file flowtrace.jsonl
+
+  # Listen on another port and list calls over 10ms as slow
+  flowctl serve --file flowtrace.jsonl --addr :8080 --slow 10ms`,
+	Args: cobra.NoArgs,
+	RunE: runServe,
+}
+
+var (
+	serveFile string
+	serveAddr string
+	serveSlow time.Duration
+)
+
+func init() {
+	serveCmd.Flags().StringVarP(&serveFile, "file", "f", "flowtrace.jsonl", "trace file to follow")
+	serveCmd.Flags().StringVar(&serveAddr, "addr", "localhost:7070", "address to listen on")
+	serveCmd.Flags().DurationVar(&serveSlow, "slow", 100*time.Millisecond, "list calls taking at least this long as slow")
+}
+
+const (
+	// servePollInterval is how often the trace file is checked for new events
+	servePollInterval = 250 * time.Millisecond
+	// maxLiveEvents bounds the events kept in memory; the oldest half is
+	// dropped when it is reached
+	maxLiveEvents = 200000
+	// maxSlowCalls is the number of recent slow calls kept
+	maxSlowCalls = 50
+	// maxTreeRoots is the number of latest top level calls in /api/tree
+	maxTreeRoots = 20
+)
+
+//go:embed serve.html
+var serveHTML []byte
+
+func runServe(cmd *cobra.Command, args []string) error {
+	live := newLiveTrace(serveSlow)
+	tailer := &traceTailer{path: serveFile}
+
+	go func() {
+		for {
+			events, reset, err := tailer.poll()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "⚠️  Failed to read %s: %v\n", serveFile, err)
+			}
+			if reset {
+				live.reset()
+			}
+			live.add(events)
+			time.Sleep(servePollInterval)
+		}
+	}()
+
+	fmt.Printf("📈 Serving %s at http://%s\n", serveFile, serveAddr)
+	return http.ListenAndServe(serveAddr, live.handler())
+}
+
+// traceTailer reads the events appended to a trace file since it was last
+// polled
+type traceTailer struct {
+	path    string
+	offset  int64  // bytes of the file read so far
+	partial []byte // start of a line whose end isn't written yet
+}
+
+// poll returns the events of the lines completed since the last poll.
+// reset is set when the file shrank, e.g. was truncated or replaced by a
+// new run; it is then read from the start. A missing file has no events
+// yet. Lines that aren't events and METADATA records are skipped.
+func (t *traceTailer) poll() (events []tracefile.Event, reset bool, err error) {
+	f, err := os.Open(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if info.Size() < t.offset {
+		t.offset = 0
+		t.partial = nil
+		reset = true
+	}
+	if info.Size() == t.offset {
+		return nil, reset, nil
+	}
+
+	if _, err := f.Seek(t.offset, io.SeekStart); err != nil {
+		return nil, reset, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, reset, err
+	}
+	t.offset += int64(len(data))
+
+	data = append(t.partial, data...)
+	end := bytes.LastIndexByte(data, '\n')
+	t.partial = slices.Clone(data[end+1:])
+
+	for _, line := range bytes.Split(data[:end+1], []byte("\n")) {
+		var event tracefile.Event
+		if len(bytes.TrimSpace(line)) == 0 || json.Unmarshal(line, &event) != nil {
+			continue
+		}
+		if event.Event == "METADATA" {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, reset, nil
+}
+
+// liveTrace aggregates the events of a followed trace for the dashboard
+type liveTrace struct {
+	slow time.Duration
+
+	mu      sync.Mutex
+	events  []tracefile.Event
+	recent  []slowCall    // recent slow calls, oldest first
+	total   int           // events added since the last reset
+	changed chan struct{} // closed and replaced when events are added
+}
+
+// slowCall is a call listed by /api/slow
+type slowCall struct {
+	Name      string `json:"name"`
+	Thread    string `json:"thread"`
+	Timestamp int64  `json:"timestamp"`
+	Duration  int64  `json:"durationMicros"`
+	Exception string `json:"exception,omitempty"`
+}
+
+// liveCall is a node of the call trees served by /api/tree
+type liveCall struct {
+	Name        string      `json:"name"`
+	Thread      string      `json:"thread"`
+	Start       int64       `json:"start"`
+	Duration    int64       `json:"durationMicros"`
+	Exception   string      `json:"exception,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	MissingExit bool        `json:"missingExit,omitempty"`
+	Children    []*liveCall `json:"children,omitempty"`
+}
+
+// liveUpdate is the data of the update events of /events
+type liveUpdate struct {
+	Events int `json:"events"`
+}
+
+func newLiveTrace(slow time.Duration) *liveTrace {
+	return &liveTrace{slow: slow, changed: make(chan struct{})}
+}
+
+// add appends events and wakes up the clients waiting for an update
+func (l *liveTrace) add(events []tracefile.Event) {
+	if len(events) == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events = append(l.events, events...)
+	if len(l.events) > maxLiveEvents {
+		l.events = slices.Clone(l.events[len(l.events)-maxLiveEvents/2:])
+	}
+	l.total += len(events)
+
+	for _, event := range events {
+		if (event.Event == "EXIT" || event.Event == "EXCEPTION") && event.Duration() >= l.slow {
+			l.recent = append(l.recent, slowCall{
+				Name:      functionName(event),
+				Thread:    event.Thread,
+				Timestamp: event.Timestamp,
+				Duration:  event.Duration().Microseconds(),
+				Exception: event.Exception,
+			})
+		}
+	}
+	if len(l.recent) > maxSlowCalls {
+		l.recent = slices.Clone(l.recent[len(l.recent)-maxSlowCalls:])
+	}
+	l.notify()
+}
+
+// reset drops the events of a trace file that was truncated
+func (l *liveTrace) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events = nil
+	l.recent = nil
+	l.total = 0
+	l.notify()
+}
+
+// notify wakes up the clients waiting for an update; l.mu must be held
+func (l *liveTrace) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// update returns the current update and a channel closed on the next one
+func (l *liveTrace) update() (liveUpdate, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return liveUpdate{Events: l.total}, l.changed
+}
+
+// stats returns the per-function statistics of the events kept
+func (l *liveTrace) stats() []functionStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return computeStats(l.events)
+}
+
+// slowCalls returns the recent slow calls, newest first
+func (l *liveTrace) slowCalls() []slowCall {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	calls := append(make([]slowCall, 0, len(l.recent)), l.recent...)
+	slices.Reverse(calls)
+	return calls
+}
+
+// tree returns the call trees of the latest top level calls, newest first
+func (l *liveTrace) tree() []*liveCall {
+	// Events kept are never changed, only appended to or dropped
+	l.mu.Lock()
+	events := l.events
+	l.mu.Unlock()
+	tree := tracefile.BuildTree(events)
+
+	var roots []*tracefile.Call
+	for _, thread := range tree.Threads {
+		roots = append(roots, tree.Roots[thread]...)
+	}
+	slices.SortStableFunc(roots, func(a, b *tracefile.Call) int {
+		return cmp.Compare(b.Start, a.Start)
+	})
+	if len(roots) > maxTreeRoots {
+		roots = roots[:maxTreeRoots]
+	}
+
+	calls := make([]*liveCall, 0, len(roots))
+	for _, root := range roots {
+		calls = append(calls, newLiveCall(root))
+	}
+	return calls
+}
+
+// newLiveCall converts a call and its callees for /api/tree. The duration
+// of a call still running is the sum of its callees so far, as in tui.
+func newLiveCall(call *tracefile.Call) *liveCall {
+	live := &liveCall{
+		Name:        call.Name(),
+		Thread:      call.Thread,
+		Start:       call.Start,
+		Duration:    call.Duration.Microseconds(),
+		Exception:   call.Exception,
+		Error:       call.Error,
+		MissingExit: call.MissingExit,
+	}
+	var callees int64
+	for _, child := range call.Children {
+		node := newLiveCall(child)
+		callees += node.Duration
+		live.Children = append(live.Children, node)
+	}
+	if call.MissingExit && live.Duration == 0 {
+		live.Duration = callees
+	}
+	return live
+}
+
+// handler serves the dashboard and its data
+func (l *liveTrace) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(serveHTML)
+	})
+	mux.HandleFunc("GET /api/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, l.stats())
+	})
+	mux.HandleFunc("GET /api/slow", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, l.slowCalls())
+	})
+	mux.HandleFunc("GET /api/tree", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, l.tree())
+	})
+	mux.HandleFunc("GET /events", l.serveEvents)
+	return mux
+}
+
+// serveEvents streams an update event right away and then whenever events
+// are added, until the client goes away
+func (l *liveTrace) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	for {
+		update, changed := l.update()
+		data, _ := json.Marshal(update)
+		fmt.Fprintf(w, "event: update\ndata: %s\n\n", data)
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeJSON writes v as the JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
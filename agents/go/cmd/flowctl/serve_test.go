@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/tracefile"
+)
+
+// appendLines appends text to the file at path
+func appendLines(t *testing.T, path, text string) {
+	t.Helper()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open trace: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(text); err != nil {
+		t.Fatalf("Failed to write trace: %v", err)
+	}
+}
+
+// pollMethods polls tailer and returns the methods of its events
+func pollMethods(t *testing.T, tailer *traceTailer) ([]string, bool) {
+	t.Helper()
+
+	events, reset, err := tailer.poll()
+	if err != nil {
+		t.Fatalf("poll failed: %v", err)
+	}
+	var methods []string
+	for _, event := range events {
+		methods = append(methods, event.Method)
+	}
+	return methods, reset
+}
+
+func TestTraceTailer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	tailer := &traceTailer{path: path}
+
+	// Not written yet
+	if methods, _ := pollMethods(t, tailer); len(methods) != 0 {
+		t.Fatalf("Expected no events before the file exists, got %v", methods)
+	}
+
+	appendLines(t, path, `{"event":"METADATA","metadata":{"pid":1}}`+"\n"+
+		`{"event":"ENTER","method":"A"}`+"\n"+
+		`not json`+"\n"+
+		`{"event":"ENTER","meth`)
+	if methods, _ := pollMethods(t, tailer); strings.Join(methods, ",") != "A" {
+		t.Errorf("Expected the complete event only, got %v", methods)
+	}
+
+	// The rest of the partial line arrives
+	appendLines(t, path, `od":"B"}`+"\n")
+	if methods, _ := pollMethods(t, tailer); strings.Join(methods, ",") != "B" {
+		t.Errorf("Expected the completed line, got %v", methods)
+	}
+	if methods, _ := pollMethods(t, tailer); len(methods) != 0 {
+		t.Errorf("Expected no events without new lines, got %v", methods)
+	}
+
+	// A new run truncates the file
+	if err := os.WriteFile(path, []byte(`{"event":"ENTER","method":"C"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	methods, reset := pollMethods(t, tailer)
+	if !reset || strings.Join(methods, ",") != "C" {
+		t.Errorf("Expected a reset and the new event, got %v, reset %v", methods, reset)
+	}
+}
+
+// liveFixture returns a liveTrace fed with the fixture trace, listing calls
+// of at least 500µs as slow
+func liveFixture(t *testing.T) *liveTrace {
+	t.Helper()
+
+	events, err := tracefile.ReadFile(filepath.Join("testdata", "trace.jsonl"))
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+	live := newLiveTrace(500 * time.Microsecond)
+	live.add(events)
+	return live
+}
+
+// getJSON requests path from handler and decodes the JSON response into v
+func getJSON(t *testing.T, handler http.Handler, path string, v interface{}) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d", path, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("GET %s: expected JSON, got %q", path, ct)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("GET %s: invalid JSON %s: %v", path, w.Body, err)
+	}
+}
+
+func TestServeStats(t *testing.T) {
+	live := liveFixture(t)
+
+	var stats []functionStats
+	getJSON(t, live.handler(), "/api/stats", &stats)
+
+	events, _ := tracefile.ReadFile(filepath.Join("testdata", "trace.jsonl"))
+	want := computeStats(events)
+	if len(stats) != len(want) || len(stats) == 0 {
+		t.Fatalf("Expected %d functions, got %d", len(want), len(stats))
+	}
+	for i := range want {
+		if stats[i] != want[i] {
+			t.Errorf("Expected %+v, got %+v", want[i], stats[i])
+		}
+	}
+}
+
+func TestServeSlowCalls(t *testing.T) {
+	live := liveFixture(t)
+
+	var calls []slowCall
+	getJSON(t, live.handler(), "/api/slow", &calls)
+	if len(calls) == 0 {
+		t.Fatal("Expected slow calls")
+	}
+	for _, call := range calls {
+		if call.Duration < 500 {
+			t.Errorf("Expected calls of at least 500µs, got %+v", call)
+		}
+	}
+
+	// Only the most recent are kept, the last written first
+	for i := 0; i < maxSlowCalls; i++ {
+		live.add([]tracefile.Event{{Event: "EXIT", Method: "Slow", Timestamp: int64(i), DurationMicros: 1000}})
+	}
+	getJSON(t, live.handler(), "/api/slow", &calls)
+	if len(calls) != maxSlowCalls || calls[0].Timestamp != maxSlowCalls-1 || calls[len(calls)-1].Name != "Slow" {
+		t.Errorf("Expected the %d latest slow calls, got %d starting with %+v", maxSlowCalls, len(calls), calls[0])
+	}
+}
+
+func TestServeTree(t *testing.T) {
+	live := newLiveTrace(time.Second)
+	live.add([]tracefile.Event{
+		{Event: "ENTER", Timestamp: 100, Class: "main", Method: "First", Thread: "goroutine-1"},
+		{Event: "EXIT", Timestamp: 150, Class: "main", Method: "First", Thread: "goroutine-1", DurationMicros: 50},
+		{Event: "ENTER", Timestamp: 200, Class: "main", Method: "Handle", Thread: "goroutine-1"},
+		{Event: "ENTER", Timestamp: 210, Class: "db", Method: "Query", Thread: "goroutine-1"},
+		{Event: "EXIT", Timestamp: 240, Class: "db", Method: "Query", Thread: "goroutine-1", DurationMicros: 30},
+	})
+
+	var roots []*liveCall
+	getJSON(t, live.handler(), "/api/tree", &roots)
+	if len(roots) != 2 || roots[0].Name != "main.Handle" || roots[1].Name != "main.First" {
+		t.Fatalf("Expected the latest call first, got %+v", roots)
+	}
+	running := roots[0]
+	if !running.MissingExit || running.Duration != 30 || len(running.Children) != 1 || running.Children[0].Name != "db.Query" {
+		t.Errorf("Expected the running call to last as long as its callees so far, got %+v", running)
+	}
+}
+
+func TestServeEvents(t *testing.T) {
+	live := newLiveTrace(time.Second)
+	server := httptest.NewServer(live.handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatalf("GET /events failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected an event stream, got %q", ct)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	next := func() string {
+		t.Helper()
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Failed to read event: %v", err)
+			}
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				return strings.TrimSpace(data)
+			}
+		}
+	}
+
+	if data := next(); data != `{"events":0}` {
+		t.Errorf("Expected the current state first, got %s", data)
+	}
+	live.add([]tracefile.Event{{Event: "ENTER", Method: "A"}, {Event: "EXIT", Method: "A"}})
+	if data := next(); data != `{"events":2}` {
+		t.Errorf("Expected an update once events are added, got %s", data)
+	}
+}
+
+func TestServePage(t *testing.T) {
+	w := httptest.NewRecorder()
+	newLiveTrace(time.Second).handler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `new EventSource("events")`) {
+		t.Errorf("Expected the dashboard page, got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/tracefile"
+	"github.com/spf13/cobra"
+)
+
+var statsCmd = &cobra.Command{
+	Use:   "stats [flags] trace.jsonl",
+	Short: "Print per-function timing statistics of a trace file",
+	Long: `Summarize where time is spent in a FlowTrace JSONL trace.
+
+Every EXIT event is counted towards its function, and the call count, total,
+minimum, maximum and average duration and the p50/p95/p99 percentiles are
+printed per function, sorted by total time.
+
+With --hist, a histogram of each function's call durations follows, in
+buckets doubling in width, so distributions with several peaks, such as fast
+cache hits and slow database reads, stand out where percentiles blur them.
+
+Examples:
+  # Print statistics for every function
+  flowctl stats flowtrace.jsonl
+
+  # Only the ten most expensive functions
+  flowctl stats --top 10 flowtrace.jsonl
+
+  # With the distribution of each function's durations
+  flowctl stats --hist --top 5 flowtrace.jsonl
+
+  # Machine-readable output
+  flowctl stats --json flowtrace.jsonl`,
+	Args: cobra.ExactArgs(1),
+	RunE: runStats,
+}
+
+var (
+	statsTop  int
+	statsJSON bool
+	statsHist bool
+)
+
+func init() {
+	statsCmd.Flags().IntVarP(&statsTop, "top", "n", 0, "only show the N functions with the highest total time")
+	statsCmd.Flags().BoolVar(&statsJSON, "json", false, "print statistics as JSON")
+	statsCmd.Flags().BoolVar(&statsHist, "hist", false, "also print a histogram of the call durations of each function")
+}
+
+// functionStats holds the aggregated durations of one function, in
+// microseconds
+type functionStats struct {
+	Name  string  `json:"name"`
+	Calls int     `json:"calls"`
+	Total int64   `json:"totalMicros"`
+	Min   int64   `json:"minMicros"`
+	Max   int64   `json:"maxMicros"`
+	Avg   float64 `json:"avgMicros"`
+	P50   int64   `json:"p50Micros"`
+	P95   int64   `json:"p95Micros"`
+	P99   int64   `json:"p99Micros"`
+}
+
+func runStats(cmd *cobra.Command, args []string) error {
+	events, err := tracefile.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to read trace: %w", err)
+	}
+
+	stats := computeStats(events)
+	if statsTop > 0 && len(stats) > statsTop {
+		stats = stats[:statsTop]
+	}
+
+	if statsHist {
+		histograms := computeHistograms(events)
+		if statsJSON {
+			return writeHistogramsJSON(os.Stdout, stats, histograms)
+		}
+		if err := writeStatsTable(os.Stdout, stats); err != nil {
+			return err
+		}
+		return writeHistograms(os.Stdout, stats, histograms)
+	}
+
+	if statsJSON {
+		return writeStatsJSON(os.Stdout, stats)
+	}
+	return writeStatsTable(os.Stdout, stats)
+}
+
+// computeStats aggregates the durations of EXIT events per function,
+// sorted by total time descending and then by name
+func computeStats(events []tracefile.Event) []functionStats {
+	durations := exitDurations(events)
+	stats := make([]functionStats, 0, len(durations))
+	for name, values := range durations {
+		sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+		var total int64
+		for _, v := range values {
+			total += v
+		}
+
+		stats = append(stats, functionStats{
+			Name:  name,
+			Calls: len(values),
+			Total: total,
+			Min:   values[0],
+			Max:   values[len(values)-1],
+			Avg:   float64(total) / float64(len(values)),
+			P50:   percentile(values, 50),
+			P95:   percentile(values, 95),
+			P99:   percentile(values, 99),
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Total != stats[j].Total {
+			return stats[i].Total > stats[j].Total
+		}
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+// exitDurations returns the durations of the EXIT events of each function,
+// in microseconds
+func exitDurations(events []tracefile.Event) map[string][]int64 {
+	durations := make(map[string][]int64)
+	for _, event := range events {
+		if event.Event == "EXIT" {
+			name := functionName(event)
+			durations[name] = append(durations[name], event.DurationMicros)
+		}
+	}
+	return durations
+}
+
+// functionName returns the qualified function name of an event, e.g.
+// db.Query
+func functionName(event tracefile.Event) string {
+	if event.Class == "" {
+		return event.Method
+	}
+	return event.Class + "." + event.Method
+}
+
+// percentile returns the p-th percentile of sorted using the nearest-rank
+// method: the smallest value at least p percent of the values are at or
+// below
+func percentile(sorted []int64, p float64) int64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// writeStatsTable prints the statistics as an aligned table
+func writeStatsTable(w io.Writer, stats []functionStats) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FUNCTION\tCALLS\tTOTAL\tMIN\tMAX\tAVG\tP50\tP95\tP99")
+	for _, s := range stats {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			s.Name, s.Calls,
+			formatMicros(float64(s.Total)), formatMicros(float64(s.Min)), formatMicros(float64(s.Max)),
+			formatMicros(s.Avg), formatMicros(float64(s.P50)), formatMicros(float64(s.P95)), formatMicros(float64(s.P99)))
+	}
+	return tw.Flush()
+}
+
+// writeStatsJSON prints the statistics as an indented JSON array
+func writeStatsJSON(w io.Writer, stats []functionStats) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(stats)
+}
+
+// formatMicros renders a duration given in microseconds like formatDuration
+func formatMicros(micros float64) string {
+	return formatDuration(time.Duration(micros * float64(time.Microsecond)))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/tracefile"
+)
+
+func loadStatsFixture(t *testing.T) []functionStats {
+	t.Helper()
+
+	// db.Query takes 1ms..100ms in shuffled order, cache.Get 100µs..400µs,
+	// init 1ms once; worker.Run only raised an EXCEPTION
+	events, err := tracefile.ReadFile("testdata/stats.jsonl")
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+	return computeStats(events)
+}
+
+func TestComputeStats(t *testing.T) {
+	stats := loadStatsFixture(t)
+
+	expected := []functionStats{
+		{Name: "db.Query", Calls: 100, Total: 5050000, Min: 1000, Max: 100000, Avg: 50500, P50: 50000, P95: 95000, P99: 99000},
+		{Name: "cache.Get", Calls: 4, Total: 1000, Min: 100, Max: 400, Avg: 250, P50: 200, P95: 400, P99: 400},
+		{Name: "init", Calls: 1, Total: 1000, Min: 1000, Max: 1000, Avg: 1000, P50: 1000, P95: 1000, P99: 1000},
+	}
+
+	if len(stats) != len(expected) {
+		t.Fatalf("Expected %d functions, got %d: %+v", len(expected), len(stats), stats)
+	}
+	for i := range expected {
+		if stats[i] != expected[i] {
+			t.Errorf("Row %d:\nexpected %+v\ngot      %+v", i, expected[i], stats[i])
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	values := []int64{10, 20, 30, 40, 50, 60, 70, 80, 90, 100}
+
+	tests := []struct {
+		p        float64
+		expected int64
+	}{
+		{0, 10},
+		{10, 10},
+		{11, 20},
+		{50, 50},
+		{95, 100},
+		{100, 100},
+	}
+
+	for _, tt := range tests {
+		if got := percentile(values, tt.p); got != tt.expected {
+			t.Errorf("percentile(%v) = %d, expected %d", tt.p, got, tt.expected)
+		}
+	}
+}
+
+func TestWriteStatsTable(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeStatsTable(&out, loadStatsFixture(t)); err != nil {
+		t.Fatalf("writeStatsTable failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected a header and 3 rows, got:\n%s", out.String())
+	}
+	for i, name := range []string{"FUNCTION", "db.Query", "cache.Get", "init"} {
+		if !strings.Contains(lines[i], name) {
+			t.Errorf("Expected line %d to show %s, got %q", i, name, lines[i])
+		}
+	}
+	if fields := strings.Fields(lines[1]); strings.Join(fields, " ") != "db.Query 100 5.05s 1ms 100ms 51ms 50ms 95ms 99ms" {
+		t.Errorf("Unexpected db.Query row: %q", lines[1])
+	}
+}
+
+func TestWriteStatsJSON(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeStatsJSON(&out, loadStatsFixture(t)[:1]); err != nil {
+		t.Fatalf("writeStatsJSON failed: %v", err)
+	}
+
+	var rows []map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &rows); err != nil {
+		t.Fatalf("Output is not a JSON array: %v\n%s", err, out.String())
+	}
+	if len(rows) != 1 || rows[0]["name"] != "db.Query" || rows[0]["p99Micros"] != float64(99000) {
+		t.Errorf("Unexpected JSON output: %s", out.String())
+	}
+}
+
+func TestDurationHistogramBimodal(t *testing.T) {
+	// store.Load hits the cache in 10µs..15µs 60 times and reads the
+	// database in 20ms..30ms 40 times
+	events, err := tracefile.ReadFile("testdata/bimodal.jsonl")
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+	buckets := computeHistograms(events)["store.Load"]
+
+	if len(buckets) != 12 {
+		t.Fatalf("Expected buckets from 8µs to 32768µs, got %+v", buckets)
+	}
+	first, last := buckets[0], buckets[len(buckets)-1]
+	if first != (histogramBucket{Low: 8, High: 16, Count: 60}) {
+		t.Errorf("Expected the cache hits in [8µs,16µs), got %+v", first)
+	}
+	if last != (histogramBucket{Low: 16384, High: 32768, Count: 40}) {
+		t.Errorf("Expected the database reads in [16384µs,32768µs), got %+v", last)
+	}
+	for _, b := range buckets[1 : len(buckets)-1] {
+		if b.Count != 0 || b.High != 2*b.Low {
+			t.Errorf("Expected empty buckets doubling in width between the peaks, got %+v", b)
+		}
+	}
+}
+
+func TestDurationHistogramBounds(t *testing.T) {
+	buckets := durationHistogram([]int64{0, 1, 3, 4})
+	expected := []histogramBucket{{0, 1, 1}, {1, 2, 1}, {2, 4, 1}, {4, 8, 1}}
+	if len(buckets) != len(expected) {
+		t.Fatalf("Expected %d buckets, got %+v", len(expected), buckets)
+	}
+	for i := range expected {
+		if buckets[i] != expected[i] {
+			t.Errorf("Bucket %d: expected %+v, got %+v", i, expected[i], buckets[i])
+		}
+	}
+}
+
+func TestWriteHistograms(t *testing.T) {
+	events, err := tracefile.ReadFile("testdata/bimodal.jsonl")
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := writeHistograms(&out, computeStats(events), computeHistograms(events)); err != nil {
+		t.Fatalf("writeHistograms failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 13 || lines[0] != "store.Load (100 calls)" {
+		t.Fatalf("Expected a title and 12 buckets, got:\n%s", out.String())
+	}
+	if !strings.HasSuffix(lines[1], strings.Repeat("█", histogramWidth)+" 60") {
+		t.Errorf("Expected the fullest bucket to have a full bar, got %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[12], strings.Repeat("█", 26)+strings.Repeat(" ", histogramWidth-26)+" 40") {
+		t.Errorf("Expected a bar in proportion, got %q", lines[12])
+	}
+
+	out.Reset()
+	if err := writeHistogramsJSON(&out, computeStats(events), computeHistograms(events)); err != nil {
+		t.Fatalf("writeHistogramsJSON failed: %v", err)
+	}
+	var decoded []functionHistogram
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("Invalid JSON: %v\n%s", err, out.String())
+	}
+	if len(decoded) != 1 || decoded[0].Calls != 100 || len(decoded[0].Histogram) != 12 {
+		t.Errorf("Expected the stats and histogram of store.Load, got %+v", decoded)
+	}
+}
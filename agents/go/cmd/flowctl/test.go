@@ -2,11 +2,8 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/exec"
-	"path/filepath"
-	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -16,7 +13,8 @@ var testCmd = &cobra.Command{
 	Short: "Test Go packages with automatic instrumentation",
 	Long: `Test Go packages with automatic FlowTrace instrumentation.
 
-This command instruments the code (including test files), then runs 'go test'.
+This command instruments a copy of the module, including its test files and
+go.mod, then runs 'go test' on the copy.
 The original source code is not modified.
 
 Examples:
@@ -59,7 +57,7 @@ func runTest(cmd *cobra.Command, args []string) error {
 	}
 
 	// Create temporary directory for instrumented code
-	tempDir, err := ioutil.TempDir("", "flowtrace-test-*")
+	tempDir, err := os.MkdirTemp("", "flowtrace-test-*")
 	if err != nil {
 		return fmt.Errorf("failed to create temp directory: %w", err)
 	}
@@ -69,28 +67,14 @@ func runTest(cmd *cobra.Command, args []string) error {
 		fmt.Printf("📁 Temp directory: %s\n", tempDir)
 	}
 
-	// Instrument code to temp directory (including tests)
+	// Instrument a copy of the module, including tests
 	if verbose {
 		fmt.Println("⚙️  Instrumenting code and tests...")
 	}
 
-	instrumentArgs := []string{
-		"instrument",
-		"--output", tempDir,
-		"--tests", // Include test files
-		"--exclude", "**/vendor/**",
-	}
-
-	// Add packages
-	instrumentArgs = append(instrumentArgs, args...)
-
-	// Run instrument command
-	instrumentCmd := exec.Command("flowctl", instrumentArgs...)
-	instrumentCmd.Stdout = os.Stdout
-	instrumentCmd.Stderr = os.Stderr
-
-	if err := instrumentCmd.Run(); err != nil {
-		return fmt.Errorf("instrumentation failed: %w", err)
+	module, err := instrumentModule(".", tempDir, true, os.Stdout)
+	if err != nil {
+		return err
 	}
 
 	// Run tests on instrumented code
@@ -115,24 +99,20 @@ func runTest(cmd *cobra.Command, args []string) error {
 		testArgs = append(testArgs, "-run", testRun)
 	}
 
-	// Calculate package paths in temp directory
+	// Calculate package paths in the copy
 	for _, arg := range args {
-		if arg == "." {
-			testArgs = append(testArgs, tempDir)
-		} else if arg == "./..." {
-			testArgs = append(testArgs, filepath.Join(tempDir, "..."))
-		} else {
-			// Convert relative path to temp directory path
-			relPath := strings.TrimPrefix(arg, "./")
-			testArgs = append(testArgs, filepath.Join(tempDir, relPath))
+		pkgArg, err := module.packageArg(arg)
+		if err != nil {
+			return err
 		}
+		testArgs = append(testArgs, pkgArg)
 	}
 
 	// Run go test
 	goTest := exec.Command("go", testArgs...)
 	goTest.Stdout = os.Stdout
 	goTest.Stderr = os.Stderr
-	goTest.Dir = tempDir
+	goTest.Dir = module.dir
 
 	if err := goTest.Run(); err != nil {
 		// Tests may fail, but we still want to show the output
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/rixmerz/flowtrace-agent-go/internal/tracefile"
+	"github.com/spf13/cobra"
+)
+
+var tuiCmd = &cobra.Command{
+	Use:   "tui [flags] trace.jsonl",
+	Short: "Browse the call tree of a trace file interactively",
+	Long: `Browse the call tree of a FlowTrace JSONL trace in the terminal.
+
+The tree is built as by analyze, with a node per goroutine holding its top
+level calls. Nodes start collapsed and are expanded one at a time, so large
+traces stay readable.
+
+Keys:
+  ↑/k ↓/j        move; pgup/pgdown and home/end move by pages and to the ends
+  →/l ←/h        expand, collapse or go to the caller
+  enter/space    expand or collapse
+  s              sort calls by duration, slowest first, or back in trace order
+  /              filter by package: calls of other packages are hidden unless
+                 they lead to a matching call; esc clears the filter
+  S              jump to the slowest subtree
+  q              quit
+
+Examples:
+  # Browse a trace
+  flowctl tui flowtrace.jsonl
+
+  # Only show the calls leading to the store package
+  flowctl tui --package example.com/shop/store flowtrace.jsonl`,
+	Args: cobra.ExactArgs(1),
+	RunE: runTUI,
+}
+
+var tuiPackage string
+
+func init() {
+	tuiCmd.Flags().StringVarP(&tuiPackage, "package", "p", "", "only show calls of packages containing this string, and their callers")
+}
+
+func runTUI(cmd *cobra.Command, args []string) error {
+	events, err := tracefile.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to read trace: %w", err)
+	}
+
+	model := newTUIModel(args[0], tracefile.BuildTree(events))
+	model.setFilter(tuiPackage)
+	_, err = tea.NewProgram(model, tea.WithAltScreen()).Run()
+	return err
+}
+
+// tuiNode is a node of the browsed tree: a goroutine, whose children are
+// its top level calls, or a call
+type tuiNode struct {
+	thread   string          // set for goroutine nodes
+	call     *tracefile.Call // set for call nodes
+	parent   *tuiNode
+	children []*tuiNode
+	duration time.Duration // of the call, or of all calls of the goroutine
+	expanded bool
+}
+
+// tuiRow is a visible node and its depth in the tree
+type tuiRow struct {
+	node  *tuiNode
+	depth int
+}
+
+// tuiModel is the state of flowctl tui. Update applies key presses to it
+// and View renders it; the tree logic doesn't depend on the terminal.
+type tuiModel struct {
+	title   string
+	threads []*tuiNode
+
+	byDuration bool              // children sorted slowest first
+	filter     string            // package filter, "" for none
+	shown      map[*tuiNode]bool // nodes passing filter, nil when there is none
+	editing    bool              // the filter is being typed
+	input      string            // filter being typed
+
+	rows   []tuiRow // visible nodes, in display order
+	cursor int      // index of the selected row
+	offset int      // index of the first row on screen
+	width  int
+	height int
+}
+
+// newTUIModel returns a model browsing tree, with every node collapsed
+func newTUIModel(title string, tree *tracefile.Tree) *tuiModel {
+	m := &tuiModel{title: title}
+	for _, thread := range tree.Threads {
+		node := &tuiNode{thread: thread}
+		for _, root := range tree.Roots[thread] {
+			child := newTUICallNode(root, node)
+			node.children = append(node.children, child)
+			node.duration += child.duration
+		}
+		m.threads = append(m.threads, node)
+	}
+	m.refresh()
+	return m
+}
+
+// newTUICallNode returns the node of call and its callees. A call that
+// never returned is as slow as its callees, as far as the trace tells.
+func newTUICallNode(call *tracefile.Call, parent *tuiNode) *tuiNode {
+	node := &tuiNode{call: call, parent: parent, duration: call.Duration}
+	var callees time.Duration
+	for _, child := range call.Children {
+		childNode := newTUICallNode(child, node)
+		node.children = append(node.children, childNode)
+		callees += childNode.duration
+	}
+	if call.MissingExit {
+		node.duration = callees
+	}
+	return node
+}
+
+func (m *tuiModel) Init() tea.Cmd {
+	return nil
+}
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		m.scroll()
+	case tea.KeyMsg:
+		if m.editing {
+			m.editFilter(msg)
+			return m, nil
+		}
+		if quit := m.handleKey(msg.String()); quit {
+			return m, tea.Quit
+		}
+	}
+	return m, nil
+}
+
+// handleKey applies a key press while browsing and reports whether it
+// quits
+func (m *tuiModel) handleKey(key string) bool {
+	switch key {
+	case "q", "ctrl+c":
+		return true
+	case "up", "k":
+		m.moveCursor(-1)
+	case "down", "j":
+		m.moveCursor(1)
+	case "pgup":
+		m.moveCursor(-m.pageSize())
+	case "pgdown":
+		m.moveCursor(m.pageSize())
+	case "home", "g":
+		m.moveCursor(-len(m.rows))
+	case "end", "G":
+		m.moveCursor(len(m.rows))
+	case "enter", " ":
+		if node := m.selected(); node != nil && len(node.children) > 0 {
+			node.expanded = !node.expanded
+			m.refresh()
+		}
+	case "right", "l":
+		m.expand()
+	case "left", "h":
+		m.collapse()
+	case "s":
+		m.byDuration = !m.byDuration
+		m.refresh()
+	case "/":
+		m.editing = true
+		m.input = m.filter
+	case "esc":
+		m.setFilter("")
+	case "S":
+		m.jumpToSlowest()
+	}
+	return false
+}
+
+// editFilter applies a key press while the package filter is typed
+func (m *tuiModel) editFilter(msg tea.KeyMsg) {
+	switch msg.Type {
+	case tea.KeyEnter:
+		m.editing = false
+		m.setFilter(m.input)
+	case tea.KeyEsc:
+		m.editing = false
+	case tea.KeyBackspace:
+		_, size := utf8.DecodeLastRuneInString(m.input)
+		m.input = m.input[:len(m.input)-size]
+	case tea.KeyRunes, tea.KeySpace:
+		m.input += string(msg.Runes)
+	}
+}
+
+// selected returns the node under the cursor, or nil when no row is shown
+func (m *tuiModel) selected() *tuiNode {
+	if m.cursor < 0 || m.cursor >= len(m.rows) {
+		return nil
+	}
+	return m.rows[m.cursor].node
+}
+
+// expand expands the selected node, or moves to its first child when it
+// is already expanded
+func (m *tuiModel) expand() {
+	node := m.selected()
+	switch {
+	case node == nil || len(node.children) == 0:
+	case !node.expanded:
+		node.expanded = true
+		m.refresh()
+	default:
+		m.moveCursor(1)
+	}
+}
+
+// collapse collapses the selected node, or moves to its parent when it is
+// already collapsed
+func (m *tuiModel) collapse() {
+	node := m.selected()
+	switch {
+	case node == nil:
+	case node.expanded:
+		node.expanded = false
+		m.refresh()
+	case node.parent != nil:
+		m.selectNode(node.parent)
+	}
+}
+
+// setFilter shows only the calls whose package contains filter, with the
+// calls and goroutines leading to them, which are expanded. Matching calls
+// keep their callees.
+func (m *tuiModel) setFilter(filter string) {
+	m.filter = filter
+	m.shown = nil
+	if filter != "" {
+		m.shown = make(map[*tuiNode]bool)
+		for _, thread := range m.threads {
+			m.markShown(thread, false)
+		}
+	}
+	m.refresh()
+}
+
+// markShown records whether node and its descendants pass the filter and
+// reports whether node does; inside is set below a matching call
+func (m *tuiModel) markShown(node *tuiNode, inside bool) bool {
+	match := inside || (node.call != nil && strings.Contains(node.call.Class, m.filter))
+	shown := match
+	for _, child := range node.children {
+		if m.markShown(child, match) {
+			shown = true
+		}
+	}
+	if shown {
+		m.shown[node] = true
+		if !match {
+			node.expanded = true
+		}
+	}
+	return shown
+}
+
+// visible reports whether node passes the filter
+func (m *tuiModel) visible(node *tuiNode) bool {
+	return m.shown == nil || m.shown[node]
+}
+
+// children returns the visible children of node in display order
+func (m *tuiModel) children(node *tuiNode) []*tuiNode {
+	var children []*tuiNode
+	for _, child := range node.children {
+		if m.visible(child) {
+			children = append(children, child)
+		}
+	}
+	if m.byDuration {
+		slices.SortStableFunc(children, func(a, b *tuiNode) int {
+			return cmp.Compare(b.duration, a.duration)
+		})
+	}
+	return children
+}
+
+// refresh rebuilds the visible rows after a node was expanded or collapsed
+// or the sort or filter changed, keeping the selected node selected, or
+// else its nearest visible ancestor
+func (m *tuiModel) refresh() {
+	selected := m.selected()
+
+	m.rows = m.rows[:0]
+	var add func(node *tuiNode, depth int)
+	add = func(node *tuiNode, depth int) {
+		m.rows = append(m.rows, tuiRow{node: node, depth: depth})
+		if node.expanded {
+			for _, child := range m.children(node) {
+				add(child, depth+1)
+			}
+		}
+	}
+	for _, thread := range m.threads {
+		if m.visible(thread) {
+			add(thread, 0)
+		}
+	}
+
+	m.cursor = 0
+	for node := selected; node != nil; node = node.parent {
+		if i := m.rowOf(node); i >= 0 {
+			m.cursor = i
+			break
+		}
+	}
+	m.scroll()
+}
+
+// rowOf returns the index of the row of node, or -1 when it isn't visible
+func (m *tuiModel) rowOf(node *tuiNode) int {
+	return slices.IndexFunc(m.rows, func(row tuiRow) bool { return row.node == node })
+}
+
+// selectNode expands the ancestors of node and moves the cursor to it
+func (m *tuiModel) selectNode(node *tuiNode) {
+	for parent := node.parent; parent != nil; parent = parent.parent {
+		parent.expanded = true
+	}
+	m.refresh()
+	if i := m.rowOf(node); i >= 0 {
+		m.cursor = i
+		m.scroll()
+	}
+}
+
+// jumpToSlowest selects the slowest subtree: starting from the slowest top
+// level call, it follows the slowest callee for as long as it takes most
+// of its caller's time
+func (m *tuiModel) jumpToSlowest() {
+	var slowest *tuiNode
+	for _, thread := range m.threads {
+		if !m.visible(thread) {
+			continue
+		}
+		for _, root := range m.children(thread) {
+			if slowest == nil || root.duration > slowest.duration {
+				slowest = root
+			}
+		}
+	}
+	if slowest == nil {
+		return
+	}
+
+	for {
+		var next *tuiNode
+		for _, child := range m.children(slowest) {
+			if next == nil || child.duration > next.duration {
+				next = child
+			}
+		}
+		if next == nil || 2*next.duration < slowest.duration {
+			break
+		}
+		slowest = next
+	}
+	m.selectNode(slowest)
+}
+
+// moveCursor moves the cursor by delta rows, within the rows
+func (m *tuiModel) moveCursor(delta int) {
+	m.cursor = max(0, min(m.cursor+delta, len(m.rows)-1))
+	m.scroll()
+}
+
+// pageSize returns the number of rows on screen
+func (m *tuiModel) pageSize() int {
+	// The title and the help line take a line each
+	return max(1, m.height-2)
+}
+
+// scroll moves the rows on screen so the cursor stays visible
+func (m *tuiModel) scroll() {
+	page := m.pageSize()
+	if m.cursor < m.offset {
+		m.offset = m.cursor
+	}
+	if m.cursor >= m.offset+page {
+		m.offset = m.cursor - page + 1
+	}
+	m.offset = max(0, min(m.offset, len(m.rows)-page))
+}
+
+func (m *tuiModel) View() string {
+	var b strings.Builder
+
+	order := "trace order"
+	if m.byDuration {
+		order = "slowest first"
+	}
+	header := fmt.Sprintf("%s · %s", m.title, order)
+	if m.filter != "" {
+		header += fmt.Sprintf(" · package %q", m.filter)
+	}
+	b.WriteString(m.clip(header) + "\n")
+
+	end := len(m.rows)
+	if m.height > 0 {
+		end = min(end, m.offset+m.pageSize())
+	}
+	for i := m.offset; i < end; i++ {
+		b.WriteString(m.clip(m.renderRow(i)) + "\n")
+	}
+	if len(m.rows) == 0 {
+		b.WriteString("no calls match the filter\n")
+	}
+
+	if m.editing {
+		b.WriteString("package: " + m.input + "█")
+	} else {
+		b.WriteString(m.clip("↑↓ move · ←→ collapse/expand · s sort · / filter · S slowest · q quit"))
+	}
+	return b.String()
+}
+
+// renderRow renders the row at index i, e.g. "> ▸ main.LoadUser (52ms)"
+func (m *tuiModel) renderRow(i int) string {
+	row := m.rows[i]
+
+	cursor := "  "
+	if i == m.cursor {
+		cursor = "> "
+	}
+	marker := "  "
+	if len(m.children(row.node)) > 0 {
+		marker = "▸ "
+		if row.node.expanded {
+			marker = "▾ "
+		}
+	}
+
+	label := row.node.thread
+	if row.node.call != nil {
+		label = describeCall(row.node.call)
+	} else {
+		label += fmt.Sprintf(" (%s)", formatDuration(row.node.duration))
+	}
+	return cursor + strings.Repeat("  ", row.depth) + marker + label
+}
+
+// clip cuts line to the width of the terminal
+func (m *tuiModel) clip(line string) string {
+	if m.width <= 0 {
+		return line
+	}
+	runes := []rune(line)
+	if len(runes) <= m.width {
+		return line
+	}
+	return string(runes[:m.width])
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// tuiKeys maps the named keys used in tests to their types; other keys are
+// typed as runes
+var tuiKeys = map[string]tea.KeyType{
+	"up":    tea.KeyUp,
+	"down":  tea.KeyDown,
+	"left":  tea.KeyLeft,
+	"right": tea.KeyRight,
+	"enter": tea.KeyEnter,
+	"esc":   tea.KeyEsc,
+}
+
+// pressKeys sends keys to m in order
+func pressKeys(m *tuiModel, keys ...string) {
+	for _, key := range keys {
+		msg := tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(key)}
+		if keyType, ok := tuiKeys[key]; ok {
+			msg = tea.KeyMsg{Type: keyType}
+		}
+		m.Update(msg)
+	}
+}
+
+// tuiRowNames returns the visible rows of m, indented by depth, with the
+// selected one marked
+func tuiRowNames(m *tuiModel) []string {
+	var names []string
+	for i, row := range m.rows {
+		name := row.node.thread
+		if row.node.call != nil {
+			name = row.node.call.Name()
+		}
+		if i == m.cursor {
+			name += " <"
+		}
+		names = append(names, strings.Repeat("  ", row.depth)+name)
+	}
+	return names
+}
+
+func assertTUIRows(t *testing.T, m *tuiModel, want ...string) {
+	t.Helper()
+	if got := tuiRowNames(m); !slices.Equal(got, want) {
+		t.Errorf("Expected rows:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestTUIExpandAndCollapse(t *testing.T) {
+	m := newTUIModel("trace.jsonl", loadFixtureTree(t))
+	assertTUIRows(t, m, "goroutine-1 <", "goroutine-7", "goroutine-8")
+
+	// Expanding an expanded node moves to its first child
+	pressKeys(m, "right", "right", "right")
+	assertTUIRows(t, m,
+		"goroutine-1",
+		"  main.main <",
+		"    main.LoadUser",
+		"goroutine-7",
+		"goroutine-8",
+	)
+
+	pressKeys(m, "down", "enter")
+	assertTUIRows(t, m,
+		"goroutine-1",
+		"  main.main",
+		"    main.LoadUser <",
+		"      cache.Get",
+		"      db.Query",
+		"goroutine-7",
+		"goroutine-8",
+	)
+
+	// Collapsing a node keeps the expansion of its children
+	pressKeys(m, "up", "left")
+	assertTUIRows(t, m,
+		"goroutine-1",
+		"  main.main <",
+		"goroutine-7",
+		"goroutine-8",
+	)
+	pressKeys(m, "right")
+	if got := len(m.rows); got != 7 {
+		t.Errorf("Expected LoadUser to stay expanded, got %d rows", got)
+	}
+
+	// Leaves can't be expanded, and collapsing one moves to its caller
+	pressKeys(m, "down", "down", "right", "enter")
+	if got := len(m.rows); got != 7 {
+		t.Errorf("Expected a leaf to stay as is, got %d rows", got)
+	}
+	pressKeys(m, "left")
+	if got := m.selected().call.Name(); got != "main.LoadUser" {
+		t.Errorf("Expected the caller to be selected, got %s", got)
+	}
+}
+
+func TestTUIFilterByPackage(t *testing.T) {
+	m := newTUIModel("trace.jsonl", loadFixtureTree(t))
+
+	// The calls leading to the matches are expanded, other calls hidden
+	pressKeys(m, "/", "d", "b", "enter")
+	if m.filter != "db" {
+		t.Fatalf("Expected the filter to be db, got %q", m.filter)
+	}
+	assertTUIRows(t, m,
+		"goroutine-1 <",
+		"  main.main",
+		"    main.LoadUser",
+		"      db.Query",
+	)
+
+	// Matching calls keep their callees
+	m.setFilter("worker")
+	pressKeys(m, "G", "right")
+	assertTUIRows(t, m,
+		"goroutine-7",
+		"  worker.Process",
+		"goroutine-8",
+		"  worker.Flush <",
+		"    io.Write",
+	)
+
+	m.setFilter("nothing")
+	if len(m.rows) != 0 || m.selected() != nil {
+		t.Errorf("Expected no rows, got %v", tuiRowNames(m))
+	}
+	if !strings.Contains(m.View(), "no calls match the filter") {
+		t.Errorf("Expected the view to tell no call matches, got:\n%s", m.View())
+	}
+
+	pressKeys(m, "esc")
+	if m.filter != "" || !slices.Contains(tuiRowNames(m), "  net.Dial") {
+		t.Errorf("Expected esc to clear the filter, got %q and rows %v", m.filter, tuiRowNames(m))
+	}
+}
+
+func TestTUIEditFilter(t *testing.T) {
+	m := newTUIModel("trace.jsonl", loadFixtureTree(t))
+
+	pressKeys(m, "/", "c", "x")
+	m.Update(tea.KeyMsg{Type: tea.KeyBackspace})
+	pressKeys(m, "a", "c", "h", "e")
+	if !strings.Contains(m.View(), "package: cache█") {
+		t.Errorf("Expected the typed filter in the view, got:\n%s", m.View())
+	}
+	m.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	if m.editing || m.filter != "" {
+		t.Errorf("Expected esc to cancel the edit, got editing %v and filter %q", m.editing, m.filter)
+	}
+
+	// Keys are typed into the filter rather than browsing
+	pressKeys(m, "/", "q", "j")
+	m.Update(tea.KeyMsg{Type: tea.KeyBackspace})
+	m.Update(tea.KeyMsg{Type: tea.KeyBackspace})
+	if _, cmd := m.Update(tea.KeyMsg{Type: tea.KeyBackspace}); cmd != nil || m.input != "" {
+		t.Errorf("Expected q to be typed, got input %q", m.input)
+	}
+	pressKeys(m, "enter")
+	if _, cmd := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("q")}); cmd == nil {
+		t.Error("Expected q to quit once the filter is applied")
+	}
+}
+
+func TestTUISortByDuration(t *testing.T) {
+	m := newTUIModel("trace.jsonl", loadFixtureTree(t))
+	pressKeys(m, "right", "right", "right", "right", "right", "down", "down", "s")
+
+	// The selected call stays selected
+	assertTUIRows(t, m,
+		"goroutine-1",
+		"  main.main",
+		"    main.LoadUser",
+		"      db.Query <",
+		"      cache.Get",
+		"goroutine-7",
+		"goroutine-8",
+	)
+
+	pressKeys(m, "s")
+	assertTUIRows(t, m,
+		"goroutine-1",
+		"  main.main",
+		"    main.LoadUser",
+		"      cache.Get",
+		"      db.Query <",
+		"goroutine-7",
+		"goroutine-8",
+	)
+}
+
+func TestTUIJumpToSlowest(t *testing.T) {
+	m := newTUIModel("trace.jsonl", loadFixtureTree(t))
+
+	// main.main never returned; its callees make it the slowest
+	pressKeys(m, "S")
+	if got := m.selected().call.Name(); got != "db.Query" {
+		t.Errorf("Expected db.Query to be selected, got %s", got)
+	}
+	assertTUIRows(t, m,
+		"goroutine-1",
+		"  main.main",
+		"    main.LoadUser",
+		"      cache.Get",
+		"      db.Query <",
+		"goroutine-7",
+		"goroutine-8",
+	)
+
+	// Within the filter
+	m.setFilter("worker")
+	pressKeys(m, "S")
+	if got := m.selected().call.Name(); got != "worker.Process" {
+		t.Errorf("Expected worker.Process to be selected, got %s", got)
+	}
+}
+
+func TestTUIViewScrolls(t *testing.T) {
+	m := newTUIModel("trace.jsonl", loadFixtureTree(t))
+	m.setFilter("main")
+	m.Update(tea.WindowSizeMsg{Width: 40, Height: 4})
+
+	view := m.View()
+	for _, want := range []string{"trace.jsonl · trace order · package", "> ▾ goroutine-1 (52ms)", "    ▸ main.main (?)"} {
+		if !strings.Contains(view, want) {
+			t.Errorf("Expected %q in the view, got:\n%s", want, view)
+		}
+	}
+
+	// Two rows fit between the title and the help line
+	pressKeys(m, "right", "right", "down", "down")
+	view = m.View()
+	if strings.Contains(view, "goroutine-1") || !strings.Contains(view, "> ") {
+		t.Errorf("Expected the view to follow the cursor, got:\n%s", view)
+	}
+	for _, line := range strings.Split(view, "\n") {
+		if n := len([]rune(line)); n > 40 {
+			t.Errorf("Expected lines to fit the width, got %d runes: %q", n, line)
+		}
+	}
+}
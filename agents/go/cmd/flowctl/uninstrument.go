@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/ast"
+	"github.com/rixmerz/flowtrace-agent-go/internal/loader"
+	"github.com/spf13/cobra"
+)
+
+var uninstrumentCmd = &cobra.Command{
+	Use:   "uninstrument [packages...]",
+	Short: "Remove FlowTrace instrumentation from Go packages",
+	Long: `Remove the instrumentation injected by flowctl instrument.
+
+This command strips the FlowTrace Enter/Exit calls and recover handlers from
+every instrumented function, restores the original return statements and
+result lists, and drops the flowtrace import when nothing else uses it.
+Files without instrumentation are left untouched.
+
+Examples:
+  # Restore sources instrumented in place
+  flowctl uninstrument --in-place ./...
+
+  # Write the restored files to another directory
+  flowctl uninstrument --output ./clean ./...`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: runUninstrument,
+}
+
+var (
+	uninstrumentOutput  string
+	uninstrumentInPlace bool
+)
+
+func init() {
+	uninstrumentCmd.Flags().StringVarP(&uninstrumentOutput, "output", "o", "", "output directory for restored files")
+	uninstrumentCmd.Flags().BoolVarP(&uninstrumentInPlace, "in-place", "i", false, "modify files in place")
+}
+
+func runUninstrument(cmd *cobra.Command, args []string) error {
+	verbose, _ := cmd.Flags().GetBool("verbose")
+
+	if uninstrumentInPlace && uninstrumentOutput != "" {
+		return fmt.Errorf("cannot use --in-place and --output together")
+	}
+
+	if !uninstrumentInPlace && uninstrumentOutput == "" {
+		return fmt.Errorf("must specify either --in-place or --output")
+	}
+
+	// Test files are included since they may have been instrumented too
+	pkgLoader := loader.NewLoader(&loader.LoadConfig{Dir: ".", Tests: true})
+
+	restored := 0
+	for _, pattern := range args {
+		pkgs, err := expandPattern(pattern)
+		if err != nil {
+			return fmt.Errorf("failed to expand pattern %s: %w", pattern, err)
+		}
+
+		for _, pkg := range pkgs {
+			files, err := pkgLoader.LoadDirectory(pkg)
+			if err != nil {
+				return fmt.Errorf("failed to load %s: %w", pkg, err)
+			}
+
+			for _, fileInfo := range files {
+				if !ast.UninstrumentFile(pkgLoader.FileSet(), fileInfo.AST) {
+					continue
+				}
+
+				outputPath := fileInfo.Path
+				if uninstrumentOutput != "" {
+					relPath, err := filepath.Rel(".", fileInfo.Path)
+					if err != nil {
+						relPath = fileInfo.Path
+					}
+					outputPath = filepath.Join(uninstrumentOutput, relPath)
+				}
+
+				if err := pkgLoader.WriteFile(fileInfo.AST, outputPath); err != nil {
+					return fmt.Errorf("failed to write %s: %w", outputPath, err)
+				}
+				restored++
+
+				if verbose {
+					fmt.Printf("   ✅ Restored: %s\n", outputPath)
+				}
+			}
+		}
+	}
+
+	if verbose {
+		fmt.Printf("\n✨ Removed instrumentation from %d file(s)\n", restored)
+	}
+
+	return nil
+}
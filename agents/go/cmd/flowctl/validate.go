@@ -0,0 +1,382 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rixmerz/flowtrace-agent-go/flowtrace"
+	"github.com/rixmerz/flowtrace-agent-go/internal/filter"
+	"github.com/spf13/cobra"
+	"golang.org/x/mod/modfile"
+	"gopkg.in/yaml.v3"
+)
+
+var validateCmd = &cobra.Command{
+	Use:   "validate [config-file]",
+	Short: "Check a FlowTrace config file for mistakes",
+	Long: `Check a FlowTrace config file, .flowtrace.yaml or the file given by
+--config unless one is passed as argument.
+
+The config is loaded as the agent loads it and its values are validated.
+Keys the agent doesn't know, such as a misspelled "max_dept", are reported
+with their line, as are include and exclude patterns that aren't valid
+globs. Patterns matching no package or file of the current module are
+warned about. The command fails when any error is found.
+
+Examples:
+  # Check .flowtrace.yaml
+  flowctl validate
+
+  # Check another file
+  flowctl validate configs/staging.yaml`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runValidate,
+}
+
+// knownConfigKeys are the keys read from a config file, as dotted paths.
+// Items of a list are below the list's key followed by [].
+var knownConfigKeys = map[string]bool{
+	"version":                      true, // written by flowctl init
+	"package_prefix":               true,
+	"service":                      true,
+	"service.name":                 true,
+	"service.version":              true,
+	"service.environment":          true,
+	"output":                       true,
+	"output.file":                  true,
+	"output.stdout":                true,
+	"output.stdout_format":         true,
+	"output.compress":              true,
+	"output.sync":                  true,
+	"output.format":                true,
+	"output.time_unit":             true,
+	"output.remote_addr":           true,
+	"max_arg_length":               true,
+	"max_arg_depth":                true,
+	"legacy_arg_format":            true,
+	"max_depth":                    true,
+	"sampling":                     true,
+	"sampling.enabled":             true, // written by flowctl init
+	"sampling.rate":                true,
+	"sampling.tail":                true,
+	"sampling.slow_threshold":      true,
+	"sampling.max_buffered_traces": true,
+	"sampling.rules":               true,
+	"sampling.rules[]":             true,
+	"sampling.rules[].pattern":     true,
+	"sampling.rules[].rate":        true,
+	"sampling.arg_rules":           true,
+	"sampling.arg_rules[]":         true,
+	"sampling.arg_rules[].pattern": true,
+	"sampling.arg_rules[].rate":    true,
+	"otlp":                         true,
+	"otlp.endpoint":                true,
+	"metrics":                      true,
+	"metrics.enabled":              true,
+	"metrics.max_methods":          true,
+	"include":                      true,
+	"include[]":                    true,
+	"exclude":                      true,
+	"exclude[]":                    true,
+	"redact":                       true,
+	"redact[]":                     true,
+	"exclude_functions":            true,
+	"exclude_functions[]":          true,
+	"include_functions":            true,
+	"include_functions[]":          true,
+	"frameworks":                   true,
+	"frameworks.auto_detect":       true,
+	"frameworks.gin":               true,
+	"frameworks.echo":              true,
+	"frameworks.fiber":             true,
+	"frameworks.chi":               true,
+}
+
+// validateErrorKeys maps the settings named by Config.Validate errors to
+// their keys in a config file
+var validateErrorKeys = map[string]string{
+	"max_arg_length":      "max_arg_length",
+	"max_arg_depth":       "max_arg_depth",
+	"format":              "output.format",
+	"stdout_format":       "output.stdout_format",
+	"time_unit":           "output.time_unit",
+	"max_depth":           "max_depth",
+	"sampling_rate":       "sampling.rate",
+	"metrics_max_methods": "metrics.max_methods",
+	"slow_threshold":      "sampling.slow_threshold",
+	"max_buffered_traces": "sampling.max_buffered_traces",
+	"remote_addr":         "output.remote_addr",
+}
+
+// configProblem is a mistake found in a config file. Line is 0 when it
+// can't be tied to a line.
+type configProblem struct {
+	Line    int
+	Message string
+	Warning bool
+}
+
+func runValidate(cmd *cobra.Command, args []string) error {
+	path := cmd.Flag("config").Value.String()
+	if len(args) == 1 {
+		path = args[0]
+	}
+
+	problems, err := validateConfigFile(path, ".")
+	if err != nil {
+		return err
+	}
+
+	out := cmd.OutOrStdout()
+	errors := writeConfigProblems(out, path, problems)
+	if errors > 0 {
+		return fmt.Errorf("%s: %d error(s) found", path, errors)
+	}
+	if warnings := len(problems); warnings > 0 {
+		fmt.Fprintf(out, "✅ %s is valid, with %d warning(s)\n", path, warnings)
+	} else {
+		fmt.Fprintf(out, "✅ %s is valid\n", path)
+	}
+	return nil
+}
+
+// writeConfigProblems prints problems as path:line: message and returns
+// the number of errors among them
+func writeConfigProblems(w io.Writer, path string, problems []configProblem) int {
+	errors := 0
+	for _, p := range problems {
+		location := path
+		if p.Line > 0 {
+			location += ":" + strconv.Itoa(p.Line)
+		}
+		if p.Warning {
+			fmt.Fprintf(w, "⚠️  %s: %s\n", location, p.Message)
+		} else {
+			errors++
+			fmt.Fprintf(w, "❌ %s: %s\n", location, p.Message)
+		}
+	}
+	return errors
+}
+
+// validateConfigFile checks the config file at path, and its include and
+// exclude patterns against the module containing dir
+func validateConfigFile(path, dir string) ([]configProblem, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		// yaml errors already carry their line
+		return []configProblem{{Message: err.Error()}}, nil
+	}
+	var root *yaml.Node
+	if len(doc.Content) > 0 {
+		root = doc.Content[0]
+	}
+	if root != nil && root.Kind != yaml.MappingNode {
+		return []configProblem{{Line: root.Line, Message: "expected a mapping of settings at the top level"}}, nil
+	}
+
+	problems := checkConfigKeys(root, "")
+
+	config, err := flowtrace.LoadConfig(path)
+	if err != nil {
+		return append(problems, configProblem{Message: err.Error()}), nil
+	}
+	if err := config.Validate(); err != nil {
+		problems = append(problems, configProblem{Line: validateErrorLine(root, err), Message: err.Error()})
+	}
+
+	candidates, err := moduleCandidates(dir)
+	if err != nil {
+		problems = append(problems, configProblem{Warning: true, Message: fmt.Sprintf("patterns not checked against the module: %v", err)})
+	}
+	problems = append(problems, checkPatterns(root, "include", config.Include, candidates)...)
+	problems = append(problems, checkPatterns(root, "exclude", config.Exclude, candidates)...)
+	return problems, nil
+}
+
+// checkConfigKeys reports the keys below node that aren't in
+// knownConfigKeys; prefix is the dotted path of node
+func checkConfigKeys(node *yaml.Node, prefix string) []configProblem {
+	if node == nil {
+		return nil
+	}
+
+	var problems []configProblem
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			path := key.Value
+			if prefix != "" {
+				path = prefix + "." + key.Value
+			}
+			if !knownConfigKeys[path] {
+				problems = append(problems, configProblem{Line: key.Line, Message: unknownKeyMessage(path, key.Value)})
+				continue
+			}
+			problems = append(problems, checkConfigKeys(node.Content[i+1], path)...)
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			problems = append(problems, checkConfigKeys(item, prefix+"[]")...)
+		}
+	}
+	return problems
+}
+
+// unknownKeyMessage describes the unknown key at path, suggesting a known
+// key of the same name placed elsewhere, e.g. rate for sampling.rate
+func unknownKeyMessage(path, name string) string {
+	var suggestions []string
+	for known := range knownConfigKeys {
+		if known != path && (known == name || strings.HasSuffix(known, "."+name)) {
+			suggestions = append(suggestions, known)
+		}
+	}
+	if len(suggestions) == 0 {
+		return fmt.Sprintf("unknown key %q", path)
+	}
+	// The least nested key is the likeliest
+	slices.SortFunc(suggestions, func(a, b string) int {
+		return cmp.Or(cmp.Compare(len(a), len(b)), strings.Compare(a, b))
+	})
+	return fmt.Sprintf("unknown key %q (did you mean %q?)", path, suggestions[0])
+}
+
+// validateErrorLine returns the line of the setting a Config.Validate error
+// is about, or 0 when it isn't found
+func validateErrorLine(root *yaml.Node, err error) int {
+	message := err.Error()
+
+	// sampling rule <i>: ... and arg sampling rule <i>: ...
+	for prefix, key := range map[string]string{"sampling rule ": "sampling.rules", "arg sampling rule ": "sampling.arg_rules"} {
+		rest, ok := strings.CutPrefix(message, prefix)
+		if !ok {
+			continue
+		}
+		index, _, _ := strings.Cut(rest, ":")
+		rules := lookupConfigKey(root, key)
+		if i, err := strconv.Atoi(index); err == nil && rules != nil && i < len(rules.Content) {
+			return rules.Content[i].Line
+		}
+		return 0
+	}
+
+	setting, _, _ := strings.Cut(message, " ")
+	if key, ok := validateErrorKeys[setting]; ok {
+		if node := lookupConfigKey(root, key); node != nil {
+			return node.Line
+		}
+	}
+	return 0
+}
+
+// lookupConfigKey returns the value node of a dotted key below root, or nil
+func lookupConfigKey(root *yaml.Node, key string) *yaml.Node {
+	node := root
+	for _, name := range strings.Split(key, ".") {
+		if node == nil || node.Kind != yaml.MappingNode {
+			return nil
+		}
+		var value *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == name {
+				value = node.Content[i+1]
+			}
+		}
+		node = value
+	}
+	return node
+}
+
+// checkPatterns reports the patterns of the include or exclude list that
+// aren't valid, and warns about those matching none of candidates. Nil
+// candidates skip the warnings.
+func checkPatterns(root *yaml.Node, key string, patterns, candidates []string) []configProblem {
+	var lines []*yaml.Node
+	if list := lookupConfigKey(root, key); list != nil && list.Kind == yaml.SequenceNode {
+		lines = list.Content
+	}
+	line := func(pattern string) int {
+		for _, item := range lines {
+			if item.Value == pattern {
+				return item.Line
+			}
+		}
+		return 0
+	}
+
+	var problems []configProblem
+	for _, pattern := range patterns {
+		if err := filter.ValidatePattern(pattern); err != nil {
+			problems = append(problems, configProblem{Line: line(pattern), Message: fmt.Sprintf("%s pattern %q: %v", key, pattern, err)})
+			continue
+		}
+		if candidates == nil || !warnUnmatched(key, pattern) {
+			continue
+		}
+		if !slices.ContainsFunc(candidates, func(c string) bool { return filter.MatchPattern(pattern, c) }) {
+			problems = append(problems, configProblem{
+				Line:    line(pattern),
+				Message: fmt.Sprintf("%s pattern %q matches no package or file of this module", key, pattern),
+				Warning: true,
+			})
+		}
+	}
+	return problems
+}
+
+// warnUnmatched reports whether a pattern matching nothing in the module is
+// worth a warning. The default excludes and patterns for standard library
+// packages are about code outside the module.
+func warnUnmatched(key, pattern string) bool {
+	if key == "exclude" && slices.Contains(filter.DefaultExcludePatterns(), pattern) {
+		return false
+	}
+	pkg := strings.TrimSuffix(strings.TrimPrefix(pattern, "!"), "/**")
+	return !filter.IsStdLibPackage(pkg)
+}
+
+// moduleCandidates returns the import paths of the packages and the paths
+// of the Go files, relative to the module root, of the module containing
+// dir: the strings include and exclude patterns are matched against
+func moduleCandidates(dir string) ([]string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	root, err := findModuleRoot(abs)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(root, "go.mod"))
+	if err != nil {
+		return nil, err
+	}
+
+	files, fileDirs, err := moduleFiles(root, modfile.ModulePath(data), true)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]string, 0, len(files)+len(fileDirs))
+	for _, pkg := range fileDirs {
+		candidates = append(candidates, pkg)
+	}
+	for _, file := range files {
+		if rel, err := filepath.Rel(root, file); err == nil {
+			candidates = append(candidates, filepath.ToSlash(rel))
+		}
+	}
+	return candidates, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runValidateCommand runs flowctl validate on config in a module with a
+// store package, returning its output and error
+func runValidateCommand(t *testing.T, config string) (string, error) {
+	t.Helper()
+
+	module := t.TempDir()
+	files := map[string]string{
+		"go.mod":               "module example.com/shop\n\ngo 1.21\n",
+		"store/store.go":       "package store\n\nfunc Get() int {\n\treturn 1\n}\n",
+		"store/store_test.go":  "package store\n",
+		".flowtrace.yaml":      config,
+		"cmd/server/server.go": "package main\n\nfunc main() {}\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(module, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create %s: %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	t.Chdir(module)
+
+	var out bytes.Buffer
+	validateCmd.SetOut(&out)
+	t.Cleanup(func() { validateCmd.SetOut(nil) })
+
+	err := runValidate(validateCmd, []string{".flowtrace.yaml"})
+	return out.String(), err
+}
+
+func TestValidateValidConfig(t *testing.T) {
+	out, err := runValidateCommand(t, `version: "1"
+output:
+  file: flowtrace.jsonl
+  format: jsonl
+include:
+  - example.com/shop/**
+exclude:
+  - "**/*_test.go"
+  - "**/vendor/**"
+  - runtime/**
+sampling:
+  enabled: false
+  rate: 0.5
+  rules:
+    - pattern: store.*
+      rate: 1.0
+`)
+	if err != nil {
+		t.Fatalf("Expected the config to be valid, got %v\n%s", err, out)
+	}
+	if strings.TrimSpace(out) != "✅ .flowtrace.yaml is valid" {
+		t.Errorf("Expected no problems, got:\n%s", out)
+	}
+}
+
+func TestValidateInvalidSamplingRate(t *testing.T) {
+	out, err := runValidateCommand(t, `output:
+  file: flowtrace.jsonl
+sampling:
+  rate: 1.5
+`)
+	if err == nil {
+		t.Fatalf("Expected the config to be rejected, got:\n%s", out)
+	}
+	if !strings.Contains(out, ".flowtrace.yaml:4: sampling_rate must be between 0.0 and 1.0") {
+		t.Errorf("Expected the error on the line of sampling.rate, got:\n%s", out)
+	}
+}
+
+func TestValidateMalformedGlob(t *testing.T) {
+	out, err := runValidateCommand(t, `include:
+  - example.com/shop/**
+exclude:
+  - example.com/shop/[v1*
+`)
+	if err == nil {
+		t.Fatalf("Expected the config to be rejected, got:\n%s", out)
+	}
+	if !strings.Contains(out, `.flowtrace.yaml:4: exclude pattern "example.com/shop/[v1*": malformed glob`) {
+		t.Errorf("Expected the malformed glob on its line, got:\n%s", out)
+	}
+}
+
+func TestValidateUnknownKeysAndUnmatchedPatterns(t *testing.T) {
+	out, err := runValidateCommand(t, `output:
+  file: flowtrace.jsonl
+  formt: json
+max_dept: 10
+rate: 0.5
+include:
+  - example.com/shop/**
+  - example.com/billing/**
+`)
+	if err == nil {
+		t.Fatalf("Expected unknown keys to be rejected, got:\n%s", out)
+	}
+	for _, want := range []string{
+		`❌ .flowtrace.yaml:3: unknown key "output.formt"`,
+		`❌ .flowtrace.yaml:4: unknown key "max_dept"`,
+		`❌ .flowtrace.yaml:5: unknown key "rate" (did you mean "sampling.rate"?)`,
+		`⚠️  .flowtrace.yaml:8: include pattern "example.com/billing/**" matches no package or file of this module`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q, got:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "example.com/shop/**") {
+		t.Errorf("Expected no warning for a pattern matching the module, got:\n%s", out)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rixmerz/flowtrace-agent-go/internal/ast"
+	"github.com/rixmerz/flowtrace-agent-go/internal/filter"
+	"github.com/rixmerz/flowtrace-agent-go/internal/loader"
+)
+
+// watchDebounce is how long the watcher waits after the last change
+// before re-instrumenting, so an editor's burst of writes is handled once
+const watchDebounce = 200 * time.Millisecond
+
+// watcher re-instruments changed Go files of a set of package directories
+// into an output directory. Unchanged files are served from the
+// ParallelTransformer cache and are not written again.
+type watcher struct {
+	root     string // directory output paths are relative to
+	output   string
+	dirs     []string
+	pkgPaths map[string]string // package directory -> import path
+	filter   *filter.Filter
+	config   *ast.Config
+	pt       *ast.ParallelTransformer
+	debounce time.Duration
+	out      io.Writer
+}
+
+// newWatcher creates a watcher for the package directories dirs. pkgPaths
+// maps directories to import paths, used as the package name of traced
+// functions; directories missing from it are instrumented without one.
+func newWatcher(root, output string, dirs []string, pkgPaths map[string]string, pkgFilter *filter.Filter, config *ast.Config, out io.Writer) *watcher {
+	return &watcher{
+		root:     root,
+		output:   output,
+		dirs:     dirs,
+		pkgPaths: pkgPaths,
+		filter:   pkgFilter,
+		config:   config,
+		pt:       ast.NewParallelTransformer(config),
+		debounce: watchDebounce,
+		out:      out,
+	}
+}
+
+// files lists the Go files the watcher instruments
+func (w *watcher) files() ([]string, error) {
+	var files []string
+	for _, dir := range w.dirs {
+		if !includesPackage(w.filter, dir) {
+			continue
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if !entry.IsDir() && w.tracks(path) {
+				files = append(files, path)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// transform instruments the tracked files package by package, so each
+// package's functions are named after its import path
+func (w *watcher) transform() ([]*ast.TransformResult, error) {
+	files, err := w.files()
+	if err != nil {
+		return nil, err
+	}
+
+	byDir := make(map[string][]string)
+	var dirs []string
+	for _, file := range files {
+		dir := filepath.Dir(file)
+		if _, ok := byDir[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		byDir[dir] = append(byDir[dir], file)
+	}
+
+	var results []*ast.TransformResult
+	for _, dir := range dirs {
+		w.pt.SetPackagePath(w.pkgPaths[dir])
+		dirResults, err := w.pt.TransformFiles(byDir[dir])
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, dirResults...)
+	}
+	return results, nil
+}
+
+// tracks reports whether path is a Go source file the watcher instruments
+func (w *watcher) tracks(path string) bool {
+	if filepath.Ext(path) != ".go" || !w.config.IncludesFile(path) || !w.filter.ShouldInstrumentFile(path) {
+		return false
+	}
+	// Never pick up our own output when it lives inside the source tree
+	rel, err := filepath.Rel(w.output, path)
+	return err != nil || strings.HasPrefix(rel, "..")
+}
+
+// outputPath maps a source file to its location in the output directory
+func (w *watcher) outputPath(path string) (string, error) {
+	return outputPath(w.root, w.output, path)
+}
+
+// cycle re-instruments the tracked files after the files in changed were
+// modified, created or removed, and returns the files it wrote
+func (w *watcher) cycle(changed []string) ([]string, error) {
+	for _, path := range changed {
+		w.pt.Invalidate(path)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			outputPath, err := w.outputPath(path)
+			if err == nil && os.Remove(outputPath) == nil {
+				fmt.Fprintf(w.out, "🗑️  Removed: %s\n", path)
+			}
+		}
+	}
+
+	results, err := w.transform()
+	if err != nil {
+		return nil, err
+	}
+
+	var written []string
+	for _, result := range results {
+		if result.Error != nil {
+			fmt.Fprintf(w.out, "⚠️  Failed to instrument %s: %v\n", result.Filename, result.Error)
+			continue
+		}
+		if result.Cached {
+			continue
+		}
+		outputPath, err := w.outputPath(result.Filename)
+		if err != nil {
+			fmt.Fprintf(w.out, "⚠️  Failed to instrument %s: %v\n", result.Filename, err)
+			continue
+		}
+		if err := loader.WriteAST(result.FileSet, result.File, outputPath); err != nil {
+			return written, err
+		}
+		written = append(written, result.Filename)
+	}
+
+	sort.Strings(written)
+	for _, path := range written {
+		fmt.Fprintf(w.out, "♻️  Re-instrumented: %s\n", path)
+	}
+	return written, nil
+}
+
+// run watches the package directories and re-instruments changed files
+// until done is closed. The files are expected to have been instrumented
+// into the output directory already; they are only transformed to fill
+// the cache.
+func (w *watcher) run(done <-chan struct{}) error {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to start watcher: %w", err)
+	}
+	defer fsw.Close()
+
+	for _, dir := range w.dirs {
+		if err := fsw.Add(dir); err != nil {
+			return fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+	}
+
+	if _, err := w.transform(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w.out, "👀 Watching %d package(s) for changes...\n", len(w.dirs))
+
+	pending := make(map[string]bool)
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-done:
+			return nil
+
+		case event, ok := <-fsw.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op == fsnotify.Chmod || !w.tracks(event.Name) {
+				continue
+			}
+			pending[event.Name] = true
+			timer = time.After(w.debounce)
+
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(w.out, "⚠️  Watch error: %v\n", err)
+
+		case <-timer:
+			timer = nil
+			changed := make([]string, 0, len(pending))
+			for path := range pending {
+				changed = append(changed, path)
+			}
+			pending = make(map[string]bool)
+
+			if _, err := w.cycle(changed); err != nil {
+				fmt.Fprintf(w.out, "⚠️  %v\n", err)
+			}
+		}
+	}
+}
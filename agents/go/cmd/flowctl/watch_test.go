@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/ast"
+	"github.com/rixmerz/flowtrace-agent-go/internal/filter"
+)
+
+// newTestWatcher creates a watcher over a temp package holding files
+func newTestWatcher(t *testing.T, files map[string]string) (*watcher, string, string) {
+	t.Helper()
+
+	src := t.TempDir()
+	out := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	pkgPaths := map[string]string{src: "example.com/app"}
+	w := newWatcher(src, out, []string{src}, pkgPaths, filter.NewFilter(nil, nil), &ast.Config{}, io.Discard)
+	return w, src, out
+}
+
+func TestWatcherCycleReemitsOnlyChangedFiles(t *testing.T) {
+	w, src, out := newTestWatcher(t, map[string]string{
+		"a.go":      "package app\n\nfunc A() {}\n",
+		"b.go":      "package app\n\nfunc B() {}\n",
+		"a_test.go": "package app\n\nfunc helper() {}\n",
+	})
+
+	written, err := w.cycle(nil)
+	if err != nil {
+		t.Fatalf("First cycle failed: %v", err)
+	}
+	if len(written) != 2 {
+		t.Fatalf("Expected first cycle to emit a.go and b.go, got %v", written)
+	}
+
+	a := filepath.Join(src, "a.go")
+	if err := os.WriteFile(a, []byte("package app\n\nfunc A() {}\n\nfunc A2() {}\n"), 0644); err != nil {
+		t.Fatalf("Failed to touch a.go: %v", err)
+	}
+
+	written, err = w.cycle([]string{a})
+	if err != nil {
+		t.Fatalf("Second cycle failed: %v", err)
+	}
+	if len(written) != 1 || written[0] != a {
+		t.Fatalf("Expected only a.go to be re-emitted, got %v", written)
+	}
+
+	data, err := os.ReadFile(filepath.Join(out, "a.go"))
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !strings.Contains(string(data), `flowtrace.EnterAt("example.com/app", "A2"`) {
+		t.Errorf("Expected re-emitted a.go to instrument A2, got:\n%s", data)
+	}
+}
+
+func TestWatcherCycleRemovesDeletedFiles(t *testing.T) {
+	w, src, out := newTestWatcher(t, map[string]string{
+		"a.go": "package app\n\nfunc A() {}\n",
+		"b.go": "package app\n\nfunc B() {}\n",
+	})
+	if _, err := w.cycle(nil); err != nil {
+		t.Fatalf("First cycle failed: %v", err)
+	}
+
+	b := filepath.Join(src, "b.go")
+	if err := os.Remove(b); err != nil {
+		t.Fatalf("Failed to remove b.go: %v", err)
+	}
+	written, err := w.cycle([]string{b})
+	if err != nil {
+		t.Fatalf("Second cycle failed: %v", err)
+	}
+	if len(written) != 0 {
+		t.Errorf("Expected nothing to be re-emitted, got %v", written)
+	}
+	if _, err := os.Stat(filepath.Join(out, "b.go")); !os.IsNotExist(err) {
+		t.Errorf("Expected b.go to be removed from the output, got %v", err)
+	}
+}
+
+func TestWatcherTracks(t *testing.T) {
+	w := newWatcher("src", "src/instrumented", nil, nil, filter.NewFilter(nil, []string{"src/gen/**"}), &ast.Config{}, io.Discard)
+
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{path: "src/app.go", expected: true},
+		{path: "src/app_test.go", expected: false},
+		{path: "src/notes.txt", expected: false},
+		{path: "src/instrumented/app.go", expected: false},
+		{path: "src/gen/models.go", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := w.tracks(tt.path); got != tt.expected {
+				t.Errorf("Expected tracks(%q) = %v, got %v", tt.path, tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestWatcherFilesOfExcludedPackage(t *testing.T) {
+	parent := t.TempDir()
+	traced := filepath.Join(parent, "traced")
+	plain := filepath.Join(parent, "plain")
+	for _, dir := range []string{traced, plain} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(traced, "a.go"): "package app\n\n//flowtrace:trace\nfunc A() {}\n",
+		filepath.Join(plain, "b.go"):  "package app\n\nfunc B() {}\n",
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+
+	// Both packages are excluded, but functions marked with
+	// //flowtrace:trace are instrumented as flowctl instrument does
+	pkgFilter := filter.NewFilter(nil, []string{filepath.Join(parent, "*")})
+	w := newWatcher(t.TempDir(), t.TempDir(), []string{traced, plain}, nil, pkgFilter, &ast.Config{}, io.Discard)
+
+	got, err := w.files()
+	if err != nil {
+		t.Fatalf("files failed: %v", err)
+	}
+	if want := filepath.Join(traced, "a.go"); len(got) != 1 || got[0] != want {
+		t.Errorf("Expected only %s to be watched, got %v", want, got)
+	}
+}
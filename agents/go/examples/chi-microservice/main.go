@@ -9,12 +9,12 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/flowtrace/flowtrace-go/flowtrace"
+	"github.com/rixmerz/flowtrace-agent-go/flowtrace"
+	"github.com/rixmerz/flowtrace-agent-go/flowtrace/frameworks"
 )
 
 // Service represents a microservice
 type Service struct {
-	ft     *flowtrace.FlowTrace
 	db     *Database
 	cache  *Cache
 	logger *Logger
@@ -55,12 +55,10 @@ func (c *Cache) Set(key string, value interface{}, ttl time.Duration) {
 }
 
 // Logger provides structured logging
-type Logger struct {
-	ft *flowtrace.FlowTrace
-}
+type Logger struct{}
 
 func (l *Logger) Info(ctx context.Context, message string, fields map[string]interface{}) {
-	span := l.ft.StartSpan("log_info")
+	span := flowtrace.StartSpan("log_info")
 	defer span.End()
 
 	span.SetTag("level", "info")
@@ -73,7 +71,7 @@ func (l *Logger) Info(ctx context.Context, message string, fields map[string]int
 }
 
 func (l *Logger) Error(ctx context.Context, message string, err error) {
-	span := l.ft.StartSpan("log_error")
+	span := flowtrace.StartSpan("log_error")
 	defer span.End()
 
 	span.SetTag("level", "error")
@@ -94,26 +92,30 @@ type Order struct {
 
 func main() {
 	// Initialize FlowTrace
-	ft := flowtrace.New(flowtrace.Config{
+	config := flowtrace.Config{
 		ServiceName:    "chi-microservice",
 		ServiceVersion: "1.0.0",
 		Environment:    "production",
-		OutputFile:     "flowtrace.jsonl",
-		BufferSize:     1000,
-		SampleRate:     0.1, // Sample 10% in production
+		LogFile:        "flowtrace.jsonl",
+		SamplingRate:   0.1, // Sample 10% in production
 		Rules: []flowtrace.SamplingRule{
-			{Path: "/health", Rate: 0.01},
-			{Path: "/metrics", Rate: 0.0},
+			{Pattern: "chi./health", Rate: 0.01},
+			{Pattern: "chi./metrics", Rate: 0.0},
 		},
-	})
-	defer ft.Close()
+	}
+
+	// Requests are traced by the middleware and service spans started with
+	// flowtrace.StartSpan, both through the global tracer
+	if err := flowtrace.Start(config); err != nil {
+		log.Fatal(err)
+	}
+	defer flowtrace.Stop()
 
 	// Initialize service dependencies
 	svc := &Service{
-		ft:     ft,
 		db:     &Database{},
 		cache:  &Cache{},
-		logger: &Logger{ft: ft},
+		logger: &Logger{},
 	}
 
 	// Create router
@@ -126,7 +128,7 @@ func main() {
 	r.Use(middleware.Timeout(60 * time.Second))
 
 	// FlowTrace middleware
-	r.Use(flowtrace.ChiMiddleware(ft))
+	r.Use(frameworks.ChiMiddleware())
 
 	// Custom tracing middleware
 	r.Use(svc.tracingMiddleware)
@@ -159,7 +161,7 @@ func main() {
 // tracingMiddleware adds custom tracing context
 func (s *Service) tracingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		span := s.ft.StartSpan("middleware_tracing")
+		span := flowtrace.StartSpan("middleware_tracing")
 		defer span.End()
 
 		// Add request context tags
@@ -173,7 +175,7 @@ func (s *Service) tracingMiddleware(next http.Handler) http.Handler {
 
 // healthHandler checks service health
 func (s *Service) healthHandler(w http.ResponseWriter, r *http.Request) {
-	span := s.ft.StartSpan("health_check")
+	span := flowtrace.StartSpan("health_check")
 	defer span.End()
 
 	health := map[string]interface{}{
@@ -189,10 +191,10 @@ func (s *Service) healthHandler(w http.ResponseWriter, r *http.Request) {
 // metricsHandler returns service metrics
 func (s *Service) metricsHandler(w http.ResponseWriter, r *http.Request) {
 	metrics := map[string]interface{}{
-		"requests_total":   12345,
-		"errors_total":     42,
-		"avg_response_ms":  125,
-		"cache_hit_rate":   0.85,
+		"requests_total":  12345,
+		"errors_total":    42,
+		"avg_response_ms": 125,
+		"cache_hit_rate":  0.85,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -201,7 +203,7 @@ func (s *Service) metricsHandler(w http.ResponseWriter, r *http.Request) {
 
 // createOrderHandler creates a new order
 func (s *Service) createOrderHandler(w http.ResponseWriter, r *http.Request) {
-	span := s.ft.StartSpan("create_order_handler")
+	span := flowtrace.StartSpan("create_order_handler")
 	defer span.End()
 
 	ctx := r.Context()
@@ -219,7 +221,7 @@ func (s *Service) createOrderHandler(w http.ResponseWriter, r *http.Request) {
 	span.SetTag("total", order.Total)
 
 	// Validate order
-	validateSpan := s.ft.StartSpan("validate_order")
+	validateSpan := flowtrace.StartSpan("validate_order")
 	if order.CustomerID == "" || order.Total <= 0 {
 		err := http.ErrBodyNotAllowed
 		validateSpan.SetError(err)
@@ -231,7 +233,7 @@ func (s *Service) createOrderHandler(w http.ResponseWriter, r *http.Request) {
 	validateSpan.End()
 
 	// Create order in database
-	dbSpan := s.ft.StartSpan("database_create_order")
+	dbSpan := flowtrace.StartSpan("database_create_order")
 	if err := s.db.CreateOrder(ctx, &order); err != nil {
 		dbSpan.SetError(err)
 		dbSpan.End()
@@ -244,7 +246,7 @@ func (s *Service) createOrderHandler(w http.ResponseWriter, r *http.Request) {
 	dbSpan.End()
 
 	// Cache the order
-	cacheSpan := s.ft.StartSpan("cache_set_order")
+	cacheSpan := flowtrace.StartSpan("cache_set_order")
 	s.cache.Set("order:"+order.ID, order, 5*time.Minute)
 	cacheSpan.End()
 
@@ -265,7 +267,7 @@ func (s *Service) createOrderHandler(w http.ResponseWriter, r *http.Request) {
 
 // getOrderHandler retrieves an order
 func (s *Service) getOrderHandler(w http.ResponseWriter, r *http.Request) {
-	span := s.ft.StartSpan("get_order_handler")
+	span := flowtrace.StartSpan("get_order_handler")
 	defer span.End()
 
 	ctx := r.Context()
@@ -274,7 +276,7 @@ func (s *Service) getOrderHandler(w http.ResponseWriter, r *http.Request) {
 	span.SetTag("order_id", orderID)
 
 	// Check cache first
-	cacheSpan := s.ft.StartSpan("cache_get_order")
+	cacheSpan := flowtrace.StartSpan("cache_get_order")
 	if cached, ok := s.cache.Get("order:" + orderID); ok {
 		cacheSpan.SetTag("cache_hit", true)
 		cacheSpan.End()
@@ -289,7 +291,7 @@ func (s *Service) getOrderHandler(w http.ResponseWriter, r *http.Request) {
 	cacheSpan.End()
 
 	// Get from database
-	dbSpan := s.ft.StartSpan("database_get_order")
+	dbSpan := flowtrace.StartSpan("database_get_order")
 	order, err := s.db.GetOrder(ctx, orderID)
 	if err != nil {
 		dbSpan.SetError(err)
@@ -302,7 +304,7 @@ func (s *Service) getOrderHandler(w http.ResponseWriter, r *http.Request) {
 	dbSpan.End()
 
 	// Cache for future requests
-	cacheSetSpan := s.ft.StartSpan("cache_set_order")
+	cacheSetSpan := flowtrace.StartSpan("cache_set_order")
 	s.cache.Set("order:"+orderID, order, 5*time.Minute)
 	cacheSetSpan.End()
 
@@ -314,7 +316,7 @@ func (s *Service) getOrderHandler(w http.ResponseWriter, r *http.Request) {
 
 // updateOrderStatusHandler updates order status
 func (s *Service) updateOrderStatusHandler(w http.ResponseWriter, r *http.Request) {
-	span := s.ft.StartSpan("update_order_status_handler")
+	span := flowtrace.StartSpan("update_order_status_handler")
 	defer span.End()
 
 	ctx := r.Context()
@@ -338,7 +340,7 @@ func (s *Service) updateOrderStatusHandler(w http.ResponseWriter, r *http.Reques
 	time.Sleep(25 * time.Millisecond)
 
 	// Invalidate cache
-	cacheSpan := s.ft.StartSpan("cache_invalidate")
+	cacheSpan := flowtrace.StartSpan("cache_invalidate")
 	// s.cache.Delete("order:" + orderID)
 	cacheSpan.End()
 
@@ -352,14 +354,14 @@ func (s *Service) updateOrderStatusHandler(w http.ResponseWriter, r *http.Reques
 
 // getCustomerOrdersHandler retrieves all orders for a customer
 func (s *Service) getCustomerOrdersHandler(w http.ResponseWriter, r *http.Request) {
-	span := s.ft.StartSpan("get_customer_orders_handler")
+	span := flowtrace.StartSpan("get_customer_orders_handler")
 	defer span.End()
 
 	customerID := chi.URLParam(r, "customerID")
 	span.SetTag("customer_id", customerID)
 
 	// Simulate fetching multiple orders
-	dbSpan := s.ft.StartSpan("database_get_customer_orders")
+	dbSpan := flowtrace.StartSpan("database_get_customer_orders")
 	time.Sleep(50 * time.Millisecond)
 	dbSpan.SetTag("customer_id", customerID)
 	dbSpan.SetTag("orders_count", 3)
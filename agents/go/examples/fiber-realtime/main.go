@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"log"
 	"sync"
@@ -9,7 +8,8 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
-	"github.com/flowtrace/flowtrace-go/flowtrace"
+	"github.com/rixmerz/flowtrace-agent-go/flowtrace"
+	"github.com/rixmerz/flowtrace-agent-go/flowtrace/frameworks"
 )
 
 // Message represents a chat message
@@ -25,22 +25,20 @@ type Message struct {
 type Room struct {
 	ID      string
 	Name    string
-	Clients map[*websocket.Conn]string // conn -> userID
+	Clients map[*flowtrace.WSConn]string // conn -> userID
 	mu      sync.RWMutex
-	ft      *flowtrace.FlowTrace
 }
 
-func NewRoom(id, name string, ft *flowtrace.FlowTrace) *Room {
+func NewRoom(id, name string) *Room {
 	return &Room{
 		ID:      id,
 		Name:    name,
-		Clients: make(map[*websocket.Conn]string),
-		ft:      ft,
+		Clients: make(map[*flowtrace.WSConn]string),
 	}
 }
 
-func (r *Room) AddClient(conn *websocket.Conn, userID string) {
-	span := r.ft.StartSpan("room_add_client")
+func (r *Room) AddClient(conn *flowtrace.WSConn, userID string) {
+	span := flowtrace.StartSpan("room_add_client")
 	defer span.End()
 
 	r.mu.Lock()
@@ -54,8 +52,8 @@ func (r *Room) AddClient(conn *websocket.Conn, userID string) {
 	log.Printf("Client %s joined room %s (total: %d)", userID, r.ID, len(r.Clients))
 }
 
-func (r *Room) RemoveClient(conn *websocket.Conn) {
-	span := r.ft.StartSpan("room_remove_client")
+func (r *Room) RemoveClient(conn *flowtrace.WSConn) {
+	span := flowtrace.StartSpan("room_remove_client")
 	defer span.End()
 
 	r.mu.Lock()
@@ -71,8 +69,8 @@ func (r *Room) RemoveClient(conn *websocket.Conn) {
 	}
 }
 
-func (r *Room) Broadcast(message *Message, excludeConn *websocket.Conn) {
-	span := r.ft.StartSpan("room_broadcast")
+func (r *Room) Broadcast(message *Message, excludeConn *flowtrace.WSConn) {
+	span := flowtrace.StartSpan("room_broadcast")
 	defer span.End()
 
 	r.mu.RLock()
@@ -112,18 +110,16 @@ func (r *Room) Broadcast(message *Message, excludeConn *websocket.Conn) {
 type RoomManager struct {
 	rooms map[string]*Room
 	mu    sync.RWMutex
-	ft    *flowtrace.FlowTrace
 }
 
-func NewRoomManager(ft *flowtrace.FlowTrace) *RoomManager {
+func NewRoomManager() *RoomManager {
 	return &RoomManager{
 		rooms: make(map[string]*Room),
-		ft:    ft,
 	}
 }
 
 func (rm *RoomManager) GetOrCreateRoom(roomID, roomName string) *Room {
-	span := rm.ft.StartSpan("room_manager_get_or_create")
+	span := flowtrace.StartSpan("room_manager_get_or_create")
 	defer span.End()
 
 	rm.mu.Lock()
@@ -131,7 +127,7 @@ func (rm *RoomManager) GetOrCreateRoom(roomID, roomName string) *Room {
 
 	room, exists := rm.rooms[roomID]
 	if !exists {
-		room = NewRoom(roomID, roomName, rm.ft)
+		room = NewRoom(roomID, roomName)
 		rm.rooms[roomID] = room
 		span.SetTag("room_created", true)
 	} else {
@@ -154,16 +150,20 @@ func (rm *RoomManager) GetRoom(roomID string) (*Room, bool) {
 }
 
 func main() {
-	// Initialize FlowTrace
-	ft := flowtrace.New(flowtrace.Config{
+	// Initialize FlowTrace. Requests are traced by the middleware and the
+	// room and handler spans started with flowtrace.StartSpan, both through
+	// the global tracer.
+	config := flowtrace.Config{
 		ServiceName:    "fiber-realtime-chat",
 		ServiceVersion: "1.0.0",
 		Environment:    "development",
-		OutputFile:     "flowtrace.jsonl",
-		BufferSize:     1000,
-		SampleRate:     1.0,
-	})
-	defer ft.Close()
+		LogFile:        "flowtrace.jsonl",
+		SamplingRate:   1.0,
+	}
+	if err := flowtrace.Start(config); err != nil {
+		log.Fatal(err)
+	}
+	defer flowtrace.Stop()
 
 	// Initialize Fiber
 	app := fiber.New(fiber.Config{
@@ -172,18 +172,18 @@ func main() {
 	})
 
 	// Add FlowTrace middleware
-	app.Use(flowtrace.FiberMiddleware(ft))
+	app.Use(frameworks.FiberMiddleware())
 
 	// Initialize room manager
-	roomManager := NewRoomManager(ft)
+	roomManager := NewRoomManager()
 
 	// REST API endpoints
 	app.Get("/api/health", func(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{"status": "ok"})
 	})
 
-	app.Get("/api/rooms", getRoomsHandler(ft, roomManager))
-	app.Post("/api/rooms", createRoomHandler(ft, roomManager))
+	app.Get("/api/rooms", getRoomsHandler(roomManager))
+	app.Post("/api/rooms", createRoomHandler(roomManager))
 
 	// WebSocket upgrade middleware
 	app.Use("/ws", func(c *fiber.Ctx) error {
@@ -194,7 +194,7 @@ func main() {
 	})
 
 	// WebSocket endpoint
-	app.Get("/ws/:roomID", websocket.New(websocketHandler(ft, roomManager)))
+	app.Get("/ws/:roomID", websocket.New(websocketHandler(roomManager)))
 
 	log.Println("Starting Fiber server on :8080")
 	if err := app.Listen(":8080"); err != nil {
@@ -202,9 +202,9 @@ func main() {
 	}
 }
 
-func getRoomsHandler(ft *flowtrace.FlowTrace, rm *RoomManager) fiber.Handler {
+func getRoomsHandler(rm *RoomManager) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		span := ft.StartSpan("get_rooms_handler")
+		span := flowtrace.StartSpan("get_rooms_handler")
 		defer span.End()
 
 		rm.mu.RLock()
@@ -228,9 +228,9 @@ func getRoomsHandler(ft *flowtrace.FlowTrace, rm *RoomManager) fiber.Handler {
 	}
 }
 
-func createRoomHandler(ft *flowtrace.FlowTrace, rm *RoomManager) fiber.Handler {
+func createRoomHandler(rm *RoomManager) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		span := ft.StartSpan("create_room_handler")
+		span := flowtrace.StartSpan("create_room_handler")
 		defer span.End()
 
 		var req struct {
@@ -259,29 +259,29 @@ func createRoomHandler(ft *flowtrace.FlowTrace, rm *RoomManager) fiber.Handler {
 	}
 }
 
-func websocketHandler(ft *flowtrace.FlowTrace, rm *RoomManager) func(*websocket.Conn) {
+func websocketHandler(rm *RoomManager) func(*websocket.Conn) {
 	return func(conn *websocket.Conn) {
-		// Start connection span
-		connSpan := ft.StartSpan("websocket_connection")
-		defer func() {
-			connSpan.End()
-			conn.Close()
-		}()
+		defer conn.Close()
 
 		roomID := conn.Params("roomID")
 		userID := conn.Query("user_id", "anonymous")
 		username := conn.Query("username", userID)
 
-		connSpan.SetTag("room_id", roomID)
-		connSpan.SetTag("user_id", userID)
-		connSpan.SetTag("username", username)
+		// The connection is one span; every message read from it or
+		// broadcast to it is a child span with the message type and size
+		wsConn := flowtrace.TraceWSConn(conn, "chat", "websocket_connection", map[string]interface{}{
+			"room_id":  roomID,
+			"user_id":  userID,
+			"username": username,
+		})
+		defer wsConn.End()
 
 		// Get or create room
 		room := rm.GetOrCreateRoom(roomID, roomID)
 
 		// Add client to room
-		room.AddClient(conn, userID)
-		defer room.RemoveClient(conn)
+		room.AddClient(wsConn, userID)
+		defer room.RemoveClient(wsConn)
 
 		// Send join message
 		joinMsg := &Message{
@@ -294,63 +294,29 @@ func websocketHandler(ft *flowtrace.FlowTrace, rm *RoomManager) func(*websocket.
 		room.Broadcast(joinMsg, nil)
 
 		// Message handling loop
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-
-		messageCount := 0
-		errorCount := 0
-
 		for {
-			msgSpan := ft.StartSpan("websocket_message")
-
-			_, msg, err := conn.ReadMessage()
+			_, msg, err := wsConn.ReadMessage()
 			if err != nil {
-				msgSpan.SetError(err)
-				msgSpan.SetTag("message_count", messageCount)
-				msgSpan.SetTag("error_count", errorCount)
-				msgSpan.End()
-
 				if websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
 					log.Printf("Client %s disconnected normally", userID)
 				} else {
 					log.Printf("WebSocket error for client %s: %v", userID, err)
-					errorCount++
 				}
 				break
 			}
 
-			messageCount++
-
 			var receivedMsg Message
 			if err := json.Unmarshal(msg, &receivedMsg); err != nil {
-				msgSpan.SetError(err)
-				errorCount++
-			} else {
-				receivedMsg.ID = generateID()
-				receivedMsg.UserID = userID
-				receivedMsg.Username = username
-				receivedMsg.Timestamp = time.Now()
-
-				msgSpan.SetTag("message_id", receivedMsg.ID)
-				msgSpan.SetTag("user_id", userID)
-				msgSpan.SetTag("content_length", len(receivedMsg.Content))
-
-				// Broadcast to all clients in room
-				broadcastSpan := ft.StartSpan("broadcast_message")
-				room.Broadcast(&receivedMsg, conn)
-				broadcastSpan.SetTag("room_id", roomID)
-				broadcastSpan.SetTag("message_id", receivedMsg.ID)
-				broadcastSpan.End()
+				log.Printf("Invalid message from client %s: %v", userID, err)
+				continue
 			}
+			receivedMsg.ID = generateID()
+			receivedMsg.UserID = userID
+			receivedMsg.Username = username
+			receivedMsg.Timestamp = time.Now()
 
-			msgSpan.End()
-
-			// Check context cancellation
-			select {
-			case <-ctx.Done():
-				return
-			default:
-			}
+			// Broadcast to all clients in room
+			room.Broadcast(&receivedMsg, wsConn)
 		}
 
 		// Send leave message
@@ -362,9 +328,6 @@ func websocketHandler(ft *flowtrace.FlowTrace, rm *RoomManager) func(*websocket.
 			Timestamp: time.Now(),
 		}
 		room.Broadcast(leaveMsg, nil)
-
-		connSpan.SetTag("total_messages", messageCount)
-		connSpan.SetTag("total_errors", errorCount)
 	}
 }
 
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/flowtrace/flowtrace-go/flowtrace"
+	"github.com/rixmerz/flowtrace-agent-go/flowtrace"
+	"github.com/rixmerz/flowtrace-agent-go/flowtrace/frameworks"
 )
 
 // User represents a user in the system
@@ -49,29 +52,32 @@ var ErrUserNotFound = gin.Error{Err: errors.New("user not found"), Type: gin.Err
 
 func main() {
 	// Initialize FlowTrace with advanced configuration
-	ft := flowtrace.New(flowtrace.Config{
+	config := flowtrace.Config{
 		ServiceName:    "gin-advanced-api",
 		ServiceVersion: "1.0.0",
 		Environment:    "development",
-		OutputFile:     "flowtrace.jsonl",
-		BufferSize:     500,
-		SampleRate:     1.0,
+		LogFile:        "flowtrace.jsonl",
+		SamplingRate:   1.0,
 		Rules: []flowtrace.SamplingRule{
-			{Path: "/health", Rate: 0.1},
-			{Path: "/metrics", Rate: 0.0},
+			{Pattern: "gin./health", Rate: 0.1},
+			{Pattern: "gin./metrics", Rate: 0.0},
 		},
-		Exclusions: flowtrace.Exclusions{
-			Packages:  []string{"vendor/*"},
-			Functions: []string{"init"},
-		},
-	})
-	defer ft.Close()
+		Exclude:          []string{"vendor/*"},
+		ExcludeFunctions: []string{"*.init"},
+	}
+
+	// Requests are traced by the middleware and handler spans started with
+	// flowtrace.StartSpan, both through the global tracer
+	if err := flowtrace.Start(config); err != nil {
+		log.Fatal(err)
+	}
+	defer flowtrace.Stop()
 
 	// Initialize Gin
 	r := gin.Default()
 
 	// Add FlowTrace middleware with custom configuration
-	r.Use(flowtrace.GinMiddleware(ft))
+	r.Use(frameworks.GinMiddleware())
 
 	// Initialize database
 	db := NewDatabase()
@@ -87,9 +93,9 @@ func main() {
 	})
 
 	// User endpoints with manual tracing
-	r.GET("/users/:id", getUserHandler(ft, db))
-	r.POST("/users", createUserHandler(ft, db))
-	r.GET("/users/:id/profile", getUserProfileHandler(ft, db))
+	r.GET("/users/:id", getUserHandler(db))
+	r.POST("/users", createUserHandler(db))
+	r.GET("/users/:id/profile", getUserProfileHandler(db))
 
 	log.Println("Starting Gin server on :8080")
 	if err := r.Run(":8080"); err != nil {
@@ -97,10 +103,10 @@ func main() {
 	}
 }
 
-func getUserHandler(ft *flowtrace.FlowTrace, db *Database) gin.HandlerFunc {
+func getUserHandler(db *Database) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Start a custom span for the handler
-		span := ft.StartSpan("get_user_handler")
+		span := flowtrace.StartSpan("get_user_handler")
 		defer span.End()
 
 		id := c.Param("id")
@@ -115,7 +121,7 @@ func getUserHandler(ft *flowtrace.FlowTrace, db *Database) gin.HandlerFunc {
 		}
 
 		// Database operation span
-		dbSpan := ft.StartSpan("database_get_user")
+		dbSpan := flowtrace.StartSpan("database_get_user")
 		user, err := db.GetUser(userID)
 		dbSpan.SetTag("user_id", userID)
 		if err != nil {
@@ -134,9 +140,9 @@ func getUserHandler(ft *flowtrace.FlowTrace, db *Database) gin.HandlerFunc {
 	}
 }
 
-func createUserHandler(ft *flowtrace.FlowTrace, db *Database) gin.HandlerFunc {
+func createUserHandler(db *Database) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		span := ft.StartSpan("create_user_handler")
+		span := flowtrace.StartSpan("create_user_handler")
 		defer span.End()
 
 		var user User
@@ -150,7 +156,7 @@ func createUserHandler(ft *flowtrace.FlowTrace, db *Database) gin.HandlerFunc {
 		span.SetTag("user_email", user.Email)
 
 		// Validate user
-		validateSpan := ft.StartSpan("validate_user")
+		validateSpan := flowtrace.StartSpan("validate_user")
 		if user.Name == "" || user.Email == "" {
 			err := errors.New("name and email are required")
 			validateSpan.SetError(err)
@@ -162,7 +168,7 @@ func createUserHandler(ft *flowtrace.FlowTrace, db *Database) gin.HandlerFunc {
 		validateSpan.End()
 
 		// Create user
-		dbSpan := ft.StartSpan("database_create_user")
+		dbSpan := flowtrace.StartSpan("database_create_user")
 		if err := db.CreateUser(&user); err != nil {
 			dbSpan.SetError(err)
 			dbSpan.End()
@@ -180,9 +186,9 @@ func createUserHandler(ft *flowtrace.FlowTrace, db *Database) gin.HandlerFunc {
 	}
 }
 
-func getUserProfileHandler(ft *flowtrace.FlowTrace, db *Database) gin.HandlerFunc {
+func getUserProfileHandler(db *Database) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		span := ft.StartSpan("get_user_profile_handler")
+		span := flowtrace.StartSpan("get_user_profile_handler")
 		defer span.End()
 
 		id := c.Param("id")
@@ -196,7 +202,7 @@ func getUserProfileHandler(ft *flowtrace.FlowTrace, db *Database) gin.HandlerFun
 		}
 
 		// Get user
-		dbSpan := ft.StartSpan("database_get_user")
+		dbSpan := flowtrace.StartSpan("database_get_user")
 		user, err := db.GetUser(userID)
 		dbSpan.SetTag("user_id", userID)
 		if err != nil {
@@ -211,7 +217,7 @@ func getUserProfileHandler(ft *flowtrace.FlowTrace, db *Database) gin.HandlerFun
 		}
 
 		// Simulate external API call
-		externalSpan := ft.StartSpan("external_api_call")
+		externalSpan := flowtrace.StartSpan("external_api_call")
 		externalSpan.SetTag("api", "profile_enrichment")
 		time.Sleep(50 * time.Millisecond) // Simulate API latency
 		externalSpan.End()
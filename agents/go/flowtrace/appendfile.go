@@ -0,0 +1,23 @@
+package flowtrace
+
+import "os"
+
+// atomicLineSize is the longest line written to the log file without a
+// lock. Lines are written with a single write to a file opened with
+// O_APPEND, which local file systems apply as a whole, so processes sharing
+// a log file, e.g. a parent and a re-exec'd child, don't interleave their
+// lines. Longer lines, which some systems may split, are written holding an
+// advisory lock on the file as well, where the OS supports one.
+const atomicLineSize = 4096
+
+// appendFile writes the lines of a log file shared with other processes
+type appendFile struct {
+	f *os.File
+}
+
+func (a appendFile) Write(p []byte) (int, error) {
+	if len(p) > atomicLineSize && lockFile(a.f) == nil {
+		defer unlockFile(a.f)
+	}
+	return a.f.Write(p)
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package flowtrace
+
+import (
+	"errors"
+	"os"
+)
+
+// lockFile is not supported here; long lines rely on O_APPEND alone
+func lockFile(f *os.File) error {
+	return errors.ErrUnsupported
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
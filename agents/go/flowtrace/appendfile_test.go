@@ -0,0 +1,90 @@
+package flowtrace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sharedLogEnv passes the log file to the processes of TestSharedLogFile
+const sharedLogEnv = "FLOWTRACE_TEST_SHARED_LOG"
+
+func TestSharedLogFile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("spawns processes")
+	}
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+
+	var cmds []*exec.Cmd
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSharedLogFileWriter$")
+		cmd.Env = append(os.Environ(), sharedLogEnv+"="+path)
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("Failed to start writer: %v", err)
+		}
+		cmds = append(cmds, cmd)
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Fatalf("Writer failed: %v", err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open trace file: %v", err)
+	}
+	defer f.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		lines++
+		var event TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Line %d is not a valid event: %v", lines, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Failed to read trace file: %v", err)
+	}
+	// Each writer logs a METADATA event and its calls
+	if want := 2 * (1 + sharedLogEvents); lines != want {
+		t.Errorf("Expected %d lines, got %d", want, lines)
+	}
+}
+
+// sharedLogEvents is the number of events logged by each writer
+const sharedLogEvents = 500
+
+// TestSharedLogFileWriter is the process logging to the file of
+// TestSharedLogFile
+func TestSharedLogFileWriter(t *testing.T) {
+	path := os.Getenv(sharedLogEnv)
+	if path == "" {
+		t.Skip("run by TestSharedLogFile")
+	}
+
+	tracer, err := NewTracer(Config{LogFile: path})
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	for i := 0; i < sharedLogEvents; i++ {
+		// Every tenth line is longer than those written without a lock
+		size := 64
+		if i%10 == 0 {
+			size = 4 * atomicLineSize
+		}
+		args := fmt.Sprintf(`{"pid":%d,"data":%q}`, os.Getpid(), strings.Repeat("x", size))
+		tracer.logEvent(TraceEvent{Event: "ENTER", Class: "main", Method: "Write", Args: json.RawMessage(args)})
+	}
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package flowtrace
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// DefaultMaxArgDepth bounds the nesting of logged values when
+// Config.MaxArgDepth is unset
+const DefaultMaxArgDepth = 16
+
+// Markers replacing the parts of a value that are not serialized
+const (
+	cycleValue    = "<cycle>"
+	maxDepthValue = "<max-depth>"
+)
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	errorType         = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// bounder cuts values down to what can be serialized safely: containers
+// nested deeper than maxDepth become "<max-depth>", and a pointer, map or
+// slice reached again from inside itself becomes "<cycle>". Without it a
+// self-referential value sends json.Marshal through a thousand levels
+// before it gives up, and fmt into unbounded recursion.
+type bounder struct {
+	maxDepth int
+	visiting map[visit]bool // containers on the path being walked
+}
+
+// visit identifies a container by its address and type; a slice also by its
+// length, as its subslices share the address
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+// boundValue returns v, or a bounded copy of it if v nests deeper than
+// maxDepth or contains a cycle. Structs in a copy become maps keyed by
+// their JSON field names, and slices and arrays become []interface{}.
+func boundValue(v interface{}, maxDepth int) interface{} {
+	if v == nil {
+		return nil
+	}
+	b := &bounder{maxDepth: maxDepth, visiting: make(map[visit]bool)}
+	if bounded, changed := b.bound(reflect.ValueOf(v), 0); changed {
+		return bounded
+	}
+	return v
+}
+
+// boundArgs bounds each argument of a call separately
+func boundArgs(args map[string]interface{}, maxDepth int) map[string]interface{} {
+	if args == nil {
+		return nil
+	}
+	bounded := make(map[string]interface{}, len(args))
+	for name, value := range args {
+		bounded[name] = boundValue(value, maxDepth)
+	}
+	return bounded
+}
+
+// bound walks v, which is nested depth containers deep, and reports whether
+// anything was cut
+func (b *bounder) bound(v reflect.Value, depth int) (interface{}, bool) {
+	if !v.IsValid() {
+		return nil, false
+	}
+
+	// Values that serialize themselves are not walked
+	if v.Kind() != reflect.Interface && (v.Type().Implements(jsonMarshalerType) || v.Type().Implements(errorType)) {
+		return nil, false
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil, false
+		}
+		return b.bound(v.Elem(), depth)
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil, false
+		}
+		key := visit{ptr: v.Pointer(), typ: v.Type()}
+		if b.visiting[key] {
+			return cycleValue, true
+		}
+		b.visiting[key] = true
+		defer delete(b.visiting, key)
+		return b.bound(v.Elem(), depth)
+
+	case reflect.Struct:
+		if depth >= b.maxDepth {
+			return maxDepthValue, true
+		}
+		fields := make(map[string]interface{}, v.NumField())
+		changed := false
+		for i := 0; i < v.NumField(); i++ {
+			name, ok := jsonFieldName(v.Type().Field(i))
+			if !ok {
+				continue
+			}
+			if inner, cut := b.bound(v.Field(i), depth+1); cut {
+				fields[name] = inner
+				changed = true
+				continue
+			}
+			fields[name] = v.Field(i).Interface()
+		}
+		return fields, changed
+
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, false
+		}
+		key := visit{ptr: v.Pointer(), typ: v.Type()}
+		if b.visiting[key] {
+			return cycleValue, true
+		}
+		if depth >= b.maxDepth {
+			return maxDepthValue, true
+		}
+		b.visiting[key] = true
+		defer delete(b.visiting, key)
+
+		entries := make(map[string]interface{}, v.Len())
+		changed := false
+		iter := v.MapRange()
+		for iter.Next() {
+			name := fmt.Sprint(iter.Key().Interface())
+			if inner, cut := b.bound(iter.Value(), depth+1); cut {
+				entries[name] = inner
+				changed = true
+				continue
+			}
+			entries[name] = iter.Value().Interface()
+		}
+		return entries, changed
+
+	case reflect.Slice:
+		if v.IsNil() || v.Type().Elem().Kind() == reflect.Uint8 {
+			return nil, false
+		}
+		key := visit{ptr: v.Pointer(), typ: v.Type(), len: v.Len()}
+		if b.visiting[key] {
+			return cycleValue, true
+		}
+		b.visiting[key] = true
+		defer delete(b.visiting, key)
+		return b.boundItems(v, depth)
+
+	case reflect.Array:
+		return b.boundItems(v, depth)
+	}
+
+	return nil, false
+}
+
+// boundItems bounds the elements of a slice or array
+func (b *bounder) boundItems(v reflect.Value, depth int) (interface{}, bool) {
+	if depth >= b.maxDepth {
+		return maxDepthValue, true
+	}
+	items := make([]interface{}, v.Len())
+	changed := false
+	for i := 0; i < v.Len(); i++ {
+		if inner, cut := b.bound(v.Index(i), depth+1); cut {
+			items[i] = inner
+			changed = true
+			continue
+		}
+		items[i] = v.Index(i).Interface()
+	}
+	return items, changed
+}
+
+// jsonFieldName returns the name json.Marshal gives a struct field, and
+// false for fields it leaves out
+func jsonFieldName(field reflect.StructField) (string, bool) {
+	if !field.IsExported() {
+		return "", false
+	}
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	if name, _, _ := strings.Cut(tag, ","); name != "" {
+		return name, true
+	}
+	return field.Name, true
+}
@@ -0,0 +1,106 @@
+package flowtrace
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type boundNode struct {
+	Value int        `json:"value"`
+	Next  *boundNode `json:"next"`
+}
+
+func TestBoundValueCycle(t *testing.T) {
+	a := &boundNode{Value: 1}
+	b := &boundNode{Value: 2, Next: a}
+	a.Next = b
+
+	lines := tracedLines(t, Config{}, func(tracer *Tracer) {
+		tracer.enter(1, "main", "Walk", map[string]interface{}{"list": a}, TraceParent{}, sourceLocation{})
+		tracer.exit(1, "main", "Walk", nil, nil)
+	})
+
+	list := lines[0]["args"].(map[string]interface{})["list"].(map[string]interface{})
+	next := list["next"].(map[string]interface{})
+	if list["value"] != float64(1) || next["value"] != float64(2) {
+		t.Fatalf("Expected the list to be logged up to the cycle, got %v", list)
+	}
+	if next["next"] != cycleValue {
+		t.Errorf("Expected the back reference to be %q, got %v", cycleValue, next["next"])
+	}
+}
+
+func TestBoundValueSelfContainingMap(t *testing.T) {
+	m := map[string]interface{}{"name": "root"}
+	m["self"] = m
+
+	for _, legacy := range []bool{false, true} {
+		tracer, err := NewTracer(Config{LegacyArgFormat: legacy})
+		if err != nil {
+			t.Fatalf("NewTracer failed: %v", err)
+		}
+		// Terminating at all is the point: fmt and the per-entry map
+		// encoding would both recurse forever
+		data := tracer.encodeValue(m)
+		tracer.Close()
+
+		var decoded interface{}
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("Invalid JSON %s: %v", data, err)
+		}
+		if legacy && decoded != "map[name:root self:<cycle>]" {
+			t.Errorf("Expected the legacy form to mark the cycle, got %v", decoded)
+		}
+		if !legacy && decoded.(map[string]interface{})["self"] != cycleValue {
+			t.Errorf("Expected the JSON form to mark the cycle, got %v", decoded)
+		}
+	}
+}
+
+func TestBoundValueMaxDepth(t *testing.T) {
+	// A map nested 100 levels deep
+	deep := map[string]interface{}{"leaf": true}
+	for i := 0; i < 100; i++ {
+		deep = map[string]interface{}{"child": deep}
+	}
+
+	bounded := boundValue(deep, 3).(map[string]interface{})
+	level := bounded
+	for i := 0; i < 2; i++ {
+		level = level["child"].(map[string]interface{})
+	}
+	if level["child"] != maxDepthValue {
+		t.Errorf("Expected the fourth level to be %q, got %v", maxDepthValue, level["child"])
+	}
+
+	lines := tracedLines(t, Config{MaxArgDepth: 2}, func(tracer *Tracer) {
+		tracer.enter(1, "main", "Load", map[string]interface{}{"tree": deep, "id": 7}, TraceParent{}, sourceLocation{})
+		tracer.exit(1, "main", "Load", nil, nil)
+	})
+	args := lines[0]["args"].(map[string]interface{})
+	tree := args["tree"].(map[string]interface{})
+	if tree["child"].(map[string]interface{})["child"] != maxDepthValue || args["id"] != float64(7) {
+		t.Errorf("Expected the tree to be cut below 2 levels, got %v", args)
+	}
+}
+
+func TestBoundValueUnchanged(t *testing.T) {
+	user := encodeUser{ID: 1, Name: "alice", Roles: []string{"admin"}}
+	if got := boundValue(user, DefaultMaxArgDepth); got.(encodeUser).Name != "alice" {
+		t.Errorf("Expected a shallow value to be returned as is, got %#v", got)
+	}
+
+	// Values that marshal themselves are not walked
+	now := time.Now()
+	if got := boundValue(now, 0); got != now {
+		t.Errorf("Expected a json.Marshaler to be returned as is, got %#v", got)
+	}
+
+	// The same pointer twice is shared, not cyclic
+	shared := &boundNode{Value: 1}
+	pair := []*boundNode{shared, shared}
+	if got := boundValue(pair, DefaultMaxArgDepth); len(got.([]*boundNode)) != 2 {
+		t.Errorf("Expected shared pointers to be returned as is, got %#v", got)
+	}
+}
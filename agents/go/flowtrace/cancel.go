@@ -0,0 +1,29 @@
+package flowtrace
+
+import "context"
+
+// Watchable is a call WatchContext can tag: a *CallContext or a *Span
+type Watchable interface {
+	watchedFrame() *spanFrame
+}
+
+func (ctx *CallContext) watchedFrame() *spanFrame {
+	if ctx == nil {
+		return nil
+	}
+	return ctx.frame
+}
+
+func (s *Span) watchedFrame() *spanFrame { return s.frame }
+
+// WatchContext ties call to ctx, the context it runs under: if ctx is done
+// by the time the call returns, because it was cancelled or its deadline
+// passed, the EXIT or EXCEPTION event of the call carries cancelled set and
+// the error of ctx, e.g. "context deadline exceeded". Timeouts thus stand
+// apart from the errors the call returns. Calls not being traced are left
+// alone.
+func WatchContext(ctx context.Context, call Watchable) {
+	if frame := call.watchedFrame(); frame != nil {
+		frame.ctx.Store(&ctx)
+	}
+}
@@ -0,0 +1,88 @@
+package flowtrace
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchContextTagsCancelledCalls(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	// Cancelled during the call
+	ctx, cancel := context.WithCancel(context.Background())
+	call := Enter("main", "fetch", nil)
+	WatchContext(ctx, call)
+	cancel()
+	call.Exit(nil)
+
+	// Timed out during the call, which then panicked
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	call = Enter("main", "query", nil)
+	WatchContext(ctx, call)
+	<-ctx.Done()
+	call.ExceptionString("panic: boom")
+
+	// Returned before its context was cancelled
+	ctx, cancel = context.WithCancel(context.Background())
+	call = Enter("main", "quick", nil)
+	WatchContext(ctx, call)
+	call.Exit(nil)
+	cancel()
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	reasons := make(map[string]string)
+	for _, event := range readTrace(t, path) {
+		if event.Event == "ENTER" {
+			if event.Cancelled {
+				t.Errorf("Expected no cancellation on ENTER, got %+v", event)
+			}
+			continue
+		}
+		if event.Cancelled != (event.CancelReason != "") {
+			t.Errorf("Expected a reason exactly on cancelled events, got %+v", event)
+		}
+		reasons[event.Method] = event.CancelReason
+	}
+
+	expected := map[string]string{
+		"fetch": "context canceled",
+		"query": "context deadline exceeded",
+		"quick": "",
+	}
+	for method, reason := range expected {
+		if reasons[method] != reason {
+			t.Errorf("Expected %s to end with cancel reason %q, got %q", method, reason, reasons[method])
+		}
+	}
+}
+
+func TestWatchContextSpan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	ft := New(Config{LogFile: path})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	span := ft.StartSpan("checkout")
+	WatchContext(ctx, span)
+	cancel()
+	span.End()
+
+	// A span that was not sampled has nothing to tag
+	WatchContext(ctx, &Span{})
+
+	if err := ft.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	events := readTrace(t, path)
+	if len(events) != 2 || !events[1].Cancelled || events[1].CancelReason != "context canceled" {
+		t.Errorf("Expected the EXIT of the span to be tagged as cancelled, got %+v", events)
+	}
+}
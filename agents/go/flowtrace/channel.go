@@ -0,0 +1,68 @@
+package flowtrace
+
+import (
+	"fmt"
+	"time"
+)
+
+// Send sends v on ch, as ch <- v does, and logs a CHANNEL event recording
+// how long the send blocked. The event names the innermost call open on
+// the calling goroutine and carries its span and trace IDs.
+func Send[T any](ch chan<- T, v T) {
+	t := globalTracer.Load()
+	if t == nil {
+		ch <- v
+		return
+	}
+
+	start := t.clock.Now()
+	ch <- v
+	t.channelOp("send", fmt.Sprintf("%T %p", ch, ch), nil, start)
+}
+
+// Recv receives from ch, as v, ok := <-ch does, and logs a CHANNEL event
+// recording how long the receive blocked, linked to the enclosing call as
+// for Send. ok is false when ch is closed and empty.
+func Recv[T any](ch <-chan T) (T, bool) {
+	t := globalTracer.Load()
+	if t == nil {
+		v, ok := <-ch
+		return v, ok
+	}
+
+	start := t.clock.Now()
+	v, ok := <-ch
+	t.channelOp("recv", fmt.Sprintf("%T %p", ch, ch), &ok, start)
+	return v, ok
+}
+
+// channelOp logs the CHANNEL event of a channel operation op on channel
+// started at time start; ok is the result of a receive
+func (t *Tracer) channelOp(op, channel string, ok *bool, start time.Time) {
+	now := t.clock.Now()
+	gid := getGoroutineID()
+
+	args := map[string]interface{}{"op": op, "channel": channel}
+	if ok != nil {
+		args["ok"] = *ok
+	}
+	waited := now.Sub(start)
+	event := TraceEvent{
+		Event:          "CHANNEL",
+		Timestamp:      t.timestamp(now),
+		Args:           t.encodeArgs(args),
+		DurationMillis: waited.Milliseconds(),
+		DurationMicros: waited.Microseconds(),
+		Thread:         threadName(gid),
+	}
+	if t.config.TimeUnit == TimeUnitNanos {
+		event.DurationNanos = waited.Nanoseconds()
+	}
+	if frame := t.openFrame(gid); frame != nil {
+		event.Class = frame.packageName
+		event.Method = frame.funcName
+		event.SpanID = frame.spanID
+		event.TraceID = frame.traceID
+	}
+	t.logEvent(event)
+}
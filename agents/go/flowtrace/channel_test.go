@@ -0,0 +1,111 @@
+package flowtrace
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// channelEvents returns the CHANNEL events of the trace at path
+func channelEvents(t *testing.T, path string) []TraceEvent {
+	t.Helper()
+
+	var events []TraceEvent
+	for _, event := range readTrace(t, path) {
+		if event.Event == "CHANNEL" {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func TestRecvRecordsBlockedWait(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	const delay = 50 * time.Millisecond
+	ch := make(chan int)
+	go func() {
+		time.Sleep(delay)
+		ch <- 42
+	}()
+	ctx := Enter("main", "Consume", nil)
+	v, ok := Recv(ch)
+	ctx.Exit(nil)
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	if v != 42 || !ok {
+		t.Errorf("Expected to receive 42, got %d, %v", v, ok)
+	}
+	events := channelEvents(t, path)
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 CHANNEL event, got %d", len(events))
+	}
+	recv := events[0]
+	if recv.DurationMicros < delay.Microseconds() || recv.DurationMillis < delay.Milliseconds() {
+		t.Errorf("Expected the receive to have waited at least %v, got %dµs", delay, recv.DurationMicros)
+	}
+	if recv.Class != "main" || recv.Method != "Consume" || recv.SpanID != ctx.spanID || recv.TraceID != ctx.traceID {
+		t.Errorf("Expected the receive to be linked to the Consume call, got %+v", recv)
+	}
+
+	var args map[string]interface{}
+	if err := json.Unmarshal(recv.Args, &args); err != nil {
+		t.Fatalf("Invalid args %s: %v", recv.Args, err)
+	}
+	if args["op"] != "recv" || args["ok"] != true || args["channel"] == "" {
+		t.Errorf("Expected a successful receive, got %s", recv.Args)
+	}
+}
+
+func TestSendAndRecvOnClosedChannel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path, TimeUnit: TimeUnitNanos}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	ch := make(chan string, 1)
+	Send(ch, "job")
+	<-ch
+	close(ch)
+	if _, ok := Recv(ch); ok {
+		t.Errorf("Expected a receive on a closed channel to report it")
+	}
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	events := channelEvents(t, path)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 CHANNEL events, got %d", len(events))
+	}
+	wantOp := []string{"send", "recv"}
+	for i, event := range events {
+		var args map[string]interface{}
+		if err := json.Unmarshal(event.Args, &args); err != nil {
+			t.Fatalf("Invalid args %s: %v", event.Args, err)
+		}
+		if args["op"] != wantOp[i] {
+			t.Errorf("Expected a %s, got %s", wantOp[i], event.Args)
+		}
+		if ok, received := args["ok"]; received != (i == 1) || received && ok != false {
+			t.Errorf("Expected only the receive to report the channel closed, got %s", event.Args)
+		}
+		if event.DurationNanos <= 0 || event.SpanID != "" {
+			t.Errorf("Expected an unlinked operation with its wait in nanoseconds, got %+v", event)
+		}
+	}
+}
+
+func TestChannelHelpersWithoutTracer(t *testing.T) {
+	ch := make(chan int, 1)
+	Send(ch, 7)
+	if v, ok := Recv(ch); v != 7 || !ok {
+		t.Errorf("Expected to receive 7 without a tracer, got %d, %v", v, ok)
+	}
+}
@@ -0,0 +1,43 @@
+package flowtrace
+
+import "time"
+
+// Timestamp units
+const (
+	// TimeUnitMicros writes timestamps in Unix microseconds (the default)
+	TimeUnitMicros = "micros"
+	// TimeUnitNanos writes timestamps in Unix nanoseconds, and adds
+	// durationNanos to EXIT and EXCEPTION events
+	TimeUnitNanos = "nanos"
+)
+
+// Clock tells a tracer the time. Tests set Config.Clock to a fake clock to
+// get exact timestamps and durations.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the wall clock used when Config.Clock is nil
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// validTimeUnit reports whether unit names a timestamp unit; empty means
+// the default
+func validTimeUnit(unit string) bool {
+	switch unit {
+	case "", TimeUnitMicros, TimeUnitNanos:
+		return true
+	}
+	return false
+}
+
+// timestamp returns now as an event timestamp in Config.TimeUnit
+func (t *Tracer) timestamp(now time.Time) int64 {
+	if t.config.TimeUnit == TimeUnitNanos {
+		return now.UnixNano()
+	}
+	return now.UnixMicro()
+}
@@ -0,0 +1,96 @@
+package flowtrace
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock that only moves when advanced
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestTracerClock(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path, Clock: clock}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	ctx := Enter("main", "Load", nil)
+	clock.Advance(100 * time.Millisecond)
+	if ctx.Duration() != 100*time.Millisecond {
+		t.Errorf("Expected the call to have lasted 100ms on the clock, got %v", ctx.Duration())
+	}
+	ctx.Exit(nil)
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"durationMillis":100,"durationMicros":100000,`) {
+		t.Errorf("Expected a 100ms duration, got:\n%s", data)
+	}
+
+	events := readTrace(t, path)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	if events[0].Timestamp != start.UnixMicro() || events[1].Timestamp != start.Add(100*time.Millisecond).UnixMicro() {
+		t.Errorf("Expected timestamps from the clock, got %d and %d", events[0].Timestamp, events[1].Timestamp)
+	}
+	if events[1].DurationNanos != 0 {
+		t.Errorf("Expected no durationNanos in microseconds, got %d", events[1].DurationNanos)
+	}
+}
+
+func TestTracerTimeUnitNanos(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path, Clock: clock, TimeUnit: TimeUnitNanos}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	ctx := Enter("main", "Load", nil)
+	clock.Advance(1500 * time.Nanosecond)
+	ctx.Exit(nil)
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	events := readTrace(t, path)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	if events[0].Timestamp != start.UnixNano() || events[1].Timestamp != start.UnixNano()+1500 {
+		t.Errorf("Expected timestamps in nanoseconds, got %d and %d", events[0].Timestamp, events[1].Timestamp)
+	}
+	exit := events[1]
+	if exit.DurationNanos != 1500 || exit.DurationMicros != 1 || exit.DurationMillis != 0 {
+		t.Errorf("Expected a 1500ns duration, got %+v", exit)
+	}
+}
@@ -3,40 +3,187 @@ package flowtrace
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 // Config holds FlowTrace configuration
 type Config struct {
-	// PackagePrefix filters traces by package prefix
+	// PackagePrefix filters traces by package prefix; calls in other packages
+	// are not logged
 	PackagePrefix string
 
-	// LogFile path to JSONL log file
+	// ServiceName, ServiceVersion and Environment identify the traced
+	// service, e.g. "checkout", "1.4.2" and "production". They are written
+	// with the host name and process ID in the METADATA event starting a
+	// trace, and describe the service to an OTLP collector.
+	ServiceName    string
+	ServiceVersion string
+	Environment    string
+
+	// LogFile path to JSONL log file. Processes may share one, each line
+	// being appended at once, unless it is compressed.
 	LogFile string
 
 	// Stdout enables logging to stdout
 	Stdout bool
 
+	// RingBufferSize, when positive, keeps the last RingBufferSize events
+	// in memory in place of writing them to LogFile and stdout, for a
+	// post-mortem trace without steady-state I/O. They are written out by
+	// Dump, on DumpSignals and by a deferred DumpOnPanic, the last two to
+	// the end of LogFile or to stderr without one. OTLP, RemoteAddr and
+	// Metrics still receive every event.
+	RingBufferSize int
+
+	// DumpSignals dump the ring buffer of RingBufferSize whenever one of
+	// them is received, e.g. syscall.SIGUSR1
+	DumpSignals []os.Signal
+
+	// StdoutFormat of stdout output: "json" (default) for JSON lines or
+	// "pretty" for indented, human-readable lines, colored on a terminal
+	StdoutFormat string
+
+	// Compress gzip-compresses the log file (also enabled by a .gz LogFile suffix)
+	Compress bool
+
+	// Sync makes Flush also fsync the log file, so flushed events survive
+	// a crash of the machine and not only of the process
+	Sync bool
+
+	// Format of the log file: "jsonl" (default), "json" for a single array
+	// that is completed on Stop and replaces an existing file, or "csv".
+	// Stdout is formatted by StdoutFormat.
+	Format string
+
+	// TimeUnit of event timestamps: "micros" (default) or "nanos", which
+	// also adds durationNanos to EXIT and EXCEPTION events
+	TimeUnit string
+
+	// Clock provides the time of events; nil means the wall clock. Tests
+	// set it to a fake clock for deterministic timestamps and durations.
+	Clock Clock
+
 	// MaxArgLength maximum length for argument values
 	MaxArgLength int
 
-	// Exclude packages/patterns to exclude
+	// MaxArgDepth bounds how deeply structs, maps and slices nested in an
+	// argument or result are logged; deeper ones are logged as
+	// "<max-depth>", and values containing themselves as "<cycle>".
+	// 0 means DefaultMaxArgDepth.
+	MaxArgDepth int
+
+	// LegacyArgFormat writes args and results as a single fmt "%v" string
+	// instead of JSON values
+	LegacyArgFormat bool
+
+	// ArgMarshaler, when set, is offered every argument and result value
+	// before it is serialized. When it returns true its string is logged in
+	// place of the value, e.g. to mask a domain type or to shorten large
+	// values (see SummarizeCollections); otherwise the value is serialized
+	// as usual. Arguments whose name matches Redact are redacted either way.
+	ArgMarshaler func(interface{}) (string, bool)
+
+	// Exclude packages/patterns to exclude, at instrument time and at runtime
 	Exclude []string
 
-	// Include packages/patterns to include
+	// Include packages/patterns to include; when set, calls in other
+	// packages are not logged. A package matching both an include and an
+	// exclude pattern follows the more specific one, so an include can
+	// re-include part of a broad exclude.
 	Include []string
 
-	// SamplingRate for trace sampling (0.0-1.0)
+	// ExcludeFunctions lists "package.Function" patterns, in the syntax of
+	// sampling rules, of functions whose calls are not logged, e.g.
+	// "main.sleep" to mute a noisy function. Calls made by a muted function
+	// are still logged, under its caller.
+	ExcludeFunctions []string
+
+	// IncludeFunctions, when set, limits logging to the calls of functions
+	// matching one of its "package.Function" patterns; ExcludeFunctions
+	// still applies to them
+	IncludeFunctions []string
+
+	// Redact lists argument and struct field names (globs, case-insensitive)
+	// whose values are logged as "<redacted>", e.g. "password" or "*token*"
+	Redact []string
+
+	// SamplingRate for trace sampling (0.0-1.0); 0 is treated as unset and
+	// traces every call. Traces are sampled whole: the decision is made at
+	// the root call and holds for all the calls below it.
 	SamplingRate float64
 
-	// MaxDepth maximum call stack depth to trace
+	// Rules override SamplingRate for matching functions. The first rule
+	// whose pattern matches a call wins; unmatched calls use SamplingRate.
+	// A rule matching a root call samples its whole trace; within a sampled
+	// trace, a rule samples the calls it matches one by one.
+	Rules []SamplingRule
+
+	// ArgRules bound the cost of serializing the arguments and results of
+	// hot functions. Every logged call of a function matching a rule still
+	// gets its events, but only the rule's Rate fraction of them record
+	// args and result; the others record just the timing. The first
+	// matching rule wins; other functions always record them.
+	ArgRules []SamplingRule
+
+	// TailSampling holds the events of each trace in memory until its root
+	// call returns, then writes them only if a call of the trace failed
+	// (returned an error or panicked) or the root took longer than
+	// SlowThreshold; fast and clean traces are discarded. Traces still
+	// open when the tracer stops are written.
+	TailSampling bool
+
+	// SlowThreshold is the root call duration above which TailSampling
+	// keeps a trace; 0 keeps only the traces that failed
+	SlowThreshold time.Duration
+
+	// MaxBufferedTraces bounds the traces TailSampling holds at once;
+	// traces started beyond it are written as they happen, like a trace
+	// too large to hold. 0 means DefaultMaxBufferedTraces.
+	MaxBufferedTraces int
+
+	// MaxDepth maximum call stack depth to trace per goroutine; deeper calls
+	// are not logged (0 means unlimited)
 	MaxDepth int
 
+	// OTLPEndpoint forwards spans to an OpenTelemetry collector over OTLP/gRPC
+	// (e.g. "localhost:4317"); events are still written to LogFile if set
+	OTLPEndpoint string
+
+	// RemoteAddr streams events as JSON lines to a collector, at
+	// "tcp://host:port", "udp://host:port" (one event per datagram) or
+	// "host:port" for TCP; events are still written to LogFile if set.
+	// Sending never blocks the traced program: events the collector can't
+	// take in time are dropped and counted (see RemoteDropped), and a lost
+	// TCP connection is redialed with backoff.
+	RemoteAddr string
+
+	// Metrics collects per-function call and error counters and duration
+	// histograms from the logged calls, served by MetricsHandler
+	Metrics bool
+
+	// MetricsMaxMethods bounds the number of functions metrics are kept
+	// for; calls of further functions are counted under class and method
+	// "other". 0 means DefaultMetricsMaxMethods.
+	MetricsMaxMethods int
+
 	// FrameworkConfig framework-specific configuration
 	Frameworks FrameworkConfig
 }
 
+// SamplingRule sets the sampling rate of the functions matching Pattern
+type SamplingRule struct {
+	// Pattern is matched against "package.Function" with the filter package
+	// syntax, e.g. "main.LoadUser", "main.*" or "github.com/acme/db.*"
+	Pattern string
+
+	// Rate is the fraction of matching calls to trace (0.0-1.0)
+	Rate float64
+}
+
 // FrameworkConfig holds framework-specific settings
 type FrameworkConfig struct {
 	AutoDetect bool
@@ -52,8 +199,8 @@ func DefaultConfig() *Config {
 		PackagePrefix: "",
 		LogFile:       "flowtrace.jsonl",
 		Stdout:        false,
+		Format:        FormatJSONL,
 		MaxArgLength:  1000,
-		MaxDepth:      100,
 		SamplingRate:  1.0,
 		Exclude:       []string{},
 		Include:       []string{},
@@ -98,11 +245,35 @@ func LoadConfig(configFile string) (*Config, error) {
 
 	// Load configuration
 	config.PackagePrefix = v.GetString("package_prefix")
+	config.ServiceName = v.GetString("service.name")
+	config.ServiceVersion = v.GetString("service.version")
+	config.Environment = v.GetString("service.environment")
 	config.LogFile = v.GetString("output.file")
 	config.Stdout = v.GetBool("output.stdout")
+	config.RingBufferSize = v.GetInt("output.ring_buffer_size")
+	config.StdoutFormat = v.GetString("output.stdout_format")
+	config.Compress = v.GetBool("output.compress")
+	config.Sync = v.GetBool("output.sync")
+	config.Format = v.GetString("output.format")
+	config.TimeUnit = v.GetString("output.time_unit")
 	config.MaxArgLength = v.GetInt("max_arg_length")
+	config.MaxArgDepth = v.GetInt("max_arg_depth")
+	config.LegacyArgFormat = v.GetBool("legacy_arg_format")
 	config.MaxDepth = v.GetInt("max_depth")
 	config.SamplingRate = v.GetFloat64("sampling.rate")
+	config.TailSampling = v.GetBool("sampling.tail")
+	config.SlowThreshold = v.GetDuration("sampling.slow_threshold")
+	config.MaxBufferedTraces = v.GetInt("sampling.max_buffered_traces")
+	if err := v.UnmarshalKey("sampling.rules", &config.Rules); err != nil {
+		return nil, fmt.Errorf("failed to read sampling rules: %w", err)
+	}
+	if err := v.UnmarshalKey("sampling.arg_rules", &config.ArgRules); err != nil {
+		return nil, fmt.Errorf("failed to read argument sampling rules: %w", err)
+	}
+	config.OTLPEndpoint = v.GetString("otlp.endpoint")
+	config.RemoteAddr = v.GetString("output.remote_addr")
+	config.Metrics = v.GetBool("metrics.enabled")
+	config.MetricsMaxMethods = v.GetInt("metrics.max_methods")
 
 	// Load exclude/include patterns
 	if v.IsSet("exclude") {
@@ -111,6 +282,15 @@ func LoadConfig(configFile string) (*Config, error) {
 	if v.IsSet("include") {
 		config.Include = v.GetStringSlice("include")
 	}
+	if v.IsSet("redact") {
+		config.Redact = v.GetStringSlice("redact")
+	}
+	if v.IsSet("exclude_functions") {
+		config.ExcludeFunctions = v.GetStringSlice("exclude_functions")
+	}
+	if v.IsSet("include_functions") {
+		config.IncludeFunctions = v.GetStringSlice("include_functions")
+	}
 
 	// Load framework config
 	if v.IsSet("frameworks") {
@@ -128,9 +308,6 @@ func LoadConfig(configFile string) (*Config, error) {
 	if config.MaxArgLength == 0 {
 		config.MaxArgLength = 1000
 	}
-	if config.MaxDepth == 0 {
-		config.MaxDepth = 100
-	}
 	if config.SamplingRate == 0 {
 		config.SamplingRate = 1.0
 	}
@@ -145,16 +322,78 @@ func LoadConfigFromEnv() *Config {
 	if val := os.Getenv("FLOWTRACE_PACKAGE_PREFIX"); val != "" {
 		config.PackagePrefix = val
 	}
+	if val := os.Getenv("FLOWTRACE_SERVICE_NAME"); val != "" {
+		config.ServiceName = val
+	}
+	if val := os.Getenv("FLOWTRACE_SERVICE_VERSION"); val != "" {
+		config.ServiceVersion = val
+	}
+	if val := os.Getenv("FLOWTRACE_ENVIRONMENT"); val != "" {
+		config.Environment = val
+	}
 	if val := os.Getenv("FLOWTRACE_LOGFILE"); val != "" {
 		config.LogFile = val
 	}
 	if val := os.Getenv("FLOWTRACE_STDOUT"); val == "true" {
 		config.Stdout = true
 	}
+	if val := os.Getenv("FLOWTRACE_STDOUT_FORMAT"); val != "" {
+		config.StdoutFormat = val
+	}
+	if val := os.Getenv("FLOWTRACE_COMPRESS"); val == "true" {
+		config.Compress = true
+	}
+	if val := os.Getenv("FLOWTRACE_SYNC"); val == "true" {
+		config.Sync = true
+	}
+	if val := os.Getenv("FLOWTRACE_FORMAT"); val != "" {
+		config.Format = val
+	}
+	if val := os.Getenv("FLOWTRACE_TIME_UNIT"); val != "" {
+		config.TimeUnit = val
+	}
+	if val := os.Getenv("FLOWTRACE_LEGACY_ARG_FORMAT"); val == "true" {
+		config.LegacyArgFormat = true
+	}
+	if val := os.Getenv("FLOWTRACE_OTLP_ENDPOINT"); val != "" {
+		config.OTLPEndpoint = val
+	}
+	if val := os.Getenv("FLOWTRACE_REMOTE_ADDR"); val != "" {
+		config.RemoteAddr = val
+	}
+	if val := os.Getenv("FLOWTRACE_METRICS"); val == "true" {
+		config.Metrics = true
+	}
+	if val := os.Getenv("FLOWTRACE_INCLUDE"); val != "" {
+		config.Include = splitList(val)
+	}
+	if val := os.Getenv("FLOWTRACE_EXCLUDE"); val != "" {
+		config.Exclude = splitList(val)
+	}
+	if val := os.Getenv("FLOWTRACE_REDACT"); val != "" {
+		config.Redact = splitList(val)
+	}
+	if val := os.Getenv("FLOWTRACE_EXCLUDE_FUNCTIONS"); val != "" {
+		config.ExcludeFunctions = splitList(val)
+	}
+	if val := os.Getenv("FLOWTRACE_INCLUDE_FUNCTIONS"); val != "" {
+		config.IncludeFunctions = splitList(val)
+	}
 
 	return config
 }
 
+// splitList splits a comma-separated environment value, dropping empty items
+func splitList(val string) []string {
+	var items []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 // Validate checks if configuration is valid
 func (c *Config) Validate() error {
 	if c == nil {
@@ -165,24 +404,115 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("max_arg_length must be non-negative")
 	}
 
-	if c.MaxDepth < 1 {
-		return fmt.Errorf("max_depth must be at least 1")
+	if c.MaxArgDepth < 0 {
+		return fmt.Errorf("max_arg_depth must be non-negative")
+	}
+
+	if !validFormat(c.Format) {
+		return fmt.Errorf("format must be one of jsonl, json or csv")
+	}
+
+	if !validStdoutFormat(c.StdoutFormat) {
+		return fmt.Errorf("stdout_format must be json or pretty")
+	}
+
+	if !validTimeUnit(c.TimeUnit) {
+		return fmt.Errorf("time_unit must be micros or nanos")
+	}
+
+	if c.MaxDepth < 0 {
+		return fmt.Errorf("max_depth must not be negative (0 means unlimited)")
 	}
 
 	if c.SamplingRate < 0.0 || c.SamplingRate > 1.0 {
 		return fmt.Errorf("sampling_rate must be between 0.0 and 1.0")
 	}
 
+	if c.SlowThreshold < 0 {
+		return fmt.Errorf("slow_threshold must be non-negative")
+	}
+
+	if c.RingBufferSize < 0 {
+		return fmt.Errorf("ring_buffer_size must be non-negative")
+	}
+
+	if c.MaxBufferedTraces < 0 {
+		return fmt.Errorf("max_buffered_traces must be non-negative")
+	}
+
+	if c.MetricsMaxMethods < 0 {
+		return fmt.Errorf("metrics_max_methods must be non-negative")
+	}
+
+	if c.RemoteAddr != "" {
+		if _, _, err := parseRemoteAddr(c.RemoteAddr); err != nil {
+			return fmt.Errorf("remote_addr must be tcp://host:port, udp://host:port or host:port: %w", err)
+		}
+	}
+
+	for i, rule := range c.Rules {
+		if rule.Pattern == "" {
+			return fmt.Errorf("sampling rule %d: pattern cannot be empty", i)
+		}
+		if rule.Rate < 0.0 || rule.Rate > 1.0 {
+			return fmt.Errorf("sampling rule %d: rate must be between 0.0 and 1.0", i)
+		}
+	}
+
+	for i, rule := range c.ArgRules {
+		if rule.Pattern == "" {
+			return fmt.Errorf("arg sampling rule %d: pattern cannot be empty", i)
+		}
+		if rule.Rate < 0.0 || rule.Rate > 1.0 {
+			return fmt.Errorf("arg sampling rule %d: rate must be between 0.0 and 1.0", i)
+		}
+	}
+
 	return nil
 }
 
-// ShouldSample determines if this call should be sampled
-func (c *Config) ShouldSample() bool {
-	if c.SamplingRate >= 1.0 {
-		return true
+// Prepare validates the config and checks that its outputs are usable, so
+// that a bad LogFile is reported up front rather than when the tracer
+// starts. The LogFile directory is created if missing and must be
+// writable. The returned warnings describe settings that are valid but
+// probably unintended, such as a config without any output. Prepare
+// touches the filesystem, so it is not part of Validate.
+func (c *Config) Prepare() (warnings []string, err error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	if c.LogFile != "" {
+		if err := checkWritableDir(filepath.Dir(c.LogFile)); err != nil {
+			return nil, fmt.Errorf("log_file %s: %w", c.LogFile, err)
+		}
+	}
+
+	if !c.Stdout && c.LogFile == "" && c.RingBufferSize == 0 && c.OTLPEndpoint == "" && c.RemoteAddr == "" && !c.Metrics {
+		warnings = append(warnings, "neither stdout, log_file, otlp_endpoint, remote_addr nor metrics is set; traces will not be recorded")
+	}
+
+	return warnings, nil
+}
+
+// checkWritableDir creates dir if needed and verifies that files can be
+// created in it
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
 	}
 
-	// Simple random sampling
-	// In production, use more sophisticated sampling
-	return false // TODO: Implement proper sampling
+	f, err := os.CreateTemp(dir, ".flowtrace-*")
+	if err != nil {
+		return fmt.Errorf("directory %s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// ShouldSample reports whether the trace traceID is logged at
+// SamplingRate. It makes the decision the tracer makes for a root call
+// without a matching rule, so every process of a trace decides alike.
+func (c *Config) ShouldSample(traceID string) bool {
+	return traceSampled(traceID, c.SamplingRate)
 }
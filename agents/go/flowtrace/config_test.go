@@ -2,7 +2,10 @@ package flowtrace
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDefaultConfig(t *testing.T) {
@@ -20,8 +23,8 @@ func TestDefaultConfig(t *testing.T) {
 		t.Errorf("Expected MaxArgLength 1000, got %d", config.MaxArgLength)
 	}
 
-	if config.MaxDepth != 100 {
-		t.Errorf("Expected MaxDepth 100, got %d", config.MaxDepth)
+	if config.MaxDepth != 0 {
+		t.Errorf("Expected unlimited MaxDepth, got %d", config.MaxDepth)
 	}
 
 	if config.SamplingRate != 1.0 {
@@ -54,12 +57,21 @@ func TestConfigValidation(t *testing.T) {
 			expectErr: true,
 		},
 		{
-			name: "zero max depth",
+			name: "unlimited max depth",
 			config: &Config{
 				MaxArgLength: 1000,
 				MaxDepth:     0,
 				SamplingRate: 1.0,
 			},
+			expectErr: false,
+		},
+		{
+			name: "negative max depth",
+			config: &Config{
+				MaxArgLength: 1000,
+				MaxDepth:     -1,
+				SamplingRate: 1.0,
+			},
 			expectErr: true,
 		},
 		{
@@ -80,6 +92,97 @@ func TestConfigValidation(t *testing.T) {
 			},
 			expectErr: true,
 		},
+		{
+			name: "sampling rule rate too high",
+			config: &Config{
+				MaxDepth:     100,
+				SamplingRate: 1.0,
+				Rules:        []SamplingRule{{Pattern: "main.*", Rate: 2}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "sampling rule without pattern",
+			config: &Config{
+				MaxDepth:     100,
+				SamplingRate: 1.0,
+				Rules:        []SamplingRule{{Rate: 0.5}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "arg sampling rule rate too high",
+			config: &Config{
+				MaxDepth:     100,
+				SamplingRate: 1.0,
+				ArgRules:     []SamplingRule{{Pattern: "main.hot", Rate: 1.5}},
+			},
+			expectErr: true,
+		},
+		{
+			name: "negative slow threshold",
+			config: &Config{
+				MaxDepth:      100,
+				SamplingRate:  1.0,
+				TailSampling:  true,
+				SlowThreshold: -time.Second,
+			},
+			expectErr: true,
+		},
+		{
+			name: "valid sampling rules",
+			config: &Config{
+				MaxDepth:     100,
+				SamplingRate: 0.1,
+				Rules:        []SamplingRule{{Pattern: "main.*", Rate: 1.0}, {Pattern: "**/util.Format", Rate: 0}},
+			},
+			expectErr: false,
+		},
+		{
+			name: "unknown time unit",
+			config: &Config{
+				MaxDepth:     100,
+				SamplingRate: 1.0,
+				TimeUnit:     "millis",
+			},
+			expectErr: true,
+		},
+		{
+			name: "remote address with unknown scheme",
+			config: &Config{
+				MaxDepth:     100,
+				SamplingRate: 1.0,
+				RemoteAddr:   "http://collector:9000",
+			},
+			expectErr: true,
+		},
+		{
+			name: "remote address without port",
+			config: &Config{
+				MaxDepth:     100,
+				SamplingRate: 1.0,
+				RemoteAddr:   "collector",
+			},
+			expectErr: true,
+		},
+		{
+			name: "valid remote address",
+			config: &Config{
+				MaxDepth:     100,
+				SamplingRate: 1.0,
+				RemoteAddr:   "udp://collector:9000",
+			},
+			expectErr: false,
+		},
+		{
+			name: "negative ring buffer size",
+			config: &Config{
+				MaxDepth:       100,
+				SamplingRate:   1.0,
+				RingBufferSize: -1,
+			},
+			expectErr: true,
+		},
 		{
 			name: "minimum valid config",
 			config: &Config{
@@ -104,6 +207,87 @@ func TestConfigValidation(t *testing.T) {
 	}
 }
 
+func TestConfigPrepare(t *testing.T) {
+	t.Run("creates log directory", func(t *testing.T) {
+		logFile := filepath.Join(t.TempDir(), "traces", "nested", "flowtrace.jsonl")
+		config := &Config{LogFile: logFile, MaxDepth: 100}
+
+		warnings, err := config.Prepare()
+		if err != nil {
+			t.Fatalf("Prepare failed: %v", err)
+		}
+		if len(warnings) != 0 {
+			t.Errorf("Expected no warnings, got %v", warnings)
+		}
+		if info, err := os.Stat(filepath.Dir(logFile)); err != nil || !info.IsDir() {
+			t.Errorf("Expected log directory to be created: %v", err)
+		}
+		if entries, _ := os.ReadDir(filepath.Dir(logFile)); len(entries) != 0 {
+			t.Errorf("Expected the writability probe to be removed, found %d entries", len(entries))
+		}
+	})
+
+	t.Run("directory cannot be created", func(t *testing.T) {
+		// A regular file where a directory is expected fails even for root
+		blocker := filepath.Join(t.TempDir(), "blocker")
+		if err := os.WriteFile(blocker, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		config := &Config{LogFile: filepath.Join(blocker, "flowtrace.jsonl"), MaxDepth: 100}
+
+		_, err := config.Prepare()
+		if err == nil || !strings.Contains(err.Error(), "log_file") {
+			t.Errorf("Expected a log_file error, got %v", err)
+		}
+	})
+
+	t.Run("unwritable directory", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("root can write to read-only directories")
+		}
+		dir := t.TempDir()
+		if err := os.Chmod(dir, 0555); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chmod(dir, 0755)
+		config := &Config{LogFile: filepath.Join(dir, "flowtrace.jsonl"), MaxDepth: 100}
+
+		_, err := config.Prepare()
+		if err == nil || !strings.Contains(err.Error(), "not writable") {
+			t.Errorf("Expected a not writable error, got %v", err)
+		}
+	})
+
+	t.Run("no output", func(t *testing.T) {
+		config := &Config{MaxDepth: 100}
+
+		warnings, err := config.Prepare()
+		if err != nil {
+			t.Fatalf("Prepare failed: %v", err)
+		}
+		if len(warnings) != 1 || !strings.Contains(warnings[0], "traces will not be recorded") {
+			t.Errorf("Expected a no-output warning, got %v", warnings)
+		}
+	})
+
+	t.Run("stdout only", func(t *testing.T) {
+		config := &Config{Stdout: true, MaxDepth: 100}
+
+		warnings, err := config.Prepare()
+		if err != nil || len(warnings) != 0 {
+			t.Errorf("Expected no error or warnings, got %v, %v", warnings, err)
+		}
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		config := &Config{Stdout: true, MaxDepth: 100, SamplingRate: 2}
+
+		if _, err := config.Prepare(); err == nil {
+			t.Error("Expected Prepare to run Validate")
+		}
+	})
+}
+
 func TestLoadConfigFromEnv(t *testing.T) {
 	// Save original env vars
 	originalPrefix := os.Getenv("FLOWTRACE_PACKAGE_PREFIX")
@@ -138,31 +322,16 @@ func TestLoadConfigFromEnv(t *testing.T) {
 }
 
 func TestConfigShouldSample(t *testing.T) {
+	traceID := newTraceID()
 	tests := []struct {
 		name         string
 		samplingRate float64
 		expected     bool
 	}{
-		{
-			name:         "always sample",
-			samplingRate: 1.0,
-			expected:     true,
-		},
-		{
-			name:         "above 1.0",
-			samplingRate: 1.5,
-			expected:     true,
-		},
-		{
-			name:         "zero sampling",
-			samplingRate: 0.0,
-			expected:     false, // Current implementation
-		},
-		{
-			name:         "partial sampling",
-			samplingRate: 0.5,
-			expected:     false, // TODO: needs proper implementation
-		},
+		{"always sample", 1.0, true},
+		{"above 1.0", 1.5, true},
+		{"zero sampling", 0.0, false},
+		{"partial sampling", 0.5, traceSampled(traceID, 0.5)},
 	}
 
 	for _, tt := range tests {
@@ -170,12 +339,23 @@ func TestConfigShouldSample(t *testing.T) {
 			config := &Config{
 				SamplingRate: tt.samplingRate,
 			}
-			result := config.ShouldSample()
-			if result != tt.expected {
+			if result := config.ShouldSample(traceID); result != tt.expected {
 				t.Errorf("ShouldSample() = %v, want %v", result, tt.expected)
 			}
 		})
 	}
+
+	// A partial rate keeps some traces and drops others
+	config := &Config{SamplingRate: 0.5}
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		if config.ShouldSample(newTraceID()) {
+			kept++
+		}
+	}
+	if kept == 0 || kept == 1000 {
+		t.Errorf("Expected some of 1000 traces kept at rate 0.5, got %d", kept)
+	}
 }
 
 func TestFrameworkConfig(t *testing.T) {
@@ -237,10 +417,10 @@ func TestConfigEdgeCases(t *testing.T) {
 	})
 
 	t.Run("empty config validation", func(t *testing.T) {
+		// Every zero value is a valid default, MaxDepth 0 being unlimited
 		config := &Config{}
-		err := config.Validate()
-		if err == nil {
-			t.Error("Expected error for empty config")
+		if err := config.Validate(); err != nil {
+			t.Errorf("Expected the empty config to be valid: %v", err)
 		}
 	})
 
@@ -298,4 +478,121 @@ func TestConfigDefaults(t *testing.T) {
 	if loaded.LogFile == "" {
 		t.Error("Expected default LogFile to be set")
 	}
+
+	if loaded.MaxDepth != 0 {
+		t.Errorf("Expected unlimited MaxDepth by default, got %d", loaded.MaxDepth)
+	}
+}
+
+func TestLoadConfigSamplingRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".flowtrace.yaml")
+	yaml := `sampling:
+  rate: 0.5
+  rules:
+    - pattern: main.LoadUser
+      rate: 1.0
+    - pattern: "main.*"
+      rate: 0.01
+  arg_rules:
+    - pattern: main.hot
+      rate: 0.1
+  tail: true
+  slow_threshold: 250ms
+  max_buffered_traces: 50
+`
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	expected := []SamplingRule{{Pattern: "main.LoadUser", Rate: 1.0}, {Pattern: "main.*", Rate: 0.01}}
+	if len(config.Rules) != len(expected) {
+		t.Fatalf("Expected %d rules, got %d", len(expected), len(config.Rules))
+	}
+	for i, rule := range expected {
+		if config.Rules[i] != rule {
+			t.Errorf("Rule %d: expected %+v, got %+v", i, rule, config.Rules[i])
+		}
+	}
+	if len(config.ArgRules) != 1 || config.ArgRules[0] != (SamplingRule{Pattern: "main.hot", Rate: 0.1}) {
+		t.Errorf("Expected the arg sampling rule, got %+v", config.ArgRules)
+	}
+	if !config.TailSampling || config.SlowThreshold != 250*time.Millisecond || config.MaxBufferedTraces != 50 {
+		t.Errorf("Expected tail sampling of traces slower than 250ms, holding 50, got %v, %v, %d", config.TailSampling, config.SlowThreshold, config.MaxBufferedTraces)
+	}
+}
+
+func TestLoadConfigSync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".flowtrace.yaml")
+	yaml := `output:
+  file: trace.jsonl
+  sync: true
+`
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if !config.Sync {
+		t.Error("Expected output.sync to set Sync")
+	}
+}
+
+func TestLoadConfigFromEnvSync(t *testing.T) {
+	if LoadConfigFromEnv().Sync {
+		t.Error("Expected Sync to be off without FLOWTRACE_SYNC")
+	}
+
+	t.Setenv("FLOWTRACE_SYNC", "true")
+	if !LoadConfigFromEnv().Sync {
+		t.Error("Expected FLOWTRACE_SYNC=true to set Sync")
+	}
+}
+
+func TestLoadConfigFromEnvPackageFilters(t *testing.T) {
+	t.Setenv("FLOWTRACE_INCLUDE", "github.com/acme/**, main")
+	t.Setenv("FLOWTRACE_EXCLUDE", "github.com/acme/db/**")
+
+	config := LoadConfigFromEnv()
+	if len(config.Include) != 2 || config.Include[0] != "github.com/acme/**" || config.Include[1] != "main" {
+		t.Errorf("Expected include patterns from env, got %v", config.Include)
+	}
+	if len(config.Exclude) != 1 || config.Exclude[0] != "github.com/acme/db/**" {
+		t.Errorf("Expected exclude patterns from env, got %v", config.Exclude)
+	}
+}
+
+func TestLoadConfigFunctionFilters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".flowtrace.yaml")
+	yaml := `exclude_functions:
+  - main.sleep
+include_functions:
+  - "main.*"
+`
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if len(config.ExcludeFunctions) != 1 || config.ExcludeFunctions[0] != "main.sleep" {
+		t.Errorf("Expected the excluded functions from the file, got %v", config.ExcludeFunctions)
+	}
+	if len(config.IncludeFunctions) != 1 || config.IncludeFunctions[0] != "main.*" {
+		t.Errorf("Expected the included functions from the file, got %v", config.IncludeFunctions)
+	}
+
+	t.Setenv("FLOWTRACE_EXCLUDE_FUNCTIONS", "main.sleep, main.poll")
+	if config := LoadConfigFromEnv(); len(config.ExcludeFunctions) != 2 || config.ExcludeFunctions[1] != "main.poll" {
+		t.Errorf("Expected the excluded functions from env, got %v", config.ExcludeFunctions)
+	}
 }
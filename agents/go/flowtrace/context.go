@@ -13,6 +13,22 @@ type CallContext struct {
 	startTime    time.Time
 	goroutineID  int64
 	args         map[string]interface{}
+	traceID      string
+	spanID       string
+	frame        *spanFrame // span of the call, nil when entered without a tracer
+	err          error      // error returned by the call, reported on exit
+	exited       bool       // set by Exit; a panic may still be logged after it
+
+	// Spans of the calls deferred by the call that are running, innermost
+	// last (see EnterDeferred)
+	deferred []*CallContext
+}
+
+// Enabled reports whether a tracer is running. Instrumented functions
+// check it before building the arguments of Enter, so they cost next to
+// nothing while tracing is off.
+func Enabled() bool {
+	return globalTracer.Load() != nil
 }
 
 // Enter creates a new call context and logs function entry
@@ -22,65 +38,243 @@ func Enter(pkg, fn string, args map[string]interface{}) *CallContext {
 		packageName:  pkg,
 		functionName: fn,
 		startTime:    time.Now(),
-		goroutineID:  getGoroutineID(),
 		args:         args,
 	}
 
-	// Log ENTER event
-	TraceEnter(pkg, fn, args)
+	// Log ENTER event; the tracer is called directly so it can locate the
+	// instrumented function from a fixed number of frames. The goroutine ID
+	// is looked up once here and reused by Exit and Exception.
+	if t := globalTracer.Load(); t != nil {
+		ctx.goroutineID = getGoroutineID()
+		ctx.setSpan(t.enter(ctx.goroutineID, pkg, fn, args, TraceParent{}, sourceLocation{}))
+	}
 
 	return ctx
 }
 
+// EnterAt is like Enter for a function defined at line of file, which its
+// events report. Instrumented code passes the position the function has in
+// the source it was generated from, as the instrumented copy that runs has
+// its lines shifted by the injected code and may be built from a temporary
+// directory.
+func EnterAt(pkg, fn, file string, line int, args map[string]interface{}) *CallContext {
+	ctx := &CallContext{
+		packageName:  pkg,
+		functionName: fn,
+		startTime:    time.Now(),
+		args:         args,
+	}
+
+	if t := globalTracer.Load(); t != nil {
+		ctx.goroutineID = getGoroutineID()
+		ctx.setSpan(t.enter(ctx.goroutineID, pkg, fn, args, TraceParent{}, sourceLocation{file: file, line: line}))
+	}
+
+	return ctx
+}
+
+// EnterWithParent is like Enter but continues a trace started by a remote
+// caller, typically parsed from an incoming traceparent header. An invalid
+// parent starts a new trace as Enter does.
+func EnterWithParent(parent TraceParent, pkg, fn string, args map[string]interface{}) *CallContext {
+	ctx := &CallContext{
+		packageName:  pkg,
+		functionName: fn,
+		startTime:    time.Now(),
+		args:         args,
+	}
+
+	if t := globalTracer.Load(); t != nil {
+		ctx.goroutineID = getGoroutineID()
+		ctx.setSpan(t.enter(ctx.goroutineID, pkg, fn, args, parent, sourceLocation{}))
+	}
+
+	return ctx
+}
+
+// setSpan records the trace and span IDs assigned at entry, and the entry
+// time on the tracer's clock
+func (ctx *CallContext) setSpan(frame *spanFrame) {
+	ctx.startTime = frame.startTime
+	ctx.traceID = frame.traceID
+	ctx.spanID = frame.spanID
+	ctx.frame = frame
+}
+
 // Exit logs function exit with optional return values
-// This is called via defer at function exit
+// This is called via defer at function exit. Like the other methods, it
+// does nothing on a nil CallContext, the one of a call instrumented code
+// did not enter because tracing was off.
 func (ctx *CallContext) Exit(resultFunc func() interface{}) {
+	if ctx == nil {
+		return
+	}
+	var result interface{}
 	if resultFunc != nil {
-		result := resultFunc()
-		TraceExit(ctx.packageName, ctx.functionName, result)
-	} else {
-		TraceExit(ctx.packageName, ctx.functionName, nil)
+		result = resultFunc()
 	}
+	ctx.traceExit(result)
 }
 
-// ExitWithValues logs function exit with explicit return values
-func (ctx *CallContext) ExitWithValues(results ...interface{}) {
-	var result interface{}
-	if len(results) == 1 {
-		result = results[0]
-	} else if len(results) > 1 {
-		result = results
+// ExitWithValues logs function exit with explicit return values, which are
+// logged as unnamed Results like those of instrumented functions
+func (ctx *CallContext) ExitWithValues(values ...interface{}) {
+	if ctx == nil {
+		return
+	}
+	var results Results
+	for _, value := range values {
+		results = append(results, Result{Value: value})
+	}
+	ctx.traceExit(results)
+}
+
+// traceExit logs the exit of the call's own span, on the goroutine recorded
+// at entry. A call entered while no tracer was running has no span, and
+// logs nothing rather than ending another call.
+func (ctx *CallContext) traceExit(result interface{}) {
+	if ctx.frame == nil {
+		return
+	}
+	ctx.exited = true
+	if t := globalTracer.Load(); t != nil {
+		t.exitSpan(ctx.GoroutineID(), ctx.frame, ctx.packageName, ctx.functionName, result, ctx.err)
+	}
+}
+
+// SetError records err as the error returned by the call; the EXIT event
+// logged by Exit then carries it with isError set. Instrumented functions
+// whose last result is an error call it just before Exit.
+func (ctx *CallContext) SetError(err error) {
+	if ctx != nil {
+		ctx.err = err
 	}
-	TraceExit(ctx.packageName, ctx.functionName, result)
 }
 
 // Exception logs function exception/panic
 // This is called when a panic is recovered
 func (ctx *CallContext) Exception(err error) {
-	TraceException(ctx.packageName, ctx.functionName, err)
+	if ctx == nil {
+		return
+	}
+	if t := globalTracer.Load(); t != nil && ctx.frame != nil {
+		t.exceptionSpan(ctx.GoroutineID(), ctx.frame, ctx.exited, ctx.packageName, ctx.functionName, err)
+	}
+}
+
+// Capture logs the value of a local variable of the call as a CAPTURE
+// event of its span. Instrumented code calls it where a
+// //flowtrace:capture comment names the variable.
+func (ctx *CallContext) Capture(name string, value interface{}) {
+	if t := globalTracer.Load(); t != nil && ctx != nil && ctx.spanID != "" {
+		t.capture(ctx, name, value)
+	}
+}
+
+// EnterDeferred logs the entry of fn, a call deferred by the call, as a
+// span nested in the call's. Instrumented code defers it right after the
+// defer statement of fn, so that it runs just before fn, and defers
+// ExitDeferred right before, so that it runs just after.
+func (ctx *CallContext) EnterDeferred(fn string) {
+	if ctx == nil {
+		return
+	}
+	deferred := &CallContext{
+		packageName:  ctx.packageName,
+		functionName: fn,
+		startTime:    time.Now(),
+	}
+
+	if t := globalTracer.Load(); t != nil {
+		deferred.goroutineID = ctx.GoroutineID()
+		deferred.setSpan(t.enter(deferred.goroutineID, ctx.packageName, fn, nil, TraceParent{}, sourceLocation{}))
+	}
+	ctx.deferred = append(ctx.deferred, deferred)
+}
+
+// ExitDeferred logs the exit of the deferred call entered last by
+// EnterDeferred
+func (ctx *CallContext) ExitDeferred() {
+	if ctx == nil {
+		return
+	}
+	n := len(ctx.deferred)
+	if n == 0 {
+		return
+	}
+	deferred := ctx.deferred[n-1]
+	ctx.deferred = ctx.deferred[:n-1]
+	deferred.traceExit(nil)
 }
 
 // ExceptionString logs function exception with string message
 func (ctx *CallContext) ExceptionString(msg string) {
-	TraceException(ctx.packageName, ctx.functionName, fmt.Errorf("%s", msg))
+	ctx.Exception(fmt.Errorf("%s", msg))
 }
 
-// Duration returns the elapsed time since function entry
+// Duration returns the elapsed time since function entry, on the tracer's
+// clock
 func (ctx *CallContext) Duration() time.Duration {
+	if ctx == nil {
+		return 0
+	}
+	if t := globalTracer.Load(); t != nil {
+		return t.clock.Now().Sub(ctx.startTime)
+	}
 	return time.Since(ctx.startTime)
 }
 
 // Package returns the package name
 func (ctx *CallContext) Package() string {
+	if ctx == nil {
+		return ""
+	}
 	return ctx.packageName
 }
 
 // Function returns the function name
 func (ctx *CallContext) Function() string {
+	if ctx == nil {
+		return ""
+	}
 	return ctx.functionName
 }
 
-// GoroutineID returns the goroutine ID
+// GoroutineID returns the ID of the goroutine the call runs on. It is
+// looked up lazily when tracing was not active at entry.
 func (ctx *CallContext) GoroutineID() int64 {
+	if ctx == nil {
+		return getGoroutineID()
+	}
+	if ctx.goroutineID == 0 {
+		ctx.goroutineID = getGoroutineID()
+	}
 	return ctx.goroutineID
 }
+
+// TraceID returns the ID of the trace the call belongs to, or "" when the
+// call was entered without an active tracer
+func (ctx *CallContext) TraceID() string {
+	if ctx == nil {
+		return ""
+	}
+	return ctx.traceID
+}
+
+// SpanID returns the span ID of the call, or "" when it was not sampled
+func (ctx *CallContext) SpanID() string {
+	if ctx == nil {
+		return ""
+	}
+	return ctx.spanID
+}
+
+// TraceParent returns the call as the parent of spans started elsewhere,
+// e.g. on another goroutine with EnterWithParent. It is invalid when the
+// call is not being traced.
+func (ctx *CallContext) TraceParent() TraceParent {
+	if ctx == nil || ctx.traceID == "" || ctx.spanID == "" {
+		return TraceParent{}
+	}
+	return TraceParent{TraceID: ctx.traceID, ParentID: ctx.spanID, Flags: 0x01}
+}
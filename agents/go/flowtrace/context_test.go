@@ -0,0 +1,116 @@
+package flowtrace
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestNilCallContext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	// The context of a call entered while tracing was off, used after a
+	// tracer started
+	var ctx *CallContext
+	ctx.SetError(errors.New("failed"))
+	ctx.Capture("total", 42)
+	ctx.EnterDeferred("cleanup")
+	ctx.ExitDeferred()
+	ctx.ExceptionString("boom")
+	ctx.ExitWithValues(1)
+	ctx.Exit(func() interface{} { return 1 })
+	WatchContext(t.Context(), ctx)
+
+	if ctx.Duration() != 0 || ctx.TraceID() != "" || ctx.SpanID() != "" || ctx.TraceParent().IsValid() {
+		t.Error("Expected a nil CallContext to describe no call")
+	}
+	if ctx.GoroutineID() != getGoroutineID() {
+		t.Error("Expected a nil CallContext to run on the current goroutine")
+	}
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if events := readTrace(t, path); len(events) != 0 {
+		t.Errorf("Expected no events for a nil CallContext, got %d", len(events))
+	}
+}
+
+func TestExitWithoutSpanKeepsOtherCalls(t *testing.T) {
+	globalTracer.Store(nil)
+	early := Enter("app", "early", nil)
+
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	outer := Enter("app", "outer", nil)
+	inner := Enter("app", "inner", nil)
+	early.ExitWithValues()
+	inner.ExitWithValues()
+	outer.ExitWithValues()
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	events := readTrace(t, path)
+	if len(events) != 4 {
+		t.Fatalf("Expected 4 events, got %d", len(events))
+	}
+	exits := map[string]string{}
+	for _, event := range events {
+		if event.Event == "EXIT" {
+			exits[event.Method] = event.SpanID
+		}
+	}
+	if exits["inner"] != inner.SpanID() || exits["outer"] != outer.SpanID() {
+		t.Errorf("Expected each call to exit its own span, got %v", exits)
+	}
+}
+
+// instrumentedSum is sum as instrumented by flowctl
+func instrumentedSum(a, b int) (__ft_ret0 int) {
+	var __ft_ctx *CallContext
+	if Enabled() {
+		__ft_ctx = Enter("bench", "sum", map[string]interface{}{"a": a, "b": b})
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			__ft_ctx.ExceptionString(fmt.Sprintf("panic: %v", r))
+			panic(r)
+		}
+	}()
+	defer __ft_ctx.Exit(func() interface{} { return Results{{Value: __ft_ret0}} })
+
+	__ft_ret0 = a + b
+	return
+}
+
+//go:noinline
+func sum(a, b int) int {
+	return a + b
+}
+
+// BenchmarkInstrumentedDisabled compares an instrumented function to the
+// original while tracing is off: no args map is built and nothing is
+// allocated, only the deferred calls remain
+func BenchmarkInstrumentedDisabled(b *testing.B) {
+	globalTracer.Store(nil)
+
+	b.Run("original", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sum(i, 1)
+		}
+	})
+	b.Run("instrumented", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			instrumentedSum(i, 1)
+		}
+	})
+}
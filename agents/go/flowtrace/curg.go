@@ -0,0 +1,9 @@
+//go:build (amd64 || arm64) && gc
+
+package flowtrace
+
+import "unsafe"
+
+// curg returns the runtime's structure of the current goroutine
+// (implemented in curg_amd64.s and curg_arm64.s)
+func curg() unsafe.Pointer
@@ -0,0 +1,9 @@
+//go:build !((amd64 || arm64) && gc)
+
+package flowtrace
+
+import "unsafe"
+
+// curg returns nil where the current goroutine's structure cannot be read,
+// so goroutine IDs are parsed from the stack
+func curg() unsafe.Pointer { return nil }
@@ -0,0 +1,119 @@
+package flowtrace
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// encodeArgs serializes the arguments of a call for an ENTER event. Calls
+// without arguments have no args field.
+func (t *Tracer) encodeArgs(args map[string]interface{}) json.RawMessage {
+	if len(args) == 0 && !t.config.LegacyArgFormat {
+		return nil
+	}
+	return t.marshal(boundArgs(t.redactor.args(t.customArgs(args)), t.maxArgDepth()))
+}
+
+// customArgs returns args with the values Config.ArgMarshaler handles
+// replaced by its output
+func (t *Tracer) customArgs(args map[string]interface{}) map[string]interface{} {
+	if t.config.ArgMarshaler == nil || args == nil {
+		return args
+	}
+	custom := make(map[string]interface{}, len(args))
+	for name, value := range args {
+		custom[name] = t.customValue(value)
+	}
+	return custom
+}
+
+// customValue returns the output of Config.ArgMarshaler for v, or v when
+// there is no marshaler or it leaves v to the default serializer
+func (t *Tracer) customValue(v interface{}) interface{} {
+	if t.config.ArgMarshaler == nil || v == nil {
+		return v
+	}
+	if s, ok := t.config.ArgMarshaler(v); ok {
+		return s
+	}
+	return v
+}
+
+// SummarizeCollections is an ArgMarshaler logging slices and arrays as
+// their type and length, e.g. "[]int(len=1000)", instead of every element.
+// Other values are left to the default serializer.
+func SummarizeCollections(v interface{}) (string, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		return fmt.Sprintf("%s(len=%d)", rv.Type(), rv.Len()), true
+	}
+	return "", false
+}
+
+// encodeValue serializes a value for a trace event: JSON by default, or the
+// %v string used before structured output with LegacyArgFormat. A nil
+// value is omitted from the event. Deep or cyclic values are cut short
+// (see boundValue).
+func (t *Tracer) encodeValue(v interface{}) json.RawMessage {
+	return t.marshal(boundValue(v, t.maxArgDepth()))
+}
+
+// maxArgDepth returns the configured nesting limit of logged values
+func (t *Tracer) maxArgDepth() int {
+	if t.config.MaxArgDepth > 0 {
+		return t.config.MaxArgDepth
+	}
+	return DefaultMaxArgDepth
+}
+
+// marshal encodes a bounded value in the configured argument format
+func (t *Tracer) marshal(v interface{}) json.RawMessage {
+	if t.config.LegacyArgFormat {
+		return marshalString(fmt.Sprintf("%v", v))
+	}
+	if v == nil {
+		return nil
+	}
+	return marshalValue(v)
+}
+
+// marshalValue returns the JSON encoding of v. Errors are encoded as their
+// message, and values json.Marshal rejects (channels, funcs, NaN) fall back
+// to their %v form. Map and slice elements are encoded one by one so a
+// single such value doesn't turn the whole collection into a string.
+func marshalValue(v interface{}) json.RawMessage {
+	switch val := v.(type) {
+	case nil:
+		return json.RawMessage("null")
+	case error:
+		return marshalString(val.Error())
+	case map[string]interface{}:
+		fields := make(map[string]json.RawMessage, len(val))
+		for key, item := range val {
+			fields[key] = marshalValue(item)
+		}
+		data, _ := json.Marshal(fields)
+		return data
+	case []interface{}:
+		items := make([]json.RawMessage, len(val))
+		for i, item := range val {
+			items[i] = marshalValue(item)
+		}
+		data, _ := json.Marshal(items)
+		return data
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return marshalString(fmt.Sprintf("%v", v))
+	}
+	return data
+}
+
+// marshalString returns s as a JSON string
+func marshalString(s string) json.RawMessage {
+	data, _ := json.Marshal(s)
+	return data
+}
@@ -0,0 +1,187 @@
+package flowtrace
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type encodeUser struct {
+	ID    int      `json:"id"`
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+// tracedLines runs fn against a tracer with config and returns the raw
+// JSON objects it logged
+func tracedLines(t *testing.T, config Config, fn func(tracer *Tracer)) []map[string]interface{} {
+	t.Helper()
+
+	tracer, err := NewTracer(config)
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	defer tracer.Close()
+
+	var buf strings.Builder
+	tracer.writer = &buf
+	fn(tracer)
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(strings.NewReader(buf.String()))
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("Invalid JSON line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestStructuredArgsAreQueryable(t *testing.T) {
+	user := encodeUser{ID: 42, Name: "alice", Roles: []string{"admin"}}
+	lines := tracedLines(t, Config{}, func(tracer *Tracer) {
+		tracer.enter(1, "main", "SaveUser", map[string]interface{}{"user": user, "force": true}, TraceParent{}, sourceLocation{})
+		tracer.exit(1, "main", "SaveUser", []interface{}{user.ID, errors.New("duplicate key")}, nil)
+	})
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(lines))
+	}
+
+	args, ok := lines[0]["args"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Expected args to be a JSON object, got %T", lines[0]["args"])
+	}
+	if args["force"] != true {
+		t.Errorf("Expected args.force true, got %v", args["force"])
+	}
+	arg, ok := args["user"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Expected args.user to be a JSON object, got %T", args["user"])
+	}
+	if arg["id"] != float64(42) || arg["name"] != "alice" {
+		t.Errorf("Expected args.user fields id=42 name=alice, got %v", arg)
+	}
+
+	result, ok := lines[1]["result"].([]interface{})
+	if !ok || len(result) != 2 {
+		t.Fatalf("Expected result to be a 2 element array, got %v", lines[1]["result"])
+	}
+	if result[0] != float64(42) || result[1] != "duplicate key" {
+		t.Errorf("Expected result [42, \"duplicate key\"], got %v", result)
+	}
+}
+
+func TestMarshalValueFallback(t *testing.T) {
+	ch := make(chan int)
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected string
+	}{
+		{name: "string", value: "alice", expected: `"alice"`},
+		{name: "error", value: errors.New("boom"), expected: `"boom"`},
+		{name: "channel", value: ch, expected: `"` + fmt.Sprintf("%v", ch) + `"`},
+		{name: "func in map keeps other fields", value: map[string]interface{}{"id": 1, "fn": func() {}}, expected: `"id":1`},
+		{name: "nil in slice", value: []interface{}{nil, 2}, expected: `[null,2]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(marshalValue(tt.value))
+			if !json.Valid([]byte(got)) {
+				t.Fatalf("Expected valid JSON, got %s", got)
+			}
+			if !strings.Contains(got, tt.expected) {
+				t.Errorf("Expected %s to contain %s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLegacyArgFormat(t *testing.T) {
+	lines := tracedLines(t, Config{LegacyArgFormat: true}, func(tracer *Tracer) {
+		tracer.enter(1, "main", "LoadUser", map[string]interface{}{"userID": 42}, TraceParent{}, sourceLocation{})
+		tracer.exit(1, "main", "LoadUser", nil, nil)
+	})
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(lines))
+	}
+	if lines[0]["args"] != "map[userID:42]" {
+		t.Errorf("Expected legacy args string, got %v", lines[0]["args"])
+	}
+	if lines[1]["result"] != "<nil>" {
+		t.Errorf("Expected legacy result string, got %v", lines[1]["result"])
+	}
+}
+
+func TestEmptyArgsAndNilResultAreOmitted(t *testing.T) {
+	lines := tracedLines(t, Config{}, func(tracer *Tracer) {
+		tracer.enter(1, "main", "Ping", nil, TraceParent{}, sourceLocation{})
+		tracer.exit(1, "main", "Ping", nil, nil)
+	})
+	if _, ok := lines[0]["args"]; ok {
+		t.Errorf("Expected no args field, got %v", lines[0]["args"])
+	}
+	if _, ok := lines[1]["result"]; ok {
+		t.Errorf("Expected no result field, got %v", lines[1]["result"])
+	}
+}
+
+// encodeCard is a domain type a custom ArgMarshaler masks
+type encodeCard struct {
+	Number string
+	Holder string
+}
+
+func TestArgMarshalerMasksDomainType(t *testing.T) {
+	mask := func(v interface{}) (string, bool) {
+		if card, ok := v.(encodeCard); ok {
+			return "card ending " + card.Number[len(card.Number)-4:], true
+		}
+		return "", false
+	}
+	card := encodeCard{Number: "4111111111111111", Holder: "alice"}
+	lines := tracedLines(t, Config{ArgMarshaler: mask}, func(tracer *Tracer) {
+		tracer.enter(1, "main", "Pay", map[string]interface{}{"card": card, "amount": 12}, TraceParent{}, sourceLocation{})
+		tracer.exit(1, "main", "Pay", Results{{Value: card}, {Name: "err", Value: nil}}, nil)
+	})
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(lines))
+	}
+
+	args := lines[0]["args"].(map[string]interface{})
+	if args["card"] != "card ending 1111" || args["amount"] != float64(12) {
+		t.Errorf("Expected the card masked and the amount serialized as usual, got %v", args)
+	}
+	result := lines[1]["result"].(map[string]interface{})
+	if result["result_0"] != "card ending 1111" {
+		t.Errorf("Expected the card result masked, got %v", result)
+	}
+}
+
+func TestSummarizeCollections(t *testing.T) {
+	ids := make([]int, 1000)
+	lines := tracedLines(t, Config{ArgMarshaler: SummarizeCollections}, func(tracer *Tracer) {
+		tracer.enter(1, "main", "Load", map[string]interface{}{"ids": ids, "pair": [2]string{"a", "b"}, "opts": map[string]int{"limit": 5}}, TraceParent{}, sourceLocation{})
+		tracer.exit(1, "main", "Load", ids, nil)
+	})
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(lines))
+	}
+
+	args := lines[0]["args"].(map[string]interface{})
+	if args["ids"] != "[]int(len=1000)" || args["pair"] != "[2]string(len=2)" {
+		t.Errorf("Expected slices and arrays to be summarized, got %v", args)
+	}
+	if opts, ok := args["opts"].(map[string]interface{}); !ok || opts["limit"] != float64(5) {
+		t.Errorf("Expected maps to be serialized as usual, got %v", args["opts"])
+	}
+	if lines[1]["result"] != "[]int(len=1000)" {
+		t.Errorf("Expected the result to be summarized, got %v", lines[1]["result"])
+	}
+}
@@ -0,0 +1,131 @@
+package flowtrace
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Log file formats
+const (
+	// FormatJSONL writes one JSON event per line (the default)
+	FormatJSONL = "jsonl"
+	// FormatJSON writes a single JSON array of events, closed on Stop
+	FormatJSON = "json"
+	// FormatCSV writes one row per event with the columns of csvHeader
+	FormatCSV = "csv"
+)
+
+// csvHeader lists the columns written by FormatCSV
+var csvHeader = []string{"event", "timestamp", "class", "method", "durationMicros", "thread"}
+
+// eventWriter encodes events onto the log file in one of the formats
+type eventWriter interface {
+	// write appends event to w; data is its JSON encoding
+	write(w io.Writer, event TraceEvent, data []byte) error
+	// finish completes the document on w, which stays open
+	finish(w io.Writer) error
+}
+
+// validFormat reports whether format names a log file format; empty means
+// the default
+func validFormat(format string) bool {
+	switch format {
+	case "", FormatJSONL, FormatJSON, FormatCSV:
+		return true
+	}
+	return false
+}
+
+// newEventWriter returns the writer for format. empty tells whether output
+// starts in an empty file, which decides if the CSV header is written.
+func newEventWriter(format string, empty bool) (eventWriter, error) {
+	switch format {
+	case "", FormatJSONL:
+		return jsonlWriter{}, nil
+	case FormatJSON:
+		return &jsonArrayWriter{}, nil
+	case FormatCSV:
+		return &csvWriter{header: empty}, nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
+// jsonlWriter writes newline-delimited JSON
+type jsonlWriter struct{}
+
+func (jsonlWriter) write(w io.Writer, event TraceEvent, data []byte) error {
+	_, err := w.Write(append(data, '\n'))
+	return err
+}
+
+func (jsonlWriter) finish(w io.Writer) error {
+	return nil
+}
+
+// jsonArrayWriter writes a JSON array, one element per line
+type jsonArrayWriter struct {
+	count int
+}
+
+func (j *jsonArrayWriter) write(w io.Writer, event TraceEvent, data []byte) error {
+	sep := ",\n"
+	if j.count == 0 {
+		sep = "[\n"
+	}
+	j.count++
+	_, err := io.WriteString(w, sep+string(data))
+	return err
+}
+
+func (j *jsonArrayWriter) finish(w io.Writer) error {
+	end := "\n]\n"
+	if j.count == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(w, end)
+	return err
+}
+
+// csvWriter writes one row per event, preceded by a header in a new file
+type csvWriter struct {
+	header bool // header still to be written
+}
+
+func (c *csvWriter) write(w io.Writer, event TraceEvent, data []byte) error {
+	// Rows are written at once, like JSONL lines
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	if c.header {
+		c.header = false
+		cw.Write(csvHeader)
+	}
+	cw.Write([]string{
+		event.Event,
+		strconv.FormatInt(event.Timestamp, 10),
+		event.Class,
+		event.Method,
+		strconv.FormatInt(event.DurationMicros, 10),
+		event.Thread,
+	})
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (c *csvWriter) finish(w io.Writer) error {
+	if !c.header {
+		return nil
+	}
+	// An empty trace still gets its header
+	c.header = false
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,176 @@
+package flowtrace
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeFormatTrace logs a call of main.LoadUser, with a nested cache.Get
+// call, to a log file in format and returns the file's path
+func writeFormatTrace(t *testing.T, format, name string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	tracer, err := NewTracer(Config{LogFile: path, Format: format})
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+
+	tracer.enter(1, "main", "LoadUser", map[string]interface{}{"id": 42}, TraceParent{}, sourceLocation{})
+	tracer.enter(1, "cache", "Get", nil, TraceParent{}, sourceLocation{})
+	tracer.exit(1, "cache", "Get", nil, nil)
+	tracer.exit(1, "main", "LoadUser", "alice", nil)
+
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	return path
+}
+
+func TestFormatJSONL(t *testing.T) {
+	f, err := os.Open(writeFormatTrace(t, FormatJSONL, "trace.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var events []TraceEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Invalid JSON line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 5 || events[0].Event != "METADATA" {
+		t.Errorf("Expected the METADATA event and 4 events, got %+v", events)
+	}
+}
+
+func TestFormatJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		gzip bool
+	}{
+		{name: "plain", file: "trace.json"},
+		{name: "compressed", file: "trace.json.gz", gzip: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.Open(writeFormatTrace(t, FormatJSON, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			var r io.Reader = f
+			if tt.gzip {
+				gz, err := gzip.NewReader(f)
+				if err != nil {
+					t.Fatalf("Trace file is not gzip-compressed: %v", err)
+				}
+				r = gz
+			}
+
+			var events []TraceEvent
+			if err := json.NewDecoder(r).Decode(&events); err != nil {
+				t.Fatalf("Trace is not a JSON array: %v", err)
+			}
+			if len(events) != 5 {
+				t.Fatalf("Expected 5 events, got %d", len(events))
+			}
+			if events[0].Event != "METADATA" || events[1].Event != "ENTER" || events[1].Method != "LoadUser" || events[4].Event != "EXIT" {
+				t.Errorf("Unexpected events: %+v", events)
+			}
+		})
+	}
+}
+
+func TestFormatJSONEmptyAndRestarted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.json")
+
+	// The second tracer replaces the first array instead of appending to it
+	for i := 0; i < 2; i++ {
+		tracer, err := NewTracer(Config{LogFile: path, Format: FormatJSON})
+		if err != nil {
+			t.Fatalf("NewTracer failed: %v", err)
+		}
+		if err := tracer.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []TraceEvent
+	if err := json.Unmarshal(data, &events); err != nil {
+		t.Fatalf("Empty trace is not a JSON array: %v\n%s", err, data)
+	}
+	if len(events) != 1 || events[0].Event != "METADATA" {
+		t.Errorf("Expected only the METADATA event of the second tracer, got %+v", events)
+	}
+}
+
+func TestFormatCSV(t *testing.T) {
+	path := writeFormatTrace(t, FormatCSV, "trace.csv")
+
+	// A second run appends rows without repeating the header
+	tracer, err := NewTracer(Config{LogFile: path, Format: FormatCSV})
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	tracer.enter(2, "main", "Again", nil, TraceParent{}, sourceLocation{})
+	tracer.exit(2, "main", "Again", nil, nil)
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("Trace is not valid CSV: %v", err)
+	}
+	if len(records) != 7 {
+		t.Fatalf("Expected a header and 6 rows, got %d: %v", len(records), records)
+	}
+	if !reflect.DeepEqual(records[0], csvHeader) {
+		t.Errorf("Expected header %v, got %v", csvHeader, records[0])
+	}
+
+	exit := records[4]
+	if exit[0] != "EXIT" || exit[2] != "main" || exit[3] != "LoadUser" || exit[5] != "goroutine-1" {
+		t.Errorf("Unexpected EXIT row: %v", exit)
+	}
+	if records[5][3] != "Again" || records[5][5] != "goroutine-2" {
+		t.Errorf("Expected appended rows after the first run, got %v", records[5])
+	}
+}
+
+func TestFormatValidation(t *testing.T) {
+	config := DefaultConfig()
+	config.Format = "xml"
+	if err := config.Validate(); err == nil {
+		t.Error("Expected Validate to reject an unknown format")
+	}
+
+	if _, err := NewTracer(Config{Format: "xml"}); err == nil {
+		t.Error("Expected NewTracer to reject an unknown format")
+	}
+}
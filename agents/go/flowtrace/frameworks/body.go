@@ -0,0 +1,115 @@
+package frameworks
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// DefaultMaxBodyBytes caps captured request and response bodies when a
+// config leaves MaxBodyBytes unset
+const DefaultMaxBodyBytes = 4096
+
+// bodyLimit returns the capture limit for a configured MaxBodyBytes
+func bodyLimit(maxBytes int) int {
+	if maxBytes <= 0 {
+		return DefaultMaxBodyBytes
+	}
+	return maxBytes
+}
+
+// bodyValue returns the value logged for a captured body. A complete JSON
+// body is logged decoded, so that the tracer's Redact patterns apply to its
+// fields; anything else, including a truncated body, is logged as text.
+func bodyValue(body []byte, truncated bool) interface{} {
+	if len(body) == 0 {
+		return nil
+	}
+	if !truncated && json.Valid(body) {
+		var decoded interface{}
+		if err := json.Unmarshal(body, &decoded); err == nil {
+			return decoded
+		}
+	}
+	if truncated {
+		return string(body) + "...(truncated)"
+	}
+	return string(body)
+}
+
+// captureRequestBody reads up to maxBytes of body and returns them with a
+// replacement body that still yields the whole original content, so the
+// handler reads the request as sent
+func captureRequestBody(body io.ReadCloser, maxBytes int) (captured []byte, truncated bool, restored io.ReadCloser) {
+	if body == nil || body == http.NoBody {
+		return nil, false, body
+	}
+
+	// One extra byte tells a body of exactly maxBytes from a longer one
+	prefix, err := io.ReadAll(io.LimitReader(body, int64(maxBytes)+1))
+	restored = readCloser{io.MultiReader(bytes.NewReader(prefix), body), body}
+	if err != nil {
+		return nil, false, restored
+	}
+	if len(prefix) > maxBytes {
+		return prefix[:maxBytes], true, restored
+	}
+	return prefix, false, restored
+}
+
+// readCloser reads from a reader while closing the original body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// bodyRecorder keeps the first bytes written to a response
+type bodyRecorder struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func newBodyRecorder(maxBytes int) *bodyRecorder {
+	return &bodyRecorder{max: maxBytes}
+}
+
+// record keeps what still fits of data
+func (b *bodyRecorder) record(data []byte) {
+	if room := b.max - b.buf.Len(); len(data) > room {
+		data = data[:room]
+		b.truncated = true
+	}
+	b.buf.Write(data)
+}
+
+// value returns the logged form of the recorded body
+func (b *bodyRecorder) value() interface{} {
+	return bodyValue(b.buf.Bytes(), b.truncated)
+}
+
+// teeResponseWriter copies what is written to a response into a recorder
+type teeResponseWriter struct {
+	http.ResponseWriter
+	body *bodyRecorder
+}
+
+func (w *teeResponseWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.body.record(data[:n])
+	return n, err
+}
+
+// Unwrap exposes the wrapped writer to http.ResponseController
+func (w *teeResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// limitBody cuts an already buffered body to maxBytes
+func limitBody(body []byte, maxBytes int) ([]byte, bool) {
+	if len(body) > maxBytes {
+		return body[:maxBytes], true
+	}
+	return body, false
+}
@@ -0,0 +1,153 @@
+package frameworks
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-chi/chi/v5"
+	"github.com/gofiber/fiber/v2"
+	"github.com/labstack/echo/v4"
+	"github.com/rixmerz/flowtrace-agent-go/flowtrace"
+)
+
+// bodyServers serve POST /users with each framework's middleware configured
+// to capture bodies of at most maxBytes. The handler stores the request
+// body it received in received and echoes it back.
+func bodyServers(maxBytes int, received *string) map[string]func(t *testing.T, req *http.Request) {
+	return map[string]func(t *testing.T, req *http.Request){
+		"chi": func(t *testing.T, req *http.Request) {
+			r := chi.NewRouter()
+			r.Use(ChiMiddlewareWithConfig(ChiConfig{CaptureRequestBody: true, CaptureResponseBody: true, MaxBodyBytes: maxBytes}))
+			r.Post("/users", func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				*received = string(body)
+				w.Write(body)
+			})
+			r.ServeHTTP(httptest.NewRecorder(), req)
+		},
+		"gin": func(t *testing.T, req *http.Request) {
+			router := gin.New()
+			router.Use(GinMiddlewareWithConfig(GinConfig{CaptureRequestBody: true, CaptureResponseBody: true, MaxBodyBytes: maxBytes}))
+			router.POST("/users", func(c *gin.Context) {
+				body, _ := io.ReadAll(c.Request.Body)
+				*received = string(body)
+				c.Data(http.StatusOK, "application/json", body)
+			})
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		},
+		"echo": func(t *testing.T, req *http.Request) {
+			e := echo.New()
+			e.Use(EchoMiddlewareWithConfig(EchoConfig{CaptureRequestBody: true, CaptureResponseBody: true, MaxBodyBytes: maxBytes}))
+			e.POST("/users", func(c echo.Context) error {
+				body, _ := io.ReadAll(c.Request().Body)
+				*received = string(body)
+				return c.Blob(http.StatusOK, "application/json", body)
+			})
+			e.ServeHTTP(httptest.NewRecorder(), req)
+		},
+		"fiber": func(t *testing.T, req *http.Request) {
+			app := fiber.New()
+			app.Use(FiberMiddlewareWithConfig(FiberConfig{CaptureRequestBody: true, CaptureResponseBody: true, MaxBodyBytes: maxBytes}))
+			app.Post("/users", func(c *fiber.Ctx) error {
+				*received = string(c.Body())
+				return c.Send(c.Body())
+			})
+			if _, err := app.Test(req); err != nil {
+				t.Fatalf("Test request failed: %v", err)
+			}
+		},
+	}
+}
+
+// capturedBodies returns the "body" argument of the ENTER event and the
+// "body" field of the result of the EXIT event
+func capturedBodies(t *testing.T, events []flowtrace.TraceEvent) (request, response interface{}) {
+	t.Helper()
+
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	var args map[string]interface{}
+	var result map[string]map[string]interface{}
+	if err := json.Unmarshal(events[0].Args, &args); err != nil {
+		t.Fatalf("Invalid args %s: %v", events[0].Args, err)
+	}
+	if err := json.Unmarshal(events[1].Result, &result); err != nil {
+		t.Fatalf("Invalid result %s: %v", events[1].Result, err)
+	}
+	return args["body"], result["result_0"]["body"]
+}
+
+func TestMiddlewaresCaptureTruncatedBodies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	const payload = `{"name":"alice","email":"alice@example.com"}`
+	var received string
+
+	for name, serve := range bodyServers(16, &received) {
+		t.Run(name, func(t *testing.T) {
+			received = ""
+			req := httptest.NewRequest("POST", "/users", strings.NewReader(payload))
+			req.Header.Set("Content-Type", "application/json")
+
+			events := captureEvents(t, func() { serve(t, req) })
+			if received != payload {
+				t.Errorf("Expected the handler to read the full body, got %q", received)
+			}
+
+			request, response := capturedBodies(t, events)
+			want := payload[:16] + "...(truncated)"
+			if request != want {
+				t.Errorf("Expected request body %q, got %v", want, request)
+			}
+			if response != want {
+				t.Errorf("Expected response body %q, got %v", want, response)
+			}
+		})
+	}
+}
+
+func TestMiddlewaresRedactCapturedBodies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	const payload = `{"name":"alice","password":"hunter2"}`
+	var received string
+
+	for name, serve := range bodyServers(0, &received) {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/users", strings.NewReader(payload))
+			req.Header.Set("Content-Type", "application/json")
+
+			events := captureEventsWith(t, flowtrace.Config{Redact: []string{"password"}}, func() { serve(t, req) })
+			if received != payload {
+				t.Errorf("Expected the handler to read the unredacted body, got %q", received)
+			}
+
+			request, response := capturedBodies(t, events)
+			for _, body := range []interface{}{request, response} {
+				fields, ok := body.(map[string]interface{})
+				if !ok {
+					t.Fatalf("Expected a decoded JSON body, got %T %v", body, body)
+				}
+				if fields["name"] != "alice" || fields["password"] != "<redacted>" {
+					t.Errorf("Expected the password to be redacted, got %v", fields)
+				}
+			}
+		})
+	}
+}
+
+func TestCaptureRequestBodyWithoutBody(t *testing.T) {
+	body, truncated, restored := captureRequestBody(http.NoBody, 16)
+	if body != nil || truncated || restored != http.NoBody {
+		t.Errorf("Expected an empty body to be left alone, got %q, %v, %v", body, truncated, restored)
+	}
+	if bodyValue(nil, false) != nil {
+		t.Error("Expected no value for an empty body")
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/rixmerz/flowtrace-agent-go/flowtrace"
+	"github.com/rixmerz/flowtrace-agent-go/internal/httpwriter"
 )
 
 // ChiMiddleware creates middleware for Chi framework
@@ -18,16 +19,18 @@ func ChiMiddleware() func(http.Handler) http.Handler {
 			method := r.Method
 
 			// Create response writer wrapper to capture status
-			wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			wrapped := httpwriter.New(w)
 
 			// Create call context
-			ctx := flowtrace.Enter("chi", path, map[string]interface{}{
+			parent := flowtrace.IncomingTraceParent(r.Header.Get(flowtrace.TraceParentHeader))
+			ctx := flowtrace.EnterWithParent(parent, "chi", path, map[string]interface{}{
 				"method":     method,
 				"path":       chi.RouteContext(r.Context()).RoutePattern(),
 				"query":      r.URL.Query(),
 				"remote":     r.RemoteAddr,
 				"user-agent": r.UserAgent(),
 			})
+			flowtrace.WatchContext(r.Context(), ctx)
 
 			// Setup panic recovery
 			defer func() {
@@ -43,8 +46,8 @@ func ChiMiddleware() func(http.Handler) http.Handler {
 			// Log exit with response info
 			duration := time.Since(start).Milliseconds()
 			ctx.ExitWithValues(map[string]interface{}{
-				"status":   wrapped.statusCode,
-				"size":     wrapped.written,
+				"status":   wrapped.Status(),
+				"size":     wrapped.Written(),
 				"duration": duration,
 			})
 		})
@@ -65,7 +68,7 @@ func ChiMiddlewareWithConfig(config ChiConfig) func(http.Handler) http.Handler {
 			path := r.URL.Path
 
 			// Create response writer wrapper
-			wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			wrapped := httpwriter.New(w)
 
 			// Build args
 			args := map[string]interface{}{
@@ -81,23 +84,52 @@ func ChiMiddlewareWithConfig(config ChiConfig) func(http.Handler) http.Handler {
 				}
 			}
 
-			ctx := flowtrace.Enter("chi", path, args)
+			maxBody := bodyLimit(config.MaxBodyBytes)
+			if config.CaptureRequestBody {
+				body, truncated, restored := captureRequestBody(r.Body, maxBody)
+				r.Body = restored
+				args["body"] = bodyValue(body, truncated)
+			}
+			var responseBody *bodyRecorder
+			if config.CaptureResponseBody {
+				responseBody = newBodyRecorder(maxBody)
+				wrapped.OnWrite = responseBody.record
+			}
+
+			parent := flowtrace.IncomingTraceParent(r.Header.Get(flowtrace.TraceParentHeader))
+			ctx := flowtrace.EnterWithParent(parent, "chi", path, args)
+			flowtrace.WatchContext(r.Context(), ctx)
 
+			// Middlewares run before chi routes the request, so its
+			// parameters are only known once the handler has run
 			defer func() {
 				if err := recover(); err != nil {
+					if config.CaptureRouteParams {
+						tagRouteParams(ctx, chiParams(r))
+					}
 					ctx.ExceptionString(fmt.Sprintf("panic: %v", err))
-					panic(err)
+					if config.RecoverMode.Rethrow(err) {
+						panic(err)
+					}
+					wrapped.Respond500()
 				}
 			}()
 
 			next.ServeHTTP(wrapped, r)
+			if config.CaptureRouteParams {
+				tagRouteParams(ctx, chiParams(r))
+			}
 
 			// Build result
 			result := map[string]interface{}{
-				"status":   wrapped.statusCode,
+				"status":   wrapped.Status(),
 				"duration": time.Since(start).Milliseconds(),
 			}
 
+			if responseBody != nil {
+				result["body"] = responseBody.value()
+			}
+
 			// Add custom result fields
 			if config.ExtraResultFields != nil {
 				for key, extractor := range config.ExtraResultFields {
@@ -120,6 +152,27 @@ type ChiConfig struct {
 
 	// ExtraResultFields adds custom fields to trace exit
 	ExtraResultFields map[string]func(http.ResponseWriter, *http.Request) interface{}
+
+	// CaptureRequestBody logs up to MaxBodyBytes of the request body as the
+	// "body" argument; a complete JSON body is logged decoded so the
+	// tracer's Redact patterns apply to its fields
+	CaptureRequestBody bool
+
+	// CaptureResponseBody logs up to MaxBodyBytes of the response body as
+	// the "body" result
+	CaptureResponseBody bool
+
+	// MaxBodyBytes caps captured bodies; 0 means DefaultMaxBodyBytes
+	MaxBodyBytes int
+
+	// RecoverMode tells what happens to a panic of the handler once it is
+	// logged; the default flowtrace.RecoverRethrow panics again
+	RecoverMode flowtrace.RecoverMode
+
+	// CaptureRouteParams tags the request with the values of the path
+	// parameters of its route, e.g. {"id":"123"} for /users/{id}, under
+	// "params"
+	CaptureRouteParams bool
 }
 
 // DefaultChiConfig returns default Chi middleware configuration
@@ -133,20 +186,15 @@ func DefaultChiConfig() ChiConfig {
 	}
 }
 
-// responseWriter wraps http.ResponseWriter to capture status code
-type responseWriter struct {
-	http.ResponseWriter
-	statusCode int
-	written    int64
-}
-
-func (rw *responseWriter) WriteHeader(statusCode int) {
-	rw.statusCode = statusCode
-	rw.ResponseWriter.WriteHeader(statusCode)
-}
-
-func (rw *responseWriter) Write(data []byte) (int, error) {
-	n, err := rw.ResponseWriter.Write(data)
-	rw.written += int64(n)
-	return n, err
+// chiParams returns the path parameters of the chi route of r by name
+func chiParams(r *http.Request) map[string]string {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil {
+		return nil
+	}
+	params := make(map[string]string, len(rctx.URLParams.Keys))
+	for i, key := range rctx.URLParams.Keys {
+		params[key] = rctx.URLParams.Values[i]
+	}
+	return params
 }
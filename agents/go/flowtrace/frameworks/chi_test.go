@@ -1,6 +1,7 @@
 package frameworks
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -315,3 +316,27 @@ func TestChiMiddlewareUserAgent(t *testing.T) {
 		t.Errorf("Expected status 200, got %d", w.Code)
 	}
 }
+
+func TestChiMiddlewareTagsCancelledRequests(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(ChiMiddleware())
+	r.Get("/slow", func(w http.ResponseWriter, r *http.Request) {
+		// The client gives up while the handler works
+		<-r.Context().Done()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	events := captureEvents(t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		req := httptest.NewRequest("GET", "/slow", nil).WithContext(ctx)
+		cancel()
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	})
+
+	if len(events) != 2 || events[1].Event != "EXIT" {
+		t.Fatalf("Expected the ENTER and EXIT of the request, got %+v", events)
+	}
+	if !events[1].Cancelled || events[1].CancelReason != "context canceled" {
+		t.Errorf("Expected the EXIT to be tagged as cancelled, got %+v", events[1])
+	}
+}
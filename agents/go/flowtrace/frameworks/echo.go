@@ -18,13 +18,15 @@ func EchoMiddleware() echo.MiddlewareFunc {
 			method := req.Method
 
 			// Create call context
-			ctx := flowtrace.Enter("echo", path, map[string]interface{}{
+			parent := flowtrace.IncomingTraceParent(c.Request().Header.Get(flowtrace.TraceParentHeader))
+			ctx := flowtrace.EnterWithParent(parent, "echo", path, map[string]interface{}{
 				"method":     method,
 				"path":       c.Path(),
 				"query":      req.URL.Query(),
 				"remote":     c.RealIP(),
 				"user-agent": req.UserAgent(),
 			})
+			flowtrace.WatchContext(c.Request().Context(), ctx)
 
 			// Setup panic recovery
 			defer func() {
@@ -38,13 +40,15 @@ func EchoMiddleware() echo.MiddlewareFunc {
 			err := next(c)
 
 			// Log exit with response info
+			committed := echoCommitResponse(c, err)
 			duration := time.Since(start).Milliseconds()
 			res := c.Response()
 
 			result := map[string]interface{}{
-				"status":   res.Status,
-				"size":     res.Size,
-				"duration": duration,
+				"status":    res.Status,
+				"committed": committed,
+				"size":      res.Size,
+				"duration":  duration,
 			}
 
 			if err != nil {
@@ -59,6 +63,21 @@ func EchoMiddleware() echo.MiddlewareFunc {
 	}
 }
 
+// echoCommitResponse makes the response status final before it is logged,
+// and reports whether the handler had already committed the response. An
+// error returned before anything was written is only turned into a response
+// by Echo's HTTPErrorHandler once the middleware chain has returned, which
+// may pick any status; the handler is called here instead, as by Echo's own
+// RequestLogger with HandleError. The error still goes up the chain, where
+// the default handler ignores it as the response is committed.
+func echoCommitResponse(c echo.Context, err error) bool {
+	committed := c.Response().Committed
+	if err != nil && !committed {
+		c.Error(err)
+	}
+	return committed
+}
+
 // EchoMiddlewareWithConfig creates middleware with custom configuration
 func EchoMiddlewareWithConfig(config EchoConfig) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
@@ -86,26 +105,58 @@ func EchoMiddlewareWithConfig(config EchoConfig) echo.MiddlewareFunc {
 				}
 			}
 
-			ctx := flowtrace.Enter("echo", path, args)
+			maxBody := bodyLimit(config.MaxBodyBytes)
+			if config.CaptureRequestBody {
+				body, truncated, restored := captureRequestBody(req.Body, maxBody)
+				req.Body = restored
+				args["body"] = bodyValue(body, truncated)
+			}
+			var responseBody *bodyRecorder
+			if config.CaptureResponseBody {
+				responseBody = newBodyRecorder(maxBody)
+				res := c.Response()
+				original := res.Writer
+				res.Writer = &teeResponseWriter{ResponseWriter: original, body: responseBody}
+				defer func() { res.Writer = original }()
+			}
+
+			parent := flowtrace.IncomingTraceParent(c.Request().Header.Get(flowtrace.TraceParentHeader))
+			ctx := flowtrace.EnterWithParent(parent, "echo", path, args)
+			flowtrace.WatchContext(c.Request().Context(), ctx)
+			if config.CaptureRouteParams {
+				tagRouteParams(ctx, echoParams(c))
+			}
 
 			defer func() {
 				if err := recover(); err != nil {
 					ctx.ExceptionString(fmt.Sprintf("panic: %v", err))
-					panic(err)
+					if config.RecoverMode.Rethrow(err) {
+						panic(err)
+					}
+					// As Echo's Recover middleware does, the error handler
+					// responds, with 500 for an error that is no HTTPError
+					if !c.Response().Committed {
+						c.Error(fmt.Errorf("panic: %v", err))
+					}
 				}
 			}()
 
 			err := next(c)
+			committed := echoCommitResponse(c, err)
 
 			// Build result
 			result := map[string]interface{}{
-				"status":   c.Response().Status,
-				"duration": time.Since(start).Milliseconds(),
+				"status":    c.Response().Status,
+				"committed": committed,
+				"duration":  time.Since(start).Milliseconds(),
 			}
 
 			if err != nil {
 				result["error"] = err.Error()
 			}
+			if responseBody != nil {
+				result["body"] = responseBody.value()
+			}
 
 			// Add custom result fields
 			if config.ExtraResultFields != nil {
@@ -130,6 +181,39 @@ type EchoConfig struct {
 
 	// ExtraResultFields adds custom fields to trace exit
 	ExtraResultFields map[string]func(echo.Context) interface{}
+
+	// CaptureRequestBody logs up to MaxBodyBytes of the request body as the
+	// "body" argument; a complete JSON body is logged decoded so the
+	// tracer's Redact patterns apply to its fields
+	CaptureRequestBody bool
+
+	// CaptureResponseBody logs up to MaxBodyBytes of the response body as
+	// the "body" result
+	CaptureResponseBody bool
+
+	// MaxBodyBytes caps captured bodies; 0 means DefaultMaxBodyBytes
+	MaxBodyBytes int
+
+	// RecoverMode tells what happens to a panic of the handler once it is
+	// logged; the default flowtrace.RecoverRethrow panics again
+	RecoverMode flowtrace.RecoverMode
+
+	// CaptureRouteParams tags the request with the values of the path
+	// parameters of its route, e.g. {"id":"123"} for /users/{id}, under
+	// "params"
+	CaptureRouteParams bool
+}
+
+// echoParams returns the path parameters of an echo route by name
+func echoParams(c echo.Context) map[string]string {
+	names, values := c.ParamNames(), c.ParamValues()
+	params := make(map[string]string, len(names))
+	for i, name := range names {
+		if i < len(values) {
+			params[name] = values[i]
+		}
+	}
+	return params
 }
 
 // DefaultEchoConfig returns default Echo middleware configuration
@@ -1,11 +1,14 @@
 package frameworks
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/labstack/echo/v4"
+	"github.com/rixmerz/flowtrace-agent-go/flowtrace"
 )
 
 func TestEchoMiddleware(t *testing.T) {
@@ -252,3 +255,102 @@ func TestEchoMiddlewareRealIP(t *testing.T) {
 		t.Errorf("Expected status 200, got %d", w.Code)
 	}
 }
+
+// echoExitResult returns the result logged by the EXIT event of a request
+func echoExitResult(t *testing.T, events []flowtrace.TraceEvent) map[string]interface{} {
+	t.Helper()
+
+	for _, event := range events {
+		if event.Event != "EXIT" {
+			continue
+		}
+		var result map[string]map[string]interface{}
+		if err := json.Unmarshal(event.Result, &result); err != nil {
+			t.Fatalf("Invalid result %s: %v", event.Result, err)
+		}
+		return result["result_0"]
+	}
+	t.Fatalf("Expected an EXIT event, got %+v", events)
+	return nil
+}
+
+func TestEchoMiddlewareLoggedStatus(t *testing.T) {
+	middlewares := map[string]echo.MiddlewareFunc{
+		"default":    EchoMiddleware(),
+		"withConfig": EchoMiddlewareWithConfig(EchoConfig{}),
+	}
+	tests := []struct {
+		name          string
+		handler       echo.HandlerFunc
+		errorHandler  echo.HTTPErrorHandler
+		wantStatus    int
+		wantCommitted bool
+	}{
+		{
+			name: "http error",
+			handler: func(c echo.Context) error {
+				return echo.NewHTTPError(http.StatusNotFound, "no such user")
+			},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name: "custom error handler",
+			handler: func(c echo.Context) error {
+				return errors.New("database down")
+			},
+			errorHandler: func(err error, c echo.Context) {
+				if !c.Response().Committed {
+					c.String(http.StatusServiceUnavailable, err.Error())
+				}
+			},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name: "streaming",
+			handler: func(c echo.Context) error {
+				res := c.Response()
+				res.WriteHeader(http.StatusOK)
+				for i := 0; i < 3; i++ {
+					res.Write([]byte("chunk\n"))
+					res.Flush()
+				}
+				// The stream breaks after the status was sent
+				return echo.NewHTTPError(http.StatusInternalServerError, "stream broken")
+			},
+			wantStatus:    http.StatusOK,
+			wantCommitted: true,
+		},
+	}
+
+	for name, middleware := range middlewares {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				e := echo.New()
+				if tt.errorHandler != nil {
+					e.HTTPErrorHandler = tt.errorHandler
+				}
+				e.Use(middleware)
+				e.GET("/users", tt.handler)
+
+				w := httptest.NewRecorder()
+				events := captureEvents(t, func() {
+					e.ServeHTTP(w, httptest.NewRequest("GET", "/users", nil))
+				})
+
+				if w.Code != tt.wantStatus {
+					t.Errorf("Expected the client to receive %d, got %d", tt.wantStatus, w.Code)
+				}
+				result := echoExitResult(t, events)
+				if result["status"] != float64(w.Code) {
+					t.Errorf("Expected the logged status to be %d as received, got %v", w.Code, result["status"])
+				}
+				if result["committed"] != tt.wantCommitted {
+					t.Errorf("Expected committed %v, got %v", tt.wantCommitted, result["committed"])
+				}
+				if result["error"] == nil {
+					t.Error("Expected the handler error to be logged")
+				}
+			})
+		}
+	}
+}
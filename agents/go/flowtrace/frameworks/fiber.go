@@ -16,13 +16,15 @@ func FiberMiddleware() fiber.Handler {
 		method := c.Method()
 
 		// Create call context
-		ctx := flowtrace.Enter("fiber", path, map[string]interface{}{
+		parent := flowtrace.IncomingTraceParent(c.Get(flowtrace.TraceParentHeader))
+		ctx := flowtrace.EnterWithParent(parent, "fiber", path, map[string]interface{}{
 			"method":     method,
 			"path":       c.Path(),
 			"query":      c.Queries(),
 			"remote":     c.IP(),
 			"user-agent": string(c.Request().Header.UserAgent()),
 		})
+		flowtrace.WatchContext(c.UserContext(), ctx)
 
 		// Setup panic recovery
 		defer func() {
@@ -56,7 +58,7 @@ func FiberMiddleware() fiber.Handler {
 
 // FiberMiddlewareWithConfig creates middleware with custom configuration
 func FiberMiddlewareWithConfig(config FiberConfig) fiber.Handler {
-	return func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) (err error) {
 		// Skip if configured
 		if config.Skip != nil && config.Skip(c) {
 			return c.Next()
@@ -79,16 +81,37 @@ func FiberMiddlewareWithConfig(config FiberConfig) fiber.Handler {
 			}
 		}
 
-		ctx := flowtrace.Enter("fiber", path, args)
+		// fasthttp buffers whole bodies, so they only need to be cut to size
+		maxBody := bodyLimit(config.MaxBodyBytes)
+		if config.CaptureRequestBody {
+			args["body"] = bodyValue(limitBody(c.Body(), maxBody))
+		}
+
+		parent := flowtrace.IncomingTraceParent(c.Get(flowtrace.TraceParentHeader))
+		ctx := flowtrace.EnterWithParent(parent, "fiber", path, args)
+		flowtrace.WatchContext(c.UserContext(), ctx)
 
+		// A middleware added by Use matches any path, so the parameters of
+		// the route are only known once its handler has run
 		defer func() {
-			if err := recover(); err != nil {
-				ctx.ExceptionString(fmt.Sprintf("panic: %v", err))
-				panic(err)
+			if rec := recover(); rec != nil {
+				if config.CaptureRouteParams {
+					tagRouteParams(ctx, c.AllParams())
+				}
+				ctx.ExceptionString(fmt.Sprintf("panic: %v", rec))
+				if config.RecoverMode.Rethrow(rec) {
+					panic(rec)
+				}
+				// As Fiber's recover middleware does, the panic is returned
+				// as an error, which the error handler responds to with 500
+				err = fmt.Errorf("panic: %v", rec)
 			}
 		}()
 
-		err := c.Next()
+		err = c.Next()
+		if config.CaptureRouteParams {
+			tagRouteParams(ctx, c.AllParams())
+		}
 
 		// Build result
 		result := map[string]interface{}{
@@ -99,6 +122,9 @@ func FiberMiddlewareWithConfig(config FiberConfig) fiber.Handler {
 		if err != nil {
 			result["error"] = err.Error()
 		}
+		if config.CaptureResponseBody {
+			result["body"] = bodyValue(limitBody(c.Response().Body(), maxBody))
+		}
 
 		// Add custom result fields
 		if config.ExtraResultFields != nil {
@@ -122,6 +148,27 @@ type FiberConfig struct {
 
 	// ExtraResultFields adds custom fields to trace exit
 	ExtraResultFields map[string]func(*fiber.Ctx) interface{}
+
+	// CaptureRequestBody logs up to MaxBodyBytes of the request body as the
+	// "body" argument; a complete JSON body is logged decoded so the
+	// tracer's Redact patterns apply to its fields
+	CaptureRequestBody bool
+
+	// CaptureResponseBody logs up to MaxBodyBytes of the response body as
+	// the "body" result
+	CaptureResponseBody bool
+
+	// MaxBodyBytes caps captured bodies; 0 means DefaultMaxBodyBytes
+	MaxBodyBytes int
+
+	// RecoverMode tells what happens to a panic of the handler once it is
+	// logged; the default flowtrace.RecoverRethrow panics again
+	RecoverMode flowtrace.RecoverMode
+
+	// CaptureRouteParams tags the request with the values of the path
+	// parameters of its route, e.g. {"id":"123"} for /users/{id}, under
+	// "params"
+	CaptureRouteParams bool
 }
 
 // DefaultFiberConfig returns default Fiber middleware configuration
@@ -2,6 +2,7 @@ package frameworks
 
 import (
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -16,13 +17,15 @@ func GinMiddleware() gin.HandlerFunc {
 		method := c.Request.Method
 
 		// Create call context
-		ctx := flowtrace.Enter("gin", path, map[string]interface{}{
+		parent := flowtrace.IncomingTraceParent(c.GetHeader(flowtrace.TraceParentHeader))
+		ctx := flowtrace.EnterWithParent(parent, "gin", path, map[string]interface{}{
 			"method":     method,
 			"path":       c.FullPath(),
 			"query":      c.Request.URL.Query(),
 			"remote":     c.ClientIP(),
 			"user-agent": c.Request.UserAgent(),
 		})
+		flowtrace.WatchContext(c.Request.Context(), ctx)
 
 		// Setup panic recovery
 		defer func() {
@@ -73,12 +76,36 @@ func GinMiddlewareWithConfig(config GinConfig) gin.HandlerFunc {
 			}
 		}
 
-		ctx := flowtrace.Enter("gin", path, args)
+		maxBody := bodyLimit(config.MaxBodyBytes)
+		if config.CaptureRequestBody {
+			body, truncated, restored := captureRequestBody(c.Request.Body, maxBody)
+			c.Request.Body = restored
+			args["body"] = bodyValue(body, truncated)
+		}
+		var responseBody *bodyRecorder
+		if config.CaptureResponseBody {
+			responseBody = newBodyRecorder(maxBody)
+			c.Writer = &ginBodyWriter{ResponseWriter: c.Writer, body: responseBody}
+		}
+
+		parent := flowtrace.IncomingTraceParent(c.GetHeader(flowtrace.TraceParentHeader))
+		ctx := flowtrace.EnterWithParent(parent, "gin", path, args)
+		flowtrace.WatchContext(c.Request.Context(), ctx)
+		if config.CaptureRouteParams {
+			tagRouteParams(ctx, ginParams(c.Params))
+		}
 
 		defer func() {
 			if err := recover(); err != nil {
 				ctx.ExceptionString(fmt.Sprintf("panic: %v", err))
-				panic(err)
+				if config.RecoverMode.Rethrow(err) {
+					panic(err)
+				}
+				if c.Writer.Written() {
+					c.Abort()
+				} else {
+					c.AbortWithStatus(http.StatusInternalServerError)
+				}
 			}
 		}()
 
@@ -90,6 +117,10 @@ func GinMiddlewareWithConfig(config GinConfig) gin.HandlerFunc {
 			"duration": time.Since(start).Milliseconds(),
 		}
 
+		if responseBody != nil {
+			result["body"] = responseBody.value()
+		}
+
 		// Add custom result fields
 		if config.ExtraResultFields != nil {
 			for key, extractor := range config.ExtraResultFields {
@@ -111,6 +142,27 @@ type GinConfig struct {
 
 	// ExtraResultFields adds custom fields to trace exit
 	ExtraResultFields map[string]func(*gin.Context) interface{}
+
+	// CaptureRequestBody logs up to MaxBodyBytes of the request body as the
+	// "body" argument; a complete JSON body is logged decoded so the
+	// tracer's Redact patterns apply to its fields
+	CaptureRequestBody bool
+
+	// CaptureResponseBody logs up to MaxBodyBytes of the response body as
+	// the "body" result
+	CaptureResponseBody bool
+
+	// MaxBodyBytes caps captured bodies; 0 means DefaultMaxBodyBytes
+	MaxBodyBytes int
+
+	// RecoverMode tells what happens to a panic of the handler once it is
+	// logged; the default flowtrace.RecoverRethrow panics again
+	RecoverMode flowtrace.RecoverMode
+
+	// CaptureRouteParams tags the request with the values of the path
+	// parameters of its route, e.g. {"id":"123"} for /users/{id}, under
+	// "params"
+	CaptureRouteParams bool
 }
 
 // DefaultGinConfig returns default Gin middleware configuration
@@ -123,3 +175,31 @@ func DefaultGinConfig() GinConfig {
 		},
 	}
 }
+
+// ginParams returns the path parameters of a gin route by name
+func ginParams(params gin.Params) map[string]string {
+	values := make(map[string]string, len(params))
+	for _, param := range params {
+		values[param.Key] = param.Value
+	}
+	return values
+}
+
+// ginBodyWriter copies the response body written by gin handlers into a
+// recorder
+type ginBodyWriter struct {
+	gin.ResponseWriter
+	body *bodyRecorder
+}
+
+func (w *ginBodyWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.body.record(data[:n])
+	return n, err
+}
+
+func (w *ginBodyWriter) WriteString(s string) (int, error) {
+	n, err := w.ResponseWriter.WriteString(s)
+	w.body.record([]byte(s[:n]))
+	return n, err
+}
@@ -0,0 +1,157 @@
+package frameworks
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rixmerz/flowtrace-agent-go/flowtrace"
+	"github.com/rixmerz/flowtrace-agent-go/internal/httpwriter"
+)
+
+// GorillaMiddleware creates middleware for Gorilla mux
+func GorillaMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			path := routeTemplate(r)
+			method := r.Method
+
+			// Create response writer wrapper to capture status
+			wrapped := httpwriter.New(w)
+
+			// Create call context
+			parent := flowtrace.IncomingTraceParent(r.Header.Get(flowtrace.TraceParentHeader))
+			ctx := flowtrace.EnterWithParent(parent, "gorilla", path, map[string]interface{}{
+				"method":     method,
+				"url":        r.URL.Path,
+				"query":      r.URL.Query(),
+				"remote":     r.RemoteAddr,
+				"user-agent": r.UserAgent(),
+			})
+			flowtrace.WatchContext(r.Context(), ctx)
+
+			// Setup panic recovery
+			defer func() {
+				if err := recover(); err != nil {
+					ctx.ExceptionString(fmt.Sprintf("panic: %v", err))
+					panic(err)
+				}
+			}()
+
+			// Process request
+			next.ServeHTTP(wrapped, r)
+
+			// Log exit with response info
+			duration := time.Since(start).Milliseconds()
+			ctx.ExitWithValues(map[string]interface{}{
+				"status":   wrapped.Status(),
+				"size":     wrapped.Written(),
+				"duration": duration,
+			})
+		})
+	}
+}
+
+// GorillaMiddlewareWithConfig creates middleware with custom configuration
+func GorillaMiddlewareWithConfig(config GorillaConfig) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Skip if configured
+			if config.Skip != nil && config.Skip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			start := time.Now()
+			path := routeTemplate(r)
+
+			// Create response writer wrapper
+			wrapped := httpwriter.New(w)
+
+			// Build args
+			args := map[string]interface{}{
+				"method": r.Method,
+				"url":    r.URL.Path,
+				"remote": r.RemoteAddr,
+			}
+
+			// Add custom fields
+			if config.ExtraFields != nil {
+				for key, extractor := range config.ExtraFields {
+					args[key] = extractor(r)
+				}
+			}
+
+			parent := flowtrace.IncomingTraceParent(r.Header.Get(flowtrace.TraceParentHeader))
+			ctx := flowtrace.EnterWithParent(parent, "gorilla", path, args)
+			flowtrace.WatchContext(r.Context(), ctx)
+
+			defer func() {
+				if err := recover(); err != nil {
+					ctx.ExceptionString(fmt.Sprintf("panic: %v", err))
+					if config.RecoverMode.Rethrow(err) {
+						panic(err)
+					}
+					wrapped.Respond500()
+				}
+			}()
+
+			next.ServeHTTP(wrapped, r)
+
+			// Build result
+			result := map[string]interface{}{
+				"status":   wrapped.Status(),
+				"duration": time.Since(start).Milliseconds(),
+			}
+
+			// Add custom result fields
+			if config.ExtraResultFields != nil {
+				for key, extractor := range config.ExtraResultFields {
+					result[key] = extractor(w, r)
+				}
+			}
+
+			ctx.ExitWithValues(result)
+		})
+	}
+}
+
+// GorillaConfig holds configuration for Gorilla middleware
+type GorillaConfig struct {
+	// Skip allows skipping certain routes
+	Skip func(*http.Request) bool
+
+	// ExtraFields adds custom fields to trace entry
+	ExtraFields map[string]func(*http.Request) interface{}
+
+	// ExtraResultFields adds custom fields to trace exit
+	ExtraResultFields map[string]func(http.ResponseWriter, *http.Request) interface{}
+
+	// RecoverMode tells what happens to a panic of the handler once it is
+	// logged; the default flowtrace.RecoverRethrow panics again
+	RecoverMode flowtrace.RecoverMode
+}
+
+// DefaultGorillaConfig returns default Gorilla middleware configuration
+func DefaultGorillaConfig() GorillaConfig {
+	return GorillaConfig{
+		Skip: func(r *http.Request) bool {
+			// Skip health check endpoints by default
+			path := routeTemplate(r)
+			return path == "/health" || path == "/ping" || path == "/metrics"
+		},
+	}
+}
+
+// routeTemplate returns the path template of the route matched by r, such
+// as "/users/{id}", falling back to the raw path when no route matched
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return r.URL.Path
+}
@@ -0,0 +1,102 @@
+package frameworks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestGorillaMiddleware(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(GorillaMiddleware())
+	r.HandleFunc("/test", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(`{"message":"ok"}`))
+	})
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Errorf("Expected status 200, got %d", w.Code)
+	}
+}
+
+func TestGorillaMiddlewareRouteTemplate(t *testing.T) {
+	tests := []struct {
+		name       string
+		middleware mux.MiddlewareFunc
+	}{
+		{name: "default", middleware: GorillaMiddleware()},
+		{name: "with config", middleware: GorillaMiddlewareWithConfig(DefaultGorillaConfig())},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mux.NewRouter()
+			r.Use(tt.middleware)
+			r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(mux.Vars(r)["id"]))
+			})
+
+			events := captureEvents(t, func() {
+				r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/123", nil))
+			})
+			if len(events) != 2 {
+				t.Fatalf("Expected 2 events, got %d", len(events))
+			}
+			for _, event := range events {
+				if event.Class != "gorilla" || event.Method != "/users/{id}" {
+					t.Errorf("Expected %s gorilla /users/{id}, got %s %s", event.Event, event.Class, event.Method)
+				}
+			}
+		})
+	}
+}
+
+func TestGorillaMiddlewareSkip(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(GorillaMiddlewareWithConfig(DefaultGorillaConfig()))
+	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+
+	events := captureEvents(t, func() {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+		if w.Code != 200 {
+			t.Errorf("Expected status 200 for health, got %d", w.Code)
+		}
+	})
+	if len(events) != 0 {
+		t.Errorf("Expected skipped route to log no events, got %d", len(events))
+	}
+}
+
+func TestGorillaMiddlewareExtraFields(t *testing.T) {
+	config := GorillaConfig{
+		ExtraFields: map[string]func(*http.Request) interface{}{
+			"tenant": func(r *http.Request) interface{} { return r.Header.Get("X-Tenant") },
+		},
+	}
+
+	r := mux.NewRouter()
+	r.Use(GorillaMiddlewareWithConfig(config))
+	r.HandleFunc("/test", func(w http.ResponseWriter, r *http.Request) {})
+
+	events := captureEvents(t, func() {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Header.Set("X-Tenant", "acme")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	})
+	if len(events) == 0 {
+		t.Fatal("Expected events to be logged")
+	}
+	if want := `"tenant":"acme"`; !strings.Contains(string(events[0].Args), want) {
+		t.Errorf("Expected args to contain %q, got %q", want, events[0].Args)
+	}
+}
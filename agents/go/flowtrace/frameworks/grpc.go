@@ -0,0 +1,184 @@
+package frameworks
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rixmerz/flowtrace-agent-go/flowtrace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// maxMessageSummary limits how much of a request message is logged
+const maxMessageSummary = 256
+
+// GRPCConfig holds configuration for the gRPC interceptors
+type GRPCConfig struct {
+	// Skip allows skipping certain methods (full method name, e.g. "/pkg.Service/Method")
+	Skip func(fullMethod string) bool
+
+	// ExtraFields adds custom fields to trace entry
+	ExtraFields map[string]func(ctx context.Context, fullMethod string) interface{}
+
+	// ExtraResultFields adds custom fields to trace exit
+	ExtraResultFields map[string]func(ctx context.Context, fullMethod string, err error) interface{}
+}
+
+// DefaultGRPCConfig returns default gRPC interceptor configuration
+func DefaultGRPCConfig() GRPCConfig {
+	return GRPCConfig{
+		Skip: func(fullMethod string) bool {
+			// Skip health checks and server reflection by default
+			return strings.HasPrefix(fullMethod, "/grpc.health.v1.Health/") ||
+				strings.HasPrefix(fullMethod, "/grpc.reflection.v1.ServerReflection/") ||
+				strings.HasPrefix(fullMethod, "/grpc.reflection.v1alpha.ServerReflection/")
+		},
+	}
+}
+
+// UnaryServerInterceptor creates a gRPC unary server interceptor
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return UnaryServerInterceptorWithConfig(GRPCConfig{})
+}
+
+// UnaryServerInterceptorWithConfig creates a unary server interceptor with custom configuration
+func UnaryServerInterceptorWithConfig(config GRPCConfig) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if config.Skip != nil && config.Skip(info.FullMethod) {
+			return handler(ctx, req)
+		}
+
+		start := time.Now()
+		args := grpcArgs(ctx, config, info.FullMethod)
+		args["request"] = messageSummary(req)
+
+		callCtx := flowtrace.Enter("grpc", info.FullMethod, args)
+		flowtrace.WatchContext(ctx, callCtx)
+
+		defer func() {
+			if err := recover(); err != nil {
+				callCtx.ExceptionString(fmt.Sprintf("panic: %v", err))
+				panic(err)
+			}
+		}()
+
+		resp, err := handler(ctx, req)
+		grpcExit(callCtx, ctx, config, info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor creates a gRPC stream server interceptor
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return StreamServerInterceptorWithConfig(GRPCConfig{})
+}
+
+// StreamServerInterceptorWithConfig creates a stream server interceptor with custom configuration
+func StreamServerInterceptorWithConfig(config GRPCConfig) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if config.Skip != nil && config.Skip(info.FullMethod) {
+			return handler(srv, ss)
+		}
+
+		start := time.Now()
+		ctx := ss.Context()
+		args := grpcArgs(ctx, config, info.FullMethod)
+		args["client_stream"] = info.IsClientStream
+		args["server_stream"] = info.IsServerStream
+
+		callCtx := flowtrace.Enter("grpc", info.FullMethod, args)
+		flowtrace.WatchContext(ctx, callCtx)
+
+		defer func() {
+			if err := recover(); err != nil {
+				callCtx.ExceptionString(fmt.Sprintf("panic: %v", err))
+				panic(err)
+			}
+		}()
+
+		err := handler(srv, ss)
+		grpcExit(callCtx, ctx, config, info.FullMethod, start, err)
+		return err
+	}
+}
+
+// UnaryClientInterceptor creates a gRPC unary client interceptor
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return UnaryClientInterceptorWithConfig(GRPCConfig{})
+}
+
+// UnaryClientInterceptorWithConfig creates a unary client interceptor with custom configuration
+func UnaryClientInterceptorWithConfig(config GRPCConfig) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if config.Skip != nil && config.Skip(method) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		start := time.Now()
+		args := grpcArgs(ctx, config, method)
+		args["target"] = cc.Target()
+		args["request"] = messageSummary(req)
+
+		callCtx := flowtrace.Enter("grpc-client", method, args)
+		flowtrace.WatchContext(ctx, callCtx)
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		grpcExit(callCtx, ctx, config, method, start, err)
+		return err
+	}
+}
+
+// grpcArgs builds the entry args shared by all interceptors
+func grpcArgs(ctx context.Context, config GRPCConfig, fullMethod string) map[string]interface{} {
+	args := map[string]interface{}{
+		"method": fullMethod,
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		args["peer"] = p.Addr.String()
+	}
+
+	// Add custom fields
+	if config.ExtraFields != nil {
+		for key, extractor := range config.ExtraFields {
+			args[key] = extractor(ctx, fullMethod)
+		}
+	}
+	return args
+}
+
+// grpcExit logs the outcome of a call: an EXIT with status code and duration
+// on success, or an EXCEPTION carrying the status when the call failed
+func grpcExit(callCtx *flowtrace.CallContext, ctx context.Context, config GRPCConfig, fullMethod string, start time.Time, err error) {
+	if err != nil {
+		st := status.Convert(err)
+		callCtx.ExceptionString(fmt.Sprintf("%s: %s", st.Code(), st.Message()))
+		return
+	}
+
+	result := map[string]interface{}{
+		"code":     status.Code(err).String(),
+		"duration": time.Since(start).Milliseconds(),
+	}
+
+	// Add custom result fields
+	if config.ExtraResultFields != nil {
+		for key, extractor := range config.ExtraResultFields {
+			result[key] = extractor(ctx, fullMethod, err)
+		}
+	}
+
+	callCtx.ExitWithValues(result)
+}
+
+// messageSummary renders a request message for logging, truncated to
+// maxMessageSummary bytes
+func messageSummary(msg interface{}) string {
+	summary := fmt.Sprintf("%T %v", msg, msg)
+	if len(summary) > maxMessageSummary {
+		summary = summary[:maxMessageSummary] + "..."
+	}
+	return summary
+}
@@ -0,0 +1,220 @@
+package frameworks
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rixmerz/flowtrace-agent-go/flowtrace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// captureEvents runs fn with tracing enabled and returns the events it
+// logged, without the METADATA event starting the trace
+func captureEvents(t *testing.T, fn func()) []flowtrace.TraceEvent {
+	t.Helper()
+	return captureEventsWith(t, flowtrace.Config{}, fn)
+}
+
+// captureEventsWith is captureEvents with a tracer configured by config,
+// whose LogFile is replaced
+func captureEventsWith(t *testing.T, config flowtrace.Config, fn func()) []flowtrace.TraceEvent {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	config.LogFile = path
+	if err := flowtrace.Start(config); err != nil {
+		t.Fatalf("Failed to start tracer: %v", err)
+	}
+	func() {
+		defer flowtrace.Stop()
+		fn()
+	}()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open trace: %v", err)
+	}
+	defer f.Close()
+
+	var events []flowtrace.TraceEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event flowtrace.TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Invalid trace line: %v", err)
+		}
+		if event.Event == "METADATA" {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// startHealthServer serves the standard health service in-process and
+// returns a client connection to it
+func startHealthServer(t *testing.T, serverOpts []grpc.ServerOption, dialOpts ...grpc.DialOption) *grpc.ClientConn {
+	t.Helper()
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(serverOpts...)
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("users", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	dialOpts = append(dialOpts,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	conn, err := grpc.NewClient("passthrough:///bufnet", dialOpts...)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	conn := startHealthServer(t, []grpc.ServerOption{grpc.UnaryInterceptor(UnaryServerInterceptor())})
+	client := healthpb.NewHealthClient(conn)
+
+	events := captureEvents(t, func() {
+		if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "users"}); err != nil {
+			t.Errorf("Check failed: %v", err)
+		}
+		_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "missing"})
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("Expected NotFound, got %v", err)
+		}
+	})
+
+	if len(events) != 4 {
+		t.Fatalf("Expected 4 events, got %d: %+v", len(events), events)
+	}
+
+	const method = "/grpc.health.v1.Health/Check"
+	for _, event := range events {
+		if event.Class != "grpc" || event.Method != method {
+			t.Errorf("Expected grpc %s, got %s %s", method, event.Class, event.Method)
+		}
+	}
+	if !strings.Contains(string(events[0].Args), "users") {
+		t.Errorf("Expected request summary in args, got %s", events[0].Args)
+	}
+	if events[1].Event != "EXIT" || !strings.Contains(string(events[1].Result), `"code":"OK"`) {
+		t.Errorf("Expected EXIT with code OK, got %s %s", events[1].Event, events[1].Result)
+	}
+	if events[3].Event != "EXCEPTION" || !strings.HasPrefix(events[3].Exception, "NotFound") {
+		t.Errorf("Expected EXCEPTION with NotFound, got %s %q", events[3].Event, events[3].Exception)
+	}
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	// The outer interceptor signals once the traced handler has returned
+	handled := make(chan struct{})
+	done := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		defer close(handled)
+		return handler(srv, ss)
+	}
+	conn := startHealthServer(t, []grpc.ServerOption{grpc.ChainStreamInterceptor(done, StreamServerInterceptor())})
+	client := healthpb.NewHealthClient(conn)
+
+	events := captureEvents(t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "users"})
+		if err != nil {
+			t.Fatalf("Watch failed: %v", err)
+		}
+		if _, err := stream.Recv(); err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		cancel()
+		<-handled
+	})
+
+	if len(events) != 2 || events[0].Event != "ENTER" || events[0].Method != "/grpc.health.v1.Health/Watch" {
+		t.Fatalf("Expected ENTER and exit for Watch, got %+v", events)
+	}
+	if !strings.Contains(string(events[0].Args), `"server_stream":true`) {
+		t.Errorf("Expected stream kind in args, got %s", events[0].Args)
+	}
+	if events[1].Event != "EXCEPTION" || !strings.HasPrefix(events[1].Exception, "Canceled") {
+		t.Errorf("Expected cancelled stream to be logged as EXCEPTION, got %s %q", events[1].Event, events[1].Exception)
+	}
+}
+
+func TestUnaryServerInterceptorConfig(t *testing.T) {
+	config := DefaultGRPCConfig()
+	config.ExtraFields = map[string]func(context.Context, string) interface{}{
+		"tenant": func(context.Context, string) interface{} { return "acme" },
+	}
+	interceptor := UnaryServerInterceptorWithConfig(config)
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+
+	events := captureEvents(t, func() {
+		interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"}, handler)
+		interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/users.Users/Get"}, handler)
+	})
+
+	if len(events) != 2 {
+		t.Fatalf("Expected health check to be skipped, got %d events", len(events))
+	}
+	if events[0].Method != "/users.Users/Get" || !strings.Contains(string(events[0].Args), `"tenant":"acme"`) {
+		t.Errorf("Expected extra field on /users.Users/Get, got %s %s", events[0].Method, events[0].Args)
+	}
+}
+
+func TestUnaryServerInterceptorPanic(t *testing.T) {
+	interceptor := UnaryServerInterceptor()
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("boom")
+	}
+
+	events := captureEvents(t, func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected panic to be re-raised")
+			}
+		}()
+		interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/users.Users/Get"}, handler)
+	})
+
+	if len(events) != 2 || events[1].Event != "EXCEPTION" || events[1].Exception != "panic: boom" {
+		t.Errorf("Expected ENTER and EXCEPTION, got %+v", events)
+	}
+}
+
+func TestUnaryClientInterceptor(t *testing.T) {
+	conn := startHealthServer(t, nil, grpc.WithUnaryInterceptor(UnaryClientInterceptor()))
+	client := healthpb.NewHealthClient(conn)
+
+	events := captureEvents(t, func() {
+		if _, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "users"}); err != nil {
+			t.Errorf("Check failed: %v", err)
+		}
+	})
+
+	if len(events) != 2 || events[0].Class != "grpc-client" || events[1].Event != "EXIT" {
+		t.Errorf("Expected client ENTER and EXIT, got %+v", events)
+	}
+}
@@ -0,0 +1,17 @@
+package frameworks
+
+import "github.com/rixmerz/flowtrace-agent-go/flowtrace"
+
+// paramsTag is the tag recording the path parameters of a request, such as
+// {"id":"123"} for /users/123 routed by /users/{id}. The route pattern stays
+// in the "path" argument, so requests of a route share it while the values
+// are kept apart; keys matching the tracer's Redact patterns are redacted.
+const paramsTag = "params"
+
+// tagRouteParams tags the request of ctx with the path parameters of its
+// route, if any
+func tagRouteParams(ctx *flowtrace.CallContext, params map[string]string) {
+	if len(params) > 0 {
+		ctx.Tag(paramsTag, params)
+	}
+}
@@ -0,0 +1,103 @@
+package frameworks
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-chi/chi/v5"
+	"github.com/gofiber/fiber/v2"
+	"github.com/labstack/echo/v4"
+	"github.com/rixmerz/flowtrace-agent-go/flowtrace"
+)
+
+// paramServers serve GET /users/{id}/tokens/{token} with each framework's
+// middleware configured to capture route parameters
+func paramServers() map[string]func(t *testing.T, req *http.Request) {
+	return map[string]func(t *testing.T, req *http.Request){
+		"chi": func(t *testing.T, req *http.Request) {
+			r := chi.NewRouter()
+			r.Use(ChiMiddlewareWithConfig(ChiConfig{CaptureRouteParams: true}))
+			r.Get("/users/{id}/tokens/{token}", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			r.ServeHTTP(httptest.NewRecorder(), req)
+		},
+		"gin": func(t *testing.T, req *http.Request) {
+			router := gin.New()
+			router.Use(GinMiddlewareWithConfig(GinConfig{CaptureRouteParams: true}))
+			router.GET("/users/:id/tokens/:token", func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		},
+		"echo": func(t *testing.T, req *http.Request) {
+			e := echo.New()
+			e.Use(EchoMiddlewareWithConfig(EchoConfig{CaptureRouteParams: true}))
+			e.GET("/users/:id/tokens/:token", func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			})
+			e.ServeHTTP(httptest.NewRecorder(), req)
+		},
+		"fiber": func(t *testing.T, req *http.Request) {
+			app := fiber.New()
+			app.Use(FiberMiddlewareWithConfig(FiberConfig{CaptureRouteParams: true}))
+			app.Get("/users/:id/tokens/:token", func(c *fiber.Ctx) error {
+				return c.SendStatus(http.StatusOK)
+			})
+			if _, err := app.Test(req); err != nil {
+				t.Fatalf("Test request failed: %v", err)
+			}
+		},
+	}
+}
+
+// capturedParams returns the params tag of the EXIT event
+func capturedParams(t *testing.T, events []flowtrace.TraceEvent) map[string]string {
+	t.Helper()
+
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	var tags map[string]map[string]string
+	if err := json.Unmarshal(events[1].Tags, &tags); err != nil {
+		t.Fatalf("Invalid tags %s: %v", events[1].Tags, err)
+	}
+	return tags[paramsTag]
+}
+
+func TestMiddlewaresCaptureRouteParams(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	for name, serve := range paramServers() {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/users/123/tokens/s3cr3t", nil)
+			events := captureEventsWith(t, flowtrace.Config{Redact: []string{"token"}}, func() { serve(t, req) })
+
+			params := capturedParams(t, events)
+			if params["id"] != "123" {
+				t.Errorf("Expected id=123 to be captured, got %v", params)
+			}
+			if params["token"] != "<redacted>" {
+				t.Errorf("Expected the token to be redacted, got %v", params)
+			}
+		})
+	}
+}
+
+func TestMiddlewaresLeaveOutRouteParamsByDefault(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	r := chi.NewRouter()
+	r.Use(ChiMiddlewareWithConfig(ChiConfig{}))
+	r.Get("/users/{id}", func(w http.ResponseWriter, r *http.Request) {})
+
+	events := captureEvents(t, func() {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/123", nil))
+	})
+	if len(events) != 2 || len(events[1].Tags) != 0 {
+		t.Errorf("Expected no tags without CaptureRouteParams, got %v", events)
+	}
+}
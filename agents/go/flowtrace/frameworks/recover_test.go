@@ -0,0 +1,98 @@
+package frameworks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-chi/chi/v5"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gorilla/mux"
+	"github.com/labstack/echo/v4"
+	"github.com/rixmerz/flowtrace-agent-go/flowtrace"
+)
+
+// panicServers serve GET /panic, whose handler panics, with each
+// framework's middleware configured with mode. They return the status the
+// client received, and whether the panic reached the caller.
+func panicServers(mode flowtrace.RecoverMode) map[string]func(t *testing.T) (status int, panicked bool) {
+	serveHTTP := func(handler http.Handler) (status int, panicked bool) {
+		defer func() {
+			if recover() != nil {
+				panicked = true
+			}
+		}()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/panic", nil))
+		return w.Code, false
+	}
+
+	return map[string]func(t *testing.T) (int, bool){
+		"chi": func(t *testing.T) (int, bool) {
+			r := chi.NewRouter()
+			r.Use(ChiMiddlewareWithConfig(ChiConfig{RecoverMode: mode}))
+			r.Get("/panic", func(w http.ResponseWriter, r *http.Request) { panic("nil map") })
+			return serveHTTP(r)
+		},
+		"gorilla": func(t *testing.T) (int, bool) {
+			r := mux.NewRouter()
+			r.Use(GorillaMiddlewareWithConfig(GorillaConfig{RecoverMode: mode}))
+			r.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) { panic("nil map") })
+			return serveHTTP(r)
+		},
+		"gin": func(t *testing.T) (int, bool) {
+			router := gin.New()
+			router.Use(GinMiddlewareWithConfig(GinConfig{RecoverMode: mode}))
+			router.GET("/panic", func(c *gin.Context) { panic("nil map") })
+			return serveHTTP(router)
+		},
+		"echo": func(t *testing.T) (int, bool) {
+			e := echo.New()
+			e.Use(EchoMiddlewareWithConfig(EchoConfig{RecoverMode: mode}))
+			e.GET("/panic", func(c echo.Context) error { panic("nil map") })
+			return serveHTTP(e)
+		},
+		"fiber": func(t *testing.T) (int, bool) {
+			if mode != flowtrace.RecoverRespond500 {
+				// A panic escaping Fiber's handler kills the test server
+				t.Skip("fiber cannot serve a rethrown panic in app.Test")
+			}
+			app := fiber.New()
+			app.Use(FiberMiddlewareWithConfig(FiberConfig{RecoverMode: mode}))
+			app.Get("/panic", func(c *fiber.Ctx) error { panic("nil map") })
+			resp, err := app.Test(httptest.NewRequest("GET", "/panic", nil))
+			if err != nil {
+				t.Fatalf("Test request failed: %v", err)
+			}
+			resp.Body.Close()
+			return resp.StatusCode, false
+		},
+	}
+}
+
+func TestMiddlewaresRecoverMode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	for _, mode := range []flowtrace.RecoverMode{flowtrace.RecoverRethrow, flowtrace.RecoverRespond500} {
+		for name, serve := range panicServers(mode) {
+			t.Run(string(mode)+"/"+name, func(t *testing.T) {
+				var status int
+				var panicked bool
+				events := captureEvents(t, func() { status, panicked = serve(t) })
+
+				if mode == flowtrace.RecoverRethrow && !panicked {
+					t.Errorf("Expected the panic to be rethrown, got status %d", status)
+				}
+				if mode == flowtrace.RecoverRespond500 && (panicked || status != http.StatusInternalServerError) {
+					t.Errorf("Expected a 500 response, got status %d (panicked: %v)", status, panicked)
+				}
+
+				if len(events) != 2 || events[1].Event != "EXCEPTION" || !strings.Contains(events[1].Exception, "nil map") {
+					t.Errorf("Expected ENTER and an EXCEPTION for the panic, got %+v", events)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package frameworks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-chi/chi/v5"
+	"github.com/gofiber/fiber/v2"
+	"github.com/labstack/echo/v4"
+	"github.com/rixmerz/flowtrace-agent-go/flowtrace"
+)
+
+func TestMiddlewaresContinueIncomingTrace(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	const (
+		traceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentID = "00f067aa0ba902b7"
+	)
+
+	serve := map[string]func(t *testing.T, req *http.Request){
+		"chi": func(t *testing.T, req *http.Request) {
+			r := chi.NewRouter()
+			r.Use(ChiMiddleware())
+			r.Get("/test", func(w http.ResponseWriter, r *http.Request) {})
+			r.ServeHTTP(httptest.NewRecorder(), req)
+		},
+		"gin": func(t *testing.T, req *http.Request) {
+			router := gin.New()
+			router.Use(GinMiddleware())
+			router.GET("/test", func(c *gin.Context) {})
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		},
+		"echo": func(t *testing.T, req *http.Request) {
+			e := echo.New()
+			e.Use(EchoMiddleware())
+			e.GET("/test", func(c echo.Context) error { return nil })
+			e.ServeHTTP(httptest.NewRecorder(), req)
+		},
+		"fiber": func(t *testing.T, req *http.Request) {
+			app := fiber.New()
+			app.Use(FiberMiddleware())
+			app.Get("/test", func(c *fiber.Ctx) error { return nil })
+			if _, err := app.Test(req); err != nil {
+				t.Fatalf("Test request failed: %v", err)
+			}
+		},
+	}
+
+	for name, fn := range serve {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/test", nil)
+			req.Header.Set(flowtrace.TraceParentHeader, "00-"+traceID+"-"+parentID+"-01")
+
+			events := captureEvents(t, func() { fn(t, req) })
+			if len(events) != 2 {
+				t.Fatalf("Expected 2 events, got %d", len(events))
+			}
+			for _, event := range events {
+				if event.TraceID != traceID {
+					t.Errorf("Expected %s trace ID %s, got %q", event.Event, traceID, event.TraceID)
+				}
+				if event.ParentSpanID != parentID {
+					t.Errorf("Expected %s parent span %s, got %q", event.Event, parentID, event.ParentSpanID)
+				}
+			}
+		})
+	}
+}
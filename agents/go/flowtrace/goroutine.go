@@ -0,0 +1,123 @@
+package flowtrace
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// getGoroutineID returns the current goroutine ID.
+//
+// The runtime keeps the ID in the structure of the goroutine, which curg
+// returns; the ID is read from it at the offset found by goidOffset, so no
+// stack is parsed once the offset is known. As that structure is not part
+// of the Go API, the stack header stays the reference: the ID read is
+// checked against it on the first call of each goroutine, and on any
+// difference the IDs are parsed from the stack from then on. Where curg is
+// not implemented, or the offset could not be found, the ID is parsed from
+// the stack as well.
+func getGoroutineID() int64 {
+	if offset := goidOffset(); offset >= 0 && !goidMismatch.Load() {
+		id := *(*int64)(unsafe.Add(curg(), offset))
+		checked := &goidChecked[uint64(id)%uint64(len(goidChecked))]
+		if id > 0 && checked.Load() == id {
+			return id
+		}
+		if parsed := stackGoroutineID(); parsed != id {
+			goidMismatch.Store(true)
+			return parsed
+		}
+		checked.Store(id)
+		return id
+	}
+	return stackGoroutineID()
+}
+
+var (
+	// goidChecked holds IDs read at goidOffset that matched the stack
+	// header, each at its index modulo the table size. An ID pushed out
+	// by another is only checked again.
+	goidChecked [1024]atomic.Int64
+
+	// goidMismatch is set once an ID read at goidOffset differed from the
+	// stack header, which disables reading it
+	goidMismatch atomic.Bool
+)
+
+// stackGoroutineID reads the current goroutine ID from the
+// "goroutine N [status]:" header of the current stack. Only the header is
+// captured and it is parsed by hand, which keeps the cost to a small
+// fixed-size stack copy without the allocations of fmt.Sscanf.
+func stackGoroutineID() int64 {
+	var buf [32]byte
+	n := runtime.Stack(buf[:], false)
+	return parseGoroutineID(buf[:n])
+}
+
+// goidSearchLimit bounds the offsets searched for the ID, which lies well
+// within the runtime's goroutine structure in every Go release
+const goidSearchLimit = 256
+
+// goidOffset returns the offset of the ID in the structure returned by
+// curg, or -1 if it is unknown. The offset is searched once, as the only
+// one holding the ID parsed from the stack of each of a few goroutines.
+var goidOffset = sync.OnceValue(func() int {
+	if curg() == nil {
+		return -1
+	}
+
+	const probes = 3
+	candidates := make(map[int]int)
+	for range probes {
+		done := make(chan []int)
+		go func() {
+			g, id := curg(), stackGoroutineID()
+			var matches []int
+			for offset := 0; offset+8 <= goidSearchLimit; offset += 8 {
+				if *(*int64)(unsafe.Add(g, offset)) == id {
+					matches = append(matches, offset)
+				}
+			}
+			done <- matches
+		}()
+		for _, offset := range <-done {
+			candidates[offset]++
+		}
+	}
+
+	found := -1
+	for offset, count := range candidates {
+		if count == probes {
+			if found >= 0 {
+				return -1
+			}
+			found = offset
+		}
+	}
+	return found
+})
+
+// parseGoroutineID extracts N from a "goroutine N ..." stack header, or
+// returns 0 if the header is not in that form
+func parseGoroutineID(header []byte) int64 {
+	const prefix = "goroutine "
+	if len(header) < len(prefix) || string(header[:len(prefix)]) != prefix {
+		return 0
+	}
+
+	var id int64
+	for _, c := range header[len(prefix):] {
+		if c < '0' || c > '9' {
+			break
+		}
+		id = id*10 + int64(c-'0')
+	}
+	return id
+}
+
+// threadName returns the Thread value logged for a goroutine
+func threadName(gid int64) string {
+	return "goroutine-" + strconv.FormatInt(gid, 10)
+}
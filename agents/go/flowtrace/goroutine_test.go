@@ -0,0 +1,158 @@
+package flowtrace
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestParseGoroutineID(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected int64
+	}{
+		{"goroutine 1 [running]:\nmain.main()", 1},
+		{"goroutine 18446 [running]:", 18446},
+		{"goroutine 7", 7},
+		{"goroutine ", 0},
+		{"", 0},
+		{"thread 5 [running]:", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if id := parseGoroutineID([]byte(tt.header)); id != tt.expected {
+				t.Errorf("Expected %d, got %d", tt.expected, id)
+			}
+		})
+	}
+}
+
+func TestGoroutineIDStableAndDistinct(t *testing.T) {
+	const workers = 50
+
+	ids := make([]int64, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			first := getGoroutineID()
+			runtime.Gosched()
+			if again := getGoroutineID(); again != first {
+				t.Errorf("Expected stable ID within a goroutine, got %d then %d", first, again)
+			}
+			ids[i] = first
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[int64]bool{getGoroutineID(): true}
+	for _, id := range ids {
+		if id <= 0 {
+			t.Errorf("Expected a positive goroutine ID, got %d", id)
+		}
+		if seen[id] {
+			t.Errorf("Expected distinct goroutine IDs, got %d twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestGoroutineIDFromRuntime(t *testing.T) {
+	if curg() == nil {
+		t.Skip("goroutine structure not readable on " + runtime.GOARCH)
+	}
+	if goidOffset() < 0 {
+		t.Fatal("Expected the offset of the goroutine ID to be found")
+	}
+
+	// The ID read matches the stack header, on fresh goroutines as well
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if id, want := getGoroutineID(), stackGoroutineID(); id != want {
+				t.Errorf("Expected goroutine ID %d, got %d", want, id)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestGoroutineIDMismatchFallsBackToStack(t *testing.T) {
+	if curg() == nil || goidOffset() < 0 {
+		t.Skip("goroutine structure not readable on " + runtime.GOARCH)
+	}
+	offset := goidOffset
+	defer func() {
+		goidOffset = offset
+		goidMismatch.Store(false)
+	}()
+
+	// An offset off by a field reads another value on a new goroutine,
+	// which the stack header catches
+	wrong := offset() + 8
+	goidOffset = func() int { return wrong }
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if id, want := getGoroutineID(), stackGoroutineID(); id != want {
+			t.Errorf("Expected goroutine ID %d, got %d", want, id)
+		}
+	}()
+	<-done
+
+	if !goidMismatch.Load() {
+		t.Error("Expected the goroutine structure not to be read after a mismatch")
+	}
+}
+
+// sscanfGoroutineID is the previous implementation, kept for comparison
+func sscanfGoroutineID() int64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	var gid int64
+	fmt.Sscanf(string(buf[:n]), "goroutine %d", &gid)
+	return gid
+}
+
+func BenchmarkGoroutineID(b *testing.B) {
+	b.Run("runtime", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			getGoroutineID()
+		}
+	})
+	b.Run("parse", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			stackGoroutineID()
+		}
+	})
+	b.Run("sscanf", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sscanfGoroutineID()
+		}
+	})
+}
+
+func BenchmarkEnterExit(b *testing.B) {
+	tracer, err := NewTracer(Config{})
+	if err != nil {
+		b.Fatalf("NewTracer failed: %v", err)
+	}
+	tracer.writer = io.Discard
+	globalTracer.Store(tracer)
+	defer globalTracer.Store(nil)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ctx := Enter("bench", "call", nil)
+		ctx.Exit(nil)
+	}
+}
@@ -0,0 +1,74 @@
+package flowtrace
+
+import (
+	"encoding/json"
+	"maps"
+)
+
+// EventHook inspects an event before it is written. It may change the
+// event, e.g. add a tag with SetTag, and returns false to drop it. Hooks
+// run on the goroutine logging the event and must not call the tracer.
+type EventHook func(event *TraceEvent) bool
+
+// AddHook registers hook to run on every event logged from now on, after
+// the hooks registered before it. An event dropped by a hook is not
+// written anywhere nor counted in the metrics, and the hooks after it
+// don't see it.
+func (t *Tracer) AddHook(hook EventHook) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Events are logged without the mutex held, so the list is replaced
+	// rather than appended to in place
+	var hooks []EventHook
+	if current := t.hooks.Load(); current != nil {
+		hooks = append(hooks, *current...)
+	}
+	hooks = append(hooks, hook)
+	t.hooks.Store(&hooks)
+}
+
+// AddHook registers hook on the running tracer; see Tracer.AddHook. It
+// does nothing when the tracer isn't started.
+func AddHook(hook EventHook) {
+	if t := globalTracer.Load(); t != nil {
+		t.AddHook(hook)
+	}
+}
+
+// runHooks passes event through the registered hooks and reports whether
+// it is kept
+func (t *Tracer) runHooks(event *TraceEvent) bool {
+	hooks := t.hooks.Load()
+	if hooks == nil {
+		return true
+	}
+	for _, hook := range *hooks {
+		if !hook(event) {
+			return false
+		}
+	}
+	return true
+}
+
+// SetTag sets a tag on the event, replacing its value if the key is
+// already set, as Tag does for the call an event belongs to. Hooks use it
+// to enrich events, e.g. with the host name. Tags not encoded as a JSON
+// object, as with Config.LegacyArgFormat, are replaced.
+func (e *TraceEvent) SetTag(key string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+
+	tags := make(map[string]json.RawMessage)
+	var current map[string]json.RawMessage
+	if json.Unmarshal(e.Tags, &current) == nil {
+		maps.Copy(tags, current)
+	}
+	tags[key] = data
+
+	if encoded, err := json.Marshal(tags); err == nil {
+		e.Tags = encoded
+	}
+}
@@ -0,0 +1,111 @@
+package flowtrace
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestHookDropsEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	seen := 0
+	AddHook(func(event *TraceEvent) bool { return event.Event != "ENTER" })
+	AddHook(func(event *TraceEvent) bool {
+		// Dropped events don't reach later hooks
+		if event.Event == "ENTER" {
+			t.Errorf("Expected ENTER to be dropped before the second hook")
+		}
+		seen++
+		return true
+	})
+
+	ctx := Enter("shop", "Checkout", nil)
+	inner := Enter("shop", "Charge", nil)
+	inner.ExceptionString("panic: declined")
+	ctx.Exit(nil)
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	events := readTrace(t, path)
+	if len(events) != 2 || seen != 2 {
+		t.Fatalf("Expected the 2 exit events, got %d written and %d seen: %+v", len(events), seen, events)
+	}
+	for _, event := range events {
+		if event.Event == "ENTER" {
+			t.Errorf("Expected no ENTER event, got %+v", event)
+		}
+	}
+}
+
+func TestHookEnrichesEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	AddHook(func(event *TraceEvent) bool {
+		event.SetTag("pod", "shop-7d9f")
+		return true
+	})
+	AddHook(func(event *TraceEvent) bool {
+		// Hooks run in registration order, so the tag is already set
+		event.SetTag("region", "eu-west-1")
+		return true
+	})
+
+	ctx := Enter("shop", "Checkout", nil)
+	Tag("order_id", 42)
+	ctx.Exit(nil)
+	// Still open at Stop
+	Enter("shop", "Poll", nil)
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	events := readTrace(t, path)
+	if len(events) != 4 {
+		t.Fatalf("Expected 4 events, got %d: %+v", len(events), events)
+	}
+	for _, event := range events {
+		var tags map[string]interface{}
+		if err := json.Unmarshal(event.Tags, &tags); err != nil {
+			t.Fatalf("Expected tags on %s %s, got %s", event.Event, event.Method, event.Tags)
+		}
+		if tags["pod"] != "shop-7d9f" || tags["region"] != "eu-west-1" {
+			t.Errorf("Expected the hook tags on %s %s, got %v", event.Event, event.Method, tags)
+		}
+		// Tags of the call are kept
+		if event.Event == "EXIT" && event.Method == "Checkout" && tags["order_id"] != float64(42) {
+			t.Errorf("Expected the order_id tag to be kept, got %v", tags)
+		}
+	}
+
+	// The EXIT logged by Stop for the open call goes through the hooks too
+	if last := events[3]; !last.Truncated {
+		t.Errorf("Expected the truncated EXIT of Poll last, got %+v", last)
+	}
+}
+
+func TestSetTag(t *testing.T) {
+	var event TraceEvent
+	event.SetTag("host", "web-1")
+	event.SetTag("attempt", 2)
+	event.SetTag("host", "web-2")
+	if got := string(event.Tags); got != `{"attempt":2,"host":"web-2"}` {
+		t.Errorf("Expected merged tags, got %s", got)
+	}
+
+	// Tags in the legacy format are replaced
+	event.Tags = json.RawMessage(`"map[host:web-1]"`)
+	event.SetTag("host", "web-3")
+	if got := string(event.Tags); got != `{"host":"web-3"}` {
+		t.Errorf("Expected legacy tags to be replaced, got %s", got)
+	}
+}
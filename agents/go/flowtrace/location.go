@@ -0,0 +1,38 @@
+package flowtrace
+
+import (
+	"runtime"
+	"sync"
+)
+
+// sourceLocation is the file and line where a traced function is defined
+type sourceLocation struct {
+	file string
+	line int
+}
+
+// locationCache maps call-site program counters to resolved locations, so
+// symbol lookups happen once per call site
+var locationCache sync.Map // uintptr -> sourceLocation
+
+// callerLocation returns the definition site of the function skip frames
+// above the caller of callerLocation. It reports where the function starts
+// rather than the line of the call, so every event of a function points at
+// its declaration.
+func callerLocation(skip int) sourceLocation {
+	pc, _, _, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return sourceLocation{}
+	}
+
+	if loc, ok := locationCache.Load(pc); ok {
+		return loc.(sourceLocation)
+	}
+
+	var loc sourceLocation
+	if fn := runtime.FuncForPC(pc); fn != nil {
+		loc.file, loc.line = fn.FileLine(fn.Entry())
+	}
+	locationCache.Store(pc, loc)
+	return loc
+}
@@ -0,0 +1,113 @@
+package flowtrace
+
+import (
+	"bufio"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// locationFixtureInstrumented mirrors what the transformer generates
+func locationFixtureInstrumented(n int) (result int) {
+	__ft_ctx := Enter("flowtrace", "locationFixtureInstrumented", map[string]interface{}{"n": n})
+	defer __ft_ctx.Exit(func() interface{} { return result })
+
+	result = n * 2
+	return
+}
+
+// locationFixtureManual traces itself through the lower-level API
+func locationFixtureManual() {
+	TraceEnter("flowtrace", "locationFixtureManual", nil)
+	defer TraceExit("flowtrace", "locationFixtureManual", nil)
+}
+
+// fixtureDeclLines returns the declaration line of each function in this file
+func fixtureDeclLines(t *testing.T) map[string]int {
+	t.Helper()
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "location_test.go", nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to parse fixture: %v", err)
+	}
+
+	lines := make(map[string]int)
+	for _, decl := range file.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			lines[fn.Name.Name] = fset.Position(fn.Pos()).Line
+		}
+	}
+	return lines
+}
+
+func TestEnterCapturesDefinitionSite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	locationFixtureInstrumented(21)
+	locationFixtureManual()
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open trace: %v", err)
+	}
+	defer f.Close()
+
+	lines := fixtureDeclLines(t)
+	entered := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Invalid JSON line: %v", err)
+		}
+		if event.Event != "ENTER" {
+			if event.File != "" || event.Line != 0 {
+				t.Errorf("Expected no location on %s event", event.Event)
+			}
+			continue
+		}
+
+		entered++
+		if filepath.Base(event.File) != "location_test.go" {
+			t.Errorf("Expected %s to be located in location_test.go, got %q", event.Method, event.File)
+		}
+		if want := lines[event.Method]; event.Line != want {
+			t.Errorf("Expected %s at line %d, got %d", event.Method, want, event.Line)
+		}
+	}
+
+	if entered != 2 {
+		t.Errorf("Expected 2 ENTER events, got %d", entered)
+	}
+}
+
+func TestEnterAtReportsGivenSite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	// As instrumented code built from a copy calls it
+	ctx := EnterAt("main", "Checkout", "/src/shop/cart.go", 42, nil)
+	ctx.Exit(nil)
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	events := readTrace(t, path)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	if enter := events[0]; enter.File != "/src/shop/cart.go" || enter.Line != 42 {
+		t.Errorf("Expected Checkout at /src/shop/cart.go:42, got %s:%d", enter.File, enter.Line)
+	}
+}
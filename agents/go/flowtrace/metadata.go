@@ -0,0 +1,60 @@
+package flowtrace
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Metadata describes the process a trace was recorded by, so traces of
+// several instances of a service can be told apart. It is written once,
+// as a METADATA event, when the tracer starts.
+type Metadata struct {
+	ServiceName    string `json:"serviceName,omitempty"`    // Config.ServiceName
+	ServiceVersion string `json:"serviceVersion,omitempty"` // Config.ServiceVersion
+	Environment    string `json:"environment,omitempty"`    // Config.Environment
+	Hostname       string `json:"hostname,omitempty"`
+	PID            int    `json:"pid"`
+}
+
+// newMetadata returns the metadata of the current process
+func newMetadata(config Config) *Metadata {
+	hostname, _ := os.Hostname()
+	return &Metadata{
+		ServiceName:    config.ServiceName,
+		ServiceVersion: config.ServiceVersion,
+		Environment:    config.Environment,
+		Hostname:       hostname,
+		PID:            os.Getpid(),
+	}
+}
+
+// logMetadata writes the METADATA event starting the trace to the log file
+// and the remote collector, the outputs traces are collected from, and
+// keeps it to start the dumps of the ring buffer. Stdout is left to the
+// calls, OTLP describes the service in its resource, and CSV has no
+// columns for it.
+func (t *Tracer) logMetadata() {
+	event := TraceEvent{
+		Event:         "METADATA",
+		Timestamp:     t.timestamp(t.clock.Now()),
+		Metadata:      newMetadata(t.config),
+		SchemaVersion: SchemaVersion,
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.ring != nil {
+		t.ring.metadata = data
+	}
+	if t.writer != nil && t.config.Format != FormatCSV {
+		t.format.write(t.writer, event, data)
+	}
+	if t.remote != nil {
+		t.remote.send(data)
+	}
+}
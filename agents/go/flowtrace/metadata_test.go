@@ -0,0 +1,94 @@
+package flowtrace
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMetadataStartsTrace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+
+	// Every run appending to the file starts with its own record
+	for i := 0; i < 2; i++ {
+		if err := Start(Config{LogFile: path, ServiceName: "checkout", ServiceVersion: "1.4.2", Environment: "staging"}); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		Enter("shop", "Checkout", nil).Exit(nil)
+		if err := Stop(); err != nil {
+			t.Fatalf("Stop failed: %v", err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open trace: %v", err)
+	}
+	defer f.Close()
+
+	var events []TraceEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Invalid trace line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 6 {
+		t.Fatalf("Expected 2 runs of 3 events, got %d", len(events))
+	}
+
+	hostname, _ := os.Hostname()
+	want := Metadata{
+		ServiceName:    "checkout",
+		ServiceVersion: "1.4.2",
+		Environment:    "staging",
+		Hostname:       hostname,
+		PID:            os.Getpid(),
+	}
+	for _, i := range []int{0, 3} {
+		event := events[i]
+		if event.Event != "METADATA" || event.Metadata == nil {
+			t.Fatalf("Expected event %d to be METADATA, got %+v", i, event)
+		}
+		if *event.Metadata != want {
+			t.Errorf("Expected metadata %+v, got %+v", want, *event.Metadata)
+		}
+		if event.Timestamp == 0 || event.SchemaVersion != SchemaVersion {
+			t.Errorf("Expected a timestamp and the schema version, got %+v", event)
+		}
+	}
+}
+
+func TestMetadataLeftOutOfStdout(t *testing.T) {
+	stdout := captureStdout(t, func() {
+		if err := Start(Config{Stdout: true, ServiceName: "checkout"}); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		if err := Stop(); err != nil {
+			t.Fatalf("Stop failed: %v", err)
+		}
+	})
+	if stdout != "" {
+		t.Errorf("Expected nothing on stdout, got %q", stdout)
+	}
+}
+
+func TestLoadConfigService(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flowtrace.yaml")
+	config := "service:\n  name: checkout\n  version: 1.4.2\n  environment: production\n"
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if loaded.ServiceName != "checkout" || loaded.ServiceVersion != "1.4.2" || loaded.Environment != "production" {
+		t.Errorf("Expected the service settings, got %q %q %q", loaded.ServiceName, loaded.ServiceVersion, loaded.Environment)
+	}
+}
@@ -0,0 +1,187 @@
+package flowtrace
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultMetricsMaxMethods bounds the number of functions metrics are kept
+// for when Config.MetricsMaxMethods is 0
+const DefaultMetricsMaxMethods = 1000
+
+// metricsOther is the class and method label of the series that calls of
+// functions past the MetricsMaxMethods limit are counted in
+const metricsOther = "other"
+
+// durationBuckets are the upper bounds, in seconds, of the call duration
+// histogram. Traced functions are mostly short, so the buckets start well
+// below the Prometheus defaults.
+var durationBuckets = []float64{
+	0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10,
+}
+
+// metrics aggregates the completed calls of a tracer into per-function call
+// and error counters and a duration histogram
+type metrics struct {
+	mu         sync.Mutex
+	maxMethods int
+	series     map[metricsKey]*methodMetrics
+	other      *methodMetrics // calls past maxMethods, created on demand
+}
+
+// metricsKey identifies the functions metrics are labeled by
+type metricsKey struct {
+	class  string
+	method string
+}
+
+// methodMetrics holds the metrics of one function
+type methodMetrics struct {
+	calls   uint64
+	errors  uint64
+	buckets []uint64 // cumulative counts, one per durationBuckets bound
+	sum     float64  // total duration in seconds
+}
+
+func newMetrics(maxMethods int) *metrics {
+	if maxMethods == 0 {
+		maxMethods = DefaultMetricsMaxMethods
+	}
+	return &metrics{
+		maxMethods: maxMethods,
+		series:     make(map[metricsKey]*methodMetrics),
+	}
+}
+
+// observe records event if it completes a call: an EXIT, which counts as an
+// error when the call returned one, or an EXCEPTION. EXITs logged by Close
+// for calls that never returned are left out, as their duration is not
+// that of the call.
+func (m *metrics) observe(event TraceEvent) {
+	if (event.Event != "EXIT" && event.Event != "EXCEPTION") || event.Truncated {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := metricsKey{event.Class, event.Method}
+	series := m.series[key]
+	if series == nil {
+		if len(m.series) < m.maxMethods {
+			series = &methodMetrics{buckets: make([]uint64, len(durationBuckets))}
+			m.series[key] = series
+		} else {
+			if m.other == nil {
+				m.other = &methodMetrics{buckets: make([]uint64, len(durationBuckets))}
+			}
+			series = m.other
+		}
+	}
+
+	series.calls++
+	if event.Event == "EXCEPTION" || event.IsError {
+		series.errors++
+	}
+	seconds := float64(event.DurationMicros) / 1e6
+	series.sum += seconds
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			series.buckets[i]++
+		}
+	}
+}
+
+// write renders the metrics in the Prometheus text exposition format,
+// ordered by class and method
+func (m *metrics) write(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]metricsKey, 0, len(m.series)+1)
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].class != keys[j].class {
+			return keys[i].class < keys[j].class
+		}
+		return keys[i].method < keys[j].method
+	})
+	lookup := func(key metricsKey) *methodMetrics {
+		if series := m.series[key]; series != nil {
+			return series
+		}
+		return m.other
+	}
+	if m.other != nil {
+		keys = append(keys, metricsKey{metricsOther, metricsOther})
+	}
+
+	fmt.Fprintln(w, "# HELP flowtrace_calls_total Completed calls of traced functions.")
+	fmt.Fprintln(w, "# TYPE flowtrace_calls_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "flowtrace_calls_total{%s} %d\n", key.labels(), lookup(key).calls)
+	}
+
+	fmt.Fprintln(w, "# HELP flowtrace_errors_total Calls of traced functions that returned an error or panicked.")
+	fmt.Fprintln(w, "# TYPE flowtrace_errors_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "flowtrace_errors_total{%s} %d\n", key.labels(), lookup(key).errors)
+	}
+
+	fmt.Fprintln(w, "# HELP flowtrace_call_duration_seconds Duration of calls of traced functions.")
+	fmt.Fprintln(w, "# TYPE flowtrace_call_duration_seconds histogram")
+	for _, key := range keys {
+		series, labels := lookup(key), key.labels()
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(w, "flowtrace_call_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, formatFloat(bound), series.buckets[i])
+		}
+		fmt.Fprintf(w, "flowtrace_call_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, series.calls)
+		fmt.Fprintf(w, "flowtrace_call_duration_seconds_sum{%s} %s\n", labels, formatFloat(series.sum))
+		fmt.Fprintf(w, "flowtrace_call_duration_seconds_count{%s} %d\n", labels, series.calls)
+	}
+}
+
+// labels renders the class and method labels of a series
+func (k metricsKey) labels() string {
+	return fmt.Sprintf(`class="%s",method="%s"`, escapeLabel(k.class), escapeLabel(k.method))
+}
+
+// labelEscaper escapes label values as the text exposition format requires
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// MetricsHandler returns an http.Handler serving the metrics of the global
+// tracer in the Prometheus text format, for a Prometheus server to scrape:
+//
+//	http.Handle("/metrics", flowtrace.MetricsHandler())
+//
+// Metrics are collected when Config.Metrics is set, from the calls that are
+// logged; calls left out by sampling or filters are not counted. Without a
+// tracer collecting metrics the handler serves an empty response.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		t := globalTracer.Load()
+		if t == nil || t.metrics == nil {
+			return
+		}
+		buf := bufio.NewWriter(w)
+		t.metrics.write(buf)
+		buf.Flush()
+	})
+}
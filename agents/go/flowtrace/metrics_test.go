@@ -0,0 +1,106 @@
+package flowtrace
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// scrapeMetrics returns the response of MetricsHandler
+func scrapeMetrics(t *testing.T) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Expected the Prometheus text format, got Content-Type %q", ct)
+	}
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	if err := Start(Config{Metrics: true}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer Stop()
+
+	if body := scrapeMetrics(t); strings.Contains(body, `method="Load"`) {
+		t.Fatalf("Expected no series before any call, got:\n%s", body)
+	}
+
+	Enter("main", "Load", nil).Exit(nil)
+	failed := Enter("main", "Load", nil)
+	failed.SetError(errors.New("not found"))
+	failed.Exit(nil)
+	Enter("main", "Save", nil).Exception(errors.New("boom"))
+
+	body := scrapeMetrics(t)
+	for _, want := range []string{
+		`flowtrace_calls_total{class="main",method="Load"} 2`,
+		`flowtrace_errors_total{class="main",method="Load"} 1`,
+		`flowtrace_calls_total{class="main",method="Save"} 1`,
+		`flowtrace_errors_total{class="main",method="Save"} 1`,
+		`flowtrace_call_duration_seconds_bucket{class="main",method="Load",le="10"} 2`,
+		`flowtrace_call_duration_seconds_bucket{class="main",method="Load",le="+Inf"} 2`,
+		`flowtrace_call_duration_seconds_count{class="main",method="Load"} 2`,
+		"# TYPE flowtrace_call_duration_seconds histogram",
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("Expected %s, got:\n%s", want, body)
+		}
+	}
+
+	Enter("main", "Load", nil).Exit(nil)
+	if body := scrapeMetrics(t); !strings.Contains(body, `flowtrace_calls_total{class="main",method="Load"} 3`+"\n") {
+		t.Errorf("Expected the call counter to increment, got:\n%s", body)
+	}
+}
+
+func TestMetricsMaxMethods(t *testing.T) {
+	if err := Start(Config{Metrics: true, MetricsMaxMethods: 1}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer Stop()
+
+	Enter("main", "A", nil).Exit(nil)
+	Enter("main", "B", nil).Exit(nil)
+	Enter("main", "C", nil).Exit(nil)
+	Enter("main", "A", nil).Exit(nil)
+
+	body := scrapeMetrics(t)
+	for _, want := range []string{
+		`flowtrace_calls_total{class="main",method="A"} 2`,
+		`flowtrace_calls_total{class="other",method="other"} 2`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("Expected %s, got:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, `method="B"`) || strings.Contains(body, `method="C"`) {
+		t.Errorf("Expected functions past the limit to have no series of their own, got:\n%s", body)
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	if err := Start(Config{}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer Stop()
+
+	Enter("main", "Load", nil).Exit(nil)
+	if body := scrapeMetrics(t); body != "" {
+		t.Errorf("Expected no metrics without Config.Metrics, got:\n%s", body)
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if got := escapeLabel("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Errorf("escapeLabel = %s", got)
+	}
+}
@@ -3,53 +3,121 @@ package flowtrace
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/httpwriter"
+)
+
+// HTTPConfig holds configuration for HTTPMiddlewareWithConfig
+type HTTPConfig struct {
+	// RoutePattern returns the route template matched by a request, such as
+	// "/users/{id}", which is logged instead of the raw path to keep the
+	// number of distinct function names low. An empty result falls back to
+	// the raw path.
+	RoutePattern func(*http.Request) string
+
+	// RecoverMode tells what happens to a panic of the handler once it is
+	// logged; the default RecoverRethrow panics again
+	RecoverMode RecoverMode
+}
+
+// RecoverMode tells a middleware what to do with a panic of the handler
+// after logging the EXCEPTION event
+type RecoverMode string
+
+const (
+	// RecoverRethrow panics again, leaving the panic to the framework's own
+	// recovery, or to net/http, which aborts the connection. The zero
+	// RecoverMode behaves the same.
+	RecoverRethrow RecoverMode = "rethrow"
+	// RecoverRespond500 swallows the panic and responds with 500 Internal
+	// Server Error, unless the response was already started, in which case
+	// it is ended as it is
+	RecoverRespond500 RecoverMode = "respond500"
 )
 
-// HTTPMiddleware creates middleware for tracing HTTP handlers
+// Rethrow reports whether a middleware in mode m panics again with the
+// recovered value rec. http.ErrAbortHandler, which handlers panic with to
+// abort a response on purpose, always is.
+func (m RecoverMode) Rethrow(rec interface{}) bool {
+	return m != RecoverRespond500 || rec == http.ErrAbortHandler
+}
+
+// HTTPMiddleware creates middleware for tracing HTTP handlers. Requests are
+// named by their raw path; use HTTPMiddlewareWithConfig with a RoutePattern
+// to group them by route.
 func HTTPMiddleware(next http.Handler) http.Handler {
+	return HTTPMiddlewareWithConfig(HTTPConfig{})(next)
+}
+
+// HTTPMiddlewareWithConfig creates HTTP tracing middleware with custom configuration
+func HTTPMiddlewareWithConfig(config HTTPConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return httpHandler(config, next)
+	}
+}
+
+// ServeMuxPattern returns a RoutePattern that looks up the pattern mux
+// routes a request to, with any method or host prefix removed
+func ServeMuxPattern(mux *http.ServeMux) func(*http.Request) string {
+	return func(r *http.Request) string {
+		_, pattern := mux.Handler(r)
+		if i := strings.IndexByte(pattern, ' '); i >= 0 {
+			pattern = strings.TrimLeft(pattern[i+1:], " \t")
+		}
+		if i := strings.IndexByte(pattern, '/'); i > 0 {
+			pattern = pattern[i:]
+		}
+		return pattern
+	}
+}
+
+// httpHandler wraps next with request tracing
+func httpHandler(config HTTPConfig, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
-		// Log request entry
-		TraceEnter("http", r.URL.Path, map[string]interface{}{
+		name := r.URL.Path
+		if config.RoutePattern != nil {
+			if pattern := config.RoutePattern(r); pattern != "" {
+				name = pattern
+			}
+		}
+
+		// Log request entry, continuing the caller's trace if it sent one
+		parent := IncomingTraceParent(r.Header.Get(TraceParentHeader))
+		ctx := EnterWithParent(parent, "http", name, map[string]interface{}{
 			"method": r.Method,
 			"url":    r.URL.String(),
 			"remote": r.RemoteAddr,
 		})
 
 		// Create response writer wrapper to capture status code
-		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		wrapped := httpwriter.New(w)
 
 		// Call next handler
 		defer func() {
 			if rec := recover(); rec != nil {
-				TraceException("http", r.URL.Path, fmt.Errorf("panic: %v", rec))
-				panic(rec)
+				ctx.Exception(fmt.Errorf("panic: %v", rec))
+				if config.RecoverMode.Rethrow(rec) {
+					panic(rec)
+				}
+				wrapped.Respond500()
 			}
 		}()
 
 		next.ServeHTTP(wrapped, r)
 
 		// Log request exit
-		TraceExit("http", r.URL.Path, map[string]interface{}{
-			"status":   wrapped.statusCode,
+		ctx.ExitWithValues(map[string]interface{}{
+			"status":   wrapped.Status(),
+			"size":     wrapped.Written(),
 			"duration": time.Since(start).Milliseconds(),
 		})
 	})
 }
 
-// responseWriter wraps http.ResponseWriter to capture status code
-type responseWriter struct {
-	http.ResponseWriter
-	statusCode int
-}
-
-func (rw *responseWriter) WriteHeader(code int) {
-	rw.statusCode = code
-	rw.ResponseWriter.WriteHeader(code)
-}
-
 // GinMiddleware creates middleware for Gin framework
 func GinMiddleware() interface{} {
 	// Placeholder for Gin middleware
@@ -0,0 +1,287 @@
+package flowtrace
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHTTPMiddlewareStreamingFlush(t *testing.T) {
+	release := make(chan struct{})
+	handler := HTTPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			t.Error("Expected wrapped writer to implement http.Flusher")
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: first\n\n")
+		flusher.Flush()
+
+		// The client must see the first event before the handler returns
+		<-release
+		fmt.Fprint(w, "data: second\n\n")
+	}))
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read flushed event: %v", err)
+	}
+	if line != "data: first\n" {
+		t.Errorf("Expected first event, got %q", line)
+	}
+
+	close(release)
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to read rest of stream: %v", err)
+	}
+	if !strings.Contains(string(rest), "data: second") {
+		t.Errorf("Expected second event, got %q", rest)
+	}
+}
+
+func TestHTTPMiddlewareHijack(t *testing.T) {
+	handler := HTTPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack failed: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+
+		msg, err := buf.ReadString('\n')
+		if err != nil {
+			return
+		}
+		buf.WriteString(msg)
+		buf.Flush()
+	}))
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: test\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read upgrade response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status 101, got %d", resp.StatusCode)
+	}
+
+	fmt.Fprint(conn, "ping\n")
+	echo, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read echo: %v", err)
+	}
+	if echo != "ping\n" {
+		t.Errorf("Expected echo %q, got %q", "ping\n", echo)
+	}
+}
+
+func TestHTTPMiddlewareRecordsSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	handler := HTTPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+		w.Write([]byte(" world"))
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/users", nil))
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	events := readTrace(t, path)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	result := string(events[1].Result)
+	for _, want := range []string{`"status":201`, `"size":11`} {
+		if !strings.Contains(result, want) {
+			t.Errorf("Expected result to contain %q, got %q", want, result)
+		}
+	}
+}
+
+func TestHTTPMiddlewareRoutePattern(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name   string
+		config HTTPConfig
+		want   string
+	}{
+		{name: "raw path by default", config: HTTPConfig{}, want: "/users/123"},
+		{
+			name:   "custom extractor",
+			config: HTTPConfig{RoutePattern: func(r *http.Request) string { return "/users/{id}" }},
+			want:   "/users/{id}",
+		},
+		{
+			name:   "empty pattern falls back to raw path",
+			config: HTTPConfig{RoutePattern: func(r *http.Request) string { return "" }},
+			want:   "/users/123",
+		},
+		{name: "ServeMux pattern", config: HTTPConfig{RoutePattern: ServeMuxPattern(mux)}, want: "/users/{id}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "trace.jsonl")
+			if err := Start(Config{LogFile: path}); err != nil {
+				t.Fatalf("Start failed: %v", err)
+			}
+
+			handler := HTTPMiddlewareWithConfig(tt.config)(mux)
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/123", nil))
+
+			if err := Stop(); err != nil {
+				t.Fatalf("Stop failed: %v", err)
+			}
+
+			events := readTrace(t, path)
+			if len(events) != 2 {
+				t.Fatalf("Expected 2 events, got %d", len(events))
+			}
+			for _, event := range events {
+				if event.Method != tt.want {
+					t.Errorf("Expected %s to be recorded as %s, got %s", event.Event, tt.want, event.Method)
+				}
+			}
+		})
+	}
+}
+
+func TestServeMuxPattern(t *testing.T) {
+	mux := http.NewServeMux()
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+	mux.HandleFunc("GET /users/{id}", noop)
+	mux.HandleFunc("example.com/static/", noop)
+	mux.HandleFunc("/health", noop)
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "http://example.com/users/42", want: "/users/{id}"},
+		{url: "http://example.com/static/app.js", want: "/static/"},
+		{url: "http://example.com/health", want: "/health"},
+		{url: "http://example.com/missing", want: ""},
+	}
+
+	pattern := ServeMuxPattern(mux)
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			if got := pattern(httptest.NewRequest("GET", tt.url, nil)); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHTTPMiddlewareRecoverMode(t *testing.T) {
+	tests := []struct {
+		mode       RecoverMode
+		wantStatus int // 0 when the connection is aborted
+	}{
+		{mode: "", wantStatus: 0},
+		{mode: RecoverRethrow, wantStatus: 0},
+		{mode: RecoverRespond500, wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "trace.jsonl")
+			if err := Start(Config{LogFile: path}); err != nil {
+				t.Fatalf("Start failed: %v", err)
+			}
+
+			handler := HTTPMiddlewareWithConfig(HTTPConfig{RecoverMode: tt.mode})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				panic("nil map")
+			}))
+			server := httptest.NewUnstartedServer(handler)
+			server.Config.ErrorLog = log.New(io.Discard, "", 0)
+			server.Start()
+			defer server.Close()
+
+			resp, err := http.Get(server.URL)
+			switch {
+			case tt.wantStatus == 0 && err == nil:
+				resp.Body.Close()
+				t.Errorf("Expected the connection to be aborted, got status %d", resp.StatusCode)
+			case tt.wantStatus != 0 && err != nil:
+				t.Errorf("Expected status %d, got %v", tt.wantStatus, err)
+			case tt.wantStatus != 0:
+				resp.Body.Close()
+				if resp.StatusCode != tt.wantStatus {
+					t.Errorf("Expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+				}
+			}
+
+			if err := Stop(); err != nil {
+				t.Fatalf("Stop failed: %v", err)
+			}
+			events := readTrace(t, path)
+			if len(events) != 2 || events[1].Event != "EXCEPTION" || !strings.Contains(events[1].Exception, "nil map") {
+				t.Errorf("Expected ENTER and an EXCEPTION for the panic, got %+v", events)
+			}
+		})
+	}
+}
+
+func TestHTTPMiddlewareRespond500AfterWrite(t *testing.T) {
+	handler := HTTPMiddlewareWithConfig(HTTPConfig{RecoverMode: RecoverRespond500})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("partial"))
+		panic("late")
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusAccepted || rec.Body.String() != "partial" {
+		t.Errorf("Expected the started response to be left as it is, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRecoverModeRethrowsAbortHandler(t *testing.T) {
+	if !RecoverRespond500.Rethrow(http.ErrAbortHandler) {
+		t.Error("Expected http.ErrAbortHandler to be rethrown in respond500 mode")
+	}
+	if RecoverRespond500.Rethrow("boom") || !RecoverRethrow.Rethrow("boom") || !RecoverMode("").Rethrow("boom") {
+		t.Error("Expected only respond500 to swallow panics")
+	}
+}
@@ -0,0 +1,214 @@
+package flowtrace
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// otlpExporter converts ENTER/EXIT event pairs into OpenTelemetry spans.
+// Spans are matched by the events' span IDs and nested under the span
+// of their parent call, so the call tree is preserved in the collector.
+type otlpExporter struct {
+	provider *sdktrace.TracerProvider
+	tracer   oteltrace.Tracer
+	open     map[string]oteltrace.Span // FlowTrace span ID -> started OTel span
+	nanos    bool                      // event timestamps are in nanoseconds
+}
+
+// newOTLPExporter creates an exporter shipping spans to an OTLP/gRPC endpoint.
+// A bare "host:port" endpoint uses an insecure connection, as is typical for
+// a local collector; pass a full URL ("https://...") to control the scheme.
+func newOTLPExporter(endpoint string, config Config) (*otlpExporter, error) {
+	var opts []otlptracegrpc.Option
+	if strings.Contains(endpoint, "://") {
+		opts = append(opts, otlptracegrpc.WithEndpointURL(endpoint))
+	} else {
+		opts = append(opts, otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+	}
+
+	exporter, err := otlptracegrpc.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := newOTLPProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(serviceAttributes(config)...)),
+	)
+
+	return newOTLPExporterWithProvider(provider), nil
+}
+
+// serviceAttributes describes the traced service to the collector, as
+// "flowtrace" when Config.ServiceName is unset
+func serviceAttributes(config Config) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{semconv.ServiceName(cmp.Or(config.ServiceName, "flowtrace"))}
+	if config.ServiceVersion != "" {
+		attrs = append(attrs, semconv.ServiceVersion(config.ServiceVersion))
+	}
+	if config.Environment != "" {
+		attrs = append(attrs, semconv.DeploymentEnvironment(config.Environment))
+	}
+	return attrs
+}
+
+// newOTLPProvider creates a provider with opts whose spans get the IDs of
+// the FlowTrace events they are exported from
+func newOTLPProvider(opts ...sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(append(opts, sdktrace.WithIDGenerator(eventIDGenerator{}))...)
+}
+
+// newOTLPExporterWithProvider creates an exporter on top of an existing provider
+func newOTLPExporterWithProvider(provider *sdktrace.TracerProvider) *otlpExporter {
+	return &otlpExporter{
+		provider: provider,
+		tracer:   provider.Tracer("github.com/rixmerz/flowtrace-agent-go/flowtrace"),
+		open:     make(map[string]oteltrace.Span),
+	}
+}
+
+// export starts a span on ENTER and ends it on the matching EXIT/EXCEPTION.
+// Callers must serialize calls (the tracer holds its mutex).
+func (e *otlpExporter) export(event TraceEvent) {
+	if event.SpanID == "" {
+		return
+	}
+
+	switch event.Event {
+	case "ENTER":
+		ctx := context.Background()
+		if parent, ok := e.open[event.ParentSpanID]; ok {
+			ctx = oteltrace.ContextWithSpan(ctx, parent)
+		} else if remote, ok := remoteSpanContext(event); ok {
+			// Root of a trace continued from an incoming traceparent
+			ctx = oteltrace.ContextWithRemoteSpanContext(ctx, remote)
+		}
+
+		ctx = context.WithValue(ctx, eventIDsKey{}, event)
+
+		_, span := e.tracer.Start(ctx, event.Class+"."+event.Method,
+			oteltrace.WithTimestamp(e.eventTime(event)),
+			oteltrace.WithAttributes(
+				attribute.String("code.namespace", event.Class),
+				attribute.String("code.function", event.Method),
+				attribute.String("flowtrace.thread", event.Thread),
+				attribute.String("flowtrace.args", attributeText(event.Args)),
+			),
+		)
+		e.open[event.SpanID] = span
+
+	case "EXIT", "EXCEPTION":
+		span, ok := e.open[event.SpanID]
+		if !ok {
+			return
+		}
+		delete(e.open, event.SpanID)
+
+		if len(event.Result) > 0 {
+			span.SetAttributes(attribute.String("flowtrace.result", attributeText(event.Result)))
+		}
+		if len(event.Tags) > 0 {
+			span.SetAttributes(attribute.String("flowtrace.tags", attributeText(event.Tags)))
+		}
+		if event.Stack != "" {
+			span.SetAttributes(attribute.String("exception.stacktrace", event.Stack))
+		}
+		if event.Event == "EXCEPTION" || event.IsError {
+			span.SetStatus(codes.Error, event.Exception)
+		}
+		span.End(oteltrace.WithTimestamp(e.eventTime(event)))
+	}
+}
+
+// eventTime returns the time of an event from its timestamp
+func (e *otlpExporter) eventTime(event TraceEvent) time.Time {
+	if e.nanos {
+		return time.Unix(0, event.Timestamp)
+	}
+	return time.UnixMicro(event.Timestamp)
+}
+
+// attributeText returns a JSON event value as attribute text, unquoting
+// plain strings
+func attributeText(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
+
+// remoteSpanContext builds the span context of a remote parent from the
+// trace and parent span IDs of an ENTER event
+func remoteSpanContext(event TraceEvent) (oteltrace.SpanContext, bool) {
+	if event.TraceID == "" || event.ParentSpanID == "" {
+		return oteltrace.SpanContext{}, false
+	}
+	traceID, err := oteltrace.TraceIDFromHex(event.TraceID)
+	if err != nil {
+		return oteltrace.SpanContext{}, false
+	}
+	spanID, err := oteltrace.SpanIDFromHex(event.ParentSpanID)
+	if err != nil {
+		return oteltrace.SpanContext{}, false
+	}
+	sc := oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: oteltrace.FlagsSampled,
+		Remote:     true,
+	})
+	return sc, sc.IsValid()
+}
+
+// eventIDsKey is the context key of the ENTER event a span is started for
+type eventIDsKey struct{}
+
+// eventIDGenerator gives each span the trace and span IDs of the ENTER event
+// in its start context, so the collector shows the IDs that are logged and
+// propagated by InjectTraceparent. IDs that are missing or malformed are
+// generated as FlowTrace generates them.
+type eventIDGenerator struct{}
+
+func (eventIDGenerator) NewIDs(ctx context.Context) (oteltrace.TraceID, oteltrace.SpanID) {
+	event, _ := ctx.Value(eventIDsKey{}).(TraceEvent)
+	traceID, err := oteltrace.TraceIDFromHex(event.TraceID)
+	if err != nil {
+		traceID, _ = oteltrace.TraceIDFromHex(newTraceID())
+	}
+	return traceID, eventSpanID(event)
+}
+
+func (eventIDGenerator) NewSpanID(ctx context.Context, _ oteltrace.TraceID) oteltrace.SpanID {
+	event, _ := ctx.Value(eventIDsKey{}).(TraceEvent)
+	return eventSpanID(event)
+}
+
+// eventSpanID returns the span ID of event, or a new one if it has none
+func eventSpanID(event TraceEvent) oteltrace.SpanID {
+	spanID, err := oteltrace.SpanIDFromHex(event.SpanID)
+	if err != nil {
+		spanID, _ = oteltrace.SpanIDFromHex(newSpanID())
+	}
+	return spanID
+}
+
+// shutdown ends spans that never exited and flushes pending spans
+func (e *otlpExporter) shutdown() error {
+	for id, span := range e.open {
+		span.End()
+		delete(e.open, id)
+	}
+	return e.provider.Shutdown(context.Background())
+}
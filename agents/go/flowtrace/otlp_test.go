@@ -0,0 +1,198 @@
+package flowtrace
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestOTLPExporterPreservesParentChild(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := newOTLPProvider(sdktrace.WithSpanProcessor(recorder))
+
+	tracer, err := NewTracer(Config{})
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	tracer.otlp = newOTLPExporterWithProvider(provider)
+
+	tracer.enter(1, "main", "HandleRequest", map[string]interface{}{"path": "/users/42"}, TraceParent{}, sourceLocation{})
+	tracer.enter(1, "main", "LoadUser", map[string]interface{}{"userID": 42}, TraceParent{}, sourceLocation{})
+	tracer.exit(1, "main", "LoadUser", "alice", nil)
+	tracer.enter(1, "main", "Render", nil, TraceParent{}, sourceLocation{})
+	tracer.exception(1, "main", "Render", errors.New("template missing"))
+	tracer.exit(1, "main", "HandleRequest", nil, nil)
+
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("Expected 3 spans, got %d", len(spans))
+	}
+
+	byName := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range spans {
+		byName[span.Name()] = span
+	}
+
+	root, ok := byName["main.HandleRequest"]
+	if !ok {
+		t.Fatal("Missing span main.HandleRequest")
+	}
+	if root.Parent().IsValid() {
+		t.Error("Expected main.HandleRequest to be a root span")
+	}
+
+	for _, name := range []string{"main.LoadUser", "main.Render"} {
+		child, ok := byName[name]
+		if !ok {
+			t.Fatalf("Missing span %s", name)
+		}
+		if child.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("Expected %s to be a child of main.HandleRequest", name)
+		}
+		if child.SpanContext().TraceID() != root.SpanContext().TraceID() {
+			t.Errorf("Expected %s to share the root trace ID", name)
+		}
+	}
+
+	if byName["main.Render"].Status().Code != codes.Error {
+		t.Error("Expected exception span to have error status")
+	}
+
+	attrs := make(map[string]string)
+	for _, kv := range byName["main.LoadUser"].Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["flowtrace.result"] != "alice" {
+		t.Errorf("Expected result attribute 'alice', got %q", attrs["flowtrace.result"])
+	}
+	if attrs["code.function"] != "LoadUser" {
+		t.Errorf("Expected code.function 'LoadUser', got %q", attrs["code.function"])
+	}
+}
+
+func TestOTLPExporterContinuesRemoteTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := newOTLPProvider(sdktrace.WithSpanProcessor(recorder))
+
+	tracer, err := NewTracer(Config{})
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	tracer.otlp = newOTLPExporterWithProvider(provider)
+
+	remote := TraceParent{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", ParentID: "00f067aa0ba902b7", Flags: 0x01}
+	tracer.enter(1, "http", "/users/42", nil, remote, sourceLocation{})
+	tracer.exit(1, "http", "/users/42", nil, nil)
+
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+	if got := spans[0].SpanContext().TraceID().String(); got != remote.TraceID {
+		t.Errorf("Expected trace ID %s, got %s", remote.TraceID, got)
+	}
+	if got := spans[0].Parent().SpanID().String(); got != remote.ParentID {
+		t.Errorf("Expected remote parent %s, got %s", remote.ParentID, got)
+	}
+}
+
+func TestOTLPExporterUsesEventIDs(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := newOTLPProvider(sdktrace.WithSpanProcessor(recorder))
+
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	tracer, err := NewTracer(Config{LogFile: path})
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	tracer.otlp = newOTLPExporterWithProvider(provider)
+
+	remote := TraceParent{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", ParentID: "00f067aa0ba902b7", Flags: 0x01}
+	tracer.enter(1, "main", "HandleRequest", nil, TraceParent{}, sourceLocation{})
+	tracer.enter(1, "main", "LoadUser", nil, TraceParent{}, sourceLocation{})
+	tracer.exit(1, "main", "LoadUser", nil, nil)
+	tracer.exit(1, "main", "HandleRequest", nil, nil)
+	tracer.enter(2, "http", "/users/42", nil, remote, sourceLocation{})
+	tracer.exit(2, "http", "/users/42", nil, nil)
+
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	exported := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		exported[span.Name()] = span
+	}
+	for _, event := range readTrace(t, path) {
+		if event.Event != "ENTER" {
+			continue
+		}
+		span, ok := exported[event.Class+"."+event.Method]
+		if !ok {
+			t.Fatalf("Missing span %s.%s", event.Class, event.Method)
+		}
+		if got := span.SpanContext().SpanID().String(); got != event.SpanID {
+			t.Errorf("Expected %s to be exported with span ID %s, got %s", event.Method, event.SpanID, got)
+		}
+		if got := span.SpanContext().TraceID().String(); got != event.TraceID {
+			t.Errorf("Expected %s to be exported with trace ID %s, got %s", event.Method, event.TraceID, got)
+		}
+	}
+}
+
+// failingExporter drops spans and fails to shut down
+type failingExporter struct{}
+
+func (failingExporter) ExportSpans(context.Context, []sdktrace.ReadOnlySpan) error { return nil }
+
+func (failingExporter) Shutdown(context.Context) error { return errors.New("collector unreachable") }
+
+func TestCloseAfterOTLPShutdownFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl.gz")
+	tracer, err := NewTracer(Config{LogFile: path})
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	tracer.otlp = newOTLPExporterWithProvider(newOTLPProvider(sdktrace.WithSyncer(failingExporter{})))
+
+	tracer.enter(1, "main", "Checkout", nil, TraceParent{}, sourceLocation{})
+	tracer.exit(1, "main", "Checkout", nil, nil)
+
+	if err := tracer.Close(); err == nil || !strings.Contains(err.Error(), "collector unreachable") {
+		t.Errorf("Expected Close to report the OTLP failure, got %v", err)
+	}
+	if tracer.logFile != nil || tracer.gzipWriter != nil {
+		t.Error("Expected the log file to be closed")
+	}
+
+	// The gzip footer was written
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open trace file: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Trace file is not gzip-compressed: %v", err)
+	}
+	if data, err := io.ReadAll(gz); err != nil || !strings.Contains(string(data), `"method":"Checkout"`) {
+		t.Errorf("Expected a complete trace file, got %q, %v", data, err)
+	}
+}
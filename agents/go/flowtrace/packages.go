@@ -0,0 +1,84 @@
+package flowtrace
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/filter"
+)
+
+// packageFilter applies PackagePrefix, Include and Exclude to traced calls
+type packageFilter struct {
+	prefix string
+	filter *filter.Filter
+}
+
+// newPackageFilter returns the runtime filter of config, or nil when it
+// does not restrict any package
+func newPackageFilter(config Config) *packageFilter {
+	if config.PackagePrefix == "" && len(config.Include) == 0 && len(config.Exclude) == 0 {
+		return nil
+	}
+	return &packageFilter{
+		prefix: config.PackagePrefix,
+		filter: filter.NewFilter(config.Include, config.Exclude),
+	}
+}
+
+// allows reports whether calls in packageName are traced. A nil filter
+// allows every package.
+func (f *packageFilter) allows(packageName string) bool {
+	if f == nil {
+		return true
+	}
+	if !strings.HasPrefix(packageName, f.prefix) {
+		return false
+	}
+	return f.filter.ShouldInstrumentPackage(packageName)
+}
+
+// functionFilter applies IncludeFunctions and ExcludeFunctions to traced
+// calls, by their "package.Function" name
+type functionFilter struct {
+	include []*filter.Pattern
+	exclude []*filter.Pattern
+}
+
+// newFunctionFilter returns the function filter of config, or nil when it
+// does not restrict any function
+func newFunctionFilter(config Config) (*functionFilter, error) {
+	if len(config.IncludeFunctions) == 0 && len(config.ExcludeFunctions) == 0 {
+		return nil, nil
+	}
+	include, err := filter.CompilePatterns(config.IncludeFunctions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include_functions pattern: %w", err)
+	}
+	exclude, err := filter.CompilePatterns(config.ExcludeFunctions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exclude_functions pattern: %w", err)
+	}
+	return &functionFilter{include: include, exclude: exclude}, nil
+}
+
+// allows reports whether calls of funcName in packageName are traced. A
+// nil filter allows every function.
+func (f *functionFilter) allows(packageName, funcName string) bool {
+	if f == nil {
+		return true
+	}
+	name := qualifiedName(packageName, funcName)
+	if len(f.include) > 0 && !filter.MatchAny(name, f.include) {
+		return false
+	}
+	return !filter.MatchAny(name, f.exclude)
+}
+
+// qualifiedName returns the "package.Function" name patterns of functions
+// are matched against
+func qualifiedName(packageName, funcName string) string {
+	if packageName == "" {
+		return funcName
+	}
+	return packageName + "." + funcName
+}
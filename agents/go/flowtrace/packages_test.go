@@ -0,0 +1,166 @@
+package flowtrace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPackageFilterAllows(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		pkg      string
+		expected bool
+	}{
+		{name: "no filters", config: Config{}, pkg: "github.com/acme/api", expected: true},
+		{name: "prefix match", config: Config{PackagePrefix: "github.com/acme/"}, pkg: "github.com/acme/api", expected: true},
+		{name: "prefix mismatch", config: Config{PackagePrefix: "github.com/acme/"}, pkg: "github.com/other/api", expected: false},
+		{name: "include match", config: Config{Include: []string{"github.com/acme/**"}}, pkg: "github.com/acme/db", expected: true},
+		{name: "include mismatch", config: Config{Include: []string{"github.com/acme/**"}}, pkg: "main", expected: false},
+		{name: "exclude match", config: Config{Exclude: []string{"github.com/acme/db/**"}}, pkg: "github.com/acme/db/pool", expected: false},
+		{name: "exclude mismatch", config: Config{Exclude: []string{"github.com/acme/db/**"}}, pkg: "github.com/acme/api", expected: true},
+		{
+			name:     "exclude takes precedence over include",
+			config:   Config{Include: []string{"github.com/acme/**"}, Exclude: []string{"github.com/acme/db/**"}},
+			pkg:      "github.com/acme/db/pool",
+			expected: false,
+		},
+		{
+			name:     "prefix and include must both match",
+			config:   Config{PackagePrefix: "github.com/acme/", Include: []string{"main"}},
+			pkg:      "main",
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newPackageFilter(tt.config).allows(tt.pkg); got != tt.expected {
+				t.Errorf("Expected allows(%q) = %v, got %v", tt.pkg, tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestTracerDropsFilteredPackages(t *testing.T) {
+	tracer, err := NewTracer(Config{Exclude: []string{"github.com/acme/db/**"}})
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	defer tracer.Close()
+
+	var buf bytes.Buffer
+	tracer.writer = &buf
+
+	tracer.enter(1, "github.com/acme/api", "Handle", nil, TraceParent{}, sourceLocation{})
+	tracer.enter(1, "github.com/acme/db/pool", "Acquire", nil, TraceParent{}, sourceLocation{})
+	tracer.enter(1, "github.com/acme/api", "render", nil, TraceParent{}, sourceLocation{})
+	tracer.exit(1, "github.com/acme/api", "render", nil, nil)
+	tracer.exit(1, "github.com/acme/db/pool", "Acquire", nil, nil)
+	tracer.exit(1, "github.com/acme/api", "Handle", nil, nil)
+
+	var methods []string
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var event TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Invalid JSON line: %v", err)
+		}
+		methods = append(methods, event.Event+" "+event.Method)
+	}
+
+	expected := []string{"ENTER Handle", "ENTER render", "EXIT render", "EXIT Handle"}
+	if len(methods) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, methods)
+	}
+	for i := range expected {
+		if methods[i] != expected[i] {
+			t.Errorf("Event %d: expected %s, got %s", i, expected[i], methods[i])
+		}
+	}
+}
+
+func TestFunctionFilterAllows(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		pkg, fn  string
+		expected bool
+	}{
+		{name: "no filters", config: Config{}, pkg: "main", fn: "sleep", expected: true},
+		{name: "excluded", config: Config{ExcludeFunctions: []string{"main.sleep"}}, pkg: "main", fn: "sleep", expected: false},
+		{name: "sibling of excluded", config: Config{ExcludeFunctions: []string{"main.sleep"}}, pkg: "main", fn: "work", expected: true},
+		{name: "excluded by glob", config: Config{ExcludeFunctions: []string{"github.com/acme/db.*"}}, pkg: "github.com/acme/db", fn: "Ping", expected: false},
+		{name: "included", config: Config{IncludeFunctions: []string{"main.Handle*"}}, pkg: "main", fn: "HandleOrder", expected: true},
+		{name: "not included", config: Config{IncludeFunctions: []string{"main.Handle*"}}, pkg: "main", fn: "render", expected: false},
+		{
+			name:     "exclude applies to included functions",
+			config:   Config{IncludeFunctions: []string{"main.*"}, ExcludeFunctions: []string{"main.sleep"}},
+			pkg:      "main",
+			fn:       "sleep",
+			expected: false,
+		},
+		{
+			name:     "negated exclude",
+			config:   Config{ExcludeFunctions: []string{"main.*", "!main.work"}},
+			pkg:      "main",
+			fn:       "work",
+			expected: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newFunctionFilter(tt.config)
+			if err != nil {
+				t.Fatalf("newFunctionFilter failed: %v", err)
+			}
+			if got := f.allows(tt.pkg, tt.fn); got != tt.expected {
+				t.Errorf("Expected allows(%q, %q) = %v, got %v", tt.pkg, tt.fn, tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestTracerMutesExcludedFunctions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path, ExcludeFunctions: []string{"main.sleep"}}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	run := Enter("main", "run", nil)
+	for i := 0; i < 3; i++ {
+		sleep := Enter("main", "sleep", map[string]interface{}{"ms": 10})
+		Enter("main", "tick", nil).Exit(nil)
+		sleep.Exit(nil)
+	}
+	Enter("main", "work", nil).Exit(nil)
+	run.Exit(nil)
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	var methods []string
+	events := readTrace(t, path)
+	for _, event := range events {
+		methods = append(methods, event.Event+" "+event.Method)
+		if event.Method == "tick" && event.Event == "ENTER" && event.ParentSpanID != events[0].SpanID {
+			t.Errorf("Expected calls made by a muted function to be children of its caller, got %+v", event)
+		}
+	}
+	expected := []string{
+		"ENTER run",
+		"ENTER tick", "EXIT tick",
+		"ENTER tick", "EXIT tick",
+		"ENTER tick", "EXIT tick",
+		"ENTER work", "EXIT work",
+		"EXIT run",
+	}
+	if strings.Join(methods, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("Expected %v, got %v", expected, methods)
+	}
+}
@@ -0,0 +1,176 @@
+package flowtrace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Stdout formats
+const (
+	// StdoutJSON writes one JSON event per line to stdout (the default)
+	StdoutJSON = "json"
+	// StdoutPretty writes one human-readable line per event to stdout,
+	// indented by call depth
+	StdoutPretty = "pretty"
+)
+
+// ANSI escape sequences used by the pretty format
+const (
+	colorReset = "\x1b[0m"
+	colorDim   = "\x1b[2m"
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorCyan  = "\x1b[36m"
+)
+
+// validStdoutFormat reports whether format names a stdout format; empty
+// means the default
+func validStdoutFormat(format string) bool {
+	switch format {
+	case "", StdoutJSON, StdoutPretty:
+		return true
+	}
+	return false
+}
+
+// newStdoutWriter returns the writer for a stdout format
+func newStdoutWriter(format string) (eventWriter, error) {
+	switch format {
+	case "", StdoutJSON:
+		return jsonlWriter{}, nil
+	case StdoutPretty:
+		return newPrettyWriter(isTerminal(os.Stdout)), nil
+	}
+	return nil, fmt.Errorf("unknown stdout format %q", format)
+}
+
+// isTerminal reports whether f is a character device such as a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// prettyWriter renders events as indented lines:
+//
+//	→ main.LoadUser(userID=42)
+//	  → db.Query(sql="SELECT ...")
+//	  ← db.Query = [...] (3ms)
+//	← main.LoadUser = {...} (52ms)
+type prettyWriter struct {
+	color bool
+	depth map[string]int // goroutine -> number of open calls
+}
+
+func newPrettyWriter(color bool) *prettyWriter {
+	return &prettyWriter{color: color, depth: make(map[string]int)}
+}
+
+func (p *prettyWriter) write(w io.Writer, event TraceEvent, data []byte) error {
+	name := event.Method
+	if event.Class != "" {
+		name = event.Class + "." + event.Method
+	}
+
+	var line string
+	switch event.Event {
+	case "ENTER":
+		line = p.indent(event.Thread) + p.paint(colorCyan, "→ "+name) + "(" + formatPrettyArgs(event.Args) + ")"
+		p.depth[event.Thread]++
+	case "EXIT":
+		p.leave(event.Thread)
+		line = p.indent(event.Thread) + p.paint(colorGreen, "← "+name)
+		if len(event.Result) > 0 {
+			line += " = " + string(event.Result)
+		}
+		if event.IsError {
+			line += " " + p.paint(colorRed, "error: "+event.Exception)
+		}
+		if event.Truncated {
+			line += " " + p.paint(colorRed, "truncated")
+		}
+		line += " " + p.paint(colorDim, "("+formatPrettyDuration(event.DurationMicros)+")")
+	case "EXCEPTION":
+		p.leave(event.Thread)
+		line = p.indent(event.Thread) + p.paint(colorRed, "✗ "+name+" panic: "+event.Exception) +
+			" " + p.paint(colorDim, "("+formatPrettyDuration(event.DurationMicros)+")")
+	case "GO_SPAWN":
+		line = p.indent(event.ParentThread) + p.paint(colorDim, "⇢ go "+event.Thread)
+	case "CAPTURE":
+		line = p.indent(event.Thread) + p.paint(colorDim, "• "+formatPrettyArgs(event.Args))
+	case "LOG":
+		line = p.indent(event.Thread) + p.paint(colorRed, "! "+formatPrettyArgs(event.Args))
+	case "CHANNEL":
+		line = p.indent(event.Thread) + p.paint(colorDim, "⇄ "+formatPrettyArgs(event.Args)+
+			" ("+formatPrettyDuration(event.DurationMicros)+")")
+	default:
+		line = string(data)
+	}
+
+	_, err := io.WriteString(w, line+"\n")
+	return err
+}
+
+func (p *prettyWriter) finish(w io.Writer) error {
+	return nil
+}
+
+// leave closes a call of goroutine thread
+func (p *prettyWriter) leave(thread string) {
+	if p.depth[thread] <= 1 {
+		delete(p.depth, thread)
+		return
+	}
+	p.depth[thread]--
+}
+
+func (p *prettyWriter) indent(thread string) string {
+	return strings.Repeat("  ", p.depth[thread])
+}
+
+// paint wraps s in color when coloring is enabled
+func (p *prettyWriter) paint(color, s string) string {
+	if !p.color {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// formatPrettyArgs renders a JSON args object as name=value pairs sorted by
+// name; args that are not an object, e.g. with LegacyArgFormat, are shown
+// as they are
+func formatPrettyArgs(args json.RawMessage) string {
+	if len(args) == 0 {
+		return ""
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(args, &fields); err != nil {
+		var text string
+		if json.Unmarshal(args, &text) == nil {
+			return text
+		}
+		return string(args)
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + string(fields[name])
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// formatPrettyDuration renders a duration in microseconds, e.g. "52ms"
+func formatPrettyDuration(micros int64) string {
+	return (time.Duration(micros) * time.Microsecond).String()
+}
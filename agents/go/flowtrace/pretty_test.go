@@ -0,0 +1,127 @@
+package flowtrace
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// captureStdout returns what fn writes to os.Stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		output <- buf.String()
+	}()
+
+	fn()
+	w.Close()
+	return <-output
+}
+
+func TestStdoutPretty(t *testing.T) {
+	output := captureStdout(t, func() {
+		if err := Start(Config{Stdout: true, StdoutFormat: StdoutPretty}); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+
+		TraceEnter("main", "LoadUser", map[string]interface{}{"userID": 42, "cache": true})
+		TraceEnter("db", "Query", map[string]interface{}{"sql": "SELECT 1"})
+		TraceException("db", "Query", errors.New("connection reset"))
+		ctx := Enter("db", "Retry", nil)
+		ctx.SetError(errors.New("gave up"))
+		ctx.Exit(nil)
+		TraceExit("main", "LoadUser", map[string]interface{}{"name": "Ada"})
+
+		if err := Stop(); err != nil {
+			t.Fatalf("Stop failed: %v", err)
+		}
+	})
+
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	duration := regexp.MustCompile(` \([0-9.]+[µnm]?s\)$`)
+	want := []string{
+		`→ main.LoadUser(cache=true, userID=42)`,
+		`  → db.Query(sql="SELECT 1")`,
+		`  ✗ db.Query panic: connection reset`,
+		`  → db.Retry()`,
+		`  ← db.Retry error: gave up`,
+		`← main.LoadUser = {"name":"Ada"}`,
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("Expected %d lines, got %d:\n%s", len(want), len(lines), output)
+	}
+	for i, line := range lines {
+		if strings.Contains(want[i], "→") {
+			if line != want[i] {
+				t.Errorf("Line %d: expected %q, got %q", i, want[i], line)
+			}
+			continue
+		}
+		// EXIT and EXCEPTION lines end with the call duration
+		if !duration.MatchString(line) {
+			t.Errorf("Line %d: expected a duration suffix, got %q", i, line)
+		}
+		if got := duration.ReplaceAllString(line, ""); got != want[i] {
+			t.Errorf("Line %d: expected %q, got %q", i, want[i], got)
+		}
+	}
+	if strings.Contains(output, "\x1b[") {
+		t.Errorf("Expected no color when stdout is not a terminal:\n%s", output)
+	}
+}
+
+func TestStdoutDefaultJSON(t *testing.T) {
+	output := captureStdout(t, func() {
+		if err := Start(Config{Stdout: true}); err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+		TraceEnter("main", "Run", nil)
+		TraceExit("main", "Run", nil)
+		Stop()
+	})
+
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], `{"event":"ENTER"`) {
+		t.Errorf("Expected two JSON lines, got:\n%s", output)
+	}
+}
+
+func TestPrettyWriterColor(t *testing.T) {
+	var buf bytes.Buffer
+	p := newPrettyWriter(true)
+	p.write(&buf, TraceEvent{Event: "ENTER", Class: "main", Method: "Run", Thread: "goroutine-1"}, nil)
+	p.write(&buf, TraceEvent{Event: "EXIT", Class: "main", Method: "Run", Thread: "goroutine-1", IsError: true, Exception: "failed", DurationMicros: 1500}, nil)
+
+	want := colorCyan + "→ main.Run" + colorReset + "()\n" +
+		colorGreen + "← main.Run" + colorReset + " " + colorRed + "error: failed" + colorReset + " " + colorDim + "(1.5ms)" + colorReset + "\n"
+	if buf.String() != want {
+		t.Errorf("Expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestValidateStdoutFormat(t *testing.T) {
+	config := DefaultConfig()
+	config.StdoutFormat = "yaml"
+	if err := config.Validate(); err == nil {
+		t.Error("Expected an unknown stdout format to be rejected")
+	}
+	if _, err := NewTracer(Config{StdoutFormat: "yaml"}); err == nil {
+		t.Error("Expected NewTracer to reject an unknown stdout format")
+	}
+}
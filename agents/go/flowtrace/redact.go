@@ -0,0 +1,157 @@
+package flowtrace
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/filter"
+)
+
+// redactedValue replaces the values of redacted arguments and fields
+const redactedValue = "<redacted>"
+
+// maxRedactDepth bounds how deep redaction descends into captured values
+const maxRedactDepth = 8
+
+// redactor replaces argument values and struct fields whose names match
+// one of the configured patterns. Matching is case-insensitive.
+type redactor struct {
+	patterns []*filter.Pattern
+}
+
+// newRedactor compiles the Config.Redact patterns; it returns nil when there
+// is nothing to redact
+func newRedactor(patterns []string) (*redactor, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	lowered := make([]string, len(patterns))
+	for i, p := range patterns {
+		lowered[i] = strings.ToLower(p)
+	}
+
+	compiled, err := filter.CompilePatterns(lowered)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redact pattern: %w", err)
+	}
+	return &redactor{patterns: compiled}, nil
+}
+
+// matches reports whether an argument or field name must be redacted
+func (r *redactor) matches(name string) bool {
+	return filter.MatchAny(strings.ToLower(name), r.patterns)
+}
+
+// args returns a copy of args with matching keys redacted and matching
+// struct fields redacted inside the remaining values
+func (r *redactor) args(args map[string]interface{}) map[string]interface{} {
+	if r == nil || args == nil {
+		return args
+	}
+
+	redacted := make(map[string]interface{}, len(args))
+	for name, value := range args {
+		if r.matches(name) {
+			redacted[name] = redactedValue
+			continue
+		}
+		redacted[name] = r.value(value)
+	}
+	return redacted
+}
+
+// value returns v with matching struct fields and map keys redacted. Values
+// without anything to redact are returned unchanged.
+func (r *redactor) value(v interface{}) interface{} {
+	if r == nil || v == nil {
+		return v
+	}
+	if redacted, changed := r.redact(reflect.ValueOf(v), 0); changed {
+		return redacted
+	}
+	return v
+}
+
+// redact walks v and reports whether anything was redacted. Changed structs
+// become maps keyed by field name, changed slices become []interface{}.
+func (r *redactor) redact(v reflect.Value, depth int) (interface{}, bool) {
+	if depth > maxRedactDepth || !v.IsValid() {
+		return nil, false
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil, false
+		}
+		return r.redact(v.Elem(), depth+1)
+
+	case reflect.Struct:
+		fields := make(map[string]interface{}, v.NumField())
+		changed := false
+		for i := 0; i < v.NumField(); i++ {
+			name := v.Type().Field(i).Name
+			if r.matches(name) {
+				fields[name] = redactedValue
+				changed = true
+				continue
+			}
+			if inner, ok := r.redact(v.Field(i), depth+1); ok {
+				fields[name] = inner
+				changed = true
+				continue
+			}
+			fields[name] = plainValue(v.Field(i))
+		}
+		return fields, changed
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		entries := make(map[string]interface{}, v.Len())
+		changed := false
+		iter := v.MapRange()
+		for iter.Next() {
+			key := iter.Key().String()
+			if r.matches(key) {
+				entries[key] = redactedValue
+				changed = true
+				continue
+			}
+			if inner, ok := r.redact(iter.Value(), depth+1); ok {
+				entries[key] = inner
+				changed = true
+				continue
+			}
+			entries[key] = plainValue(iter.Value())
+		}
+		return entries, changed
+
+	case reflect.Slice, reflect.Array:
+		items := make([]interface{}, v.Len())
+		changed := false
+		for i := 0; i < v.Len(); i++ {
+			if inner, ok := r.redact(v.Index(i), depth+1); ok {
+				items[i] = inner
+				changed = true
+				continue
+			}
+			items[i] = plainValue(v.Index(i))
+		}
+		return items, changed
+	}
+
+	return nil, false
+}
+
+// plainValue returns the value held by v. Unexported struct fields cannot be
+// extracted, so they are kept in their printed form.
+func plainValue(v reflect.Value) interface{} {
+	if v.CanInterface() {
+		return v.Interface()
+	}
+	return fmt.Sprint(v)
+}
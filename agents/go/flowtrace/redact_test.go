@@ -0,0 +1,145 @@
+package flowtrace
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type testUser struct {
+	UserID   int
+	Email    string
+	Password string
+	Profile  *testProfile
+}
+
+type testProfile struct {
+	Nickname string
+	APIToken string
+}
+
+func TestRedactorArgs(t *testing.T) {
+	r, err := newRedactor([]string{"password", "*token*", "email"})
+	if err != nil {
+		t.Fatalf("newRedactor failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		args     map[string]interface{}
+		contains []string
+		excludes []string
+	}{
+		{
+			name:     "redacts matching argument",
+			args:     map[string]interface{}{"userID": 42, "password": "hunter2"},
+			contains: []string{"userID:42", "password:<redacted>"},
+			excludes: []string{"hunter2"},
+		},
+		{
+			name:     "case insensitive",
+			args:     map[string]interface{}{"Password": "hunter2", "EMAIL": "a@b.c", "refreshToken": "xyz"},
+			contains: []string{"Password:<redacted>", "EMAIL:<redacted>", "refreshToken:<redacted>"},
+			excludes: []string{"hunter2", "a@b.c", "xyz"},
+		},
+		{
+			name: "struct fields",
+			args: map[string]interface{}{
+				"user": &testUser{UserID: 7, Email: "a@b.c", Password: "hunter2", Profile: &testProfile{Nickname: "al", APIToken: "xyz"}},
+			},
+			contains: []string{"UserID:7", "Email:<redacted>", "Password:<redacted>", "Nickname:al", "APIToken:<redacted>"},
+			excludes: []string{"hunter2", "a@b.c", "xyz"},
+		},
+		{
+			name:     "nested maps and slices",
+			args:     map[string]interface{}{"batch": []map[string]string{{"name": "al", "password": "hunter2"}}},
+			contains: []string{"name:al", "password:<redacted>"},
+			excludes: []string{"hunter2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := fmt.Sprintf("%v", r.args(tt.args))
+			for _, want := range tt.contains {
+				if !strings.Contains(output, want) {
+					t.Errorf("Expected %q in %s", want, output)
+				}
+			}
+			for _, secret := range tt.excludes {
+				if strings.Contains(output, secret) {
+					t.Errorf("Expected %q to be redacted in %s", secret, output)
+				}
+			}
+		})
+	}
+}
+
+func TestRedactorLeavesCleanValuesUnchanged(t *testing.T) {
+	r, err := newRedactor([]string{"password"})
+	if err != nil {
+		t.Fatalf("newRedactor failed: %v", err)
+	}
+
+	profile := testProfile{Nickname: "al"}
+	if got := r.value(profile); got != profile {
+		t.Errorf("Expected value without redacted fields to be returned as is, got %v", got)
+	}
+
+	args := map[string]interface{}{"userID": 42}
+	redacted := r.args(args)
+	if fmt.Sprint(redacted) != fmt.Sprint(args) {
+		t.Errorf("Expected %v, got %v", args, redacted)
+	}
+}
+
+func TestRedactorDisabled(t *testing.T) {
+	r, err := newRedactor(nil)
+	if err != nil {
+		t.Fatalf("newRedactor failed: %v", err)
+	}
+
+	args := map[string]interface{}{"password": "hunter2"}
+	if got := r.args(args); got["password"] != "hunter2" {
+		t.Errorf("Expected no redaction without patterns, got %v", got)
+	}
+}
+
+func TestRedactorUnexportedFields(t *testing.T) {
+	r, err := newRedactor([]string{"secret"})
+	if err != nil {
+		t.Fatalf("newRedactor failed: %v", err)
+	}
+
+	value := struct {
+		name   string
+		secret string
+	}{name: "al", secret: "hunter2"}
+
+	output := fmt.Sprintf("%v", r.value(value))
+	if !strings.Contains(output, "name:al") || strings.Contains(output, "hunter2") {
+		t.Errorf("Expected unexported secret redacted and name kept, got %s", output)
+	}
+}
+
+func TestTracerRedactsArgs(t *testing.T) {
+	tracer, err := NewTracer(Config{Redact: []string{"Password"}})
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	defer tracer.Close()
+
+	var buf strings.Builder
+	tracer.writer = &buf
+
+	tracer.enter(1, "main", "Login", map[string]interface{}{"userID": "u-1", "password": "hunter2"}, TraceParent{}, sourceLocation{})
+	tracer.exit(1, "main", "Login", map[string]interface{}{"result_0": testUser{UserID: 1, Password: "hunter2"}}, nil)
+
+	output := buf.String()
+	if strings.Contains(output, "hunter2") {
+		t.Errorf("Expected password to be redacted\n%s", output)
+	}
+	if !strings.Contains(output, `"userID":"u-1"`) {
+		t.Errorf("Expected userID to be preserved\n%s", output)
+	}
+}
@@ -0,0 +1,164 @@
+package flowtrace
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// remoteQueueSize is the number of events buffered while the collector
+	// is slow or unreachable; further events are dropped
+	remoteQueueSize = 4096
+
+	// Backoff between attempts to reconnect to a TCP collector
+	remoteMinBackoff = 100 * time.Millisecond
+	remoteMaxBackoff = 5 * time.Second
+
+	// remoteWriteTimeout bounds a write to a collector that stopped reading
+	remoteWriteTimeout = 2 * time.Second
+
+	// remoteCloseTimeout is how long Close waits for queued events to be
+	// sent before dropping them
+	remoteCloseTimeout = time.Second
+)
+
+// remoteWriter streams events as JSON lines to a collector over TCP or UDP.
+// Events are queued and sent by a goroutine of its own, so the traced
+// program never waits on the network: an event that finds the queue full,
+// or whose UDP datagram can't be sent, is dropped and counted instead. A
+// lost TCP connection is redialed with exponential backoff.
+type remoteWriter struct {
+	network string // "tcp" or "udp"
+	addr    string
+	queue   chan []byte
+	dropped atomic.Uint64
+
+	// ctx is canceled by close to give up on sending, e.g. while redialing
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{} // closed when run returns
+}
+
+// parseRemoteAddr splits a Config.RemoteAddr into network and address. A
+// bare "host:port" is a TCP address.
+func parseRemoteAddr(addr string) (network, hostport string, err error) {
+	network, hostport = "tcp", addr
+	if scheme, rest, ok := strings.Cut(addr, "://"); ok {
+		network, hostport = scheme, rest
+	}
+	if network != "tcp" && network != "udp" {
+		return "", "", fmt.Errorf("unsupported scheme %q, expected tcp or udp", network)
+	}
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		return "", "", err
+	}
+	return network, hostport, nil
+}
+
+// newRemoteWriter starts streaming to addr; the connection is made in the
+// background, so an unreachable collector is not an error
+func newRemoteWriter(addr string) (*remoteWriter, error) {
+	network, hostport, err := parseRemoteAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &remoteWriter{
+		network: network,
+		addr:    hostport,
+		queue:   make(chan []byte, remoteQueueSize),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// send queues an encoded event without blocking; the tracer holds its
+// mutex, so send is never called after close
+func (w *remoteWriter) send(data []byte) {
+	select {
+	case w.queue <- data:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// run sends the queued events until the queue is closed
+func (w *remoteWriter) run() {
+	defer close(w.done)
+
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	var dialer net.Dialer
+	backoff := remoteMinBackoff
+	for data := range w.queue {
+		for conn == nil && w.ctx.Err() == nil {
+			c, err := dialer.DialContext(w.ctx, w.network, w.addr)
+			if err == nil {
+				conn = c
+				backoff = remoteMinBackoff
+				break
+			}
+			select {
+			case <-time.After(backoff):
+			case <-w.ctx.Done():
+			}
+			backoff = min(2*backoff, remoteMaxBackoff)
+		}
+		if w.ctx.Err() != nil {
+			// Given up by close
+			w.dropped.Add(1)
+			continue
+		}
+
+		// The capacity is cut so the newline never lands in a buffer the
+		// tracer may share
+		line := append(data[:len(data):len(data)], '\n')
+		conn.SetWriteDeadline(time.Now().Add(remoteWriteTimeout))
+		if _, err := conn.Write(line); err != nil {
+			w.dropped.Add(1)
+			// A UDP socket stays usable after a refused or oversized
+			// datagram; a TCP connection is redialed
+			if w.network == "tcp" {
+				conn.Close()
+				conn = nil
+			}
+		}
+	}
+}
+
+// close sends the events still queued, waiting up to remoteCloseTimeout,
+// and closes the connection. It returns the number of events dropped.
+func (w *remoteWriter) close() uint64 {
+	close(w.queue)
+	select {
+	case <-w.done:
+	case <-time.After(remoteCloseTimeout):
+		w.cancel()
+		<-w.done
+	}
+	w.cancel()
+	return w.dropped.Load()
+}
+
+// RemoteDropped returns the number of events the running tracer dropped
+// instead of sending them to Config.RemoteAddr, because the collector was
+// unreachable or could not keep up
+func RemoteDropped() uint64 {
+	if t := globalTracer.Load(); t != nil && t.remote != nil {
+		return t.remote.dropped.Load()
+	}
+	return 0
+}
@@ -0,0 +1,189 @@
+package flowtrace
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// acceptLines accepts TCP connections on ln and sends every line received
+// on any of them to lines
+func acceptLines(t *testing.T, ln net.Listener) (lines chan string, conns chan net.Conn) {
+	t.Helper()
+
+	lines = make(chan string, 100)
+	conns = make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go func() {
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+	return lines, conns
+}
+
+// receiveEvent returns the next event received on lines
+func receiveEvent(t *testing.T, lines chan string) TraceEvent {
+	t.Helper()
+
+	select {
+	case line := <-lines:
+		var event TraceEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("Invalid event %q: %v", line, err)
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+		return TraceEvent{}
+	}
+}
+
+func TestRemoteTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	lines, _ := acceptLines(t, ln)
+
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path, RemoteAddr: "tcp://" + ln.Addr().String()}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	Enter("main", "Checkout", map[string]interface{}{"id": 7}).Exit(nil)
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	if metadata := receiveEvent(t, lines); metadata.Event != "METADATA" || metadata.Metadata == nil {
+		t.Errorf("Expected the METADATA event first, got %+v", metadata)
+	}
+	enter, exit := receiveEvent(t, lines), receiveEvent(t, lines)
+	if enter.Event != "ENTER" || exit.Event != "EXIT" || enter.Method != "Checkout" || enter.SpanID != exit.SpanID {
+		t.Errorf("Expected the ENTER and EXIT of Checkout, got %+v and %+v", enter, exit)
+	}
+	if string(enter.Args) != `{"id":7}` {
+		t.Errorf("Expected the event as logged, got args %s", enter.Args)
+	}
+	if events := readTrace(t, path); len(events) != 2 {
+		t.Errorf("Expected the events to be written to the log file too, got %d", len(events))
+	}
+}
+
+func TestRemoteUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer conn.Close()
+
+	if err := Start(Config{RemoteAddr: "udp://" + conn.LocalAddr().String()}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	Enter("main", "Checkout", nil).Exit(nil)
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	buf := make([]byte, 64*1024)
+	for _, want := range []string{"METADATA", "ENTER", "EXIT"} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Expected a datagram, got %v", err)
+		}
+		var event TraceEvent
+		if err := json.Unmarshal(buf[:n], &event); err != nil || event.Event != want {
+			t.Errorf("Expected one %s event per datagram, got %q (%v)", want, buf[:n], err)
+		}
+	}
+}
+
+func TestRemoteTCPReconnects(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	lines, conns := acceptLines(t, ln)
+
+	if err := Start(Config{RemoteAddr: ln.Addr().String()}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer Stop()
+
+	Enter("main", "First", nil).Exit(nil)
+	receiveEvent(t, lines) // METADATA
+	if event := receiveEvent(t, lines); event.Method != "First" {
+		t.Fatalf("Expected the first call, got %+v", event)
+	}
+	receiveEvent(t, lines)
+
+	// The collector drops the connection; events logged meanwhile may be
+	// lost, but a later one arrives on a new connection
+	(<-conns).Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		Enter("main", "Later", nil).Exit(nil)
+		select {
+		case <-conns:
+			if event := receiveEvent(t, lines); event.Method != "Later" {
+				t.Fatalf("Expected a later call, got %+v", event)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	t.Fatal("Expected the tracer to reconnect")
+}
+
+func TestRemoteDeadEndpointDoesNotBlock(t *testing.T) {
+	// A port nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path, RemoteAddr: addr}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	start := time.Now()
+	calls := remoteQueueSize
+	for i := 0; i < calls; i++ {
+		Enter("main", "Work", nil).Exit(nil)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected logging not to wait for the collector, took %v", elapsed)
+	}
+	if RemoteDropped() == 0 {
+		t.Error("Expected the events that overflowed the queue to be counted as dropped")
+	}
+
+	start = time.Now()
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > remoteCloseTimeout+2*time.Second {
+		t.Errorf("Expected Stop to give up on the collector, took %v", elapsed)
+	}
+	if events := readTrace(t, path); len(events) != 2*calls {
+		t.Errorf("Expected all %d events in the log file, got %d", 2*calls, len(events))
+	}
+}
@@ -0,0 +1,75 @@
+package flowtrace
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// Result is one value returned by a call
+type Result struct {
+	// Name is the declared name of the result, empty when unnamed
+	Name  string
+	Value interface{}
+}
+
+// Results are the values returned by a call, in order. Instrumented code and
+// ExitWithValues both log them, as an object keyed result_0, result_1, ...
+// in that order, so tools read result i of any call the same way. The
+// declared names, when any result has one, go in the resultNames field of
+// the EXIT event.
+type Results []Result
+
+// resultKey returns the key result i is logged under
+func resultKey(i int) string {
+	return "result_" + strconv.Itoa(i)
+}
+
+// names returns the declared names of the results, or nil when none has one
+func (r Results) names() []string {
+	for _, result := range r {
+		if result.Name != "" {
+			names := make([]string, len(r))
+			for i, result := range r {
+				names[i] = result.Name
+			}
+			return names
+		}
+	}
+	return nil
+}
+
+// encodeResults serializes the results of a call for an EXIT event. Results
+// whose name matches Config.Redact are redacted like arguments.
+func (t *Tracer) encodeResults(results Results) json.RawMessage {
+	if len(results) == 0 {
+		return nil
+	}
+
+	values := make(map[string]interface{}, len(results))
+	for i, result := range results {
+		if result.Name != "" && t.redactor != nil && t.redactor.matches(result.Name) {
+			values[resultKey(i)] = redactedValue
+			continue
+		}
+		values[resultKey(i)] = boundValue(t.redactor.value(t.customValue(result.Value)), t.maxArgDepth())
+	}
+	if t.config.LegacyArgFormat {
+		return t.marshal(values)
+	}
+
+	// Keys are written in result order; json.Marshal would sort result_10
+	// before result_2
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i := range results {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(marshalString(resultKey(i)))
+		buf.WriteByte(':')
+		buf.Write(marshalValue(values[resultKey(i)]))
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
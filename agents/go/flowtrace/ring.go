@@ -0,0 +1,137 @@
+package flowtrace
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+)
+
+// ringBuffer keeps the encoded lines of the last events logged under
+// Config.RingBufferSize. It is guarded by the tracer's mutex.
+type ringBuffer struct {
+	lines    [][]byte
+	next     int    // index the next line is stored at
+	full     bool   // every slot holds a line; next is the oldest
+	metadata []byte // the METADATA record, written ahead of every dump
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{lines: make([][]byte, size)}
+}
+
+// add stores line, replacing the oldest one when the buffer is full
+func (r *ringBuffer) add(line []byte) {
+	r.lines[r.next] = line
+	r.next++
+	if r.next == len(r.lines) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// snapshot returns the metadata record, if any, then the lines kept,
+// oldest first
+func (r *ringBuffer) snapshot() [][]byte {
+	var lines [][]byte
+	if r.metadata != nil {
+		lines = append(lines, r.metadata)
+	}
+	if r.full {
+		lines = append(lines, r.lines[r.next:]...)
+	}
+	return append(lines, r.lines[:r.next]...)
+}
+
+// Dump writes the events kept by Config.RingBufferSize to w as JSON lines,
+// oldest first, after the METADATA record. The buffer is left as it is, so
+// later dumps repeat the events still kept; it can be dumped after Close.
+// A tracer without a ring buffer writes nothing.
+func (t *Tracer) Dump(w io.Writer) error {
+	if t.ring == nil {
+		return nil
+	}
+
+	// Lines are never changed once stored, so they are written unlocked
+	t.mutex.Lock()
+	lines := t.ring.snapshot()
+	t.mutex.Unlock()
+
+	for _, line := range lines {
+		// Each line is written at once, as appendFile needs
+		if _, err := w.Write(append(line[:len(line):len(line)], '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dumpToOutput dumps the ring buffer to the end of LogFile, or to stderr
+// without one, for the dumps not asked for with a writer
+func (t *Tracer) dumpToOutput() error {
+	if t.config.LogFile == "" {
+		return t.Dump(os.Stderr)
+	}
+
+	f, err := os.OpenFile(t.config.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	if err := t.Dump(appendFile{f}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// dumpOnSignals dumps the ring buffer whenever one of signals is received,
+// until done is closed. The signals are caught from when it returns.
+func (t *Tracer) dumpOnSignals(signals []os.Signal, done <-chan struct{}) {
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+	go t.dumpOnReceive(received, done)
+}
+
+// dumpOnReceive dumps the ring buffer for every signal received, until
+// done is closed
+func (t *Tracer) dumpOnReceive(received chan os.Signal, done <-chan struct{}) {
+	defer signal.Stop(received)
+
+	for {
+		select {
+		case <-received:
+			if err := t.dumpToOutput(); err != nil {
+				fmt.Fprintf(os.Stderr, "flowtrace: failed to dump the ring buffer: %v\n", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Dump dumps the ring buffer of the global tracer; see Tracer.Dump
+func Dump(w io.Writer) error {
+	if t := globalTracer.Load(); t != nil {
+		return t.Dump(w)
+	}
+	return nil
+}
+
+// DumpOnPanic dumps the ring buffer of the global tracer to the end of
+// Config.LogFile, or to stderr without one, when the goroutine is
+// panicking, then lets the panic go on. It must be deferred directly, at
+// the top of main and of the goroutines whose crash should be captured:
+//
+//	defer flowtrace.DumpOnPanic()
+func DumpOnPanic() {
+	rec := recover()
+	if rec == nil {
+		return
+	}
+	if t := globalTracer.Load(); t != nil && t.ring != nil {
+		if err := t.dumpToOutput(); err != nil {
+			fmt.Fprintf(os.Stderr, "flowtrace: failed to dump the ring buffer: %v\n", err)
+		}
+	}
+	panic(rec)
+}
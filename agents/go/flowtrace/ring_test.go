@@ -0,0 +1,132 @@
+package flowtrace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// dumpedEvents returns the events of a dump, METADATA record included
+func dumpedEvents(t *testing.T, data []byte) []TraceEvent {
+	t.Helper()
+
+	var events []TraceEvent
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var event TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Invalid dump line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestDumpKeepsLastEventsInOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	tracer, err := NewTracer(Config{LogFile: path, RingBufferSize: 5, ServiceName: "shop"})
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+
+	// 12 events: the ring wraps around twice
+	for i := 0; i < 12; i++ {
+		tracer.logEvent(TraceEvent{Event: "LOG", Method: fmt.Sprintf("call%d", i)})
+	}
+
+	var buf bytes.Buffer
+	if err := tracer.Dump(&buf); err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+	events := dumpedEvents(t, buf.Bytes())
+	if len(events) != 6 {
+		t.Fatalf("Expected the METADATA record and 5 events, got %d:\n%s", len(events), buf.Bytes())
+	}
+	if events[0].Event != "METADATA" || events[0].Metadata.ServiceName != "shop" {
+		t.Errorf("Expected the dump to start with the METADATA record, got %+v", events[0])
+	}
+	for i, event := range events[1:] {
+		if want := fmt.Sprintf("call%d", 7+i); event.Method != want {
+			t.Errorf("Expected event %d to be %s, got %s", i, want, event.Method)
+		}
+	}
+
+	// Dumping leaves the buffer as it is
+	var again bytes.Buffer
+	tracer.Dump(&again)
+	if !bytes.Equal(again.Bytes(), buf.Bytes()) {
+		t.Errorf("Expected a second dump to repeat the first, got\n%s", again.Bytes())
+	}
+
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be written to the log file, got %v", err)
+	}
+}
+
+func TestDumpBeforeRingIsFull(t *testing.T) {
+	tracer, err := NewTracer(Config{RingBufferSize: 10})
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	defer tracer.Close()
+
+	for i := 0; i < 3; i++ {
+		tracer.logEvent(TraceEvent{Event: "LOG", Method: fmt.Sprintf("call%d", i)})
+	}
+
+	var buf bytes.Buffer
+	tracer.Dump(&buf)
+	events := dumpedEvents(t, buf.Bytes())
+	if len(events) != 4 || events[1].Method != "call0" || events[3].Method != "call2" {
+		t.Errorf("Expected the METADATA record and the 3 events logged, got\n%s", buf.Bytes())
+	}
+}
+
+func TestDumpWithoutRingBuffer(t *testing.T) {
+	tracer, err := NewTracer(Config{})
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	defer tracer.Close()
+
+	tracer.logEvent(TraceEvent{Event: "LOG"})
+	var buf bytes.Buffer
+	if err := tracer.Dump(&buf); err != nil || buf.Len() != 0 {
+		t.Errorf("Expected no dump without a ring buffer, got %q, %v", buf.String(), err)
+	}
+}
+
+func TestDumpOnPanic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path, RingBufferSize: 4}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer Stop()
+
+	func() {
+		defer func() {
+			if rec := recover(); rec != "boom" {
+				t.Errorf("Expected the panic to go on, got %v", rec)
+			}
+		}()
+		defer DumpOnPanic()
+		Enter("main", "Crash", nil)
+		panic("boom")
+	}()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected the panic to dump to the log file: %v", err)
+	}
+	events := dumpedEvents(t, data)
+	if len(events) != 2 || events[1].Method != "Crash" {
+		t.Errorf("Expected the dump to hold the call before the panic, got %+v", events)
+	}
+}
@@ -0,0 +1,39 @@
+//go:build unix
+
+package flowtrace
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDumpOnSignal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	tracer, err := NewTracer(Config{LogFile: path, RingBufferSize: 4, DumpSignals: []os.Signal{syscall.SIGUSR1}})
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	defer tracer.Close()
+
+	frame := tracer.enter(getGoroutineID(), "main", "Serve", nil, TraceParent{}, sourceLocation{})
+	if frame == nil {
+		t.Fatal("Expected the call to be logged")
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatalf("Kill failed: %v", err)
+	}
+
+	var events []TraceEvent
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		data, _ := os.ReadFile(path)
+		if events = dumpedEvents(t, data); len(events) == 2 {
+			break
+		}
+	}
+	if len(events) != 2 || events[1].Event != "ENTER" || events[1].Method != "Serve" {
+		t.Errorf("Expected the signal to dump the ENTER event to the log file, got %+v", events)
+	}
+}
@@ -0,0 +1,104 @@
+package flowtrace
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/filter"
+)
+
+// samplingRule is a SamplingRule with its pattern compiled
+type samplingRule struct {
+	pattern *filter.Pattern
+	rate    float64
+}
+
+// compileSamplingRules compiles the patterns of rules, keeping their order
+func compileSamplingRules(rules []SamplingRule) ([]samplingRule, error) {
+	compiled := make([]samplingRule, 0, len(rules))
+	for _, rule := range rules {
+		patterns, err := filter.CompilePatterns([]string{rule.Pattern})
+		if err != nil {
+			return nil, fmt.Errorf("invalid sampling pattern %q: %w", rule.Pattern, err)
+		}
+		compiled = append(compiled, samplingRule{pattern: patterns[0], rate: rule.Rate})
+	}
+	return compiled, nil
+}
+
+// sampleRate returns the rate of the first rule matching packageName.funcName,
+// falling back to the global SamplingRate
+func (t *Tracer) sampleRate(packageName, funcName string) float64 {
+	if rate, ok := t.ruleRate(packageName, funcName); ok {
+		return rate
+	}
+
+	if t.config.SamplingRate == 0 {
+		return 1.0
+	}
+	return t.config.SamplingRate
+}
+
+// ruleRate returns the rate of the first rule matching packageName.funcName
+func (t *Tracer) ruleRate(packageName, funcName string) (float64, bool) {
+	name := qualifiedName(packageName, funcName)
+	for _, rule := range t.rules {
+		if rule.pattern.Match(name) {
+			return rule.rate, true
+		}
+	}
+	return 0, false
+}
+
+// argsSampled decides whether a logged call records its args and result,
+// from the first of Config.ArgRules matching packageName.funcName
+func (t *Tracer) argsSampled(packageName, funcName string) bool {
+	if len(t.argRules) == 0 {
+		return true
+	}
+	name := qualifiedName(packageName, funcName)
+	for _, rule := range t.argRules {
+		if rule.pattern.Match(name) {
+			return sampled(rule.rate)
+		}
+	}
+	return true
+}
+
+// sampledByRule decides whether a call inside a sampled trace is logged.
+// Whole traces are sampled at their root by traceSampled; within one, only
+// the rules still thin out the calls they match, whose callees are then
+// parented to the nearest logged caller.
+func (t *Tracer) sampledByRule(packageName, funcName string) bool {
+	rate, ok := t.ruleRate(packageName, funcName)
+	return !ok || sampled(rate)
+}
+
+// traceSampled decides whether the trace traceID is logged at all. The
+// decision is made once, at the root call, from a hash of the trace ID, so
+// a trace is logged whole or not at all, and processes continuing the same
+// trace at the same rate all decide alike.
+func traceSampled(traceID string, rate float64) bool {
+	if rate >= 1.0 {
+		return true
+	}
+	if rate <= 0.0 {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(traceID))
+	// The top 53 bits make a uniform float64 in [0, 1)
+	return float64(h.Sum64()>>11)/(1<<53) < rate
+}
+
+// sampled makes a random sampling decision for the given rate
+func sampled(rate float64) bool {
+	if rate >= 1.0 {
+		return true
+	}
+	if rate <= 0.0 {
+		return false
+	}
+	return rand.Float64() < rate
+}
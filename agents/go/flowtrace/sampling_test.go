@@ -0,0 +1,229 @@
+package flowtrace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestSampleRateRules(t *testing.T) {
+	config := Config{
+		SamplingRate: 0.5,
+		Rules: []SamplingRule{
+			{Pattern: "main.LoadUser", Rate: 1.0},
+			{Pattern: "main.*", Rate: 0.01},
+			{Pattern: "main.LoadOrder", Rate: 0.9}, // shadowed by main.*
+			{Pattern: "github.com/acme/db.*", Rate: 0.2},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		pkg      string
+		fn       string
+		expected float64
+	}{
+		{name: "exact rule", pkg: "main", fn: "LoadUser", expected: 1.0},
+		{name: "glob rule", pkg: "main", fn: "formatName", expected: 0.01},
+		{name: "first matching rule wins", pkg: "main", fn: "LoadOrder", expected: 0.01},
+		{name: "package path rule", pkg: "github.com/acme/db", fn: "Query", expected: 0.2},
+		{name: "fallback to global rate", pkg: "github.com/acme/api", fn: "Handle", expected: 0.5},
+		{name: "function without package", pkg: "", fn: "LoadUser", expected: 0.5},
+	}
+
+	tracer, err := NewTracer(config)
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	defer tracer.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rate := tracer.sampleRate(tt.pkg, tt.fn); rate != tt.expected {
+				t.Errorf("Expected rate %v for %s.%s, got %v", tt.expected, tt.pkg, tt.fn, rate)
+			}
+		})
+	}
+}
+
+func TestSampleRateUnsetGlobalRate(t *testing.T) {
+	tracer, err := NewTracer(Config{})
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	defer tracer.Close()
+
+	if rate := tracer.sampleRate("main", "main"); rate != 1.0 {
+		t.Errorf("Expected unset SamplingRate to trace everything, got %v", rate)
+	}
+}
+
+func TestTracerDropsUnsampledCalls(t *testing.T) {
+	tracer, err := NewTracer(Config{
+		SamplingRate: 1.0,
+		Rules:        []SamplingRule{{Pattern: "main.noisy", Rate: 0}},
+	})
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	defer tracer.Close()
+
+	var buf bytes.Buffer
+	tracer.writer = &buf
+
+	tracer.enter(1, "main", "outer", nil, TraceParent{}, sourceLocation{})
+	tracer.enter(1, "main", "noisy", nil, TraceParent{}, sourceLocation{})
+	tracer.enter(1, "main", "inner", nil, TraceParent{}, sourceLocation{})
+	tracer.exit(1, "main", "inner", nil, nil)
+	tracer.exit(1, "main", "noisy", nil, nil)
+	tracer.exit(1, "main", "outer", nil, nil)
+
+	var events []TraceEvent
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var event TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Invalid JSON line: %v", err)
+		}
+		events = append(events, event)
+	}
+
+	if len(events) != 4 {
+		t.Fatalf("Expected 4 events, got %d", len(events))
+	}
+
+	expected := []struct{ event, method string }{
+		{"ENTER", "outer"}, {"ENTER", "inner"}, {"EXIT", "inner"}, {"EXIT", "outer"},
+	}
+	for i, want := range expected {
+		if events[i].Event != want.event || events[i].Method != want.method {
+			t.Errorf("Event %d: expected %s %s, got %s %s", i, want.event, want.method, events[i].Event, events[i].Method)
+		}
+	}
+
+	// inner is re-parented to the nearest sampled caller
+	if events[1].ParentSpanID != events[0].SpanID {
+		t.Errorf("Expected inner's parent to be outer (%s), got %s", events[0].SpanID, events[1].ParentSpanID)
+	}
+	if events[2].SpanID != events[1].SpanID || events[3].SpanID != events[0].SpanID {
+		t.Error("Expected exits to match their enters")
+	}
+}
+
+func TestTracerSamplesWholeTraces(t *testing.T) {
+	tracer, err := NewTracer(Config{SamplingRate: 0.5})
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	defer tracer.Close()
+
+	var buf bytes.Buffer
+	tracer.writer = &buf
+
+	const traces = 200
+	for i := 0; i < traces; i++ {
+		tracer.enter(1, "main", "root", nil, TraceParent{}, sourceLocation{})
+		tracer.enter(1, "main", "child", nil, TraceParent{}, sourceLocation{})
+		tracer.enter(1, "main", "grandchild", nil, TraceParent{}, sourceLocation{})
+		tracer.exit(1, "main", "grandchild", nil, nil)
+		tracer.exit(1, "main", "child", nil, nil)
+		tracer.exit(1, "main", "root", nil, nil)
+	}
+
+	perTrace := make(map[string]int)
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var event TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Invalid JSON line: %v", err)
+		}
+		perTrace[event.TraceID]++
+	}
+
+	// A sampled root keeps all its descendants, an unsampled one drops them
+	for traceID, count := range perTrace {
+		if count != 6 {
+			t.Errorf("Expected trace %s to be logged whole, got %d of 6 events", traceID, count)
+		}
+	}
+	if len(perTrace) == 0 || len(perTrace) == traces {
+		t.Errorf("Expected about half of %d traces to be sampled, got %d", traces, len(perTrace))
+	}
+}
+
+func TestTracerSamplesArgs(t *testing.T) {
+	tracer, err := NewTracer(Config{
+		ArgRules: []SamplingRule{{Pattern: "main.hot", Rate: 0.25}},
+	})
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	defer tracer.Close()
+
+	var buf bytes.Buffer
+	tracer.writer = &buf
+
+	const calls = 2000
+	for i := 0; i < calls; i++ {
+		tracer.enter(1, "main", "hot", map[string]interface{}{"i": i}, TraceParent{}, sourceLocation{})
+		tracer.exit(1, "main", "hot", i, nil)
+	}
+	tracer.enter(1, "main", "cold", map[string]interface{}{"i": 0}, TraceParent{}, sourceLocation{})
+	tracer.exit(1, "main", "cold", 0, nil)
+
+	var events []TraceEvent
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var event TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Invalid JSON line: %v", err)
+		}
+		events = append(events, event)
+	}
+
+	// Every call is still logged, with its timing
+	if len(events) != 2*(calls+1) {
+		t.Fatalf("Expected %d events, got %d", 2*(calls+1), len(events))
+	}
+
+	withArgs := 0
+	for i := 0; i < 2*calls; i += 2 {
+		enter, exit := events[i], events[i+1]
+		if (len(enter.Args) > 0) != (len(exit.Result) > 0) {
+			t.Fatalf("Expected the EXIT to record a result exactly when its ENTER records args, got %+v and %+v", enter, exit)
+		}
+		if len(enter.Args) > 0 {
+			withArgs++
+		}
+	}
+	if fraction := float64(withArgs) / calls; fraction < 0.2 || fraction > 0.3 {
+		t.Errorf("Expected about 25%% of hot calls to record args, got %.1f%%", 100*fraction)
+	}
+
+	cold := events[2*calls:]
+	if len(cold[0].Args) == 0 || len(cold[1].Result) == 0 {
+		t.Errorf("Expected a function without arg rule to record args and result, got %+v", cold)
+	}
+}
+
+func TestTraceSampled(t *testing.T) {
+	if !traceSampled("anything", 1.0) || traceSampled("anything", 0) {
+		t.Error("Expected rates 1 and 0 to keep and drop every trace")
+	}
+
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		traceID := newTraceID()
+		decision := traceSampled(traceID, 0.25)
+		if traceSampled(traceID, 0.25) != decision {
+			t.Fatalf("Expected the same decision for trace %s every time", traceID)
+		}
+		if decision {
+			kept++
+		}
+	}
+	if kept < 2200 || kept > 2800 {
+		t.Errorf("Expected about 2500 of 10000 traces at rate 0.25, got %d", kept)
+	}
+}
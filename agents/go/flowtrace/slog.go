@@ -0,0 +1,132 @@
+package flowtrace
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Attribute keys SlogHandler adds to log records
+const (
+	SlogTraceIDKey = "trace_id"
+	SlogSpanIDKey  = "span_id"
+)
+
+// SlogHandlerOptions configures a SlogHandler
+type SlogHandlerOptions struct {
+	// EventLevel, when set, also logs every record at or above it as a LOG
+	// trace event of the current call, e.g. slog.LevelError to see errors
+	// in the trace next to the calls that logged them. Nil logs no events.
+	EventLevel slog.Leveler
+}
+
+// SlogHandler is a slog.Handler adding the trace and span IDs of the current
+// call to every record before passing it on to the handler it wraps, so
+// logs can be joined with the trace:
+//
+//	logger := slog.New(flowtrace.NewSlogHandler(slog.NewJSONHandler(os.Stderr, nil), nil))
+//
+// The current call is the span in the context passed to the logger, as set
+// by StartSpanContext or ContextWithSpan, or else the innermost traced call
+// of the logging goroutine. Records logged outside any call are passed on
+// as they are.
+type SlogHandler struct {
+	handler slog.Handler
+	opts    SlogHandlerOptions
+}
+
+// NewSlogHandler returns a SlogHandler wrapping handler; opts may be nil
+func NewSlogHandler(handler slog.Handler, opts *SlogHandlerOptions) *SlogHandler {
+	h := &SlogHandler{handler: handler}
+	if opts != nil {
+		h.opts = *opts
+	}
+	return h
+}
+
+// Enabled reports whether the wrapped handler handles records at level, or
+// they are logged as trace events
+func (h *SlogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level) || h.logsEvent(level)
+}
+
+// Handle adds the IDs of the current call to r and passes it on, and logs
+// it as a trace event when it reaches EventLevel
+func (h *SlogHandler) Handle(ctx context.Context, r slog.Record) error {
+	t := globalTracer.Load()
+	var span *CallContext
+	if t != nil {
+		span = t.currentSpan(ctx)
+	}
+
+	if span != nil && h.logsEvent(r.Level) {
+		t.logRecord(span, r)
+	}
+	if !h.handler.Enabled(ctx, r.Level) {
+		return nil
+	}
+	if span != nil && span.spanID != "" {
+		r = r.Clone()
+		r.AddAttrs(slog.String(SlogTraceIDKey, span.traceID), slog.String(SlogSpanIDKey, span.spanID))
+	}
+	return h.handler.Handle(ctx, r)
+}
+
+// WithAttrs returns a SlogHandler wrapping the handler with attrs
+func (h *SlogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &SlogHandler{handler: h.handler.WithAttrs(attrs), opts: h.opts}
+}
+
+// WithGroup returns a SlogHandler wrapping the handler with the group name.
+// The IDs of records logged through it are added inside the group.
+func (h *SlogHandler) WithGroup(name string) slog.Handler {
+	return &SlogHandler{handler: h.handler.WithGroup(name), opts: h.opts}
+}
+
+// logsEvent reports whether records at level are logged as trace events
+func (h *SlogHandler) logsEvent(level slog.Level) bool {
+	return h.opts.EventLevel != nil && level >= h.opts.EventLevel.Level()
+}
+
+// currentSpan returns the span in ctx, or else the innermost logged call
+// open on the calling goroutine, or nil when there is neither
+func (t *Tracer) currentSpan(ctx context.Context) *CallContext {
+	if span := FromContext(ctx); span != nil {
+		return span
+	}
+	gid := getGoroutineID()
+	frame := t.openFrame(gid)
+	if frame == nil {
+		return nil
+	}
+	return &CallContext{
+		packageName:  frame.packageName,
+		functionName: frame.funcName,
+		goroutineID:  gid,
+		traceID:      frame.traceID,
+		spanID:       frame.spanID,
+	}
+}
+
+// logRecord logs a LOG event for the slog record r, logged during the call
+// span. Its args are the level, the message and the record's attributes.
+func (t *Tracer) logRecord(span *CallContext, r slog.Record) {
+	args := make(map[string]interface{}, r.NumAttrs()+2)
+	r.Attrs(func(attr slog.Attr) bool {
+		args[attr.Key] = attr.Value.Resolve().Any()
+		return true
+	})
+	args["level"] = r.Level.String()
+	args["msg"] = r.Message
+
+	now := t.clock.Now()
+	t.logEvent(TraceEvent{
+		Event:     "LOG",
+		Timestamp: t.timestamp(now),
+		Class:     span.packageName,
+		Method:    span.functionName,
+		Args:      t.encodeArgs(args),
+		Thread:    threadName(getGoroutineID()),
+		SpanID:    span.spanID,
+		TraceID:   span.traceID,
+	})
+}
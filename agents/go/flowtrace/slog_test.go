@@ -0,0 +1,126 @@
+package flowtrace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// slogRecords returns the records logged as JSON to buf
+func slogRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Invalid record %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestSlogHandlerAddsSpanIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer Stop()
+
+	var buf bytes.Buffer
+	logger := slog.New(NewSlogHandler(slog.NewJSONHandler(&buf, nil), nil))
+
+	logger.Info("starting")
+	outer := Enter("main", "Checkout", nil)
+	logger.Info("in checkout")
+	inner := Enter("main", "Charge", nil)
+	logger.With("order", 7).Info("in charge")
+	inner.Exit(nil)
+
+	// A span handed over in a context is found on any goroutine
+	ctx := ContextWithSpan(context.Background(), outer)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		logger.InfoContext(ctx, "in background")
+	}()
+	<-done
+	outer.Exit(nil)
+
+	records := slogRecords(t, &buf)
+	if len(records) != 4 {
+		t.Fatalf("Expected 4 records, got %d", len(records))
+	}
+	if _, ok := records[0][SlogSpanIDKey]; ok {
+		t.Errorf("Expected no span ID outside any call, got %v", records[0])
+	}
+	for i, want := range []*CallContext{outer, inner, outer} {
+		record := records[i+1]
+		if record[SlogSpanIDKey] != want.SpanID() || record[SlogTraceIDKey] != want.TraceID() {
+			t.Errorf("Expected %q to carry span %s of trace %s, got %v", record["msg"], want.SpanID(), want.TraceID(), record)
+		}
+	}
+	if records[2]["order"] != float64(7) {
+		t.Errorf("Expected the logger's attributes to be kept, got %v", records[2])
+	}
+}
+
+func TestSlogHandlerEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path, Redact: []string{"card"}}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	logger := slog.New(NewSlogHandler(slog.NewJSONHandler(&buf, nil), &SlogHandlerOptions{EventLevel: slog.LevelError}))
+
+	ctx := Enter("main", "Charge", nil)
+	logger.Info("charging")
+	logger.Error("payment declined", "card", "4111", "attempt", 2)
+	ctx.Exit(nil)
+	logger.Error("outside any call")
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	var logs []TraceEvent
+	for _, event := range readTrace(t, path) {
+		if event.Event == "LOG" {
+			logs = append(logs, event)
+		}
+	}
+	if len(logs) != 1 {
+		t.Fatalf("Expected a LOG event for the error in Charge only, got %+v", logs)
+	}
+	event := logs[0]
+	if event.Method != "Charge" || event.SpanID != ctx.SpanID() || event.TraceID != ctx.TraceID() {
+		t.Errorf("Expected the event to belong to Charge, got %+v", event)
+	}
+	var args map[string]interface{}
+	if err := json.Unmarshal(event.Args, &args); err != nil {
+		t.Fatalf("Invalid args %s: %v", event.Args, err)
+	}
+	if args["msg"] != "payment declined" || args["level"] != "ERROR" || args["attempt"] != float64(2) || args["card"] != redactedValue {
+		t.Errorf("Expected the record's level, message and redacted attributes, got %v", args)
+	}
+
+	if records := slogRecords(t, &buf); len(records) != 3 {
+		t.Errorf("Expected all 3 records to reach the wrapped handler, got %d", len(records))
+	}
+}
+
+func TestSlogHandlerWithoutTracer(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewSlogHandler(slog.NewJSONHandler(&buf, nil), &SlogHandlerOptions{EventLevel: slog.LevelError}))
+
+	logger.Error("no tracer")
+	if records := slogRecords(t, &buf); len(records) != 1 || records[0][SlogSpanIDKey] != nil {
+		t.Errorf("Expected the record to pass through unchanged, got %v", records)
+	}
+}
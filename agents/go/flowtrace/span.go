@@ -0,0 +1,127 @@
+package flowtrace
+
+import "sync"
+
+// FlowTrace is a tracer for code that creates spans explicitly with
+// StartSpan instead of being instrumented. Each FlowTrace writes to its own
+// output, independently of the global tracer of Start.
+type FlowTrace struct {
+	tracer *Tracer
+	err    error
+}
+
+// New creates a FlowTrace writing to the outputs of config. If the tracer
+// cannot be created, e.g. because the log file cannot be opened, the
+// FlowTrace records nothing and Err reports why.
+func New(config Config) *FlowTrace {
+	tracer, err := NewTracer(config)
+	if err != nil {
+		return &FlowTrace{err: err}
+	}
+	return &FlowTrace{tracer: tracer}
+}
+
+// Err returns the error that kept New from creating the tracer, or nil
+func (ft *FlowTrace) Err() error {
+	return ft.err
+}
+
+// Close flushes and closes the outputs. Spans ended afterwards are dropped.
+func (ft *FlowTrace) Close() error {
+	if ft.tracer == nil {
+		return nil
+	}
+	return ft.tracer.Close()
+}
+
+// StartSpan logs the ENTER event of a span named name. Spans started on the
+// same goroutine before this one is ended become its children.
+func (ft *FlowTrace) StartSpan(name string) *Span {
+	return startSpan(ft.tracer, name)
+}
+
+// StartSpan starts a span named name on the global tracer, as
+// FlowTrace.StartSpan does, so it nests in the calls traced by Start, e.g.
+// the request span of a framework middleware. Without a running tracer the
+// span records nothing.
+func StartSpan(name string) *Span {
+	return startSpan(globalTracer.Load(), name)
+}
+
+// startSpan starts a span named name on t, which may be nil
+func startSpan(t *Tracer, name string) *Span {
+	span := &Span{tracer: t, name: name}
+	if t != nil {
+		span.goroutineID = getGoroutineID()
+		span.frame = t.enter(span.goroutineID, "", name, nil, TraceParent{}, sourceLocation{})
+	}
+	return span
+}
+
+// Span is a unit of work started by FlowTrace.StartSpan. Tags and the
+// error are logged with its EXIT event when End is called.
+type Span struct {
+	tracer      *Tracer
+	name        string
+	goroutineID int64
+	frame       *spanFrame
+
+	mutex sync.Mutex
+	tags  map[string]interface{}
+	err   error
+	ended bool
+}
+
+// SetTag sets a tag logged in the result of the EXIT event; setting a key
+// again replaces its value
+func (s *Span) SetTag(key string, value interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.tags == nil {
+		s.tags = make(map[string]interface{})
+	}
+	s.tags[key] = value
+}
+
+// SetError marks the span as failed with err, which the EXIT event reports
+// with isError set. A nil err is ignored.
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.err = err
+}
+
+// End logs the EXIT event of the span with its tags and error. Spans may be
+// ended in any order and from any goroutine. Calls after the first are
+// ignored, so End can be both deferred and called early.
+func (s *Span) End() {
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	var result interface{}
+	if len(s.tags) > 0 {
+		result = s.tags
+	}
+	err := s.err
+	s.mutex.Unlock()
+
+	if s.tracer != nil {
+		s.tracer.exitSpan(s.goroutineID, s.frame, "", s.name, result, err)
+	}
+}
+
+// SpanID returns the span ID of the span, or "" when it was not sampled
+func (s *Span) SpanID() string {
+	if s.frame == nil {
+		return ""
+	}
+	return s.frame.spanID
+}
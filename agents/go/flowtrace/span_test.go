@@ -0,0 +1,170 @@
+package flowtrace
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSpanTags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	ft := New(Config{LogFile: path})
+	if err := ft.Err(); err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	request := ft.StartSpan("HandleRequest")
+	request.SetTag("user_id", "42")
+	request.SetTag("status", 500)
+
+	query := ft.StartSpan("QueryDB")
+	query.SetTag("rows", 3)
+	query.End()
+
+	// A tag set again keeps its latest value
+	request.SetTag("status", 200)
+	request.End()
+	request.End()
+
+	if err := ft.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	events := readTrace(t, path)
+	if len(events) != 4 {
+		t.Fatalf("Expected 4 events, got %d: %+v", len(events), events)
+	}
+	if events[0].Event != "ENTER" || events[0].Method != "HandleRequest" {
+		t.Errorf("Expected the ENTER of HandleRequest first, got %+v", events[0])
+	}
+	if events[1].ParentSpanID != events[0].SpanID {
+		t.Errorf("Expected QueryDB to be a child of HandleRequest, got parent %q", events[1].ParentSpanID)
+	}
+
+	var tags map[string]interface{}
+	if err := json.Unmarshal(events[3].Result, &tags); err != nil {
+		t.Fatalf("Failed to decode result %s: %v", events[3].Result, err)
+	}
+	if tags["user_id"] != "42" || tags["status"] != float64(200) || len(tags) != 2 {
+		t.Errorf("Expected tags user_id=42 and status=200, got %v", tags)
+	}
+	if events[3].IsError {
+		t.Error("Expected HandleRequest not to be an error")
+	}
+}
+
+func TestSpanEndOutOfOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	ft := New(Config{LogFile: path})
+	if err := ft.Err(); err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	a := ft.StartSpan("a")
+	b := ft.StartSpan("b")
+	a.End()
+	b.End()
+
+	// A span ended on another goroutine leaves the calls open there alone
+	c := ft.StartSpan("c")
+	d := ft.StartSpan("d")
+	done := make(chan struct{})
+	go func() {
+		c.End()
+		close(done)
+	}()
+	<-done
+	d.End()
+
+	if err := ft.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	spans := map[string]string{"a": a.SpanID(), "b": b.SpanID(), "c": c.SpanID(), "d": d.SpanID()}
+	var exits []string
+	for _, event := range readTrace(t, path) {
+		if event.Event != "EXIT" {
+			continue
+		}
+		exits = append(exits, event.Method)
+		if event.SpanID != spans[event.Method] || event.Truncated {
+			t.Errorf("Expected the EXIT of %s to end span %s, got %+v", event.Method, spans[event.Method], event)
+		}
+	}
+	if strings.Join(exits, ",") != "a,b,c,d" {
+		t.Errorf("Expected the spans to exit in the order they were ended, got %v", exits)
+	}
+}
+
+func TestSpanError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	ft := New(Config{LogFile: path})
+
+	span := ft.StartSpan("ChargeCard")
+	span.SetError(errors.New("card declined"))
+	span.SetError(nil)
+	span.End()
+	ft.Close()
+
+	events := readTrace(t, path)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	exit := events[1]
+	if !exit.IsError || exit.Exception != "card declined" {
+		t.Errorf("Expected the EXIT to report the error, got isError=%v exception=%q", exit.IsError, exit.Exception)
+	}
+	if len(exit.Result) != 0 {
+		t.Errorf("Expected no result without tags, got %s", exit.Result)
+	}
+}
+
+func TestNewFailure(t *testing.T) {
+	ft := New(Config{LogFile: filepath.Join(t.TempDir(), "missing", "trace.jsonl")})
+	if ft.Err() == nil {
+		t.Fatal("Expected Err to report the unopenable log file")
+	}
+
+	// A disabled FlowTrace still hands out spans that do nothing
+	span := ft.StartSpan("Noop")
+	span.SetTag("key", "value")
+	span.End()
+	if err := ft.Close(); err != nil {
+		t.Errorf("Expected Close to succeed, got %v", err)
+	}
+}
+
+func TestStartSpanOnGlobalTracer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	// A span started in a traced call is its child
+	ctx := Enter("main", "HandleRequest", nil)
+	span := StartSpan("QueryDB")
+	span.SetTag("rows", 3)
+	span.End()
+	ctx.Exit(nil)
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	events := readTrace(t, path)
+	if len(events) != 4 {
+		t.Fatalf("Expected 4 events, got %d: %+v", len(events), events)
+	}
+	if events[1].Method != "QueryDB" || events[1].ParentSpanID != events[0].SpanID {
+		t.Errorf("Expected QueryDB to be a child of HandleRequest, got %+v", events[1])
+	}
+
+	// Without a running tracer the span does nothing
+	span = StartSpan("Noop")
+	span.SetTag("key", "value")
+	span.End()
+	if span.SpanID() != "" {
+		t.Errorf("Expected no span without a tracer, got %s", span.SpanID())
+	}
+}
@@ -0,0 +1,34 @@
+package flowtrace
+
+import "context"
+
+// spanContextKey is the context.Context key of the active span
+type spanContextKey struct{}
+
+// ContextWithSpan returns a copy of parent carrying span as the active span,
+// so that spans started from the returned context, on any goroutine, become
+// its children
+func ContextWithSpan(parent context.Context, span *CallContext) context.Context {
+	return context.WithValue(parent, spanContextKey{}, span)
+}
+
+// FromContext returns the active span stored in ctx by StartSpanContext or
+// ContextWithSpan, or nil
+func FromContext(ctx context.Context) *CallContext {
+	span, _ := ctx.Value(spanContextKey{}).(*CallContext)
+	return span
+}
+
+// StartSpanContext starts a span named name and returns it with a copy of
+// ctx carrying it. The span is a child of the span in ctx; unlike Enter,
+// this holds when ctx was handed to another goroutine, e.g. one started to
+// process a request in the background. Without a span in ctx the parent is
+// the goroutine's current call as with Enter. The span is logged without a
+// package, so a PackagePrefix or Include filter drops it.
+//
+//	ctx, span := flowtrace.StartSpanContext(ctx, "ProcessOrder")
+//	defer span.Exit(nil)
+func StartSpanContext(ctx context.Context, name string) (context.Context, *CallContext) {
+	span := EnterWithParent(FromContext(ctx).TraceParent(), "", name, nil)
+	return ContextWithSpan(ctx, span), span
+}
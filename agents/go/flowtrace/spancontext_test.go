@@ -0,0 +1,69 @@
+package flowtrace
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestStartSpanContextAcrossGoroutines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	ctx, request := StartSpanContext(context.Background(), "HandleRequest")
+	if FromContext(ctx) != request {
+		t.Fatal("Expected FromContext to return the started span")
+	}
+
+	// The background goroutine has an empty span stack of its own, so only
+	// the context links its spans to the request
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func(ctx context.Context) {
+		defer wg.Done()
+		ctx, job := StartSpanContext(ctx, "ProcessJob")
+		defer job.Exit(nil)
+
+		_, step := StartSpanContext(ctx, "SaveResult")
+		step.Exit(nil)
+	}(ctx)
+	wg.Wait()
+	request.Exit(nil)
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	enters := make(map[string]TraceEvent)
+	for _, event := range readTrace(t, path) {
+		if event.Event == "ENTER" {
+			enters[event.Method] = event
+		}
+	}
+
+	root, job, step := enters["HandleRequest"], enters["ProcessJob"], enters["SaveResult"]
+	if root.SpanID == "" || root.ParentSpanID != "" {
+		t.Fatalf("Expected HandleRequest to be a root span, got %+v", root)
+	}
+	if job.Thread == root.Thread {
+		t.Fatalf("Expected ProcessJob to run on another goroutine, both ran on %s", job.Thread)
+	}
+	if job.ParentSpanID != root.SpanID || job.TraceID != root.TraceID {
+		t.Errorf("Expected ProcessJob to be a child of HandleRequest, got parent %q in trace %q", job.ParentSpanID, job.TraceID)
+	}
+	if step.ParentSpanID != job.SpanID || step.TraceID != root.TraceID {
+		t.Errorf("Expected SaveResult to be a child of ProcessJob, got parent %q in trace %q", step.ParentSpanID, step.TraceID)
+	}
+}
+
+func TestFromContextWithoutSpan(t *testing.T) {
+	if span := FromContext(context.Background()); span != nil {
+		t.Errorf("Expected no span in an empty context, got %+v", span)
+	}
+	if FromContext(context.Background()).TraceParent().IsValid() {
+		t.Error("Expected a nil span to have no trace parent")
+	}
+}
@@ -0,0 +1,56 @@
+package flowtrace
+
+import "time"
+
+// Go runs f in a new goroutine, as a go statement does, and logs a GO_SPAWN
+// event linking the new goroutine to the one calling Go. The event is
+// logged by the new goroutine before f runs. It names the call that
+// spawned the goroutine and carries that call's span and trace IDs, so
+// tools can attach the calls made by f to it.
+func Go(f func()) {
+	t := globalTracer.Load()
+	if t == nil {
+		go f()
+		return
+	}
+
+	parent := getGoroutineID()
+	spawner := t.openFrame(parent)
+	now := t.clock.Now()
+	go func() {
+		t.spawned(parent, getGoroutineID(), spawner, now)
+		f()
+	}()
+}
+
+// openFrame returns the innermost logged call open on goroutine gid, or nil
+func (t *Tracer) openFrame(gid int64) *spanFrame {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stack := t.spans[gid]
+	for i := len(stack) - 1; i >= 0; i-- {
+		if !stack[i].dropped {
+			return stack[i]
+		}
+	}
+	return nil
+}
+
+// spawned logs the GO_SPAWN event of goroutine child, started at time now
+// by goroutine parent during the call spawner
+func (t *Tracer) spawned(parent, child int64, spawner *spanFrame, now time.Time) {
+	event := TraceEvent{
+		Event:        "GO_SPAWN",
+		Timestamp:    t.timestamp(now),
+		Thread:       threadName(child),
+		ParentThread: threadName(parent),
+	}
+	if spawner != nil {
+		event.Class = spawner.packageName
+		event.Method = spawner.funcName
+		event.ParentSpanID = spawner.spanID
+		event.TraceID = spawner.traceID
+	}
+	t.logEvent(event)
+}
@@ -0,0 +1,89 @@
+package flowtrace
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestGoLinksSpawnedGoroutines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	ctx := Enter("main", "Serve", nil)
+	parent := threadName(getGoroutineID())
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		Go(func() {
+			defer wg.Done()
+			Enter("main", "Handle", nil).Exit(nil)
+		})
+	}
+	wg.Wait()
+	ctx.Exit(nil)
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	var serve TraceEvent
+	spawns := make(map[string]TraceEvent)
+	handlers := make(map[string]bool)
+	for _, event := range readTrace(t, path) {
+		switch {
+		case event.Event == "ENTER" && event.Method == "Serve":
+			serve = event
+		case event.Event == "GO_SPAWN":
+			spawns[event.Thread] = event
+		case event.Event == "ENTER" && event.Method == "Handle":
+			handlers[event.Thread] = true
+		}
+	}
+
+	if len(spawns) != 3 {
+		t.Fatalf("Expected 3 GO_SPAWN events for distinct goroutines, got %d", len(spawns))
+	}
+	for child, spawn := range spawns {
+		if spawn.ParentThread != parent || child == parent {
+			t.Errorf("Expected %s to be spawned by %s, got %+v", child, parent, spawn)
+		}
+		if spawn.Class != "main" || spawn.Method != "Serve" || spawn.ParentSpanID != serve.SpanID || spawn.TraceID != serve.TraceID {
+			t.Errorf("Expected the spawn to be linked to the Serve call %s, got %+v", serve.SpanID, spawn)
+		}
+		if !handlers[child] {
+			t.Errorf("Expected Handle to run on spawned goroutine %s", child)
+		}
+	}
+}
+
+func TestGoWithoutSpan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	done := make(chan struct{})
+	Go(func() { close(done) })
+	<-done
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	events := readTrace(t, path)
+	if len(events) != 1 || events[0].Event != "GO_SPAWN" || events[0].ParentThread == "" {
+		t.Fatalf("Expected a single GO_SPAWN event, got %+v", events)
+	}
+	if events[0].ParentSpanID != "" || events[0].Method != "" {
+		t.Errorf("Expected a spawn outside any call to carry no span, got %+v", events[0])
+	}
+}
+
+func TestGoWithoutTracer(t *testing.T) {
+	done := make(chan struct{})
+	Go(func() { close(done) })
+	<-done
+}
@@ -0,0 +1,80 @@
+package flowtrace
+
+import (
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/filter"
+)
+
+// maxStackFrames bounds the frames read for the stack of an exception
+const maxStackFrames = 64
+
+// exceptionStack returns the stack of the goroutine logging an exception,
+// trimmed to user frames, in the format of runtime/debug.Stack without the
+// goroutine header: the function of each frame on a line, followed by its
+// file and line indented by a tab. Called from the deferred function of an
+// instrumented call recovering a panic, it reports where the panic was
+// raised; otherwise, where the exception was logged from.
+func exceptionStack() string {
+	pcs := make([]uintptr, maxStackFrames)
+	n := runtime.Callers(1, pcs)
+
+	var frames []runtime.Frame
+	panicked := false
+	iter := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := iter.Next()
+		if frame.Function == "runtime.gopanic" {
+			// The frames above are the deferred calls run by the panic.
+			// A call re-panicking after its recover adds another gopanic
+			// above the one of the original panic, hence the last one.
+			frames = frames[:0]
+			panicked = true
+		} else {
+			frames = append(frames, frame)
+		}
+		if !more {
+			break
+		}
+	}
+
+	var b strings.Builder
+	leading := !panicked
+	for _, frame := range frames {
+		pkg := funcPackage(frame.Function)
+		// Without a panic, the frames of the agent logging the exception
+		// come first
+		if leading && pkg == agentPackage {
+			continue
+		}
+		leading = false
+		if pkg == "" || filter.IsStdLibPackage(pkg) {
+			continue
+		}
+		b.WriteString(frame.Function)
+		b.WriteString("\n\t")
+		b.WriteString(frame.File)
+		b.WriteByte(':')
+		b.WriteString(strconv.Itoa(frame.Line))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// agentPackage is the import path of this package
+var agentPackage = reflect.TypeOf(Tracer{}).PkgPath()
+
+// funcPackage returns the import path of the package of a function named
+// as by runtime.Frame.Function, e.g. example.com/shop for
+// example.com/shop.(*Cart).Add.func1
+func funcPackage(function string) string {
+	slash := strings.LastIndexByte(function, '/')
+	dot := strings.IndexByte(function[slash+1:], '.')
+	if dot < 0 {
+		return ""
+	}
+	return function[:slash+1+dot]
+}
@@ -0,0 +1,131 @@
+package flowtrace
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// instrumentedCheckout and instrumentedCharge are instrumented by flowctl;
+// charge panics on a nil card
+func instrumentedCheckout(card *string) {
+	var __ft_ctx *CallContext
+	if Enabled() {
+		__ft_ctx = Enter("shop", "Checkout", nil)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			__ft_ctx.ExceptionString(fmt.Sprintf("panic: %v", r))
+			panic(r)
+		}
+	}()
+	defer __ft_ctx.Exit(nil)
+
+	instrumentedCharge(card)
+}
+
+func instrumentedCharge(card *string) int {
+	var __ft_ctx *CallContext
+	if Enabled() {
+		__ft_ctx = Enter("shop", "Charge", nil)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			__ft_ctx.ExceptionString(fmt.Sprintf("panic: %v", r))
+			panic(r)
+		}
+	}()
+	defer __ft_ctx.Exit(nil)
+
+	return len(*card)
+}
+
+func TestExceptionRecordsPanicStack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	func() {
+		defer func() { recover() }()
+		instrumentedCheckout(nil)
+	}()
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	stacks := make(map[string]string)
+	for _, event := range readTrace(t, path) {
+		if event.Event == "EXCEPTION" {
+			stacks[event.Method] = event.Stack
+		}
+	}
+	for _, method := range []string{"Charge", "Checkout"} {
+		stack := stacks[method]
+		if stack == "" {
+			t.Fatalf("Expected a stack on the EXCEPTION of %s, got events %v", method, stacks)
+		}
+
+		// The frame raising the panic comes first, followed by its callers
+		lines := strings.Split(stack, "\n")
+		if want := agentPackage + ".instrumentedCharge"; lines[0] != want {
+			t.Errorf("Expected the stack of %s to start at %s, got:\n%s", method, want, stack)
+		}
+		if !strings.Contains(lines[1], "stack_test.go:") {
+			t.Errorf("Expected the file and line of the panic, got:\n%s", stack)
+		}
+		if !strings.Contains(stack, agentPackage+".instrumentedCheckout\n") {
+			t.Errorf("Expected the caller in the stack of %s, got:\n%s", method, stack)
+		}
+
+		// Standard library frames and the deferred calls of the panic are
+		// trimmed
+		for _, unwanted := range []string{"runtime.", "testing.", "instrumentedCharge.func", "instrumentedCheckout.func", "ExceptionString"} {
+			if strings.Contains(stack, unwanted) {
+				t.Errorf("Expected no %q frame in the stack of %s, got:\n%s", unwanted, method, stack)
+			}
+		}
+	}
+}
+
+func TestExceptionStackWithoutPanic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	ctx := Enter("shop", "Refund", nil)
+	ctx.ExceptionString("refused")
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	// The agent frames logging the exception are trimmed, leaving the
+	// test, which is in the same package, and the standard library
+	for _, event := range readTrace(t, path) {
+		if event.Event == "EXCEPTION" && strings.Contains(event.Stack, "ExceptionString") {
+			t.Errorf("Expected the agent frames to be trimmed, got:\n%s", event.Stack)
+		}
+	}
+}
+
+func TestFuncPackage(t *testing.T) {
+	tests := map[string]string{
+		"main.main":                            "main",
+		"example.com/shop.(*Cart).Add.func1":   "example.com/shop",
+		"example.com/shop/v2.Checkout":         "example.com/shop/v2",
+		"github.com/acme/api.init.0":           "github.com/acme/api",
+		"runtime.gopanic":                      "runtime",
+		"net/http.HandlerFunc.ServeHTTP":       "net/http",
+		"example.com/x.y/pkg.(*T[...]).Method": "example.com/x.y/pkg",
+		"unknown":                              "",
+	}
+	for function, want := range tests {
+		if got := funcPackage(function); got != want {
+			t.Errorf("funcPackage(%q) = %q, want %q", function, got, want)
+		}
+	}
+}
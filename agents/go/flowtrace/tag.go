@@ -0,0 +1,47 @@
+package flowtrace
+
+// Tag attaches key and value to the innermost traced call open on the
+// calling goroutine, typically the instrumented function calling Tag, as in
+// flowtrace.Tag("order_id", id). The EXIT or EXCEPTION event of that call
+// carries its tags; setting a key again replaces its value. Tag does nothing
+// when no call is open on the goroutine or the tracer isn't started.
+func Tag(key string, value interface{}) {
+	if t := globalTracer.Load(); t != nil {
+		t.tag(getGoroutineID(), key, value)
+	}
+}
+
+// Tag is like the package-level Tag but attaches key and value to the call
+// of ctx, whichever call is innermost, e.g. the request of a middleware once
+// its handler has returned. It does nothing once the call has exited.
+func (ctx *CallContext) Tag(key string, value interface{}) {
+	if ctx == nil || ctx.frame == nil {
+		return
+	}
+	if t := globalTracer.Load(); t != nil {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		t.tagFrame(ctx.frame, key, value)
+	}
+}
+
+// tag sets a tag on the innermost call open on goroutine gid. An unsampled
+// call keeps it too, so it doesn't end up on the caller.
+func (t *Tracer) tag(gid int64, key string, value interface{}) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stack := t.spans[gid]
+	if len(stack) == 0 {
+		return
+	}
+	t.tagFrame(stack[len(stack)-1], key, value)
+}
+
+// tagFrame sets a tag on the call of frame; t.mutex must be held
+func (t *Tracer) tagFrame(frame *spanFrame, key string, value interface{}) {
+	if frame.tags == nil {
+		frame.tags = make(map[string]interface{})
+	}
+	frame.tags[key] = value
+}
@@ -0,0 +1,87 @@
+package flowtrace
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestTagAttachesToInnermostCall(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path, Redact: []string{"card"}}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	// Before any call: ignored
+	Tag("ignored", true)
+
+	order := Enter("shop", "PlaceOrder", nil)
+	Tag("order_id", 42)
+	charge := Enter("shop", "Charge", nil)
+	Tag("card", "4111-1111")
+	Tag("attempt", 1)
+	Tag("attempt", 2)
+	charge.Exit(nil)
+	Tag("status", "paid")
+	order.Exit(func() interface{} { return Results{{Value: "ok"}} })
+
+	failed := Enter("shop", "Refund", nil)
+	Tag("order_id", 42)
+	failed.ExceptionString("panic: no payment")
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	tags := make(map[string]string)
+	for _, event := range readTrace(t, path) {
+		if event.Event == "ENTER" {
+			if len(event.Tags) > 0 {
+				t.Errorf("Expected no tags on ENTER, got %s", event.Tags)
+			}
+			continue
+		}
+		tags[event.Method] = string(event.Tags)
+	}
+
+	expected := map[string]string{
+		"Charge":     `{"attempt":2,"card":"\u003credacted\u003e"}`,
+		"PlaceOrder": `{"order_id":42,"status":"paid"}`,
+		"Refund":     `{"order_id":42}`,
+	}
+	for method, want := range expected {
+		if tags[method] != want {
+			t.Errorf("Expected tags %s on %s, got %s", want, method, tags[method])
+		}
+	}
+}
+
+func TestCallContextTagAttachesToItsCall(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	request := Enter("http", "/users/42", nil)
+	handler := Enter("shop", "GetUser", nil)
+	request.Tag("params", map[string]string{"id": "42"})
+	handler.Exit(nil)
+	request.Exit(nil)
+	// After the exit: ignored
+	request.Tag("late", true)
+	var disabled *CallContext
+	disabled.Tag("ignored", true)
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	tags := make(map[string]string)
+	for _, event := range readTrace(t, path) {
+		if event.Event == "EXIT" {
+			tags[event.Method] = string(event.Tags)
+		}
+	}
+	if tags["/users/42"] != `{"params":{"id":"42"}}` || tags["GetUser"] != "" {
+		t.Errorf("Expected the params tag on the request only, got %v", tags)
+	}
+}
@@ -0,0 +1,131 @@
+package flowtrace
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// DefaultMaxBufferedTraces is the number of traces Config.TailSampling
+	// holds at once when Config.MaxBufferedTraces is unset
+	DefaultMaxBufferedTraces = 1000
+
+	// tailMaxTraceEvents bounds the events held for one trace; a trace
+	// growing past it is kept, as if it had failed
+	tailMaxTraceEvents = 10000
+)
+
+// tailSampler holds the events of the traces open under Config.TailSampling
+// until their root calls return. It is guarded by the tracer's mutex.
+type tailSampler struct {
+	maxTraces int
+	traces    map[string]*tailTrace
+}
+
+// tailTrace is a trace whose events are held
+type tailTrace struct {
+	events  []heldEvent
+	roots   int  // root calls of the trace still open
+	keep    bool // written whatever happens: failed, slow or too large
+	spilled bool // too large to hold, its events are written as they happen
+}
+
+// heldEvent is an event waiting for the decision on its trace
+type heldEvent struct {
+	event TraceEvent
+	data  []byte
+}
+
+func newTailSampler(config Config) *tailSampler {
+	maxTraces := config.MaxBufferedTraces
+	if maxTraces == 0 {
+		maxTraces = DefaultMaxBufferedTraces
+	}
+	return &tailSampler{maxTraces: maxTraces, traces: make(map[string]*tailTrace)}
+}
+
+// begin starts holding the events of traceID for a root call of it. It
+// reports false when the buffer is full, in which case the trace is
+// written as it happens.
+func (s *tailSampler) begin(traceID string) bool {
+	if trace, ok := s.traces[traceID]; ok {
+		trace.roots++
+		return true
+	}
+	if len(s.traces) >= s.maxTraces {
+		return false
+	}
+	s.traces[traceID] = &tailTrace{roots: 1}
+	return true
+}
+
+// holdEvent holds an event of a trace under tail sampling, reporting
+// whether it did; t.mutex must be held
+func (t *Tracer) holdEvent(event TraceEvent, data []byte) bool {
+	trace := t.tail.traces[event.TraceID]
+	if trace == nil || trace.spilled {
+		return false
+	}
+	if event.IsError || event.Event == "EXCEPTION" {
+		trace.keep = true
+	}
+	if len(trace.events) == tailMaxTraceEvents {
+		trace.keep, trace.spilled = true, true
+		t.releaseTrace(trace)
+		return false
+	}
+	trace.events = append(trace.events, heldEvent{event: event, data: data})
+	return true
+}
+
+// endTailRoot ends a root call of a trace under tail sampling, returned at
+// time now. Once all its roots have returned, the trace is written if it
+// is to be kept and forgotten otherwise.
+func (t *Tracer) endTailRoot(frame *spanFrame, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	trace := t.tail.traces[frame.traceID]
+	if trace == nil {
+		// Written by Close already
+		return
+	}
+	if threshold := t.config.SlowThreshold; threshold > 0 && now.Sub(frame.startTime) > threshold {
+		trace.keep = true
+	}
+	trace.roots--
+	if trace.roots > 0 {
+		return
+	}
+
+	delete(t.tail.traces, frame.traceID)
+	if trace.keep {
+		t.releaseTrace(trace)
+	}
+}
+
+// releaseTrace writes the events held for trace; t.mutex must be held
+func (t *Tracer) releaseTrace(trace *tailTrace) {
+	for _, held := range trace.events {
+		t.output(held.event, held.data)
+	}
+	trace.events = nil
+}
+
+// releaseOpenTraces writes the traces still held when the tracer closes,
+// oldest first: the program stopped inside them. t.mutex must be held.
+func (t *Tracer) releaseOpenTraces() {
+	open := make([]*tailTrace, 0, len(t.tail.traces))
+	for _, trace := range t.tail.traces {
+		if len(trace.events) > 0 {
+			open = append(open, trace)
+		}
+	}
+	sort.Slice(open, func(i, j int) bool {
+		return open[i].events[0].event.Timestamp < open[j].events[0].event.Timestamp
+	})
+	for _, trace := range open {
+		t.releaseTrace(trace)
+	}
+	clear(t.tail.traces)
+}
@@ -0,0 +1,135 @@
+package flowtrace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// tailTracer returns a tail sampling tracer writing to a buffer, with a
+// fake clock
+func tailTracer(t *testing.T, config Config) (*Tracer, *bytes.Buffer, *fakeClock) {
+	t.Helper()
+
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	config.TailSampling = true
+	config.Clock = clock
+	tracer, err := NewTracer(config)
+	if err != nil {
+		t.Fatalf("NewTracer failed: %v", err)
+	}
+	var buf bytes.Buffer
+	tracer.writer = &buf
+	return tracer, &buf, clock
+}
+
+// tracedMethods returns the methods of the ENTER events in buf
+func tracedMethods(t *testing.T, buf *bytes.Buffer) []string {
+	t.Helper()
+
+	var methods []string
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var event TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Invalid JSON line: %v", err)
+		}
+		if event.Event == "ENTER" {
+			methods = append(methods, event.Method)
+		}
+	}
+	return methods
+}
+
+func TestTailSamplingKeepsSlowAndFailedTraces(t *testing.T) {
+	tracer, buf, clock := tailTracer(t, Config{SlowThreshold: 100 * time.Millisecond})
+	defer tracer.Close()
+
+	// A fast and clean trace
+	tracer.enter(1, "main", "fast", nil, TraceParent{}, sourceLocation{})
+	tracer.enter(1, "main", "child", nil, TraceParent{}, sourceLocation{})
+	tracer.exit(1, "main", "child", nil, nil)
+	clock.Advance(10 * time.Millisecond)
+	tracer.exit(1, "main", "fast", nil, nil)
+	if buf.Len() != 0 {
+		t.Fatalf("Expected the events of a fast trace to be held, got:\n%s", buf.String())
+	}
+
+	// A slow one
+	tracer.enter(1, "main", "slow", nil, TraceParent{}, sourceLocation{})
+	clock.Advance(200 * time.Millisecond)
+	tracer.exit(1, "main", "slow", nil, nil)
+
+	// One whose child returned an error
+	tracer.enter(1, "main", "failing", nil, TraceParent{}, sourceLocation{})
+	tracer.enter(1, "main", "load", nil, TraceParent{}, sourceLocation{})
+	tracer.exit(1, "main", "load", nil, errors.New("not found"))
+	tracer.exit(1, "main", "failing", nil, nil)
+
+	// One that panicked
+	tracer.enter(1, "main", "panicking", nil, TraceParent{}, sourceLocation{})
+	tracer.exception(1, "main", "panicking", errors.New("boom"))
+
+	got := tracedMethods(t, buf)
+	expected := []string{"slow", "failing", "load", "panicking"}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected the calls of %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Expected the calls of %v, got %v", expected, got)
+			break
+		}
+	}
+}
+
+func TestTailSamplingWithoutThresholdKeepsOnlyFailures(t *testing.T) {
+	tracer, buf, clock := tailTracer(t, Config{})
+	defer tracer.Close()
+
+	tracer.enter(1, "main", "slow", nil, TraceParent{}, sourceLocation{})
+	clock.Advance(time.Hour)
+	tracer.exit(1, "main", "slow", nil, nil)
+
+	if buf.Len() != 0 {
+		t.Errorf("Expected a clean trace to be dropped without SlowThreshold, got:\n%s", buf.String())
+	}
+}
+
+func TestTailSamplingSpillsWhenFull(t *testing.T) {
+	tracer, buf, _ := tailTracer(t, Config{MaxBufferedTraces: 1})
+	defer tracer.Close()
+
+	// The first trace is held, the second finds the buffer full and is
+	// written as it happens
+	tracer.enter(1, "main", "held", nil, TraceParent{}, sourceLocation{})
+	tracer.enter(2, "main", "spilled", nil, TraceParent{}, sourceLocation{})
+	if got := tracedMethods(t, buf); len(got) != 1 || got[0] != "spilled" {
+		t.Fatalf("Expected only the trace past the limit to be written, got %v", got)
+	}
+	tracer.exit(2, "main", "spilled", nil, nil)
+	tracer.exit(1, "main", "held", nil, nil)
+
+	// The held trace was fast and clean, so the buffer is free again
+	buf.Reset()
+	tracer.enter(3, "main", "next", nil, TraceParent{}, sourceLocation{})
+	if buf.Len() != 0 {
+		t.Errorf("Expected the next trace to be held, got:\n%s", buf.String())
+	}
+}
+
+func TestTailSamplingWritesOpenTracesOnClose(t *testing.T) {
+	tracer, buf, _ := tailTracer(t, Config{})
+
+	tracer.enter(1, "main", "serve", nil, TraceParent{}, sourceLocation{})
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if got := tracedMethods(t, buf); len(got) != 1 || got[0] != "serve" {
+		t.Errorf("Expected the open trace to be written at close, got %v", got)
+	}
+}
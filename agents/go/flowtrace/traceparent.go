@@ -0,0 +1,101 @@
+package flowtrace
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TraceParentHeader is the W3C Trace Context header carrying the caller's span
+const TraceParentHeader = "traceparent"
+
+// TraceParent is a parsed W3C traceparent header
+// (https://www.w3.org/TR/trace-context/#traceparent-header)
+type TraceParent struct {
+	// TraceID is the 32 hex character ID shared by all spans of a trace
+	TraceID string
+	// ParentID is the 16 hex character span ID of the remote caller
+	ParentID string
+	// Flags holds the trace flags; bit 0 is the sampled flag
+	Flags byte
+}
+
+// ParseTraceParent parses a version 00 traceparent header value such as
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01". Higher versions
+// are accepted as long as they start with the version 00 fields.
+func ParseTraceParent(header string) (TraceParent, error) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 {
+		return TraceParent{}, fmt.Errorf("invalid traceparent %q: expected 4 fields", header)
+	}
+
+	version, traceID, parentID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isLowerHex(version, 2) || version == "ff" {
+		return TraceParent{}, fmt.Errorf("invalid traceparent version %q", version)
+	}
+	if version == "00" && len(parts) != 4 {
+		return TraceParent{}, fmt.Errorf("invalid traceparent %q: unexpected fields", header)
+	}
+	if !isLowerHex(traceID, 32) || traceID == strings.Repeat("0", 32) {
+		return TraceParent{}, fmt.Errorf("invalid trace ID %q", traceID)
+	}
+	if !isLowerHex(parentID, 16) || parentID == strings.Repeat("0", 16) {
+		return TraceParent{}, fmt.Errorf("invalid parent ID %q", parentID)
+	}
+	if !isLowerHex(flags, 2) {
+		return TraceParent{}, fmt.Errorf("invalid trace flags %q", flags)
+	}
+
+	flagBytes, _ := hex.DecodeString(flags)
+	return TraceParent{TraceID: traceID, ParentID: parentID, Flags: flagBytes[0]}, nil
+}
+
+// String formats tp as a version 00 traceparent header value
+func (tp TraceParent) String() string {
+	return fmt.Sprintf("00-%s-%s-%02x", tp.TraceID, tp.ParentID, tp.Flags)
+}
+
+// IsValid reports whether tp carries a trace ID and parent span ID
+func (tp TraceParent) IsValid() bool {
+	return tp.TraceID != "" && tp.ParentID != ""
+}
+
+// IncomingTraceParent parses the traceparent header of an incoming request,
+// for a middleware to pass to EnterWithParent. A missing or malformed header
+// yields the zero TraceParent, which starts a new trace.
+func IncomingTraceParent(header string) TraceParent {
+	if header == "" {
+		return TraceParent{}
+	}
+	parent, err := ParseTraceParent(header)
+	if err != nil {
+		return TraceParent{}
+	}
+	return parent
+}
+
+// InjectTraceparent sets the traceparent header of an outbound request so the
+// receiving service continues the trace of the call described by ctx. It does
+// nothing when the call is not being traced.
+func InjectTraceparent(ctx *CallContext, req *http.Request) {
+	tp := ctx.TraceParent()
+	if !tp.IsValid() {
+		return
+	}
+	req.Header.Set(TraceParentHeader, tp.String())
+}
+
+// isLowerHex reports whether s is exactly n lowercase hex characters
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
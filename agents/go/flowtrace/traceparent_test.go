@@ -0,0 +1,201 @@
+package flowtrace
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    TraceParent
+		wantErr bool
+	}{
+		{
+			name:   "sampled",
+			header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			want:   TraceParent{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", ParentID: "00f067aa0ba902b7", Flags: 0x01},
+		},
+		{
+			name:   "future version with extra fields",
+			header: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra",
+			want:   TraceParent{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", ParentID: "00f067aa0ba902b7"},
+		},
+		{name: "empty", header: "", wantErr: true},
+		{name: "too few fields", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-01", wantErr: true},
+		{name: "invalid version", header: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", wantErr: true},
+		{name: "extra fields in version 00", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-x", wantErr: true},
+		{name: "uppercase trace ID", header: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", wantErr: true},
+		{name: "zero trace ID", header: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", wantErr: true},
+		{name: "zero parent ID", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", wantErr: true},
+		{name: "short parent ID", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa-01", wantErr: true},
+		{name: "invalid flags", header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTraceParent(tt.header)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error for %q, got %+v", tt.header, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTraceParentString(t *testing.T) {
+	header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tp, err := ParseTraceParent(header)
+	if err != nil {
+		t.Fatalf("ParseTraceParent failed: %v", err)
+	}
+	if tp.String() != header {
+		t.Errorf("Expected %s, got %s", header, tp.String())
+	}
+}
+
+// readTrace decodes the events of a JSONL trace file, but for the METADATA
+// event starting it
+func readTrace(t *testing.T, path string) []TraceEvent {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open trace: %v", err)
+	}
+	defer f.Close()
+
+	var events []TraceEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Invalid trace line: %v", err)
+		}
+		if event.Event == "METADATA" {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestHTTPMiddlewareContinuesIncomingTrace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	handler := HTTPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := Enter("main", "LoadUser", nil)
+		ctx.Exit(nil)
+	}))
+
+	req := httptest.NewRequest("GET", "/users/42", nil)
+	req.Header.Set(TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	events := readTrace(t, path)
+	if len(events) != 4 {
+		t.Fatalf("Expected 4 events, got %d", len(events))
+	}
+	for _, event := range events {
+		if event.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("Expected %s %s to carry the incoming trace ID, got %q", event.Event, event.Method, event.TraceID)
+		}
+	}
+	if events[0].ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("Expected request span to be parented to the remote caller, got %q", events[0].ParentSpanID)
+	}
+	if events[1].ParentSpanID != events[0].SpanID {
+		t.Errorf("Expected LoadUser to be a child of the request span")
+	}
+}
+
+func TestEnterStartsNewTrace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	first := Enter("main", "First", nil)
+	first.Exit(nil)
+	second := Enter("main", "Second", nil)
+	second.Exit(nil)
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	if len(first.TraceID()) != 32 {
+		t.Errorf("Expected a 32 character trace ID, got %q", first.TraceID())
+	}
+	if first.TraceID() == second.TraceID() {
+		t.Error("Expected separate root calls to start separate traces")
+	}
+	for _, event := range readTrace(t, path) {
+		if event.ParentSpanID != "" {
+			t.Errorf("Expected %s %s to be a root, got parent %q", event.Event, event.Method, event.ParentSpanID)
+		}
+	}
+}
+
+func TestInjectTraceparent(t *testing.T) {
+	if err := Start(Config{LogFile: filepath.Join(t.TempDir(), "trace.jsonl")}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer Stop()
+
+	ctx := Enter("main", "CallUpstream", nil)
+	defer ctx.Exit(nil)
+
+	req := httptest.NewRequest("GET", "http://upstream/users", nil)
+	InjectTraceparent(ctx, req)
+
+	tp, err := ParseTraceParent(req.Header.Get(TraceParentHeader))
+	if err != nil {
+		t.Fatalf("Injected header is invalid: %v", err)
+	}
+	if tp.TraceID != ctx.TraceID() {
+		t.Errorf("Expected trace ID %s, got %s", ctx.TraceID(), tp.TraceID)
+	}
+	if tp.ParentID != ctx.SpanID() {
+		t.Errorf("Expected parent ID %s, got %s", ctx.SpanID(), tp.ParentID)
+	}
+}
+
+func TestInjectTraceparentWithoutTracer(t *testing.T) {
+	ctx := Enter("main", "CallUpstream", nil)
+	req := httptest.NewRequest("GET", "http://upstream/users", nil)
+	InjectTraceparent(ctx, req)
+
+	if got := req.Header.Get(TraceParentHeader); got != "" {
+		t.Errorf("Expected no traceparent header, got %q", got)
+	}
+}
+
+func TestIncomingTraceParentIgnoresMalformedHeader(t *testing.T) {
+	for _, header := range []string{"", "garbage", "00-xyz-00f067aa0ba902b7-01"} {
+		if parent := IncomingTraceParent(header); parent.IsValid() {
+			t.Errorf("Expected no parent for %q, got %+v", header, parent)
+		}
+	}
+}
@@ -2,65 +2,327 @@
 package flowtrace
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand/v2"
 	"os"
-	"runtime"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// SchemaVersion is the version of the event format, written on every event
+// so readers can tell trace files of different agents apart. It is bumped
+// when fields are added or change meaning; events without it are version 1,
+// written before the field existed. Version 3 added cancelled and
+// cancelReason, version 4 tags, version 5 stack, version 6 the METADATA
+// event, version 7 the CHANNEL event. traceio/schema.json describes the
+// current version.
+const SchemaVersion = 7
+
 // TraceEvent represents a single trace event
 type TraceEvent struct {
-	Event          string  `json:"event"`              // ENTER, EXIT, EXCEPTION
-	Timestamp      int64   `json:"timestamp"`          // Unix timestamp in microseconds
-	Class          string  `json:"class"`              // Package name
-	Method         string  `json:"method"`             // Function name
-	Args           string  `json:"args,omitempty"`     // String representation of arguments
-	Result         string  `json:"result,omitempty"`   // String representation of result
-	Exception      string  `json:"exception,omitempty"` // Exception message
-	DurationMillis int64   `json:"durationMillis"`     // Duration in milliseconds (ALWAYS included for compatibility)
-	DurationMicros int64   `json:"durationMicros"`     // Duration in microseconds (ALWAYS included for compatibility)
-	Thread         string  `json:"thread"`             // Thread/goroutine name
+	Event          string          `json:"event"`                   // ENTER, EXIT, EXCEPTION, GO_SPAWN, CAPTURE, LOG, METADATA, CHANNEL
+	Timestamp      int64           `json:"timestamp"`               // Unix timestamp in microseconds (nanoseconds with TimeUnit nanos)
+	Class          string          `json:"class"`                   // Package name
+	Method         string          `json:"method"`                  // Function name
+	File           string          `json:"file,omitempty"`          // Source file defining the function (ENTER only)
+	Line           int             `json:"line,omitempty"`          // Line of the function declaration (ENTER only)
+	Args           json.RawMessage `json:"args,omitempty"`          // Arguments as a JSON object (a %v string with LegacyArgFormat)
+	Result         json.RawMessage `json:"result,omitempty"`        // Return values as JSON (a %v string with LegacyArgFormat)
+	ResultNames    []string        `json:"resultNames,omitempty"`   // Declared names of the results, if any (EXIT only)
+	Exception      string          `json:"exception,omitempty"`     // Exception message, or the error returned on EXIT
+	IsError        bool            `json:"isError,omitempty"`       // EXIT of a call that returned a non-nil error
+	DurationMillis int64           `json:"durationMillis"`          // Duration in milliseconds (ALWAYS included for compatibility)
+	DurationMicros int64           `json:"durationMicros"`          // Duration in microseconds (ALWAYS included for compatibility)
+	DurationNanos  int64           `json:"durationNanos,omitempty"` // Duration in nanoseconds (TimeUnit nanos only)
+	Thread         string          `json:"thread"`                  // Thread/goroutine name
+	Depth          int             `json:"depth,omitempty"`         // Calls open below this one on Thread, 0 for a root (ENTER, EXIT, EXCEPTION)
+	SpanID         string          `json:"spanId,omitempty"`        // Unique ID of the call this event belongs to
+	ParentSpanID   string          `json:"parentSpanId,omitempty"`  // Span ID of the calling function, empty for roots
+	TraceID        string          `json:"traceId,omitempty"`       // ID shared by all calls of one trace
+	Truncated      bool            `json:"truncated,omitempty"`     // EXIT logged by Close for a call that never returned
+	ParentThread   string          `json:"parentThread,omitempty"`  // Goroutine that started Thread (GO_SPAWN only)
+	Cancelled      bool            `json:"cancelled,omitempty"`     // The call's context was done before it returned (see WatchContext)
+	CancelReason   string          `json:"cancelReason,omitempty"`  // Error of the done context, e.g. "context canceled"
+	Tags           json.RawMessage `json:"tags,omitempty"`          // Tags set by Tag during the call, as a JSON object (EXIT, EXCEPTION)
+	Stack          string          `json:"stack,omitempty"`         // User frames of the goroutine where the panic was raised (EXCEPTION only)
+	Metadata       *Metadata       `json:"metadata,omitempty"`      // Service and process the trace was recorded by (METADATA only)
+	SchemaVersion  int             `json:"schemaVersion,omitempty"` // SchemaVersion, set when the event is logged
 }
 
 // Tracer manages function tracing
 type Tracer struct {
-	config    Config
-	logFile   *os.File
-	mutex     sync.Mutex
-	callStack map[int64]time.Time // goroutine ID -> call start time
+	config     Config
+	logFile    *os.File
+	writer     io.Writer    // destination for log lines (logFile or gzipWriter)
+	gzipWriter *gzip.Writer // non-nil when output is compressed
+	format     eventWriter  // encodes events onto writer in Config.Format
+	stdout     eventWriter  // encodes events onto stdout in Config.StdoutFormat
+	otlp       *otlpExporter
+	remote     *remoteWriter // streams events to Config.RemoteAddr
+	clock      Clock         // Config.Clock, or the wall clock
+	metrics    *metrics      // non-nil when Config.Metrics is set
+	tail       *tailSampler  // non-nil when Config.TailSampling is set
+	ring       *ringBuffer   // non-nil when Config.RingBufferSize is set
+	dumpDone   chan struct{} // closed by Close to stop dumping on Config.DumpSignals
+	rules      []samplingRule
+	argRules   []samplingRule
+	packages   *packageFilter
+	functions  *functionFilter
+	redactor   *redactor
+	mutex      sync.Mutex
+	spans      map[int64][]*spanFrame // goroutine ID -> stack of open calls
+	overflow   map[int64]bool         // goroutines whose stack went past MaxDepth
+	closed     bool                   // set by Close; later events are dropped
+
+	hooks atomic.Pointer[[]EventHook] // registered by AddHook, replaced on every registration
+}
+
+// spanFrame is an open call on a goroutine's span stack
+type spanFrame struct {
+	packageName  string
+	funcName     string
+	spanID       string
+	parentSpanID string // nearest logged caller, or the remote parent of a root
+	traceID      string
+	startTime    time.Time
+	depth        int  // number of calls below it on the goroutine's stack
+	dropped      bool // not sampled; its enter and exit are not logged
+	argsDropped  bool // logged without args and result (Config.ArgRules)
+	traceDropped bool // the trace was not sampled at its root, so no call of it is logged
+	tailRoot     bool // a root call of a trace held by Config.TailSampling
+
+	// Set by Tag; guarded by the tracer's mutex while the call is open
+	tags map[string]interface{}
+
+	// Context the call runs under, set by WatchContext
+	ctx atomic.Pointer[context.Context]
 }
 
 var (
-	globalTracer *Tracer
+	// globalTracer is read lock-free on every traced call; tracerMutex only
+	// serializes Start and Stop
+	globalTracer atomic.Pointer[Tracer]
 	tracerMutex  sync.Mutex
 )
 
 // NewTracer creates a new tracer instance
 func NewTracer(config Config) (*Tracer, error) {
+	rules, err := compileSamplingRules(config.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	argRules, err := compileSamplingRules(config.ArgRules)
+	if err != nil {
+		return nil, err
+	}
+
+	redactor, err := newRedactor(config.Redact)
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := newEventWriter(config.Format, true)
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := newStdoutWriter(config.StdoutFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	functions, err := newFunctionFilter(config)
+	if err != nil {
+		return nil, err
+	}
+
+	clock := config.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+
 	t := &Tracer{
 		config:    config,
-		callStack: make(map[int64]time.Time),
+		clock:     clock,
+		format:    format,
+		stdout:    stdout,
+		rules:     rules,
+		argRules:  argRules,
+		packages:  newPackageFilter(config),
+		functions: functions,
+		redactor:  redactor,
+		spans:     make(map[int64][]*spanFrame),
+		overflow:  make(map[int64]bool),
 	}
 
-	if config.LogFile != "" {
-		f, err := os.OpenFile(config.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if config.RingBufferSize > 0 {
+		// Events stay in memory; LogFile only receives dumps
+		t.ring = newRingBuffer(config.RingBufferSize)
+		if len(config.DumpSignals) > 0 {
+			t.dumpDone = make(chan struct{})
+			t.dumpOnSignals(config.DumpSignals, t.dumpDone)
+		}
+	} else if config.LogFile != "" {
+		// A JSON array cannot be appended to, so that format starts over
+		flags := os.O_APPEND | os.O_CREATE | os.O_WRONLY
+		if config.Format == FormatJSON {
+			flags = os.O_TRUNC | os.O_CREATE | os.O_WRONLY
+		}
+		f, err := os.OpenFile(config.LogFile, flags, 0644)
 		if err != nil {
 			return nil, fmt.Errorf("failed to open log file: %w", err)
 		}
 		t.logFile = f
+		t.writer = appendFile{f}
+
+		// Appended CSV already has its header
+		if info, err := f.Stat(); err == nil && info.Size() > 0 {
+			t.format, _ = newEventWriter(config.Format, false)
+		}
+
+		// Compressed output: every Close() ends a gzip member, and appending
+		// to an existing .gz file yields a multistream file that gzip readers
+		// decode transparently. Its blocks don't follow lines, so it can't
+		// be shared with another process.
+		if config.Compress || strings.HasSuffix(config.LogFile, ".gz") {
+			t.gzipWriter = gzip.NewWriter(f)
+			t.writer = t.gzipWriter
+		}
+
+	}
+
+	if config.OTLPEndpoint != "" {
+		exporter, err := newOTLPExporter(config.OTLPEndpoint, config)
+		if err != nil {
+			// Close releases what is set up already: the log file and its
+			// gzip writer, and the handler of the dump signals
+			t.Close()
+			return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+		}
+		exporter.nanos = config.TimeUnit == TimeUnitNanos
+		t.otlp = exporter
+	}
+
+	if config.RemoteAddr != "" {
+		remote, err := newRemoteWriter(config.RemoteAddr)
+		if err != nil {
+			// Shuts the OTLP exporter down as well
+			t.Close()
+			return nil, fmt.Errorf("invalid remote address %s: %w", config.RemoteAddr, err)
+		}
+		t.remote = remote
 	}
 
+	if config.TailSampling {
+		t.tail = newTailSampler(config)
+	}
+
+	if config.Metrics {
+		t.metrics = newMetrics(config.MetricsMaxMethods)
+	}
+
+	t.logMetadata()
 	return t, nil
 }
 
+// Close flushes pending output and closes the log file. Calls still open,
+// e.g. because the program exited from inside them or a panic escaped, get
+// a synthetic EXIT marked truncated so the log stays balanced. Events logged
+// after Close, e.g. by calls that were in flight, are dropped.
+func (t *Tracer) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	if open := t.exitOpenSpans(); open > 0 {
+		fmt.Fprintf(os.Stderr, "flowtrace: %d call(s) still open at stop, logged as truncated\n", open)
+	}
+	if t.tail != nil {
+		t.releaseOpenTraces()
+	}
+	t.closed = true
+
+	if t.dumpDone != nil {
+		close(t.dumpDone)
+	}
+
+	// Every output is closed even if another fails, so the log file is
+	// complete whenever it can be
+	var errs []error
+	if t.writer != nil {
+		// Close the JSON array before the file goes away
+		errs = append(errs, t.format.finish(t.writer))
+	}
+
+	if t.otlp != nil {
+		errs = append(errs, t.otlp.shutdown())
+		t.otlp = nil
+	}
+
+	if t.remote != nil {
+		if dropped := t.remote.close(); dropped > 0 {
+			fmt.Fprintf(os.Stderr, "flowtrace: %d event(s) could not be sent to %s and were dropped\n", dropped, t.config.RemoteAddr)
+		}
+	}
+
+	if t.gzipWriter != nil {
+		// Closing the gzip writer writes the footer; without it the file is truncated
+		errs = append(errs, t.gzipWriter.Close())
+		t.gzipWriter = nil
+	}
+
+	if t.logFile != nil {
+		errs = append(errs, t.logFile.Close())
+		t.logFile = nil
+		t.writer = nil
+	}
+
+	return errors.Join(errs...)
+}
+
+// Flush writes buffered output, e.g. of a compressed log file, to the log
+// file and, when Config.Sync is set, commits the file to stable storage, so
+// that a reader sees every event logged so far.
+func (t *Tracer) Flush() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return nil
+	}
+
+	if t.gzipWriter != nil {
+		// Ends the current deflate block so a reader can decode all of it
+		if err := t.gzipWriter.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if t.config.Sync && t.logFile != nil {
+		return t.logFile.Sync()
+	}
+
+	return nil
+}
+
 // Start initializes global tracing
 func Start(config Config) error {
 	tracerMutex.Lock()
 	defer tracerMutex.Unlock()
 
-	if globalTracer != nil {
+	if globalTracer.Load() != nil {
 		return fmt.Errorf("tracer already started")
 	}
 
@@ -69,136 +331,410 @@ func Start(config Config) error {
 		return err
 	}
 
-	globalTracer = t
+	globalTracer.Store(t)
 	return nil
 }
 
-// Stop terminates tracing
+// Stop terminates tracing. The tracer is unpublished before it is closed,
+// so new calls stop tracing immediately; Close waits for events being
+// written and drops those of calls still in flight.
 func Stop() error {
 	tracerMutex.Lock()
 	defer tracerMutex.Unlock()
 
-	if globalTracer == nil {
+	t := globalTracer.Swap(nil)
+	if t == nil {
 		return nil
 	}
+	return t.Close()
+}
 
-	if globalTracer.logFile != nil {
-		if err := globalTracer.logFile.Close(); err != nil {
-			return err
-		}
+// Flush flushes the global tracer; see Tracer.Flush
+func Flush() error {
+	if t := globalTracer.Load(); t != nil {
+		return t.Flush()
 	}
-
-	globalTracer = nil
 	return nil
 }
 
 // TraceEnter logs function entry
 func TraceEnter(packageName, funcName string, args map[string]interface{}) {
-	if globalTracer == nil {
-		return
+	if t := globalTracer.Load(); t != nil {
+		t.enter(getGoroutineID(), packageName, funcName, args, TraceParent{}, sourceLocation{})
+	}
+}
+
+// TraceExit logs function exit
+func TraceExit(packageName, funcName string, result interface{}) {
+	if t := globalTracer.Load(); t != nil {
+		t.exit(getGoroutineID(), packageName, funcName, result, nil)
+	}
+}
+
+// TraceException logs function exception
+func TraceException(packageName, funcName string, err error) {
+	if t := globalTracer.Load(); t != nil {
+		t.exception(getGoroutineID(), packageName, funcName, err)
 	}
+}
 
-	gid := getGoroutineID()
-	now := time.Now()
+// enter pushes a new span for goroutine gid and logs an ENTER event.
+// It must be called directly from the public entry points (TraceEnter, Enter)
+// so that the traced function is the third frame up. A valid remote parent
+// makes the call a root that continues the remote trace. A zero loc is
+// looked up from the traced function.
+func (t *Tracer) enter(gid int64, packageName, funcName string, args map[string]interface{}, remote TraceParent, loc sourceLocation) *spanFrame {
+	now := t.clock.Now()
 
-	globalTracer.mutex.Lock()
-	globalTracer.callStack[gid] = now
-	globalTracer.mutex.Unlock()
+	// Filtered and unsampled calls still get a frame so their exit is dropped as well
+	frame := &spanFrame{packageName: packageName, funcName: funcName, startTime: now}
 
-	// Convert args map to string representation
-	argsStr := fmt.Sprintf("%v", args)
+	t.mutex.Lock()
+	stack := t.spans[gid]
+	frame.depth = len(stack)
+
+	switch {
+	case remote.IsValid():
+		frame.traceID = remote.TraceID
+		frame.parentSpanID = remote.ParentID
+	case len(stack) > 0:
+		frame.traceID = stack[len(stack)-1].traceID
+		frame.parentSpanID = openSpanID(stack)
+	default:
+		frame.traceID = newTraceID()
+	}
+
+	root := len(stack) == 0 || remote.IsValid()
+	if !root {
+		frame.traceDropped = stack[len(stack)-1].traceDropped
+		frame.dropped = frame.traceDropped || !t.traces(packageName, funcName) || !t.sampledByRule(packageName, funcName)
+	} else {
+		frame.traceDropped = !traceSampled(frame.traceID, t.sampleRate(packageName, funcName))
+		frame.dropped = frame.traceDropped || !t.traces(packageName, funcName)
+	}
+	if !frame.dropped {
+		frame.spanID = newSpanID()
+		frame.argsDropped = !t.argsSampled(packageName, funcName)
+	}
+
+	// Calls deeper than MaxDepth are dropped like unsampled ones; the first
+	// one on a goroutine's stack is reported with a marker event
+	depthExceeded := false
+	if t.config.MaxDepth > 0 && len(stack) >= t.config.MaxDepth {
+		frame.spanID = ""
+		frame.dropped = true
+		if !t.overflow[gid] {
+			t.overflow[gid] = true
+			depthExceeded = true
+		}
+	}
+
+	if t.tail != nil && root && !frame.dropped {
+		frame.tailRoot = t.tail.begin(frame.traceID)
+	}
+
+	t.spans[gid] = append(stack, frame)
+	t.mutex.Unlock()
+
+	if depthExceeded {
+		t.logEvent(TraceEvent{
+			Event:        "depth_exceeded",
+			Timestamp:    t.timestamp(now),
+			Class:        packageName,
+			Method:       funcName,
+			Args:         t.encodeValue(map[string]interface{}{"maxDepth": t.config.MaxDepth}),
+			Thread:       threadName(gid),
+			ParentSpanID: frame.parentSpanID,
+			TraceID:      frame.traceID,
+		})
+	}
+
+	if frame.dropped {
+		return frame
+	}
+
+	if loc.file == "" {
+		// Skip enter and the public entry point to reach the traced function
+		loc = callerLocation(2)
+	}
 
 	event := TraceEvent{
-		Event:     "ENTER",
-		Timestamp: now.UnixMicro(),
-		Class:     packageName,
-		Method:    funcName,
-		Args:      argsStr,
-		Thread:    fmt.Sprintf("goroutine-%d", gid),
+		Event:        "ENTER",
+		Timestamp:    t.timestamp(now),
+		Class:        packageName,
+		Method:       funcName,
+		File:         loc.file,
+		Line:         loc.line,
+		Thread:       threadName(gid),
+		Depth:        frame.depth,
+		SpanID:       frame.spanID,
+		ParentSpanID: frame.parentSpanID,
+		TraceID:      frame.traceID,
+	}
+	if !frame.argsDropped {
+		event.Args = t.encodeArgs(args)
 	}
 
-	globalTracer.logEvent(event)
+	t.logEvent(event)
+	return frame
 }
 
-// TraceExit logs function exit
-func TraceExit(packageName, funcName string, result interface{}) {
-	if globalTracer == nil {
+// traces reports whether calls of funcName in packageName pass the package
+// and function filters. The frames of filtered calls are still pushed, so
+// their exits are dropped too and their callees are logged under the
+// nearest logged caller.
+func (t *Tracer) traces(packageName, funcName string) bool {
+	return t.packages.allows(packageName) && t.functions.allows(packageName, funcName)
+}
+
+// exit pops the current span and logs an EXIT event; a non-nil err is the
+// error the call returned
+func (t *Tracer) exit(gid int64, packageName, funcName string, result interface{}, err error) {
+	now := t.clock.Now()
+	t.logExit(gid, t.popSpan(gid), now, packageName, funcName, result, err)
+}
+
+// exitSpan ends frame, an open call of goroutine gid that need not be its
+// innermost, e.g. an explicit span ended out of order or from another
+// goroutine, and logs its EXIT event. A frame no longer open, e.g. ended
+// as truncated by Close, is not logged again.
+func (t *Tracer) exitSpan(gid int64, frame *spanFrame, packageName, funcName string, result interface{}, err error) {
+	now := t.clock.Now()
+	if !t.removeSpan(gid, frame) {
 		return
 	}
+	t.logExit(gid, frame, now, packageName, funcName, result, err)
+}
 
-	gid := getGoroutineID()
-	now := time.Now()
+// logExit logs the EXIT event at time now of frame, a call of goroutine
+// gid already removed from its span stack
+func (t *Tracer) logExit(gid int64, frame *spanFrame, now time.Time, packageName, funcName string, result interface{}, err error) {
+	if frame != nil && frame.dropped {
+		return
+	}
+
+	event := TraceEvent{
+		Event:     "EXIT",
+		Timestamp: t.timestamp(now),
+		Class:     packageName,
+		Method:    funcName,
+		Thread:    threadName(gid),
+	}
+	switch results, ok := result.(Results); {
+	case frame != nil && frame.argsDropped:
+		// Only timing is recorded for this call
+	case ok:
+		event.Result = t.encodeResults(results)
+		event.ResultNames = results.names()
+	default:
+		event.Result = t.encodeValue(t.redactor.value(t.customValue(result)))
+	}
+	if err != nil {
+		event.Exception = err.Error()
+		event.IsError = true
+	}
+	t.setSpanFields(&event, frame, now)
 
-	globalTracer.mutex.Lock()
-	startTime, exists := globalTracer.callStack[gid]
-	if exists {
-		delete(globalTracer.callStack, gid)
+	t.logEvent(event)
+	if frame != nil && frame.tailRoot {
+		t.endTailRoot(frame, now)
 	}
-	globalTracer.mutex.Unlock()
+}
+
+// exception pops the current span and logs an EXCEPTION event carrying
+// the stack it was called from
+func (t *Tracer) exception(gid int64, packageName, funcName string, err error) {
+	now := t.clock.Now()
+	t.logException(gid, t.popSpan(gid), now, packageName, funcName, err)
+}
 
-	var durationMillis, durationMicros int64
-	if exists {
-		elapsed := now.Sub(startTime)
-		durationMicros = elapsed.Microseconds()
-		durationMillis = durationMicros / 1000
+// exceptionSpan ends frame, a call of goroutine gid, with a panic as
+// exitSpan does with a return. exited is set when the call's EXIT was
+// logged already: instrumented code defers Exit after its recover, so Exit
+// runs first on a panic, and the panic is then logged for the same span.
+func (t *Tracer) exceptionSpan(gid int64, frame *spanFrame, exited bool, packageName, funcName string, err error) {
+	now := t.clock.Now()
+	if !t.removeSpan(gid, frame) && !exited {
+		return
 	}
+	t.logException(gid, frame, now, packageName, funcName, err)
+}
 
-	// Convert result to string representation
-	resultStr := fmt.Sprintf("%v", result)
+// logException logs the EXCEPTION event at time now of frame, a call of
+// goroutine gid already removed from its span stack
+func (t *Tracer) logException(gid int64, frame *spanFrame, now time.Time, packageName, funcName string, err error) {
+	if frame != nil && frame.dropped {
+		return
+	}
 
 	event := TraceEvent{
-		Event:          "EXIT",
-		Timestamp:      now.UnixMicro(),
-		Class:          packageName,
-		Method:         funcName,
-		Result:         resultStr,
-		DurationMillis: durationMillis,
-		DurationMicros: durationMicros,
-		Thread:         fmt.Sprintf("goroutine-%d", gid),
+		Event:     "EXCEPTION",
+		Timestamp: t.timestamp(now),
+		Class:     packageName,
+		Method:    funcName,
+		Exception: err.Error(),
+		Thread:    threadName(gid),
+		Stack:     exceptionStack(),
 	}
+	t.setSpanFields(&event, frame, now)
 
-	globalTracer.logEvent(event)
+	t.logEvent(event)
+	if frame != nil && frame.tailRoot {
+		t.endTailRoot(frame, now)
+	}
 }
 
-// TraceException logs function exception
-func TraceException(packageName, funcName string, err error) {
-	if globalTracer == nil {
-		return
+// capture logs a CAPTURE event recording the value of a variable named name
+// during the call of ctx; the value is in args, keyed by name
+func (t *Tracer) capture(ctx *CallContext, name string, value interface{}) {
+	now := t.clock.Now()
+	t.logEvent(TraceEvent{
+		Event:     "CAPTURE",
+		Timestamp: t.timestamp(now),
+		Class:     ctx.packageName,
+		Method:    ctx.functionName,
+		Args:      t.encodeArgs(map[string]interface{}{name: value}),
+		Thread:    threadName(ctx.goroutineID),
+		SpanID:    ctx.spanID,
+		TraceID:   ctx.traceID,
+	})
+}
+
+// exitOpenSpans logs a truncated EXIT for every logged call still on a span
+// stack, innermost first, and returns how many it logged. Goroutines are
+// visited in ID order. t.mutex must be held.
+func (t *Tracer) exitOpenSpans() int {
+	gids := make([]int64, 0, len(t.spans))
+	for gid := range t.spans {
+		gids = append(gids, gid)
 	}
+	sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+
+	now := t.clock.Now()
+	count := 0
+	for _, gid := range gids {
+		stack := t.spans[gid]
+		for i := len(stack) - 1; i >= 0; i-- {
+			frame := stack[i]
+			if frame.dropped {
+				continue
+			}
+			event := TraceEvent{
+				Event:     "EXIT",
+				Timestamp: t.timestamp(now),
+				Class:     frame.packageName,
+				Method:    frame.funcName,
+				Thread:    threadName(gid),
+				Truncated: true,
+			}
+			t.setSpanFields(&event, frame, now)
+			if !t.runHooks(&event) {
+				continue
+			}
+			event.SchemaVersion = SchemaVersion
+			if data, err := json.Marshal(event); err == nil {
+				t.writeEvent(event, data)
+				count++
+			}
+		}
+		delete(t.spans, gid)
+		delete(t.overflow, gid)
+	}
+	return count
+}
 
-	gid := getGoroutineID()
-	now := time.Now()
+// popSpan removes and returns the innermost open span of a goroutine
+func (t *Tracer) popSpan(gid int64) *spanFrame {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 
-	globalTracer.mutex.Lock()
-	startTime, exists := globalTracer.callStack[gid]
-	if exists {
-		delete(globalTracer.callStack, gid)
+	stack := t.spans[gid]
+	if len(stack) == 0 {
+		return nil
 	}
-	globalTracer.mutex.Unlock()
 
-	var durationMillis, durationMicros int64
-	if exists {
-		elapsed := now.Sub(startTime)
-		durationMicros = elapsed.Microseconds()
-		durationMillis = durationMicros / 1000
+	frame := stack[len(stack)-1]
+	stack = stack[:len(stack)-1]
+	if len(stack) == 0 {
+		delete(t.spans, gid)
+		delete(t.overflow, gid)
+	} else {
+		t.spans[gid] = stack
 	}
+	return frame
+}
 
-	event := TraceEvent{
-		Event:          "EXCEPTION",
-		Timestamp:      now.UnixMicro(),
-		Class:          packageName,
-		Method:         funcName,
-		Exception:      err.Error(),
-		DurationMillis: durationMillis,
-		DurationMicros: durationMicros,
-		Thread:         fmt.Sprintf("goroutine-%d", gid),
+// removeSpan removes frame from the span stack of goroutine gid, wherever
+// it is on it, and reports whether it was there
+func (t *Tracer) removeSpan(gid int64, frame *spanFrame) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// The innermost call is the one usually ended, so the stack is
+	// searched from it
+	stack := t.spans[gid]
+	i := len(stack) - 1
+	for i >= 0 && stack[i] != frame {
+		i--
+	}
+	if i < 0 {
+		return false
 	}
 
-	globalTracer.logEvent(event)
+	stack = slices.Delete(stack, i, i+1)
+	if len(stack) == 0 {
+		delete(t.spans, gid)
+		delete(t.overflow, gid)
+	} else {
+		t.spans[gid] = stack
+	}
+	return true
+}
+
+// openSpanID returns the span ID of the innermost logged call on stack, so
+// calls below an unsampled frame are parented to its nearest logged caller
+func openSpanID(stack []*spanFrame) string {
+	for i := len(stack) - 1; i >= 0; i-- {
+		if !stack[i].dropped {
+			return stack[i].spanID
+		}
+	}
+	return ""
+}
+
+// setSpanFields fills span IDs, depth and durations of an EXIT/EXCEPTION event
+func (t *Tracer) setSpanFields(event *TraceEvent, frame *spanFrame, now time.Time) {
+	if frame == nil {
+		return
+	}
+
+	elapsed := now.Sub(frame.startTime)
+	event.DurationMicros = elapsed.Microseconds()
+	event.DurationMillis = event.DurationMicros / 1000
+	if t.config.TimeUnit == TimeUnitNanos {
+		event.DurationNanos = elapsed.Nanoseconds()
+	}
+	event.Depth = frame.depth
+	event.SpanID = frame.spanID
+	event.ParentSpanID = frame.parentSpanID
+	event.TraceID = frame.traceID
+	if ctx := frame.ctx.Load(); ctx != nil {
+		if err := (*ctx).Err(); err != nil {
+			event.Cancelled = true
+			event.CancelReason = err.Error()
+		}
+	}
+	if len(frame.tags) > 0 {
+		event.Tags = t.encodeArgs(frame.tags)
+	}
 }
 
 // logEvent writes event to log file and/or stdout
 func (t *Tracer) logEvent(event TraceEvent) {
+	if !t.runHooks(&event) {
+		return
+	}
+	event.SchemaVersion = SchemaVersion
 	data, err := json.Marshal(event)
 	if err != nil {
 		return
@@ -207,23 +743,66 @@ func (t *Tracer) logEvent(event TraceEvent) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 
-	line := string(data) + "\n"
+	if t.closed {
+		return
+	}
+	t.writeEvent(event, data)
+}
+
+// writeEvent sends an encoded event to the outputs; t.mutex must be held
+func (t *Tracer) writeEvent(event TraceEvent, data []byte) {
+	if t.metrics != nil {
+		t.metrics.observe(event)
+	}
 
-	if t.logFile != nil {
-		t.logFile.WriteString(line)
+	// Events of a trace under tail sampling wait for the decision on it
+	if t.tail != nil && t.holdEvent(event, data) {
+		return
+	}
+	t.output(event, data)
+}
+
+// output writes an event to the collectors and to the log file and stdout,
+// or to the ring buffer in their place; t.mutex must be held
+func (t *Tracer) output(event TraceEvent, data []byte) {
+	if t.otlp != nil {
+		t.otlp.export(event)
+	}
+
+	if t.remote != nil {
+		t.remote.send(data)
+	}
+
+	// The ring buffer takes the place of the log file and stdout
+	if t.ring != nil {
+		t.ring.add(data)
+		return
+	}
+
+	if t.writer != nil {
+		t.format.write(t.writer, event, data)
 	}
 
 	if t.config.Stdout {
-		fmt.Print(line)
+		t.stdout.write(os.Stdout, event, data)
+	}
+}
+
+// newSpanID returns a random 64-bit span ID as 16 hex characters
+func newSpanID() string {
+	id := rand.Uint64()
+	for id == 0 {
+		// An all-zero ID is invalid for OpenTelemetry and W3C trace context
+		id = rand.Uint64()
 	}
+	return fmt.Sprintf("%016x", id)
 }
 
-// getGoroutineID returns the current goroutine ID
-func getGoroutineID() int64 {
-	var buf [64]byte
-	n := runtime.Stack(buf[:], false)
-	// Parse goroutine ID from stack trace
-	var gid int64
-	fmt.Sscanf(string(buf[:n]), "goroutine %d", &gid)
-	return gid
+// newTraceID returns a random 128-bit trace ID as 32 hex characters
+func newTraceID() string {
+	hi, lo := rand.Uint64(), rand.Uint64()
+	for hi == 0 && lo == 0 {
+		hi, lo = rand.Uint64(), rand.Uint64()
+	}
+	return fmt.Sprintf("%016x%016x", hi, lo)
 }
@@ -0,0 +1,624 @@
+package flowtrace
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestTracerCompressedOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		logFile  string
+		compress bool
+	}{
+		{name: "compress flag", logFile: "trace.jsonl", compress: true},
+		{name: "gz suffix", logFile: "trace.jsonl.gz", compress: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.logFile)
+
+			tracer, err := NewTracer(Config{LogFile: path, Compress: tt.compress})
+			if err != nil {
+				t.Fatalf("NewTracer failed: %v", err)
+			}
+
+			methods := []string{"LoadUser", "SaveUser", "DeleteUser"}
+			for _, method := range methods {
+				tracer.logEvent(TraceEvent{Event: "ENTER", Class: "main", Method: method})
+			}
+
+			if err := tracer.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatalf("Failed to open trace file: %v", err)
+			}
+			defer f.Close()
+
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatalf("Trace file is not gzip-compressed: %v", err)
+			}
+			defer gz.Close()
+
+			var events []TraceEvent
+			scanner := bufio.NewScanner(gz)
+			for scanner.Scan() {
+				var event TraceEvent
+				if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+					t.Fatalf("Failed to decode line %q: %v", scanner.Text(), err)
+				}
+				events = append(events, event)
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatalf("Failed to read decompressed trace: %v", err)
+			}
+
+			if len(events) != len(methods)+1 || events[0].Event != "METADATA" {
+				t.Fatalf("Expected the METADATA event and %d events, got %+v", len(methods), events)
+			}
+			for i, method := range methods {
+				if events[i+1].Method != method {
+					t.Errorf("Event %d: expected method %q, got %q", i, method, events[i].Method)
+				}
+			}
+		})
+	}
+}
+
+func TestStopFlushesCompressedOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl.gz")
+
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	TraceEnter("main", "LoadUser", map[string]interface{}{"userID": 42})
+	TraceExit("main", "LoadUser", nil)
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open trace file: %v", err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Trace file is not gzip-compressed: %v", err)
+	}
+
+	lines := 0
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		lines++
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Compressed trace is truncated: %v", err)
+	}
+
+	if lines != 3 {
+		t.Errorf("Expected the METADATA event and 2 events, got %d", lines)
+	}
+}
+
+func TestNewTracerFailureClosesOutputs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl.gz")
+
+	_, err := NewTracer(Config{
+		LogFile:      path,
+		OTLPEndpoint: "localhost:4318",
+		RemoteAddr:   "http://collector:9000",
+	})
+	if err == nil {
+		t.Fatal("Expected NewTracer to reject the remote address")
+	}
+
+	// The gzip stream set up before the failure is ended
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open trace file: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Trace file is not gzip-compressed: %v", err)
+	}
+	if _, err := io.ReadAll(gz); err != nil {
+		t.Errorf("Compressed trace is truncated: %v", err)
+	}
+}
+
+// TestStopWhileTracing stops the tracer while goroutines are emitting
+// events; run with -race to check the global tracer is swapped safely
+func TestStopWhileTracing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl.gz")
+
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	done := make(chan struct{})
+	var wg, started sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		started.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				ctx := Enter("main", "work", map[string]interface{}{"worker": worker})
+				TraceEnter("main", "legacy", nil)
+				TraceExit("main", "legacy", worker)
+				ctx.Exit(nil)
+				if n == 0 {
+					started.Done()
+				}
+			}
+		}(i)
+	}
+
+	// Stop once every goroutine is tracing
+	started.Wait()
+	stopped := make(chan error)
+	go func() { stopped <- Stop() }()
+	if err := <-stopped; err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	close(done)
+	wg.Wait()
+
+	// Everything written before Stop must form a complete gzip stream of
+	// whole JSON lines
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open trace file: %v", err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Trace file is not gzip-compressed: %v", err)
+	}
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		var event TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Corrupt event %q: %v", scanner.Text(), err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Compressed trace is truncated: %v", err)
+	}
+}
+
+// recurse traces a chain of n nested calls
+func recurse(n int) {
+	ctx := Enter("main", "recurse", map[string]interface{}{"n": n})
+	defer ctx.Exit(nil)
+	if n > 1 {
+		recurse(n - 1)
+	}
+}
+
+func TestTracerMaxDepth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path, MaxDepth: 50}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	recurse(200)
+	recurse(60)
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	counts := make(map[string]int)
+	depth, maxDepth := 0, 0
+	for _, event := range readTrace(t, path) {
+		counts[event.Event]++
+		switch event.Event {
+		case "ENTER":
+			depth++
+			if depth > maxDepth {
+				maxDepth = depth
+			}
+		case "EXIT":
+			depth--
+		}
+	}
+
+	if counts["ENTER"] != 100 || counts["EXIT"] != 100 {
+		t.Errorf("Expected 100 balanced enters and exits, got %d enters and %d exits", counts["ENTER"], counts["EXIT"])
+	}
+	if maxDepth != 50 {
+		t.Errorf("Expected deepest logged call at depth 50, got %d", maxDepth)
+	}
+	// One marker per outermost call that went past the cap
+	if counts["depth_exceeded"] != 2 {
+		t.Errorf("Expected 2 depth_exceeded markers, got %d", counts["depth_exceeded"])
+	}
+}
+
+func TestTracerUnlimitedDepth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	recurse(200)
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	if events := readTrace(t, path); len(events) != 400 {
+		t.Errorf("Expected all 400 events without MaxDepth, got %d", len(events))
+	}
+}
+
+// divide is instrumented the way the transformer instruments a function
+// whose last result is an error
+func divide(a, b int) (__ft_ret0 int, __ft_ret1 error) {
+	__ft_ctx := Enter("main", "divide", map[string]interface{}{"a": a, "b": b})
+	defer func() {
+		if __ft_ret1 != nil {
+			__ft_ctx.SetError(__ft_ret1)
+		}
+		__ft_ctx.Exit(func() interface{} {
+			return Results{{Value: __ft_ret0}, {Value: __ft_ret1}}
+		})
+	}()
+	if b == 0 {
+		__ft_ret0, __ft_ret1 = 0, errors.New("division by zero")
+		return
+	}
+	__ft_ret0, __ft_ret1 = a/b, nil
+	return
+}
+
+func TestTracerReturnedError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	divide(10, 2)
+	divide(10, 0)
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	var exits []TraceEvent
+	for _, event := range readTrace(t, path) {
+		if event.Event == "EXIT" {
+			exits = append(exits, event)
+		}
+	}
+	if len(exits) != 2 {
+		t.Fatalf("Expected 2 EXIT events, got %d", len(exits))
+	}
+	if exits[0].IsError || exits[0].Exception != "" {
+		t.Errorf("Expected divide(10, 2) to exit without error, got %+v", exits[0])
+	}
+	if !exits[1].IsError || exits[1].Exception != "division by zero" {
+		t.Errorf("Expected divide(10, 0) to exit with its error, got %+v", exits[1])
+	}
+}
+
+func TestTracerDepth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	ctx := Enter("main", "Run", nil)
+	recurse(3)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recurse(2)
+		}()
+	}
+	wg.Wait()
+	ctx.Exit(nil)
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	// Every goroutine's stack starts at depth 0, and each EXIT carries the
+	// depth of its ENTER
+	open := make(map[string][]int)
+	for _, event := range readTrace(t, path) {
+		stack := open[event.Thread]
+		switch event.Event {
+		case "ENTER":
+			if event.Depth != len(stack) {
+				t.Errorf("Expected %s on %s at depth %d, got %d", event.Method, event.Thread, len(stack), event.Depth)
+			}
+			open[event.Thread] = append(stack, event.Depth)
+		case "EXIT":
+			if len(stack) == 0 || event.Depth != stack[len(stack)-1] {
+				t.Fatalf("Expected the EXIT of %s on %s to match its ENTER depth, got %d", event.Method, event.Thread, event.Depth)
+			}
+			open[event.Thread] = stack[:len(stack)-1]
+		}
+	}
+	if len(open) != 5 {
+		t.Errorf("Expected calls on 5 goroutines, got %d", len(open))
+	}
+}
+
+func TestResultsMatchExitWithValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path, Redact: []string{"token"}}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	divide(10, 2)
+	Enter("main", "divide", nil).ExitWithValues(5, nil)
+	Enter("main", "login", nil).Exit(func() interface{} {
+		return Results{{Name: "token", Value: "secret"}, {Name: "err", Value: nil}}
+	})
+	values := make([]interface{}, 12)
+	for i := range values {
+		values[i] = i
+	}
+	Enter("main", "many", nil).ExitWithValues(values...)
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	var exits []TraceEvent
+	for _, event := range readTrace(t, path) {
+		if event.Event == "EXIT" {
+			exits = append(exits, event)
+		}
+	}
+	if len(exits) != 4 {
+		t.Fatalf("Expected 4 EXIT events, got %d", len(exits))
+	}
+
+	want := `{"result_0":5,"result_1":null}`
+	if string(exits[0].Result) != want || string(exits[1].Result) != want {
+		t.Errorf("Expected instrumented and manual results to be %s, got %s and %s", want, exits[0].Result, exits[1].Result)
+	}
+	if exits[0].ResultNames != nil || exits[1].ResultNames != nil {
+		t.Errorf("Expected unnamed results to have no names, got %v and %v", exits[0].ResultNames, exits[1].ResultNames)
+	}
+
+	if string(exits[2].Result) != `{"result_0":"\u003credacted\u003e","result_1":null}` {
+		t.Errorf("Expected the token result to be redacted by name, got %s", exits[2].Result)
+	}
+	if strings.Join(exits[2].ResultNames, ",") != "token,err" {
+		t.Errorf("Expected the declared result names, got %v", exits[2].ResultNames)
+	}
+
+	many := string(exits[3].Result)
+	if !strings.HasPrefix(many, `{"result_0":0,"result_1":1,"result_2":2,`) || !strings.HasSuffix(many, `"result_10":10,"result_11":11}`) {
+		t.Errorf("Expected results in order, got %s", many)
+	}
+}
+
+func TestTracerCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path, Redact: []string{"secret"}}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	ctx := Enter("main", "Sum", nil)
+	for i := 0; i < 2; i++ {
+		ctx.Capture("i", i)
+	}
+	ctx.Capture("secret", "hunter2")
+	ctx.Exit(nil)
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	events := readTrace(t, path)
+	var captures []string
+	for _, event := range events {
+		if event.Event == "CAPTURE" {
+			if event.SpanID != events[0].SpanID || event.TraceID != events[0].TraceID || event.Method != "Sum" {
+				t.Errorf("Expected the capture to belong to the Sum call, got %+v", event)
+			}
+			captures = append(captures, string(event.Args))
+		}
+	}
+	want := []string{`{"i":0}`, `{"i":1}`, `{"secret":"\u003credacted\u003e"}`}
+	if len(captures) != len(want) {
+		t.Fatalf("Expected captures %v, got %v", want, captures)
+	}
+	for i := range want {
+		if captures[i] != want[i] {
+			t.Errorf("Expected capture %s, got %s", want[i], captures[i])
+		}
+	}
+}
+
+func TestTracerDeferredCalls(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	// What instrumentation with InstrumentDefers generates
+	checkout := func() {
+		ctx := Enter("main", "Checkout", nil)
+		defer ctx.Exit(nil)
+		defer ctx.ExitDeferred()
+		defer func() { Enter("main", "release", nil).Exit(nil) }()
+		defer ctx.EnterDeferred("checkout.func1")
+		defer ctx.ExitDeferred()
+		defer func() {}()
+		defer ctx.EnterDeferred("unlock")
+		Enter("main", "Charge", nil).Exit(nil)
+	}
+	checkout()
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	events := readTrace(t, path)
+	var got []string
+	spans := make(map[string]TraceEvent)
+	for _, event := range events {
+		got = append(got, event.Event+" "+event.Method)
+		if event.Event == "ENTER" {
+			spans[event.Method] = event
+		}
+	}
+	want := []string{
+		"ENTER Checkout", "ENTER Charge", "EXIT Charge",
+		"ENTER unlock", "EXIT unlock",
+		"ENTER checkout.func1", "ENTER release", "EXIT release", "EXIT checkout.func1",
+		"EXIT Checkout",
+	}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Fatalf("Expected events %v, got %v", want, got)
+	}
+
+	outer := spans["Checkout"].SpanID
+	for _, name := range []string{"unlock", "checkout.func1"} {
+		if span := spans[name]; span.ParentSpanID != outer || span.Depth != 1 {
+			t.Errorf("Expected %s to be a child of Checkout at depth 1, got %+v", name, span)
+		}
+	}
+	if spans["release"].ParentSpanID != spans["checkout.func1"].SpanID {
+		t.Errorf("Expected calls made by a deferred call to be its children, got %+v", spans["release"])
+	}
+}
+
+func TestFlushMidRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		logFile string
+	}{
+		{name: "plain", logFile: "trace.jsonl"},
+		{name: "compressed", logFile: "trace.jsonl.gz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.logFile)
+			if err := Start(Config{LogFile: path, Sync: true}); err != nil {
+				t.Fatalf("Start failed: %v", err)
+			}
+			defer Stop()
+
+			for i := 0; i < 50; i++ {
+				TraceEnter("main", "LoadUser", map[string]interface{}{"userID": i})
+				TraceExit("main", "LoadUser", nil)
+			}
+			if err := Flush(); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+
+			// Read the file while the tracer is still running, as a tool
+			// inspecting a live trace would
+			counted := make(chan int)
+			go func() {
+				counted <- countFlushedEvents(t, path)
+			}()
+			if got := <-counted; got != 101 {
+				t.Errorf("Expected the METADATA event and 100 flushed events, got %d", got)
+			}
+		})
+	}
+}
+
+// countFlushedEvents counts the events of a trace file that is still being
+// written; a compressed file then lacks its gzip footer
+func countFlushedEvents(t *testing.T, path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Errorf("Failed to open trace file: %v", err)
+		return 0
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if filepath.Ext(path) == ".gz" {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Errorf("Trace file is not gzip-compressed: %v", err)
+			return 0
+		}
+		r = gz
+	}
+
+	count := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var event TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Errorf("Failed to decode line %q: %v", scanner.Text(), err)
+			return count
+		}
+		count++
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Failed to read trace: %v", err)
+	}
+	return count
+}
+
+func TestStopClosesOpenSpans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	// serve never returns, as if the program exited from inside handle
+	TraceEnter("main", "serve", nil)
+	TraceEnter("main", "handle", nil)
+	TraceEnter("main", "done", nil)
+	TraceExit("main", "done", nil)
+
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	events := readTrace(t, path)
+	if len(events) != 6 {
+		t.Fatalf("Expected 6 events, got %d: %+v", len(events), events)
+	}
+	for _, event := range events {
+		if event.SchemaVersion != SchemaVersion {
+			t.Errorf("Expected schema version %d on every event, got %+v", SchemaVersion, event)
+		}
+	}
+	if events[3].Truncated {
+		t.Error("Expected the EXIT of a returned call not to be truncated")
+	}
+
+	// Open calls are closed innermost first
+	for i, method := range []string{"handle", "serve"} {
+		exit := events[4+i]
+		if exit.Event != "EXIT" || exit.Method != method || !exit.Truncated {
+			t.Errorf("Expected a truncated EXIT of %s, got %+v", method, exit)
+		}
+		enter := events[1-i]
+		if exit.SpanID != enter.SpanID || exit.TraceID != enter.TraceID {
+			t.Errorf("Expected the EXIT of %s to close span %s, got %s", method, enter.SpanID, exit.SpanID)
+		}
+	}
+}
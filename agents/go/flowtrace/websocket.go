@@ -0,0 +1,100 @@
+package flowtrace
+
+// MessageConn is the message API shared by gorilla/websocket,
+// fasthttp/websocket and gofiber/websocket connections
+type MessageConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+}
+
+// WSConn traces a websocket connection. The connection is one span, started
+// by TraceWSConn and ended by End, and every ReadMessage and WriteMessage is
+// a child span of it tagged with the message type and size, whichever
+// goroutine calls it.
+type WSConn struct {
+	conn MessageConn
+	pkg  string
+	span *CallContext
+}
+
+// TraceWSConn starts the span of a websocket connection, logged as pkg.name
+// with args, and returns conn wrapped to trace its messages. Call End when
+// the connection is done, on the goroutine that called TraceWSConn.
+func TraceWSConn(conn MessageConn, pkg, name string, args map[string]interface{}) *WSConn {
+	return &WSConn{
+		conn: conn,
+		pkg:  pkg,
+		span: Enter(pkg, name, args),
+	}
+}
+
+// Span returns the call context of the connection span
+func (c *WSConn) Span() *CallContext {
+	return c.span
+}
+
+// Parent returns the connection span as a parent for work done on behalf of
+// the connection on other goroutines, e.g. a broadcast fanning a message
+// out to other connections:
+//
+//	ctx := flowtrace.EnterWithParent(conn.Parent(), "chat", "Broadcast", nil)
+func (c *WSConn) Parent() TraceParent {
+	return c.span.TraceParent()
+}
+
+// ReadMessage reads the next message, traced as a ReadMessage span whose
+// result holds the message type and size
+func (c *WSConn) ReadMessage() (int, []byte, error) {
+	ctx := EnterWithParent(c.Parent(), c.pkg, "ReadMessage", nil)
+	messageType, data, err := c.conn.ReadMessage()
+	if err != nil {
+		ctx.SetError(err)
+	}
+	ctx.ExitWithValues(map[string]interface{}{
+		"type": messageTypeName(messageType),
+		"size": len(data),
+	})
+	return messageType, data, err
+}
+
+// WriteMessage writes a message, traced as a WriteMessage span whose
+// arguments hold the message type and size
+func (c *WSConn) WriteMessage(messageType int, data []byte) error {
+	ctx := EnterWithParent(c.Parent(), c.pkg, "WriteMessage", map[string]interface{}{
+		"type": messageTypeName(messageType),
+		"size": len(data),
+	})
+	err := c.conn.WriteMessage(messageType, data)
+	if err != nil {
+		ctx.SetError(err)
+	}
+	ctx.ExitWithValues()
+	return err
+}
+
+// End ends the connection span, even while spans started after it on its
+// goroutine are still open, and leaves those open. It does not close the
+// connection.
+func (c *WSConn) End() {
+	if t := globalTracer.Load(); t != nil && c.span.frame != nil {
+		t.exitSpan(c.span.GoroutineID(), c.span.frame, c.span.packageName, c.span.functionName, Results(nil), c.span.err)
+	}
+}
+
+// messageTypeName names the websocket message types of RFC 6455, which the
+// websocket packages use as their message type constants
+func messageTypeName(messageType int) string {
+	switch messageType {
+	case 1:
+		return "text"
+	case 2:
+		return "binary"
+	case 8:
+		return "close"
+	case 9:
+		return "ping"
+	case 10:
+		return "pong"
+	}
+	return "unknown"
+}
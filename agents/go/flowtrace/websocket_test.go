@@ -0,0 +1,178 @@
+package flowtrace
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// memMessage is a message in flight between two memConns
+type memMessage struct {
+	messageType int
+	data        []byte
+}
+
+// memConn is one end of an in-memory websocket connection
+type memConn struct {
+	in  <-chan memMessage
+	out chan<- memMessage
+}
+
+// memConnPair returns the two connected ends of an in-memory connection
+func memConnPair() (*memConn, *memConn) {
+	a, b := make(chan memMessage, 8), make(chan memMessage, 8)
+	return &memConn{in: a, out: b}, &memConn{in: b, out: a}
+}
+
+func (c *memConn) ReadMessage() (int, []byte, error) {
+	msg, ok := <-c.in
+	if !ok {
+		return -1, nil, errors.New("connection closed")
+	}
+	return msg.messageType, msg.data, nil
+}
+
+func (c *memConn) WriteMessage(messageType int, data []byte) error {
+	c.out <- memMessage{messageType, data}
+	return nil
+}
+
+func (c *memConn) Close() {
+	close(c.out)
+}
+
+func TestWSConnTracesMessages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	server, client := memConnPair()
+	client.WriteMessage(1, []byte("hello"))
+	client.Close()
+
+	conn := TraceWSConn(server, "chat", "Connection", map[string]interface{}{"room": "lobby"})
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "hello" {
+		t.Fatalf("Expected to read hello, got %q, %v", data, err)
+	}
+
+	// Fan-out on other goroutines is linked to the connection span
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ctx := EnterWithParent(conn.Parent(), "chat", "Broadcast", nil)
+		conn.WriteMessage(2, []byte{1, 2, 3})
+		ctx.ExitWithValues(nil)
+	}()
+	wg.Wait()
+
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("Expected reading a closed connection to fail")
+	}
+	conn.End()
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	var enters []TraceEvent
+	exits := make(map[string]TraceEvent)
+	for _, event := range readTrace(t, path) {
+		switch event.Event {
+		case "ENTER":
+			enters = append(enters, event)
+		case "EXIT":
+			exits[event.SpanID] = event
+		}
+	}
+	if len(enters) != 5 {
+		t.Fatalf("Expected 5 spans, got %d: %+v", len(enters), enters)
+	}
+
+	connection := enters[0]
+	if connection.Method != "Connection" || connection.ParentSpanID != "" {
+		t.Fatalf("Expected the connection span first, got %+v", connection)
+	}
+
+	// Messages written during the broadcast still belong to the connection
+	for _, event := range enters[1:] {
+		if event.TraceID != connection.TraceID {
+			t.Errorf("Expected %s in the connection's trace, got %s", event.Method, event.TraceID)
+		}
+		if event.ParentSpanID != connection.SpanID {
+			t.Errorf("Expected %s to have the connection as parent, got %q", event.Method, event.ParentSpanID)
+		}
+	}
+
+	var results map[string]map[string]interface{}
+	if err := json.Unmarshal(exits[enters[1].SpanID].Result, &results); err != nil {
+		t.Fatalf("Invalid ReadMessage result: %v", err)
+	}
+	read := results["result_0"]
+	if read["type"] != "text" || read["size"] != float64(5) {
+		t.Errorf("Expected a 5 byte text message, got %v", read)
+	}
+
+	var write map[string]interface{}
+	for _, event := range enters {
+		if event.Method == "WriteMessage" {
+			json.Unmarshal(event.Args, &write)
+		}
+	}
+	if write["type"] != "binary" || write["size"] != float64(3) {
+		t.Errorf("Expected a 3 byte binary message, got %v", write)
+	}
+
+	failed := exits[enters[4].SpanID]
+	if enters[4].Method != "ReadMessage" || !failed.IsError || failed.Exception != "connection closed" {
+		t.Errorf("Expected the failed read to report its error, got %+v", failed)
+	}
+}
+
+func TestWSConnEndWithSpanOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := Start(Config{LogFile: path}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	server, _ := memConnPair()
+	conn := TraceWSConn(server, "chat", "Connection", nil)
+	handler := Enter("chat", "Handle", nil)
+	conn.End()
+	handler.Exit(nil)
+	if err := Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	spans := map[string]string{"Connection": conn.Span().spanID, "Handle": handler.spanID}
+	exits := 0
+	for _, event := range readTrace(t, path) {
+		if event.Event != "EXIT" {
+			continue
+		}
+		exits++
+		if event.SpanID != spans[event.Method] || event.Truncated {
+			t.Errorf("Expected the EXIT of %s to end span %s, got %+v", event.Method, spans[event.Method], event)
+		}
+	}
+	if exits != 2 {
+		t.Errorf("Expected 2 EXIT events, got %d", exits)
+	}
+}
+
+func TestWSConnUntraced(t *testing.T) {
+	server, client := memConnPair()
+	client.WriteMessage(1, []byte("hi"))
+
+	// Without a tracer the wrapper just passes messages through
+	conn := TraceWSConn(server, "chat", "Connection", nil)
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "hi" {
+		t.Errorf("Expected to read hi, got %q, %v", data, err)
+	}
+	if conn.Parent().IsValid() {
+		t.Error("Expected no parent without a tracer")
+	}
+	conn.End()
+}
@@ -4,6 +4,20 @@ import (
 	"go/ast"
 	"go/token"
 	"go/types"
+	"strings"
+)
+
+// Directive is an instrumentation directive from a function's doc comment
+type Directive int
+
+const (
+	// DirectiveNone means the function follows the include/exclude filters
+	DirectiveNone Directive = iota
+	// DirectiveSkip (//flowtrace:skip) never instruments the function
+	DirectiveSkip
+	// DirectiveTrace (//flowtrace:trace) instruments the function even in an
+	// excluded package
+	DirectiveTrace
 )
 
 // Analyzer provides code analysis utilities
@@ -43,12 +57,195 @@ func (a *Analyzer) ShouldInstrument(fn *ast.FuncDecl) bool {
 		return false
 	}
 
+	// Skip functions opted out with //flowtrace:skip
+	if a.Directive(fn) == DirectiveSkip {
+		return false
+	}
+
 	return true
 }
 
+// Directive returns the flowtrace directive in the function's doc comment.
+// Like other Go directives it must start the line with no space after the
+// slashes; when both are present, skip wins.
+func (a *Analyzer) Directive(fn *ast.FuncDecl) Directive {
+	if fn == nil || fn.Doc == nil {
+		return DirectiveNone
+	}
+
+	directive := DirectiveNone
+	for _, comment := range fn.Doc.List {
+		switch directiveName(comment.Text) {
+		case "flowtrace:skip":
+			return DirectiveSkip
+		case "flowtrace:trace":
+			directive = DirectiveTrace
+		}
+	}
+	return directive
+}
+
+// directiveName returns the directive of a "//name args" comment, or ""
+func directiveName(text string) string {
+	text, ok := strings.CutPrefix(text, "//")
+	if !ok || strings.HasPrefix(text, " ") {
+		return ""
+	}
+	name, _, _ := strings.Cut(text, " ")
+	return name
+}
+
+// Capture is a //flowtrace:capture comment in a function body, naming local
+// variables whose values are recorded where the comment stands
+type Capture struct {
+	Pos   token.Pos // start of the comment
+	End   token.Pos // end of the comment
+	Names []string
+}
+
+// Captures returns the //flowtrace:capture comments among comments that lie
+// in body, in source order
+func (a *Analyzer) Captures(body *ast.BlockStmt, comments []*ast.CommentGroup) []Capture {
+	if body == nil {
+		return nil
+	}
+
+	var captures []Capture
+	for _, group := range comments {
+		if group.Pos() < body.Lbrace || group.End() > body.Rbrace {
+			continue
+		}
+		for _, comment := range group.List {
+			if directiveName(comment.Text) != "flowtrace:capture" {
+				continue
+			}
+			_, args, _ := strings.Cut(comment.Text, " ")
+			if names := strings.Fields(args); len(names) > 0 {
+				captures = append(captures, Capture{Pos: comment.Pos(), End: comment.End(), Names: names})
+			}
+		}
+	}
+	return captures
+}
+
+// InScope reports whether name is a variable or constant of fn visible at
+// pos: a receiver, parameter or result of fn or of a function literal
+// around pos, or a local declared before pos in a block around it. Only the
+// syntax is consulted, so package-level names are not in scope.
+func (a *Analyzer) InScope(fn *ast.FuncDecl, pos token.Pos, name string) bool {
+	if name == "_" {
+		return false
+	}
+
+	var declared []*ast.Ident
+	declare := func(idents ...*ast.Ident) {
+		declared = append(declared, idents...)
+	}
+	declareFields := func(fields *ast.FieldList) {
+		if fields == nil {
+			return
+		}
+		for _, field := range fields.List {
+			declare(field.Names...)
+		}
+	}
+	declareStmt := func(stmt ast.Stmt) {
+		switch s := stmt.(type) {
+		case *ast.AssignStmt:
+			if s.Tok == token.DEFINE {
+				for _, lhs := range s.Lhs {
+					if ident, ok := lhs.(*ast.Ident); ok {
+						declare(ident)
+					}
+				}
+			}
+		case *ast.DeclStmt:
+			if gen, ok := s.Decl.(*ast.GenDecl); ok && (gen.Tok == token.VAR || gen.Tok == token.CONST) {
+				for _, spec := range gen.Specs {
+					declare(spec.(*ast.ValueSpec).Names...)
+				}
+			}
+		}
+	}
+	declareBefore := func(stmts []ast.Stmt) {
+		for _, stmt := range stmts {
+			if stmt.End() <= pos {
+				declareStmt(stmt)
+			}
+		}
+	}
+
+	// Visit the nodes enclosing pos, outermost first
+	ast.Inspect(fn, func(n ast.Node) bool {
+		if n == nil || pos < n.Pos() || pos >= n.End() {
+			return false
+		}
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			declareFields(n.Recv)
+			declareFields(n.Type.Params)
+			declareFields(n.Type.Results)
+		case *ast.FuncLit:
+			declareFields(n.Type.Params)
+			declareFields(n.Type.Results)
+		case *ast.BlockStmt:
+			declareBefore(n.List)
+		case *ast.CaseClause:
+			declareBefore(n.Body)
+		case *ast.CommClause:
+			if n.Comm != nil && n.Comm.End() <= pos {
+				declareStmt(n.Comm)
+			}
+			declareBefore(n.Body)
+		case *ast.IfStmt:
+			if n.Init != nil && n.Init.End() <= pos {
+				declareStmt(n.Init)
+			}
+		case *ast.ForStmt:
+			if n.Init != nil && n.Init.End() <= pos {
+				declareStmt(n.Init)
+			}
+		case *ast.SwitchStmt:
+			if n.Init != nil && n.Init.End() <= pos {
+				declareStmt(n.Init)
+			}
+		case *ast.TypeSwitchStmt:
+			if n.Init != nil && n.Init.End() <= pos {
+				declareStmt(n.Init)
+			}
+			if n.Assign.End() <= pos {
+				declareStmt(n.Assign)
+			}
+		case *ast.RangeStmt:
+			if n.Tok == token.DEFINE && n.X.End() <= pos {
+				for _, expr := range []ast.Expr{n.Key, n.Value} {
+					if ident, ok := expr.(*ast.Ident); ok {
+						declare(ident)
+					}
+				}
+			}
+		}
+		return true
+	})
+
+	for _, ident := range declared {
+		if ident.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 // IsTestFile checks if a file is a test file
 func (a *Analyzer) IsTestFile(filename string) bool {
-	return len(filename) > 8 && filename[len(filename)-8:] == "_test.go"
+	return IsTestFile(filename)
+}
+
+// IsTestFile reports whether filename names a Go test file. It is the one
+// test-file check shared by the transformer and the loader, so that
+// Config.InstrumentTests and LoadConfig.Tests agree on what a test file is.
+func IsTestFile(filename string) bool {
+	return strings.HasSuffix(filename, "_test.go")
 }
 
 // HasNamedReturns checks if function has named return values
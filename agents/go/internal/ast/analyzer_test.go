@@ -150,6 +150,50 @@ func Print() {
 	}
 }
 
+func TestHasVariadicParams(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		expected bool
+	}{
+		{
+			name:     "named variadic",
+			source:   "package main\nfunc Sum(prefix string, nums ...int) {}",
+			expected: true,
+		},
+		{
+			name:     "unnamed variadic",
+			source:   "package main\nfunc Sum(string, ...int) {}",
+			expected: true,
+		},
+		{
+			name:     "slice parameter",
+			source:   "package main\nfunc Sum(nums []int) {}",
+			expected: false,
+		},
+		{
+			name:     "no parameters",
+			source:   "package main\nfunc Sum() {}",
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fset := token.NewFileSet()
+			file, err := parser.ParseFile(fset, "test.go", tt.source, 0)
+			if err != nil {
+				t.Fatalf("Failed to parse: %v", err)
+			}
+
+			fn := file.Decls[0].(*ast.FuncDecl)
+			if result := (&Analyzer{}).HasVariadicParams(fn); result != tt.expected {
+				t.Errorf("HasVariadicParams() = %v, want %v", result, tt.expected)
+			}
+		})
+	}
+}
+
 func TestCountReturns(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -388,3 +432,111 @@ func Empty() {
 		}
 	})
 }
+
+func TestDirective(t *testing.T) {
+	tests := []struct {
+		name     string
+		doc      string
+		expected Directive
+	}{
+		{name: "no doc", doc: "", expected: DirectiveNone},
+		{name: "plain doc", doc: "// Load reads a user.\n", expected: DirectiveNone},
+		{name: "skip", doc: "//flowtrace:skip\n", expected: DirectiveSkip},
+		{name: "trace after doc", doc: "// Load reads a user.\n//\n//flowtrace:trace\n", expected: DirectiveTrace},
+		{name: "spaced is not a directive", doc: "// flowtrace:skip\n", expected: DirectiveNone},
+		{name: "prefix of another directive", doc: "//flowtrace:skipped\n", expected: DirectiveNone},
+		{name: "skip wins over trace", doc: "//flowtrace:trace\n//flowtrace:skip\n", expected: DirectiveSkip},
+		{name: "block comment", doc: "/* flowtrace:skip */\n", expected: DirectiveNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := "package main\n" + tt.doc + "func Load() {}\n"
+			fset := token.NewFileSet()
+			file, err := parser.ParseFile(fset, "test.go", source, parser.ParseComments)
+			if err != nil {
+				t.Fatalf("Failed to parse: %v", err)
+			}
+
+			analyzer := NewAnalyzer(fset)
+			if got := analyzer.Directive(file.Decls[0].(*ast.FuncDecl)); got != tt.expected {
+				t.Errorf("Directive() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestInScope(t *testing.T) {
+	source := `package main
+
+var global = 1
+
+func (s *Server) Handle(id int) (n int) {
+	//flowtrace:capture atStart
+	before := 2
+	if ok := id > 0; ok {
+		//flowtrace:capture inIf
+	}
+	for i := 0; i < id; i++ {
+		inner := i
+		//flowtrace:capture inFor
+	}
+	for k, v := range []int{} {
+		//flowtrace:capture inRange
+	}
+	switch x := any(id).(type) {
+	case int:
+		//flowtrace:capture inCase
+	}
+	func(arg string) {
+		//flowtrace:capture inClosure
+	}("")
+	after := before
+	return after
+}
+`
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "test.go", source, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("Failed to parse source: %v", err)
+	}
+	fn := file.Decls[1].(*ast.FuncDecl)
+
+	analyzer := NewAnalyzer(fset)
+	captures := analyzer.Captures(fn.Body, file.Comments)
+	at := make(map[string]token.Pos)
+	for _, capture := range captures {
+		at[capture.Names[0]] = capture.Pos
+	}
+	if len(at) != 6 {
+		t.Fatalf("Expected 6 captures, got %+v", captures)
+	}
+
+	tests := []struct {
+		at      string
+		inScope []string
+		outside []string
+	}{
+		{"atStart", []string{"s", "id", "n"}, []string{"before", "global", "_"}},
+		{"inIf", []string{"before", "ok"}, []string{"after", "i"}},
+		{"inFor", []string{"i", "inner"}, []string{"ok"}},
+		{"inRange", []string{"k", "v"}, []string{"i", "inner"}},
+		{"inCase", []string{"x", "id"}, []string{"k"}},
+		{"inClosure", []string{"arg", "before"}, []string{"x", "after"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.at, func(t *testing.T) {
+			for _, name := range tt.inScope {
+				if !analyzer.InScope(fn, at[tt.at], name) {
+					t.Errorf("Expected %s to be in scope", name)
+				}
+			}
+			for _, name := range tt.outside {
+				if analyzer.InScope(fn, at[tt.at], name) {
+					t.Errorf("Expected %s not to be in scope", name)
+				}
+			}
+		})
+	}
+}
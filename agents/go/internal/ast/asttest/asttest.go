@@ -0,0 +1,168 @@
+// Package asttest checks that instrumenting a program leaves its behavior
+// unchanged, so the transformer can be regression-tested against many
+// functions at once
+package asttest
+
+import (
+	"bytes"
+	"errors"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/ast"
+)
+
+// runtimeStub stands in for the flowtrace package in instrumented programs.
+// Exit reads the results like the tracer does, but nothing is written, so
+// the output of a program is its own.
+const runtimeStub = `package flowtrace
+
+type CallContext struct{}
+
+type Result struct {
+	Name  string
+	Value interface{}
+}
+
+type Results []Result
+
+func Enabled() bool { return true }
+
+func Enter(pkg, fn string, args map[string]interface{}) *CallContext { return &CallContext{} }
+
+func EnterAt(pkg, fn, file string, line int, args map[string]interface{}) *CallContext { return &CallContext{} }
+
+func (ctx *CallContext) Exit(resultFunc func() interface{}) {
+	if resultFunc != nil {
+		resultFunc()
+	}
+}
+
+func (ctx *CallContext) SetError(err error) {}
+
+func (ctx *CallContext) ExceptionString(msg string) {}
+
+func (ctx *CallContext) EnterDeferred(fn string) {}
+
+func (ctx *CallContext) ExitDeferred() {}
+
+func (ctx *CallContext) Capture(name string, value interface{}) {}
+`
+
+// run is the outcome of running a program
+type run struct {
+	Stdout   string
+	ExitCode int
+}
+
+// AssertSemanticEquivalence instruments src, a main package, with the
+// default config and fails t unless the original and instrumented programs
+// print the same standard output and exit with the same code. Standard
+// error is not compared, as a re-raised panic is reported differently. It
+// is skipped in short mode since it invokes the go tool.
+func AssertSemanticEquivalence(t testing.TB, src string) {
+	t.Helper()
+	AssertSemanticEquivalenceWith(t, src, &ast.Config{})
+}
+
+// AssertSemanticEquivalenceWith is AssertSemanticEquivalence with the given
+// transformer config
+func AssertSemanticEquivalenceWith(t testing.TB, src string, config *ast.Config) {
+	t.Helper()
+
+	if testing.Short() {
+		t.Skip("skipping go build in short mode")
+	}
+
+	instrumented, err := Instrument(src, config)
+	if err != nil {
+		t.Fatalf("Failed to instrument source: %v\n%s", err, src)
+	}
+
+	want, err := runProgram(t.TempDir(), map[string]string{
+		"go.mod":  "module example.com/original\n\ngo 1.21\n",
+		"main.go": src,
+	})
+	if err != nil {
+		t.Fatalf("Failed to run the original program: %v", err)
+	}
+	got, err := runProgram(t.TempDir(), map[string]string{
+		"go.mod":                 "module example.com/instrumented\n\ngo 1.21\n\nrequire github.com/rixmerz/flowtrace-agent-go v0.0.0\n\nreplace github.com/rixmerz/flowtrace-agent-go => ./stub\n",
+		"main.go":                instrumented,
+		"stub/go.mod":            "module github.com/rixmerz/flowtrace-agent-go\n\ngo 1.21\n",
+		"stub/flowtrace/stub.go": runtimeStub,
+	})
+	if err != nil {
+		t.Fatalf("Failed to run the instrumented program: %v\n%s", err, instrumented)
+	}
+
+	if got != want {
+		t.Errorf("Instrumentation changed the behavior of the program\noriginal:     %+v\ninstrumented: %+v\n%s", want, got, instrumented)
+	}
+}
+
+// Instrument returns src transformed with config and formatted like the
+// loader writes it
+func Instrument(src string, config *ast.Config) (string, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "main.go", src, parser.ParseComments)
+	if err != nil {
+		return "", err
+	}
+	if err := ast.NewTransformer(fset, config).TransformFile(file); err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, file); err != nil {
+		return "", err
+	}
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+	return string(formatted), nil
+}
+
+// runProgram writes files, a main module, to dir then builds and runs it.
+// A program exiting with an error is a run, not an error; failing to build
+// it is.
+func runProgram(dir string, files map[string]string) (run, error) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return run{}, err
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			return run{}, err
+		}
+	}
+
+	binary := filepath.Join(dir, "program")
+	build := exec.Command("go", "build", "-o", binary, ".")
+	build.Dir = dir
+	build.Env = append(os.Environ(), "GOFLAGS=-mod=mod")
+	if out, err := build.CombinedOutput(); err != nil {
+		return run{}, errors.New(string(bytes.TrimSpace(out)))
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(binary)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return run{}, err
+	}
+	result := run{Stdout: stdout.String()}
+	if exitErr != nil {
+		result.ExitCode = exitErr.ExitCode()
+	}
+	return result, nil
+}
@@ -0,0 +1,212 @@
+package asttest
+
+import (
+	"testing"
+
+	"github.com/rixmerz/flowtrace-agent-go/internal/ast"
+)
+
+func TestSemanticEquivalence(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{
+			name: "defer mutating a named result",
+			source: `package main
+
+import "fmt"
+
+func double(n int) (result int) {
+	defer func() { result *= 2 }()
+	return n + 1
+}
+
+func tally(items []string) (count int, err error) {
+	defer func() {
+		if count > 2 {
+			count, err = 0, fmt.Errorf("too many items: %d", count)
+		}
+	}()
+	for range items {
+		count++
+	}
+	return count, nil
+}
+
+func main() {
+	fmt.Println(double(3))
+	fmt.Println(tally([]string{"a", "b"}))
+	fmt.Println(tally([]string{"a", "b", "c"}))
+}
+`,
+		},
+		{
+			name: "panic recovered into the results",
+			source: `package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+func safeDivide(a, b int) (q int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered: %v", r)
+		}
+	}()
+	return a / b, nil
+}
+
+func mustPositive(n int) int {
+	if n < 0 {
+		panic(errors.New("negative"))
+	}
+	return n
+}
+
+func main() {
+	fmt.Println(safeDivide(6, 3))
+	fmt.Println(safeDivide(1, 0))
+	defer func() { fmt.Println("main recovered:", recover()) }()
+	fmt.Println(mustPositive(4))
+	fmt.Println(mustPositive(-1))
+}
+`,
+		},
+		{
+			name: "unrecovered panic",
+			source: `package main
+
+import "fmt"
+
+func fail() (int, error) {
+	fmt.Println("failing")
+	panic("boom")
+}
+
+func main() {
+	fmt.Println(fail())
+}
+`,
+		},
+		{
+			name: "goto and labels",
+			source: `package main
+
+import "fmt"
+
+func find(grid [][]int, target int) (row, col int) {
+	for i, line := range grid {
+		for j, v := range line {
+			if v == target {
+				row, col = i, j
+				goto found
+			}
+		}
+	}
+	return -1, -1
+found:
+	return row, col
+}
+
+func retry(attempts int) (tries int) {
+again:
+	tries++
+	if tries < attempts {
+		goto again
+	}
+	return tries
+}
+
+func main() {
+	grid := [][]int{{1, 2}, {3, 4}}
+	fmt.Println(find(grid, 4))
+	fmt.Println(find(grid, 5))
+	fmt.Println(retry(3))
+}
+`,
+		},
+		{
+			name: "multi-value call and shadowed results",
+			source: `package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+func parse(kind, s string) (n int, err error) {
+	switch kind {
+	case "hex":
+		if n, err := strconv.ParseInt(s, 16, 64); err == nil {
+			return int(n), nil
+		}
+	case "dec":
+		return strconv.Atoi(s)
+	}
+	return -1, fmt.Errorf("cannot parse %q as %s", s, kind)
+}
+
+func main() {
+	fmt.Println(parse("hex", "ff"))
+	fmt.Println(parse("hex", "zz"))
+	fmt.Println(parse("dec", "12"))
+	fmt.Println(parse("dec", "x"))
+}
+`,
+		},
+		{
+			name: "exit code",
+			source: `package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func check(n int) (ok bool) {
+	defer func() { ok = !ok }()
+	return n%2 == 0
+}
+
+func main() {
+	fmt.Println(check(2), check(3))
+	os.Exit(3)
+}
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			AssertSemanticEquivalence(t, tt.source)
+		})
+	}
+}
+
+func TestSemanticEquivalenceClosuresAndDefers(t *testing.T) {
+	source := `package main
+
+import "fmt"
+
+func counter() (next func() int, total int) {
+	n := 0
+	defer func() { total = n }()
+	next = func() int {
+		n++
+		return n
+	}
+	next()
+	next()
+	return next, n
+}
+
+func main() {
+	next, total := counter()
+	fmt.Println(next(), total)
+}
+`
+	AssertSemanticEquivalenceWith(t, source, &ast.Config{InstrumentClosures: true, InstrumentDefers: true})
+}
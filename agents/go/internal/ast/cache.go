@@ -4,8 +4,10 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"go/ast"
+	"go/printer"
 	"go/token"
 	"sync"
+	"time"
 )
 
 // Cache provides AST transformation caching for performance optimization
@@ -13,6 +15,9 @@ type Cache struct {
 	mu          sync.RWMutex
 	transformed map[string]*CachedAST
 	maxSize     int
+	lookups     int              // calls to Get
+	hits        int              // calls to Get that found an entry
+	now         func() time.Time // clock for LastAccess, replaced in tests
 }
 
 // CachedAST represents a cached AST transformation result
@@ -22,7 +27,8 @@ type CachedAST struct {
 	Hash       string
 	ModTime    int64
 	Hits       int
-	Size       int
+	LastAccess time.Time // when the entry was stored or last returned by Get
+	Size       int       // source size in bytes
 	Compressed bool
 }
 
@@ -34,21 +40,26 @@ func NewCache(maxSize int) *Cache {
 	return &Cache{
 		transformed: make(map[string]*CachedAST),
 		maxSize:     maxSize,
+		now:         time.Now,
 	}
 }
 
 // Get retrieves a cached AST transformation
 func (c *Cache) Get(key string) (*ast.File, *token.FileSet, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	// A write lock, as the hit counter is updated
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
+	c.lookups++
 	cached, ok := c.transformed[key]
 	if !ok {
 		return nil, nil, false
 	}
 
-	// Update hit counter
+	// Update hit counter and recency
+	c.hits++
 	cached.Hits++
+	cached.LastAccess = c.now()
 
 	return cached.File, cached.FileSet, true
 }
@@ -58,22 +69,36 @@ func (c *Cache) Put(key string, file *ast.File, fset *token.FileSet, modTime int
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// Check if we need to evict entries
-	if len(c.transformed) >= c.maxSize {
+	// Check if we need to evict entries; replacing an entry needs no room
+	if _, ok := c.transformed[key]; !ok && len(c.transformed) >= c.maxSize {
 		c.evictLRU()
 	}
 
 	// Calculate hash for validation
-	hash := c.calculateHash(file)
+	hash := c.calculateHash(fset, file)
 
 	// Store in cache
 	c.transformed[key] = &CachedAST{
-		File:    file,
-		FileSet: fset,
-		Hash:    hash,
-		ModTime: modTime,
-		Hits:    0,
+		File:       file,
+		FileSet:    fset,
+		Hash:       hash,
+		ModTime:    modTime,
+		Hits:       0,
+		LastAccess: c.now(),
+		Size:       sourceSize(fset, file),
+	}
+}
+
+// sourceSize estimates the memory held by a cached file by the size of its
+// source
+func sourceSize(fset *token.FileSet, file *ast.File) int {
+	if fset == nil || file == nil {
+		return 0
+	}
+	if tf := fset.File(file.Pos()); tf != nil {
+		return tf.Size()
 	}
+	return 0
 }
 
 // Invalidate removes a specific entry from cache
@@ -97,17 +122,16 @@ func (c *Cache) Stats() CacheStats {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	totalHits := 0
 	totalSize := 0
 
 	for _, cached := range c.transformed {
-		totalHits += cached.Hits
 		totalSize += cached.Size
 	}
 
 	return CacheStats{
 		Entries:   len(c.transformed),
-		TotalHits: totalHits,
+		Lookups:   c.lookups,
+		TotalHits: c.hits,
 		TotalSize: totalSize,
 		MaxSize:   c.maxSize,
 	}
@@ -116,27 +140,28 @@ func (c *Cache) Stats() CacheStats {
 // CacheStats holds cache statistics
 type CacheStats struct {
 	Entries   int
-	TotalHits int
-	TotalSize int
+	Lookups   int // calls to Get, including those of evicted entries
+	TotalHits int // calls to Get that found an entry
+	TotalSize int // source bytes of the cached files
 	MaxSize   int
 }
 
-// HitRate returns the cache hit rate
+// HitRate returns the fraction of lookups that found an entry
 func (s CacheStats) HitRate() float64 {
-	if s.TotalHits == 0 {
+	if s.Lookups == 0 {
 		return 0.0
 	}
-	return float64(s.TotalHits) / float64(s.Entries)
+	return float64(s.TotalHits) / float64(s.Lookups)
 }
 
 // evictLRU removes the least recently used entry
 func (c *Cache) evictLRU() {
 	var lruKey string
-	minHits := -1
+	var oldest time.Time
 
 	for key, cached := range c.transformed {
-		if minHits == -1 || cached.Hits < minHits {
-			minHits = cached.Hits
+		if lruKey == "" || cached.LastAccess.Before(oldest) {
+			oldest = cached.LastAccess
 			lruKey = key
 		}
 	}
@@ -146,19 +171,15 @@ func (c *Cache) evictLRU() {
 	}
 }
 
-// calculateHash computes a hash of the AST for validation
-func (c *Cache) calculateHash(file *ast.File) string {
+// calculateHash computes a hash of the AST for validation, over the whole
+// file as printed
+func (c *Cache) calculateHash(fset *token.FileSet, file *ast.File) string {
 	h := sha256.New()
-
-	// Simple hash based on package name and declarations count
-	h.Write([]byte(file.Name.Name))
-
-	for _, decl := range file.Decls {
-		if fn, ok := decl.(*ast.FuncDecl); ok {
-			h.Write([]byte(fn.Name.Name))
-		}
+	if err := printer.Fprint(h, fset, file); err != nil {
+		// Fall back to the package name, which at least tells files apart
+		// across packages
+		h.Write([]byte(file.Name.Name))
 	}
-
 	return hex.EncodeToString(h.Sum(nil))
 }
 
@@ -0,0 +1,96 @@
+package ast
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+	"time"
+)
+
+// newTestCache returns a cache whose clock advances a second on every read
+func newTestCache(maxSize int) *Cache {
+	c := NewCache(maxSize)
+	now := time.Unix(0, 0)
+	c.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	return c
+}
+
+func parseCacheSource(t *testing.T, source string) (*token.FileSet, *ast.File) {
+	t.Helper()
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "test.go", source, 0)
+	if err != nil {
+		t.Fatalf("Failed to parse source: %v", err)
+	}
+	return fset, file
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	fset, file := parseCacheSource(t, "package app\n")
+	c := newTestCache(2)
+
+	c.Put("a", file, fset, 0)
+	c.Put("b", file, fset, 0)
+
+	// a is hit more often, but b is used last
+	for i := 0; i < 5; i++ {
+		c.Get("a")
+	}
+	c.Get("b")
+
+	c.Put("c", file, fset, 0)
+
+	if _, _, ok := c.Get("a"); ok {
+		t.Error("a was used least recently and should have been evicted")
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, _, ok := c.Get(key); !ok {
+			t.Errorf("%s should still be cached", key)
+		}
+	}
+}
+
+func TestCacheReplaceDoesNotEvict(t *testing.T) {
+	fset, file := parseCacheSource(t, "package app\n")
+	c := newTestCache(2)
+
+	c.Put("a", file, fset, 0)
+	c.Put("b", file, fset, 0)
+	c.Put("a", file, fset, 1)
+
+	if stats := c.Stats(); stats.Entries != 2 {
+		t.Errorf("Entries = %d, want 2", stats.Entries)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	source := "package app\n\nfunc F() {}\n"
+	fset, file := parseCacheSource(t, source)
+	c := newTestCache(10)
+
+	if rate := c.Stats().HitRate(); rate != 0 {
+		t.Errorf("HitRate without lookups = %v, want 0", rate)
+	}
+
+	c.Put("a", file, fset, 0)
+	c.Get("a")
+	c.Get("a")
+	c.Get("a")
+	c.Get("missing")
+
+	stats := c.Stats()
+	if stats.Lookups != 4 || stats.TotalHits != 3 {
+		t.Errorf("Lookups, TotalHits = %d, %d, want 4, 3", stats.Lookups, stats.TotalHits)
+	}
+	if rate := stats.HitRate(); rate != 0.75 {
+		t.Errorf("HitRate = %v, want 0.75", rate)
+	}
+	if stats.TotalSize != len(source) {
+		t.Errorf("TotalSize = %d, want %d", stats.TotalSize, len(source))
+	}
+}
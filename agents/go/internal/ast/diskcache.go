@@ -0,0 +1,159 @@
+package ast
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DiskCacheDir is the directory flowctl instrument keeps its cache in,
+// relative to where it runs
+const DiskCacheDir = ".flowtrace-cache"
+
+// diskCacheVersion is bumped when the instrumentation changes, so that
+// output written by an older flowctl is not reused
+const diskCacheVersion = 4
+
+// DiskCache persists, across instrument runs, the content hashes of the
+// files each run read and wrote. A file whose source and output are both
+// unchanged since they were recorded need not be transformed again.
+type DiskCache struct {
+	mu       sync.Mutex
+	path     string
+	manifest diskManifest
+}
+
+// diskManifest is the file a DiskCache is stored in
+type diskManifest struct {
+	// Config is a hash of the transformer config of the recorded run;
+	// entries recorded under another config are dropped
+	Config string               `json:"config"`
+	Files  map[string]diskEntry `json:"files"`
+}
+
+// diskEntry records the instrumentation of one source file
+type diskEntry struct {
+	SourceHash string `json:"source_hash"` // source as left by the run
+	Output     string `json:"output"`
+	OutputHash string `json:"output_hash"`
+	PkgPath    string `json:"pkg_path"`
+}
+
+// OpenDiskCache loads the cache stored in dir for config. A missing or
+// unreadable cache, or one recorded under a different config, starts
+// out empty.
+func OpenDiskCache(dir string, config *Config) (*DiskCache, error) {
+	configHash, err := hashConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &DiskCache{
+		path: filepath.Join(dir, "manifest.json"),
+		manifest: diskManifest{
+			Config: configHash,
+			Files:  make(map[string]diskEntry),
+		},
+	}
+
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return c, nil
+	}
+	var stored diskManifest
+	if json.Unmarshal(data, &stored) == nil && stored.Config == configHash && stored.Files != nil {
+		c.manifest.Files = stored.Files
+	}
+	return c, nil
+}
+
+// Unchanged reports whether source was instrumented into output, for the
+// package pkgPath, and neither file changed since
+func (c *DiskCache) Unchanged(source, output, pkgPath string) bool {
+	c.mu.Lock()
+	entry, ok := c.manifest.Files[source]
+	c.mu.Unlock()
+
+	if !ok || entry.Output != output || entry.PkgPath != pkgPath {
+		return false
+	}
+	if hash, err := hashFile(source); err != nil || hash != entry.SourceHash {
+		return false
+	}
+	hash, err := hashFile(output)
+	return err == nil && hash == entry.OutputHash
+}
+
+// Record notes that source has been instrumented into output. It is called
+// after output is written, and hashes source as it is then, which for an
+// in-place run is the output.
+func (c *DiskCache) Record(source, output, pkgPath string) error {
+	sourceHash, err := hashFile(source)
+	if err != nil {
+		return err
+	}
+	outputHash, err := hashFile(output)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.manifest.Files[source] = diskEntry{
+		SourceHash: sourceHash,
+		Output:     output,
+		OutputHash: outputHash,
+		PkgPath:    pkgPath,
+	}
+	return nil
+}
+
+// Save writes the cache back to its directory
+func (c *DiskCache) Save() error {
+	c.mu.Lock()
+	data, err := json.MarshalIndent(c.manifest, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	// Write to a temporary file first so an interrupted run leaves the
+	// previous manifest intact
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write cache: %w", err)
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// hashConfig identifies a transformer config, and the version of the
+// instrumentation, in the manifest
+func hashConfig(config *Config) (string, error) {
+	data, err := json.Marshal(struct {
+		Version int
+		Config  *Config
+	}{diskCacheVersion, config})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// hashFile returns the sha256 of the contents of the file at path
+func hashFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,59 @@
+package ast
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, DiskCacheDir)
+	source := filepath.Join(dir, "app.go")
+	output := filepath.Join(dir, "out", "app.go")
+	write := func(path, content string) {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(source, "package app\n")
+	write(output, "package app // instrumented\n")
+
+	config := &Config{}
+	cache, err := OpenDiskCache(cacheDir, config)
+	if err != nil {
+		t.Fatalf("OpenDiskCache failed: %v", err)
+	}
+	if cache.Unchanged(source, output, "example.com/app") {
+		t.Error("a file never recorded should not be unchanged")
+	}
+	if err := cache.Record(source, output, "example.com/app"); err != nil {
+		t.Fatalf("Record failed: %v", err)
+	}
+	if err := cache.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	cache, _ = OpenDiskCache(cacheDir, config)
+	if !cache.Unchanged(source, output, "example.com/app") {
+		t.Error("recorded file should be unchanged after reopening the cache")
+	}
+	if cache.Unchanged(source, output, "example.com/other") {
+		t.Error("file should not be unchanged for another package path")
+	}
+
+	if other, _ := OpenDiskCache(cacheDir, &Config{InstrumentClosures: true}); other.Unchanged(source, output, "example.com/app") {
+		t.Error("entries recorded under another config should be dropped")
+	}
+
+	write(output, "package app // edited\n")
+	if cache.Unchanged(source, output, "example.com/app") {
+		t.Error("file whose output was edited should not be unchanged")
+	}
+	write(output, "package app // instrumented\n")
+	write(source, "package app\n\nfunc F() {}\n")
+	if cache.Unchanged(source, output, "example.com/app") {
+		t.Error("modified source should not be unchanged")
+	}
+}
@@ -3,15 +3,21 @@ package ast
 import (
 	"go/ast"
 	"go/token"
+	"os"
+	"path/filepath"
 	"runtime"
 	"sync"
 )
 
-// ParallelTransformer handles parallel AST transformation
+// ParallelTransformer handles parallel AST transformation. Every file is
+// transformed by a Transformer of its own, as a Transformer keeps per-file
+// state.
 type ParallelTransformer struct {
-	transformer *Transformer
-	workers     int
-	cache       *Cache
+	config   *Config
+	pkgPath  string
+	pkgPaths map[string]string // package directory -> import path
+	workers  int
+	cache    *Cache
 }
 
 // NewParallelTransformer creates a parallel AST transformer
@@ -22,9 +28,9 @@ func NewParallelTransformer(config *Config) *ParallelTransformer {
 	}
 
 	return &ParallelTransformer{
-		transformer: NewTransformer(token.NewFileSet(), config),
-		workers:     workers,
-		cache:       NewCache(200), // Cache up to 200 files
+		config:  config,
+		workers: workers,
+		cache:   NewCache(200), // Cache up to 200 files
 	}
 }
 
@@ -72,6 +78,12 @@ type TransformResult struct {
 	Duration  int64 // nanoseconds
 	Functions int
 	Lines     int
+	// Instrumented names the functions instrumented (see
+	// Transformer.Instrumented); empty for cached results
+	Instrumented []string
+	// Skipped lists the functions left uninstrumented (see
+	// Transformer.Skipped); empty for cached results
+	Skipped []SkippedFunction
 }
 
 // worker processes transformation jobs
@@ -90,7 +102,14 @@ func (pt *ParallelTransformer) transformFile(filename string) *TransformResult {
 		Filename: filename,
 	}
 
-	// Check cache first
+	// Check cache first; a file modified since it was cached is redone
+	var modTime int64
+	if info, err := os.Stat(filename); err == nil {
+		modTime = info.ModTime().UnixNano()
+	}
+	if !pt.cache.Validate(filename, modTime) {
+		pt.cache.Invalidate(filename)
+	}
 	if file, fset, ok := pt.cache.Get(filename); ok {
 		result.File = file
 		result.FileSet = fset
@@ -106,18 +125,21 @@ func (pt *ParallelTransformer) transformFile(filename string) *TransformResult {
 	}
 
 	// Transform file
-	pt.transformer.fset = fset
-	if err := pt.transformer.TransformFile(file); err != nil {
+	transformer := NewTransformer(fset, pt.config)
+	transformer.SetPackagePath(pt.packagePath(filename))
+	if err := transformer.TransformFile(file); err != nil {
 		result.Error = err
 		return result
 	}
 
 	// Count functions and lines
+	result.Instrumented = transformer.Instrumented()
+	result.Skipped = transformer.Skipped()
 	result.Functions = countFunctions(file)
 	result.Lines = countLines(fset, file)
 
 	// Cache result
-	pt.cache.Put(filename, file, fset, 0)
+	pt.cache.Put(filename, file, fset, modTime)
 
 	result.File = file
 	result.FileSet = fset
@@ -146,6 +168,12 @@ func NewBatchTransformer(config *Config) *BatchTransformer {
 	}
 }
 
+// SetPackagePaths maps package directories to import paths (see
+// ParallelTransformer.SetPackagePaths)
+func (bt *BatchTransformer) SetPackagePaths(pkgPaths map[string]string) {
+	bt.pt.SetPackagePaths(pkgPaths)
+}
+
 // TransformBatch transforms files in batches with progress updates
 func (bt *BatchTransformer) TransformBatch(files []string) (<-chan *Progress, <-chan *TransformResult, <-chan error) {
 	progress := make(chan *Progress, 10)
@@ -205,6 +233,33 @@ func (pt *ParallelTransformer) CacheStats() CacheStats {
 	return pt.cache.Stats()
 }
 
+// SetPackagePath sets the import path of the package subsequent files
+// belong to (see Transformer.SetPackagePath)
+func (pt *ParallelTransformer) SetPackagePath(pkgPath string) {
+	pt.pkgPath = pkgPath
+}
+
+// SetPackagePaths maps package directories to import paths, so that one
+// TransformFiles call can span several packages. Files in other
+// directories belong to the package of SetPackagePath.
+func (pt *ParallelTransformer) SetPackagePaths(pkgPaths map[string]string) {
+	pt.pkgPaths = pkgPaths
+}
+
+// packagePath returns the import path of the package filename belongs to
+func (pt *ParallelTransformer) packagePath(filename string) string {
+	if pkgPath, ok := pt.pkgPaths[filepath.Dir(filename)]; ok {
+		return pkgPath
+	}
+	return pt.pkgPath
+}
+
+// Invalidate drops the cached transformation of filename, so the next
+// TransformFiles call re-reads and re-instruments it
+func (pt *ParallelTransformer) Invalidate(filename string) {
+	pt.cache.Invalidate(filename)
+}
+
 // ClearCache clears the transformation cache
 func (pt *ParallelTransformer) ClearCache() {
 	pt.cache.Clear()
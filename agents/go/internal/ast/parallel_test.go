@@ -0,0 +1,102 @@
+package ast
+
+import (
+	"bytes"
+	"go/format"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// printResult prints the file of a transform result
+func printResult(t *testing.T, result *TransformResult) string {
+	t.Helper()
+
+	if result.Error != nil {
+		t.Fatalf("%s: %v", result.Filename, result.Error)
+	}
+	var buf bytes.Buffer
+	if err := format.Node(&buf, result.FileSet, result.File); err != nil {
+		t.Fatalf("Failed to print %s: %v", result.Filename, err)
+	}
+	return buf.String()
+}
+
+// TestParallelTransformManyFiles transforms enough files at once for the
+// workers to overlap; run with -race to check they share no state
+func TestParallelTransformManyFiles(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 64; i++ {
+		name := "F" + strconv.Itoa(i)
+		filename := filepath.Join(dir, strings.ToLower(name)+".go")
+		source := "package app\n\nfunc " + name + "(x int) int {\n\treturn x + " + strconv.Itoa(i) + "\n}\n"
+		if err := os.WriteFile(filename, []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, filename)
+	}
+
+	pt := NewParallelTransformer(&Config{})
+	pt.SetPackagePath("example.com/app")
+	results, err := pt.TransformFiles(files)
+	if err != nil {
+		t.Fatalf("TransformFiles failed: %v", err)
+	}
+	if len(results) != len(files) {
+		t.Fatalf("got %d results, want %d", len(results), len(files))
+	}
+
+	for _, result := range results {
+		name := strings.ToUpper(strings.TrimSuffix(filepath.Base(result.Filename), ".go"))
+		want := `flowtrace.EnterAt("example.com/app", "` + name + `"`
+		if output := printResult(t, result); !strings.Contains(output, want) {
+			t.Errorf("%s: expected %s in:\n%s", result.Filename, want, output)
+		}
+	}
+}
+
+// TestParallelTransformModifiedFile checks that a file changed since it was
+// cached is transformed again
+func TestParallelTransformModifiedFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "app.go")
+	write := func(source string, modTime time.Time) {
+		if err := os.WriteFile(filename, []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	modTime := time.Now().Add(-time.Hour)
+	write("package app\n\nfunc Old() int {\n\treturn 1\n}\n", modTime)
+
+	pt := NewParallelTransformer(&Config{})
+	transform := func() *TransformResult {
+		results, err := pt.TransformFiles([]string{filename})
+		if err != nil || len(results) != 1 {
+			t.Fatalf("TransformFiles = %v, %v", results, err)
+		}
+		return results[0]
+	}
+
+	if result := transform(); result.Cached {
+		t.Error("first transform should not come from the cache")
+	}
+	if result := transform(); !result.Cached {
+		t.Error("unchanged file should come from the cache")
+	}
+
+	write("package app\n\nfunc New() int {\n\treturn 2\n}\n", modTime.Add(time.Second))
+	result := transform()
+	if result.Cached {
+		t.Error("modified file should not come from the cache")
+	}
+	output := printResult(t, result)
+	if !strings.Contains(output, `"New"`) || strings.Contains(output, `"Old"`) {
+		t.Errorf("expected the modified source to be instrumented, got:\n%s", output)
+	}
+}
@@ -0,0 +1,55 @@
+package ast
+
+import (
+	"go/ast"
+	"go/token"
+	"reflect"
+)
+
+var posType = reflect.TypeOf(token.NoPos)
+
+// injectedPos returns the position given to nodes created by the transformer.
+//
+// The printer interleaves comments by comparing their offsets with the
+// positions of the nodes it prints, and it estimates positions for nodes
+// without one by advancing from the last known position. Injected code
+// printed at a source position therefore drags comments that follow it in
+// the file into the middle of generated statements. Positioning injected
+// nodes at the start of a separate, empty file keeps the printer's estimate
+// below every comment offset, so comments stay with the original code.
+func (t *Transformer) injectedPos() token.Pos {
+	if t.injected == nil {
+		t.injected = t.fset.AddFile("<flowtrace>", -1, 0)
+	}
+	return token.Pos(t.injected.Base())
+}
+
+// setPos assigns pos to every unset position in the subtree rooted at node.
+// CallExpr.Ellipsis is skipped since setting it marks the call as variadic.
+func setPos(node ast.Node, pos token.Pos) {
+	ast.Inspect(node, func(n ast.Node) bool {
+		if n == nil {
+			return false
+		}
+		v := reflect.ValueOf(n)
+		if v.Kind() != reflect.Ptr || v.IsNil() {
+			return true
+		}
+		v = v.Elem()
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Field(i)
+			if field.Type() != posType || !field.CanSet() || token.Pos(field.Int()).IsValid() {
+				continue
+			}
+			if _, ok := n.(*ast.CallExpr); ok && v.Type().Field(i).Name == "Ellipsis" {
+				continue
+			}
+			// A declaration with a valid Lparen is printed in parentheses
+			if _, ok := n.(*ast.GenDecl); ok && v.Type().Field(i).Name != "TokPos" {
+				continue
+			}
+			field.SetInt(int64(pos))
+		}
+		return true
+	})
+}
@@ -28,31 +28,45 @@ func (r *Rewriter) RewriteReturnStatements(fn *ast.FuncDecl, info *FuncInfo) {
 	// Create a map to track statements that need to be replaced
 	replacements := make(map[*ast.ReturnStmt]*ast.BlockStmt)
 
-	// Find all return statements
-	ast.Inspect(fn.Body, func(n ast.Node) bool {
-		if ret, ok := n.(*ast.ReturnStmt); ok {
-			if len(ret.Results) > 0 {
-				// Create assignment statement
-				assignment := r.createReturnAssignment(ret, info)
-
-				// Create new block with assignment + naked return
-				block := &ast.BlockStmt{
-					List: []ast.Stmt{
-						assignment,
-						&ast.ReturnStmt{}, // Naked return
-					},
-				}
+	// Find all return statements of this function
+	for _, ret := range functionReturns(fn.Body) {
+		// Create assignment statement
+		assignment := r.createReturnAssignment(ret, info)
+
+		// Create new block with assignment + naked return
+		block := &ast.BlockStmt{
+			List: []ast.Stmt{
+				assignment,
+				&ast.ReturnStmt{}, // Naked return
+			},
+		}
+
+		replacements[ret] = block
+	}
 
-				replacements[ret] = block
+	// Apply replacements
+	// This is complex because we need to replace in parent blocks
+	r.applyReturnReplacements(fn.Body, replacements)
+}
+
+// functionReturns returns the return statements with results that belong
+// to the function of body. Function literals are not descended into since
+// their returns belong to the literal, not the enclosing function.
+func functionReturns(body *ast.BlockStmt) []*ast.ReturnStmt {
+	var returns []*ast.ReturnStmt
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.ReturnStmt:
+			if len(n.Results) > 0 {
+				returns = append(returns, n)
 			}
 			return false
 		}
 		return true
 	})
-
-	// Apply replacements
-	// This is complex because we need to replace in parent blocks
-	r.applyReturnReplacements(fn.Body, replacements)
+	return returns
 }
 
 // createReturnAssignment creates an assignment for return values
@@ -0,0 +1,72 @@
+package ast
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+const nestedClosureSource = `package main
+
+func Outer(xs []int) (int, error) {
+	double := func(x int) int {
+		return x * 2
+	}
+	go func() {
+		return
+	}()
+	if len(xs) == 0 {
+		return 0, nil
+	}
+	return double(xs[0]), nil
+}
+`
+
+func TestFunctionReturnsSkipsFuncLits(t *testing.T) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "test.go", nestedClosureSource, 0)
+	if err != nil {
+		t.Fatalf("Failed to parse source: %v", err)
+	}
+	fn := file.Decls[0].(*ast.FuncDecl)
+
+	returns := functionReturns(fn.Body)
+	if len(returns) != 2 {
+		t.Fatalf("Expected the 2 returns of Outer, got %d", len(returns))
+	}
+	for _, ret := range returns {
+		if len(ret.Results) != 2 {
+			t.Errorf("Expected only returns of Outer, got one with %d results at %s", len(ret.Results), fset.Position(ret.Pos()))
+		}
+	}
+}
+
+func TestRewriteReturnStatementsLeavesClosuresUntouched(t *testing.T) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "test.go", nestedClosureSource, 0)
+	if err != nil {
+		t.Fatalf("Failed to parse source: %v", err)
+	}
+	fn := file.Decls[0].(*ast.FuncDecl)
+
+	info := &FuncInfo{Results: []ResultInfo{{Name: "r0", Type: "int"}, {Name: "r1", Type: "error"}}}
+	NewRewriter(fset).RewriteReturnStatements(fn, info)
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, file); err != nil {
+		t.Fatalf("Failed to print rewritten file: %v", err)
+	}
+	output := buf.String()
+	for _, want := range []string{"return x * 2", "r0, r1 = double(xs[0]), nil"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected output to contain %q\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, "r0, r1 = x * 2") {
+		t.Errorf("Closure return was rewritten to the outer function's results\n%s", output)
+	}
+}
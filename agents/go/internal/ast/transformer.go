@@ -1,21 +1,79 @@
 package ast
 
 import (
+	"cmp"
 	"fmt"
 	"go/ast"
+	"go/build"
 	"go/parser"
 	"go/token"
 	"go/types"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 
+	"github.com/rixmerz/flowtrace-agent-go/internal/filter"
 	"golang.org/x/tools/go/packages"
 )
 
+// DefaultFlowtracePkgPath is the default import path of the runtime package
+// used by instrumented code
+const DefaultFlowtracePkgPath = "github.com/rixmerz/flowtrace-agent-go/flowtrace"
+
+// knownFlowtraceImportPaths are the paths the runtime package is published
+// under; a file importing any of them keeps its import
+var knownFlowtraceImportPaths = []string{
+	DefaultFlowtracePkgPath,
+	"github.com/flowtrace/flowtrace-go/flowtrace",
+}
+
 // Transformer handles AST transformation for code instrumentation
 type Transformer struct {
-	fset    *token.FileSet
-	config  *Config
-	pkgPath string
+	fset     *token.FileSet
+	config   *Config
+	pkgPath  string
+	pkgName  string // package clause of the file being transformed
+	analyzer *Analyzer
+	filter   *filter.Filter
+
+	// Per-file record of which imports the injected code depends on, and
+	// the names it refers to them by
+	usesFlowtrace bool
+	usesFmt       bool
+	flowtraceName string
+	fmtName       string
+
+	// Functions instrumented and skipped in the file being transformed
+	instrumented []string
+	skipped      []SkippedFunction
+
+	// Comments of the file being transformed, searched for
+	// //flowtrace:capture directives
+	comments []*ast.CommentGroup
+
+	// Lazily created file that positions injected nodes (see injectedPos)
+	injected *token.File
+}
+
+// Reasons for which TransformFile leaves a function uninstrumented
+const (
+	SkipNoBody          = "no-body"              // declared without a body
+	SkipInit            = "init"                 // init runs before tracing can start
+	SkipInstrumented    = "already-instrumented" // carries instrumentation already
+	SkipFiltered        = "filtered"             // excluded package, or //flowtrace:skip
+	SkipUnexported      = "unexported"           // Config.OnlyExported
+	SkipBelowComplexity = "below-complexity"     // Config.MinComplexity
+	SkipNotSelected     = "not-selected"         // Config.Only
+	SkipCgo             = "cgo"                  // its file imports "C"
+)
+
+// SkippedFunction is a function left uninstrumented, named as in
+// Transformer.Instrumented, with one of the Skip reasons
+type SkippedFunction struct {
+	Name   string
+	Reason string
 }
 
 // Config holds transformer configuration
@@ -26,8 +84,85 @@ type Config struct {
 	Exclude []string
 	// Maximum instrumentation depth
 	MaxDepth int
-	// Whether to instrument test files
+	// Whether to instrument test files; TransformPackage and TransformFile
+	// leave _test.go files alone otherwise
 	InstrumentTests bool
+	// Whether to also instrument anonymous functions (closures, go func(){...})
+	InstrumentClosures bool
+	// Whether to trace the calls deferred by instrumented functions, each
+	// as a span of its own run after the function's body
+	InstrumentDefers bool
+	// Minimum cyclomatic complexity (see Analyzer.FunctionComplexity) of a
+	// function to instrument; simpler ones such as getters are skipped unless
+	// marked with //flowtrace:trace. 0 instruments all functions.
+	MinComplexity int
+	// Whether to instrument only exported functions and methods, leaving
+	// unexported ones untraced unless marked with //flowtrace:trace
+	OnlyExported bool
+	// Functions to instrument, as patterns matched by filter.MatchFunction
+	// against the name of a function as in the trace, e.g.
+	// UserService.LoadUser, and against that name qualified by the package
+	// name or import path. Other functions are left alone, even if marked
+	// with //flowtrace:trace. Empty instruments all functions.
+	Only []string
+	// Import path of the flowtrace runtime added to instrumented files;
+	// defaults to github.com/rixmerz/flowtrace-agent-go/flowtrace
+	FlowtracePkgPath string
+	// Names of the parameters left out of the args passed to Enter, e.g.
+	// "buf"; "receiver" leaves out the receivers of methods
+	ExcludeArgs []string
+	// Types of the parameters left out of the args passed to Enter, as
+	// written in the source, e.g. "context.Context", "*sql.DB" or
+	// "io.Reader"; variadic parameters have their slice type, e.g. "[]any",
+	// and "chan" stands for every channel type. Nil leaves out
+	// DefaultExcludeArgTypes, an empty list none.
+	ExcludeArgTypes []string
+	// Directory the files instrumented were copied to from SourceDir, such
+	// as the temporary copy built by flowctl run. The positions passed to
+	// EnterAt for files under CopyDir are reported under SourceDir instead.
+	CopyDir   string
+	SourceDir string
+}
+
+// DefaultExcludeArgTypes returns the types of the parameters left out of
+// the args passed to Enter unless Config.ExcludeArgTypes is set: values
+// that serialize to nothing useful, or to something huge
+func DefaultExcludeArgTypes() []string {
+	return []string{
+		"context.Context",
+		"io.Reader",
+		"io.Writer",
+		"io.ReadCloser",
+		"io.WriteCloser",
+		"io.ReadWriter",
+		"*sync.Mutex",
+		"*sync.RWMutex",
+		"*sync.WaitGroup",
+		"chan",
+	}
+}
+
+// excludesArg reports whether the parameter name of type typ is left out
+// of the args passed to Enter
+func (c *Config) excludesArg(name, typ string) bool {
+	if slices.Contains(c.ExcludeArgs, name) {
+		return true
+	}
+	types := c.ExcludeArgTypes
+	if types == nil {
+		types = DefaultExcludeArgTypes()
+	}
+	if slices.Contains(types, typ) {
+		return true
+	}
+	isChan := strings.HasPrefix(typ, "chan ") || strings.HasPrefix(typ, "chan<- ") || strings.HasPrefix(typ, "<-chan ")
+	return isChan && slices.Contains(types, "chan")
+}
+
+// IncludesFile reports whether the file named filename is instrumented,
+// which for a test file requires InstrumentTests
+func (c *Config) IncludesFile(filename string) bool {
+	return c.InstrumentTests || !IsTestFile(filename)
 }
 
 // NewTransformer creates a new AST transformer
@@ -39,11 +174,26 @@ func NewTransformer(fset *token.FileSet, config *Config) *Transformer {
 		}
 	}
 	return &Transformer{
-		fset:   fset,
-		config: config,
+		fset:     fset,
+		config:   config,
+		analyzer: NewAnalyzer(fset),
+		filter:   filter.NewFilter(config.Include, config.Exclude),
 	}
 }
 
+// SetPackagePath sets the package the transformed files belong to. Functions
+// of a package excluded by the Include/Exclude filters are only instrumented
+// when marked with //flowtrace:trace.
+func (t *Transformer) SetPackagePath(pkgPath string) {
+	t.pkgPath = pkgPath
+}
+
+// packageIncluded reports whether the current package passes the filters;
+// files of an unknown package are always included
+func (t *Transformer) packageIncluded() bool {
+	return t.pkgPath == "" || t.filter.ShouldInstrumentPackage(t.pkgPath)
+}
+
 // TransformPackage transforms all files in a package
 func (t *Transformer) TransformPackage(pkgPath string) ([]*ast.File, error) {
 	// Load package
@@ -51,6 +201,12 @@ func (t *Transformer) TransformPackage(pkgPath string) ([]*ast.File, error) {
 		Mode: packages.NeedFiles | packages.NeedSyntax | packages.NeedTypes,
 		Fset: t.fset,
 	}
+	if HasCgoFiles(pkgPath, ".", nil) {
+		// Type-checking the code cgo generates needs the packages it
+		// imports, such as syscall, which go/packages otherwise leaves
+		// unloaded
+		cfg.Mode |= packages.NeedImports | packages.NeedDeps
+	}
 
 	pkgs, err := packages.Load(cfg, pkgPath)
 	if err != nil {
@@ -64,11 +220,24 @@ func (t *Transformer) TransformPackage(pkgPath string) ([]*ast.File, error) {
 	pkg := pkgs[0]
 	t.pkgPath = pkg.PkgPath
 
+	sources := make(map[string]bool, len(pkg.GoFiles))
+	for _, path := range pkg.GoFiles {
+		sources[path] = true
+	}
+
 	var transformed []*ast.File
 	for _, file := range pkg.Syntax {
-		// Skip test files if configured
-		filename := t.fset.Position(file.Pos()).Filename
-		if !t.config.InstrumentTests && strings.HasSuffix(filename, "_test.go") {
+		// Skip test files if configured, and the code cgo generated for
+		// files importing "C". Line directives of the generated code point
+		// to the cgo file, so they are ignored.
+		filename := t.fset.PositionFor(file.Pos(), false).Filename
+		if !t.config.IncludesFile(filename) || !sources[filename] {
+			continue
+		}
+
+		// A file that doesn't type-check is skipped, not the package
+		if err := fileError(pkg, filename); err != nil {
+			fmt.Printf("Warning: skipping %s: %v\n", filename, err.Msg)
 			continue
 		}
 
@@ -83,8 +252,59 @@ func (t *Transformer) TransformPackage(pkgPath string) ([]*ast.File, error) {
 	return transformed, nil
 }
 
-// TransformFile transforms a single AST file
+// HasCgoFiles reports whether the package pkgPath, a directory relative to
+// dir or an import path, has files importing "C" when built with tags. A
+// package that can't be found has none.
+func HasCgoFiles(pkgPath, dir string, tags []string) bool {
+	ctx := build.Default
+	ctx.BuildTags = append(ctx.BuildTags, tags...)
+	pkg, err := ctx.Import(pkgPath, dir, 0)
+	return err == nil && len(pkg.CgoFiles) > 0
+}
+
+// fileError returns the first error of pkg located in filename, or nil
+func fileError(pkg *packages.Package, filename string) *packages.Error {
+	for i, e := range pkg.Errors {
+		if strings.HasPrefix(e.Pos, filename+":") {
+			return &pkg.Errors[i]
+		}
+	}
+	return nil
+}
+
+// TransformFile transforms a single AST file. Test files are left alone
+// unless Config.InstrumentTests is set.
 func (t *Transformer) TransformFile(file *ast.File) error {
+	t.instrumented = nil
+	t.skipped = nil
+	if !t.config.IncludesFile(t.fset.Position(file.Pos()).Filename) {
+		return nil
+	}
+
+	// Instrumenting an already instrumented file would inject a second layer
+	// of Enter/Exit calls, so such files are left as they are
+	if isInstrumentedFile(file, t.config.FlowtracePkgPath) {
+		return nil
+	}
+
+	// The imports added to a cgo file could end up between its C preamble
+	// and import "C", so its functions are left alone
+	if importsC(file) {
+		for _, decl := range file.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok {
+				t.skip(fn, SkipCgo)
+			}
+		}
+		return nil
+	}
+
+	t.usesFlowtrace = false
+	t.usesFmt = false
+	t.comments = file.Comments
+	t.pkgName = file.Name.Name
+	t.flowtraceName = cmp.Or(flowtraceImportName(file, t.config.FlowtracePkgPath), "flowtrace")
+	t.fmtName = cmp.Or(importName(file, "fmt"), "fmt")
+
 	// Walk the AST and transform function declarations
 	ast.Inspect(file, func(n ast.Node) bool {
 		if fn, ok := n.(*ast.FuncDecl); ok {
@@ -97,7 +317,7 @@ func (t *Transformer) TransformFile(file *ast.File) error {
 		return true
 	})
 
-	// Add flowtrace import if not present
+	// Add the imports required by the injected code
 	t.ensureFlowtraceImport(file)
 
 	return nil
@@ -107,55 +327,453 @@ func (t *Transformer) TransformFile(file *ast.File) error {
 func (t *Transformer) instrumentFunction(fn *ast.FuncDecl) error {
 	if fn.Body == nil {
 		// Skip functions without body (interface methods, external declarations)
+		t.skip(fn, SkipNoBody)
 		return nil
 	}
 
 	// Skip init functions (they run before we can set up tracing)
 	if fn.Name.Name == "init" {
+		t.skip(fn, SkipInit)
+		return nil
+	}
+
+	// Skip functions that already carry instrumentation
+	if isInstrumentedBody(fn.Body) {
+		t.skip(fn, SkipInstrumented)
+		return nil
+	}
+
+	if len(t.config.Only) > 0 && !t.selected(fn) {
+		t.skip(fn, SkipNotSelected)
 		return nil
 	}
 
+	// Doc comment directives override the package filters
+	switch t.analyzer.Directive(fn) {
+	case DirectiveSkip:
+		t.skip(fn, SkipFiltered)
+		return nil
+	case DirectiveTrace:
+	default:
+		if !t.packageIncluded() {
+			t.skip(fn, SkipFiltered)
+			return nil
+		}
+		if t.config.OnlyExported && !t.analyzer.IsExported(fn) {
+			t.skip(fn, SkipUnexported)
+			return nil
+		}
+		if t.config.MinComplexity > 0 && t.analyzer.FunctionComplexity(fn) < t.config.MinComplexity {
+			t.skip(fn, SkipBelowComplexity)
+			return nil
+		}
+	}
+
 	// Get function info
 	info := t.analyzeFuncSignature(fn)
 
+	// Captures go in before closures are instrumented, so that a capture in
+	// an instrumented closure records into the closure's own call
+	t.injectCaptures(fn)
+
+	// Closures are instrumented first, before the outer body gains the
+	// injected defer FuncLits, so those are never mistaken for user closures
+	if t.config.InstrumentClosures {
+		t.instrumentClosures(fn.Body, info.Name, false)
+	}
+
+	t.instrumentBody(fn.Type, fn.Body, info)
+	t.instrumented = append(t.instrumented, info.Name)
+
+	return nil
+}
+
+// selected reports whether fn is one of the functions of Config.Only
+func (t *Transformer) selected(fn *ast.FuncDecl) bool {
+	name := FuncDeclName(fn)
+	names := []string{name, t.pkgName + "." + name}
+	if t.pkgPath != "" {
+		names = append(names, t.pkgPath+"."+name)
+	}
+	for _, pattern := range t.config.Only {
+		for _, n := range names {
+			if filter.MatchFunction(pattern, n) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Instrumented returns the names of the functions instrumented by the last
+// TransformFile call, methods qualified with their receiver type as in the
+// trace. Closures are not listed.
+func (t *Transformer) Instrumented() []string {
+	return t.instrumented
+}
+
+// Skipped returns the functions the last TransformFile call left
+// uninstrumented, and why
+func (t *Transformer) Skipped() []SkippedFunction {
+	return t.skipped
+}
+
+// skip records that fn is left uninstrumented for reason
+func (t *Transformer) skip(fn *ast.FuncDecl, reason string) {
+	t.skipped = append(t.skipped, SkippedFunction{Name: FuncDeclName(fn), Reason: reason})
+}
+
+// FuncDeclName returns the name of fn as in the trace, methods qualified
+// with their receiver type, e.g. UserService.LoadUser
+func FuncDeclName(fn *ast.FuncDecl) string {
+	if fn.Recv != nil && len(fn.Recv.List) > 0 {
+		return receiverTypeName(fn.Recv.List[0].Type) + "." + fn.Name.Name
+	}
+	return fn.Name.Name
+}
+
+// injectCaptures inserts a __ft_ctx.Capture call for every variable named
+// by a //flowtrace:capture comment in fn, at the place of the comment.
+// Names that are not variables in scope there are reported and skipped.
+func (t *Transformer) injectCaptures(fn *ast.FuncDecl) {
+	for _, capture := range t.analyzer.Captures(fn.Body, t.comments) {
+		var stmts []ast.Stmt
+		for _, name := range capture.Names {
+			if !t.analyzer.InScope(fn, capture.Pos, name) {
+				fmt.Printf("Warning: %s: cannot capture %s: no such variable in scope\n", t.fset.Position(capture.Pos), name)
+				continue
+			}
+			// Create: __ft_ctx.Capture("name", name)
+			stmt := &ast.ExprStmt{
+				X: &ast.CallExpr{
+					Fun: &ast.SelectorExpr{
+						X:   ast.NewIdent("__ft_ctx"),
+						Sel: ast.NewIdent("Capture"),
+					},
+					Args: []ast.Expr{
+						&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(name)},
+						ast.NewIdent(name),
+					},
+				},
+			}
+			// Unlike other injected code the call is positioned in the
+			// source, right after the comment, so it is printed below it
+			setPos(stmt, capture.End)
+			stmts = append(stmts, stmt)
+		}
+		if len(stmts) > 0 && !insertAt(fn.Body, capture.Pos, stmts) {
+			fmt.Printf("Warning: %s: cannot capture outside a statement list\n", t.fset.Position(capture.Pos))
+		}
+	}
+}
+
+// insertAt inserts stmts into the innermost statement list of body around
+// pos, before the first statement that starts after pos. It reports
+// false when pos is not in a statement list, e.g. between the clauses of a
+// switch.
+func insertAt(body *ast.BlockStmt, pos token.Pos, stmts []ast.Stmt) bool {
+	var list *[]ast.Stmt
+	clauses := make(map[*ast.BlockStmt]bool)
+	ast.Inspect(body, func(n ast.Node) bool {
+		if n == nil || pos < n.Pos() || pos >= n.End() {
+			return false
+		}
+		switch n := n.(type) {
+		case *ast.SwitchStmt:
+			clauses[n.Body] = true
+		case *ast.TypeSwitchStmt:
+			clauses[n.Body] = true
+		case *ast.SelectStmt:
+			clauses[n.Body] = true
+		case *ast.BlockStmt:
+			list = &n.List
+			if clauses[n] {
+				list = nil
+			}
+		case *ast.CaseClause:
+			list = &n.Body
+		case *ast.CommClause:
+			list = &n.Body
+		}
+		return true
+	})
+	if list == nil {
+		return false
+	}
+
+	i := 0
+	for ; i < len(*list); i++ {
+		if (*list)[i].Pos() > pos {
+			break
+		}
+	}
+	*list = append((*list)[:i], append(stmts, (*list)[i:]...)...)
+	return true
+}
+
+// isInstrumentedBody reports whether a function body starts with the Enter
+// call injected by instrumentBody
+func isInstrumentedBody(body *ast.BlockStmt) bool {
+	return enterStmts(body) > 0
+}
+
+// enterStmts returns the number of statements the Enter call injected by
+// instrumentBody takes at the start of body, or 0 when there is none: 2 for
+// the declaration of __ft_ctx and the if statement assigning it, 1 for the
+// `__ft_ctx := flowtrace.Enter(...)` of earlier versions
+func enterStmts(body *ast.BlockStmt) int {
+	if body == nil || len(body.List) == 0 {
+		return 0
+	}
+
+	if assign, ok := body.List[0].(*ast.AssignStmt); ok {
+		if isEnterAssign(assign) {
+			return 1
+		}
+		return 0
+	}
+
+	decl, ok := body.List[0].(*ast.DeclStmt)
+	if !ok || len(body.List) < 2 {
+		return 0
+	}
+	gen, ok := decl.Decl.(*ast.GenDecl)
+	if !ok || gen.Tok != token.VAR || len(gen.Specs) != 1 {
+		return 0
+	}
+	spec, ok := gen.Specs[0].(*ast.ValueSpec)
+	if !ok || len(spec.Names) != 1 || spec.Names[0].Name != "__ft_ctx" {
+		return 0
+	}
+	ifStmt, ok := body.List[1].(*ast.IfStmt)
+	if !ok || ifStmt.Init != nil || ifStmt.Else != nil || len(ifStmt.Body.List) != 1 {
+		return 0
+	}
+	if assign, ok := ifStmt.Body.List[0].(*ast.AssignStmt); ok && isEnterAssign(assign) {
+		return 2
+	}
+	return 0
+}
+
+// sourceFile returns the file filename was copied from under
+// Config.CopyDir, or filename itself
+func (t *Transformer) sourceFile(filename string) string {
+	if t.config.CopyDir == "" {
+		return filename
+	}
+	rel, err := filepath.Rel(t.config.CopyDir, filename)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filename
+	}
+	return filepath.Join(t.config.SourceDir, rel)
+}
+
+// isEnterAssign reports whether assign sets __ft_ctx to a call of Enter or
+// EnterAt
+func isEnterAssign(assign *ast.AssignStmt) bool {
+	if len(assign.Lhs) != 1 || len(assign.Rhs) != 1 {
+		return false
+	}
+
+	if ident, ok := assign.Lhs[0].(*ast.Ident); !ok || ident.Name != "__ft_ctx" {
+		return false
+	}
+
+	call, ok := assign.Rhs[0].(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	return ok && (sel.Sel.Name == "Enter" || sel.Sel.Name == "EnterAt")
+}
+
+// isInstrumentedFile reports whether a file imports flowtrace, under a known
+// path or pkgPath, and contains at least one function instrumented by this tool
+func isInstrumentedFile(file *ast.File, pkgPath string) bool {
+	if importedFlowtracePath(file, pkgPath) == "" {
+		return false
+	}
+
+	for _, decl := range file.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && isInstrumentedBody(fn.Body) {
+			return true
+		}
+	}
+	return false
+}
+
+// importsC reports whether file uses cgo
+func importsC(file *ast.File) bool {
+	for _, spec := range file.Imports {
+		if spec.Path.Value == `"C"` {
+			return true
+		}
+	}
+	return false
+}
+
+// instrumentClosures instruments the function literals directly nested in
+// node, innermost first. Names follow the runtime's convention: closures of
+// a declared function are "outer.func1", "outer.func2", ...; closures nested
+// in another closure are "outer.func1.1", and so on.
+func (t *Transformer) instrumentClosures(node ast.Node, parentName string, nested bool) {
+	counter := 0
+	ast.Inspect(node, func(n ast.Node) bool {
+		lit, ok := n.(*ast.FuncLit)
+		if !ok {
+			return true
+		}
+
+		counter++
+		name := fmt.Sprintf("%s.func%d", parentName, counter)
+		if nested {
+			name = fmt.Sprintf("%s.%d", parentName, counter)
+		}
+
+		t.instrumentClosures(lit.Body, name, true)
+		t.instrumentBody(lit.Type, lit.Body, t.analyzeFuncType(name, lit.Type))
+
+		// Nested literals were handled by the recursive call above
+		return false
+	})
+}
+
+// instrumentBody injects Enter/Exit/recover instrumentation into a function body
+func (t *Transformer) instrumentBody(fnType *ast.FuncType, body *ast.BlockStmt, info *FuncInfo) {
 	// Step 1: Ensure function has named returns
-	t.ensureNamedReturns(fn, info)
+	t.ensureNamedReturns(fnType, info)
 
 	// Step 2: Create instrumentation statements
-	enterStmt := t.createEnterCall(fn, info)
-	exitDefer := t.createExitDefer(fn, info)
-	recoverDefer := t.createRecoverDefer(fn, info)
-
-	// Step 3: Transform return statements
-	t.transformReturns(fn, info)
+	enter := t.createEnterCall(info)
+	exitDefer := t.createExitDefer(info)
+	recoverDefer := t.createRecoverDefer(info)
+
+	// Step 3: Transform return statements, and bracket deferred calls
+	t.transformReturns(body, info)
+	if t.config.InstrumentDefers {
+		t.instrumentDefers(body, info)
+	}
 
 	// Step 4: Inject instrumentation at function start
-	newBody := []ast.Stmt{
-		enterStmt,
-		recoverDefer,
-		exitDefer,
+	newBody := append(enter, recoverDefer, exitDefer)
+	for _, stmt := range newBody {
+		setPos(stmt, t.injectedPos())
 	}
-	newBody = append(newBody, fn.Body.List...)
-	fn.Body.List = newBody
+	newBody = append(newBody, body.List...)
+	body.List = newBody
+}
 
-	return nil
+// instrumentDefers brackets every unlabeled defer statement of body,
+// outside nested function literals, with deferred EnterDeferred and ExitDeferred calls so
+// the deferred call is traced as a span of its own:
+//
+//	defer __ft_ctx.ExitDeferred()
+//	defer f.Close()
+//	defer __ft_ctx.EnterDeferred("f.Close")
+//
+// Deferred calls run last in, first out, so EnterDeferred runs right before
+// the call and ExitDeferred right after it, even when it panics. The defer
+// statement itself is left as it is, so its function and arguments are
+// still evaluated where it stands. Deferred closures are named like
+// instrumented ones, and skipped when closures are instrumented since they
+// already have a span then.
+func (t *Transformer) instrumentDefers(body *ast.BlockStmt, info *FuncInfo) {
+	closures := make(map[*ast.FuncLit]string)
+	ast.Inspect(body, func(n ast.Node) bool {
+		if lit, ok := n.(*ast.FuncLit); ok {
+			closures[lit] = fmt.Sprintf("%s.func%d", info.Name, len(closures)+1)
+			return false
+		}
+		return true
+	})
+
+	// bracket returns the statements replacing stmt, or nil to keep it
+	bracket := func(stmt ast.Stmt) []ast.Stmt {
+		d, ok := stmt.(*ast.DeferStmt)
+		if !ok {
+			return nil
+		}
+
+		name := types.ExprString(d.Call.Fun)
+		if lit, ok := d.Call.Fun.(*ast.FuncLit); ok {
+			if t.config.InstrumentClosures {
+				return nil
+			}
+			name = closures[lit]
+		}
+
+		exit := &ast.DeferStmt{Call: &ast.CallExpr{
+			Fun: &ast.SelectorExpr{X: ast.NewIdent("__ft_ctx"), Sel: ast.NewIdent("ExitDeferred")},
+		}}
+		enter := &ast.DeferStmt{Call: &ast.CallExpr{
+			Fun:  &ast.SelectorExpr{X: ast.NewIdent("__ft_ctx"), Sel: ast.NewIdent("EnterDeferred")},
+			Args: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(name)}},
+		}}
+		// Positioned at the defer statement, so they print right around it
+		setPos(exit, d.Pos())
+		setPos(enter, d.End())
+		return []ast.Stmt{exit, d, enter}
+	}
+	rewrite := func(list []ast.Stmt) []ast.Stmt {
+		var out []ast.Stmt
+		for _, stmt := range list {
+			if stmts := bracket(stmt); stmts != nil {
+				out = append(out, stmts...)
+			} else {
+				out = append(out, stmt)
+			}
+		}
+		return out
+	}
+
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.BlockStmt:
+			n.List = rewrite(n.List)
+		case *ast.CaseClause:
+			n.Body = rewrite(n.Body)
+		case *ast.CommClause:
+			n.Body = rewrite(n.Body)
+		}
+		return true
+	})
 }
 
 // FuncInfo holds analyzed function information
 type FuncInfo struct {
-	Name           string
-	PackageName    string
-	ReceiverName   string
-	ReceiverType   string
-	Args           []ArgInfo
-	Results        []ResultInfo
+	Name            string
+	PackageName     string
+	ReceiverName    string
+	ReceiverType    string
+	TypeParams      []TypeParamInfo
+	Args            []ArgInfo
+	Results         []ResultInfo
 	HasNamedReturns bool
+	// ReturnsError is set when the last result is of type error, which is
+	// then reported on the EXIT event when non-nil
+	ReturnsError bool
+	// File and Line locate the func keyword in the source being
+	// instrumented; File is empty when it is unknown
+	File string
+	Line int
+}
+
+// TypeParamInfo holds type parameter information for generic functions
+type TypeParamInfo struct {
+	Name       string
+	Constraint string
 }
 
 // ArgInfo holds argument information
 type ArgInfo struct {
 	Name string
 	Type string
+	// Variadic is set for a trailing ...T parameter, whose value inside the
+	// function (and so in the Enter args map) is a []T slice; Type holds
+	// the slice type
+	Variadic bool
 }
 
 // ResultInfo holds return value information
@@ -166,35 +784,91 @@ type ResultInfo struct {
 
 // analyzeFuncSignature extracts function signature information
 func (t *Transformer) analyzeFuncSignature(fn *ast.FuncDecl) *FuncInfo {
-	info := &FuncInfo{
-		Name:        fn.Name.Name,
-		PackageName: t.pkgPath,
-	}
+	info := t.analyzeFuncType(fn.Name.Name, fn.Type)
 
 	// Extract receiver info (for methods)
 	if fn.Recv != nil && len(fn.Recv.List) > 0 {
 		recv := fn.Recv.List[0]
-		if len(recv.Names) > 0 {
+		// A blank receiver cannot be captured
+		if len(recv.Names) > 0 && recv.Names[0].Name != "_" {
 			info.ReceiverName = recv.Names[0].Name
 		}
 		info.ReceiverType = types.ExprString(recv.Type)
+		// Qualify methods with their receiver type, e.g. UserService.LoadUser,
+		// so that methods of different types do not collide in the trace
+		info.Name = receiverTypeName(recv.Type) + "." + info.Name
+	}
+
+	return info
+}
+
+// receiverTypeName returns the name of a receiver's base type, without the
+// pointer and type parameters: *List[T] becomes List
+func receiverTypeName(expr ast.Expr) string {
+	for {
+		switch e := expr.(type) {
+		case *ast.StarExpr:
+			expr = e.X
+		case *ast.ParenExpr:
+			expr = e.X
+		case *ast.IndexExpr:
+			expr = e.X
+		case *ast.IndexListExpr:
+			expr = e.X
+		default:
+			return types.ExprString(expr)
+		}
+	}
+}
+
+// analyzeFuncType extracts parameter and result information from a function
+// type; it is shared by declared functions and function literals
+func (t *Transformer) analyzeFuncType(name string, fnType *ast.FuncType) *FuncInfo {
+	info := &FuncInfo{
+		Name:        name,
+		PackageName: t.pkgPath,
+	}
+	if t.fset != nil && fnType.Pos().IsValid() {
+		pos := t.fset.Position(fnType.Pos())
+		info.File, info.Line = t.sourceFile(pos.Filename), pos.Line
+	}
+
+	// Extract type parameters (generic functions). They are left untouched in
+	// the declaration; generated code only references parameters and results by
+	// name, so the Enter args map captures the instantiated values.
+	if fnType.TypeParams != nil {
+		for _, field := range fnType.TypeParams.List {
+			constraint := types.ExprString(field.Type)
+			for _, name := range field.Names {
+				info.TypeParams = append(info.TypeParams, TypeParamInfo{
+					Name:       name.Name,
+					Constraint: constraint,
+				})
+			}
+		}
 	}
 
 	// Extract arguments
-	if fn.Type.Params != nil {
-		for _, field := range fn.Type.Params.List {
+	if fnType.Params != nil {
+		for _, field := range fnType.Params.List {
 			typeName := types.ExprString(field.Type)
+			ellipsis, variadic := field.Type.(*ast.Ellipsis)
+			if variadic {
+				typeName = "[]" + types.ExprString(ellipsis.Elt)
+			}
 			if len(field.Names) == 0 {
 				// Unnamed parameter
 				info.Args = append(info.Args, ArgInfo{
-					Name: "_",
-					Type: typeName,
+					Name:     "_",
+					Type:     typeName,
+					Variadic: variadic,
 				})
 			} else {
 				for _, name := range field.Names {
 					info.Args = append(info.Args, ArgInfo{
-						Name: name.Name,
-						Type: typeName,
+						Name:     name.Name,
+						Type:     typeName,
+						Variadic: variadic,
 					})
 				}
 			}
@@ -202,9 +876,9 @@ func (t *Transformer) analyzeFuncSignature(fn *ast.FuncDecl) *FuncInfo {
 	}
 
 	// Extract results
-	if fn.Type.Results != nil {
+	if fnType.Results != nil {
 		hasNames := false
-		for _, field := range fn.Type.Results.List {
+		for _, field := range fnType.Results.List {
 			typeName := types.ExprString(field.Type)
 			if len(field.Names) > 0 {
 				hasNames = true
@@ -222,23 +896,28 @@ func (t *Transformer) analyzeFuncSignature(fn *ast.FuncDecl) *FuncInfo {
 			}
 		}
 		info.HasNamedReturns = hasNames
+		if n := len(info.Results); n > 0 && info.Results[n-1].Type == "error" {
+			info.ReturnsError = true
+		}
 	}
 
 	return info
 }
 
-// ensureNamedReturns converts unnamed returns to named returns
-func (t *Transformer) ensureNamedReturns(fn *ast.FuncDecl, info *FuncInfo) {
-	if fn.Type.Results == nil || info.HasNamedReturns {
+// ensureNamedReturns names every result so that rewritten returns can
+// assign it and the deferred Exit can read it. Unnamed and blank (_)
+// results get a synthetic __ft_retN name, N being the result's position.
+func (t *Transformer) ensureNamedReturns(fnType *ast.FuncType, info *FuncInfo) {
+	if fnType.Results == nil {
 		return
 	}
 
-	// Add names to return values
 	idx := 0
-	for _, field := range fn.Type.Results.List {
+	for _, field := range fnType.Results.List {
 		if len(field.Names) == 0 {
 			// Generate name: __ft_ret0, __ft_ret1, etc.
 			name := ast.NewIdent(fmt.Sprintf("__ft_ret%d", idx))
+			name.NamePos = field.Type.Pos()
 			field.Names = []*ast.Ident{name}
 
 			// Update info
@@ -246,19 +925,42 @@ func (t *Transformer) ensureNamedReturns(fn *ast.FuncDecl, info *FuncInfo) {
 				info.Results[idx].Name = name.Name
 			}
 			idx++
+			continue
+		}
+
+		// A blank result cannot be assigned or read, so it needs a name
+		// just like an unnamed one
+		for _, name := range field.Names {
+			if name.Name == "_" {
+				name.Name = fmt.Sprintf("__ft_ret%d", idx)
+				if idx < len(info.Results) {
+					info.Results[idx].Name = name.Name
+				}
+			}
+			idx++
 		}
 	}
 
 	info.HasNamedReturns = true
 }
 
-// createEnterCall creates the flowtrace.Enter() call
-func (t *Transformer) createEnterCall(fn *ast.FuncDecl, info *FuncInfo) *ast.AssignStmt {
+// createEnterCall creates the flowtrace.Enter() call. It is only made while
+// tracing is on, so a function called with tracing off builds no args map:
+//
+//	var __ft_ctx *flowtrace.CallContext
+//	if flowtrace.Enabled() {
+//		__ft_ctx = flowtrace.Enter("pkg", "func", map[string]interface{}{...})
+//	}
+//
+// A nil __ft_ctx ignores the calls made on it.
+func (t *Transformer) createEnterCall(info *FuncInfo) []ast.Stmt {
+	t.usesFlowtrace = true
+
 	// Build args map: map[string]interface{}{"arg1": arg1, "arg2": arg2}
 	var argElements []ast.Expr
 
 	for _, arg := range info.Args {
-		if arg.Name != "_" {
+		if arg.Name != "_" && !t.config.excludesArg(arg.Name, arg.Type) {
 			// Key-value pair
 			argElements = append(argElements,
 				&ast.KeyValueExpr{
@@ -270,7 +972,7 @@ func (t *Transformer) createEnterCall(fn *ast.FuncDecl, info *FuncInfo) *ast.Ass
 	}
 
 	// Add receiver for methods
-	if info.ReceiverName != "" {
+	if info.ReceiverName != "" && !t.config.excludesArg("receiver", info.ReceiverType) {
 		argElements = append([]ast.Expr{
 			&ast.KeyValueExpr{
 				Key:   &ast.BasicLit{Kind: token.STRING, Value: `"receiver"`},
@@ -279,49 +981,93 @@ func (t *Transformer) createEnterCall(fn *ast.FuncDecl, info *FuncInfo) *ast.Ass
 		}, argElements...)
 	}
 
-	// Create: __ft_ctx := flowtrace.Enter("pkg", "func", map[string]interface{}{...})
-	return &ast.AssignStmt{
+	decl := &ast.DeclStmt{
+		Decl: &ast.GenDecl{
+			Tok: token.VAR,
+			Specs: []ast.Spec{
+				&ast.ValueSpec{
+					Names: []*ast.Ident{ast.NewIdent("__ft_ctx")},
+					Type: &ast.StarExpr{X: &ast.SelectorExpr{
+						X:   ast.NewIdent(t.flowtraceName),
+						Sel: ast.NewIdent("CallContext"),
+					}},
+				},
+			},
+		},
+	}
+
+	// Create: __ft_ctx = flowtrace.EnterAt("pkg", "func", "file.go", line, map[string]interface{}{...})
+	// The position is the one of the source, which the instrumented copy
+	// that runs no longer has; without one, Enter looks it up at runtime
+	enterFunc := "Enter"
+	enterArgs := []ast.Expr{
+		&ast.BasicLit{Kind: token.STRING, Value: fmt.Sprintf(`"%s"`, info.PackageName)},
+		&ast.BasicLit{Kind: token.STRING, Value: fmt.Sprintf(`"%s"`, info.Name)},
+	}
+	if info.File != "" {
+		enterFunc = "EnterAt"
+		enterArgs = append(enterArgs,
+			&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(info.File)},
+			&ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(info.Line)},
+		)
+	}
+	enterArgs = append(enterArgs, &ast.CompositeLit{
+		Type: &ast.MapType{
+			Key:   ast.NewIdent("string"),
+			Value: &ast.InterfaceType{Methods: &ast.FieldList{}},
+		},
+		Elts: argElements,
+	})
+
+	enter := &ast.AssignStmt{
 		Lhs: []ast.Expr{ast.NewIdent("__ft_ctx")},
-		Tok: token.DEFINE,
+		Tok: token.ASSIGN,
 		Rhs: []ast.Expr{
 			&ast.CallExpr{
 				Fun: &ast.SelectorExpr{
-					X:   ast.NewIdent("flowtrace"),
-					Sel: ast.NewIdent("Enter"),
-				},
-				Args: []ast.Expr{
-					&ast.BasicLit{Kind: token.STRING, Value: fmt.Sprintf(`"%s"`, info.PackageName)},
-					&ast.BasicLit{Kind: token.STRING, Value: fmt.Sprintf(`"%s"`, info.Name)},
-					&ast.CompositeLit{
-						Type: &ast.MapType{
-							Key:   ast.NewIdent("string"),
-							Value: &ast.InterfaceType{Methods: &ast.FieldList{}},
-						},
-						Elts: argElements,
-					},
+					X:   ast.NewIdent(t.flowtraceName),
+					Sel: ast.NewIdent(enterFunc),
 				},
+				Args: enterArgs,
+			},
+		},
+	}
+
+	enabled := &ast.IfStmt{
+		Cond: &ast.CallExpr{
+			Fun: &ast.SelectorExpr{
+				X:   ast.NewIdent(t.flowtraceName),
+				Sel: ast.NewIdent("Enabled"),
 			},
 		},
+		Body: &ast.BlockStmt{List: []ast.Stmt{enter}},
 	}
+	return []ast.Stmt{decl, enabled}
 }
 
 // createExitDefer creates the defer __ft_ctx.Exit(...) statement
-func (t *Transformer) createExitDefer(fn *ast.FuncDecl, info *FuncInfo) *ast.DeferStmt {
+func (t *Transformer) createExitDefer(info *FuncInfo) *ast.DeferStmt {
 	// Build result map or nil
 	var resultExpr ast.Expr = ast.NewIdent("nil")
 
 	if len(info.Results) > 0 {
-		// Create function that returns results: func() interface{} { return map[string]interface{}{...} }
+		// Create function that returns results:
+		// func() interface{} { return flowtrace.Results{{Name: "n", Value: n}, {Value: __ft_ret1}} }
 		var resultElements []ast.Expr
-		for i, res := range info.Results {
-			if res.Name != "" {
-				resultElements = append(resultElements,
-					&ast.KeyValueExpr{
-						Key:   &ast.BasicLit{Kind: token.STRING, Value: fmt.Sprintf(`"result_%d"`, i)},
-						Value: ast.NewIdent(res.Name),
-					},
-				)
+		for _, res := range info.Results {
+			var fields []ast.Expr
+			// Synthetic names of unnamed and blank results are not logged
+			if !strings.HasPrefix(res.Name, "__ft_ret") {
+				fields = append(fields, &ast.KeyValueExpr{
+					Key:   ast.NewIdent("Name"),
+					Value: &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(res.Name)},
+				})
 			}
+			fields = append(fields, &ast.KeyValueExpr{
+				Key:   ast.NewIdent("Value"),
+				Value: ast.NewIdent(res.Name),
+			})
+			resultElements = append(resultElements, &ast.CompositeLit{Elts: fields})
 		}
 
 		resultExpr = &ast.FuncLit{
@@ -337,9 +1083,9 @@ func (t *Transformer) createExitDefer(fn *ast.FuncDecl, info *FuncInfo) *ast.Def
 					&ast.ReturnStmt{
 						Results: []ast.Expr{
 							&ast.CompositeLit{
-								Type: &ast.MapType{
-									Key:   ast.NewIdent("string"),
-									Value: &ast.InterfaceType{Methods: &ast.FieldList{}},
+								Type: &ast.SelectorExpr{
+									X:   ast.NewIdent(t.flowtraceName),
+									Sel: ast.NewIdent("Results"),
 								},
 								Elts: resultElements,
 							},
@@ -350,21 +1096,59 @@ func (t *Transformer) createExitDefer(fn *ast.FuncDecl, info *FuncInfo) *ast.Def
 		}
 	}
 
-	// Create: defer __ft_ctx.Exit(func() interface{} { return ... })
+	exitCall := &ast.CallExpr{
+		Fun: &ast.SelectorExpr{
+			X:   ast.NewIdent("__ft_ctx"),
+			Sel: ast.NewIdent("Exit"),
+		},
+		Args: []ast.Expr{resultExpr},
+	}
+
+	if !info.ReturnsError {
+		// Create: defer __ft_ctx.Exit(func() interface{} { return ... })
+		return &ast.DeferStmt{Call: exitCall}
+	}
+
+	// Create: defer func() { if err != nil { __ft_ctx.SetError(err) }; __ft_ctx.Exit(...) }()
+	errName := info.Results[len(info.Results)-1].Name
 	return &ast.DeferStmt{
 		Call: &ast.CallExpr{
-			Fun: &ast.SelectorExpr{
-				X:   ast.NewIdent("__ft_ctx"),
-				Sel: ast.NewIdent("Exit"),
+			Fun: &ast.FuncLit{
+				Type: &ast.FuncType{},
+				Body: &ast.BlockStmt{
+					List: []ast.Stmt{
+						&ast.IfStmt{
+							Cond: &ast.BinaryExpr{
+								X:  ast.NewIdent(errName),
+								Op: token.NEQ,
+								Y:  ast.NewIdent("nil"),
+							},
+							Body: &ast.BlockStmt{
+								List: []ast.Stmt{
+									&ast.ExprStmt{
+										X: &ast.CallExpr{
+											Fun: &ast.SelectorExpr{
+												X:   ast.NewIdent("__ft_ctx"),
+												Sel: ast.NewIdent("SetError"),
+											},
+											Args: []ast.Expr{ast.NewIdent(errName)},
+										},
+									},
+								},
+							},
+						},
+						&ast.ExprStmt{X: exitCall},
+					},
+				},
 			},
-			Args: []ast.Expr{resultExpr},
 		},
 	}
 }
 
 // createRecoverDefer creates panic recovery defer statement
-func (t *Transformer) createRecoverDefer(fn *ast.FuncDecl, info *FuncInfo) *ast.DeferStmt {
+func (t *Transformer) createRecoverDefer(info *FuncInfo) *ast.DeferStmt {
 	// Create: defer func() { if r := recover(); r != nil { __ft_ctx.Exception(...); panic(r) } }()
+	t.usesFmt = true
 	return &ast.DeferStmt{
 		Call: &ast.CallExpr{
 			Fun: &ast.FuncLit{
@@ -397,7 +1181,7 @@ func (t *Transformer) createRecoverDefer(fn *ast.FuncDecl, info *FuncInfo) *ast.
 											Args: []ast.Expr{
 												&ast.CallExpr{
 													Fun: &ast.SelectorExpr{
-														X:   ast.NewIdent("fmt"),
+														X:   ast.NewIdent(t.fmtName),
 														Sel: ast.NewIdent("Sprintf"),
 													},
 													Args: []ast.Expr{
@@ -425,17 +1209,34 @@ func (t *Transformer) createRecoverDefer(fn *ast.FuncDecl, info *FuncInfo) *ast.
 }
 
 // transformReturns transforms all return statements to use named returns
-func (t *Transformer) transformReturns(fn *ast.FuncDecl, info *FuncInfo) {
+func (t *Transformer) transformReturns(body *ast.BlockStmt, info *FuncInfo) {
 	if len(info.Results) == 0 {
 		return
 	}
 
 	// Use a visitor to find and replace return statements in their parent context
-	t.transformReturnsInBlock(fn.Body, info)
+	t.transformReturnsInBlock(body, info, nil)
+}
+
+// returnsResults reports whether ret returns the named results of the
+// function, in order, as in return a, b for results (a, b int)
+func returnsResults(ret *ast.ReturnStmt, info *FuncInfo) bool {
+	if len(ret.Results) != len(info.Results) {
+		return false
+	}
+	for i, expr := range ret.Results {
+		ident, ok := expr.(*ast.Ident)
+		if !ok || ident.Name != info.Results[i].Name {
+			return false
+		}
+	}
+	return true
 }
 
-// transformReturnsInBlock recursively transforms return statements in a block
-func (t *Transformer) transformReturnsInBlock(block *ast.BlockStmt, info *FuncInfo) {
+// transformReturnsInBlock recursively transforms return statements in a
+// block. shadowed holds the result names redeclared by the enclosing nested
+// scopes, and is nil for the function body itself.
+func (t *Transformer) transformReturnsInBlock(block *ast.BlockStmt, info *FuncInfo, shadowed map[string]bool) {
 	if block == nil {
 		return
 	}
@@ -443,16 +1244,30 @@ func (t *Transformer) transformReturnsInBlock(block *ast.BlockStmt, info *FuncIn
 	for i := 0; i < len(block.List); i++ {
 		stmt := block.List[i]
 
-		// Check if this is a return statement with results
-		if ret, ok := stmt.(*ast.ReturnStmt); ok && len(ret.Results) > 0 {
+		// Check if this is a return statement with results. One where a
+		// result is shadowed is kept: it couldn't be made bare, and Go sets
+		// the results before the deferred Exit runs either way.
+		if ret, ok := stmt.(*ast.ReturnStmt); ok && len(ret.Results) > 0 && !shadowsResult(shadowed, info) {
+			// return a, b already holding the results a and b is made bare,
+			// as assigning them to themselves would be flagged by vet
+			if returnsResults(ret, info) {
+				ret.Results = nil
+				continue
+			}
+
 			// Create assignment: __ft_ret0, __ft_ret1 = x, y
+			// A single call returning all the values, as in return f(),
+			// becomes __ft_ret0, __ft_ret1 = f()
 			assignment := &ast.AssignStmt{
-				Tok: token.ASSIGN,
+				TokPos: ret.Return,
+				Tok:    token.ASSIGN,
 			}
 
 			// Build LHS (named returns)
 			for _, res := range info.Results {
-				assignment.Lhs = append(assignment.Lhs, ast.NewIdent(res.Name))
+				name := ast.NewIdent(res.Name)
+				name.NamePos = ret.Return
+				assignment.Lhs = append(assignment.Lhs, name)
 			}
 
 			// Use existing RHS from return
@@ -471,94 +1286,232 @@ func (t *Transformer) transformReturnsInBlock(block *ast.BlockStmt, info *FuncIn
 			continue
 		}
 
+		// Names declared in a nested block shadow the results for the
+		// statements after them; the function body shares the results' scope
+		if shadowed != nil {
+			shadowed = declareResults(shadowed, stmt, info)
+		}
+
 		// Recursively handle nested blocks
 		switch s := stmt.(type) {
 		case *ast.IfStmt:
-			t.transformReturnsInBlock(s.Body, info)
+			t.transformReturnsInBlock(s.Body, info, declareResults(shadowed, s.Init, info))
 			if s.Else != nil {
 				if elseBlock, ok := s.Else.(*ast.BlockStmt); ok {
-					t.transformReturnsInBlock(elseBlock, info)
+					t.transformReturnsInBlock(elseBlock, info, declareResults(shadowed, s.Init, info))
 				} else if elseIf, ok := s.Else.(*ast.IfStmt); ok {
-					// Handle else-if: create a temporary block to process it
+					// Handle else-if: create a temporary block to process it.
+					// It is in the scope of the outer if's init.
 					tempBlock := &ast.BlockStmt{List: []ast.Stmt{elseIf}}
-					t.transformReturnsInBlock(tempBlock, info)
+					t.transformReturnsInBlock(tempBlock, info, declareResults(shadowed, s.Init, info))
 				}
 			}
 		case *ast.ForStmt:
-			t.transformReturnsInBlock(s.Body, info)
+			t.transformReturnsInBlock(s.Body, info, declareResults(shadowed, s.Init, info))
 		case *ast.RangeStmt:
-			t.transformReturnsInBlock(s.Body, info)
+			scope := shadowed
+			if s.Tok == token.DEFINE {
+				scope = declareResults(shadowed, &ast.AssignStmt{Lhs: []ast.Expr{s.Key, s.Value}, Tok: token.DEFINE}, info)
+			}
+			t.transformReturnsInBlock(s.Body, info, scope)
 		case *ast.SwitchStmt:
-			t.transformReturnsInBlock(s.Body, info)
+			t.transformReturnsInBlock(s.Body, info, declareResults(shadowed, s.Init, info))
 		case *ast.TypeSwitchStmt:
-			t.transformReturnsInBlock(s.Body, info)
+			scope := declareResults(declareResults(shadowed, s.Init, info), s.Assign, info)
+			t.transformReturnsInBlock(s.Body, info, scope)
 		case *ast.SelectStmt:
-			t.transformReturnsInBlock(s.Body, info)
+			t.transformReturnsInBlock(s.Body, info, declareResults(shadowed, nil, info))
+		case *ast.BlockStmt:
+			t.transformReturnsInBlock(s, info, declareResults(shadowed, nil, info))
 		case *ast.CaseClause:
-			t.transformReturnsInBlock(&ast.BlockStmt{List: s.Body}, info)
+			// The clause body is not a block: write the rewritten list back
+			body := &ast.BlockStmt{List: s.Body}
+			t.transformReturnsInBlock(body, info, declareResults(shadowed, nil, info))
+			s.Body = body.List
 		case *ast.CommClause:
-			t.transformReturnsInBlock(&ast.BlockStmt{List: s.Body}, info)
+			body := &ast.BlockStmt{List: s.Body}
+			t.transformReturnsInBlock(body, info, declareResults(shadowed, s.Comm, info))
+			s.Body = body.List
+		case *ast.LabeledStmt:
+			// A labeled return keeps its label on the assignment, so a goto
+			// still runs both; the bare return follows the labeled statement
+			labeled := &ast.BlockStmt{List: []ast.Stmt{s.Stmt}}
+			t.transformReturnsInBlock(labeled, info, shadowed)
+			s.Stmt = labeled.List[0]
+			if rest := labeled.List[1:]; len(rest) > 0 {
+				block.List = append(block.List[:i+1], append(rest, block.List[i+1:]...)...)
+				i += len(rest)
+			}
 		}
 	}
 }
 
-// ensureFlowtraceImport adds flowtrace import if not present
-func (t *Transformer) ensureFlowtraceImport(file *ast.File) {
-	// Check if flowtrace is already imported
-	hasFlowtrace := false
-	hasFmt := false
+// declareResults returns shadowed plus the result names stmt declares, as
+// a new map when any is added. It never returns nil, so the blocks below a
+// statement know they are nested.
+func declareResults(shadowed map[string]bool, stmt ast.Stmt, info *FuncInfo) map[string]bool {
+	var names []*ast.Ident
+	switch s := stmt.(type) {
+	case *ast.AssignStmt:
+		if s.Tok == token.DEFINE {
+			for _, lhs := range s.Lhs {
+				if ident, ok := lhs.(*ast.Ident); ok {
+					names = append(names, ident)
+				}
+			}
+		}
+	case *ast.DeclStmt:
+		if gen, ok := s.Decl.(*ast.GenDecl); ok {
+			for _, spec := range gen.Specs {
+				switch spec := spec.(type) {
+				case *ast.ValueSpec:
+					names = append(names, spec.Names...)
+				case *ast.TypeSpec:
+					names = append(names, spec.Name)
+				}
+			}
+		}
+	}
 
-	for _, imp := range file.Imports {
-		if imp.Path.Value == `"github.com/rixmerz/flowtrace-agent-go/flowtrace"` {
-			hasFlowtrace = true
+	scope := shadowed
+	for _, name := range names {
+		for _, res := range info.Results {
+			if name.Name == res.Name && !scope[res.Name] {
+				scope = maps.Clone(scope)
+				if scope == nil {
+					scope = map[string]bool{}
+				}
+				scope[res.Name] = true
+			}
 		}
-		if imp.Path.Value == `"fmt"` {
-			hasFmt = true
+	}
+	if scope == nil {
+		scope = map[string]bool{}
+	}
+	return scope
+}
+
+// shadowsResult reports whether any result is in shadowed
+func shadowsResult(shadowed map[string]bool, info *FuncInfo) bool {
+	for _, res := range info.Results {
+		if shadowed[res.Name] {
+			return true
 		}
 	}
+	return false
+}
 
-	// Add imports if needed
-	if !hasFlowtrace {
-		file.Imports = append(file.Imports, &ast.ImportSpec{
-			Path: &ast.BasicLit{Kind: token.STRING, Value: `"github.com/rixmerz/flowtrace-agent-go/flowtrace"`},
-		})
+// ensureFlowtraceImport adds the flowtrace and fmt imports needed by the
+// injected code. Nothing is added when no function was instrumented.
+// A file that already imports the runtime under a known path keeps that
+// import, so code written against either module path still compiles.
+func (t *Transformer) ensureFlowtraceImport(file *ast.File) {
+	if t.usesFlowtrace && flowtraceImportName(file, t.config.FlowtracePkgPath) == "" {
+		addImport(file, t.flowtracePkgPath())
+	}
+	if t.usesFmt {
+		addImport(file, "fmt")
 	}
+}
 
-	if !hasFmt {
-		file.Imports = append(file.Imports, &ast.ImportSpec{
-			Path: &ast.BasicLit{Kind: token.STRING, Value: `"fmt"`},
-		})
+// flowtracePkgPath returns the import path of the runtime package to add
+func (t *Transformer) flowtracePkgPath() string {
+	if t.config.FlowtracePkgPath != "" {
+		return t.config.FlowtracePkgPath
 	}
+	return DefaultFlowtracePkgPath
+}
 
-	// Update import declarations
-	if len(file.Decls) > 0 {
-		// Find or create import declaration
-		var importDecl *ast.GenDecl
-		for _, decl := range file.Decls {
-			if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.IMPORT {
-				importDecl = gen
-				break
-			}
+// importedFlowtracePath returns the path of the file's import of the
+// runtime package, either one of the known paths or extra, or "" if the
+// file has none that code can refer to
+func importedFlowtracePath(file *ast.File, extra string) string {
+	for _, path := range flowtraceImportPaths(extra) {
+		if importName(file, path) != "" {
+			return path
 		}
+	}
+	return ""
+}
 
-		if importDecl == nil {
-			// Create new import declaration
-			importDecl = &ast.GenDecl{
-				Tok: token.IMPORT,
-			}
-			file.Decls = append([]ast.Decl{importDecl}, file.Decls...)
+// flowtraceImportName returns the name the file imports the runtime
+// package under, from one of the known paths or extra, or "" if it does
+// not import it
+func flowtraceImportName(file *ast.File, extra string) string {
+	for _, path := range flowtraceImportPaths(extra) {
+		if name := importName(file, path); name != "" {
+			return name
 		}
+	}
+	return ""
+}
 
-		// Add import specs
-		if !hasFlowtrace {
-			importDecl.Specs = append(importDecl.Specs, &ast.ImportSpec{
-				Path: &ast.BasicLit{Kind: token.STRING, Value: `"github.com/rixmerz/flowtrace-agent-go/flowtrace"`},
-			})
+// flowtraceImportPaths returns extra, if set, followed by the known paths
+// of the runtime package
+func flowtraceImportPaths(extra string) []string {
+	if extra == "" {
+		return knownFlowtraceImportPaths
+	}
+	return append([]string{extra}, knownFlowtraceImportPaths...)
+}
+
+// importName returns the name by which the file's import declarations make
+// path available, its last element when the import is unnamed, or "" if
+// the file does not import path under a name code can refer to, as with a
+// blank or dot import
+func importName(file *ast.File, path string) string {
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.IMPORT {
+			continue
 		}
-		if !hasFmt {
-			importDecl.Specs = append(importDecl.Specs, &ast.ImportSpec{
-				Path: &ast.BasicLit{Kind: token.STRING, Value: `"fmt"`},
-			})
+		for _, spec := range gen.Specs {
+			imp := spec.(*ast.ImportSpec)
+			if p, err := strconv.Unquote(imp.Path.Value); err != nil || p != path {
+				continue
+			}
+			if imp.Name == nil {
+				return path[strings.LastIndex(path, "/")+1:]
+			}
+			if imp.Name.Name != "_" && imp.Name.Name != "." {
+				return imp.Name.Name
+			}
+		}
+	}
+	return ""
+}
+
+// addImport adds an unnamed import of path to the file's first import
+// declaration, unless the file imports path under a name already. The new
+// spec is left without positions for the printer to derive, and
+// file.Imports is left as parsed.
+//
+// The printer estimates the position of a node without one from the text
+// printed since the last known position, and prints the comments before
+// that estimate first. The spec is therefore put ahead of the positioned
+// ones, where only the comments above the declaration come before it. A
+// file without imports gets a declaration of its own for each import, at
+// its package clause, which comments following the clause lie beyond;
+// writing the file merges them.
+func addImport(file *ast.File, path string) {
+	if importName(file, path) != "" {
+		return
+	}
+
+	spec := &ast.ImportSpec{
+		Path: &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(path)},
+	}
+
+	if len(file.Imports) == 0 {
+		importDecl := &ast.GenDecl{TokPos: file.Package, Tok: token.IMPORT, Specs: []ast.Spec{spec}}
+		file.Decls = append([]ast.Decl{importDecl}, file.Decls...)
+		return
+	}
+
+	for _, decl := range file.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.IMPORT {
+			gen.Specs = append([]ast.Spec{spec}, gen.Specs...)
+			return
 		}
 	}
 }
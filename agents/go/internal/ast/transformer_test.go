@@ -1,11 +1,205 @@
 package ast
 
 import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/importer"
 	"go/parser"
 	"go/token"
+	"go/types"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 )
 
+// flowtraceStub mirrors the flowtrace API referenced by generated code so that
+// transformed sources can be type-checked without loading the real package
+const flowtraceStub = `package flowtrace
+
+type CallContext struct{}
+
+type Result struct {
+	Name  string
+	Value interface{}
+}
+
+type Results []Result
+
+func Enabled() bool { return true }
+
+func Enter(pkg, fn string, args map[string]interface{}) *CallContext { return nil }
+
+func EnterAt(pkg, fn, file string, line int, args map[string]interface{}) *CallContext { return nil }
+
+func (ctx *CallContext) Exit(resultFunc func() interface{}) {}
+
+func (ctx *CallContext) SetError(err error) {}
+
+func (ctx *CallContext) ExceptionString(msg string) {}
+
+func (ctx *CallContext) EnterDeferred(fn string) { println("enter", fn) }
+
+func (ctx *CallContext) ExitDeferred() { println("exit") }
+
+func (ctx *CallContext) Capture(name string, value interface{}) {
+	if n, ok := value.(int); ok {
+		println("capture", name, n)
+	}
+}
+`
+
+// stubImporter resolves the flowtrace package to flowtraceStub and everything
+// else to the standard library
+type stubImporter struct {
+	stub *types.Package
+	std  types.Importer
+}
+
+func (i *stubImporter) Import(path string) (*types.Package, error) {
+	if path == "github.com/rixmerz/flowtrace-agent-go/flowtrace" {
+		return i.stub, nil
+	}
+	return i.std.Import(path)
+}
+
+// transformSource instruments source and returns the printed result
+func transformSource(t *testing.T, source string, config *Config) string {
+	t.Helper()
+	return transformFile(t, "test.go", source, config)
+}
+
+// transformFile is transformSource for a file named filename
+func transformFile(t *testing.T, filename, source string, config *Config) string {
+	t.Helper()
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, source, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("Failed to parse source: %v", err)
+	}
+
+	if err := NewTransformer(fset, config).TransformFile(file); err != nil {
+		t.Fatalf("TransformFile failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, file); err != nil {
+		t.Fatalf("Failed to print transformed file: %v", err)
+	}
+
+	// Reformat like the loader does so injected imports end up sorted
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to format transformed file: %v\n%s", err, buf.String())
+	}
+	return string(formatted)
+}
+
+// assertCompiles re-parses transformed source and type-checks it
+func assertCompiles(t *testing.T, source string) {
+	t.Helper()
+
+	fset := token.NewFileSet()
+	stubFile, err := parser.ParseFile(fset, "flowtrace.go", flowtraceStub, 0)
+	if err != nil {
+		t.Fatalf("Failed to parse flowtrace stub: %v", err)
+	}
+	stub, err := (&types.Config{}).Check("github.com/rixmerz/flowtrace-agent-go/flowtrace", fset, []*ast.File{stubFile}, nil)
+	if err != nil {
+		t.Fatalf("Failed to type-check flowtrace stub: %v", err)
+	}
+
+	file, err := parser.ParseFile(fset, "instrumented.go", source, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("Transformed source does not parse: %v\n%s", err, source)
+	}
+
+	conf := &types.Config{Importer: &stubImporter{stub: stub, std: importer.Default()}}
+	if _, err := conf.Check("main", fset, []*ast.File{file}, nil); err != nil {
+		t.Fatalf("Transformed source does not compile: %v\n%s", err, source)
+	}
+}
+
+// resultsStub is a flowtrace stub whose Exit prints the results of the
+// call, to check what the tracer is given
+const resultsStub = `package flowtrace
+
+import "fmt"
+
+type CallContext struct{ fn string }
+
+type Result struct {
+	Name  string
+	Value interface{}
+}
+
+type Results []Result
+
+func Enabled() bool { return true }
+
+func Enter(pkg, fn string, args map[string]interface{}) *CallContext { return &CallContext{fn: fn} }
+
+func EnterAt(pkg, fn, file string, line int, args map[string]interface{}) *CallContext { return &CallContext{fn: fn} }
+
+func (ctx *CallContext) Exit(resultFunc func() interface{}) {
+	if resultFunc != nil {
+		fmt.Printf("exit %s %v\n", ctx.fn, resultFunc())
+	}
+}
+
+func (ctx *CallContext) SetError(err error) {}
+
+func (ctx *CallContext) ExceptionString(msg string) {}
+`
+
+// runInstrumented builds and runs a transformed main package against
+// flowtraceStub and returns its output. It is skipped in short mode since
+// it invokes the go tool.
+func runInstrumented(t *testing.T, source string) string {
+	t.Helper()
+	return runInstrumentedWith(t, source, flowtraceStub)
+}
+
+// runInstrumentedWith is runInstrumented against another flowtrace stub
+func runInstrumentedWith(t *testing.T, source, stub string) string {
+	t.Helper()
+
+	if testing.Short() {
+		t.Skip("skipping go run in short mode")
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":                 "module example.com/instrumented\n\ngo 1.21\n\nrequire github.com/rixmerz/flowtrace-agent-go v0.0.0\n\nreplace github.com/rixmerz/flowtrace-agent-go => ./stub\n",
+		"main.go":                source,
+		"stub/go.mod":            "module github.com/rixmerz/flowtrace-agent-go\n\ngo 1.21\n",
+		"stub/flowtrace/stub.go": stub,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command("go", "run", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("go run failed: %v\n%s\n%s", err, out, source)
+	}
+	return string(out)
+}
+
 func TestTransformerBasicFunction(t *testing.T) {
 	source := `package main
 
@@ -99,3 +293,1511 @@ type Reader interface {
 		t.Fatalf("TransformFile failed: %v", err)
 	}
 }
+
+func TestTransformerGenericFunctions(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		contains []string
+	}{
+		{
+			name: "single type parameter",
+			source: `package main
+
+func Map[T any](xs []T, f func(T) T) []T {
+	out := make([]T, 0, len(xs))
+	for _, x := range xs {
+		out = append(out, f(x))
+	}
+	return out
+}
+`,
+			contains: []string{"func Map[T any](xs []T, f func(T) T) (__ft_ret0 []T)", `"xs": xs`},
+		},
+		{
+			name: "multiple type parameters and constraints",
+			source: `package main
+
+type Number interface {
+	~int | ~int64 | ~float64
+}
+
+func Reduce[T any, N Number](xs []T, init N, f func(N, T) N) N {
+	acc := init
+	for _, x := range xs {
+		acc = f(acc, x)
+	}
+	return acc
+}
+
+func Keys[K comparable, V any](m map[K]V) (keys []K) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return
+}
+`,
+			contains: []string{"func Reduce[T any, N Number](", "func Keys[K comparable, V any](m map[K]V) (keys []K)", `"init": init`},
+		},
+		{
+			name: "generic method on generic receiver",
+			source: `package main
+
+type Pair[K comparable, V any] struct {
+	Key   K
+	Value V
+}
+
+func (p *Pair[K, V]) Swap(v V) V {
+	old := p.Value
+	p.Value = v
+	return old
+}
+
+func (p Pair[K, V]) Get() (K, V) {
+	return p.Key, p.Value
+}
+`,
+			contains: []string{"func (p *Pair[K, V]) Swap(v V) (__ft_ret0 V)", "func (p Pair[K, V]) Get() (__ft_ret0 K, __ft_ret1 V)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := transformSource(t, tt.source, &Config{})
+
+			for _, want := range tt.contains {
+				if !strings.Contains(output, want) {
+					t.Errorf("Expected output to contain %q\n%s", want, output)
+				}
+			}
+
+			assertCompiles(t, output)
+		})
+	}
+}
+
+func TestAnalyzeFuncSignatureTypeParams(t *testing.T) {
+	source := `package main
+
+func Convert[From ~int | ~int64, To any](v From, f func(From) To) To {
+	return f(v)
+}
+`
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "test.go", source, 0)
+	if err != nil {
+		t.Fatalf("Failed to parse source: %v", err)
+	}
+
+	fn := file.Decls[0].(*ast.FuncDecl)
+	info := NewTransformer(fset, &Config{}).analyzeFuncSignature(fn)
+
+	expected := []TypeParamInfo{
+		{Name: "From", Constraint: "~int | ~int64"},
+		{Name: "To", Constraint: "any"},
+	}
+	if len(info.TypeParams) != len(expected) {
+		t.Fatalf("Expected %d type params, got %d", len(expected), len(info.TypeParams))
+	}
+	for i, want := range expected {
+		if info.TypeParams[i] != want {
+			t.Errorf("TypeParams[%d] = %+v, want %+v", i, info.TypeParams[i], want)
+		}
+	}
+}
+
+func TestTransformerVariadic(t *testing.T) {
+	tests := []struct {
+		name        string
+		source      string
+		config      *Config
+		contains    []string
+		notContains []string
+	}{
+		{
+			name: "named variadic",
+			source: `package main
+
+func Join(prefix string, nums ...int) int {
+	total := 0
+	for _, n := range nums {
+		total += n
+	}
+	return total
+}
+
+func main() {
+	Join("a", 1, 2, 3)
+	Join("b", []int{4, 5}...)
+}
+`,
+			contains: []string{`"prefix": prefix`, `"nums": nums`, "func Join(prefix string, nums ...int) (__ft_ret0 int)"},
+		},
+		{
+			name: "unnamed variadic",
+			source: `package main
+
+func Ignore(string, ...int) {}
+
+func Blank(prefix string, _ ...int) {}
+`,
+			contains:    []string{`flowtrace.EnterAt("", "Ignore", "test.go", 3, map[string]interface{}{})`, `"prefix": prefix`},
+			notContains: []string{`"_"`},
+		},
+		{
+			name: "variadic closure",
+			source: `package main
+
+func Run() int {
+	sum := func(nums ...int) int {
+		return len(nums)
+	}
+	return sum(1, 2)
+}
+`,
+			config:   &Config{InstrumentClosures: true},
+			contains: []string{`"nums": nums`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			if config == nil {
+				config = &Config{}
+			}
+			output := transformSource(t, tt.source, config)
+
+			for _, want := range tt.contains {
+				if !strings.Contains(output, want) {
+					t.Errorf("Expected output to contain %q\n%s", want, output)
+				}
+			}
+			for _, unwanted := range tt.notContains {
+				if strings.Contains(output, unwanted) {
+					t.Errorf("Expected output not to contain %q\n%s", unwanted, output)
+				}
+			}
+
+			assertCompiles(t, output)
+		})
+	}
+}
+
+func TestAnalyzeFuncSignatureVariadic(t *testing.T) {
+	source := `package main
+
+func Join(prefix string, nums ...int) {}
+`
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "test.go", source, 0)
+	if err != nil {
+		t.Fatalf("Failed to parse source: %v", err)
+	}
+
+	fn := file.Decls[0].(*ast.FuncDecl)
+	info := NewTransformer(fset, &Config{}).analyzeFuncSignature(fn)
+
+	expected := []ArgInfo{
+		{Name: "prefix", Type: "string"},
+		{Name: "nums", Type: "[]int", Variadic: true},
+	}
+	if len(info.Args) != len(expected) {
+		t.Fatalf("Expected %d args, got %+v", len(expected), info.Args)
+	}
+	for i, want := range expected {
+		if info.Args[i] != want {
+			t.Errorf("Args[%d] = %+v, want %+v", i, info.Args[i], want)
+		}
+	}
+}
+
+func TestTransformerResultNames(t *testing.T) {
+	source := `package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+func Pair(swap bool) (a, b int) {
+	if swap {
+		return 2, 1
+	}
+	return 1, 2
+}
+
+func Twice(_ int, x, y string) (int, int) {
+	return len(x), len(y)
+}
+
+func Forward(swap bool) (int, int) {
+	return Pair(swap)
+}
+
+func Blank(fail bool) (_ int, err error) {
+	if fail {
+		return -1, errors.New("failed")
+	}
+	return 42, nil
+}
+
+type Service struct{}
+
+func (_ Service) Name() (_, _ string) {
+	return "svc", "v1"
+}
+
+func main() {
+	fmt.Println(Pair(false))
+	fmt.Println(Pair(true))
+	fmt.Println(Twice(0, "a", "bcd"))
+	fmt.Println(Forward(true))
+	fmt.Println(Blank(false))
+	fmt.Println(Blank(true))
+	fmt.Println(Service{}.Name())
+}
+`
+	output := transformSource(t, source, &Config{})
+
+	for _, want := range []string{
+		"func Pair(swap bool) (a, b int)",
+		"a, b = 2, 1",
+		"func Twice(_ int, x, y string) (__ft_ret0 int, __ft_ret1 int)",
+		`map[string]interface{}{"x": x, "y": y}`,
+		"__ft_ret0, __ft_ret1 = Pair(swap)",
+		"func Blank(fail bool) (__ft_ret0 int, err error)",
+		"__ft_ret0, err = -1, errors.New(\"failed\")",
+		`flowtrace.Results{{Value: __ft_ret0}, {Name: "err", Value: err}}`,
+		"func (_ Service) Name() (__ft_ret0, __ft_ret1 string)",
+		`flowtrace.EnterAt("", "Service.Name", "test.go", 32, map[string]interface{}{})`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected output to contain %q\n%s", want, output)
+		}
+	}
+
+	assertCompiles(t, output)
+
+	expected := "1 2\n2 1\n1 3\n2 1\n42 <nil>\n-1 failed\nsvc v1\n"
+	if got := runInstrumented(t, output); got != expected {
+		t.Errorf("Instrumented program printed:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestTransformerMethodNames(t *testing.T) {
+	source := `package main
+
+type UserService struct{}
+
+func (s *UserService) LoadUser(id int) string {
+	load := func() string { return "alice" }
+	return load()
+}
+
+type OrderService struct{}
+
+func (o OrderService) LoadUser(id int) string {
+	return "bob"
+}
+
+type List[T any] struct{ items []T }
+
+func (l *List[T]) Len() int {
+	return len(l.items)
+}
+
+func LoadUser(id int) string {
+	return "carol"
+}
+`
+	output := transformSource(t, source, &Config{InstrumentClosures: true})
+
+	for _, want := range []string{
+		`flowtrace.EnterAt("", "UserService.LoadUser", "test.go", 5, map[string]interface{}{"receiver": s, "id": id})`,
+		`flowtrace.EnterAt("", "UserService.LoadUser.func1", `,
+		`flowtrace.EnterAt("", "OrderService.LoadUser", "test.go", 12, map[string]interface{}{"receiver": o, "id": id})`,
+		`flowtrace.EnterAt("", "List.Len", `,
+		`flowtrace.EnterAt("", "LoadUser", "test.go", 22, map[string]interface{}{"id": id})`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected output to contain %q\n%s", want, output)
+		}
+	}
+
+	assertCompiles(t, output)
+}
+
+func TestTransformerErrorResult(t *testing.T) {
+	source := `package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+func divide(a, b int) (int, error) {
+	if b == 0 {
+		return 0, errors.New("division by zero")
+	}
+	return a / b, nil
+}
+
+func parse(s string) (n int, err error) {
+	_, err = fmt.Sscan(s, &n)
+	return
+}
+
+func swapped() (error, int) {
+	return nil, 1
+}
+
+func main() {
+	fmt.Println(divide(10, 2))
+	fmt.Println(divide(10, 0))
+	fmt.Println(parse("7"))
+	fmt.Println(swapped())
+}
+`
+	output := transformSource(t, source, &Config{})
+
+	for _, want := range []string{
+		"if __ft_ret1 != nil {\n\t\t\t__ft_ctx.SetError(__ft_ret1)\n\t\t}",
+		"if err != nil {\n\t\t\t__ft_ctx.SetError(err)\n\t\t}",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected output to contain %q\n%s", want, output)
+		}
+	}
+	// Only a trailing error result is reported
+	if strings.Contains(output, "SetError(__ft_ret0)") {
+		t.Errorf("Leading error result should not be reported\n%s", output)
+	}
+
+	assertCompiles(t, output)
+
+	expected := "5 <nil>\n0 division by zero\n7 <nil>\n<nil> 1\n"
+	if got := runInstrumented(t, output); got != expected {
+		t.Errorf("Instrumented program printed:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestTransformerMultiValueCallReturns(t *testing.T) {
+	source := `package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+func Parse(s string) (int, error) {
+	return strconv.Atoi(s)
+}
+
+func ParseKind(kind, s string) (int, error) {
+	switch kind {
+	case "hex":
+		n, err := strconv.ParseInt(s, 16, 64)
+		return int(n), err
+	case "dec":
+		return strconv.Atoi(s)
+	}
+	{
+		return strconv.Atoi("-" + s)
+	}
+}
+
+func ParseAll(values []string) (n int, err error) {
+	sum := 0
+values:
+	for _, v := range values {
+		select {
+		default:
+			if v == "" {
+				continue values
+			}
+			if n, err := strconv.Atoi(v); err != nil {
+				return n, err
+			}
+		}
+	}
+	return sum, nil
+}
+
+func ParseLast(s string) (int, error) {
+	goto parse
+parse:
+	return strconv.Atoi(s)
+}
+
+func main() {
+	fmt.Println(Parse("12"))
+	fmt.Println(Parse("x"))
+	fmt.Println(ParseKind("hex", "ff"))
+	fmt.Println(ParseKind("dec", "34"))
+	fmt.Println(ParseKind("neg", "5"))
+	fmt.Println(ParseAll([]string{"1", "", "y"}))
+	fmt.Println(ParseLast("6"))
+}
+`
+	output := transformSource(t, source, &Config{})
+
+	for _, want := range []string{
+		"__ft_ret0, __ft_ret1 = strconv.Atoi(s)\n\treturn\n",
+		"case \"dec\":\n\t\t__ft_ret0, __ft_ret1 = strconv.Atoi(s)\n\t\treturn\n",
+		"{\n\t\t__ft_ret0, __ft_ret1 = strconv.Atoi(\"-\" + s)\n\t\treturn\n",
+		// The results are shadowed, so the return can't be made bare
+		"if n, err := strconv.Atoi(v); err != nil {\n\t\t\t\treturn n, err\n",
+		"n, err = sum, nil\n",
+		"parse:\n\t__ft_ret0, __ft_ret1 = strconv.Atoi(s)\n\treturn\n",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected output to contain %q\n%s", want, output)
+		}
+	}
+
+	assertCompiles(t, output)
+
+	expected := "12 <nil>\n" +
+		"0 strconv.Atoi: parsing \"x\": invalid syntax\n" +
+		"255 <nil>\n34 <nil>\n-5 <nil>\n" +
+		"0 strconv.Atoi: parsing \"y\": invalid syntax\n" +
+		"6 <nil>\n"
+	if got := runInstrumented(t, output); got != expected {
+		t.Errorf("Instrumented program printed:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestTransformerNamedResultsWithBareReturns(t *testing.T) {
+	source := `package main
+
+import "fmt"
+
+func Clamp(n, limit int) (result int) {
+	result = n
+	if n > limit {
+		result = limit
+		return
+	}
+	if n < 0 {
+		return 0
+	}
+	if n == limit {
+		return result
+	}
+	if result := n * 2; result > limit {
+		return result - limit
+	}
+	for i := 0; i < 2; i++ {
+		result++
+	}
+	return
+}
+
+func Divide(a, b int) (q, r int) {
+	q, r = a/b, a%b
+	if r == 0 {
+		return q, r
+	}
+	return r, q
+}
+
+func main() {
+	fmt.Println(Clamp(20, 10))
+	fmt.Println(Clamp(-3, 10))
+	fmt.Println(Clamp(10, 10))
+	fmt.Println(Clamp(7, 10))
+	fmt.Println(Clamp(3, 10))
+	fmt.Println(Divide(8, 2))
+	fmt.Println(Divide(7, 2))
+}
+`
+	output := transformSource(t, source, &Config{})
+
+	for _, want := range []string{
+		"func Clamp(n, limit int) (result int) {",
+		"result = limit\n\t\treturn\n",
+		"result = 0\n\t\treturn\n",
+		// Returning the results as they are needs no assignment
+		"if n == limit {\n\t\treturn\n",
+		"if r == 0 {\n\t\treturn\n",
+		"q, r = r, q\n\treturn\n",
+		// The if statement shadows result, so its return stays as written
+		"return result - limit\n",
+		`flowtrace.Results{{Name: "result", Value: result}}`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected output to contain %q\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, "__ft_ret") {
+		t.Errorf("Expected the existing result name to be kept\n%s", output)
+	}
+	if strings.Contains(output, "result = result") || strings.Contains(output, "q, r = q, r") {
+		t.Errorf("Expected no result to be assigned to itself\n%s", output)
+	}
+
+	assertCompiles(t, output)
+
+	expected := "exit Clamp [{result 10}]\n10\n" +
+		"exit Clamp [{result 0}]\n0\n" +
+		"exit Clamp [{result 10}]\n10\n" +
+		"exit Clamp [{result 4}]\n4\n" +
+		"exit Clamp [{result 5}]\n5\n" +
+		"exit Divide [{q 4} {r 0}]\n4 0\n" +
+		"exit Divide [{q 1} {r 3}]\n1 3\n"
+	if got := runInstrumentedWith(t, output, resultsStub); got != expected {
+		t.Errorf("Instrumented program printed:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestTransformerClosures(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		contains []string
+	}{
+		{
+			name: "immediately invoked function",
+			source: `package main
+
+func outer() int {
+	return func(x int) int {
+		return x * 2
+	}(21)
+}
+`,
+			contains: []string{`flowtrace.EnterAt("", "outer", `, `flowtrace.EnterAt("", "outer.func1", `, `{"x": x}`},
+		},
+		{
+			name: "closure stored in variable",
+			source: `package main
+
+import "strings"
+
+func greet(names []string) (out []string) {
+	format := func(name string) string {
+		return "hello " + strings.ToUpper(name)
+	}
+	for _, name := range names {
+		out = append(out, format(name))
+	}
+	return
+}
+`,
+			contains: []string{`flowtrace.EnterAt("", "greet.func1", `, `{"name": name}`},
+		},
+		{
+			name: "go func launched in loop",
+			source: `package main
+
+import "sync"
+
+func spawn(n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			_ = id
+		}(i)
+	}
+	wg.Wait()
+}
+`,
+			contains: []string{`flowtrace.EnterAt("", "spawn.func1", `, `{"id": id}`},
+		},
+		{
+			name: "nested closures and captured named return",
+			source: `package main
+
+import "errors"
+
+func process() (err error) {
+	defer func() {
+		if err != nil {
+			err = errors.New("wrapped: " + err.Error())
+		}
+	}()
+	run := func() error {
+		inner := func() error {
+			return errors.New("failed")
+		}
+		return inner()
+	}
+	return run()
+}
+`,
+			contains: []string{`"process.func1"`, `"process.func2"`, `"process.func2.1"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := transformSource(t, tt.source, &Config{InstrumentClosures: true})
+
+			for _, want := range tt.contains {
+				if !strings.Contains(output, want) {
+					t.Errorf("Expected output to contain %q\n%s", want, output)
+				}
+			}
+
+			assertCompiles(t, output)
+		})
+	}
+}
+
+func TestTransformerClosuresSingleInstrumentation(t *testing.T) {
+	source := `package main
+
+func outer() {
+	f := func() {}
+	f()
+}
+`
+	output := transformSource(t, source, &Config{InstrumentClosures: true})
+
+	// One Enter for outer and one for the closure; the injected recover and
+	// exit defers must not be instrumented as closures themselves
+	if count := strings.Count(output, "flowtrace.Enter"); count != 2 {
+		t.Errorf("Expected 2 Enter calls, got %d\n%s", count, output)
+	}
+
+	withoutClosures := transformSource(t, source, &Config{})
+	if count := strings.Count(withoutClosures, "flowtrace.EnterAt("); count != 1 {
+		t.Errorf("Expected closures to be skipped by default, got %d Enter calls", count)
+	}
+}
+
+func TestTransformerDefers(t *testing.T) {
+	source := `package main
+
+import "fmt"
+
+type file struct{ name string }
+
+func (f *file) Close() { fmt.Println("close", f.name) }
+
+func cleanup(step int) { fmt.Println("cleanup", step) }
+
+func work() {
+	f := &file{name: "a"}
+	defer f.Close()
+	step := 1
+	defer cleanup(step)
+	step = 2
+	defer func() {
+		fmt.Println("closure", step)
+	}()
+	fmt.Println("body")
+}
+
+func main() {
+	work()
+}
+`
+	output := transformSource(t, source, &Config{InstrumentDefers: true})
+
+	for _, want := range []string{
+		"defer __ft_ctx.ExitDeferred()\n\tdefer f.Close()\n\tdefer __ft_ctx.EnterDeferred(\"f.Close\")",
+		"defer __ft_ctx.ExitDeferred()\n\tdefer cleanup(step)\n\tdefer __ft_ctx.EnterDeferred(\"cleanup\")",
+		`defer __ft_ctx.EnterDeferred("work.func1")`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected output to contain %q\n%s", want, output)
+		}
+	}
+	assertCompiles(t, output)
+
+	// Each deferred call runs inside its own span, after the body, with its
+	// arguments evaluated at the defer statement
+	expected := "body\nenter work.func1\nclosure 2\nexit\nenter cleanup\ncleanup 1\nexit\nenter f.Close\nclose a\nexit\n"
+	if got := runInstrumented(t, output); got != expected {
+		t.Errorf("Instrumented program printed:\n%s\nexpected:\n%s", got, expected)
+	}
+
+	// Instrumented closures have a span already
+	withClosures := transformSource(t, source, &Config{InstrumentDefers: true, InstrumentClosures: true})
+	if strings.Contains(withClosures, `EnterDeferred("work.func1")`) || !strings.Contains(withClosures, `EnterDeferred("f.Close")`) {
+		t.Errorf("Expected only the deferred closure to be left alone\n%s", withClosures)
+	}
+	assertCompiles(t, withClosures)
+
+	if without := transformSource(t, source, &Config{}); strings.Contains(without, "EnterDeferred") {
+		t.Errorf("Expected deferred calls to be left alone by default\n%s", without)
+	}
+}
+
+func TestTransformerIdempotent(t *testing.T) {
+	source := `package main
+
+import "errors"
+
+type Calculator struct{}
+
+func (c *Calculator) Divide(a, b int) (int, error) {
+	if b == 0 {
+		return 0, errors.New("division by zero")
+	}
+	return a / b, nil
+}
+
+func run() {
+	worker := func() {}
+	worker()
+}
+`
+	config := &Config{InstrumentClosures: true}
+
+	first := transformSource(t, source, config)
+	second := transformSource(t, first, config)
+
+	if first != second {
+		t.Errorf("Re-instrumenting changed the output\nfirst:\n%s\nsecond:\n%s", first, second)
+	}
+
+	if count := strings.Count(second, "flowtrace.EnterAt("); count != 3 {
+		t.Errorf("Expected 3 Enter calls, got %d", count)
+	}
+}
+
+func TestTransformFileTestFiles(t *testing.T) {
+	source := `package store
+
+func helper() int {
+	return 1
+}
+`
+
+	tests := []struct {
+		filename        string
+		instrumentTests bool
+		expected        bool
+	}{
+		{filename: "store.go", instrumentTests: false, expected: true},
+		{filename: "store_test.go", instrumentTests: false, expected: false},
+		{filename: "store_test.go", instrumentTests: true, expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filename+" tests="+strconv.FormatBool(tt.instrumentTests), func(t *testing.T) {
+			fset := token.NewFileSet()
+			file, err := parser.ParseFile(fset, tt.filename, source, parser.ParseComments)
+			if err != nil {
+				t.Fatalf("Failed to parse source: %v", err)
+			}
+
+			config := &Config{InstrumentTests: tt.instrumentTests}
+			if err := NewTransformer(fset, config).TransformFile(file); err != nil {
+				t.Fatalf("TransformFile failed: %v", err)
+			}
+
+			fn := file.Decls[len(file.Decls)-1].(*ast.FuncDecl)
+			if got := isInstrumentedBody(fn.Body); got != tt.expected {
+				t.Errorf("Expected instrumented=%v, got %v", tt.expected, got)
+			}
+			if got := config.IncludesFile(tt.filename); got != tt.expected {
+				t.Errorf("Expected IncludesFile=%v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestTransformerSkipsInstrumentedFunction(t *testing.T) {
+	// A manually instrumented function in a file that does not yet import
+	// flowtrace is left alone while its neighbours are instrumented
+	source := `package main
+
+func manual() {
+	__ft_ctx := flowtrace.Enter("main", "manual", nil)
+	defer __ft_ctx.Exit(nil)
+}
+
+func plain() {}
+`
+	output := transformSource(t, source, &Config{})
+
+	if count := strings.Count(output, "flowtrace.Enter"); count != 2 {
+		t.Errorf("Expected 2 Enter calls, got %d\n%s", count, output)
+	}
+	if !strings.Contains(output, `flowtrace.EnterAt("", "plain", `) {
+		t.Errorf("Expected plain to be instrumented\n%s", output)
+	}
+}
+
+func TestTransformerGuardsEnter(t *testing.T) {
+	source := `package main
+
+func Add(a, b int) int {
+	return a + b
+}
+`
+	output := transformSource(t, source, &Config{})
+
+	// The args map is only built while tracing is on
+	want := "\tvar __ft_ctx *flowtrace.CallContext\n" +
+		"\tif flowtrace.Enabled() {\n" +
+		"\t\t__ft_ctx = flowtrace.EnterAt(\"\", \"Add\", \"test.go\", 3, map[string]interface{}{\"a\": a, \"b\": b})\n" +
+		"\t}\n"
+	if !strings.Contains(output, want) {
+		t.Errorf("Expected Enter to be guarded by flowtrace.Enabled\n%s", output)
+	}
+	assertCompiles(t, output)
+
+	// Instrumenting again leaves the function alone
+	if again := transformSource(t, output, &Config{}); strings.Count(again, "flowtrace.EnterAt(") != 1 {
+		t.Errorf("Expected the guarded function to be detected as instrumented\n%s", again)
+	}
+}
+
+func TestTransformerSourcePositions(t *testing.T) {
+	source := `package main
+
+import "fmt"
+
+// Greet prints a greeting
+func Greet(name string) {
+	print := func(s string) {
+		fmt.Println(s)
+	}
+	print("hello " + name)
+}
+
+func (s *Service) Run() {}
+
+type Service struct{}
+`
+	// The injected code shifts the lines of the instrumented copy, so
+	// functions are located by their lines in the source
+	dir := t.TempDir()
+	config := &Config{InstrumentClosures: true}
+	output := transformFile(t, filepath.Join(dir, "greet.go"), source, config)
+	file := strconv.Quote(filepath.Join(dir, "greet.go"))
+	for _, want := range []string{
+		`flowtrace.EnterAt("", "Greet", ` + file + `, 6, `,
+		`flowtrace.EnterAt("", "Greet.func1", ` + file + `, 7, `,
+		`flowtrace.EnterAt("", "Service.Run", ` + file + `, 13, `,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected output to contain %q\n%s", want, output)
+		}
+	}
+
+	// A copy is located in the directory it was copied from
+	src := filepath.Join(dir, "src")
+	config = &Config{CopyDir: filepath.Join(dir, "copy"), SourceDir: src}
+	output = transformFile(t, filepath.Join(dir, "copy", "cmd", "greet.go"), source, config)
+	want := `flowtrace.EnterAt("", "Greet", ` + strconv.Quote(filepath.Join(src, "cmd", "greet.go")) + `, 6, `
+	if !strings.Contains(output, want) {
+		t.Errorf("Expected output to contain %q\n%s", want, output)
+	}
+}
+
+func TestEnsureFlowtraceImport(t *testing.T) {
+	const otherPath = "github.com/flowtrace/flowtrace-go/flowtrace"
+
+	tests := []struct {
+		name   string
+		config Config
+		source string
+		want   map[string]int
+		uses   string // how the injected code refers to flowtrace
+	}{
+		{
+			name: "no imports",
+			source: `package main
+
+// run does the work
+func run(n int) int {
+	return n * 2
+}
+`,
+			want: map[string]int{DefaultFlowtracePkgPath: 1, "fmt": 1},
+		},
+		{
+			name: "single import",
+			source: `package main
+
+import "errors"
+
+func run() error {
+	return errors.New("failed")
+}
+`,
+			want: map[string]int{"errors": 1, DefaultFlowtracePkgPath: 1, "fmt": 1},
+		},
+		{
+			name: "grouped imports",
+			source: `package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func run(s string) string {
+	return fmt.Sprint(strings.ToUpper(s))
+}
+`,
+			want: map[string]int{"fmt": 1, "strings": 1, DefaultFlowtracePkgPath: 1},
+		},
+		{
+			name: "flowtrace already imported",
+			source: `package main
+
+import "github.com/rixmerz/flowtrace-agent-go/flowtrace"
+
+func setup() {
+	flowtrace.Start(flowtrace.Config{})
+}
+`,
+			want: map[string]int{DefaultFlowtracePkgPath: 1, "fmt": 1},
+		},
+		{
+			name: "other module path already imported",
+			source: `package main
+
+import "github.com/flowtrace/flowtrace-go/flowtrace"
+
+func setup() {
+	flowtrace.Start(flowtrace.Config{})
+}
+`,
+			want: map[string]int{otherPath: 1, "fmt": 1},
+		},
+		{
+			name:   "configured module path",
+			config: Config{FlowtracePkgPath: otherPath},
+			source: `package main
+
+func run(n int) int {
+	return n * 2
+}
+`,
+			want: map[string]int{otherPath: 1, "fmt": 1},
+		},
+		{
+			name:   "configured path with default path already imported",
+			config: Config{FlowtracePkgPath: otherPath},
+			source: `package main
+
+import "github.com/rixmerz/flowtrace-agent-go/flowtrace"
+
+func setup() {
+	flowtrace.Start(flowtrace.Config{})
+}
+`,
+			want: map[string]int{DefaultFlowtracePkgPath: 1, "fmt": 1},
+		},
+		{
+			name: "flowtrace imported under an alias",
+			source: `package main
+
+import ft "github.com/rixmerz/flowtrace-agent-go/flowtrace"
+
+func setup() {
+	ft.Start(ft.Config{})
+}
+`,
+			want: map[string]int{DefaultFlowtracePkgPath: 1, "fmt": 1},
+			uses: "ft.EnterAt(",
+		},
+		{
+			name: "flowtrace and fmt imported under aliases",
+			source: `package main
+
+import (
+	f "fmt"
+
+	ft "github.com/flowtrace/flowtrace-go/flowtrace"
+)
+
+func setup() {
+	ft.Start(ft.Config{})
+	f.Println("started")
+}
+`,
+			want: map[string]int{otherPath: 1, "fmt": 1},
+			uses: "f.Sprintf(",
+		},
+		{
+			name: "flowtrace imported for side effects",
+			source: `package main
+
+import _ "github.com/rixmerz/flowtrace-agent-go/flowtrace"
+
+func run(n int) int {
+	return n * 2
+}
+`,
+			want: map[string]int{DefaultFlowtracePkgPath: 2, "fmt": 1},
+			uses: "flowtrace.EnterAt(",
+		},
+		{
+			name: "nothing instrumented",
+			source: `package main
+
+import "os"
+
+func init() {
+	os.Exit(0)
+}
+`,
+			want: map[string]int{"os": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fset := token.NewFileSet()
+			file, err := parser.ParseFile(fset, "test.go", tt.source, parser.ParseComments)
+			if err != nil {
+				t.Fatalf("Failed to parse source: %v", err)
+			}
+			if err := NewTransformer(fset, &tt.config).TransformFile(file); err != nil {
+				t.Fatalf("TransformFile failed: %v", err)
+			}
+
+			// The printed file must be valid Go without any reformatting
+			var buf bytes.Buffer
+			if err := format.Node(&buf, fset, file); err != nil {
+				t.Fatalf("Failed to print transformed file: %v", err)
+			}
+			reparsed, err := parser.ParseFile(token.NewFileSet(), "out.go", buf.Bytes(), parser.ImportsOnly)
+			if err != nil {
+				t.Fatalf("Transformed source does not parse: %v\n%s", err, buf.String())
+			}
+
+			got := make(map[string]int)
+			for _, imp := range reparsed.Imports {
+				path, _ := strconv.Unquote(imp.Path.Value)
+				got[path]++
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("Expected imports %v, got %v\n%s", tt.want, got, buf.String())
+			}
+			for path, count := range tt.want {
+				if got[path] != count {
+					t.Errorf("Expected %d import(s) of %q, got %d\n%s", count, path, got[path], buf.String())
+				}
+			}
+			if tt.uses != "" && !strings.Contains(buf.String(), tt.uses) {
+				t.Errorf("Expected injected code to call %s\n%s", tt.uses, buf.String())
+			}
+		})
+	}
+}
+
+func TestTransformerDirectives(t *testing.T) {
+	source := `package store
+
+func plain() {}
+
+//flowtrace:skip
+func skipped() {}
+
+// traced is always instrumented.
+//
+//flowtrace:trace
+func traced() {}
+`
+
+	tests := []struct {
+		name     string
+		pkgPath  string
+		config   *Config
+		expected []string
+	}{
+		{
+			name:     "no filters",
+			pkgPath:  "example.com/app/store",
+			config:   &Config{},
+			expected: []string{"plain", "traced"},
+		},
+		{
+			name:     "package included",
+			pkgPath:  "example.com/app/store",
+			config:   &Config{Include: []string{"example.com/app/**"}},
+			expected: []string{"plain", "traced"},
+		},
+		{
+			name:     "package excluded",
+			pkgPath:  "example.com/app/store",
+			config:   &Config{Exclude: []string{"example.com/app/**"}},
+			expected: []string{"traced"},
+		},
+		{
+			name:     "package not in include list",
+			pkgPath:  "example.com/app/store",
+			config:   &Config{Include: []string{"example.com/other/**"}},
+			expected: []string{"traced"},
+		},
+		{
+			name:     "unknown package ignores filters",
+			pkgPath:  "",
+			config:   &Config{Exclude: []string{"example.com/app/**"}},
+			expected: []string{"plain", "traced"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fset := token.NewFileSet()
+			file, err := parser.ParseFile(fset, "store.go", source, parser.ParseComments)
+			if err != nil {
+				t.Fatalf("Failed to parse source: %v", err)
+			}
+
+			transformer := NewTransformer(fset, tt.config)
+			transformer.SetPackagePath(tt.pkgPath)
+			if err := transformer.TransformFile(file); err != nil {
+				t.Fatalf("TransformFile failed: %v", err)
+			}
+
+			var instrumented []string
+			for _, decl := range file.Decls {
+				if fn, ok := decl.(*ast.FuncDecl); ok && isInstrumentedBody(fn.Body) {
+					instrumented = append(instrumented, fn.Name.Name)
+				}
+			}
+			if strings.Join(instrumented, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("Expected %v instrumented, got %v", tt.expected, instrumented)
+			}
+		})
+	}
+}
+
+func TestTransformerMinComplexity(t *testing.T) {
+	source := `package store
+
+type User struct{ name string }
+
+// Name has complexity 1
+func (u *User) Name() string {
+	return u.name
+}
+
+// Validate has complexity 3
+func (u *User) Validate() bool {
+	if u == nil || u.name == "" {
+		return false
+	}
+	return true
+}
+
+// ID is simple but always traced.
+//
+//flowtrace:trace
+func ID() int { return 1 }
+`
+
+	tests := []struct {
+		name          string
+		minComplexity int
+		expected      []string
+	}{
+		{name: "unset", minComplexity: 0, expected: []string{"Name", "Validate", "ID"}},
+		{name: "skip trivial", minComplexity: 2, expected: []string{"Validate", "ID"}},
+		{name: "at threshold", minComplexity: 3, expected: []string{"Validate", "ID"}},
+		{name: "above all", minComplexity: 4, expected: []string{"ID"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := transformSource(t, source, &Config{MinComplexity: tt.minComplexity})
+
+			var instrumented []string
+			for _, name := range []string{"User.Name", "User.Validate", "ID"} {
+				if strings.Contains(output, `flowtrace.EnterAt("", "`+name+`", `) {
+					instrumented = append(instrumented, name[strings.LastIndex(name, ".")+1:])
+				}
+			}
+			if strings.Join(instrumented, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("Expected %v instrumented, got %v\n%s", tt.expected, instrumented, output)
+			}
+			assertCompiles(t, output)
+		})
+	}
+}
+
+func TestTransformerOnlyExported(t *testing.T) {
+	source := `package store
+
+type User struct{ id int }
+
+type UserService struct{}
+
+func (s *UserService) LoadUser(id int) (User, error) {
+	return s.internalLoad(id)
+}
+
+func (s *UserService) internalLoad(id int) (User, error) {
+	return User{id: id}, nil
+}
+
+func loadUser(id int) User {
+	return User{id: id}
+}
+
+// audit is unexported but always traced.
+//
+//flowtrace:trace
+func audit() {}
+`
+
+	tests := []struct {
+		name         string
+		onlyExported bool
+		expected     []string
+	}{
+		{name: "unset", onlyExported: false, expected: []string{"UserService.LoadUser", "UserService.internalLoad", "loadUser", "audit"}},
+		{name: "only exported", onlyExported: true, expected: []string{"UserService.LoadUser", "audit"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := transformSource(t, source, &Config{OnlyExported: tt.onlyExported})
+
+			var instrumented []string
+			for _, name := range []string{"UserService.LoadUser", "UserService.internalLoad", "loadUser", "audit"} {
+				if strings.Contains(output, `flowtrace.EnterAt("", "`+name+`", `) {
+					instrumented = append(instrumented, name)
+				}
+			}
+			if strings.Join(instrumented, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("Expected %v instrumented, got %v\n%s", tt.expected, instrumented, output)
+			}
+			assertCompiles(t, output)
+		})
+	}
+}
+
+func TestTransformerOnly(t *testing.T) {
+	source := `package store
+
+type User struct{ id int }
+
+type UserService struct{}
+
+func (s *UserService) LoadUser(id int) (User, error) {
+	return s.internalLoad(id)
+}
+
+func (s *UserService) internalLoad(id int) (User, error) {
+	return User{id: id}, nil
+}
+
+func LoadUser(id int) User {
+	return User{id: id}
+}
+
+//flowtrace:trace
+func audit() {}
+`
+	names := []string{"UserService.LoadUser", "UserService.internalLoad", "LoadUser", "audit"}
+
+	tests := []struct {
+		name     string
+		only     []string
+		expected []string
+	}{
+		{name: "method", only: []string{"UserService.LoadUser"}, expected: []string{"UserService.LoadUser"}},
+		{name: "whole name only", only: []string{"LoadUser"}, expected: []string{"LoadUser"}},
+		{name: "package qualified glob", only: []string{"store.UserService.*"}, expected: []string{"UserService.LoadUser", "UserService.internalLoad"}},
+		{name: "repeated", only: []string{"audit", "*.internalLoad"}, expected: []string{"UserService.internalLoad", "audit"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := transformSource(t, source, &Config{Only: tt.only})
+
+			var instrumented []string
+			for _, name := range names {
+				if strings.Contains(output, `flowtrace.EnterAt("", "`+name+`", `) {
+					instrumented = append(instrumented, name)
+				}
+			}
+			if strings.Join(instrumented, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("Expected %v instrumented, got %v\n%s", tt.expected, instrumented, output)
+			}
+			assertCompiles(t, output)
+		})
+	}
+
+	// A file without any of the functions is left as it is
+	output := transformSource(t, source, &Config{Only: []string{"OtherService.*"}})
+	if strings.Contains(output, "flowtrace.") || strings.Contains(output, "import") {
+		t.Errorf("Expected no instrumentation, got\n%s", output)
+	}
+}
+
+func TestTransformerExcludeArgs(t *testing.T) {
+	source := `package main
+
+import (
+	"context"
+	"database/sql"
+	"io"
+)
+
+type Repo struct{ db *sql.DB }
+
+func (r *Repo) Find(ctx context.Context, id int, token string) error {
+	return nil
+}
+
+func Upload(ctx context.Context, db *sql.DB, body io.Reader, name string) {}
+
+func Log(ctx context.Context, values ...any) {}
+`
+	output := transformSource(t, source, &Config{
+		ExcludeArgs:     []string{"token", "receiver"},
+		ExcludeArgTypes: []string{"context.Context", "*sql.DB", "io.Reader", "[]any"},
+	})
+
+	for _, want := range []string{
+		`flowtrace.EnterAt("", "Repo.Find", "test.go", 11, map[string]interface{}{"id": id})`,
+		`flowtrace.EnterAt("", "Upload", "test.go", 15, map[string]interface{}{"name": name})`,
+		`flowtrace.EnterAt("", "Log", "test.go", 17, map[string]interface{}{})`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected output to contain %q\n%s", want, output)
+		}
+	}
+	assertCompiles(t, output)
+}
+
+func TestTransformerDefaultExcludeArgTypes(t *testing.T) {
+	source := `package main
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+type Order struct{ ID int }
+
+func Process(ctx context.Context, r io.Reader, w io.Writer, mu *sync.Mutex, done chan struct{}, results <-chan int, order Order, ids []int, name string) {}
+`
+	wantDefault := `flowtrace.EnterAt("", "Process", "test.go", 11, map[string]interface{}{"order": order, "ids": ids, "name": name})`
+	if output := transformSource(t, source, &Config{}); !strings.Contains(output, wantDefault) {
+		t.Errorf("Expected the default types to be left out\n%s", output)
+	} else {
+		assertCompiles(t, output)
+	}
+
+	wantAll := `flowtrace.EnterAt("", "Process", "test.go", 11, map[string]interface{}{"ctx": ctx, "r": r, "w": w, "mu": mu, "done": done, "results": results, "order": order, "ids": ids, "name": name})`
+	if output := transformSource(t, source, &Config{ExcludeArgTypes: []string{}}); !strings.Contains(output, wantAll) {
+		t.Errorf("Expected an empty ExcludeArgTypes to capture every parameter\n%s", output)
+	}
+}
+
+func TestTransformerSkipped(t *testing.T) {
+	source := `package store
+
+type Store struct{}
+
+func init() {}
+
+func (s *Store) Get() int {
+	return 1
+}
+
+//flowtrace:skip
+func Debug() {}
+
+func fastAdd(a, b int) int
+`
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "store.go", source, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("Failed to parse source: %v", err)
+	}
+	transformer := NewTransformer(fset, &Config{})
+	if err := transformer.TransformFile(file); err != nil {
+		t.Fatalf("TransformFile failed: %v", err)
+	}
+
+	if got := transformer.Instrumented(); len(got) != 1 || got[0] != "Store.Get" {
+		t.Errorf("Expected Store.Get to be instrumented, got %v", got)
+	}
+	expected := []SkippedFunction{
+		{Name: "init", Reason: SkipInit},
+		{Name: "Debug", Reason: SkipFiltered},
+		{Name: "fastAdd", Reason: SkipNoBody},
+	}
+	if got := transformer.Skipped(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %+v skipped, got %+v", expected, got)
+	}
+}
+
+func TestTransformerSkipsCgoFiles(t *testing.T) {
+	source := `package native
+
+// int add(int a, int b) { return a + b; }
+import "C"
+
+func Add(a, b int) int {
+	return int(C.add(C.int(a), C.int(b)))
+}
+`
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "native.go", source, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("Failed to parse source: %v", err)
+	}
+	transformer := NewTransformer(fset, &Config{})
+	if err := transformer.TransformFile(file); err != nil {
+		t.Fatalf("TransformFile failed: %v", err)
+	}
+
+	if got := transformer.Instrumented(); len(got) != 0 {
+		t.Errorf("Expected nothing instrumented in a cgo file, got %v", got)
+	}
+	expected := []SkippedFunction{{Name: "Add", Reason: SkipCgo}}
+	if got := transformer.Skipped(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %+v skipped, got %+v", expected, got)
+	}
+	if len(file.Imports) != 1 {
+		t.Errorf("Expected no import added to a cgo file, got %d imports", len(file.Imports))
+	}
+}
+
+func TestTransformerCaptures(t *testing.T) {
+	source := `package main
+
+func Sum(n int) int {
+	total := 0
+	for i := 0; i < n; i++ {
+		total += i
+		//flowtrace:capture i total
+	}
+	//flowtrace:capture missing
+	return total
+}
+
+func main() {
+	Sum(2)
+}
+`
+
+	output := transformSource(t, source, &Config{})
+	assertCompiles(t, output)
+
+	want := "\t\ttotal += i\n\t\t//flowtrace:capture i total\n\t\t__ft_ctx.Capture(\"i\", i)\n\t\t__ft_ctx.Capture(\"total\", total)\n\t}"
+	if !strings.Contains(output, want) {
+		t.Errorf("Expected the loop to capture i and total below the comment, got:\n%s", output)
+	}
+	if strings.Contains(output, "missing)") {
+		t.Errorf("Expected a variable out of scope not to be captured, got:\n%s", output)
+	}
+
+	expected := "capture i 0\ncapture total 0\ncapture i 1\ncapture total 1\n"
+	if got := runInstrumented(t, output); got != expected {
+		t.Errorf("Expected the loop variable at each iteration %q, got %q", expected, got)
+	}
+}
@@ -0,0 +1,303 @@
+package ast
+
+import (
+	"go/ast"
+	"go/token"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// UninstrumentFile removes the instrumentation injected by Transformer from
+// file: the Enter call and its deferred Exit and recover handlers, the
+// Capture calls of //flowtrace:capture comments, the spans of deferred
+// calls, the result names synthesized for unnamed results, and the return
+// statements rewritten to assign them. The flowtrace and fmt imports are
+// dropped when nothing else uses them. It reports whether the file was
+// changed.
+func UninstrumentFile(fset *token.FileSet, file *ast.File) bool {
+	changed := false
+
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch fn := n.(type) {
+		case *ast.FuncDecl:
+			if uninstrumentBody(fset, fn.Type, fn.Body) {
+				changed = true
+			}
+		case *ast.FuncLit:
+			if uninstrumentBody(fset, fn.Type, fn.Body) {
+				changed = true
+			}
+		}
+		return true
+	})
+
+	if !changed {
+		return false
+	}
+
+	deleted := false
+	if path := importedFlowtracePath(file, ""); path != "" && !astutil.UsesImport(file, path) {
+		deleted = astutil.DeleteImport(fset, file, path)
+	}
+	// The injected recover handler is the only fmt user an instrumented
+	// file may have gained; a file that used fmt before still does
+	if !astutil.UsesImport(file, "fmt") {
+		deleted = astutil.DeleteImport(fset, file, "fmt") || deleted
+	}
+	if deleted {
+		collapseImports(file)
+	}
+
+	return true
+}
+
+// collapseImports drops the parentheses of import declarations left with a
+// single spec, undoing the grouping addImport introduced
+func collapseImports(file *ast.File) {
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.IMPORT {
+			continue
+		}
+		if len(gen.Specs) == 1 {
+			gen.Lparen = token.NoPos
+			gen.Rparen = token.NoPos
+		}
+	}
+}
+
+// uninstrumentBody strips the statements injected by instrumentBody from a
+// function body and restores its original returns
+func uninstrumentBody(fset *token.FileSet, fnType *ast.FuncType, body *ast.BlockStmt) bool {
+	start := enterStmts(body)
+	if start == 0 {
+		return false
+	}
+
+	// The Enter call is followed by the recover and Exit defers
+	end := start
+	for end < len(body.List) && end < start+2 {
+		if d, ok := body.List[end].(*ast.DeferStmt); !ok || !referencesCallContext(d) {
+			break
+		}
+		end++
+	}
+	next := body.Rbrace
+	if end < len(body.List) {
+		next = body.List[end].Pos()
+	}
+	mergeLines(fset, body.List[0].Pos(), next)
+	body.List = body.List[end:]
+	removeCaptures(fset, body)
+
+	if names := resultNames(fnType); len(names) > 0 {
+		body.List = mergeReturns(fset, body.List, names)
+	}
+	removeSyntheticResultNames(fnType)
+
+	return true
+}
+
+// removeCaptures deletes the __ft_ctx.Capture calls injected for
+// //flowtrace:capture comments anywhere in body, and the deferred
+// EnterDeferred and ExitDeferred calls injected around defer statements
+func removeCaptures(fset *token.FileSet, body *ast.BlockStmt) {
+	astutil.Apply(body, func(c *astutil.Cursor) bool {
+		if c.Index() < 0 {
+			return true
+		}
+		var stmt ast.Stmt
+		switch n := c.Node().(type) {
+		case *ast.ExprStmt:
+			if isCaptureCall(n.X) {
+				stmt = n
+			}
+		case *ast.DeferStmt:
+			if isDeferredSpanCall(n.Call) {
+				stmt = n
+			}
+		}
+		if stmt == nil {
+			return true
+		}
+		// Join the call's line to the one before so no blank line is left
+		if file := fset.File(stmt.Pos()); file != nil && file.Line(stmt.Pos()) > 1 {
+			file.MergeLine(file.Line(stmt.Pos()) - 1)
+		}
+		c.Delete()
+		return false
+	}, nil)
+}
+
+// isCaptureCall reports whether expr is a __ft_ctx.Capture(...) call
+func isCaptureCall(expr ast.Expr) bool {
+	return isCallContextCall(expr, "Capture")
+}
+
+// isDeferredSpanCall reports whether call is a __ft_ctx.EnterDeferred(...)
+// or __ft_ctx.ExitDeferred() call
+func isDeferredSpanCall(call *ast.CallExpr) bool {
+	return isCallContextCall(call, "EnterDeferred") || isCallContextCall(call, "ExitDeferred")
+}
+
+// isCallContextCall reports whether expr calls the method of __ft_ctx named
+// method
+func isCallContextCall(expr ast.Expr, method string) bool {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != method {
+		return false
+	}
+	ident, ok := sel.X.(*ast.Ident)
+	return ok && ident.Name == "__ft_ctx"
+}
+
+// mergeLines joins the lines from the line of from through the line of to
+// into one, so that removing the statements between them leaves no blank
+// lines behind when the file is printed
+func mergeLines(fset *token.FileSet, from, to token.Pos) {
+	if !from.IsValid() || !to.IsValid() {
+		return
+	}
+	file := fset.File(from)
+	if file == nil || fset.File(to) != file {
+		return
+	}
+	for n := file.Line(to) - file.Line(from); n > 0; n-- {
+		file.MergeLine(file.Line(from))
+	}
+}
+
+// referencesCallContext reports whether node uses the injected __ft_ctx
+func referencesCallContext(node ast.Node) bool {
+	found := false
+	ast.Inspect(node, func(n ast.Node) bool {
+		if ident, ok := n.(*ast.Ident); ok && ident.Name == "__ft_ctx" {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// resultNames returns the names of a function's results in order, or nil
+// when they are unnamed
+func resultNames(fnType *ast.FuncType) []string {
+	if fnType.Results == nil {
+		return nil
+	}
+
+	var names []string
+	for _, field := range fnType.Results.List {
+		if len(field.Names) == 0 {
+			return nil
+		}
+		for _, name := range field.Names {
+			names = append(names, name.Name)
+		}
+	}
+	return names
+}
+
+// removeSyntheticResultNames undoes ensureNamedReturns: synthetic __ft_retN
+// names are dropped when every result has one, and were blank (_) results
+// otherwise
+func removeSyntheticResultNames(fnType *ast.FuncType) {
+	if fnType.Results == nil {
+		return
+	}
+
+	allSynthetic := true
+	for _, field := range fnType.Results.List {
+		for _, name := range field.Names {
+			if !strings.HasPrefix(name.Name, "__ft_ret") {
+				allSynthetic = false
+			}
+		}
+	}
+
+	for _, field := range fnType.Results.List {
+		if allSynthetic {
+			field.Names = nil
+			continue
+		}
+		for _, name := range field.Names {
+			if strings.HasPrefix(name.Name, "__ft_ret") {
+				name.Name = "_"
+			}
+		}
+	}
+}
+
+// mergeReturns turns each `r0, r1 = x, y` assignment to the named results
+// that is directly followed by a bare return back into `return x, y`,
+// descending into nested blocks but not into function literals, whose
+// returns belong to them.
+func mergeReturns(fset *token.FileSet, stmts []ast.Stmt, names []string) []ast.Stmt {
+	var merged []ast.Stmt
+	for i := 0; i < len(stmts); i++ {
+		stmt := stmts[i]
+
+		if assign, ok := stmt.(*ast.AssignStmt); ok && i+1 < len(stmts) && assignsResults(assign, names) {
+			if ret, ok := stmts[i+1].(*ast.ReturnStmt); ok && len(ret.Results) == 0 {
+				mergeLines(fset, assign.End(), ret.Return)
+				ret.Return = assign.Pos()
+				ret.Results = assign.Rhs
+				merged = append(merged, ret)
+				i++
+				continue
+			}
+		}
+
+		mergeNestedReturns(fset, stmt, names)
+		merged = append(merged, stmt)
+	}
+	return merged
+}
+
+// mergeNestedReturns applies mergeReturns to the blocks nested in stmt
+func mergeNestedReturns(fset *token.FileSet, stmt ast.Stmt, names []string) {
+	switch s := stmt.(type) {
+	case *ast.BlockStmt:
+		s.List = mergeReturns(fset, s.List, names)
+	case *ast.IfStmt:
+		s.Body.List = mergeReturns(fset, s.Body.List, names)
+		if s.Else != nil {
+			mergeNestedReturns(fset, s.Else, names)
+		}
+	case *ast.ForStmt:
+		s.Body.List = mergeReturns(fset, s.Body.List, names)
+	case *ast.RangeStmt:
+		s.Body.List = mergeReturns(fset, s.Body.List, names)
+	case *ast.SwitchStmt:
+		s.Body.List = mergeReturns(fset, s.Body.List, names)
+	case *ast.TypeSwitchStmt:
+		s.Body.List = mergeReturns(fset, s.Body.List, names)
+	case *ast.SelectStmt:
+		s.Body.List = mergeReturns(fset, s.Body.List, names)
+	case *ast.CaseClause:
+		s.Body = mergeReturns(fset, s.Body, names)
+	case *ast.CommClause:
+		s.Body = mergeReturns(fset, s.Body, names)
+	case *ast.LabeledStmt:
+		mergeNestedReturns(fset, s.Stmt, names)
+	}
+}
+
+// assignsResults reports whether assign is a plain assignment to exactly
+// the named results, in order
+func assignsResults(assign *ast.AssignStmt, names []string) bool {
+	if assign.Tok != token.ASSIGN || len(assign.Lhs) != len(names) {
+		return false
+	}
+	for i, lhs := range assign.Lhs {
+		if ident, ok := lhs.(*ast.Ident); !ok || ident.Name != names[i] {
+			return false
+		}
+	}
+	return true
+}
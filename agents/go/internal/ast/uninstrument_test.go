@@ -0,0 +1,265 @@
+package ast
+
+import (
+	"bytes"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+// uninstrumentSource parses source, removes its instrumentation and returns
+// the formatted result
+func uninstrumentSource(t *testing.T, source string) string {
+	t.Helper()
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "test.go", source, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("Failed to parse source: %v", err)
+	}
+
+	UninstrumentFile(fset, file)
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, file); err != nil {
+		t.Fatalf("Failed to print uninstrumented file: %v", err)
+	}
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to format uninstrumented file: %v\n%s", err, buf.String())
+	}
+	return string(formatted)
+}
+
+func TestUninstrumentRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		config *Config
+	}{
+		{
+			name: "plain function",
+			source: `package main
+
+func Hello(name string) {
+	println("hello", name)
+}
+`,
+		},
+		{
+			name: "unnamed results",
+			source: `package main
+
+import "errors"
+
+func Find(xs []int, want int) (int, error) {
+	for i, x := range xs {
+		if x == want {
+			return i, nil
+		}
+	}
+	if len(xs) == 0 {
+		return -1, errors.New("empty")
+	} else if len(xs) > 100 {
+		return -1, errors.New("too long")
+	}
+	return -1, errors.New("not found")
+}
+`,
+		},
+		{
+			name: "named results",
+			source: `package main
+
+func Divide(a, b int) (q int, ok bool) {
+	if b == 0 {
+		return 0, false
+	}
+	return a / b, true
+}
+`,
+		},
+		{
+			name: "method",
+			source: `package main
+
+type Counter struct{ n int }
+
+func (c *Counter) Inc() int {
+	c.n++
+	return c.n
+}
+`,
+		},
+		{
+			name: "closures",
+			source: `package main
+
+func Adder(base int) func(int) int {
+	add := func(x int) int {
+		return base + x
+	}
+	return add
+}
+`,
+			config: &Config{InstrumentClosures: true},
+		},
+		{
+			name: "keeps existing fmt import",
+			source: `package main
+
+import "fmt"
+
+func Greet(name string) string {
+	return fmt.Sprintf("hello %s", name)
+}
+`,
+		},
+		{
+			name: "blank results",
+			source: `package main
+
+import "errors"
+
+func Parse(s string) (_ int, err error) {
+	if s == "" {
+		return 0, errors.New("empty")
+	}
+	return len(s), nil
+}
+`,
+		},
+		{
+			name: "variadic",
+			source: `package main
+
+func Sum(xs ...int) int {
+	total := 0
+	for _, x := range xs {
+		total += x
+	}
+	return total
+}
+`,
+		},
+		{
+			name: "captures",
+			source: `package main
+
+func Sum(xs []int) int {
+	total := 0
+	for _, x := range xs {
+		total += x
+		//flowtrace:capture x total
+	}
+	return total
+}
+`,
+		},
+		{
+			name: "deferred calls",
+			source: `package main
+
+import "sync"
+
+func Locked(mu *sync.Mutex, done func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 0; i < 2; i++ {
+		defer func() {
+			done()
+		}()
+	}
+}
+`,
+			config: &Config{InstrumentDefers: true},
+		},
+		{
+			name: "other module path",
+			source: `package main
+
+func Double(n int) int {
+	return n * 2
+}
+`,
+			config: &Config{FlowtracePkgPath: "github.com/flowtrace/flowtrace-go/flowtrace"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			if config == nil {
+				config = &Config{}
+			}
+
+			instrumented := transformSource(t, tt.source, config)
+			if !strings.Contains(instrumented, "__ft_ctx") {
+				t.Fatalf("Source was not instrumented:\n%s", instrumented)
+			}
+
+			restored := uninstrumentSource(t, instrumented)
+			assertCompiles(t, restored)
+
+			want, err := format.Source([]byte(tt.source))
+			if err != nil {
+				t.Fatalf("Failed to format original: %v", err)
+			}
+			if restored != string(want) {
+				t.Errorf("Round trip changed the source.\nwant:\n%s\ngot:\n%s", want, restored)
+			}
+		})
+	}
+}
+
+func TestUninstrumentLeavesPlainFilesAlone(t *testing.T) {
+	source := `package main
+
+func Hello() {}
+`
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "test.go", source, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("Failed to parse source: %v", err)
+	}
+
+	if UninstrumentFile(fset, file) {
+		t.Error("UninstrumentFile reported a change for a file without instrumentation")
+	}
+}
+
+func TestUninstrumentEarlierEnterForm(t *testing.T) {
+	// Files instrumented before Enter was guarded by flowtrace.Enabled
+	source := `package main
+
+import (
+	"fmt"
+
+	"github.com/rixmerz/flowtrace-agent-go/flowtrace"
+)
+
+func Hello(name string) {
+	__ft_ctx := flowtrace.Enter("main", "Hello", map[string]interface{}{"name": name})
+	defer func() {
+		if r := recover(); r != nil {
+			__ft_ctx.ExceptionString(fmt.Sprintf("panic: %v", r))
+			panic(r)
+		}
+	}()
+	defer __ft_ctx.Exit(nil)
+
+	println("hello", name)
+}
+`
+	want := `package main
+
+func Hello(name string) {
+	println("hello", name)
+}
+`
+	if restored := uninstrumentSource(t, source); restored != want {
+		t.Errorf("Expected the instrumentation to be removed.\nwant:\n%s\ngot:\n%s", want, restored)
+	}
+}
@@ -1,97 +1,222 @@
 package filter
 
 import (
+	"fmt"
 	"path/filepath"
 	"strings"
 )
 
 // Filter handles package and file filtering
 type Filter struct {
-	include []string
-	exclude []string
+	include []filterPattern
+	exclude []filterPattern
 }
 
 // NewFilter creates a new filter with include/exclude patterns
 func NewFilter(include, exclude []string) *Filter {
 	return &Filter{
-		include: include,
-		exclude: exclude,
+		include: compileFilterPatterns(include),
+		exclude: compileFilterPatterns(exclude),
 	}
 }
 
-// ShouldInstrumentPackage checks if a package should be instrumented
-func (f *Filter) ShouldInstrumentPackage(pkgPath string) bool {
-	// Check exclude patterns first
-	for _, pattern := range f.exclude {
-		if f.matchPattern(pattern, pkgPath) {
-			return false
+// patternKind tells how a filter pattern is matched
+type patternKind int
+
+const (
+	matchContains    patternKind = iota // plain text found anywhere in the path
+	matchPrefix                         // package/** matches paths starting with package
+	matchSuffix                         // **/suffix matches paths ending with suffix
+	matchSegmentGlob                    // **/glob matches paths whose trailing segments match glob
+	matchGlob                           // other wildcards, matched with filepath.Match
+)
+
+// filterPattern is an include or exclude pattern whose kind is decided once
+// in NewFilter rather than on every match
+type filterPattern struct {
+	pattern string
+	kind    patternKind
+	value   string // prefix or suffix to match, for those kinds
+	negate  bool   // pattern started with !
+	// specificity is the number of literal characters in the pattern,
+	// deciding between a matching include and exclude
+	specificity int
+}
+
+// compileFilterPattern decides how pattern is matched
+func compileFilterPattern(pattern string) filterPattern {
+	negate := strings.HasPrefix(pattern, "!")
+	pattern = strings.TrimPrefix(pattern, "!")
+	p := filterPattern{
+		pattern:     pattern,
+		negate:      negate,
+		specificity: len(pattern) - strings.Count(pattern, "*") - strings.Count(pattern, "?"),
+	}
+	switch {
+	case strings.HasSuffix(pattern, "/**"):
+		p.kind = matchPrefix
+		p.value = strings.TrimSuffix(pattern, "/**")
+	case strings.HasPrefix(pattern, "**/"):
+		p.kind = matchSuffix
+		p.value = strings.TrimPrefix(pattern, "**/")
+		if hasWildcard(p.value) {
+			p.kind = matchSegmentGlob
 		}
+	case strings.Contains(pattern, "*"):
+		p.kind = matchGlob
+	default:
+		p.kind = matchContains
 	}
+	return p
+}
 
-	// If no include patterns, instrument everything not excluded
-	if len(f.include) == 0 {
+// compileFilterPatterns compiles each of patterns
+func compileFilterPatterns(patterns []string) []filterPattern {
+	compiled := make([]filterPattern, len(patterns))
+	for i, pattern := range patterns {
+		compiled[i] = compileFilterPattern(pattern)
+	}
+	return compiled
+}
+
+// match matches the pattern against a string
+func (p *filterPattern) match(str string) bool {
+	// Handle exact matches
+	if p.pattern == str {
 		return true
 	}
 
-	// Check include patterns
-	for _, pattern := range f.include {
-		if f.matchPattern(pattern, pkgPath) {
-			return true
+	switch p.kind {
+	case matchPrefix:
+		return strings.HasPrefix(str, p.value)
+	case matchSuffix:
+		return strings.HasSuffix(str, p.value)
+	case matchSegmentGlob:
+		// **/ matches any number of leading directories, including none
+		for {
+			if matched, _ := filepath.Match(p.value, str); matched {
+				return true
+			}
+			i := strings.Index(str, "/")
+			if i < 0 {
+				return false
+			}
+			str = str[i+1:]
 		}
+	case matchGlob:
+		matched, _ := filepath.Match(p.pattern, str)
+		return matched
 	}
 
-	return false
+	// Check if str contains pattern
+	return strings.Contains(str, p.pattern)
 }
 
-// ShouldInstrumentFile checks if a file should be instrumented
-func (f *Filter) ShouldInstrumentFile(filename string) bool {
-	// Skip test files
-	if strings.HasSuffix(filename, "_test.go") {
-		return false
+// ShouldInstrumentPackage checks if a package should be instrumented.
+//
+// When a package matches both an include and an exclude pattern, the more
+// specific pattern wins, i.e. the one with more literal (non-wildcard)
+// characters; on a tie the exclude wins. Excluding github.com/acme/** and
+// including github.com/acme/billing/** thus instruments only billing among
+// the acme packages, while an exclude more specific than the include still
+// carves packages out of it. Within each list, a !pattern cancels the
+// earlier patterns matching a path, as in .gitignore.
+func (f *Filter) ShouldInstrumentPackage(pkgPath string) bool {
+	excluded := bestMatch(f.exclude, pkgPath)
+
+	// If no include patterns, instrument everything not excluded
+	if len(f.include) == 0 {
+		return excluded < 0
 	}
 
+	included := bestMatch(f.include, pkgPath)
+	return included >= 0 && included > excluded
+}
+
+// bestMatch returns the specificity of the most specific of patterns that
+// matches str, or -1 if none does. As in .gitignore, a matching !pattern
+// cancels the matches of the patterns before it.
+func bestMatch(patterns []filterPattern, str string) int {
+	best := -1
+	for i := range patterns {
+		p := &patterns[i]
+		if p.negate {
+			if best >= 0 && p.match(str) {
+				best = -1
+			}
+		} else if p.specificity > best && p.match(str) {
+			best = p.specificity
+		}
+	}
+	return best
+}
+
+// ShouldInstrumentFile checks if a file should be instrumented. Test files
+// are only skipped by exclude patterns such as "**/*_test.go"; whether they
+// are instrumented at all is up to the transformer's InstrumentTests.
+func (f *Filter) ShouldInstrumentFile(filename string) bool {
 	// Skip generated files
 	if strings.Contains(filename, ".pb.go") || strings.Contains(filename, ".gen.go") {
 		return false
 	}
 
 	// Check exclude patterns
-	for _, pattern := range f.exclude {
-		if f.matchPattern(pattern, filename) {
-			return false
-		}
-	}
-
-	return true
+	return bestMatch(f.exclude, filename) < 0
 }
 
 // matchPattern matches a glob pattern against a string
 func (f *Filter) matchPattern(pattern, str string) bool {
-	// Handle exact matches
-	if pattern == str {
-		return true
-	}
+	return MatchPattern(pattern, str)
+}
 
-	// Handle prefix matches (package/**)
-	if strings.HasSuffix(pattern, "/**") {
-		prefix := strings.TrimSuffix(pattern, "/**")
-		return strings.HasPrefix(str, prefix)
-	}
+// MatchPattern reports whether str matches an include or exclude pattern.
+// The ! of a negated pattern is ignored.
+func MatchPattern(pattern, str string) bool {
+	p := compileFilterPattern(pattern)
+	return p.match(str)
+}
 
-	// Handle suffix matches (**/suffix)
-	if strings.HasPrefix(pattern, "**/") {
-		suffix := strings.TrimPrefix(pattern, "**/")
-		return strings.HasSuffix(str, suffix)
+// MatchFunction reports whether the function name, e.g.
+// shop.UserService.LoadUser, matches pattern. Wildcards match as in package
+// patterns, but a pattern without any must be the whole name rather than a
+// part of it, so LoadUser doesn't match PreloadUser.
+func MatchFunction(pattern, name string) bool {
+	p := compileFilterPattern(pattern)
+	if p.kind == matchContains {
+		return p.pattern == name
 	}
+	return p.match(name)
+}
 
-	// Handle wildcard matches
-	if strings.Contains(pattern, "*") {
-		matched, _ := filepath.Match(pattern, str)
-		return matched
+// ValidatePattern checks that an include or exclude pattern compiles and
+// that its wildcards form a valid glob. A malformed glob such as "api/[v1*"
+// would otherwise silently match nothing.
+func ValidatePattern(pattern string) error {
+	if _, err := compilePattern(pattern); err != nil {
+		return err
 	}
 
-	// Check if str contains pattern
-	return strings.Contains(str, pattern)
+	p := compileFilterPattern(pattern)
+	var glob string
+	switch p.kind {
+	case matchSegmentGlob:
+		glob = p.value
+	case matchGlob:
+		glob = p.pattern
+	default:
+		if p.pattern == "" {
+			return fmt.Errorf("empty pattern")
+		}
+		return nil
+	}
+	// filepath.Match stops checking the syntax at the first mismatch, so the
+	// glob is matched against both an empty string and itself
+	for _, name := range []string{"", glob} {
+		if _, err := filepath.Match(glob, name); err != nil {
+			return fmt.Errorf("malformed glob %q: %w", pattern, err)
+		}
+	}
+	return nil
 }
 
 // DefaultExcludePatterns returns common packages to exclude
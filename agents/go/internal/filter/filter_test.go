@@ -1,6 +1,7 @@
 package filter
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -89,6 +90,54 @@ func TestFilterShouldInstrumentPackage(t *testing.T) {
 	}
 }
 
+func TestFilterIncludeOverridesBroaderExclude(t *testing.T) {
+	f := NewFilter(
+		[]string{"github.com/acme/billing/**"},
+		[]string{"github.com/acme/**", "github.com/acme/billing/legacy/**"},
+	)
+
+	testCases := []struct {
+		path     string
+		expected bool
+	}{
+		{"github.com/acme/billing", true},
+		{"github.com/acme/billing/invoices", true},
+		{"github.com/acme/shipping", false},
+		{"github.com/acme/auth/tokens", false},
+		// A more specific exclude still wins over the include
+		{"github.com/acme/billing/legacy/v1", false},
+		// Neither excluded nor included
+		{"github.com/other/lib", false},
+	}
+
+	for _, tc := range testCases {
+		if result := f.ShouldInstrumentPackage(tc.path); result != tc.expected {
+			t.Errorf("ShouldInstrumentPackage(%q) = %v, want %v", tc.path, result, tc.expected)
+		}
+	}
+}
+
+func TestFilterEqualSpecificityExcludeWins(t *testing.T) {
+	f := NewFilter([]string{"github.com/acme/**"}, []string{"github.com/acme/**"})
+	if f.ShouldInstrumentPackage("github.com/acme/billing") {
+		t.Error("Expected an exclude as specific as the include to win")
+	}
+}
+
+func TestFilterNegatedPatterns(t *testing.T) {
+	f := NewFilter(nil, []string{"github.com/acme/**", "!github.com/acme/billing/**"})
+
+	if !f.ShouldInstrumentPackage("github.com/acme/billing/invoices") {
+		t.Error("Expected the negated exclude to re-admit billing")
+	}
+	if f.ShouldInstrumentPackage("github.com/acme/shipping") {
+		t.Error("Expected other acme packages to stay excluded")
+	}
+	if !f.ShouldInstrumentFile("github.com/acme/billing/invoice.go") {
+		t.Error("Expected files of billing to be instrumented")
+	}
+}
+
 func TestFilterShouldInstrumentFile(t *testing.T) {
 	tests := []struct {
 		name         string
@@ -102,6 +151,18 @@ func TestFilterShouldInstrumentFile(t *testing.T) {
 			filePath:     "api_test.go",
 			expected:     false,
 		},
+		{
+			name:         "exclude nested test files",
+			excludeFiles: []string{"**/*_test.go"},
+			filePath:     "/src/app/api/user_test.go",
+			expected:     false,
+		},
+		{
+			name:         "test files without exclusions",
+			excludeFiles: []string{},
+			filePath:     "api_test.go",
+			expected:     true,
+		},
 		{
 			name:         "include regular files",
 			excludeFiles: []string{"**/*_test.go"},
@@ -130,7 +191,7 @@ func TestFilterShouldInstrumentFile(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			f := &Filter{exclude: tt.excludeFiles}
+			f := NewFilter(nil, tt.excludeFiles)
 			result := f.ShouldInstrumentFile(tt.filePath)
 			if result != tt.expected {
 				t.Errorf("ShouldInstrumentFile(%q) = %v, want %v",
@@ -237,3 +298,89 @@ func TestFilterCaseSensitivity(t *testing.T) {
 	result := f.ShouldInstrumentPackage("github.com/user/project/api")
 	t.Logf("Case-insensitive match result: %v", result)
 }
+
+func TestValidatePattern(t *testing.T) {
+	valid := []string{"github.com/acme/**", "**/*_test.go", "!**/vendor/**", "cmd/*", "api/[v]1/**", "legacy"}
+	for _, pattern := range valid {
+		if err := ValidatePattern(pattern); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", pattern, err)
+		}
+	}
+
+	invalid := []string{"", "!", "api/[v1*", "**/handler[*.go", "cmd/*["}
+	for _, pattern := range invalid {
+		if err := ValidatePattern(pattern); err == nil {
+			t.Errorf("Expected %q to be rejected", pattern)
+		}
+	}
+}
+
+func TestMatchFunction(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"UserService.LoadUser", "UserService.LoadUser", true},
+		{"LoadUser", "UserService.LoadUser", false},
+		{"LoadUser", "PreloadUser", false},
+		{"UserService.*", "UserService.LoadUser", true},
+		{"*.LoadUser", "UserService.LoadUser", true},
+		{"shop.*", "shop.UserService.LoadUser", true},
+		{"shop.*", "shopping.LoadUser", false},
+		{"**/shop.UserService.*", "example.com/app/shop.UserService.LoadUser", true},
+	}
+	for _, tt := range tests {
+		if got := MatchFunction(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("MatchFunction(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+// benchmarkPaths returns n package paths spread over user, vendored and
+// standard library packages
+func benchmarkPaths(n int) []string {
+	paths := make([]string, n)
+	for i := range paths {
+		switch i % 4 {
+		case 0:
+			paths[i] = fmt.Sprintf("github.com/user/project/module%d/handlers", i)
+		case 1:
+			paths[i] = fmt.Sprintf("github.com/user/project/vendor/lib%d", i)
+		case 2:
+			paths[i] = fmt.Sprintf("net/http/sub%d", i)
+		default:
+			paths[i] = fmt.Sprintf("github.com/other/dep%d/file_test.go", i)
+		}
+	}
+	return paths
+}
+
+func BenchmarkFilterShouldInstrumentPackage(b *testing.B) {
+	f := NewFilter([]string{"github.com/user/**", "*/other/*"}, DefaultExcludePatterns())
+	paths := benchmarkPaths(10000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, path := range paths {
+			f.ShouldInstrumentPackage(path)
+		}
+	}
+}
+
+func BenchmarkFilterShouldInstrumentFile(b *testing.B) {
+	f := NewFilter(nil, DefaultExcludePatterns())
+	paths := benchmarkPaths(10000)
+	for i := range paths {
+		paths[i] += ".go"
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, path := range paths {
+			f.ShouldInstrumentFile(path)
+		}
+	}
+}
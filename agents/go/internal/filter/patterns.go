@@ -5,7 +5,11 @@ import (
 	"strings"
 )
 
-// PatternMatcher provides advanced pattern matching
+// PatternMatcher provides advanced pattern matching. A pattern starting with
+// ! negates the patterns before it, as in .gitignore: patterns are evaluated
+// in order and the last one matching a string decides, so
+// ["**/*_test.go", "!**/integration_test.go"] matches every test file except
+// integration_test.go.
 type PatternMatcher struct {
 	patterns []*Pattern
 }
@@ -18,6 +22,7 @@ type Pattern struct {
 	prefix   string
 	suffix   string
 	isGlob   bool
+	negate   bool // pattern started with !
 }
 
 // NewPatternMatcher creates a new pattern matcher
@@ -37,24 +42,22 @@ func NewPatternMatcher(patterns []string) (*PatternMatcher, error) {
 	return pm, nil
 }
 
-// Match checks if a string matches any pattern
+// Match checks if a string matches any pattern, the last matching pattern
+// deciding when some are negated
 func (pm *PatternMatcher) Match(s string) bool {
-	for _, p := range pm.patterns {
-		if p.Match(s) {
-			return true
-		}
-	}
-	return false
+	return MatchAny(s, pm.patterns)
 }
 
-// MatchAll checks if a string matches all patterns
+// MatchAll checks if a string matches all patterns; a negated pattern must
+// not match
 func (pm *PatternMatcher) MatchAll(s string) bool {
-	for _, p := range pm.patterns {
-		if !p.Match(s) {
-			return false
-		}
-	}
-	return true
+	return MatchAll(s, pm.patterns)
+}
+
+// Negated reports whether the pattern started with !. Match still reports
+// whether the rest of the pattern matches.
+func (p *Pattern) Negated() bool {
+	return p.negate
 }
 
 // Match checks if a string matches this pattern
@@ -89,9 +92,12 @@ func (p *Pattern) Match(s string) bool {
 
 // compilePattern compiles a pattern string into a Pattern
 func compilePattern(pattern string) (*Pattern, error) {
-	p := &Pattern{
-		original: pattern,
+	p := &Pattern{}
+	if strings.HasPrefix(pattern, "!") {
+		p.negate = true
+		pattern = pattern[1:]
 	}
+	p.original = pattern
 
 	// Check for exact match
 	if !strings.Contains(pattern, "*") && !strings.Contains(pattern, "?") {
@@ -99,15 +105,16 @@ func compilePattern(pattern string) (*Pattern, error) {
 		return p, nil
 	}
 
-	// Check for prefix match (**/ at end)
-	if strings.HasSuffix(pattern, "/**") {
-		p.prefix = strings.TrimSuffix(pattern, "/**")
+	// Check for prefix match (**/ at end); a prefix with wildcards of its
+	// own, as in **/vendor/**, needs the regex
+	if prefix := strings.TrimSuffix(pattern, "/**"); prefix != pattern && !hasWildcard(prefix) {
+		p.prefix = prefix
 		return p, nil
 	}
 
-	// Check for suffix match (**/ at start)
-	if strings.HasPrefix(pattern, "**/") {
-		p.suffix = strings.TrimPrefix(pattern, "**/")
+	// Check for suffix match (**/ at start), likewise without wildcards
+	if suffix := strings.TrimPrefix(pattern, "**/"); suffix != pattern && !hasWildcard(suffix) {
+		p.suffix = suffix
 		return p, nil
 	}
 
@@ -128,6 +135,11 @@ func compilePattern(pattern string) (*Pattern, error) {
 	return p, nil
 }
 
+// hasWildcard reports whether a glob pattern contains * or ?
+func hasWildcard(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?")
+}
+
 // globToRegex converts a glob pattern to a regex pattern
 func globToRegex(pattern string) string {
 	var result strings.Builder
@@ -224,20 +236,25 @@ func CompilePatterns(patterns []string) ([]*Pattern, error) {
 	return result, nil
 }
 
-// MatchAny checks if string matches any of the patterns
+// MatchAny checks if string matches any of the patterns. Patterns are
+// evaluated in order and a matching negated pattern overrides the matches
+// before it.
 func MatchAny(s string, patterns []*Pattern) bool {
+	matched := false
 	for _, p := range patterns {
-		if p.Match(s) {
-			return true
+		// Only a pattern that could change the outcome needs to be tried
+		if matched == p.negate && p.Match(s) {
+			matched = !p.negate
 		}
 	}
-	return false
+	return matched
 }
 
-// MatchAll checks if string matches all patterns
+// MatchAll checks if string matches all patterns; a negated pattern must
+// not match
 func MatchAll(s string, patterns []*Pattern) bool {
 	for _, p := range patterns {
-		if !p.Match(s) {
+		if p.Match(s) == p.negate {
 			return false
 		}
 	}
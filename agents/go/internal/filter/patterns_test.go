@@ -315,3 +315,80 @@ func TestMultipleStarPatterns(t *testing.T) {
 		})
 	}
 }
+
+func TestPatternMatcherNegation(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		matches  bool
+	}{
+		{
+			name:     "negation re-admits a match",
+			patterns: []string{"**/*_test.go", "!**/integration_test.go"},
+			path:     "api/integration_test.go",
+			matches:  false,
+		},
+		{
+			name:     "negation leaves other matches",
+			patterns: []string{"**/*_test.go", "!**/integration_test.go"},
+			path:     "api/user_test.go",
+			matches:  true,
+		},
+		{
+			name:     "later pattern overrides negation",
+			patterns: []string{"**/*_test.go", "!**/integration_test.go", "legacy/**"},
+			path:     "legacy/integration_test.go",
+			matches:  true,
+		},
+		{
+			name:     "negation before the pattern has no effect",
+			patterns: []string{"!**/integration_test.go", "**/*_test.go"},
+			path:     "api/integration_test.go",
+			matches:  true,
+		},
+		{
+			name:     "negation with double star prefix",
+			patterns: []string{"github.com/acme/**", "!github.com/acme/billing/**"},
+			path:     "github.com/acme/billing/invoices",
+			matches:  false,
+		},
+		{
+			name:     "double star in the middle of a negation",
+			patterns: []string{"**/vendor/**", "!**/vendor/**/keep.go"},
+			path:     "project/vendor/pkg/keep.go",
+			matches:  false,
+		},
+		{
+			name:     "lone negation matches nothing",
+			patterns: []string{"!**/*.go"},
+			path:     "main.go",
+			matches:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm, err := NewPatternMatcher(tt.patterns)
+			if err != nil {
+				t.Fatalf("NewPatternMatcher failed: %v", err)
+			}
+			if got := pm.Match(tt.path); got != tt.matches {
+				t.Errorf("Patterns %q against %q: got %v, want %v", tt.patterns, tt.path, got, tt.matches)
+			}
+		})
+	}
+}
+
+func TestPatternMatcherMatchAllNegation(t *testing.T) {
+	pm, err := NewPatternMatcher([]string{"**/*.go", "!**/*_test.go"})
+	if err != nil {
+		t.Fatalf("NewPatternMatcher failed: %v", err)
+	}
+	if !pm.MatchAll("pkg/file.go") {
+		t.Error("Expected pkg/file.go to match *.go and not *_test.go")
+	}
+	if pm.MatchAll("pkg/file_test.go") {
+		t.Error("Expected pkg/file_test.go to fail the negated pattern")
+	}
+}
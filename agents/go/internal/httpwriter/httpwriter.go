@@ -0,0 +1,128 @@
+// Package httpwriter provides the http.ResponseWriter wrapper the HTTP
+// middlewares record responses with
+package httpwriter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// ResponseWriter wraps an http.ResponseWriter to record the status code and
+// the number of body bytes of the response. Flush, Hijack, Push and ReadFrom
+// are forwarded when the wrapped writer supports them, so streaming
+// responses, connection upgrades and sendfile keep working behind the
+// middleware.
+type ResponseWriter struct {
+	http.ResponseWriter
+
+	// OnWrite, when set, is called with every chunk of the body written
+	OnWrite func([]byte)
+
+	status      int
+	written     int64
+	wroteHeader bool
+}
+
+// New wraps w. The status is http.StatusOK until the handler sets another.
+func New(w http.ResponseWriter) *ResponseWriter {
+	return &ResponseWriter{ResponseWriter: w, status: http.StatusOK}
+}
+
+// Status returns the status code of the response
+func (rw *ResponseWriter) Status() int {
+	return rw.status
+}
+
+// Written returns the number of body bytes written
+func (rw *ResponseWriter) Written() int64 {
+	return rw.written
+}
+
+// WroteHeader reports whether the response was started: its header was
+// sent, or the connection was hijacked. A response can't be changed then.
+func (rw *ResponseWriter) WroteHeader() bool {
+	return rw.wroteHeader
+}
+
+// Respond500 answers a request whose handler panicked with 500 Internal
+// Server Error, unless the handler started the response
+func (rw *ResponseWriter) Respond500() {
+	if !rw.wroteHeader {
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+func (rw *ResponseWriter) WriteHeader(code int) {
+	rw.status = code
+	rw.wroteHeader = true
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *ResponseWriter) Write(data []byte) (int, error) {
+	rw.wroteHeader = true
+	n, err := rw.ResponseWriter.Write(data)
+	rw.written += int64(n)
+	if rw.OnWrite != nil {
+		rw.OnWrite(data[:n])
+	}
+	return n, err
+}
+
+// ReadFrom copies r to the response, through the wrapped writer's ReadFrom
+// when it has one, which lets net/http send files with sendfile. With
+// OnWrite set the body goes through Write instead, to be seen.
+func (rw *ResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	rf, ok := rw.ResponseWriter.(io.ReaderFrom)
+	if !ok || rw.OnWrite != nil {
+		// writerOnly hides ReadFrom, which io.Copy would call back
+		return io.Copy(writerOnly{rw}, r)
+	}
+	rw.wroteHeader = true
+	n, err := rf.ReadFrom(r)
+	rw.written += n
+	return n, err
+}
+
+// writerOnly exposes only the Write method of a writer
+type writerOnly struct {
+	io.Writer
+}
+
+// Flush sends buffered data to the client if the wrapped writer supports it
+func (rw *ResponseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		rw.wroteHeader = true
+		f.Flush()
+	}
+}
+
+// Hijack lets the handler take over the connection, e.g. for WebSockets
+func (rw *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not implement http.Hijacker")
+	}
+	conn, buf, err := h.Hijack()
+	if err == nil {
+		// The connection is the handler's now, so no response can be sent
+		rw.wroteHeader = true
+	}
+	return conn, buf, err
+}
+
+// Push initiates an HTTP/2 server push if the wrapped writer supports it
+func (rw *ResponseWriter) Push(target string, opts *http.PushOptions) error {
+	p, ok := rw.ResponseWriter.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return p.Push(target, opts)
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController
+func (rw *ResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -0,0 +1,129 @@
+package httpwriter
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fullWriter is a writer with all the optional interfaces, recording which
+// were called
+type fullWriter struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+	pushed   string
+}
+
+func (w *fullWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.readFrom = true
+	return io.Copy(w.ResponseRecorder, r)
+}
+
+func (w *fullWriter) Push(target string, opts *http.PushOptions) error {
+	w.pushed = target
+	return nil
+}
+
+func TestResponseWriterForwardsInterfaces(t *testing.T) {
+	underlying := &fullWriter{ResponseRecorder: httptest.NewRecorder()}
+	rw := New(underlying)
+
+	var w http.ResponseWriter = rw
+	if _, ok := w.(http.Flusher); !ok {
+		t.Fatal("Expected the wrapper to implement http.Flusher")
+	}
+	if _, ok := w.(http.Hijacker); !ok {
+		t.Fatal("Expected the wrapper to implement http.Hijacker")
+	}
+
+	w.(http.Flusher).Flush()
+	if !underlying.Flushed || !rw.WroteHeader() {
+		t.Error("Expected Flush to reach the underlying writer and start the response")
+	}
+	if err := w.(http.Pusher).Push("/app.js", nil); err != nil || underlying.pushed != "/app.js" {
+		t.Errorf("Expected Push to reach the underlying writer, got %v", err)
+	}
+	if n, err := w.(io.ReaderFrom).ReadFrom(strings.NewReader("hello")); n != 5 || err != nil || !underlying.readFrom {
+		t.Errorf("Expected ReadFrom to reach the underlying writer, got %d, %v", n, err)
+	}
+	if http.NewResponseController(w).Flush() != nil {
+		t.Error("Expected http.ResponseController to find the underlying writer")
+	}
+}
+
+func TestResponseWriterCountsBytes(t *testing.T) {
+	underlying := &fullWriter{ResponseRecorder: httptest.NewRecorder()}
+	rw := New(underlying)
+
+	if rw.Status() != http.StatusOK || rw.WroteHeader() {
+		t.Errorf("Expected a pending 200 response, got %d (started: %v)", rw.Status(), rw.WroteHeader())
+	}
+	rw.WriteHeader(http.StatusCreated)
+	rw.Write([]byte("hello"))
+	rw.ReadFrom(strings.NewReader(" world"))
+
+	if rw.Status() != http.StatusCreated || rw.Written() != 11 {
+		t.Errorf("Expected status 201 and 11 bytes, got %d and %d", rw.Status(), rw.Written())
+	}
+	if underlying.Body.String() != "hello world" {
+		t.Errorf("Expected the body to reach the underlying writer, got %q", underlying.Body.String())
+	}
+}
+
+func TestResponseWriterOnWrite(t *testing.T) {
+	underlying := &fullWriter{ResponseRecorder: httptest.NewRecorder()}
+	rw := New(underlying)
+	var seen strings.Builder
+	rw.OnWrite = func(data []byte) { seen.Write(data) }
+
+	rw.Write([]byte("hello"))
+	rw.ReadFrom(strings.NewReader(" world"))
+
+	if seen.String() != "hello world" || rw.Written() != 11 {
+		t.Errorf("Expected OnWrite to see the whole body, got %q (%d bytes)", seen.String(), rw.Written())
+	}
+	if underlying.readFrom {
+		t.Error("Expected ReadFrom to go through Write when OnWrite is set")
+	}
+}
+
+func TestResponseWriterUnsupportedInterfaces(t *testing.T) {
+	// A writer with none of the optional interfaces
+	underlying := httptest.NewRecorder()
+	rw := New(struct{ http.ResponseWriter }{underlying})
+
+	rw.Flush()
+	if rw.WroteHeader() {
+		t.Error("Expected a Flush the writer can't do not to start the response")
+	}
+	if _, _, err := rw.Hijack(); err == nil {
+		t.Error("Expected Hijack to fail when the underlying writer cannot hijack")
+	}
+	if err := rw.Push("/app.js", nil); !errors.Is(err, http.ErrNotSupported) {
+		t.Errorf("Expected http.ErrNotSupported, got %v", err)
+	}
+	if n, err := rw.ReadFrom(strings.NewReader("hello")); n != 5 || err != nil || rw.Written() != 5 || underlying.Body.String() != "hello" {
+		t.Errorf("Expected ReadFrom to fall back to Write, got %d, %v", n, err)
+	}
+}
+
+func TestResponseWriterRespond500(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	rw := New(recorder)
+	rw.Respond500()
+	if recorder.Code != http.StatusInternalServerError || rw.Status() != http.StatusInternalServerError {
+		t.Errorf("Expected 500, got %d", recorder.Code)
+	}
+
+	// A started response is left as it is
+	recorder = httptest.NewRecorder()
+	rw = New(recorder)
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Respond500()
+	if recorder.Code != http.StatusAccepted || rw.Status() != http.StatusAccepted {
+		t.Errorf("Expected the started response to keep status 202, got %d", recorder.Code)
+	}
+}
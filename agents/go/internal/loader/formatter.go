@@ -3,10 +3,12 @@ package loader
 import (
 	"bytes"
 	"go/ast"
+	"go/build/constraint"
 	"go/format"
 	"go/printer"
 	"go/token"
 	"io"
+	"strings"
 
 	"golang.org/x/tools/imports"
 )
@@ -38,10 +40,61 @@ func formatAST(fset *token.FileSet, file *ast.File, w io.Writer) error {
 	}
 
 	// Write formatted code
+	formatted = restoreBuildConstraints(formatted, buildConstraints(file))
 	_, err = w.Write(formatted)
 	return err
 }
 
+// buildConstraints returns the //go:build and // +build lines above the
+// package clause of file
+func buildConstraints(file *ast.File) []string {
+	var lines []string
+	for _, group := range file.Comments {
+		if group.Pos() >= file.Package {
+			break
+		}
+		for _, c := range group.List {
+			if constraint.IsGoBuild(c.Text) || constraint.IsPlusBuild(c.Text) {
+				lines = append(lines, c.Text)
+			}
+		}
+	}
+	return lines
+}
+
+// restoreBuildConstraints puts back any of the constraint lines that are no
+// longer above the package clause of src. A constraint comment is not
+// attached to a declaration, so rewriting the AST can drop or move it, and a
+// file without its constraint is built on every platform.
+func restoreBuildConstraints(src []byte, lines []string) []byte {
+	if len(lines) == 0 {
+		return src
+	}
+
+	header := make(map[string]bool)
+	for _, line := range strings.Split(string(src), "\n") {
+		if strings.HasPrefix(line, "package ") {
+			break
+		}
+		header[strings.TrimSpace(line)] = true
+	}
+
+	var missing []string
+	for _, line := range lines {
+		if !header[line] {
+			missing = append(missing, line)
+		}
+	}
+	if len(missing) == 0 {
+		return src
+	}
+
+	// Constraints must precede the package clause and be followed by a
+	// blank line
+	restored := strings.Join(missing, "\n") + "\n\n"
+	return append([]byte(restored), src...)
+}
+
 // FormatNode formats an AST node and returns formatted source
 func FormatNode(fset *token.FileSet, node ast.Node) ([]byte, error) {
 	var buf bytes.Buffer
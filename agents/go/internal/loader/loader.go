@@ -8,7 +8,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
+	ftast "github.com/rixmerz/flowtrace-agent-go/internal/ast"
 	"golang.org/x/tools/go/packages"
 )
 
@@ -22,7 +24,7 @@ type Loader struct {
 type LoadConfig struct {
 	// Directory to load packages from
 	Dir string
-	// Include test files
+	// Include test files, as decided by ast.IsTestFile
 	Tests bool
 	// Build tags
 	Tags []string
@@ -34,6 +36,13 @@ type LoadConfig struct {
 type PackageInfo struct {
 	Package *packages.Package
 	Files   []*FileInfo
+	Skipped []SkippedFile
+}
+
+// SkippedFile is a file of a package left out of Files, and why
+type SkippedFile struct {
+	Path   string
+	Reason string
 }
 
 // FileInfo holds file information
@@ -79,6 +88,14 @@ func (l *Loader) LoadPackage(pkgPattern string) (*PackageInfo, error) {
 		Tests: l.config.Tests,
 	}
 
+	if l.config.Tests || ftast.HasCgoFiles(pkgPattern, l.config.Dir, l.config.Tags) {
+		// Type-checking the test variants needs the types of the packages
+		// only tests import, such as testing, and type-checking the code cgo
+		// generates those it imports, such as syscall. go/packages otherwise
+		// leaves them unloaded.
+		cfg.Mode |= packages.NeedDeps
+	}
+
 	if len(l.config.Tags) > 0 {
 		cfg.BuildFlags = []string{"-tags", joinTags(l.config.Tags)}
 	}
@@ -93,10 +110,9 @@ func (l *Loader) LoadPackage(pkgPattern string) (*PackageInfo, error) {
 	}
 
 	pkg := pkgs[0]
-
-	// Check for errors
-	if len(pkg.Errors) > 0 {
-		return nil, fmt.Errorf("package has errors: %v", pkg.Errors)
+	syntax := []*packages.Package{pkg}
+	if l.config.Tests {
+		pkg, syntax = testVariants(pkgs)
 	}
 
 	// Create package info
@@ -105,23 +121,101 @@ func (l *Loader) LoadPackage(pkgPattern string) (*PackageInfo, error) {
 		Files:   make([]*FileInfo, 0, len(pkg.Syntax)),
 	}
 
-	// Process files
-	for i, file := range pkg.Syntax {
-		filePath := pkg.CompiledGoFiles[i]
+	// Process files. A file that doesn't type-check is skipped rather than
+	// failing the package; errors not tied to a file still do.
+	for _, p := range syntax {
+		errs := fileErrors(p)
+		if len(errs[""]) > 0 {
+			return nil, fmt.Errorf("package has errors: %v", errs[""])
+		}
 
-		fileInfo := &FileInfo{
-			Path:        filePath,
-			AST:         file,
-			IsTest:      isTestFile(filePath),
-			IsGenerated: isGeneratedFile(file),
+		sources := make(map[string]bool, len(p.GoFiles))
+		for _, path := range p.GoFiles {
+			sources[path] = true
 		}
+		compiled := make(map[string]bool, len(p.CompiledGoFiles))
+		for i, file := range p.Syntax {
+			filePath := p.CompiledGoFiles[i]
+			compiled[filePath] = true
+
+			// Code cgo generated for the files importing "C"
+			if !sources[filePath] {
+				continue
+			}
+			if fileErrs := errs[filePath]; len(fileErrs) > 0 {
+				info.Skipped = append(info.Skipped, SkippedFile{Path: filePath, Reason: fileErrs[0].Msg})
+				continue
+			}
 
-		info.Files = append(info.Files, fileInfo)
+			fileInfo := &FileInfo{
+				Path:        filePath,
+				AST:         file,
+				IsTest:      isTestFile(filePath),
+				IsGenerated: isGeneratedFile(file),
+			}
+
+			info.Files = append(info.Files, fileInfo)
+		}
+
+		// Files importing "C" are compiled from what cgo generates for
+		// them; instrumenting them could break their C preamble
+		for _, path := range p.GoFiles {
+			if !compiled[path] {
+				info.Skipped = append(info.Skipped, SkippedFile{Path: path, Reason: `imports "C"`})
+			}
+		}
 	}
 
 	return info, nil
 }
 
+// fileErrors groups the errors of p by the file they point into, which
+// for code cgo generated is the file importing "C". Errors not tied to one
+// of its files are under "".
+func fileErrors(p *packages.Package) map[string][]packages.Error {
+	errs := make(map[string][]packages.Error)
+	for _, e := range p.Errors {
+		file := ""
+		for _, path := range append(p.CompiledGoFiles, p.GoFiles...) {
+			if strings.HasPrefix(e.Pos, path+":") {
+				file = path
+				break
+			}
+		}
+		errs[file] = append(errs[file], e)
+	}
+	return errs
+}
+
+// testVariants picks the packages holding the files of a package loaded
+// with Tests: the package recompiled with its in-package test files, e.g.
+// "p [p.test]", and the external test package "p_test [p.test]" if any.
+// The generated test main is skipped. Without test files the plain package
+// is returned alone.
+func testVariants(pkgs []*packages.Package) (*packages.Package, []*packages.Package) {
+	pkg := pkgs[0]
+	testID := pkg.ID + " [" + pkg.PkgPath + ".test]"
+
+	var variant, external *packages.Package
+	for _, p := range pkgs {
+		switch {
+		case p.ID == testID:
+			variant = p
+		case p.PkgPath == pkg.PkgPath+"_test":
+			external = p
+		}
+	}
+
+	if variant != nil {
+		pkg = variant
+	}
+	syntax := []*packages.Package{pkg}
+	if external != nil {
+		syntax = append(syntax, external)
+	}
+	return pkg, syntax
+}
+
 // LoadPackages loads multiple packages
 func (l *Loader) LoadPackages(patterns ...string) ([]*PackageInfo, error) {
 	result := make([]*PackageInfo, 0, len(patterns))
@@ -235,6 +329,12 @@ func (l *Loader) LoadRecursive(root string) ([]*FileInfo, error) {
 
 // WriteFile writes an AST file to disk
 func (l *Loader) WriteFile(file *ast.File, outputPath string) error {
+	return WriteAST(l.fset, file, outputPath)
+}
+
+// WriteAST formats file, whose positions belong to fset, and writes it to
+// outputPath, creating parent directories as needed
+func WriteAST(fset *token.FileSet, file *ast.File, outputPath string) error {
 	// Create output directory if needed
 	dir := filepath.Dir(outputPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
@@ -249,7 +349,7 @@ func (l *Loader) WriteFile(file *ast.File, outputPath string) error {
 	defer f.Close()
 
 	// Format and write
-	if err := formatAST(l.fset, file, f); err != nil {
+	if err := formatAST(fset, file, f); err != nil {
 		return fmt.Errorf("failed to format file: %w", err)
 	}
 
@@ -258,7 +358,7 @@ func (l *Loader) WriteFile(file *ast.File, outputPath string) error {
 
 // isTestFile checks if a filename is a test file
 func isTestFile(filename string) bool {
-	return len(filename) > 8 && filename[len(filename)-8:] == "_test.go"
+	return ftast.IsTestFile(filename)
 }
 
 // isGeneratedFile checks if a file is generated
@@ -0,0 +1,172 @@
+package loader
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ftast "github.com/rixmerz/flowtrace-agent-go/internal/ast"
+)
+
+const commentedSource = `// Package demo is used to check comment preservation.
+package demo
+
+import "errors"
+
+// Foo does X.
+func Foo(a int) (int, error) {
+	// reject negative input
+	if a < 0 {
+		return 0, errors.New("negative") // inline error
+	}
+	return a * 2, nil
+}
+
+// Bar does Y.
+func Bar() {
+	/* nothing to see */
+	println("bar")
+}
+`
+
+// instrumentAndWrite loads source from disk, instruments it and writes it back
+// through the loader, returning the written source
+func instrumentAndWrite(t *testing.T, source string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "demo.go")
+	if err := os.WriteFile(input, []byte(source), 0644); err != nil {
+		t.Fatalf("Failed to write input: %v", err)
+	}
+
+	l := NewLoader(nil)
+	info, err := l.LoadFile(input)
+	if err != nil {
+		t.Fatalf("LoadFile failed: %v", err)
+	}
+	if err := ftast.NewTransformer(l.FileSet(), nil).TransformFile(info.AST); err != nil {
+		t.Fatalf("TransformFile failed: %v", err)
+	}
+
+	output := filepath.Join(dir, "out", "demo.go")
+	if err := l.WriteFile(info.AST, output); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	return string(data)
+}
+
+func TestWriteFilePreservesDocComments(t *testing.T) {
+	output := instrumentAndWrite(t, commentedSource)
+
+	file, err := parser.ParseFile(token.NewFileSet(), "demo.go", output, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("Output does not parse: %v\n%s", err, output)
+	}
+
+	docs := map[string]string{
+		"Foo": "Foo does X.\n",
+		"Bar": "Bar does Y.\n",
+	}
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		want, ok := docs[fn.Name.Name]
+		if !ok {
+			continue
+		}
+		delete(docs, fn.Name.Name)
+		if got := fn.Doc.Text(); got != want {
+			t.Errorf("Expected doc comment %q on %s, got %q\n%s", want, fn.Name.Name, got, output)
+		}
+	}
+	for name := range docs {
+		t.Errorf("Expected function %s in output\n%s", name, output)
+	}
+
+	if file.Doc.Text() != "Package demo is used to check comment preservation.\n" {
+		t.Errorf("Expected package doc comment to be preserved, got %q", file.Doc.Text())
+	}
+}
+
+func TestWriteFilePreservesInlineComments(t *testing.T) {
+	output := instrumentAndWrite(t, commentedSource)
+
+	tests := []struct {
+		comment string
+		before  string
+	}{
+		{"// reject negative input", "if a < 0 {"},
+		{"/* nothing to see */", `println("bar")`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.comment, func(t *testing.T) {
+			idx := strings.Index(output, tt.comment)
+			if idx < 0 {
+				t.Fatalf("Expected comment %q in output\n%s", tt.comment, output)
+			}
+			// The comment must still sit directly above the statement it described
+			rest := strings.TrimSpace(output[idx+len(tt.comment):])
+			if !strings.HasPrefix(rest, tt.before) {
+				t.Errorf("Expected %q to be followed by %q\n%s", tt.comment, tt.before, output)
+			}
+		})
+	}
+
+	if !strings.Contains(output, "// inline error") {
+		t.Errorf("Expected inline comment to be preserved\n%s", output)
+	}
+	if strings.Contains(output, "interface {\n") {
+		t.Errorf("Expected injected empty interfaces to print on one line\n%s", output)
+	}
+}
+
+const constrainedSource = `//go:build linux && amd64
+// +build linux,amd64
+
+// Package demo only builds on linux/amd64.
+package demo
+
+func Foo(a int) int {
+	return a * 2
+}
+`
+
+func TestWriteFilePreservesBuildConstraints(t *testing.T) {
+	output := instrumentAndWrite(t, constrainedSource)
+
+	want := "//go:build linux && amd64\n// +build linux,amd64\n\n// Package demo only builds on linux/amd64.\npackage demo\n"
+	if !strings.HasPrefix(output, want) {
+		t.Fatalf("Expected output to start with the build constraints\n%s", output)
+	}
+	if !strings.Contains(output, "flowtrace.Enter") {
+		t.Errorf("Expected the file to be instrumented\n%s", output)
+	}
+}
+
+func TestRestoreBuildConstraints(t *testing.T) {
+	lines := []string{"//go:build linux", "// +build linux"}
+
+	kept := "//go:build linux\n// +build linux\n\npackage demo\n"
+	if got := string(restoreBuildConstraints([]byte(kept), lines)); got != kept {
+		t.Errorf("Expected constraints in place to be left alone, got\n%s", got)
+	}
+
+	dropped := "package demo\n\n//go:build linux\n"
+	want := "//go:build linux\n// +build linux\n\npackage demo\n\n//go:build linux\n"
+	if got := string(restoreBuildConstraints([]byte(dropped), lines)); got != want {
+		t.Errorf("Expected misplaced constraints to be restored above the package clause, got\n%s", got)
+	}
+}
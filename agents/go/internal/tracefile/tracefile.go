@@ -0,0 +1,65 @@
+// Package tracefile reads FlowTrace JSONL trace files and rebuilds the call
+// trees they describe.
+package tracefile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rixmerz/flowtrace-agent-go/traceio"
+)
+
+// SchemaVersion is the newest event format this package reads; it follows
+// flowtrace.SchemaVersion. Events without a version are read as version 1.
+const SchemaVersion = traceio.SchemaVersion
+
+// Event is a single trace record as written by the flowtrace package.
+// Args and Result are kept raw so both string and structured values load.
+type Event traceio.TraceEvent
+
+// Metadata is the service and process a trace was recorded by, carried by
+// the METADATA event starting each run of the agent
+type Metadata = traceio.Metadata
+
+// Duration returns the call duration recorded on an EXIT or EXCEPTION event
+func (e *Event) Duration() time.Duration {
+	if e.DurationNanos > 0 {
+		return time.Duration(e.DurationNanos)
+	}
+	if e.DurationMicros > 0 {
+		return time.Duration(e.DurationMicros) * time.Microsecond
+	}
+	return time.Duration(e.DurationMillis) * time.Millisecond
+}
+
+// ReadFile reads all events from a trace file, which may be gzip-compressed
+func ReadFile(path string) ([]Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Read(f)
+}
+
+// Read reads JSONL events from r with traceio, transparently decompressing
+// gzip input. Blank lines are skipped; malformed lines and events of a
+// schema version newer than SchemaVersion are reported with their number.
+func Read(r io.Reader) ([]Event, error) {
+	dec := traceio.NewDecoder(r)
+	var events []Event
+	for event := range dec.Events() {
+		events = append(events, Event(event))
+	}
+	if err := dec.Err(); err != nil {
+		if errors.Is(err, traceio.ErrUnsupportedVersion) {
+			return nil, fmt.Errorf("%w; upgrade flowctl", err)
+		}
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,191 @@
+package tracefile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sampleTrace = `{"event":"ENTER","timestamp":100,"class":"main","method":"Run","file":"/src/main.go","line":12,"args":"map[n:1]","thread":"goroutine-1","spanId":"a"}
+{"event":"ENTER","timestamp":110,"class":"main","method":"step","args":{"n":1},"thread":"goroutine-1","spanId":"b","parentSpanId":"a"}
+{"event":"EXIT","timestamp":150,"class":"main","method":"step","result":{"result_0":2},"durationMicros":40,"thread":"goroutine-1","spanId":"b","parentSpanId":"a"}
+{"event":"EXCEPTION","timestamp":300,"class":"main","method":"Run","exception":"panic: boom","durationMillis":0,"durationMicros":200,"thread":"goroutine-1","spanId":"a"}
+`
+
+func TestRead(t *testing.T) {
+	events, err := Read(strings.NewReader(sampleTrace + "\n\n"))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(events) != 4 {
+		t.Fatalf("Expected 4 events, got %d", len(events))
+	}
+	if events[2].Duration() != 40*time.Microsecond {
+		t.Errorf("Expected duration 40µs, got %v", events[2].Duration())
+	}
+}
+
+func TestEventDurationNanos(t *testing.T) {
+	event := Event{DurationMillis: 0, DurationMicros: 1, DurationNanos: 1500}
+	if event.Duration() != 1500*time.Nanosecond {
+		t.Errorf("Expected duration 1.5µs, got %v", event.Duration())
+	}
+}
+
+func TestReadGzip(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(sampleTrace))
+	gz.Close()
+
+	events, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if len(events) != 4 {
+		t.Errorf("Expected 4 events, got %d", len(events))
+	}
+}
+
+func TestReadMalformedLine(t *testing.T) {
+	_, err := Read(strings.NewReader(sampleTrace + "{not json}\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 5") {
+		t.Errorf("Expected error mentioning line 5, got %v", err)
+	}
+}
+
+func TestReadSchemaVersion(t *testing.T) {
+	current := fmt.Sprintf(`{"event":"ENTER","timestamp":100,"class":"main","method":"Run","thread":"goroutine-1","schemaVersion":%d}`+"\n", SchemaVersion)
+	events, err := Read(strings.NewReader(sampleTrace + current))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	// sampleTrace predates the field
+	if events[0].SchemaVersion != 1 || events[4].SchemaVersion != SchemaVersion {
+		t.Errorf("Expected versions 1 and %d, got %d and %d", SchemaVersion, events[0].SchemaVersion, events[4].SchemaVersion)
+	}
+
+	newer := fmt.Sprintf(`{"event":"ENTER","timestamp":100,"class":"main","method":"Run","thread":"goroutine-1","schemaVersion":%d}`+"\n", SchemaVersion+1)
+	_, err = Read(strings.NewReader(sampleTrace + newer))
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("line 5: unsupported schema version %d", SchemaVersion+1)) || !strings.Contains(err.Error(), "upgrade flowctl") {
+		t.Errorf("Expected a newer version to be rejected on line 5, got %v", err)
+	}
+}
+
+func TestReadMetadata(t *testing.T) {
+	metadata := `{"event":"METADATA","timestamp":90,"thread":"goroutine-1","schemaVersion":6,"metadata":{"serviceName":"shop","environment":"prod","hostname":"web-1","pid":42}}` + "\n"
+	events, err := Read(strings.NewReader(metadata + sampleTrace))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	m := events[0].Metadata
+	if m == nil || m.ServiceName != "shop" || m.Environment != "prod" || m.Hostname != "web-1" || m.PID != 42 {
+		t.Errorf("Expected the service metadata to be read, got %+v", m)
+	}
+	if events[1].Metadata != nil {
+		t.Errorf("Expected no metadata on call events, got %+v", events[1].Metadata)
+	}
+}
+
+func TestBuildTree(t *testing.T) {
+	events, err := Read(strings.NewReader(sampleTrace))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	tree := BuildTree(events)
+	roots := tree.Roots["goroutine-1"]
+	if len(roots) != 1 {
+		t.Fatalf("Expected 1 root, got %d", len(roots))
+	}
+
+	run := roots[0]
+	if run.Name() != "main.Run" || run.Exception != "panic: boom" || run.Duration != 200*time.Microsecond {
+		t.Errorf("Unexpected root call: %+v", run)
+	}
+	if len(run.Children) != 1 {
+		t.Fatalf("Expected 1 child, got %d", len(run.Children))
+	}
+
+	step := run.Children[0]
+	if step.Args != `{"n":1}` || step.Result != `{"result_0":2}` {
+		t.Errorf("Expected structured args and result, got %q and %q", step.Args, step.Result)
+	}
+	if run.File != "/src/main.go" || run.Line != 12 {
+		t.Errorf("Expected location /src/main.go:12, got %s:%d", run.File, run.Line)
+	}
+	if run.Args != "map[n:1]" {
+		t.Errorf("Expected string args to be unquoted, got %q", run.Args)
+	}
+}
+
+func TestBuildTreeUnbalanced(t *testing.T) {
+	events := []Event{
+		{Event: "ENTER", Class: "main", Method: "outer", Thread: "goroutine-1", Timestamp: 10},
+		{Event: "ENTER", Class: "main", Method: "inner", Thread: "goroutine-1", Timestamp: 20},
+		{Event: "EXIT", Class: "main", Method: "outer", Thread: "goroutine-1", Timestamp: 50, DurationMicros: 40},
+		{Event: "EXIT", Class: "main", Method: "orphan", Thread: "goroutine-2", Timestamp: 90, DurationMicros: 30},
+		{Event: "ENTER", Class: "main", Method: "crashed", Thread: "goroutine-2", Timestamp: 100},
+	}
+
+	tree := BuildTree(events)
+
+	if len(tree.Threads) != 2 || tree.Threads[0] != "goroutine-1" {
+		t.Fatalf("Expected threads in order of appearance, got %v", tree.Threads)
+	}
+
+	outer := tree.Roots["goroutine-1"][0]
+	if outer.Unbalanced() {
+		t.Error("Expected outer to be balanced")
+	}
+	if !outer.Children[0].MissingExit {
+		t.Error("Expected inner to be flagged as missing EXIT")
+	}
+
+	roots := tree.Roots["goroutine-2"]
+	if len(roots) != 2 {
+		t.Fatalf("Expected 2 roots on goroutine-2, got %d", len(roots))
+	}
+	if !roots[0].MissingEnter || roots[0].Start != 60 {
+		t.Errorf("Expected orphan exit flagged as missing ENTER starting at 60, got %+v", roots[0])
+	}
+	if !roots[1].MissingExit {
+		t.Error("Expected crashed call to be flagged as missing EXIT")
+	}
+}
+
+func TestBuildTreeTruncatedExit(t *testing.T) {
+	events := []Event{
+		{Event: "ENTER", Class: "main", Method: "serve", Thread: "goroutine-1", SpanID: "a", Timestamp: 10},
+		{Event: "EXIT", Class: "main", Method: "serve", Thread: "goroutine-1", SpanID: "a", Timestamp: 90, DurationMicros: 80, Truncated: true},
+	}
+
+	serve := BuildTree(events).Roots["goroutine-1"][0]
+	if !serve.MissingExit {
+		t.Error("Expected a truncated EXIT to flag the call as missing its exit")
+	}
+	if serve.Duration != 80*time.Microsecond {
+		t.Errorf("Expected the duration up to Stop, got %v", serve.Duration)
+	}
+}
+
+func TestBuildTreeReturnedError(t *testing.T) {
+	trace := `{"event":"ENTER","timestamp":100,"class":"main","method":"divide","args":{"a":10,"b":0},"thread":"goroutine-1"}
+{"event":"EXIT","timestamp":120,"class":"main","method":"divide","result":{"result_0":0,"result_1":{}},"exception":"division by zero","isError":true,"durationMicros":20,"thread":"goroutine-1"}
+`
+	events, err := Read(strings.NewReader(trace))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	divide := BuildTree(events).Roots["goroutine-1"][0]
+	if divide.Error != "division by zero" || divide.Exception != "" {
+		t.Errorf("Expected returned error without exception, got error %q and exception %q", divide.Error, divide.Exception)
+	}
+	if divide.Result == "" {
+		t.Error("Expected the result to be kept alongside the error")
+	}
+}
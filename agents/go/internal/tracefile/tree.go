@@ -0,0 +1,203 @@
+package tracefile
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Call is a single function invocation rebuilt from its ENTER and EXIT or
+// EXCEPTION events
+type Call struct {
+	Class     string
+	Method    string
+	Thread    string
+	SpanID    string
+	File      string
+	Line      int
+	Args      string
+	Result    string
+	Exception string
+	// Error is the error the call returned, from an EXIT event with
+	// isError set
+	Error string
+	// ParentSpanID is the span of the caller, which may have run on
+	// another goroutine
+	ParentSpanID string
+	// Start is the entry time in Unix microseconds, or nanoseconds for a
+	// trace written with the nanos time unit
+	Start    int64
+	Duration time.Duration
+	Children []*Call
+
+	// MissingExit is set when no EXIT or EXCEPTION closed the call, e.g.
+	// because the program crashed or the trace was cut short, or when the
+	// tracer closed it with a truncated EXIT at Stop
+	MissingExit bool
+	// MissingEnter is set for an EXIT or EXCEPTION without a matching ENTER
+	MissingEnter bool
+}
+
+// Name returns the qualified function name, e.g. "main.LoadUser"
+func (c *Call) Name() string {
+	if c.Class == "" {
+		return c.Method
+	}
+	return c.Class + "." + c.Method
+}
+
+// Unbalanced reports whether the call is missing its ENTER or its exit event
+func (c *Call) Unbalanced() bool {
+	return c.MissingExit || c.MissingEnter
+}
+
+// Walk calls fn for c and every descendant in depth-first order
+func (c *Call) Walk(fn func(call *Call, depth int)) {
+	c.walk(fn, 0)
+}
+
+func (c *Call) walk(fn func(call *Call, depth int), depth int) {
+	fn(c, depth)
+	for _, child := range c.Children {
+		child.walk(fn, depth+1)
+	}
+}
+
+// Tree holds the call trees of all goroutines in a trace
+type Tree struct {
+	// Threads lists goroutines in order of their first event
+	Threads []string
+	// Roots holds the top-level calls of each goroutine
+	Roots map[string][]*Call
+}
+
+// Walk calls fn for every call of every goroutine in depth-first order
+func (t *Tree) Walk(fn func(call *Call, depth int)) {
+	for _, thread := range t.Threads {
+		for _, root := range t.Roots[thread] {
+			root.Walk(fn)
+		}
+	}
+}
+
+// BuildTree matches ENTER events with their EXIT or EXCEPTION events per
+// goroutine and nests calls under their callers. Exit events are matched by
+// span ID when present and by function name otherwise; calls left open
+// or closed without an ENTER are flagged rather than dropped.
+func BuildTree(events []Event) *Tree {
+	tree := &Tree{Roots: make(map[string][]*Call)}
+	stacks := make(map[string][]*Call)
+
+	attach := func(thread string, call *Call) {
+		if _, seen := tree.Roots[thread]; !seen {
+			tree.Threads = append(tree.Threads, thread)
+			tree.Roots[thread] = nil
+		}
+		stack := stacks[thread]
+		if len(stack) == 0 {
+			tree.Roots[thread] = append(tree.Roots[thread], call)
+			return
+		}
+		parent := stack[len(stack)-1]
+		parent.Children = append(parent.Children, call)
+	}
+
+	for i := range events {
+		event := &events[i]
+		switch event.Event {
+		case "ENTER":
+			call := &Call{
+				Class:        event.Class,
+				Method:       event.Method,
+				Thread:       event.Thread,
+				SpanID:       event.SpanID,
+				ParentSpanID: event.ParentSpanID,
+				File:         event.File,
+				Line:         event.Line,
+				Args:         rawString(event.Args),
+				Start:        event.Timestamp,
+			}
+			attach(event.Thread, call)
+			stacks[event.Thread] = append(stacks[event.Thread], call)
+
+		case "EXIT", "EXCEPTION":
+			stack := stacks[event.Thread]
+			idx := matchFrame(stack, event)
+			var call *Call
+			if idx < 0 {
+				call = &Call{
+					Class:        event.Class,
+					Method:       event.Method,
+					Thread:       event.Thread,
+					SpanID:       event.SpanID,
+					ParentSpanID: event.ParentSpanID,
+					Start:        event.Timestamp - timestampDuration(event),
+					MissingEnter: true,
+				}
+				attach(event.Thread, call)
+			} else {
+				// Frames above the match never saw their exit event
+				for _, open := range stack[idx+1:] {
+					open.MissingExit = true
+				}
+				call = stack[idx]
+				stacks[event.Thread] = stack[:idx]
+			}
+			call.Duration = event.Duration()
+			if event.Event == "EXCEPTION" {
+				call.Exception = event.Exception
+			} else {
+				call.Result = rawString(event.Result)
+				if event.IsError {
+					call.Error = event.Exception
+				}
+				call.MissingExit = event.Truncated
+			}
+		}
+	}
+
+	for _, stack := range stacks {
+		for _, open := range stack {
+			open.MissingExit = true
+		}
+	}
+
+	return tree
+}
+
+// matchFrame returns the index of the stack frame closed by event, or -1
+func matchFrame(stack []*Call, event *Event) int {
+	for i := len(stack) - 1; i >= 0; i-- {
+		frame := stack[i]
+		if event.SpanID != "" && frame.SpanID != "" {
+			if frame.SpanID == event.SpanID {
+				return i
+			}
+			continue
+		}
+		if frame.Class == event.Class && frame.Method == event.Method {
+			return i
+		}
+	}
+	return -1
+}
+
+// rawString returns a JSON string value unquoted and any other value as is
+func rawString(raw []byte) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
+
+// timestampDuration returns the duration of an EXIT or EXCEPTION event in
+// the unit of its timestamp; only nanosecond traces record durationNanos
+func timestampDuration(event *Event) int64 {
+	if event.DurationNanos > 0 {
+		return event.DurationNanos
+	}
+	return event.Duration().Microseconds()
+}
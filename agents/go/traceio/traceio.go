@@ -0,0 +1,122 @@
+// Package traceio reads and writes FlowTrace JSONL trace files, for tools
+// consuming traces without re-deriving their format. Every line of a trace
+// is one TraceEvent, as described by the JSON Schema in Schema.
+package traceio
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+
+	"github.com/rixmerz/flowtrace-agent-go/flowtrace"
+)
+
+// TraceEvent is a single trace record, as written by the flowtrace package
+type TraceEvent = flowtrace.TraceEvent
+
+// Metadata is the service and process carried by a METADATA event
+type Metadata = flowtrace.Metadata
+
+// SchemaVersion is the newest event format this package reads and the one
+// it writes. Events without a version are read as version 1.
+const SchemaVersion = flowtrace.SchemaVersion
+
+// Schema is the JSON Schema of a trace line of format SchemaVersion
+//
+//go:embed schema.json
+var Schema []byte
+
+// ErrUnsupportedVersion is reported for an event of a schema version newer
+// than SchemaVersion, which a newer release of this package reads
+var ErrUnsupportedVersion = errors.New("unsupported schema version")
+
+// maxLineSize bounds a trace line, as big arguments make for long lines
+const maxLineSize = 64 << 20
+
+// Decoder reads the events of a trace, transparently decompressing gzip
+// input. Blank lines are skipped.
+type Decoder struct {
+	r   io.Reader
+	err error
+}
+
+// NewDecoder returns a decoder reading events from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// Events returns the events of the trace in order. The sequence stops at
+// the first malformed line or event of a schema version newer than
+// SchemaVersion, which Err then reports with its line number. It can be
+// ranged over once.
+func (d *Decoder) Events() iter.Seq[TraceEvent] {
+	return func(yield func(TraceEvent) bool) {
+		br := bufio.NewReader(d.r)
+		if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+			gz, err := gzip.NewReader(br)
+			if err != nil {
+				d.err = fmt.Errorf("failed to open gzip stream: %w", err)
+				return
+			}
+			defer gz.Close()
+			br = bufio.NewReader(gz)
+		}
+
+		scanner := bufio.NewScanner(br)
+		scanner.Buffer(nil, maxLineSize)
+		for lineNum := 1; scanner.Scan(); lineNum++ {
+			line := scanner.Bytes()
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var event TraceEvent
+			if err := json.Unmarshal(line, &event); err != nil {
+				d.err = fmt.Errorf("line %d: %w", lineNum, err)
+				return
+			}
+			if event.SchemaVersion == 0 {
+				// Written before events carried their version
+				event.SchemaVersion = 1
+			}
+			if event.SchemaVersion > SchemaVersion {
+				d.err = fmt.Errorf("line %d: %w %d, this reader supports up to %d", lineNum, ErrUnsupportedVersion, event.SchemaVersion, SchemaVersion)
+				return
+			}
+			if !yield(event) {
+				return
+			}
+		}
+		d.err = scanner.Err()
+	}
+}
+
+// Err returns the error that stopped Events, or nil at the end of the trace
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Decode returns the events read from r; see Decoder.Events. A malformed
+// trace ends the sequence early; use a Decoder to tell it from the end.
+func Decode(r io.Reader) iter.Seq[TraceEvent] {
+	return NewDecoder(r).Events()
+}
+
+// Encode writes event to w as a trace line. An event without a schema
+// version is written with SchemaVersion.
+func Encode(w io.Writer, event TraceEvent) error {
+	if event.SchemaVersion == 0 {
+		event.SchemaVersion = SchemaVersion
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
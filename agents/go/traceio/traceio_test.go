@@ -0,0 +1,261 @@
+package traceio
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rixmerz/flowtrace-agent-go/flowtrace"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// readFixture returns the contents of testdata/trace.jsonl
+func readFixture(t *testing.T) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", "trace.jsonl"))
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+	return data
+}
+
+// decodeAll returns the events of data and the error that stopped them
+func decodeAll(data []byte) ([]TraceEvent, error) {
+	d := NewDecoder(bytes.NewReader(data))
+	var events []TraceEvent
+	for event := range d.Events() {
+		events = append(events, event)
+	}
+	return events, d.Err()
+}
+
+func TestDecodeFixture(t *testing.T) {
+	events, err := decodeAll(readFixture(t))
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	var kinds []string
+	for _, event := range events {
+		kinds = append(kinds, event.Event)
+	}
+	want := "METADATA,ENTER,CAPTURE,GO_SPAWN,LOG,ENTER,EXCEPTION,EXIT"
+	if strings.Join(kinds, ",") != want {
+		t.Fatalf("Expected events %s, got %s", want, strings.Join(kinds, ","))
+	}
+
+	if m := events[0].Metadata; m == nil || m.ServiceName != "shop" || m.PID != 4242 {
+		t.Errorf("Expected the service metadata, got %+v", m)
+	}
+	exit := events[7]
+	if !exit.IsError || exit.DurationMicros != 2000 || string(exit.Tags) != `{"user_id":42}` || exit.ResultNames[1] != "err" {
+		t.Errorf("Expected the EXIT fields to be decoded, got %+v", exit)
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	events, err := decodeAll(readFixture(t))
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	for _, event := range events {
+		if err := Encode(&buf, event); err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+	}
+	if !bytes.Equal(buf.Bytes(), readFixture(t)) {
+		t.Errorf("Expected the fixture to be encoded as it was written, got\n%s", buf.Bytes())
+	}
+
+	decoded, err := decodeAll(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Decode of encoded events failed: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, events) {
+		t.Errorf("Expected the events to round-trip, got %+v", decoded)
+	}
+}
+
+func TestEncodeSetsSchemaVersion(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, TraceEvent{Event: "ENTER", Method: "main"}); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	want := fmt.Sprintf(`"schemaVersion":%d}`+"\n", SchemaVersion)
+	if !strings.HasSuffix(buf.String(), want) {
+		t.Errorf("Expected the current schema version, got %s", buf.String())
+	}
+}
+
+func TestDecodeGzip(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(readFixture(t))
+	gz.Close()
+
+	events, err := decodeAll(buf.Bytes())
+	if err != nil || len(events) != 8 {
+		t.Errorf("Expected 8 events from compressed input, got %d: %v", len(events), err)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		trace   string
+		events  int
+		wantErr string
+	}{
+		{name: "version 1", trace: `{"event":"ENTER","timestamp":1,"method":"A"}` + "\n\n", events: 1},
+		{name: "malformed line", trace: `{"event":"ENTER"}` + "\n" + `{"event":` + "\n", events: 1, wantErr: "line 2:"},
+		{name: "newer version", trace: fmt.Sprintf(`{"event":"ENTER","schemaVersion":%d}`, SchemaVersion+1), wantErr: "line 1: unsupported schema version"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := decodeAll([]byte(tt.trace))
+			if len(events) != tt.events {
+				t.Errorf("Expected %d events, got %d", tt.events, len(events))
+			}
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Expected error %q, got %v", tt.wantErr, err)
+			}
+			if newer := tt.name == "newer version"; errors.Is(err, ErrUnsupportedVersion) != newer {
+				t.Errorf("Expected ErrUnsupportedVersion only for a newer version, got %v", err)
+			}
+			for _, event := range events {
+				if event.SchemaVersion != 1 {
+					t.Errorf("Expected an unversioned event to be version 1, got %d", event.SchemaVersion)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeStopsEarly(t *testing.T) {
+	count := 0
+	for range Decode(bytes.NewReader(readFixture(t))) {
+		count++
+		if count == 2 {
+			break
+		}
+	}
+	if count != 2 {
+		t.Errorf("Expected to stop after 2 events, got %d", count)
+	}
+}
+
+// compileSchema compiles Schema
+func compileSchema(t *testing.T) *jsonschema.Schema {
+	t.Helper()
+
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(Schema))
+	if err != nil {
+		t.Fatalf("Invalid schema JSON: %v", err)
+	}
+	c := jsonschema.NewCompiler()
+	if err := c.AddResource("schema.json", doc); err != nil {
+		t.Fatalf("AddResource failed: %v", err)
+	}
+	schema, err := c.Compile("schema.json")
+	if err != nil {
+		t.Fatalf("Invalid schema: %v", err)
+	}
+	return schema
+}
+
+// validateLines validates every line of a trace against schema
+func validateLines(t *testing.T, schema *jsonschema.Schema, data []byte) int {
+	t.Helper()
+
+	lines := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		lines++
+		instance, err := jsonschema.UnmarshalJSON(bytes.NewReader(scanner.Bytes()))
+		if err != nil {
+			t.Fatalf("Line %d: %v", lines, err)
+		}
+		if err := schema.Validate(instance); err != nil {
+			t.Errorf("Line %d does not match the schema: %v\n%s", lines, err, scanner.Bytes())
+		}
+	}
+	return lines
+}
+
+func TestSchemaValidatesFixture(t *testing.T) {
+	validateLines(t, compileSchema(t), readFixture(t))
+}
+
+func TestSchemaValidatesTracerOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := flowtrace.Start(flowtrace.Config{LogFile: path, ServiceName: "shop"}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	outer := flowtrace.Enter("example.com/shop", "PlaceOrder", map[string]interface{}{"id": 42})
+	outer.Capture("total", 9.99)
+	flowtrace.Tag("order_id", 42)
+	ch := make(chan int, 1)
+	flowtrace.Send(ch, 42)
+	flowtrace.Recv(ch)
+	inner := flowtrace.Enter("example.com/shop", "Charge", nil)
+	inner.ExceptionString("panic: declined")
+	outer.SetError(fmt.Errorf("declined"))
+	outer.Exit(func() interface{} { return flowtrace.Results{{Name: "err", Value: "declined"}} })
+	flowtrace.Enter("example.com/shop", "Never", nil)
+	if err := flowtrace.Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read trace: %v", err)
+	}
+	if lines := validateLines(t, compileSchema(t), data); lines < 6 {
+		t.Errorf("Expected the trace to be written, got %d lines", lines)
+	}
+}
+
+func TestSchemaFollowsSchemaVersion(t *testing.T) {
+	var schema struct {
+		Properties struct {
+			SchemaVersion struct {
+				Maximum int `json:"maximum"`
+			} `json:"schemaVersion"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(Schema, &schema); err != nil {
+		t.Fatalf("Invalid schema JSON: %v", err)
+	}
+	if schema.Properties.SchemaVersion.Maximum != SchemaVersion {
+		t.Errorf("Expected the schema to describe version %d, got %d", SchemaVersion, schema.Properties.SchemaVersion.Maximum)
+	}
+}
+
+func TestSchemaRejectsInvalidEvents(t *testing.T) {
+	schema := compileSchema(t)
+	invalid := []string{
+		`{"timestamp":1,"class":"","method":"","durationMillis":0,"durationMicros":0,"thread":""}`,
+		`{"event":"START","timestamp":1,"class":"","method":"","durationMillis":0,"durationMicros":0,"thread":""}`,
+		`{"event":"ENTER","timestamp":"1","class":"","method":"","durationMillis":0,"durationMicros":0,"thread":""}`,
+		`{"event":"ENTER","timestamp":1,"class":"","method":"","durationMillis":0,"durationMicros":0,"thread":"","spanId":"xyz"}`,
+		`{"event":"ENTER","timestamp":1,"class":"","method":"","durationMillis":0,"durationMicros":0,"thread":"","unknown":true}`,
+	}
+	for _, line := range invalid {
+		instance, _ := jsonschema.UnmarshalJSON(strings.NewReader(line))
+		if schema.Validate(instance) == nil {
+			t.Errorf("Expected %s to be rejected", line)
+		}
+	}
+}